@@ -0,0 +1,26 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+)
+
+var errAdminDisabled = errors.New("admin API is disabled, set ADMIN_API_KEY to enable it")
+
+func (cfg *apiConfig) authorizeAdmin(headers http.Header) error {
+	if cfg.adminAPIKey == "" {
+		return errAdminDisabled
+	}
+
+	apiKey, err := auth.GetAPIKey(headers)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(apiKey), []byte(cfg.adminAPIKey)) != 1 {
+		return errors.New("invalid admin API key")
+	}
+	return nil
+}
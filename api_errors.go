@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+
+	"github.com/google/uuid"
+)
+
+// apiErrorCode identifies the kind of an API error. Codes are part of the
+// API, once published they must keep their meaning.
+type apiErrorCode string
+
+const (
+	errCodeInternal             apiErrorCode = "INTERNAL"
+	errCodeUnavailable          apiErrorCode = "UNAVAILABLE"
+	errCodeUpstreamFailed       apiErrorCode = "UPSTREAM_FAILED"
+	errCodeNotImplemented       apiErrorCode = "NOT_IMPLEMENTED"
+	errCodeMalformedRequest     apiErrorCode = "MALFORMED_REQUEST"
+	errCodeValidationFailed     apiErrorCode = "VALIDATION_FAILED"
+	errCodeInvalidID            apiErrorCode = "INVALID_ID"
+	errCodeUnsupportedMediaType apiErrorCode = "UNSUPPORTED_MEDIA_TYPE"
+	errCodePayloadTooLarge      apiErrorCode = "PAYLOAD_TOO_LARGE"
+	errCodeChecksumMismatch     apiErrorCode = "CHECKSUM_MISMATCH"
+	errCodeEmptyUpload          apiErrorCode = "EMPTY_UPLOAD"
+	errCodeIncompleteUpload     apiErrorCode = "INCOMPLETE_UPLOAD"
+	errCodeUnauthenticated      apiErrorCode = "UNAUTHENTICATED"
+	errCodeInvalidCredentials   apiErrorCode = "INVALID_CREDENTIALS"
+	errCodeForbidden            apiErrorCode = "FORBIDDEN"
+	errCodeNotFound             apiErrorCode = "NOT_FOUND"
+	errCodeConflict             apiErrorCode = "CONFLICT"
+	errCodeCapacityExceeded     apiErrorCode = "CAPACITY_EXCEEDED"
+	errCodeQuotaExceeded        apiErrorCode = "QUOTA_EXCEEDED"
+	errCodeRateLimited          apiErrorCode = "RATE_LIMITED"
+	errCodeInsufficientScope    apiErrorCode = "INSUFFICIENT_SCOPE"
+
+	errCodeVideoNotFound           apiErrorCode = "VIDEO_NOT_FOUND"
+	errCodeVideoFileMissing        apiErrorCode = "VIDEO_FILE_MISSING"
+	errCodeUserNotFound            apiErrorCode = "USER_NOT_FOUND"
+	errCodeOrganizationNotFound    apiErrorCode = "ORGANIZATION_NOT_FOUND"
+	errCodeJobNotFound             apiErrorCode = "JOB_NOT_FOUND"
+	errCodeLiveStreamNotFound      apiErrorCode = "LIVE_STREAM_NOT_FOUND"
+	errCodeUploadSessionNotFound   apiErrorCode = "UPLOAD_SESSION_NOT_FOUND"
+	errCodeUploadSessionExpired    apiErrorCode = "UPLOAD_SESSION_EXPIRED"
+	errCodeInvalidStreamKey        apiErrorCode = "INVALID_STREAM_KEY"
+	errCodeInvalidTranscodeProfile apiErrorCode = "INVALID_TRANSCODE_PROFILE"
+	errCodeRestoreWindowPassed     apiErrorCode = "RESTORE_WINDOW_PASSED"
+	errCodeAgeConfirmationRequired apiErrorCode = "AGE_CONFIRMATION_REQUIRED"
+	errCodeGeoBlocked              apiErrorCode = "GEO_BLOCKED"
+	errCodeDomainNotVerified       apiErrorCode = "DOMAIN_NOT_VERIFIED"
+	errCodeInvalidMedia            apiErrorCode = "INVALID_MEDIA"
+	errCodeInvalidPlaybackToken    apiErrorCode = "INVALID_PLAYBACK_TOKEN"
+	errCodeStreamLimitReached      apiErrorCode = "STREAM_LIMIT_REACHED"
+	errCodeTwoFactorRequired       apiErrorCode = "TWO_FACTOR_REQUIRED"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// clients may pick their own request IDs to correlate logs, anything odd is
+// replaced so it can't be used to forge log lines
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestIDMiddleware tags every request with an ID that is echoed in the
+// response headers and error bodies.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !requestIDRegexp.MatchString(requestID) {
+			requestID = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+		next.ServeHTTP(w, r)
+	})
+}
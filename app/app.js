@@ -36,7 +36,7 @@ async function createVideoDraft() {
     });
     const data = await res.json();
     if (!res.ok) {
-      throw new Error(`Failed to create video draft: ${data.error}`);
+      throw new Error(`Failed to create video draft: ${data.message}`);
     }
 
     const videoID = data.id;
@@ -63,7 +63,7 @@ async function login() {
     });
     const data = await res.json();
     if (!res.ok) {
-      throw new Error(`Failed to login: ${data.error}`);
+      throw new Error(`Failed to login: ${data.message}`);
     }
 
     if (data.token) {
@@ -93,7 +93,7 @@ async function signup() {
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to create user: ${data.error}`);
+      throw new Error(`Failed to create user: ${data.message}`);
     }
     console.log('User created!');
     await login();
@@ -139,7 +139,7 @@ async function uploadThumbnail(videoID) {
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to upload thumbnail. Error: ${data.error}`);
+      throw new Error(`Failed to upload thumbnail. Error: ${data.message}`);
     }
 
     await res.json();
@@ -172,7 +172,7 @@ async function uploadVideoFile(videoID) {
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to upload video file. Error: ${data.error}`);
+      throw new Error(`Failed to upload video file. Error: ${data.message}`);
     }
 
     console.log('Video uploaded!');
@@ -196,7 +196,7 @@ async function getVideos() {
     });
     if (!res.ok) {
       const data = await res.json();
-      throw new Error(`Failed to get videos. Error: ${data.error}`);
+      throw new Error(`Failed to get videos. Error: ${data.message}`);
     }
 
     const videos = await res.json();
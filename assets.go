@@ -1,7 +1,11 @@
 package main
 
 import (
+	"net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
 )
 
 func (cfg apiConfig) ensureAssetsDir() error {
@@ -10,3 +14,17 @@ func (cfg apiConfig) ensureAssetsDir() error {
 	}
 	return nil
 }
+
+// assetPathFromURL maps a URL served by the /assets/ handler back to the
+// file on disk.
+func (cfg apiConfig) assetPathFromURL(assetURL string) (string, bool) {
+	u, err := url.Parse(assetURL)
+	if err != nil {
+		return "", false
+	}
+	name, ok := strings.CutPrefix(u.Path, "/assets/")
+	if !ok || name == "" {
+		return "", false
+	}
+	return filepath.Join(cfg.assetsRoot, path.Clean("/"+name)), true
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	maxAudioTrackBytes       = 1 << 30
+	maxAudioTrackLabelLength = 100
+)
+
+// BCP 47 tags as players use them: a primary language, optionally followed
+// by script or region subtags
+var audioTrackLanguagePattern = regexp.MustCompile(`^[a-z]{2,3}(-[A-Za-z0-9]{2,8})*$`)
+
+// audioTrackPlayback is how players learn about a video's alternate audio.
+// URL is the whole track for players that don't use the HLS rendition.
+type audioTrackPlayback struct {
+	Language string `json:"language"`
+	Label    string `json:"label"`
+	URL      string `json:"url"`
+}
+
+func (cfg *apiConfig) audioTrackPlayback(tracks []database.AudioTrack, domain string) []audioTrackPlayback {
+	playback := make([]audioTrackPlayback, 0, len(tracks))
+	for _, track := range tracks {
+		playback = append(playback, audioTrackPlayback{
+			Language: track.Language,
+			Label:    track.Label,
+			URL:      cfg.withPlaybackDomain(cfg.objectURL(track.S3Key), domain),
+		})
+	}
+	return playback
+}
+
+// handlerVideoAudioTrackUpload adds an audio track in the language from the
+// "audio" form file, replacing the video's earlier track in it. Any file
+// ffmpeg can read audio from works, it's stored as AAC. The optional label
+// query parameter names the track in players and defaults to the language.
+func (cfg *apiConfig) handlerVideoAudioTrackUpload(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+	language := r.PathValue("language")
+	if !audioTrackLanguagePattern.MatchString(language) {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Language must be a BCP 47 tag like en or pt-BR", nil)
+		return
+	}
+	label := strings.TrimSpace(r.URL.Query().Get("label"))
+	if label == "" {
+		label = language
+	}
+	if len(label) > maxAudioTrackLabelLength || strings.ContainsAny(label, "\"\r\n") {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("Labels are at most %d characters without quotes or line breaks", maxAudioTrackLabelLength), nil)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this video", nil)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxAudioTrackBytes+64<<10)
+	part, err := streamFormFile(r, "audio")
+	if err != nil {
+		if isMaxBytesError(err) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, errCodePayloadTooLarge, "Audio track is too large", err)
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't parse audio", err)
+		return
+	}
+	defer part.Close()
+
+	tempFile, err := os.CreateTemp("", "tubely-audio")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create temp file", err)
+		return
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	written, err := io.Copy(tempFile, part)
+	if isMaxBytesError(err) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, errCodePayloadTooLarge, "Audio track is too large", err)
+		return
+	}
+	if err := checkPartReceived(part, written, err); err != nil {
+		respondWithUploadError(w, "Audio track", err)
+		return
+	}
+
+	streams, err := probeStreams(r.Context(), tempFile.Name())
+	if err != nil || !slices.ContainsFunc(streams.Streams, func(s Stream) bool { return s.CodecType == "audio" }) {
+		respondWithError(w, http.StatusBadRequest, errCodeUnsupportedMediaType, "Couldn't find any audio in the file", err)
+		return
+	}
+
+	processedPath := tempFile.Name() + ".m4a"
+	err = transcodeAudioTrack(r.Context(), tempFile.Name(), processedPath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't process audio track", err)
+		return
+	}
+	defer os.Remove(processedPath)
+
+	processed, err := os.Open(processedPath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't open processed audio track", err)
+		return
+	}
+	defer processed.Close()
+
+	enc, err := cfg.objectEncryptionForUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get encryption settings", err)
+		return
+	}
+	tags, err := cfg.objectTagsForUser(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get organization", err)
+		return
+	}
+	key := fmt.Sprintf("audio/%s/%s-%s.m4a", video.ID, language, uuid.New())
+	_, err = cfg.putFileObject(r.Context(), key, "audio/mp4", processed, enc, tags)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't upload audio track", err)
+		return
+	}
+
+	track, previous, err := cfg.db.PutAudioTrack(video.ID, language, label, key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save audio track", err)
+		return
+	}
+	if previous != nil {
+		cfg.removeAudioTrackObject(r.Context(), *previous)
+	}
+	if video.VideoURL != nil {
+		cfg.requestHLSPackaging(video.ID)
+	}
+
+	respondWithJSON(w, http.StatusOK, track)
+}
+
+func (cfg *apiConfig) handlerVideoAudioTracksRetrieve(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this video", nil)
+		return
+	}
+
+	tracks, err := cfg.db.GetAudioTracks(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get audio tracks", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, tracks)
+}
+
+func (cfg *apiConfig) handlerVideoAudioTrackDelete(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this video", nil)
+		return
+	}
+
+	track, err := cfg.db.GetAudioTrack(video.ID, r.PathValue("language"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get audio track", err)
+		return
+	}
+	if track.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "The video has no audio track in this language", nil)
+		return
+	}
+
+	err = cfg.db.DeleteAudioTrack(track.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't delete audio track", err)
+		return
+	}
+	cfg.removeAudioTrackObject(r.Context(), track.S3Key)
+	if video.VideoURL != nil {
+		cfg.requestHLSPackaging(video.ID)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeAudioTrackObject deletes a replaced or removed track. The HLS
+// rendition keeps its own copy until it's packaged again.
+func (cfg *apiConfig) removeAudioTrackObject(ctx context.Context, key string) {
+	if err := cfg.deleteObject(ctx, key); err != nil {
+		log.Printf("Couldn't delete audio track %s: %v", key, err)
+	}
+}
+
+// transcodeAudioTrack stores the first audio stream as stereo AAC, which the
+// HLS rendition can take without re-encoding.
+func transcodeAudioTrack(ctx context.Context, input, outPath string) error {
+	cmd := ffmpegRunner.Command(ctx, "ffmpeg",
+		"-y",
+		"-i", input,
+		"-map", "0:a:0",
+		"-vn",
+		"-c:a", "aac",
+		"-b:a", "192k",
+		"-ar", "48000",
+		"-ac", "2",
+		"-movflags", "+faststart",
+		outPath,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return newCommandError("ffmpeg", err, stderr.Bytes())
+	}
+	return nil
+}
+
+// packageAudioTracks adds the video's audio tracks to an HLS rendition in
+// outDir as alternate audio renditions, encrypted with the video's keys, and
+// writes master.m3u8 offering them next to index.m3u8. The video's own audio
+// stays muxed into its segments. It returns the keys, with any new ones the
+// tracks needed, and the playlist players should load.
+func (cfg *apiConfig) packageAudioTracks(ctx context.Context, video database.Video, srcPath, outDir string, keys [][]byte) ([][]byte, string, error) {
+	tracks, err := cfg.db.GetAudioTracks(video.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(tracks) == 0 {
+		return keys, "index.m3u8", nil
+	}
+
+	var master strings.Builder
+	master.WriteString("#EXTM3U\n#EXT-X-VERSION:3\n")
+	master.WriteString("#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"Original\",DEFAULT=YES,AUTOSELECT=YES\n")
+	for _, track := range tracks {
+		trackPath := filepath.Join(filepath.Dir(outDir), "audio-"+track.Language+".m4a")
+		file, err := os.Create(trackPath)
+		if err != nil {
+			return nil, "", err
+		}
+		err = cfg.downloadObject(ctx, track.S3Key, file)
+		file.Close()
+		if err != nil {
+			return nil, "", fmt.Errorf("couldn't download audio track %s: %w", track.S3Key, err)
+		}
+
+		trackDir := filepath.Join(outDir, "audio", track.Language)
+		err = segmentHLS(ctx, trackPath, trackDir, "-c", "copy")
+		if err != nil {
+			return nil, "", withStage("audio_tracks", err)
+		}
+		keys, err = cfg.encryptHLS(trackDir, video.ID, keys)
+		if err != nil {
+			return nil, "", err
+		}
+
+		fmt.Fprintf(&master, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",LANGUAGE=\"%s\",NAME=\"%s\",DEFAULT=NO,AUTOSELECT=YES,URI=\"audio/%s/index.m3u8\"\n",
+			track.Language, track.Label, track.Language)
+	}
+
+	bandwidth, err := estimateBandwidth(ctx, srcPath)
+	if err != nil {
+		return nil, "", err
+	}
+	fmt.Fprintf(&master, "#EXT-X-STREAM-INF:BANDWIDTH=%d,AUDIO=\"audio\"\nindex.m3u8\n", bandwidth)
+
+	err = os.WriteFile(filepath.Join(outDir, "master.m3u8"), []byte(master.String()), 0644)
+	if err != nil {
+		return nil, "", err
+	}
+	return keys, "master.m3u8", nil
+}
+
+// estimateBandwidth is the file's average bitrate in bits per second, close
+// enough for a single-rendition master playlist.
+func estimateBandwidth(ctx context.Context, path string) (int64, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+	duration, err := getVideoDuration(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("%s has no duration", filepath.Base(path))
+	}
+	return int64(float64(info.Size()*8) / duration), nil
+}
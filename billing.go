@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// paying users' jobs run ahead of the free plan's, but not ahead of quick
+// jobs like moderation
+const proPlanJobPriority = 5
+
+// planLimits is what a plan includes. A zero storage quota is unlimited.
+type planLimits struct {
+	storageQuota int64
+	// overagesAllowed lets uploads continue past the quota, the extra
+	// storage shows up in usage reports to be billed
+	overagesAllowed bool
+	jobPriority     int
+	// concurrentStreams caps the devices a user watches on at once when
+	// playback tokens are on, 0 is unlimited
+	concurrentStreams int
+}
+
+// userPlan returns the user's plan and its limits. Unknown users and plans
+// get the free plan.
+func (cfg *apiConfig) userPlan(userID uuid.UUID) (database.Plan, planLimits, error) {
+	billing, err := cfg.db.GetUserBilling(userID)
+	if err != nil {
+		return database.PlanFree, cfg.plans[database.PlanFree], err
+	}
+	limits, ok := cfg.plans[billing.Plan]
+	if !ok {
+		return database.PlanFree, cfg.plans[database.PlanFree], nil
+	}
+	return billing.Plan, limits, nil
+}
+
+// admitUpload refuses new uploads while the server sheds load and those of
+// users at their plan's storage quota, responding with the error itself.
+// Uploads that take a user past it are still let in, their size isn't
+// always known up front.
+func (cfg *apiConfig) admitUpload(w http.ResponseWriter, userID uuid.UUID) bool {
+	if !cfg.admitUploadUnderLoad(w) {
+		return false
+	}
+	plan, limits, err := cfg.userPlan(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get plan", err)
+		return false
+	}
+	if limits.storageQuota <= 0 || limits.overagesAllowed {
+		return true
+	}
+
+	used, err := cfg.db.GetUserStorageBytes(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get storage usage", err)
+		return false
+	}
+	if used < limits.storageQuota {
+		return true
+	}
+	respondWithErrorDetails(w, http.StatusForbidden, errCodeQuotaExceeded,
+		fmt.Sprintf("Your videos use all %s of the %s plan, delete some or upgrade", formatBytes(limits.storageQuota), plan),
+		map[string]any{"plan": plan, "used_bytes": used, "quota_bytes": limits.storageQuota}, nil)
+	return false
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// bumpers are short branding clips, not content
+	maxBumperSeconds = 30
+	maxBumperBytes   = 200 << 20
+)
+
+// bumperSelection is which of the organization's bumpers an upload is
+// wrapped in.
+type bumperSelection struct {
+	intro bool
+	outro bool
+}
+
+// parseBumperSelection reads a comma separated list like "intro,outro".
+func parseBumperSelection(s string) (bumperSelection, error) {
+	var sel bumperSelection
+	if s == "" {
+		return sel, nil
+	}
+	for _, position := range strings.Split(s, ",") {
+		switch database.BumperPosition(strings.TrimSpace(position)) {
+		case database.BumperIntro:
+			sel.intro = true
+		case database.BumperOutro:
+			sel.outro = true
+		default:
+			return bumperSelection{}, fmt.Errorf("unknown bumper %q, must be intro or outro", position)
+		}
+	}
+	return sel, nil
+}
+
+func (sel bumperSelection) String() string {
+	var positions []string
+	if sel.intro {
+		positions = append(positions, string(database.BumperIntro))
+	}
+	if sel.outro {
+		positions = append(positions, string(database.BumperOutro))
+	}
+	return strings.Join(positions, ",")
+}
+
+func (sel bumperSelection) empty() bool {
+	return !sel.intro && !sel.outro
+}
+
+// bumpersFromRequest reads the bumpers query parameter of an upload, which
+// may only name bumpers the uploader's organization has.
+func (cfg *apiConfig) bumpersFromRequest(r *http.Request, userID uuid.UUID) (bumperSelection, error) {
+	sel, err := parseBumperSelection(r.URL.Query().Get("bumpers"))
+	if err != nil || sel.empty() {
+		return sel, err
+	}
+
+	org, err := cfg.db.GetOrganizationByUser(userID)
+	if err != nil {
+		return bumperSelection{}, err
+	}
+	if sel.intro && org.IntroKey == nil {
+		return bumperSelection{}, errors.New("your organization has no intro")
+	}
+	if sel.outro && org.OutroKey == nil {
+		return bumperSelection{}, errors.New("your organization has no outro")
+	}
+	return sel, nil
+}
+
+// addBumpers writes the source wrapped in the organization's bumpers to a new
+// file and returns its path. Files whose streams all match are joined
+// without re-encoding, anything else goes through the concat filter like a
+// stitched video. Bumpers the organization removed since the upload are
+// left out.
+func (cfg *apiConfig) addBumpers(ctx context.Context, userID uuid.UUID, filePath string, sel bumperSelection) (string, error) {
+	org, err := cfg.db.GetOrganizationByUser(userID)
+	if err != nil {
+		return "", err
+	}
+	var introKey, outroKey *string
+	if sel.intro {
+		introKey = org.IntroKey
+	}
+	if sel.outro {
+		outroKey = org.OutroKey
+	}
+	if introKey == nil && outroKey == nil {
+		log.Printf("Organization of user %s no longer has the bumpers %s, skipping them", userID, sel)
+		return filePath, nil
+	}
+
+	source, err := probeStitchInput(ctx, filePath)
+	if err != nil {
+		return "", err
+	}
+	inputs := []stitchInput{source}
+	if introKey != nil {
+		intro, err := cfg.downloadBumper(ctx, *introKey, filePath+".intro.mp4")
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(intro.path)
+		inputs = append([]stitchInput{intro}, inputs...)
+	}
+	if outroKey != nil {
+		outro, err := cfg.downloadBumper(ctx, *outroKey, filePath+".outro.mp4")
+		if err != nil {
+			return "", err
+		}
+		defer os.Remove(outro.path)
+		inputs = append(inputs, outro)
+	}
+
+	outPath := filePath + ".bumpers.mp4"
+	copyable := true
+	for _, input := range inputs {
+		copyable = copyable && input.params == source.params
+	}
+	if copyable {
+		err = concatCopy(ctx, inputs, outPath)
+	} else {
+		err = stitchClips(ctx, inputs, outPath)
+	}
+	if err != nil {
+		os.Remove(outPath)
+		return "", err
+	}
+	return outPath, nil
+}
+
+func (cfg *apiConfig) downloadBumper(ctx context.Context, key, path string) (stitchInput, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return stitchInput{}, err
+	}
+	err = cfg.downloadObject(ctx, key, file)
+	file.Close()
+	if err != nil {
+		os.Remove(path)
+		return stitchInput{}, fmt.Errorf("couldn't download bumper %s: %w", key, err)
+	}
+	input, err := probeStitchInput(ctx, path)
+	if err != nil {
+		os.Remove(path)
+		return stitchInput{}, err
+	}
+	return input, nil
+}
+
+// concatCopy joins whole files with matching streams using the concat
+// demuxer, which copies the packets as they are.
+func concatCopy(ctx context.Context, inputs []stitchInput, outPath string) error {
+	var list strings.Builder
+	for _, input := range inputs {
+		fmt.Fprintf(&list, "file '%s'\n", input.path)
+	}
+	listPath := outPath + ".txt"
+	err := os.WriteFile(listPath, []byte(list.String()), 0644)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(listPath)
+
+	cmd := ffmpegRunner.Command(ctx, "ffmpeg",
+		"-y",
+		"-f", "concat",
+		"-safe", "0",
+		"-i", listPath,
+		"-c", "copy",
+		outPath,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return newCommandError("ffmpeg", err, stderr.Bytes())
+	}
+	return nil
+}
+
+// handlerOrganizationBumperUpload sets the organization's intro or outro from
+// the "video" form file. The clip is transcoded with the default profile,
+// so uploads processed with it can be joined to it without re-encoding.
+func (cfg *apiConfig) handlerOrganizationBumperUpload(w http.ResponseWriter, r *http.Request) {
+	position := database.BumperPosition(r.PathValue("position"))
+	if position != database.BumperIntro && position != database.BumperOutro {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Bumpers are intro or outro", nil)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	org, ok := cfg.getOwnedOrganization(w, userID)
+	if !ok {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxBumperBytes+64<<10)
+	part, err := streamFormFile(r, "video")
+	if err != nil {
+		if isMaxBytesError(err) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, errCodePayloadTooLarge, "Bumper is too large", err)
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't parse video", err)
+		return
+	}
+	defer part.Close()
+
+	mediaType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeUnsupportedMediaType, "Invalid content type", err)
+		return
+	}
+	if !sourceMediaTypeAllowed(mediaType, part.FileName()) {
+		respondWithError(w, http.StatusBadRequest, errCodeUnsupportedMediaType, "Media type not allowed. Only mp4, mov, mkv and webm are supported", nil)
+		return
+	}
+
+	tempFile, err := os.CreateTemp("", "tubely-bumper")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create temp file", err)
+		return
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	written, err := io.Copy(tempFile, part)
+	if isMaxBytesError(err) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, errCodePayloadTooLarge, "Bumper is too large", err)
+		return
+	}
+	if err := checkPartReceived(part, written, err); err != nil {
+		respondWithUploadError(w, "Bumper", err)
+		return
+	}
+
+	source, err := probeSource(r.Context(), tempFile.Name())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeUnsupportedMediaType, "Couldn't read the video, is it a video file?", err)
+		return
+	}
+	if err := source.checkSupported(); err != nil {
+		respondWithErrorDetails(w, http.StatusBadRequest, errCodeUnsupportedMediaType, err.Error(), source, nil)
+		return
+	}
+	if err := source.checkIntegrity(); err != nil {
+		respondWithErrorDetails(w, http.StatusBadRequest, errCodeInvalidMedia, err.Error(), source, nil)
+		return
+	}
+	if source.Duration > maxBumperSeconds {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("Bumpers can be at most %ds long", maxBumperSeconds), nil)
+		return
+	}
+
+	processedPath := tempFile.Name() + ".mp4"
+	err = transcodeVideo(r.Context(), tempFile.Name(), processedPath, source.normalizedProfile(cfg.defaultTranscodeProfile()))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't process bumper", err)
+		return
+	}
+	defer os.Remove(processedPath)
+
+	processed, err := os.Open(processedPath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't open processed bumper", err)
+		return
+	}
+	defer processed.Close()
+
+	enc, err := cfg.objectEncryptionForUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get encryption settings", err)
+		return
+	}
+	key := fmt.Sprintf("bumpers/%s/%s-%s.mp4", org.ID, position, uuid.New())
+	_, err = cfg.putFileObject(r.Context(), key, "video/mp4", processed, enc, ownerTags(userID, org.ID))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't upload bumper", err)
+		return
+	}
+
+	previous := org.IntroKey
+	if position == database.BumperOutro {
+		previous = org.OutroKey
+	}
+	err = cfg.db.SetOrganizationBumper(org.ID, position, &key)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update organization", err)
+		return
+	}
+	if previous != nil {
+		cfg.removeBumperObject(r.Context(), *previous)
+	}
+
+	org, err = cfg.db.GetOrganization(org.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get organization", err)
+		return
+	}
+	cfg.respondWithOrganization(w, http.StatusOK, org)
+}
+
+func (cfg *apiConfig) handlerOrganizationBumperDelete(w http.ResponseWriter, r *http.Request) {
+	position := database.BumperPosition(r.PathValue("position"))
+	if position != database.BumperIntro && position != database.BumperOutro {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Bumpers are intro or outro", nil)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	org, ok := cfg.getOwnedOrganization(w, userID)
+	if !ok {
+		return
+	}
+
+	previous := org.IntroKey
+	if position == database.BumperOutro {
+		previous = org.OutroKey
+	}
+	if previous == nil {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, fmt.Sprintf("Your organization has no %s", position), nil)
+		return
+	}
+
+	err = cfg.db.SetOrganizationBumper(org.ID, position, nil)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update organization", err)
+		return
+	}
+	cfg.removeBumperObject(r.Context(), *previous)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// removeBumperObject deletes a replaced bumper. An upload that looked it up
+// just before fails to fetch it and has to be retried.
+func (cfg *apiConfig) removeBumperObject(ctx context.Context, key string) {
+	if err := cfg.deleteObject(ctx, key); err != nil {
+		log.Printf("Couldn't delete bumper %s: %v", key, err)
+	}
+}
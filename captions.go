@@ -0,0 +1,319 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	maxCaptionsBytes = 2 << 20
+	// matching cues listed for each video a transcript search finds
+	transcriptSearchCuesPerVideo = 10
+)
+
+var (
+	vttTimestampPattern = regexp.MustCompile(`^(?:(\d{2,}):)?([0-5]\d):([0-5]\d)\.(\d{3})$`)
+	// voice, class and timestamp tags inside cue text
+	vttTagPattern = regexp.MustCompile(`<[^>]*>`)
+)
+
+// transcriptMatch is a cue a transcript search found. URL opens the watch
+// page at the cue.
+type transcriptMatch struct {
+	Language     string  `json:"language"`
+	StartSeconds float64 `json:"start_seconds"`
+	EndSeconds   float64 `json:"end_seconds"`
+	Text         string  `json:"text"`
+	URL          string  `json:"url"`
+}
+
+type transcriptResult struct {
+	Video   database.Video    `json:"video"`
+	Matches []transcriptMatch `json:"matches"`
+}
+
+// handlerVideoCaptionsPut sets the video's captions in the language from a
+// WebVTT body and queues generating chapters from them. Cues are stored as
+// plain text to be searchable, so styling and positioning don't survive.
+func (cfg *apiConfig) handlerVideoCaptionsPut(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+	language := r.PathValue("language")
+	if !audioTrackLanguagePattern.MatchString(language) {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Language must be a BCP 47 tag like en or pt-BR", nil)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxCaptionsBytes)
+	cues, err := parseWebVTT(r.Body)
+	if isMaxBytesError(err) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, errCodePayloadTooLarge, "Captions are too large", err)
+		return
+	}
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("Invalid WebVTT: %v", err), err)
+		return
+	}
+
+	err = cfg.db.PutCaptions(video.ID, language, cues)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save captions", err)
+		return
+	}
+	cfg.requestChapters(video.ID, language)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerVideoCaptionsGet serves the captions in the language as WebVTT,
+// to the owner and to anyone who may watch the video.
+func (cfg *apiConfig) handlerVideoCaptionsGet(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.viewableVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	cues, err := cfg.db.GetCaptions(video.ID, r.PathValue("language"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get captions", err)
+		return
+	}
+	if len(cues) == 0 {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Captions not found", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/vtt; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	writeWebVTT(w, cues)
+}
+
+// viewableVideoFromRequest loads the video in the path for its owner, or
+// for anyone if it isn't hidden. It responds with an error and returns
+// false otherwise.
+func (cfg *apiConfig) viewableVideoFromRequest(w http.ResponseWriter, r *http.Request) (database.Video, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return database.Video{}, false
+	}
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return database.Video{}, false
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil || (isVideoHidden(video) && !cfg.isVideoOwner(r, video)) {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil)
+		return database.Video{}, false
+	}
+	return video, true
+}
+
+func (cfg *apiConfig) handlerVideoCaptionsDelete(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := cfg.db.DeleteCaptions(video.ID, r.PathValue("language"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't delete captions", err)
+		return
+	}
+	if !deleted {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Captions not found", nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerTranscriptSearch finds public videos in which the phrase q is
+// said, going by their captions, with links to the moments it is.
+func (cfg *apiConfig) handlerTranscriptSearch(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Results []transcriptResult `json:"results"`
+	}
+
+	query := r.URL.Query()
+	q := strings.Join(strings.Fields(query.Get("q")), " ")
+	if q == "" {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Missing q", nil)
+		return
+	}
+	limit, offset, err := searchPage(query)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid page", err)
+		return
+	}
+
+	matches, err := cfg.db.SearchCaptions(q, limit, offset, transcriptSearchCuesPerVideo)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't search captions", err)
+		return
+	}
+
+	results := []transcriptResult{}
+	for _, match := range matches {
+		video, ok, err := cfg.discoverableVideo(r, match.VideoID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+			return
+		}
+		if !ok {
+			continue
+		}
+		result := transcriptResult{Video: video, Matches: make([]transcriptMatch, 0, len(match.Cues))}
+		for _, cue := range match.Cues {
+			result.Matches = append(result.Matches, transcriptMatch{
+				Language:     cue.Language,
+				StartSeconds: float64(cue.StartMS) / 1000,
+				EndSeconds:   float64(cue.EndMS) / 1000,
+				Text:         cue.Text,
+				URL:          cfg.watchURLAt(video.ID, int(cue.StartMS/1000)),
+			})
+		}
+		results = append(results, result)
+	}
+
+	w.Header().Add("Vary", "Accept-Language")
+	respondWithJSON(w, http.StatusOK, response{Results: results})
+}
+
+// parseWebVTT reads the cues of a WebVTT file. Markup in cue text is
+// dropped; NOTE, STYLE and REGION blocks are skipped.
+func parseWebVTT(r io.Reader) ([]database.CaptionCue, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64<<10), maxCaptionsBytes)
+
+	var blocks [][]string
+	var block []string
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if len(blocks) == 0 && block == nil {
+			line = strings.TrimPrefix(line, "\ufeff")
+		}
+		if strings.TrimSpace(line) == "" {
+			if block != nil {
+				blocks = append(blocks, block)
+				block = nil
+			}
+			continue
+		}
+		block = append(block, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if block != nil {
+		blocks = append(blocks, block)
+	}
+
+	if len(blocks) == 0 || !isWebVTTSignature(blocks[0][0]) {
+		return nil, errors.New("missing WEBVTT header")
+	}
+
+	cues := []database.CaptionCue{}
+	for _, block := range blocks[1:] {
+		if !strings.Contains(block[0], "-->") {
+			switch strings.Fields(block[0])[0] {
+			case "NOTE", "STYLE", "REGION":
+				continue
+			}
+			// an identifier precedes the timings
+			block = block[1:]
+			if len(block) == 0 || !strings.Contains(block[0], "-->") {
+				return nil, fmt.Errorf("cue %d has no timings", len(cues)+1)
+			}
+		}
+		start, end, err := parseWebVTTTimings(block[0])
+		if err != nil {
+			return nil, fmt.Errorf("cue %d: %w", len(cues)+1, err)
+		}
+
+		lines := make([]string, 0, len(block)-1)
+		for _, line := range block[1:] {
+			line = strings.TrimSpace(html.UnescapeString(vttTagPattern.ReplaceAllString(line, "")))
+			if line != "" {
+				lines = append(lines, line)
+			}
+		}
+		if len(lines) == 0 {
+			continue
+		}
+		cues = append(cues, database.CaptionCue{StartMS: start, EndMS: end, Text: strings.Join(lines, "\n")})
+	}
+	return cues, nil
+}
+
+func isWebVTTSignature(line string) bool {
+	rest, ok := strings.CutPrefix(line, "WEBVTT")
+	return ok && (rest == "" || rest[0] == ' ' || rest[0] == '\t')
+}
+
+// parseWebVTTTimings parses a line like "00:01.000 --> 00:04.250 line:0",
+// ignoring the cue settings after the end time.
+func parseWebVTTTimings(line string) (startMS, endMS int64, err error) {
+	startText, rest, _ := strings.Cut(line, "-->")
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return 0, 0, errors.New("missing end time")
+	}
+	startMS, err = parseWebVTTTimestamp(strings.TrimSpace(startText))
+	if err != nil {
+		return 0, 0, err
+	}
+	endMS, err = parseWebVTTTimestamp(fields[0])
+	if err != nil {
+		return 0, 0, err
+	}
+	if endMS <= startMS {
+		return 0, 0, errors.New("cue ends before it starts")
+	}
+	return startMS, endMS, nil
+}
+
+func parseWebVTTTimestamp(s string) (int64, error) {
+	parts := vttTimestampPattern.FindStringSubmatch(s)
+	if parts == nil {
+		return 0, fmt.Errorf("invalid timestamp %q", s)
+	}
+	var ms int64
+	for i, unit := range []int64{3600_000, 60_000, 1000, 1} {
+		if parts[i+1] == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(parts[i+1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q", s)
+		}
+		ms += n * unit
+	}
+	return ms, nil
+}
+
+func writeWebVTT(w io.Writer, cues []database.CaptionCue) {
+	bw := bufio.NewWriter(w)
+	bw.WriteString("WEBVTT\n")
+	escaper := strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+	for _, cue := range cues {
+		fmt.Fprintf(bw, "\n%s --> %s\n%s\n", formatWebVTTTimestamp(cue.StartMS), formatWebVTTTimestamp(cue.EndMS), escaper.Replace(cue.Text))
+	}
+	bw.Flush()
+}
+
+func formatWebVTTTimestamp(ms int64) string {
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600_000, ms/60_000%60, ms/1000%60, ms%1000)
+}
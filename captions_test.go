@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestParseWebVTT(t *testing.T) {
+	vtt := "\ufeffWEBVTT - Boots\r\n\r\n" +
+		"NOTE made by hand\n\n" +
+		"STYLE\n::cue { color: lime }\n\n" +
+		"intro\n00:01.000 --> 00:04.250 line:0\n<v Ann>Boots &amp; laces</v>\nare <b>back</b>\n\n" +
+		"01:02:03.004 --> 01:02:05.000\nLater\n\n" +
+		"00:06.000 --> 00:07.000\n<i></i>\n"
+	cues, err := parseWebVTT(strings.NewReader(vtt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []database.CaptionCue{
+		{StartMS: 1000, EndMS: 4250, Text: "Boots & laces\nare back"},
+		{StartMS: 3723004, EndMS: 3725000, Text: "Later"},
+	}
+	if len(cues) != len(want) {
+		t.Fatalf("cues = %+v", cues)
+	}
+	for i := range want {
+		if cues[i] != want[i] {
+			t.Errorf("cue %d = %+v, want %+v", i, cues[i], want[i])
+		}
+	}
+
+	var b strings.Builder
+	writeWebVTT(&b, cues)
+	if got := b.String(); got != "WEBVTT\n\n00:00:01.000 --> 00:00:04.250\nBoots &amp; laces\nare back\n\n01:02:03.004 --> 01:02:05.000\nLater\n" {
+		t.Errorf("wrote %q", got)
+	}
+}
+
+func TestParseWebVTTRefusesInvalidFiles(t *testing.T) {
+	for _, vtt := range []string{
+		"",
+		"00:01.000 --> 00:02.000\nno header",
+		"WEBVTTX\n\n00:01.000 --> 00:02.000\nbad header",
+		"WEBVTT\n\n00:01.000 -> 00:02.000\nbad arrow",
+		"WEBVTT\n\n00:01 --> 00:02.000\nno milliseconds",
+		"WEBVTT\n\n00:03.000 --> 00:02.000\nbackwards",
+	} {
+		if _, err := parseWebVTT(strings.NewReader(vtt)); err == nil {
+			t.Errorf("parsed %q", vtt)
+		}
+	}
+}
+
+func TestHandlerTranscriptSearch(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.appBaseURL = "https://tubely.example.com"
+
+	public, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Boots", UserID: uuid.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Secret", Visibility: database.VisibilityPrivate, UserID: uuid.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cues := []database.CaptionCue{
+		{StartMS: 500, EndMS: 2000, Text: "Welcome back"},
+		{StartMS: 61500, EndMS: 64000, Text: "the 100% LEATHER boots"},
+		{StartMS: 90000, EndMS: 92000, Text: "leather-free boots too"},
+	}
+	for _, id := range []uuid.UUID{public.ID, private.ID} {
+		if err := cfg.db.PutCaptions(id, "en", cues); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	search := func(q string) []transcriptResult {
+		t.Helper()
+		w := httptest.NewRecorder()
+		cfg.handlerTranscriptSearch(w, httptest.NewRequest(http.MethodGet, "/api/videos/search/transcript?q="+q, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		var resp struct {
+			Results []transcriptResult `json:"results"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return resp.Results
+	}
+
+	results := search("leather+boots")
+	if len(results) != 1 || results[0].Video.ID != public.ID {
+		t.Fatalf("results %+v, want only the public video", results)
+	}
+	matches := results[0].Matches
+	if len(matches) != 1 || matches[0].StartSeconds != 61.5 || matches[0].Language != "en" {
+		t.Fatalf("matches %+v", matches)
+	}
+	if want := "https://tubely.example.com/watch/" + public.ID.String() + "?t=61"; matches[0].URL != want {
+		t.Errorf("url = %s, want %s", matches[0].URL, want)
+	}
+
+	// LIKE wildcards in the phrase match literally
+	if results := search("100%25"); len(results) != 1 {
+		t.Errorf("searching 100%% found %d videos", len(results))
+	}
+	if results := search("1_0"); len(results) != 0 {
+		t.Errorf("searching 1_0 found %d videos", len(results))
+	}
+}
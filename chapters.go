@@ -0,0 +1,363 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/llm"
+	"github.com/google/uuid"
+)
+
+const (
+	jobTypeGenerateChapters = "generate_chapters"
+
+	maxChapters           = 100
+	maxChapterTitleLength = 100
+
+	// a pause this long between cues, or a cue opening with a transition
+	// phrase, starts a chapter once the current one is long enough
+	chapterSilenceGapMS = 3000
+	chapterMinLengthMS  = 30_000
+	chapterTitleWords   = 3
+
+	// transcripts are cut to this many bytes before they're sent to a model
+	maxChapterTranscriptBytes = 60_000
+)
+
+var (
+	chapterTransitionPattern = regexp.MustCompile(`(?i)^(?:(?:so|ok|okay|alright|and|now)[,.]?\s+)?(?:next(?:\s+up)?|moving on(?:\s+to)?|let'?s\s+(?:talk about|look at|move on to|get into)|in this (?:section|part)|(?:chapter|part|step)\s+(?:\d+|one|two|three|four|five|six|seven|eight|nine|ten)|finally|in conclusion|to (?:sum|wrap) up)\b[,:.]?\s*`)
+	chapterWordPattern       = regexp.MustCompile(`[\p{L}\p{N}']+`)
+	// words too common to name a chapter after
+	chapterStopWords = map[string]bool{
+		"about": true, "after": true, "again": true, "also": true, "because": true, "been": true, "before": true,
+		"being": true, "could": true, "does": true, "doing": true, "going": true, "gonna": true, "have": true,
+		"here": true, "into": true, "just": true, "know": true, "like": true, "little": true, "look": true,
+		"make": true, "more": true, "much": true, "need": true, "okay": true, "only": true, "really": true,
+		"right": true, "should": true, "some": true, "something": true, "that": true, "that's": true, "their": true,
+		"them": true, "then": true, "there": true, "these": true, "they": true, "thing": true, "things": true,
+		"think": true, "this": true, "those": true, "want": true, "well": true, "were": true, "what": true,
+		"when": true, "where": true, "which": true, "while": true, "will": true, "with": true, "would": true,
+		"yeah": true, "your": true, "you're": true, "it's": true, "let's": true, "we're": true, "i'm": true,
+	}
+)
+
+type generateChaptersPayload struct {
+	VideoID  uuid.UUID `json:"video_id"`
+	Language string    `json:"language"`
+	// Force replaces chapters the owner edited
+	Force bool `json:"force"`
+}
+
+// chapterSegmenter splits a transcript into chapters. The first chapter
+// starts at 0; fewer than two chapters mean the video has none.
+type chapterSegmenter interface {
+	segmentChapters(ctx context.Context, cues []database.CaptionCue) ([]database.Chapter, error)
+}
+
+// requestChapters queues generating the video's chapters from its captions
+// in the language. Failing to queue it is logged rather than failing the
+// request.
+func (cfg *apiConfig) requestChapters(videoID uuid.UUID, language string) {
+	_, err := cfg.enqueueJob(jobTypeGenerateChapters, &videoID, generateChaptersPayload{VideoID: videoID, Language: language})
+	if err != nil {
+		log.Printf("Couldn't queue chapters for video %s: %v", videoID, err)
+	}
+}
+
+func (cfg *apiConfig) runGenerateChaptersJob(ctx context.Context, job database.Job) error {
+	var payload generateChaptersPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+
+	video, err := cfg.db.GetVideo(payload.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		return nil
+	}
+	cues, err := cfg.db.GetCaptions(video.ID, payload.Language)
+	if err != nil {
+		return err
+	}
+	if len(cues) == 0 {
+		// the captions were deleted since
+		return nil
+	}
+
+	chapters, err := cfg.chapterSegmenter.segmentChapters(ctx, cues)
+	if err != nil {
+		return fmt.Errorf("couldn't segment transcript: %w", err)
+	}
+	if len(chapters) < 2 {
+		chapters = nil
+	}
+	for i := range chapters {
+		chapters[i].Generated = true
+	}
+
+	replaced, err := cfg.db.ReplaceChapters(video.ID, chapters, payload.Force)
+	if err != nil {
+		return err
+	}
+	if !replaced {
+		log.Printf("Kept the edited chapters of video %s", video.ID)
+	}
+	return nil
+}
+
+// heuristicSegmenter starts chapters at long pauses and at cues opening
+// with phrases like "moving on to", and names them after the phrase or
+// the chapter's most frequent words.
+type heuristicSegmenter struct{}
+
+func (heuristicSegmenter) segmentChapters(ctx context.Context, cues []database.CaptionCue) ([]database.Chapter, error) {
+	var groups [][]database.CaptionCue
+	for i, cue := range cues {
+		if i > 0 {
+			current := groups[len(groups)-1]
+			longEnough := cue.StartMS-current[0].StartMS >= chapterMinLengthMS
+			pause := cue.StartMS-cues[i-1].EndMS >= chapterSilenceGapMS
+			if !longEnough || !(pause || chapterTransitionPattern.MatchString(cue.Text)) {
+				groups[len(groups)-1] = append(current, cue)
+				continue
+			}
+		}
+		groups = append(groups, []database.CaptionCue{cue})
+	}
+	if len(groups) < 2 {
+		return nil, nil
+	}
+
+	chapters := make([]database.Chapter, 0, len(groups))
+	for i, group := range groups {
+		start := group[0].StartMS
+		if i == 0 {
+			start = 0
+		}
+		title := chapterTitle(group)
+		if title == "" {
+			title = fmt.Sprintf("Chapter %d", i+1)
+		}
+		chapters = append(chapters, database.Chapter{StartMS: start, Title: title})
+	}
+	return chapters, nil
+}
+
+// chapterTitle names a chapter after what follows its transition phrase,
+// or else its most frequent words.
+func chapterTitle(cues []database.CaptionCue) string {
+	first := strings.ReplaceAll(cues[0].Text, "\n", " ")
+	if loc := chapterTransitionPattern.FindStringIndex(first); loc != nil {
+		rest, _, _ := strings.Cut(first[loc[1]:], ". ")
+		rest = strings.TrimRight(strings.TrimSpace(rest), ".!?,")
+		if words := strings.Fields(rest); len(words) > 0 && len(words) <= 8 {
+			return capitalize(rest)
+		}
+	}
+
+	counts := map[string]int{}
+	var order []string
+	for _, cue := range cues {
+		for _, word := range chapterWordPattern.FindAllString(strings.ToLower(cue.Text), -1) {
+			if len([]rune(word)) < 4 || chapterStopWords[word] {
+				continue
+			}
+			if counts[word] == 0 {
+				order = append(order, word)
+			}
+			counts[word]++
+		}
+	}
+	// most frequent first, ties in order of appearance
+	slices.SortStableFunc(order, func(a, b string) int { return cmp.Compare(counts[b], counts[a]) })
+	if len(order) > chapterTitleWords {
+		order = order[:chapterTitleWords]
+	}
+	if len(order) == 0 {
+		return ""
+	}
+	return capitalize(strings.Join(order, ", "))
+}
+
+func capitalize(s string) string {
+	r := []rune(s)
+	if len(r) == 0 {
+		return s
+	}
+	r[0] = unicode.ToUpper(r[0])
+	return string(r)
+}
+
+// llmSegmenter asks a language model for the chapters, sending it the
+// transcript with the second each cue starts at.
+type llmSegmenter struct {
+	provider llm.Provider
+}
+
+const chapterSystemPrompt = `You split video transcripts into chapters. Each transcript line starts with the second it is said at, in brackets.
+Reply with JSON only, like {"chapters":[{"start_seconds":0,"title":"Introduction"}]}.
+The first chapter starts at 0. Use 3 to 12 chapters of at least 30 seconds each, following changes of topic.
+Titles are at most 60 characters, in the language of the transcript.`
+
+func (s llmSegmenter) segmentChapters(ctx context.Context, cues []database.CaptionCue) ([]database.Chapter, error) {
+	var transcript strings.Builder
+	for _, cue := range cues {
+		line := fmt.Sprintf("[%d] %s\n", cue.StartMS/1000, strings.ReplaceAll(cue.Text, "\n", " "))
+		if transcript.Len()+len(line) > maxChapterTranscriptBytes {
+			break
+		}
+		transcript.WriteString(line)
+	}
+
+	reply, err := s.provider.Complete(ctx, chapterSystemPrompt, transcript.String())
+	if err != nil {
+		return nil, err
+	}
+	var out struct {
+		Chapters []struct {
+			StartSeconds float64 `json:"start_seconds"`
+			Title        string  `json:"title"`
+		} `json:"chapters"`
+	}
+	if err := llm.DecodeJSON(reply, &out); err != nil {
+		return nil, fmt.Errorf("couldn't decode chapters: %w", err)
+	}
+
+	// models don't always follow the rules, so fix what's fixable
+	end := cues[len(cues)-1].EndMS
+	chapters := []database.Chapter{}
+	for _, ch := range out.Chapters {
+		start := int64(ch.StartSeconds * 1000)
+		title := strings.Join(strings.Fields(ch.Title), " ")
+		if start < 0 || start >= end || title == "" {
+			continue
+		}
+		if r := []rune(title); len(r) > maxChapterTitleLength {
+			title = string(r[:maxChapterTitleLength])
+		}
+		chapters = append(chapters, database.Chapter{StartMS: start, Title: title})
+	}
+	slices.SortStableFunc(chapters, func(a, b database.Chapter) int { return cmp.Compare(a.StartMS, b.StartMS) })
+	chapters = slices.CompactFunc(chapters, func(a, b database.Chapter) bool { return a.StartMS == b.StartMS })
+	if len(chapters) > maxChapters {
+		chapters = chapters[:maxChapters]
+	}
+	if len(chapters) > 0 {
+		chapters[0].StartMS = 0
+	}
+	return chapters, nil
+}
+
+// handlerVideoChaptersGet lists the chapters to anyone who may see the
+// video.
+func (cfg *apiConfig) handlerVideoChaptersGet(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.viewableVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	chapters, err := cfg.db.GetChapters(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get chapters", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, chapters)
+}
+
+// handlerVideoChaptersPut replaces the chapters with the owner's. Generated
+// chapters never overwrite them, only asking to regenerate does.
+func (cfg *apiConfig) handlerVideoChaptersPut(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Chapters []struct {
+			StartMS int64  `json:"start_ms"`
+			Title   string `json:"title"`
+		} `json:"chapters"`
+	}
+
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if len(params.Chapters) > maxChapters {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("Videos can have at most %d chapters", maxChapters), nil)
+		return
+	}
+
+	chapters := make([]database.Chapter, 0, len(params.Chapters))
+	for i, ch := range params.Chapters {
+		title := strings.TrimSpace(ch.Title)
+		if title == "" || len(title) > maxChapterTitleLength {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("Chapter titles must be 1 to %d characters long", maxChapterTitleLength), nil)
+			return
+		}
+		if i == 0 && ch.StartMS != 0 {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "The first chapter must start at 0", nil)
+			return
+		}
+		if i > 0 && ch.StartMS <= chapters[i-1].StartMS {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Chapters must be in order of their start", nil)
+			return
+		}
+		chapters = append(chapters, database.Chapter{StartMS: ch.StartMS, Title: title})
+	}
+
+	_, err = cfg.db.ReplaceChapters(video.ID, chapters, true)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save chapters", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, chapters)
+}
+
+// handlerVideoChaptersGenerate queues generating the chapters again from
+// the captions in the language query parameter, replacing edited ones.
+func (cfg *apiConfig) handlerVideoChaptersGenerate(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+	language := r.URL.Query().Get("language")
+	if language == "" {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Missing language", nil)
+		return
+	}
+
+	cues, err := cfg.db.GetCaptions(video.ID, language)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get captions", err)
+		return
+	}
+	if len(cues) == 0 {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "The video has no captions in this language", nil)
+		return
+	}
+
+	job, err := cfg.enqueueJob(jobTypeGenerateChapters, &video.ID, generateChaptersPayload{VideoID: video.ID, Language: language, Force: true})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create chapters job", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, job)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestHeuristicSegmenter(t *testing.T) {
+	cues := []database.CaptionCue{
+		{StartMS: 2000, EndMS: 5000, Text: "Welcome, today we're talking boots"},
+		{StartMS: 5000, EndMS: 9000, Text: "Leather boots and more leather"},
+		// a pause, but the chapter is too short to end
+		{StartMS: 20000, EndMS: 25000, Text: "Leather lasts"},
+		{StartMS: 40000, EndMS: 44000, Text: "Moving on to laces. They matter"},
+		{StartMS: 44000, EndMS: 48000, Text: "Waxed laces hold knots"},
+		// long enough and a pause
+		{StartMS: 80000, EndMS: 84000, Text: "Polish, polish, polish the leather"},
+	}
+	chapters, err := heuristicSegmenter{}.segmentChapters(context.Background(), cues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []database.Chapter{
+		{StartMS: 0, Title: "Leather, boots, welcome"},
+		{StartMS: 40000, Title: "Laces"},
+		{StartMS: 80000, Title: "Polish, leather"},
+	}
+	if len(chapters) != len(want) {
+		t.Fatalf("chapters = %+v", chapters)
+	}
+	for i := range want {
+		if chapters[i] != want[i] {
+			t.Errorf("chapter %d = %+v, want %+v", i, chapters[i], want[i])
+		}
+	}
+
+	// one topic is no chapters at all
+	chapters, err = heuristicSegmenter{}.segmentChapters(context.Background(), cues[:2])
+	if err != nil || len(chapters) != 0 {
+		t.Errorf("chapters = %+v, %v", chapters, err)
+	}
+}
+
+type fakeLLM struct {
+	prompt string
+	reply  string
+}
+
+func (f *fakeLLM) Complete(ctx context.Context, system, prompt string) (string, error) {
+	f.prompt = prompt
+	return f.reply, nil
+}
+
+func TestLLMSegmenter(t *testing.T) {
+	provider := &fakeLLM{reply: "Sure!\n```json\n" + `{"chapters":[{"start_seconds":61.5,"title":"  Laces  "},{"start_seconds":3,"title":"Boots"},{"start_seconds":61.5,"title":"Again"},{"start_seconds":500,"title":"Past the end"},{"start_seconds":90,"title":""}]}` + "\n```"}
+	cues := []database.CaptionCue{
+		{StartMS: 3000, EndMS: 5000, Text: "Boots\nand more"},
+		{StartMS: 61500, EndMS: 120000, Text: "Laces"},
+	}
+	chapters, err := llmSegmenter{provider: provider}.segmentChapters(context.Background(), cues)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if provider.prompt != "[3] Boots and more\n[61] Laces\n" {
+		t.Errorf("prompt = %q", provider.prompt)
+	}
+	want := []database.Chapter{{StartMS: 0, Title: "Boots"}, {StartMS: 61500, Title: "Laces"}}
+	if len(chapters) != len(want) || chapters[0] != want[0] || chapters[1] != want[1] {
+		t.Errorf("chapters = %+v, want %+v", chapters, want)
+	}
+}
+
+func TestGenerateChaptersJobKeepsEditedChapters(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.chapterSegmenter = &llmSegmenter{provider: &fakeLLM{reply: `{"chapters":[{"start_seconds":0,"title":"Intro"},{"start_seconds":40,"title":"Laces"}]}`}}
+
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Boots", UserID: uuid.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.db.PutCaptions(video.ID, "en", []database.CaptionCue{{StartMS: 0, EndMS: 60000, Text: "Boots"}}); err != nil {
+		t.Fatal(err)
+	}
+	run := func(force bool) []database.Chapter {
+		t.Helper()
+		payload, err := json.Marshal(generateChaptersPayload{VideoID: video.ID, Language: "en", Force: force})
+		if err != nil {
+			t.Fatal(err)
+		}
+		job := database.Job{CreateJobParams: database.CreateJobParams{Payload: payload}}
+		if err := cfg.runGenerateChaptersJob(context.Background(), job); err != nil {
+			t.Fatal(err)
+		}
+		chapters, err := cfg.db.GetChapters(video.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return chapters
+	}
+
+	if chapters := run(false); len(chapters) != 2 || !chapters[1].Generated || chapters[1].Title != "Laces" {
+		t.Fatalf("chapters = %+v", chapters)
+	}
+	if _, err := cfg.db.ReplaceChapters(video.ID, []database.Chapter{{StartMS: 0, Title: "Mine"}}, true); err != nil {
+		t.Fatal(err)
+	}
+	if chapters := run(false); len(chapters) != 1 || chapters[0].Title != "Mine" {
+		t.Errorf("generating replaced edited chapters: %+v", chapters)
+	}
+	if chapters := run(true); len(chapters) != 2 {
+		t.Errorf("regenerating kept edited chapters: %+v", chapters)
+	}
+}
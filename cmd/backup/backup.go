@@ -0,0 +1,352 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	snapshotIDLayout = "20060102T150405Z"
+
+	// files of a snapshot, backup.json is written last so a snapshot
+	// without it is incomplete
+	snapshotInfoFile     = "backup.json"
+	snapshotDBFile       = "tubely.db"
+	snapshotManifestFile = "objects.jsonl.gz"
+	snapshotAssetsFile   = "assets.tar.gz"
+
+	// where the server writes objects in test data mode
+	testDataPrefix = "test-data/"
+)
+
+// snapshotInfo describes a snapshot.
+type snapshotInfo struct {
+	ID        string     `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	DBSHA256  string     `json:"db_sha256"`
+	Locations []location `json:"locations"`
+	Objects   int        `json:"objects"`
+	Assets    bool       `json:"assets"`
+}
+
+// manifestEntry is a stored object, one per line of the manifest.
+type manifestEntry struct {
+	Bucket       string    `json:"bucket"`
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag"`
+	LastModified time.Time `json:"last_modified"`
+}
+
+// backup takes a snapshot and returns its ID.
+func (t tool) backup(ctx context.Context) (string, error) {
+	info := snapshotInfo{
+		CreatedAt: time.Now().UTC(),
+		Locations: t.locations,
+	}
+	info.ID = info.CreatedAt.Format(snapshotIDLayout)
+
+	dir, err := os.MkdirTemp("", "tubely-backup")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+
+	db, err := database.NewClient(t.dbPath)
+	if err != nil {
+		return "", fmt.Errorf("couldn't open database: %w", err)
+	}
+	defer db.Close()
+	dbPath := filepath.Join(dir, snapshotDBFile)
+	err = db.Snapshot(dbPath)
+	if err != nil {
+		return "", fmt.Errorf("couldn't snapshot database: %w", err)
+	}
+	info.DBSHA256, err = fileSHA256(dbPath)
+	if err != nil {
+		return "", err
+	}
+	err = t.putFile(ctx, info.ID, snapshotDBFile, dbPath)
+	if err != nil {
+		return "", err
+	}
+
+	// listed after the database so every object it names is in the
+	// manifest, uploads finishing meanwhile only add extra entries
+	objects, err := t.listObjects(ctx, t.locations)
+	if err != nil {
+		return "", err
+	}
+	info.Objects = len(objects)
+	manifestPath := filepath.Join(dir, snapshotManifestFile)
+	err = writeManifest(manifestPath, objects)
+	if err != nil {
+		return "", err
+	}
+	err = t.putFile(ctx, info.ID, snapshotManifestFile, manifestPath)
+	if err != nil {
+		return "", err
+	}
+
+	if t.assetsRoot != "" {
+		assetsPath := filepath.Join(dir, snapshotAssetsFile)
+		info.Assets, err = archiveAssets(assetsPath, t.assetsRoot)
+		if err != nil {
+			return "", fmt.Errorf("couldn't archive assets: %w", err)
+		}
+		if info.Assets {
+			err = t.putFile(ctx, info.ID, snapshotAssetsFile, assetsPath)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	dat, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	err = t.put(ctx, info.ID, snapshotInfoFile, dat)
+	if err != nil {
+		return "", err
+	}
+	return info.ID, nil
+}
+
+// listSnapshots prints the complete snapshots in the bucket, oldest first.
+func (t tool) listSnapshots(ctx context.Context) error {
+	paginator := s3.NewListObjectsV2Paginator(t.s3Client, &s3.ListObjectsV2Input{
+		Bucket:    aws.String(t.bucket),
+		Prefix:    aws.String(t.prefix),
+		Delimiter: aws.String("/"),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return err
+		}
+		for _, p := range page.CommonPrefixes {
+			id := filepath.Base(aws.ToString(p.Prefix))
+			info, err := t.snapshotInfo(ctx, id)
+			if err != nil {
+				fmt.Printf("%s\tincomplete\n", id)
+				continue
+			}
+			fmt.Printf("%s\t%d objects\tassets: %t\n", info.ID, info.Objects, info.Assets)
+		}
+	}
+	return nil
+}
+
+func (t tool) snapshotInfo(ctx context.Context, id string) (snapshotInfo, error) {
+	out, err := t.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(t.key(id, snapshotInfoFile)),
+	})
+	if err != nil {
+		return snapshotInfo{}, err
+	}
+	defer out.Body.Close()
+
+	var info snapshotInfo
+	err = json.NewDecoder(out.Body).Decode(&info)
+	return info, err
+}
+
+// listObjects returns the objects stored in the locations by bucket and
+// key.
+func (t tool) listObjects(ctx context.Context, locations []location) (map[string]manifestEntry, error) {
+	objects := map[string]manifestEntry{}
+	for _, l := range locations {
+		paginator := s3.NewListObjectsV2Paginator(t.s3Client, &s3.ListObjectsV2Input{
+			Bucket: aws.String(l.Bucket),
+			Prefix: aws.String(l.Prefix),
+		})
+		for paginator.HasMorePages() {
+			page, err := paginator.NextPage(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("couldn't list bucket %s: %w", l.Bucket, err)
+			}
+			for _, object := range page.Contents {
+				// snapshots kept in a bucket that is backed up aren't
+				// part of the install
+				if l.Bucket == t.bucket && strings.HasPrefix(aws.ToString(object.Key), t.prefix) {
+					continue
+				}
+				// neither is the test data cmd/purge-test-data removes
+				if strings.HasPrefix(aws.ToString(object.Key), testDataPrefix) {
+					continue
+				}
+				entry := manifestEntry{
+					Bucket:       l.Bucket,
+					Key:          aws.ToString(object.Key),
+					Size:         aws.ToInt64(object.Size),
+					ETag:         aws.ToString(object.ETag),
+					LastModified: aws.ToTime(object.LastModified),
+				}
+				objects[entry.Bucket+"/"+entry.Key] = entry
+			}
+		}
+	}
+	return objects, nil
+}
+
+func writeManifest(path string, objects map[string]manifestEntry) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	zw := gzip.NewWriter(f)
+	encoder := json.NewEncoder(zw)
+	for _, entry := range objects {
+		if err := encoder.Encode(entry); err != nil {
+			return err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func readManifest(r io.Reader) ([]manifestEntry, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	entries := []manifestEntry{}
+	scanner := bufio.NewScanner(zr)
+	for scanner.Scan() {
+		var entry manifestEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// archiveAssets writes the files under root to a gzipped tarball. It
+// reports false, writing nothing, if root doesn't exist.
+func archiveAssets(path, root string) (bool, error) {
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return false, nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	zw := gzip.NewWriter(f)
+	tw := tar.NewWriter(zw)
+
+	err = filepath.WalkDir(root, func(filePath string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return err
+		}
+		name, err := filepath.Rel(root, filePath)
+		if err != nil {
+			return err
+		}
+		fileInfo, err := d.Info()
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(fileInfo, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(name)
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		src, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+
+	if err := tw.Close(); err != nil {
+		return false, err
+	}
+	if err := zw.Close(); err != nil {
+		return false, err
+	}
+	return true, f.Close()
+}
+
+func (t tool) key(id, name string) string {
+	return t.prefix + id + "/" + name
+}
+
+func (t tool) put(ctx context.Context, id, name string, dat []byte) error {
+	_, err := t.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(t.key(id, name)),
+		Body:   bytes.NewReader(dat),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't upload %s: %w", name, err)
+	}
+	return nil
+}
+
+func (t tool) putFile(ctx context.Context, id, name, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = t.s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(t.key(id, name)),
+		Body:   f,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't upload %s: %w", name, err)
+	}
+	return nil
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
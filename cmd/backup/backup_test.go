@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStorageLocations(t *testing.T) {
+	routesPath := filepath.Join(t.TempDir(), "routes.json")
+	routes := `{"originals": {"bucket": "tubely-originals", "prefix": "tubely/"}, "exports": {"prefix": "exports-"}}`
+	if err := os.WriteFile(routesPath, []byte(routes), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	locations, err := storageLocations("tubely", routesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []location{{Bucket: "tubely"}, {Bucket: "tubely-originals", Prefix: "tubely/"}}
+	if len(locations) != len(want) || locations[0] != want[0] || locations[1] != want[1] {
+		t.Errorf("locations %+v, want %+v", locations, want)
+	}
+}
+
+func TestManifestRoundTrip(t *testing.T) {
+	objects := map[string]manifestEntry{
+		"tubely/landscape/a.mp4":  {Bucket: "tubely", Key: "landscape/a.mp4", Size: 1024, ETag: `"abc"`, LastModified: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)},
+		"tubely/hls/a/index.m3u8": {Bucket: "tubely", Key: "hls/a/index.m3u8", Size: 12},
+	}
+	path := filepath.Join(t.TempDir(), snapshotManifestFile)
+	if err := writeManifest(path, objects); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries, err := readManifest(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(objects) {
+		t.Fatalf("read %d entries, want %d", len(entries), len(objects))
+	}
+	for _, entry := range entries {
+		if objects[entry.Bucket+"/"+entry.Key] != entry {
+			t.Errorf("entry %+v doesn't match what was written", entry)
+		}
+	}
+}
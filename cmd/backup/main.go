@@ -0,0 +1,161 @@
+// Command backup snapshots a Tubely install for disaster recovery, and
+// restores one.
+//
+// A snapshot is the database, a manifest of every stored object and the
+// local assets (thumbnails), written to a target bucket under
+// <prefix><snapshot ID>/. The objects themselves aren't copied; replicate
+// or version the buckets for that. Restoring checks that every object in
+// the manifest is still stored before it rebuilds the database.
+//
+// It reads the server's .env for DB_PATH, ASSETS_ROOT, S3_BUCKET,
+// S3_REGION, S3_ENDPOINT, S3_FORCE_PATH_STYLE and STORAGE_ROUTES_PATH.
+//
+//	backup -bucket tubely-backups                 take a snapshot
+//	backup -bucket tubely-backups -list           list snapshots
+//	backup -bucket tubely-backups -restore ID     restore one
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/joho/godotenv"
+)
+
+// location is a bucket and prefix the server stores objects under.
+type location struct {
+	Bucket string `json:"bucket"`
+	Prefix string `json:"prefix"`
+}
+
+type tool struct {
+	s3Client *s3.Client
+	// bucket and prefix snapshots are written under
+	bucket string
+	prefix string
+	dbPath string
+	// assetsRoot is empty when the install doesn't keep local assets
+	assetsRoot string
+	locations  []location
+}
+
+func main() {
+	godotenv.Load(".env")
+
+	bucket := flag.String("bucket", os.Getenv("BACKUP_BUCKET"), "bucket snapshots are written to, defaults to BACKUP_BUCKET")
+	prefix := flag.String("prefix", "tubely-backups/", "key prefix of the snapshots in the bucket")
+	list := flag.Bool("list", false, "list the snapshots in the bucket")
+	restore := flag.String("restore", "", "ID of the snapshot to restore")
+	force := flag.Bool("force", false, "when restoring, move an existing database aside instead of refusing")
+	allowMissing := flag.Bool("allow-missing", false, "when restoring, rebuild the database even if objects are missing")
+	flag.Parse()
+
+	if *bucket == "" {
+		log.Fatal("-bucket or BACKUP_BUCKET must be set")
+	}
+	if *prefix != "" && !strings.HasSuffix(*prefix, "/") {
+		*prefix += "/"
+	}
+
+	dbPath := os.Getenv("DB_PATH")
+	if dbPath == "" {
+		log.Fatal("DB_PATH must be set")
+	}
+	s3Bucket := os.Getenv("S3_BUCKET")
+	if s3Bucket == "" {
+		log.Fatal("S3_BUCKET environment variable is not set")
+	}
+	s3Region := os.Getenv("S3_REGION")
+	if s3Region == "" {
+		log.Fatal("S3_REGION environment variable is not set")
+	}
+	locations, err := storageLocations(s3Bucket, os.Getenv("STORAGE_ROUTES_PATH"))
+	if err != nil {
+		log.Fatalf("Couldn't load storage routes: %v", err)
+	}
+
+	for _, l := range locations {
+		if l.Bucket == *bucket && *prefix == "" {
+			log.Fatalf("-prefix must be set to keep snapshots in %s, which holds the install's objects", *bucket)
+		}
+	}
+
+	awsConfig, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+	if err != nil {
+		log.Fatalf("Couldn't load AWS config: %v", err)
+	}
+	endpoint := strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/")
+	s3Client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		o.UsePathStyle = os.Getenv("S3_FORCE_PATH_STYLE") == "true"
+		if endpoint == "" {
+			return
+		}
+		o.BaseEndpoint = aws.String(endpoint)
+		o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+		o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+	})
+
+	t := tool{
+		s3Client:   s3Client,
+		bucket:     *bucket,
+		prefix:     *prefix,
+		dbPath:     dbPath,
+		assetsRoot: os.Getenv("ASSETS_ROOT"),
+		locations:  locations,
+	}
+
+	ctx := context.Background()
+	switch {
+	case *list:
+		err = t.listSnapshots(ctx)
+	case *restore != "":
+		err = t.restore(ctx, *restore, *force, *allowMissing)
+	default:
+		var id string
+		id, err = t.backup(ctx)
+		if err == nil {
+			fmt.Println(id)
+		}
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// storageLocations returns where the server stores objects: S3_BUCKET,
+// and the buckets and prefixes of its storage routes file.
+func storageLocations(defaultBucket, routesPath string) ([]location, error) {
+	locations := []location{{Bucket: defaultBucket}}
+	if routesPath == "" {
+		return locations, nil
+	}
+
+	dat, err := os.ReadFile(routesPath)
+	if err != nil {
+		return nil, err
+	}
+	var routes map[string]location
+	err = json.Unmarshal(dat, &routes)
+	if err != nil {
+		return nil, err
+	}
+	for _, route := range routes {
+		if route.Bucket == "" {
+			route.Bucket = defaultBucket
+		}
+		// the default bucket is listed whole already
+		if route.Bucket == defaultBucket {
+			continue
+		}
+		locations = append(locations, route)
+	}
+	return locations, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// missing objects listed before the count is summed up
+const maxMissingObjectsListed = 20
+
+// restore checks the objects in the snapshot's manifest are still stored,
+// then puts its database at DB_PATH and its assets in ASSETS_ROOT. An
+// existing database is only replaced with force, and moved aside rather
+// than deleted.
+func (t tool) restore(ctx context.Context, id string, force, allowMissing bool) error {
+	info, err := t.snapshotInfo(ctx, id)
+	if err != nil {
+		return fmt.Errorf("couldn't read snapshot %s, is it complete? %w", id, err)
+	}
+
+	if _, err := os.Stat(t.dbPath); err == nil && !force {
+		return fmt.Errorf("%s exists, restore with -force to move it aside", t.dbPath)
+	}
+
+	// next to the database so it can be renamed into place
+	tempDB, err := os.CreateTemp(filepath.Dir(t.dbPath), ".tubely-restore-*.db")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempDB.Name())
+	err = t.download(ctx, id, snapshotDBFile, tempDB)
+	tempDB.Close()
+	if err != nil {
+		return err
+	}
+	checksum, err := fileSHA256(tempDB.Name())
+	if err != nil {
+		return err
+	}
+	if checksum != info.DBSHA256 {
+		return fmt.Errorf("database of snapshot %s is corrupt: sha256 %s, want %s", id, checksum, info.DBSHA256)
+	}
+
+	missing, err := t.verifyObjects(ctx, id, info)
+	if err != nil {
+		return err
+	}
+	for i, entry := range missing {
+		if i == maxMissingObjectsListed {
+			log.Printf("... and %d more", len(missing)-i)
+			break
+		}
+		log.Printf("missing s3://%s/%s (%d bytes)", entry.Bucket, entry.Key, entry.Size)
+	}
+	if len(missing) > 0 && !allowMissing {
+		return fmt.Errorf("%d of %d objects are missing or changed, restore them first or pass -allow-missing", len(missing), info.Objects)
+	}
+
+	if _, err := os.Stat(t.dbPath); err == nil {
+		aside := t.dbPath + ".before-restore"
+		if err := os.Rename(t.dbPath, aside); err != nil {
+			return err
+		}
+		log.Printf("moved the existing database to %s", aside)
+	}
+	err = os.Rename(tempDB.Name(), t.dbPath)
+	if err != nil {
+		return err
+	}
+	// brings a snapshot of an older version up to this one's schema
+	db, err := database.NewClient(t.dbPath)
+	if err != nil {
+		return fmt.Errorf("couldn't migrate restored database: %w", err)
+	}
+	db.Close()
+
+	if info.Assets && t.assetsRoot != "" {
+		err = t.restoreAssets(ctx, id)
+		if err != nil {
+			return fmt.Errorf("couldn't restore assets: %w", err)
+		}
+	}
+
+	log.Printf("restored snapshot %s: %d objects checked, %d missing", id, info.Objects, len(missing))
+	return nil
+}
+
+// verifyObjects lists the snapshot's storage locations and returns the
+// manifest entries that are gone or have a different size.
+func (t tool) verifyObjects(ctx context.Context, id string, info snapshotInfo) ([]manifestEntry, error) {
+	out, err := t.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(t.key(id, snapshotManifestFile)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't download manifest: %w", err)
+	}
+	defer out.Body.Close()
+	manifest, err := readManifest(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read manifest: %w", err)
+	}
+
+	stored, err := t.listObjects(ctx, info.Locations)
+	if err != nil {
+		return nil, err
+	}
+	missing := []manifestEntry{}
+	for _, entry := range manifest {
+		object, ok := stored[entry.Bucket+"/"+entry.Key]
+		if !ok || object.Size != entry.Size {
+			missing = append(missing, entry)
+		}
+	}
+	return missing, nil
+}
+
+// restoreAssets extracts the snapshot's assets into ASSETS_ROOT, over
+// files of the same name.
+func (t tool) restoreAssets(ctx context.Context, id string) error {
+	out, err := t.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(t.key(id, snapshotAssetsFile)),
+	})
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+
+	zr, err := gzip.NewReader(out.Body)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+	tr := tar.NewReader(zr)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		name := filepath.FromSlash(header.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("asset %q is outside the assets directory", header.Name)
+		}
+		err = extractFile(filepath.Join(t.assetsRoot, name), tr)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func extractFile(path string, r io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(f, r); err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func (t tool) download(ctx context.Context, id, name string, dst io.Writer) error {
+	out, err := t.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(t.bucket),
+		Key:    aws.String(t.key(id, name)),
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't download %s: %w", name, err)
+	}
+	defer out.Body.Close()
+	_, err = io.Copy(dst, out.Body)
+	if err != nil {
+		return fmt.Errorf("couldn't download %s: %w", name, err)
+	}
+	return nil
+}
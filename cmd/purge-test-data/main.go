@@ -0,0 +1,168 @@
+// Command purge-test-data removes what a server running with
+// TEST_DATA_MODE=true wrote: every object under test-data/ of
+// TEST_DATA_BUCKET, the videos marked as test data and the users marked as
+// test data with everything they own.
+//
+// Local assets (thumbnails) aren't tracked per record, give test servers
+// an ASSETS_ROOT of their own and remove it after the run.
+//
+// It reads the server's .env for DB_PATH, S3_BUCKET, TEST_DATA_BUCKET,
+// S3_REGION, S3_ENDPOINT and S3_FORCE_PATH_STYLE.
+//
+//	purge-test-data -dry-run    show what would be removed
+//	purge-test-data             remove it
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/joho/godotenv"
+)
+
+// testDataPrefix is where the server writes objects in test data mode.
+const testDataPrefix = "test-data/"
+
+// most keys DeleteObjects takes at once
+const deleteBatchSize = 1000
+
+func main() {
+	godotenv.Load(".env")
+
+	dryRun := flag.Bool("dry-run", false, "print what would be removed without removing it")
+	flag.Parse()
+
+	dbPath := os.Getenv("DB_PATH")
+	if dbPath == "" {
+		log.Fatal("DB_PATH must be set")
+	}
+	bucket := os.Getenv("TEST_DATA_BUCKET")
+	if bucket == "" {
+		bucket = os.Getenv("S3_BUCKET")
+	}
+	if bucket == "" {
+		log.Fatal("TEST_DATA_BUCKET or S3_BUCKET must be set")
+	}
+	s3Region := os.Getenv("S3_REGION")
+	if s3Region == "" {
+		log.Fatal("S3_REGION environment variable is not set")
+	}
+
+	awsConfig, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(s3Region))
+	if err != nil {
+		log.Fatalf("Couldn't load AWS config: %v", err)
+	}
+	endpoint := strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/")
+	s3Client := s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		o.UsePathStyle = os.Getenv("S3_FORCE_PATH_STYLE") == "true"
+		if endpoint == "" {
+			return
+		}
+		o.BaseEndpoint = aws.String(endpoint)
+		o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+		o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+	})
+
+	db, err := database.NewClient(dbPath)
+	if err != nil {
+		log.Fatalf("Couldn't connect to database: %v", err)
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	objects, err := purgeObjects(ctx, s3Client, bucket, *dryRun)
+	if err != nil {
+		log.Fatalf("Couldn't purge objects: %v", err)
+	}
+	videos, users, err := purgeRecords(db, *dryRun)
+	if err != nil {
+		log.Fatalf("Couldn't purge records: %v", err)
+	}
+
+	verb := "Removed"
+	if *dryRun {
+		verb = "Would remove"
+	}
+	fmt.Printf("%s %d objects from s3://%s/%s, %d videos and %d users\n", verb, objects, bucket, testDataPrefix, videos, users)
+}
+
+// purgeObjects deletes the objects under the test data prefix and returns
+// how many there were.
+func purgeObjects(ctx context.Context, client *s3.Client, bucket string, dryRun bool) (int, error) {
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{
+		Bucket:  aws.String(bucket),
+		Prefix:  aws.String(testDataPrefix),
+		MaxKeys: aws.Int32(deleteBatchSize),
+	})
+	purged := 0
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return purged, fmt.Errorf("couldn't list bucket %s: %w", bucket, err)
+		}
+		if len(page.Contents) == 0 {
+			continue
+		}
+		if dryRun {
+			purged += len(page.Contents)
+			continue
+		}
+
+		ids := make([]types.ObjectIdentifier, 0, len(page.Contents))
+		for _, object := range page.Contents {
+			ids = append(ids, types.ObjectIdentifier{Key: object.Key})
+		}
+		out, err := client.DeleteObjects(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(bucket),
+			Delete: &types.Delete{Objects: ids, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return purged, err
+		}
+		if len(out.Errors) > 0 {
+			e := out.Errors[0]
+			return purged, fmt.Errorf("couldn't delete %s: %s", aws.ToString(e.Key), aws.ToString(e.Message))
+		}
+		purged += len(ids)
+	}
+	return purged, nil
+}
+
+// purgeRecords deletes the test videos, then the test users with the rest
+// of their data. Test videos of real users go, their owners stay.
+func purgeRecords(db database.Client, dryRun bool) (videos, users int, err error) {
+	videoIDs, err := db.GetTestDataVideoIDs()
+	if err != nil {
+		return 0, 0, err
+	}
+	userIDs, err := db.GetTestDataUserIDs()
+	if err != nil {
+		return 0, 0, err
+	}
+	if dryRun {
+		return len(videoIDs), len(userIDs), nil
+	}
+
+	for _, id := range videoIDs {
+		if err := db.DeleteVideo(id); err != nil {
+			return videos, users, fmt.Errorf("video %s: %w", id, err)
+		}
+		videos++
+	}
+	for _, id := range userIDs {
+		if err := db.DeleteUserData(id); err != nil {
+			return videos, users, fmt.Errorf("user %s: %w", id, err)
+		}
+		users++
+	}
+	return videos, users, nil
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/contentid"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const jobTypeCheckContentID = "check_content_id"
+
+type checkContentIDPayload struct {
+	VideoID uuid.UUID `json:"video_id"`
+}
+
+// requestContentIDCheck queues looking the video's current file up in the
+// content ID registry. It runs after the frame hashes are stored, which are
+// sent along with the audio. Failing to queue it is logged rather than
+// failing the upload.
+func (cfg *apiConfig) requestContentIDCheck(videoID uuid.UUID) {
+	if _, ok := cfg.contentID.(contentid.Noop); ok || cfg.contentID == nil {
+		return
+	}
+	_, err := cfg.enqueueJob(jobTypeCheckContentID, &videoID, checkContentIDPayload{VideoID: videoID})
+	if err != nil {
+		log.Printf("Couldn't queue content ID check for video %s: %v", videoID, err)
+	}
+}
+
+func (cfg *apiConfig) runCheckContentIDJob(ctx context.Context, job database.Job) error {
+	var payload checkContentIDPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+
+	video, err := cfg.db.GetVideo(payload.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil || video.VideoURL == nil {
+		return nil
+	}
+	key, ok := cfg.objectKeyFromURL(*video.VideoURL)
+	if !ok {
+		return nil
+	}
+	hashes, err := cfg.db.GetVideoPerceptualHashes(video.ID)
+	if err != nil {
+		return err
+	}
+
+	dir, err := os.MkdirTemp("", "tubely-content-id")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	videoPath := filepath.Join(dir, "video.mp4")
+	videoFile, err := os.Create(videoPath)
+	if err != nil {
+		return err
+	}
+	err = cfg.downloadObject(ctx, key, videoFile)
+	videoFile.Close()
+	if err != nil {
+		return fmt.Errorf("couldn't download %s: %w", key, err)
+	}
+
+	duration, err := getVideoDuration(ctx, videoPath)
+	if err != nil {
+		return err
+	}
+	fingerprints := contentid.Fingerprints{
+		VideoID:         video.ID.String(),
+		DurationSeconds: duration,
+		FrameHashes:     hashes,
+	}
+	hasAudio, err := videoHasAudio(ctx, videoPath)
+	if err != nil {
+		return err
+	}
+	if hasAudio {
+		fingerprints.AudioPath = filepath.Join(dir, "audio.m4a")
+		if err := extractContentIDAudio(ctx, videoPath, fingerprints.AudioPath); err != nil {
+			return err
+		}
+	}
+
+	matches, err := cfg.contentID.Check(ctx, fingerprints)
+	if err != nil {
+		return fmt.Errorf("couldn't check content ID: %w", err)
+	}
+	return cfg.applyContentIDMatches(ctx, video, matches)
+}
+
+// applyContentIDMatches stores the report of the matches confident enough
+// to count, and blocks the video over them if configured to. A check that
+// finds nothing releases a video blocked over its previous file.
+func (cfg *apiConfig) applyContentIDMatches(ctx context.Context, video database.Video, matches []contentid.Match) error {
+	report := []database.ContentIDMatch{}
+	for _, m := range matches {
+		if m.Confidence < cfg.contentIDConfidence {
+			continue
+		}
+		report = append(report, database.ContentIDMatch{
+			ReferenceID:  m.ReferenceID,
+			Title:        m.Title,
+			Owner:        m.Owner,
+			Media:        m.Media,
+			Confidence:   m.Confidence,
+			StartSeconds: m.StartSeconds,
+			EndSeconds:   m.EndSeconds,
+		})
+	}
+	blocked := cfg.contentIDBlock && len(report) > 0
+
+	err := cfg.db.PutContentIDReport(video.ID, report, blocked)
+	if err != nil {
+		return err
+	}
+	if blocked != video.CopyrightBlocked {
+		err = cfg.db.SetVideoCopyrightBlocked(video.ID, blocked)
+		if err != nil {
+			return err
+		}
+		video.CopyrightBlocked = blocked
+	}
+
+	if len(report) > 0 {
+		log.Printf("Video %s matched %d registered works (blocked: %t)", video.ID, len(report), blocked)
+		err = cfg.sendWebhook(ctx, "video.content_id_matched", video)
+		if err != nil {
+			log.Printf("Couldn't send video.content_id_matched webhook for %s: %v", video.ID, err)
+		}
+	}
+	return nil
+}
+
+// extractContentIDAudio writes the first audio track as low bitrate mono
+// AAC, plenty for fingerprinting and quick to upload.
+func extractContentIDAudio(ctx context.Context, videoPath, outPath string) error {
+	cmd := ffmpegRunner.Command(ctx, "ffmpeg",
+		"-i", videoPath,
+		"-map", "0:a:0",
+		"-ac", "1",
+		"-ar", "16000",
+		"-c:a", "aac",
+		"-b:a", "32k",
+		"-f", "mp4",
+		outPath,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return newCommandError("ffmpeg", err, stderr.Bytes())
+	}
+	return nil
+}
+
+// handlerVideoContentID shows the owner what the last content ID check of
+// the video found.
+func (cfg *apiConfig) handlerVideoContentID(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	report, err := cfg.db.GetContentIDReport(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get content ID report", err)
+		return
+	}
+	if report == nil {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Video hasn't been checked", nil)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+// handlerAdminContentIDMatches lists the videos that matched registered
+// works, blocked or only flagged, for moderators to review.
+func (cfg *apiConfig) handlerAdminContentIDMatches(w http.ResponseWriter, r *http.Request) {
+	type match struct {
+		Video  database.Video           `json:"video"`
+		Report database.ContentIDReport `json:"report"`
+	}
+
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+	limit, offset, err := searchPage(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid page", err)
+		return
+	}
+
+	reports, err := cfg.db.GetMatchedContentIDReports(limit, offset)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't retrieve content ID reports", err)
+		return
+	}
+
+	matches := make([]match, 0, len(reports))
+	for _, report := range reports {
+		video, err := cfg.db.GetVideo(report.VideoID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't retrieve video", err)
+			return
+		}
+		matches = append(matches, match{Video: cfg.withSignedURLs(video), Report: report})
+	}
+
+	respondWithJSON(w, http.StatusOK, matches)
+}
+
+// handlerAdminContentIDReview settles a match: "block" hides the video from
+// everyone but its owner, "release" makes it watchable again, e.g. once the
+// owner showed they have a license.
+func (cfg *apiConfig) handlerAdminContentIDReview(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Decision string `json:"decision"`
+	}
+
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	var blocked bool
+	switch params.Decision {
+	case "block":
+		blocked = true
+	case "release":
+		blocked = false
+	default:
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, `decision must be "block" or "release"`, nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil)
+		return
+	}
+
+	err = cfg.db.SetVideoCopyrightBlocked(video.ID, blocked)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video", err)
+		return
+	}
+	video.CopyrightBlocked = blocked
+
+	respondWithJSON(w, http.StatusOK, cfg.withSignedURLs(video))
+}
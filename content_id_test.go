@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/contentid"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestContentIDRegistry(t *testing.T) {
+	var fingerprints struct {
+		VideoID     string   `json:"video_id"`
+		FrameHashes []string `json:"frame_hashes"`
+	}
+	var audio []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.Unmarshal([]byte(r.FormValue("fingerprints")), &fingerprints)
+		if file, _, err := r.FormFile("audio"); err == nil {
+			audio, _ = io.ReadAll(file)
+		}
+		io.WriteString(w, `{"matches":[{"reference_id":"ref-1","title":"Song","media":"audio","confidence":97.5,"start_seconds":3,"end_seconds":40}]}`)
+	}))
+	defer server.Close()
+
+	audioPath := filepath.Join(t.TempDir(), "audio.m4a")
+	if err := os.WriteFile(audioPath, []byte("aac"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	matches, err := contentid.NewRegistry(server.URL, "secret").Check(context.Background(), contentid.Fingerprints{
+		VideoID:     "v1",
+		FrameHashes: []uint64{0xff, 1 << 63},
+		AudioPath:   audioPath,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 1 || matches[0].ReferenceID != "ref-1" || matches[0].Confidence != 97.5 {
+		t.Errorf("matches %+v", matches)
+	}
+	if fingerprints.VideoID != "v1" || len(fingerprints.FrameHashes) != 2 || fingerprints.FrameHashes[0] != "00000000000000ff" || fingerprints.FrameHashes[1] != "8000000000000000" {
+		t.Errorf("sent fingerprints %+v", fingerprints)
+	}
+	if string(audio) != "aac" {
+		t.Errorf("sent audio %q", audio)
+	}
+
+	if _, err := contentid.NewRegistry(server.URL, "wrong").Check(context.Background(), contentid.Fingerprints{}); err == nil {
+		t.Error("no error for a refused request")
+	}
+}
+
+func TestApplyContentIDMatches(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.contentIDConfidence = 90
+	cfg.contentIDBlock = true
+
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Cover", UserID: uuid.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	matches := []contentid.Match{
+		{ReferenceID: "ref-1", Media: "audio", Confidence: 95},
+		{ReferenceID: "ref-2", Media: "video", Confidence: 60},
+	}
+	if err := cfg.applyContentIDMatches(context.Background(), video, matches); err != nil {
+		t.Fatal(err)
+	}
+
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !video.CopyrightBlocked || !isVideoHidden(video) {
+		t.Fatal("a confident match didn't block the video")
+	}
+	report, err := cfg.db.GetContentIDReport(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report == nil || !report.Blocked || len(report.Matches) != 1 || report.Matches[0].ReferenceID != "ref-1" {
+		t.Fatalf("report %+v, want only the confident match", report)
+	}
+
+	// a new file without matches releases the video
+	if err := cfg.applyContentIDMatches(context.Background(), video, nil); err != nil {
+		t.Fatal(err)
+	}
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.CopyrightBlocked {
+		t.Error("video still blocked after a clean check")
+	}
+
+	// flagging only reports
+	cfg.contentIDBlock = false
+	if err := cfg.applyContentIDMatches(context.Background(), video, matches); err != nil {
+		t.Fatal(err)
+	}
+	video, err = cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reports, err := cfg.db.GetMatchedContentIDReports(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if video.CopyrightBlocked || len(reports) != 1 || reports[0].Blocked {
+		t.Errorf("flagging blocked %t, reports %+v", video.CopyrightBlocked, reports)
+	}
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	maxVideoTags      = 20
+	maxVideoTagLength = 30
+
+	discoveryRefreshInterval = 15 * time.Minute
+	// views older than this don't count towards trending
+	trendingWindow = 14 * 24 * time.Hour
+	// a view counts half as much after this long
+	trendingHalfLife   = 3 * 24 * time.Hour
+	maxTrendingVideos  = 200
+	trendingMaxLimit   = 50
+	maxRelatedVideos   = 10
+	discoveryListLimit = 20
+)
+
+// validateVideoTags normalizes tags to trimmed lower case words without
+// duplicates.
+func validateVideoTags(params *database.CreateVideoParams) error {
+	tags := make([]string, 0, len(params.Tags))
+	for _, tag := range params.Tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || len(tag) > maxVideoTagLength {
+			return fmt.Errorf("tags must be 1 to %d characters long", maxVideoTagLength)
+		}
+		// tags are stored comma separated
+		if strings.Contains(tag, ",") {
+			return fmt.Errorf("tag %q can't contain a comma", tag)
+		}
+		if !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	if len(tags) > maxVideoTags {
+		return fmt.Errorf("a video can have at most %d tags", maxVideoTags)
+	}
+	params.Tags = tags
+	return nil
+}
+
+func (cfg *apiConfig) handlerVideoTagsUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Tags []string `json:"tags"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this video", nil)
+		return
+	}
+
+	video.Tags = params.Tags
+	err = validateVideoTags(&video.CreateVideoParams)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid tags", err)
+		return
+	}
+
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.withSignedURLs(video))
+}
+
+// recordVideoView counts a play towards trending. Like deliveries, failing
+// to count it doesn't fail playback.
+func (cfg *apiConfig) recordVideoView(ctx context.Context, videoID uuid.UUID) {
+	day := time.Now().UTC().Format(database.VideoViewDayLayout)
+	if err := cfg.db.WithContext(ctx).RecordVideoView(videoID, day); err != nil {
+		log.Printf("Couldn't record view of video %s: %v", videoID, err)
+	}
+}
+
+// handlerVideosTrending lists the videos with the most recent views. The
+// list is precomputed by refreshDiscovery.
+func (cfg *apiConfig) handlerVideosTrending(w http.ResponseWriter, r *http.Request) {
+	limit := discoveryListLimit
+	if limitString := r.URL.Query().Get("limit"); limitString != "" {
+		var err error
+		limit, err = strconv.Atoi(limitString)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid limit", err)
+			return
+		}
+		limit = min(max(limit, 1), trendingMaxLimit)
+	}
+
+	trending, err := cfg.db.GetTrendingVideos(limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get trending videos", err)
+		return
+	}
+	videos, err := cfg.discoverableVideos(r, trending)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get trending videos", err)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept-Language")
+	respondWithJSON(w, http.StatusOK, videos)
+}
+
+// handlerVideoRelated lists videos sharing tags or the owner with the video.
+// The list is precomputed by refreshDiscovery.
+func (cfg *apiConfig) handlerVideoRelated(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil || (isVideoHidden(video) && !cfg.isVideoOwner(r, video)) {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	related, err := cfg.db.GetRelatedVideos(video.ID, maxRelatedVideos)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get related videos", err)
+		return
+	}
+	videos, err := cfg.discoverableVideos(r, related)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get related videos", err)
+		return
+	}
+
+	w.Header().Add("Vary", "Accept-Language")
+	respondWithJSON(w, http.StatusOK, videos)
+}
+
+// discoverableVideos loads the scored videos as the viewer may see them.
+// Videos deleted or hidden since the lists were computed are left out.
+func (cfg *apiConfig) discoverableVideos(r *http.Request, scored []database.ScoredVideo) ([]database.Video, error) {
+	videos := []database.Video{}
+	for _, s := range scored {
+		video, ok, err := cfg.discoverableVideo(r, s.VideoID)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			videos = append(videos, video)
+		}
+	}
+	return videos, nil
+}
+
+// discoverableVideo loads a listed video as the viewer may see it. It
+// reports false when the video was deleted or hidden since it was listed.
+func (cfg *apiConfig) discoverableVideo(r *http.Request, videoID uuid.UUID) (database.Video, bool, error) {
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		return database.Video{}, false, err
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil || isVideoHidden(video) {
+		return database.Video{}, false, nil
+	}
+	video, err = cfg.withViewerRestrictions(r, video)
+	if err != nil {
+		return database.Video{}, false, err
+	}
+	video, err = cfg.localizeVideo(r, video)
+	if err != nil {
+		return database.Video{}, false, err
+	}
+	return cfg.withSignedURLs(cfg.applyAgeGate(r, video)), true, nil
+}
+
+// refreshDiscovery recomputes the trending and related videos, so listing
+// them is a lookup.
+func (cfg *apiConfig) refreshDiscovery(ctx context.Context) error {
+	videos, err := cfg.db.GetPublicVideos()
+	if err != nil {
+		return err
+	}
+	videos = slices.DeleteFunc(videos, isVideoHidden)
+
+	now := time.Now().UTC()
+	since := now.Add(-trendingWindow).Format(database.VideoViewDayLayout)
+	views, err := cfg.db.GetVideoViewsSince(since)
+	if err != nil {
+		return err
+	}
+	err = cfg.db.ReplaceTrendingVideos(trendingScores(videos, views, now))
+	if err != nil {
+		return err
+	}
+	if _, err := cfg.db.DeleteVideoViewsBefore(since); err != nil {
+		return err
+	}
+
+	return cfg.db.ReplaceRelatedVideos(relatedVideos(videos))
+}
+
+// trendingScores adds up the views of each video, halving their weight
+// every trendingHalfLife, and returns the highest scoring videos.
+func trendingScores(videos []database.Video, views []database.VideoViews, now time.Time) []database.ScoredVideo {
+	listed := map[uuid.UUID]bool{}
+	for _, video := range videos {
+		listed[video.ID] = true
+	}
+	today, _ := time.Parse(database.VideoViewDayLayout, now.Format(database.VideoViewDayLayout))
+
+	scores := map[uuid.UUID]float64{}
+	for _, v := range views {
+		if !listed[v.VideoID] {
+			continue
+		}
+		day, err := time.Parse(database.VideoViewDayLayout, v.Day)
+		if err != nil {
+			continue
+		}
+		age := today.Sub(day)
+		scores[v.VideoID] += float64(v.Views) * math.Pow(0.5, age.Hours()/trendingHalfLife.Hours())
+	}
+
+	trending := make([]database.ScoredVideo, 0, len(scores))
+	for id, score := range scores {
+		trending = append(trending, database.ScoredVideo{VideoID: id, Score: score})
+	}
+	slices.SortFunc(trending, func(a, b database.ScoredVideo) int {
+		if a.Score != b.Score {
+			return cmp.Compare(b.Score, a.Score)
+		}
+		return strings.Compare(a.VideoID.String(), b.VideoID.String())
+	})
+	if len(trending) > maxTrendingVideos {
+		trending = trending[:maxTrendingVideos]
+	}
+	return trending
+}
+
+// relatedVideos pairs up videos that share tags or the owner. Every shared
+// tag counts twice as much as a shared owner; ties go to newer videos.
+func relatedVideos(videos []database.Video) map[uuid.UUID][]database.ScoredVideo {
+	byTag := map[string][]int{}
+	byOwner := map[uuid.UUID][]int{}
+	for i, video := range videos {
+		for _, tag := range video.Tags {
+			byTag[tag] = append(byTag[tag], i)
+		}
+		byOwner[video.UserID] = append(byOwner[video.UserID], i)
+	}
+
+	related := map[uuid.UUID][]database.ScoredVideo{}
+	for i, video := range videos {
+		scores := map[int]float64{}
+		for _, tag := range video.Tags {
+			for _, j := range byTag[tag] {
+				scores[j] += 2
+			}
+		}
+		for _, j := range byOwner[video.UserID] {
+			scores[j]++
+		}
+		delete(scores, i)
+
+		candidates := make([]int, 0, len(scores))
+		for j := range scores {
+			candidates = append(candidates, j)
+		}
+		slices.SortFunc(candidates, func(a, b int) int {
+			if scores[a] != scores[b] {
+				return cmp.Compare(scores[b], scores[a])
+			}
+			return videos[b].CreatedAt.Compare(videos[a].CreatedAt)
+		})
+		if len(candidates) > maxRelatedVideos {
+			candidates = candidates[:maxRelatedVideos]
+		}
+		for _, j := range candidates {
+			related[video.ID] = append(related[video.ID], database.ScoredVideo{VideoID: videos[j].ID, Score: scores[j]})
+		}
+	}
+	return related
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/drm"
+	"github.com/google/uuid"
+)
+
+const jobTypePackageDRM = "package_drm"
+
+type packageDRMPayload struct {
+	VideoID uuid.UUID `json:"video_id"`
+}
+
+// drmLicenseServers are handed to players in the playback response so they
+// know where to request licenses for encrypted renditions.
+type drmLicenseServers struct {
+	WidevineLicenseURL     string `json:"widevine_license_url,omitempty"`
+	FairPlayLicenseURL     string `json:"fairplay_license_url,omitempty"`
+	FairPlayCertificateURL string `json:"fairplay_certificate_url,omitempty"`
+}
+
+type drmPlayback struct {
+	KeyID   uuid.UUID `json:"key_id"`
+	HLSURL  string    `json:"hls_url"`
+	DASHURL string    `json:"dash_url"`
+	drmLicenseServers
+}
+
+// requestDRMPackaging queues encrypted HLS/DASH packaging of the video's
+// current file when a key server is configured.
+func (cfg *apiConfig) requestDRMPackaging(videoID uuid.UUID) {
+	if cfg.drmKeyServer == nil {
+		return
+	}
+	_, err := cfg.enqueueJob(jobTypePackageDRM, &videoID, packageDRMPayload{VideoID: videoID})
+	if err != nil {
+		log.Printf("Couldn't queue DRM packaging for video %s: %v", videoID, err)
+	}
+}
+
+func (cfg *apiConfig) runPackageDRMJob(ctx context.Context, job database.Job) error {
+	var payload packageDRMPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+
+	video, err := cfg.db.GetVideo(payload.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.VideoURL == nil {
+		return fmt.Errorf("video %s has no file to package", payload.VideoID)
+	}
+	key, ok := cfg.objectKeyFromURL(*video.VideoURL)
+	if !ok {
+		return fmt.Errorf("video %s isn't stored in our bucket", payload.VideoID)
+	}
+
+	contentKey, err := cfg.drmKeyServer.GetContentKey(ctx, video.ID.String(), []string{
+		drm.WidevineSystemID,
+		drm.FairPlaySystemID,
+	})
+	if err != nil {
+		return fmt.Errorf("couldn't get content key: %w", err)
+	}
+
+	dir, err := os.MkdirTemp("", "tubely-drm")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	srcPath := filepath.Join(dir, "source.mp4")
+	srcFile, err := os.Create(srcPath)
+	if err != nil {
+		return err
+	}
+	err = cfg.downloadObject(ctx, key, srcFile)
+	srcFile.Close()
+	if err != nil {
+		return fmt.Errorf("couldn't download %s: %w", key, err)
+	}
+
+	outDir := filepath.Join(dir, "out")
+	err = cfg.packageEncrypted(ctx, srcPath, outDir, contentKey)
+	if err != nil {
+		return err
+	}
+
+	// a new key gets a fresh prefix so CDN caches never mix renditions
+	enc, err := cfg.objectEncryptionForUser(video.UserID)
+	if err != nil {
+		return err
+	}
+	tags, err := cfg.objectTagsForUser(video.UserID)
+	if err != nil {
+		return err
+	}
+	prefix := fmt.Sprintf("drm/%s/%s", video.ID, contentKey.KeyID)
+	err = cfg.uploadDirectory(ctx, outDir, prefix, enc, tags)
+	if err != nil {
+		return err
+	}
+
+	return cfg.db.UpsertVideoDRM(database.VideoDRM{
+		VideoID:        video.ID,
+		KeyID:          contentKey.KeyID,
+		HLSKey:         prefix + "/master.m3u8",
+		DASHKey:        prefix + "/manifest.mpd",
+		FairPlayKeyURI: contentKey.FairPlayKeyURI,
+	})
+}
+
+// packageEncrypted runs Shaka Packager over the source file to produce CENC
+// (cbcs) encrypted fMP4 renditions with both HLS and DASH manifests.
+func (cfg *apiConfig) packageEncrypted(ctx context.Context, srcPath, outDir string, key drm.ContentKey) error {
+	err := os.MkdirAll(outDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	hasAudio, err := videoHasAudio(ctx, srcPath)
+	if err != nil {
+		return err
+	}
+
+	args := []string{
+		fmt.Sprintf("in=%s,stream=video,init_segment=%s,segment_template=%s,playlist_name=video.m3u8",
+			srcPath,
+			filepath.Join(outDir, "video", "init.mp4"),
+			filepath.Join(outDir, "video", "$Number$.m4s"),
+		),
+	}
+	if hasAudio {
+		args = append(args, fmt.Sprintf("in=%s,stream=audio,init_segment=%s,segment_template=%s,playlist_name=audio.m3u8,hls_group_id=audio",
+			srcPath,
+			filepath.Join(outDir, "audio", "init.mp4"),
+			filepath.Join(outDir, "audio", "$Number$.m4s"),
+		))
+	}
+
+	// sort the system IDs so repeated runs produce identical init segments
+	systemIDs := make([]string, 0, len(key.PSSH))
+	for systemID := range key.PSSH {
+		systemIDs = append(systemIDs, systemID)
+	}
+	sort.Strings(systemIDs)
+	var pssh []byte
+	for _, systemID := range systemIDs {
+		pssh = append(pssh, key.PSSH[systemID]...)
+	}
+
+	args = append(args,
+		"--enable_raw_key_encryption",
+		"--protection_scheme", "cbcs",
+		"--keys", fmt.Sprintf("label=:key_id=%s:key=%s", strings.ReplaceAll(key.KeyID.String(), "-", ""), hex.EncodeToString(key.Key)),
+		"--mpd_output", filepath.Join(outDir, "manifest.mpd"),
+		"--hls_master_playlist_output", filepath.Join(outDir, "master.m3u8"),
+	)
+	if len(pssh) > 0 {
+		args = append(args, "--pssh", hex.EncodeToString(pssh))
+	}
+	if key.FairPlayKeyURI != "" {
+		args = append(args, "--hls_key_uri", key.FairPlayKeyURI)
+	}
+
+	cmd := exec.CommandContext(ctx, cfg.packagerBin, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return newCommandError("packager", err, stderr.Bytes())
+	}
+	return nil
+}
+
+func videoHasAudio(ctx context.Context, filePath string) (bool, error) {
+	cmd := ffmpegRunner.Command(ctx, "ffprobe", "-v", "error", "-select_streams", "a", "-show_entries", "stream=index", "-of", "csv=p=0", filePath)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+
+	err := cmd.Run()
+	if err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(out.String()) != "", nil
+}
+
+// videoDRMPlayback returns the encrypted renditions of a video, or nil when
+// it hasn't been packaged.
+func (cfg *apiConfig) videoDRMPlayback(videoID uuid.UUID) (*drmPlayback, error) {
+	if cfg.drmKeyServer == nil {
+		return nil, nil
+	}
+	videoDRM, err := cfg.db.GetVideoDRM(videoID)
+	if err != nil {
+		return nil, err
+	}
+	if videoDRM.VideoID == uuid.Nil {
+		return nil, nil
+	}
+	return &drmPlayback{
+		KeyID:             videoDRM.KeyID,
+		HLSURL:            cfg.objectURL(videoDRM.HLSKey),
+		DASHURL:           cfg.objectURL(videoDRM.DASHKey),
+		drmLicenseServers: cfg.drmLicenseServers,
+	}, nil
+}
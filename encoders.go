@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+)
+
+// videoEncoder is how ffmpeg encodes one codec. inputArgs go before the
+// first input, e.g. to open a hardware device, outputArgs replace -c:v.
+type videoEncoder struct {
+	name       string
+	accel      string
+	inputArgs  []string
+	outputArgs []string
+}
+
+const encoderProbeTimeout = 15 * time.Second
+
+const (
+	encoderAccelAuto  = "auto"
+	encoderAccelNone  = "none"
+	encoderAccelNVENC = "nvenc"
+	encoderAccelQSV   = "qsv"
+	encoderAccelVAAPI = "vaapi"
+)
+
+// softwareEncoders are always available and used whenever no hardware
+// encoder works for the codec.
+var softwareEncoders = map[string]videoEncoder{
+	"h264": {
+		name:       "libx264",
+		accel:      encoderAccelNone,
+		outputArgs: []string{"-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency", "-sc_threshold", "0"},
+	},
+}
+
+// hardwareEncoders lists the accelerated encoders of each codec in the
+// order auto-detection tries them.
+func hardwareEncoders(codec, vaapiDevice string) []videoEncoder {
+	switch codec {
+	case "h264":
+		return []videoEncoder{
+			{
+				name:       "h264_nvenc",
+				accel:      encoderAccelNVENC,
+				outputArgs: []string{"-c:v", "h264_nvenc", "-preset", "p3", "-tune", "ll", "-no-scenecut", "1"},
+			},
+			{
+				name:       "h264_qsv",
+				accel:      encoderAccelQSV,
+				outputArgs: []string{"-c:v", "h264_qsv", "-preset", "veryfast", "-scenario", "livestreaming"},
+			},
+			{
+				name:       "h264_vaapi",
+				accel:      encoderAccelVAAPI,
+				inputArgs:  []string{"-vaapi_device", vaapiDevice},
+				outputArgs: []string{"-vf", "format=nv12,hwupload", "-c:v", "h264_vaapi"},
+			},
+		}
+	}
+	return nil
+}
+
+// detectVideoEncoder picks the encoder for codec. With accel "auto" it uses
+// the first hardware encoder that can actually encode a test frame on this
+// host, with a specific accel only that one is tried. It falls back to the
+// software encoder when none works.
+func detectVideoEncoder(codec, accel, vaapiDevice string) (videoEncoder, error) {
+	software, ok := softwareEncoders[codec]
+	if !ok {
+		return videoEncoder{}, fmt.Errorf("unsupported codec %q", codec)
+	}
+	if accel == encoderAccelNone {
+		return software, nil
+	}
+
+	candidates := hardwareEncoders(codec, vaapiDevice)
+	if accel != encoderAccelAuto {
+		candidates = slices.DeleteFunc(candidates, func(e videoEncoder) bool {
+			return e.accel != accel
+		})
+		if len(candidates) == 0 {
+			return videoEncoder{}, fmt.Errorf("no %s encoder for %s", accel, codec)
+		}
+	}
+
+	for _, encoder := range candidates {
+		err := probeVideoEncoder(encoder)
+		if err == nil {
+			return encoder, nil
+		}
+		if accel != encoderAccelAuto {
+			log.Printf("Encoder %s doesn't work on this host, falling back to %s: %v", encoder.name, software.name, err)
+		}
+	}
+	return software, nil
+}
+
+// probeVideoEncoder encodes a single generated frame, which fails quickly
+// when ffmpeg was built without the encoder or the GPU isn't there.
+func probeVideoEncoder(encoder videoEncoder) error {
+	ctx, cancel := context.WithTimeout(context.Background(), encoderProbeTimeout)
+	defer cancel()
+
+	args := slices.Concat(
+		[]string{"-hide_banner", "-v", "error"},
+		encoder.inputArgs,
+		[]string{"-f", "lavfi", "-i", "color=size=256x144:rate=30:duration=0.1", "-frames:v", "1"},
+		encoder.outputArgs,
+		[]string{"-f", "null", "-"},
+	)
+	cmd := ffmpegRunner.Command(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return newCommandError("ffmpeg", err, lastLines(stderr.Bytes(), 3))
+	}
+	return nil
+}
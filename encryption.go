@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/google/uuid"
+)
+
+var kmsKeyARNRegexp = regexp.MustCompile(`^arn:aws[a-z-]*:kms:[a-z0-9-]+:[0-9]{12}:key/[A-Za-z0-9-]+$`)
+
+// objectEncryption is the server-side encryption S3 applies to the objects
+// we upload. The zero value leaves it to the bucket's default encryption.
+type objectEncryption struct {
+	algorithm types.ServerSideEncryption
+	// kmsKeyID is only used with aws:kms, empty means the AWS managed key
+	kmsKeyID string
+}
+
+// parseObjectEncryption reads the S3_SSE setting: empty, "AES256" for SSE-S3
+// or "aws:kms" for SSE-KMS with an optional key.
+func parseObjectEncryption(algorithm, kmsKeyID string) (objectEncryption, error) {
+	switch types.ServerSideEncryption(algorithm) {
+	case "":
+		if kmsKeyID != "" {
+			return objectEncryption{}, fmt.Errorf("a KMS key needs S3_SSE=%s", types.ServerSideEncryptionAwsKms)
+		}
+		return objectEncryption{}, nil
+	case types.ServerSideEncryptionAes256:
+		if kmsKeyID != "" {
+			return objectEncryption{}, fmt.Errorf("a KMS key needs S3_SSE=%s", types.ServerSideEncryptionAwsKms)
+		}
+		return objectEncryption{algorithm: types.ServerSideEncryptionAes256}, nil
+	case types.ServerSideEncryptionAwsKms:
+		return objectEncryption{algorithm: types.ServerSideEncryptionAwsKms, kmsKeyID: kmsKeyID}, nil
+	}
+	return objectEncryption{}, fmt.Errorf("unsupported server-side encryption %q", algorithm)
+}
+
+func (e objectEncryption) applyPut(input *s3.PutObjectInput) {
+	if e.algorithm == "" {
+		return
+	}
+	input.ServerSideEncryption = e.algorithm
+	if e.kmsKeyID != "" {
+		input.SSEKMSKeyId = aws.String(e.kmsKeyID)
+	}
+}
+
+func (e objectEncryption) applyCopy(input *s3.CopyObjectInput) {
+	if e.algorithm == "" {
+		return
+	}
+	input.ServerSideEncryption = e.algorithm
+	if e.kmsKeyID != "" {
+		input.SSEKMSKeyId = aws.String(e.kmsKeyID)
+	}
+}
+
+// objectEncryptionForUser returns the encryption of objects owned by the
+// user. Organizations with their own KMS key get it instead of the default.
+func (cfg *apiConfig) objectEncryptionForUser(userID uuid.UUID) (objectEncryption, error) {
+	org, err := cfg.db.GetOrganizationByUser(userID)
+	if err != nil {
+		return objectEncryption{}, fmt.Errorf("couldn't get organization of user %s: %w", userID, err)
+	}
+	if org.KMSKeyARN != nil {
+		return objectEncryption{algorithm: types.ServerSideEncryptionAwsKms, kmsKeyID: *org.KMSKeyARN}, nil
+	}
+	return cfg.objectEncryption, nil
+}
+
+// handlerAdminOrganizationKMSKey sets the KMS key the organization's objects
+// are encrypted with, null goes back to the default. Existing objects keep
+// the key they were written with.
+func (cfg *apiConfig) handlerAdminOrganizationKMSKey(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		KMSKeyARN *string `json:"kms_key_arn"`
+	}
+
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	orgIDString := r.PathValue("organizationID")
+	orgID, err := uuid.Parse(orgIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.KMSKeyARN != nil && !kmsKeyARNRegexp.MatchString(*params.KMSKeyARN) {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "kms_key_arn must be a KMS key ARN", nil)
+		return
+	}
+
+	org, err := cfg.db.GetOrganization(orgID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get organization", err)
+		return
+	}
+	if org.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeOrganizationNotFound, "Couldn't find organization", nil)
+		return
+	}
+
+	err = cfg.db.SetOrganizationKMSKey(org.ID, params.KMSKeyARN)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update organization", err)
+		return
+	}
+	org.KMSKeyARN = params.KMSKeyARN
+
+	cfg.respondWithOrganization(w, http.StatusOK, org)
+}
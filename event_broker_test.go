@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func testBrokerEvent() brokerEvent {
+	videoURL := "https://cdn.example.com/landscape/a.mp4"
+	created := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	return newBrokerEvent(videoEvent{
+		ID:         uuid.MustParse("7f0f3c4e-5d2b-4c1a-9f6e-1b2c3d4e5f60"),
+		Name:       eventVideoProcessed,
+		OccurredAt: created.Add(time.Minute),
+		Video: database.Video{
+			ID:        uuid.MustParse("0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d"),
+			CreatedAt: created,
+			UpdatedAt: created,
+			VideoURL:  &videoURL,
+			CreateVideoParams: database.CreateVideoParams{
+				Title:      "Boots",
+				UserID:     uuid.MustParse("11111111-2222-4333-8444-555555555555"),
+				Visibility: database.VisibilityPublic,
+			},
+		},
+	})
+}
+
+// TestBrokerEventSchema pins the JSON consumers rely on. Adding fields is
+// fine, changing or removing any needs a new schema version.
+func TestBrokerEventSchema(t *testing.T) {
+	got, err := json.Marshal(testBrokerEvent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"schema":"tubely.video_event.v1","id":"7f0f3c4e-5d2b-4c1a-9f6e-1b2c3d4e5f60","type":"video.processed","occurred_at":"2026-03-01T12:01:00Z",` +
+		`"video":{"id":"0a1b2c3d-4e5f-4a6b-8c7d-9e0f1a2b3c4d","user_id":"11111111-2222-4333-8444-555555555555","created_at":"2026-03-01T12:00:00Z","updated_at":"2026-03-01T12:00:00Z",` +
+		`"title":"Boots","description":"","visibility":"public","publish_at":null,"tags":[],"metadata":null,"external_id":null,` +
+		`"video_url":"https://cdn.example.com/landscape/a.mp4","thumbnail_url":null}}`
+	if string(got) != want {
+		t.Errorf("got  %s\nwant %s", got, want)
+	}
+}
+
+func TestKafkaRESTBroker(t *testing.T) {
+	var gotPath, gotAuth, gotType string
+	var gotBody kafkaRecords
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		gotType = r.Header.Get("Content-Type")
+		user, password, _ := r.BasicAuth()
+		gotAuth = user + ":" + password
+		json.NewDecoder(r.Body).Decode(&gotBody)
+		if gotBody.Records[0].Value.Video.Title == "refused" {
+			io.WriteString(w, `{"offsets":[{"partition":null,"offset":null,"error_code":50002,"error":"not leader"}]}`)
+			return
+		}
+		io.WriteString(w, `{"offsets":[{"partition":0,"offset":42,"error_code":null,"error":null}]}`)
+	}))
+	defer server.Close()
+
+	broker, err := newEventBroker("kafka", strings.Replace(server.URL, "http://", "http://user:secret@", 1), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := testBrokerEvent()
+	if err := broker.Publish(context.Background(), event); err != nil {
+		t.Fatalf("Publish: %v", err)
+	}
+	if gotPath != "/topics/tubely.events" {
+		t.Errorf("path = %q", gotPath)
+	}
+	if gotAuth != "user:secret" {
+		t.Errorf("basic auth = %q", gotAuth)
+	}
+	if gotType != "application/vnd.kafka.json.v2+json" {
+		t.Errorf("content type = %q", gotType)
+	}
+	if len(gotBody.Records) != 1 || gotBody.Records[0].Key != event.Video.ID.String() || gotBody.Records[0].Value.ID != event.ID {
+		t.Errorf("records = %+v", gotBody.Records)
+	}
+
+	event.Video.Title = "refused"
+	if err := broker.Publish(context.Background(), event); err == nil {
+		t.Error("Publish ignored a record error")
+	}
+}
+
+// fakeNATS is a NATS server that wants the token s3cret and reports the
+// subject and payload of every publish.
+func fakeNATS(t *testing.T, published chan<- string) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				io.WriteString(conn, "INFO {\"server_id\":\"fake\",\"max_payload\":1048576}\r\n")
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					line = strings.TrimRight(line, "\r\n")
+					switch {
+					case strings.HasPrefix(line, "CONNECT "):
+						if !strings.Contains(line, `"auth_token":"s3cret"`) {
+							io.WriteString(conn, "-ERR 'Authorization Violation'\r\n")
+							return
+						}
+						// servers ping clients now and then
+						io.WriteString(conn, "PING\r\n")
+					case strings.HasPrefix(line, "PUB "):
+						fields := strings.Fields(line)
+						size, _ := strconv.Atoi(fields[2])
+						payload := make([]byte, size+2)
+						if _, err := io.ReadFull(r, payload); err != nil {
+							return
+						}
+						published <- fields[1] + " " + string(payload[:size])
+					case line == "PING":
+						io.WriteString(conn, "PONG\r\n")
+					}
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestNATSBroker(t *testing.T) {
+	published := make(chan string, 2)
+	addr := fakeNATS(t, published)
+
+	broker, err := newEventBroker("nats", "nats://s3cret@"+addr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := testBrokerEvent()
+	for i := 0; i < 2; i++ {
+		if err := broker.Publish(context.Background(), event); err != nil {
+			t.Fatalf("Publish %d: %v", i, err)
+		}
+		subject, payload, _ := strings.Cut(<-published, " ")
+		if subject != "tubely.events.video.processed" {
+			t.Errorf("subject = %q", subject)
+		}
+		var got brokerEvent
+		if err := json.Unmarshal([]byte(payload), &got); err != nil || got.ID != event.ID {
+			t.Errorf("payload = %s (%v)", payload, err)
+		}
+	}
+
+	wrongToken, err := newEventBroker("nats", "nats://wrong@"+addr, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := wrongToken.Publish(context.Background(), event); err == nil || !strings.Contains(err.Error(), "Authorization Violation") {
+		t.Errorf("Publish with a wrong token: %v", err)
+	}
+}
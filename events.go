@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"slices"
+	"sync/atomic"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// domain events about videos, subscribers react to them instead of the
+// handlers calling every side effect themselves
+const (
+	eventVideoCreated = "video.created"
+	// published when processing an upload finished or failed
+	eventVideoProcessed = "video.processed"
+	// published when a video is purged for good, not when it's trashed
+	eventVideoDeleted = "video.deleted"
+)
+
+const (
+	jobTypeDispatchEvent = "dispatch_event"
+
+	eventDispatchSync  = "sync"
+	eventDispatchAsync = "async"
+)
+
+type videoEvent struct {
+	// ID stays the same through retries, so receivers can drop duplicates
+	ID         uuid.UUID      `json:"id"`
+	Name       string         `json:"name"`
+	OccurredAt time.Time      `json:"occurred_at"`
+	Video      database.Video `json:"video"`
+	// Error is why processing failed, only set on failed video.processed
+	Error string `json:"error,omitempty"`
+}
+
+type eventHandler func(ctx context.Context, event videoEvent) error
+
+type eventSubscriber struct {
+	// name identifies the subscriber in queued deliveries, so renaming one
+	// orphans its pending deliveries
+	name   string
+	events []string
+	handle eventHandler
+}
+
+func (cfg *apiConfig) eventSubscribers() []eventSubscriber {
+	subscribers := []eventSubscriber{
+		{
+			name:   "webhook",
+			events: []string{eventVideoCreated, eventVideoProcessed, eventVideoDeleted},
+			handle: cfg.sendEventWebhook,
+		},
+		{
+			name:   "notifications",
+			events: []string{eventVideoProcessed},
+			handle: cfg.notifyVideoEvent,
+		},
+		{
+			name:   "analytics",
+			events: []string{eventVideoCreated, eventVideoProcessed, eventVideoDeleted},
+			handle: countVideoEvent,
+		},
+		{
+			name:   "cdn",
+			events: []string{eventVideoDeleted},
+			handle: cfg.invalidateDeletedVideo,
+		},
+	}
+	if cfg.eventBroker != nil {
+		subscribers = append(subscribers, eventSubscriber{
+			name:   "broker",
+			events: []string{eventVideoCreated, eventVideoProcessed, eventVideoDeleted},
+			handle: cfg.publishToBroker,
+		})
+	}
+	return subscribers
+}
+
+type dispatchEventPayload struct {
+	Subscriber string     `json:"subscriber"`
+	Event      videoEvent `json:"event"`
+}
+
+// publishEvent hands the event to its subscribers. Sync dispatch runs them
+// one after another before returning, async dispatch queues a job per
+// subscriber so a slow or failing one is retried on its own without holding
+// up the request. Failures are logged rather than failing whatever
+// published the event.
+func (cfg *apiConfig) publishEvent(ctx context.Context, name string, video database.Video, eventErr error) {
+	event := videoEvent{
+		ID:         uuid.New(),
+		Name:       name,
+		OccurredAt: time.Now().UTC(),
+		Video:      video,
+	}
+	if eventErr != nil {
+		event.Error = eventErr.Error()
+	}
+
+	for _, subscriber := range cfg.eventSubscribers() {
+		if !slices.Contains(subscriber.events, name) {
+			continue
+		}
+		if cfg.eventDispatch == eventDispatchAsync {
+			_, err := cfg.enqueueJob(jobTypeDispatchEvent, nil, dispatchEventPayload{
+				Subscriber: subscriber.name,
+				Event:      event,
+			})
+			if err != nil {
+				log.Printf("Couldn't queue %s event of video %s for %s: %v", name, video.ID, subscriber.name, err)
+			}
+			continue
+		}
+		// sync subscribers outlive a cancelled request, like the side
+		// effects they replace
+		if err := subscriber.handle(context.WithoutCancel(ctx), event); err != nil {
+			log.Printf("Couldn't handle %s event of video %s in %s: %v", name, video.ID, subscriber.name, err)
+		}
+	}
+}
+
+func (cfg *apiConfig) runDispatchEventJob(ctx context.Context, job database.Job) error {
+	var payload dispatchEventPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+	for _, subscriber := range cfg.eventSubscribers() {
+		if subscriber.name == payload.Subscriber {
+			return subscriber.handle(ctx, payload.Event)
+		}
+	}
+	return fmt.Errorf("unknown event subscriber %q", payload.Subscriber)
+}
+
+func (cfg *apiConfig) sendEventWebhook(ctx context.Context, event videoEvent) error {
+	type data struct {
+		database.Video
+		ProcessingError string `json:"processing_error,omitempty"`
+	}
+	return cfg.sendWebhook(ctx, event.Name, data{Video: event.Video, ProcessingError: event.Error})
+}
+
+func (cfg *apiConfig) notifyVideoEvent(ctx context.Context, event videoEvent) error {
+	if event.Error != "" {
+		cfg.notifyProcessingFailed(event.Video, event.Error)
+	} else {
+		cfg.notifyProcessingFinished(event.Video)
+	}
+	return nil
+}
+
+// videoEventCounts counts the events the analytics subscriber handled in
+// this process, by name.
+var videoEventCounts = map[string]*atomic.Int64{
+	eventVideoCreated:   {},
+	eventVideoProcessed: {},
+	eventVideoDeleted:   {},
+}
+
+func countVideoEvent(ctx context.Context, event videoEvent) error {
+	if count, ok := videoEventCounts[event.Name]; ok {
+		count.Add(1)
+	}
+	return nil
+}
+
+// invalidateDeletedVideo drops the purged video's file and thumbnail from
+// the CDN, which would otherwise keep serving them until they expire.
+func (cfg *apiConfig) invalidateDeletedVideo(ctx context.Context, event videoEvent) error {
+	keys := []string{}
+	for _, url := range []*string{event.Video.VideoURL, event.Video.ThumbnailURL} {
+		if url == nil {
+			continue
+		}
+		if key, ok := cfg.objectKeyFromURL(*url); ok {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return cfg.invalidateCDNKeys(ctx, keys...)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// webhookReceiver records the events posted to it.
+func webhookReceiver(t *testing.T, cfg *apiConfig) func() []string {
+	t.Helper()
+	var mu sync.Mutex
+	events := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		events = append(events, r.Header.Get("X-Tubely-Event"))
+	}))
+	t.Cleanup(server.Close)
+	cfg.webhookURL = server.URL
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), events...)
+	}
+}
+
+func TestPublishEventSync(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.eventDispatch = eventDispatchSync
+	received := webhookReceiver(t, cfg)
+	before := videoEventCounts[eventVideoCreated].Load()
+
+	cfg.publishEvent(context.Background(), eventVideoCreated, database.Video{ID: uuid.New()}, nil)
+
+	if got := received(); len(got) != 1 || got[0] != eventVideoCreated {
+		t.Errorf("webhooks = %v, want one %s", got, eventVideoCreated)
+	}
+	if got := videoEventCounts[eventVideoCreated].Load() - before; got != 1 {
+		t.Errorf("counted %d events, want 1", got)
+	}
+}
+
+func TestPublishEventAsync(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.eventDispatch = eventDispatchAsync
+	cfg.jobQueue = dbJobQueue{db: cfg.db, visibilityTimeout: time.Minute}
+	received := webhookReceiver(t, cfg)
+	before := videoEventCounts[eventVideoDeleted].Load()
+
+	cfg.publishEvent(context.Background(), eventVideoDeleted, database.Video{ID: uuid.New()}, nil)
+	if got := received(); len(got) != 0 {
+		t.Fatalf("webhooks = %v before the jobs ran", got)
+	}
+
+	// one job per subscriber of the event
+	jobs := 0
+	for {
+		id, err := cfg.db.NextJobID(jobRetryDelay, time.Minute, jobPriorityAgingInterval)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id == uuid.Nil {
+			break
+		}
+		if _, err := cfg.db.ClaimJob(id, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		job, err := cfg.db.GetJob(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cfg.runDispatchEventJob(context.Background(), job); err != nil {
+			t.Errorf("job %s: %v", job.Payload, err)
+		}
+		if err := cfg.db.CompleteJob(id); err != nil {
+			t.Fatal(err)
+		}
+		jobs++
+	}
+	if jobs != 3 {
+		t.Errorf("queued %d jobs, want one for each of the 3 subscribers", jobs)
+	}
+	if got := received(); len(got) != 1 || got[0] != eventVideoDeleted {
+		t.Errorf("webhooks = %v, want one %s", got, eventVideoDeleted)
+	}
+	if got := videoEventCounts[eventVideoDeleted].Load() - before; got != 1 {
+		t.Errorf("counted %d events, want 1", got)
+	}
+}
+
+func TestDispatchEventJobUnknownSubscriber(t *testing.T) {
+	cfg := newTestConfig(t)
+	err := cfg.runDispatchEventJob(context.Background(), database.Job{CreateJobParams: database.CreateJobParams{Payload: []byte(`{"subscriber":"gone"}`)}})
+	if err == nil {
+		t.Error("ran a delivery of an unknown subscriber")
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+)
+
+// FFmpegRunner makes the commands media is probed and processed with,
+// "ffmpeg" or "ffprobe" with their arguments. Tests swap in one that runs a
+// fake, so the pipeline can be exercised without the binaries.
+type FFmpegRunner interface {
+	Command(ctx context.Context, name string, args ...string) *exec.Cmd
+}
+
+// execFFmpeg runs the binaries found on PATH.
+type execFFmpeg struct{}
+
+func (execFFmpeg) Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, name, args...)
+}
+
+// ffmpegRunner runs every ffmpeg and ffprobe command of the app.
+var ffmpegRunner FFmpegRunner = execFFmpeg{}
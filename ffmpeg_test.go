@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// fakeFFmpegEnv names the tool the test binary stands in for when it's run
+// by fakeFFmpeg.
+const fakeFFmpegEnv = "TUBELY_FAKE_FFMPEG"
+
+func TestMain(m *testing.M) {
+	if name := os.Getenv(fakeFFmpegEnv); name != "" {
+		os.Exit(runFakeFFmpeg(name, os.Args[1:]))
+	}
+	os.Exit(m.Run())
+}
+
+// fakeFFmpeg runs the test binary in place of ffmpeg and ffprobe. Every
+// source looks like a 10 second 1280x720 H.264 video with AAC audio.
+// Outputs are copies of the input, a small gray JPEG for images or a single
+// segment HLS playlist, and each command is logged so tests can check what
+// ran.
+type fakeFFmpeg struct {
+	logPath string
+}
+
+// useFakeFFmpeg makes the app run fakeFFmpeg until the test ends.
+func useFakeFFmpeg(t *testing.T) *fakeFFmpeg {
+	t.Helper()
+	fake := &fakeFFmpeg{logPath: filepath.Join(t.TempDir(), "ffmpeg.log")}
+	previous := ffmpegRunner
+	ffmpegRunner = fake
+	t.Cleanup(func() { ffmpegRunner = previous })
+	return fake
+}
+
+func (f *fakeFFmpeg) Command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, os.Args[0], args...)
+	cmd.Env = append(os.Environ(), fakeFFmpegEnv+"="+name, "TUBELY_FAKE_FFMPEG_LOG="+f.logPath)
+	return cmd
+}
+
+// calls returns the commands run so far, each as the tool's name followed
+// by its arguments.
+func (f *fakeFFmpeg) calls(t *testing.T) [][]string {
+	t.Helper()
+	file, err := os.Open(f.logPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	calls := [][]string{}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		var call []string
+		if err := json.Unmarshal(scanner.Bytes(), &call); err != nil {
+			t.Fatal(err)
+		}
+		calls = append(calls, call)
+	}
+	return calls
+}
+
+func runFakeFFmpeg(name string, args []string) int {
+	if logPath := os.Getenv("TUBELY_FAKE_FFMPEG_LOG"); logPath != "" {
+		f, err := os.OpenFile(logPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err == nil {
+			line, _ := json.Marshal(append([]string{name}, args...))
+			f.Write(append(line, '\n'))
+			f.Close()
+		}
+	}
+
+	// ffprobe takes the file last, ffmpeg after -i unless it's a lavfi
+	// source like color=size=256x144
+	var input string
+	if name == "ffprobe" && len(args) > 0 {
+		input = args[len(args)-1]
+	} else if i := slices.Index(args, "-i"); i >= 0 && i+1 < len(args) && !slices.Contains(args, "lavfi") {
+		input = args[i+1]
+	}
+	if input != "" {
+		if info, err := os.Stat(input); err != nil || info.Size() == 0 {
+			fmt.Fprintf(os.Stderr, "%s: Invalid data found when processing input\n", input)
+			return 1
+		}
+	}
+
+	switch name {
+	case "ffprobe":
+		if slices.Contains(args, "csv=p=0") {
+			// index of the audio stream
+			fmt.Println("1")
+			return 0
+		}
+		fmt.Print(fakeProbeJSON)
+		return 0
+	case "ffmpeg":
+		return fakeFFmpegOutput(input, args)
+	}
+	fmt.Fprintf(os.Stderr, "unknown tool %s\n", name)
+	return 1
+}
+
+const fakeProbeJSON = `{
+	"streams": [
+		{"index": 0, "codec_type": "video", "codec_name": "h264", "pix_fmt": "yuv420p", "width": 1280, "height": 720, "duration": "10.000000"},
+		{"index": 1, "codec_type": "audio", "codec_name": "aac", "duration": "10.000000"}
+	],
+	"format": {"format_name": "mov,mp4,m4a,3gp,3g2,mj2", "duration": "10.000000"}
+}
+`
+
+func fakeFFmpegOutput(input string, args []string) int {
+	output := args[len(args)-1]
+	var err error
+	switch {
+	case output == "-":
+		if slices.Contains(args, "rawvideo") {
+			// a 9x8 gray gradient, for frame hashes
+			pixels := make([]byte, 9*8)
+			for i := range pixels {
+				pixels[i] = byte(i % 9 * 20)
+			}
+			_, err = os.Stdout.Write(pixels)
+		}
+	case slices.Contains(args, "-hls_segment_filename"):
+		segment := fmt.Sprintf(args[slices.Index(args, "-hls_segment_filename")+1], 0)
+		playlist := "#EXTM3U\n#EXT-X-VERSION:3\n#EXT-X-TARGETDURATION:10\n#EXT-X-PLAYLIST-TYPE:VOD\n" +
+			"#EXTINF:10.000000,\n" + filepath.Base(segment) + "\n#EXT-X-ENDLIST\n"
+		err = copyFile(input, segment)
+		if err == nil {
+			err = os.WriteFile(output, []byte(playlist), 0644)
+		}
+	case isImagePath(output):
+		// JPEG whatever the extension, nothing looks closer
+		img := image.NewGray(image.Rect(0, 0, 16, 9))
+		for i := range img.Pix {
+			img.Pix[i] = 128
+		}
+		img.Set(0, 0, color.Gray{Y: 255})
+		var out bytes.Buffer
+		err = jpeg.Encode(&out, img, nil)
+		if err == nil {
+			err = os.WriteFile(output, out.Bytes(), 0644)
+		}
+	case input != "":
+		err = copyFile(input, output)
+	default:
+		// generated from a lavfi source
+		err = os.WriteFile(output, nil, 0644)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
+
+func isImagePath(path string) bool {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".jpg", ".jpeg", ".png", ".webp":
+		return true
+	}
+	return false
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+func TestValidateProcessedWithFakeFFmpeg(t *testing.T) {
+	fake := useFakeFFmpeg(t)
+	path := filepath.Join(t.TempDir(), "video.mp4")
+	if err := os.WriteFile(path, []byte("not really a video"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := probeSource(context.Background(), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if source.VideoCodec != "h264" || source.Duration != 10 {
+		t.Errorf("probed %+v", source)
+	}
+	if err := validateProcessed(context.Background(), path, source.Duration); err != nil {
+		t.Errorf("validateProcessed: %v", err)
+	}
+	if calls := fake.calls(t); len(calls) < 2 || calls[0][0] != "ffprobe" {
+		t.Errorf("ran %v", calls)
+	}
+
+	// files ffmpeg can't read fail the way they do with the real thing
+	empty := filepath.Join(t.TempDir(), "empty.mp4")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := probeSource(context.Background(), empty); err == nil {
+		t.Error("probed an empty file")
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// the server refuses larger headers before any handler runs, the checks
+	// below apply the same limit exactly
+	maxRequestHeaderBytes = 32 << 10
+	// no legitimate client sends a single header this long
+	maxRequestHeaderValueBytes = 8 << 10
+)
+
+// requestsBlocked counts requests the firewall refused since the process
+// started.
+var requestsBlocked atomic.Int64
+
+// ipList is a set of addresses and networks from the configuration.
+type ipList []netip.Prefix
+
+// parseIPList reads comma separated IPs and CIDR ranges.
+func parseIPList(s string) (ipList, error) {
+	list := ipList{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, prefix.Masked())
+	}
+	return list, nil
+}
+
+func (l ipList) contains(addr netip.Addr) bool {
+	// an IPv4 client on a dual stack listener shows up as ::ffff:a.b.c.d
+	addr = addr.Unmap()
+	for _, prefix := range l {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// firewallMiddleware refuses requests from denied addresses, from addresses
+// missing from the allowlist when there is one, and requests no client of
+// ours sends: path traversal attempts and oversized headers. It runs before
+// routing, so blocked requests never reach a handler.
+func (cfg *apiConfig) firewallMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(cfg.ipAllowlist) > 0 || len(cfg.ipDenylist) > 0 {
+			addr, ok := cfg.clientIP(r)
+			if !ok || cfg.ipDenylist.contains(addr) || (len(cfg.ipAllowlist) > 0 && !cfg.ipAllowlist.contains(addr)) {
+				blockRequest(w, r, http.StatusForbidden, errCodeForbidden, "Access denied", fmt.Sprintf("address %s not allowed", addr))
+				return
+			}
+		}
+
+		if reason := oversizedHeader(r.Header); reason != "" {
+			blockRequest(w, r, http.StatusRequestHeaderFieldsTooLarge, errCodeValidationFailed, "Request headers too large", reason)
+			return
+		}
+		if reason := traversalAttempt(r); reason != "" {
+			blockRequest(w, r, http.StatusBadRequest, errCodeMalformedRequest, "Invalid request path", reason)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func blockRequest(w http.ResponseWriter, r *http.Request, code int, errCode apiErrorCode, msg, reason string) {
+	requestsBlocked.Add(1)
+	log.Printf("[%s] blocked %s %s: %s", w.Header().Get(requestIDHeader), r.Method, r.URL.EscapedPath(), reason)
+	respondWithError(w, code, errCode, msg, nil)
+}
+
+// oversizedHeader describes what is too large about the headers, or returns
+// an empty string when they are fine.
+func oversizedHeader(header http.Header) string {
+	total := 0
+	for name, values := range header {
+		for _, value := range values {
+			if len(value) > maxRequestHeaderValueBytes {
+				return fmt.Sprintf("header %s is %d bytes", name, len(value))
+			}
+			total += len(name) + len(value)
+		}
+	}
+	if total > maxRequestHeaderBytes {
+		return fmt.Sprintf("headers are %d bytes", total)
+	}
+	return ""
+}
+
+// traversalAttempt looks for ".." segments and NUL bytes in the path and
+// query, the usual ways of escaping a directory. Both are checked decoded,
+// so "%2e%2e%2f" counts too. It describes what it found, or returns an
+// empty string.
+func traversalAttempt(r *http.Request) string {
+	if hasTraversal(r.URL.Path) {
+		return "traversal in path"
+	}
+	for _, values := range r.URL.Query() {
+		for _, value := range values {
+			if hasTraversal(value) {
+				return "traversal in query"
+			}
+		}
+	}
+	return ""
+}
+
+// hasTraversal reports whether s has a NUL byte or a ".." segment between
+// forward or back slashes.
+func hasTraversal(s string) bool {
+	if strings.ContainsRune(s, 0) {
+		return true
+	}
+	for _, segment := range strings.FieldsFunc(s, func(r rune) bool { return r == '/' || r == '\\' }) {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFirewallIgnoresForgedForwardedFor(t *testing.T) {
+	denylist, err := parseIPList("198.51.100.7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &apiConfig{trustProxyHeaders: true, trustedProxyHops: 2, ipDenylist: denylist}
+	handler := cfg.firewallMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name      string
+		forwarded []string
+		want      int
+	}{
+		// CloudFront appends the client, the load balancer CloudFront's edge
+		{"denied client", []string{"198.51.100.7, 203.0.113.10"}, http.StatusForbidden},
+		{"forged entry in front", []string{"192.0.2.1, 198.51.100.7, 203.0.113.10"}, http.StatusForbidden},
+		{"forged header line in front", []string{"192.0.2.1", "198.51.100.7, 203.0.113.10"}, http.StatusForbidden},
+		{"allowed client", []string{"198.51.100.7, 192.0.2.1, 203.0.113.10"}, http.StatusNoContent},
+		// too few entries, the proxies were bypassed
+		{"direct request", []string{"192.0.2.1"}, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api/videos", nil)
+			req.RemoteAddr = "198.51.100.7:4321"
+			for _, value := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.want {
+				t.Errorf("got %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
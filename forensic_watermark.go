@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Forensic watermarking uses A/B segments: every segment of the HLS
+// rendition is encoded twice with a different faint mark, and each viewer
+// gets a playlist that picks A or B per segment from a pattern derived from
+// their user ID. The marks of a leaked copy spell out the pattern, which
+// points back to the viewer.
+const (
+	watermarkVariantA = "a"
+	watermarkVariantB = "b"
+
+	// the pattern repeats after this many segments, about 25 minutes
+	watermarkPatternBits = sha256.Size * 8
+	// fewer known segments match too many viewers by chance
+	minWatermarkSegments = 16
+)
+
+// watermarkFilters mark each variant with a small translucent box, A in the
+// top left corner and B in the bottom right. They survive re-encoding and
+// screen recording but are hard to spot while watching.
+var watermarkFilters = map[string]string{
+	watermarkVariantA: "drawbox=x=iw*0.03:y=ih*0.03:w=iw/48:h=iw/48:color=white@0.06:t=fill",
+	watermarkVariantB: "drawbox=x=iw*0.97-iw/48:y=ih*0.97-iw/48:w=iw/48:h=iw/48:color=white@0.06:t=fill",
+}
+
+// packageWatermarkedHLS encodes the A and B variants into subdirectories of
+// outDir and encrypts both with the same keys, so a playlist can mix their
+// segments freely.
+func (cfg *apiConfig) packageWatermarkedHLS(ctx context.Context, srcPath, outDir string, videoID uuid.UUID) ([][]byte, error) {
+	variants := []string{watermarkVariantA, watermarkVariantB}
+	for _, variant := range variants {
+		err := segmentHLS(ctx, srcPath, filepath.Join(outDir, variant),
+			"-vf", watermarkFilters[variant],
+			"-c:v", "libx264",
+			"-preset", "veryfast",
+			"-crf", "20",
+			// keyframes at fixed times so both variants are cut at the same
+			// points
+			"-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%d)", hlsSegmentSeconds),
+			"-sc_threshold", "0",
+			"-c:a", "copy",
+		)
+		if err != nil {
+			return nil, withStage("watermark_"+variant, err)
+		}
+	}
+
+	playlistA, err := os.ReadFile(filepath.Join(outDir, watermarkVariantA, "plain.m3u8"))
+	if err != nil {
+		return nil, err
+	}
+	playlistB, err := os.ReadFile(filepath.Join(outDir, watermarkVariantB, "plain.m3u8"))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(playlistA, playlistB) {
+		return nil, errors.New("watermark variants were segmented differently")
+	}
+
+	var keys [][]byte
+	for _, variant := range variants {
+		keys, err = cfg.encryptHLS(filepath.Join(outDir, variant), videoID, keys)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return keys, nil
+}
+
+// watermarkPattern is the viewer's A/B pattern for the video. It's keyed
+// with the JWT secret so viewers can't work out each other's patterns.
+func (cfg *apiConfig) watermarkPattern(videoID, userID uuid.UUID) []byte {
+	mac := hmac.New(sha256.New, []byte(cfg.jwtSecret))
+	fmt.Fprintf(mac, "forensic-watermark:%s:%s", videoID, userID)
+	return mac.Sum(nil)
+}
+
+// watermarkVariant returns the variant the pattern picks for a segment.
+func watermarkVariant(pattern []byte, segment int) string {
+	bit := segment % watermarkPatternBits
+	if pattern[bit/8]>>(7-bit%8)&1 == 1 {
+		return watermarkVariantB
+	}
+	return watermarkVariantA
+}
+
+// isWatermarkProtected reports whether the video may only be watched through
+// per-viewer playlists, which holds as soon as its organization turns
+// watermarking on, before the video has been packaged with it.
+func (cfg *apiConfig) isWatermarkProtected(video database.Video) (bool, error) {
+	if video.HLSWatermarked {
+		return true, nil
+	}
+	org, err := cfg.db.GetOrganizationByUser(video.UserID)
+	if err != nil {
+		return false, err
+	}
+	return org.ForensicWatermark, nil
+}
+
+func (cfg *apiConfig) watermarkedPlaylistURL(videoID uuid.UUID) string {
+	return fmt.Sprintf("%s/api/videos/%s/hls/index.m3u8", cfg.appBaseURL, videoID)
+}
+
+// handlerVideoWatermarkedPlaylist serves the viewer's own playlist of a
+// watermarked video. Every request is audited, those are the viewers a leak
+// is matched against.
+func (cfg *apiConfig) handlerVideoWatermarkedPlaylist(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.cachedVideo(r.Context(), videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil || (isVideoHidden(video) && video.UserID != userID) {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", nil)
+		return
+	}
+	if video.UserID != userID {
+		if reason, blocked := geoBlockReason(video, cfg.viewerCountry(r)); blocked {
+			respondWithError(w, http.StatusUnavailableForLegalReasons, errCodeGeoBlocked, reason, nil)
+			return
+		}
+		if !cfg.checkPlaybackToken(w, r, userID, video.ID) {
+			return
+		}
+	}
+	if !video.HLSWatermarked || video.HLSPlaylistKey == nil {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Video has no watermarked rendition", nil)
+		return
+	}
+
+	plain, err := cfg.cachedPlaylist(r.Context(), *video.HLSPlaylistKey)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get playlist", err)
+		return
+	}
+
+	domain, err := cfg.playbackDomain(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get playback domain", err)
+		return
+	}
+
+	ipAddress := ""
+	if addr, ok := cfg.clientIP(r); ok {
+		ipAddress = addr.String()
+	}
+	err = cfg.db.CreateAuditLogEntry(database.CreateAuditLogEntryParams{
+		UserID:    userID,
+		Action:    database.AuditActionWatermarkedPlayback,
+		VideoID:   &video.ID,
+		IPAddress: ipAddress,
+		Detail:    *video.HLSPlaylistKey,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't record playback", err)
+		return
+	}
+
+	// the variants sit next to each other under the rendition's prefix
+	prefix := path.Dir(path.Dir(*video.HLSPlaylistKey))
+	pattern := cfg.watermarkPattern(video.ID, userID)
+
+	var playlist strings.Builder
+	segment := 0
+	scanner := bufio.NewScanner(bytes.NewReader(plain))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" && !strings.HasPrefix(line, "#") {
+			key := path.Join(prefix, watermarkVariant(pattern, segment), line)
+			line = cfg.withPlaybackDomain(cfg.objectURL(key), domain)
+			segment++
+		}
+		playlist.WriteString(line)
+		playlist.WriteString("\n")
+	}
+	if err := scanner.Err(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't read playlist", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(playlist.String()))
+}
+
+// handlerAdminWatermarkIdentify matches the A/B marks read off a leaked copy
+// against every viewer who was handed a watermarked playlist of the video.
+// Segments is one character per segment from the first: A, B, or ? where
+// the mark couldn't be read.
+func (cfg *apiConfig) handlerAdminWatermarkIdentify(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Segments string `json:"segments"`
+	}
+	type candidate struct {
+		UserID uuid.UUID `json:"user_id"`
+		// Matched of the Compared known segments follow the user's pattern
+		Matched  int `json:"matched"`
+		Compared int `json:"compared"`
+	}
+
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	observed := map[int]string{}
+	for i, c := range strings.ToLower(params.Segments) {
+		switch c {
+		case 'a':
+			observed[i] = watermarkVariantA
+		case 'b':
+			observed[i] = watermarkVariantB
+		case '?':
+		default:
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "segments may only contain A, B and ?", nil)
+			return
+		}
+	}
+	if len(observed) < minWatermarkSegments {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "At least "+strconv.Itoa(minWatermarkSegments)+" segments must be known", nil)
+		return
+	}
+
+	userIDs, err := cfg.db.GetAuditLogUserIDs(database.AuditLogFilter{
+		VideoID: &videoID,
+		Action:  database.AuditActionWatermarkedPlayback,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get viewers", err)
+		return
+	}
+
+	candidates := make([]candidate, 0, len(userIDs))
+	for _, userID := range userIDs {
+		pattern := cfg.watermarkPattern(videoID, userID)
+		c := candidate{UserID: userID, Compared: len(observed)}
+		for segment, variant := range observed {
+			if watermarkVariant(pattern, segment) == variant {
+				c.Matched++
+			}
+		}
+		candidates = append(candidates, c)
+	}
+	slices.SortFunc(candidates, func(a, b candidate) int {
+		return cmp.Compare(b.Matched, a.Matched)
+	})
+
+	respondWithJSON(w, http.StatusOK, candidates)
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+//go:embed app
+var embeddedApp embed.FS
+
+// hashed files change name whenever their content does, so browsers can keep
+// them forever
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// frontend serves the web UI. Files are fingerprinted by content hash, the
+// index page links them as /app/{name}?v={hash} and any path that isn't a
+// file falls back to the index page so client side routes survive a reload.
+type frontend struct {
+	files     map[string][]byte
+	hashes    map[string]string
+	index     []byte
+	indexHash string
+	loadedAt  time.Time
+}
+
+func newFrontend(fsys fs.FS) (*frontend, error) {
+	f := &frontend{
+		files:    map[string][]byte{},
+		hashes:   map[string]string{},
+		loadedAt: time.Now(),
+	}
+	err := fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		dat, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		f.files[name] = dat
+		f.hashes[name] = contentHash(dat)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	index, ok := f.files["index.html"]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	// relative links would break on fallback routes like /app/videos/{id}
+	for name, hash := range f.hashes {
+		if name == "index.html" {
+			continue
+		}
+		fingerprinted := "/app/" + name + "?v=" + hash
+		index = bytes.ReplaceAll(index, []byte(`href="`+name+`"`), []byte(`href="`+fingerprinted+`"`))
+		index = bytes.ReplaceAll(index, []byte(`src="`+name+`"`), []byte(`src="`+fingerprinted+`"`))
+	}
+	f.index = index
+	f.indexHash = contentHash(index)
+	return f, nil
+}
+
+func contentHash(dat []byte) string {
+	sum := sha256.Sum256(dat)
+	return hex.EncodeToString(sum[:6])
+}
+
+// ServeHTTP expects the /app prefix to be stripped already.
+func (f *frontend) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	dat, ok := f.files[name]
+	if !ok || name == "index.html" {
+		if path.Ext(name) != "" && name != "index.html" {
+			http.NotFound(w, r)
+			return
+		}
+		f.serveIndex(w, r)
+		return
+	}
+
+	hash := f.hashes[name]
+	w.Header().Set("ETag", `"`+hash+`"`)
+	if r.URL.Query().Get("v") == hash {
+		w.Header().Set("Cache-Control", immutableCacheControl)
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.ServeContent(w, r, name, f.loadedAt, bytes.NewReader(dat))
+}
+
+// serveIndex always revalidates the index page since it carries the current
+// fingerprints.
+func (f *frontend) serveIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("ETag", `"`+f.indexHash+`"`)
+	w.Header().Set("Cache-Control", "no-cache")
+	http.ServeContent(w, r, "index.html", f.loadedAt, bytes.NewReader(f.index))
+}
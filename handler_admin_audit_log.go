@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerAdminAuditLog lists audit log entries, newest first. They can be
+// narrowed down with the user_id, video_id and action query parameters.
+func (cfg *apiConfig) handlerAdminAuditLog(w http.ResponseWriter, r *http.Request) {
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	limit, err := adminListLimit(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid limit", err)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := database.AuditLogFilter{Action: query.Get("action")}
+	if userIDString := query.Get("user_id"); userIDString != "" {
+		userID, err := uuid.Parse(userIDString)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid user ID", err)
+			return
+		}
+		filter.UserID = &userID
+	}
+	if videoIDString := query.Get("video_id"); videoIDString != "" {
+		videoID, err := uuid.Parse(videoIDString)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+			return
+		}
+		filter.VideoID = &videoID
+	}
+
+	entries, err := cfg.db.GetAuditLogEntries(filter, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get audit log", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, entries)
+}
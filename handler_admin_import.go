@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	jobTypeImportS3Prefix = "import_s3_prefix"
+	jobTypeImportS3Object = "import_s3_object"
+)
+
+type importS3PrefixPayload struct {
+	SourceBucket string    `json:"source_bucket"`
+	Prefix       string    `json:"prefix"`
+	UserID       uuid.UUID `json:"user_id"`
+}
+
+type importS3ObjectPayload struct {
+	SourceBucket string `json:"source_bucket"`
+	Key          string `json:"key"`
+}
+
+func (cfg *apiConfig) handlerAdminImportCreate(w http.ResponseWriter, r *http.Request) {
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := importS3PrefixPayload{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	if params.SourceBucket == "" || params.UserID == uuid.Nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "source_bucket and user_id are required", nil)
+		return
+	}
+
+	user, err := cfg.db.GetUser(params.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get user", err)
+		return
+	}
+	if user == nil {
+		respondWithError(w, http.StatusNotFound, errCodeUserNotFound, "Couldn't find user", nil)
+		return
+	}
+
+	job, err := cfg.enqueueJob(jobTypeImportS3Prefix, nil, params)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create import job", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, job)
+}
+
+func (cfg *apiConfig) handlerAdminJobGet(w http.ResponseWriter, r *http.Request) {
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	jobIDString := r.PathValue("jobID")
+	jobID, err := uuid.Parse(jobIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	job, err := cfg.db.GetJob(jobID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get job", err)
+		return
+	}
+	if job.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeJobNotFound, "Couldn't find job", nil)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, job)
+}
+
+func (cfg *apiConfig) runImportS3PrefixJob(ctx context.Context, job database.Job) error {
+	var payload importS3PrefixPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+
+	keys, err := cfg.listBucketKeys(ctx, payload.SourceBucket, payload.Prefix)
+	if err != nil {
+		return fmt.Errorf("couldn't list source bucket: %w", err)
+	}
+
+	imported := 0
+	for _, key := range keys {
+		if _, ok := sourceExtensions[strings.ToLower(path.Ext(key))]; !ok {
+			continue
+		}
+
+		video, err := cfg.createVideo(ctx, database.CreateVideoParams{
+			Title:  strings.TrimSuffix(path.Base(key), path.Ext(key)),
+			UserID: payload.UserID,
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't create video for %s: %w", key, err)
+		}
+
+		_, err = cfg.enqueueJob(jobTypeImportS3Object, &video.ID, importS3ObjectPayload{
+			SourceBucket: payload.SourceBucket,
+			Key:          key,
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't enqueue import of %s: %w", key, err)
+		}
+		imported++
+	}
+
+	log.Printf("Queued %d of %d objects from s3://%s/%s for import", imported, len(keys), payload.SourceBucket, payload.Prefix)
+	return nil
+}
+
+func (cfg *apiConfig) runImportS3ObjectJob(ctx context.Context, job database.Job) error {
+	var payload importS3ObjectPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+	if job.VideoID == nil {
+		return fmt.Errorf("import job has no video")
+	}
+
+	video, err := cfg.db.GetVideo(*job.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		return fmt.Errorf("video %s no longer exists", *job.VideoID)
+	}
+
+	tempFile, err := os.CreateTemp("", "tubely-import.mp4")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	err = cfg.downloadBucketObject(ctx, payload.SourceBucket, payload.Key, tempFile)
+	if err != nil {
+		return fmt.Errorf("couldn't download s3://%s/%s: %w", payload.SourceBucket, payload.Key, err)
+	}
+
+	_, err = cfg.processVideoUpload(ctx, video, tempFile.Name(), cfg.defaultTranscodeProfile())
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerAdminJobRetry(w http.ResponseWriter, r *http.Request) {
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	jobIDString := r.PathValue("jobID")
+	jobID, err := uuid.Parse(jobIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	job, err := cfg.db.GetJob(jobID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get job", err)
+		return
+	}
+	if job.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeJobNotFound, "Couldn't find job", nil)
+		return
+	}
+	if job.Status != database.JobStatusFailed && job.Status != database.JobStatusDead {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "Only failed jobs can be retried", nil)
+		return
+	}
+
+	retried, err := cfg.db.RetryJob(jobID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't retry job", err)
+		return
+	}
+	if !retried {
+		// someone else retried it in the meantime
+		respondWithError(w, http.StatusConflict, errCodeConflict, "Only failed jobs can be retried", nil)
+		return
+	}
+
+	err = cfg.jobQueue.Publish(r.Context(), jobID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't queue job", err)
+		return
+	}
+
+	job, err = cfg.db.GetJob(jobID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get job", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, job)
+}
+
+func (cfg *apiConfig) handlerAdminJobsRetryFailed(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Retried int `json:"retried"`
+	}
+
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	jobIDs, err := cfg.db.RetryFailedJobs()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't retry jobs", err)
+		return
+	}
+	for _, jobID := range jobIDs {
+		err = cfg.jobQueue.Publish(r.Context(), jobID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't queue job", err)
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusAccepted, response{Retried: len(jobIDs)})
+}
+
+func (cfg *apiConfig) handlerAdminDeadJobsRetrieve(w http.ResponseWriter, r *http.Request) {
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	limit, err := adminListLimit(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid limit", err)
+		return
+	}
+
+	jobs, err := cfg.db.GetJobsByStatus(database.JobStatusDead, limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get dead jobs", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, jobs)
+}
+
+func (cfg *apiConfig) handlerAdminDeadJobsPurge(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Purged int64 `json:"purged"`
+	}
+
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	purged, err := cfg.db.DeleteJobsByStatus(database.JobStatusDead)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't purge dead jobs", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{Purged: purged})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const jobTypeMigrateVideoKeys = "migrate_video_keys"
+
+// handlerAdminKeyMigrationCreate queues a job moving every video file to the
+// key the current VIDEO_KEY_PATTERN gives it. Follow it with the jobs API.
+func (cfg *apiConfig) handlerAdminKeyMigrationCreate(w http.ResponseWriter, r *http.Request) {
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	job, err := cfg.enqueueJob(jobTypeMigrateVideoKeys, nil, struct{}{})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create key migration job", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, job)
+}
+
+// runMigrateVideoKeysJob moves the files of every video. Files already
+// under their new key are skipped, so a failed run can just be retried.
+func (cfg *apiConfig) runMigrateVideoKeysJob(ctx context.Context, job database.Job) error {
+	videos, err := cfg.db.WithContext(ctx).GetAllVideos()
+	if err != nil {
+		return err
+	}
+
+	moved := 0
+	for _, video := range videos {
+		n, err := cfg.migrateVideoKeys(ctx, video)
+		if err != nil {
+			return fmt.Errorf("video %s: %w", video.ID, err)
+		}
+		moved += n
+	}
+	log.Printf("Moved the files of %d video versions to their new keys", moved)
+	return nil
+}
+
+// migrateVideoKeys moves the files of the video's versions and returns how
+// many versions moved. Each file is copied, recorded under its new key and
+// only then deleted, the video keeps playing throughout.
+func (cfg *apiConfig) migrateVideoKeys(ctx context.Context, video database.Video) (int, error) {
+	db := cfg.db.WithContext(ctx)
+	versions, err := db.GetVideoVersions(video.ID)
+	if err != nil {
+		return 0, err
+	}
+	if len(versions) == 0 {
+		if video.VideoURL == nil {
+			return 0, nil
+		}
+		// records the file of videos from before versioning as version 1
+		if _, err := cfg.nextVideoVersion(ctx, video); err != nil {
+			return 0, err
+		}
+		versions, err = db.GetVideoVersions(video.ID)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	enc, err := cfg.objectEncryptionForUser(video.UserID)
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, version := range versions {
+		aspect, _, _ := strings.Cut(version.S3Key, "/")
+		if aspect != "landscape" && aspect != "portrait" && aspect != "other" {
+			log.Printf("Not moving %s, its aspect is unknown", version.S3Key)
+			continue
+		}
+		params := videoKeyParams{
+			VideoID:   video.ID,
+			UserID:    video.UserID,
+			Date:      version.CreatedAt,
+			Aspect:    aspect,
+			Version:   version.Version,
+			Rendition: renditionSDR,
+		}
+		newKey := cfg.keyStrategy.VideoKey(params)
+		var newHDRKey *string
+		if version.HDRKey != nil {
+			params.Rendition = renditionHDR
+			key := cfg.keyStrategy.VideoKey(params)
+			newHDRKey = &key
+		}
+		if newKey == version.S3Key && (newHDRKey == nil || *newHDRKey == *version.HDRKey) {
+			continue
+		}
+
+		if newKey != version.S3Key {
+			if err := cfg.copyObject(ctx, version.S3Key, newKey, enc); err != nil {
+				return moved, fmt.Errorf("couldn't copy %s: %w", version.S3Key, err)
+			}
+		}
+		if newHDRKey != nil && *newHDRKey != *version.HDRKey {
+			if err := cfg.copyObject(ctx, *version.HDRKey, *newHDRKey, enc); err != nil {
+				return moved, fmt.Errorf("couldn't copy %s: %w", *version.HDRKey, err)
+			}
+		}
+
+		err := db.MoveVideoVersion(version.ID, newKey, newHDRKey, cfg.objectURL(version.S3Key), cfg.objectURL(newKey))
+		if err != nil {
+			return moved, err
+		}
+
+		if newKey != version.S3Key {
+			if err := cfg.deleteObject(ctx, version.S3Key); err != nil {
+				return moved, fmt.Errorf("couldn't delete %s: %w", version.S3Key, err)
+			}
+			cfg.invalidateVideoURL(ctx, cfg.objectURL(version.S3Key))
+		}
+		if newHDRKey != nil && *newHDRKey != *version.HDRKey {
+			if err := cfg.deleteObject(ctx, *version.HDRKey); err != nil {
+				return moved, fmt.Errorf("couldn't delete %s: %w", *version.HDRKey, err)
+			}
+		}
+		moved++
+	}
+	return moved, nil
+}
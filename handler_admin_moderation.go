@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerAdminModerationQueue(w http.ResponseWriter, r *http.Request) {
+	type queueItem struct {
+		Video  database.Video             `json:"video"`
+		Labels []database.ModerationLabel `json:"labels"`
+	}
+
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	videos, err := cfg.db.GetVideosByModerationStatus(database.ModerationStatusQuarantined)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't retrieve videos", err)
+		return
+	}
+
+	items := make([]queueItem, 0, len(videos))
+	for _, video := range videos {
+		labels, err := cfg.db.GetModerationLabels(video.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't retrieve moderation labels", err)
+			return
+		}
+		items = append(items, queueItem{Video: video, Labels: labels})
+	}
+
+	respondWithJSON(w, http.StatusOK, items)
+}
+
+func (cfg *apiConfig) handlerAdminModerationReview(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Decision string `json:"decision"`
+	}
+
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	var status database.ModerationStatus
+	switch params.Decision {
+	case "approve":
+		status = database.ModerationStatusApproved
+	case "reject":
+		status = database.ModerationStatusRejected
+	default:
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, `decision must be "approve" or "reject"`, nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", err)
+		return
+	}
+
+	err = cfg.db.SetVideoModerationStatus(video.ID, status)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video", err)
+		return
+	}
+	video.ModerationStatus = status
+
+	respondWithJSON(w, http.StatusOK, cfg.withSignedURLs(video))
+}
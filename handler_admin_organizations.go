@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/google/uuid"
+)
+
+// handlerAdminOrganizationJobPriority sets how far ahead of everyone else the
+// organization's background jobs are scheduled. Negative values push them
+// back. It only affects jobs created afterwards.
+func (cfg *apiConfig) handlerAdminOrganizationJobPriority(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		JobPriority int `json:"job_priority"`
+	}
+
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	orgIDString := r.PathValue("organizationID")
+	orgID, err := uuid.Parse(orgIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.JobPriority < jobPriorityLow || params.JobPriority > jobPriorityHigh {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "job_priority must be between -10 and 10", nil)
+		return
+	}
+
+	org, err := cfg.db.GetOrganization(orgID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get organization", err)
+		return
+	}
+	if org.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeOrganizationNotFound, "Couldn't find organization", nil)
+		return
+	}
+
+	err = cfg.db.SetOrganizationJobPriority(org.ID, params.JobPriority)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update organization", err)
+		return
+	}
+	org.JobPriority = params.JobPriority
+
+	cfg.respondWithOrganization(w, http.StatusOK, org)
+}
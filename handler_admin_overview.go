@@ -0,0 +1,85 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+const (
+	adminListDefaultLimit = 20
+	adminListMaxLimit     = 100
+)
+
+func (cfg *apiConfig) handlerAdminOverview(w http.ResponseWriter, r *http.Request) {
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	stats, err := cfg.db.GetSystemStats()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get stats", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, stats)
+}
+
+// handlerAdminErrors lists recently failed background jobs, which is where
+// processing, packaging and import errors end up.
+func (cfg *apiConfig) handlerAdminErrors(w http.ResponseWriter, r *http.Request) {
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	limit, err := adminListLimit(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid limit", err)
+		return
+	}
+
+	jobs, err := cfg.db.GetRecentFailedJobs(limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get failed jobs", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, jobs)
+}
+
+func (cfg *apiConfig) handlerAdminTopUsers(w http.ResponseWriter, r *http.Request) {
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	limit, err := adminListLimit(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid limit", err)
+		return
+	}
+
+	usage, err := cfg.db.GetTopStorageConsumers(limit)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get storage usage", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, usage)
+}
+
+func adminListLimit(r *http.Request) (int, error) {
+	limitString := r.URL.Query().Get("limit")
+	if limitString == "" {
+		return adminListDefaultLimit, nil
+	}
+	limit, err := strconv.Atoi(limitString)
+	if err != nil {
+		return 0, err
+	}
+	return min(max(limit, 1), adminListMaxLimit), nil
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	jobTypeReconcileStorage = "reconcile_storage"
+	// objects this new may belong to uploads or processing still in
+	// flight, they aren't reported as missing a record
+	reconcileGracePeriod = 24 * time.Hour
+)
+
+type reconcileStoragePayload struct {
+	ReportID uuid.UUID `json:"report_id"`
+}
+
+// handlerAdminReconciliationCreate starts a cross-check of the database
+// against the bucket. With {"repair": true} the problems that can be fixed
+// safely are fixed as well.
+func (cfg *apiConfig) handlerAdminReconciliationCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Repair bool `json:"repair"`
+	}
+
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	params := parameters{}
+	err = json.NewDecoder(r.Body).Decode(&params)
+	if err != nil && err != io.EOF {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	report, err := cfg.db.CreateReconciliationReport(params.Repair)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create reconciliation report", err)
+		return
+	}
+	_, err = cfg.enqueueJob(jobTypeReconcileStorage, nil, reconcileStoragePayload{ReportID: report.ID})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create reconciliation job", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, report)
+}
+
+func (cfg *apiConfig) handlerAdminReconciliationGet(w http.ResponseWriter, r *http.Request) {
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	reportID, err := uuid.Parse(r.PathValue("reportID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	report, err := cfg.db.GetReconciliationReport(reportID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get reconciliation report", err)
+		return
+	}
+	if report.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Couldn't find reconciliation report", nil)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+func (cfg *apiConfig) runReconcileStorageJob(ctx context.Context, job database.Job) error {
+	var payload reconcileStoragePayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+	report, err := cfg.db.GetReconciliationReport(payload.ReportID)
+	if err != nil {
+		return err
+	}
+	if report.ID == uuid.Nil {
+		return fmt.Errorf("reconciliation report %s no longer exists", payload.ReportID)
+	}
+
+	findings, err := cfg.reconcileStorage(ctx, report.Repair)
+	if err != nil {
+		if err := cfg.db.FailReconciliationReport(report.ID, err.Error()); err != nil {
+			log.Printf("Couldn't mark reconciliation report %s as failed: %v", report.ID, err)
+		}
+		return err
+	}
+	log.Printf("Storage reconciliation %s found %d problems", report.ID, len(findings))
+	return cfg.db.CompleteReconciliationReport(report.ID, findings)
+}
+
+// reconcileStorage compares every key the database refers to with the
+// objects in the buckets, both ways.
+func (cfg *apiConfig) reconcileStorage(ctx context.Context, repair bool) ([]database.ReconciliationFinding, error) {
+	db := cfg.db.WithContext(ctx)
+
+	objects, err := cfg.listStoredObjects(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list objects: %w", err)
+	}
+	stored := make(map[string]storedObject, len(objects))
+	for _, object := range objects {
+		stored[object.Key] = object
+	}
+
+	videos, err := db.GetAllVideos()
+	if err != nil {
+		return nil, err
+	}
+	videosByID := make(map[uuid.UUID]database.Video, len(videos))
+	// keys that belong to a record, everything else is reported
+	referenced := map[string]bool{}
+	for _, video := range videos {
+		videosByID[video.ID] = video
+		if video.VideoURL != nil {
+			if key, ok := cfg.objectKeyFromURL(*video.VideoURL); ok {
+				referenced[key] = true
+			}
+		}
+	}
+
+	findings := []database.ReconciliationFinding{}
+
+	versions, err := db.GetAllVideoVersions()
+	if err != nil {
+		return nil, err
+	}
+	for _, version := range versions {
+		referenced[version.S3Key] = true
+		if version.SourceKey != nil {
+			referenced[*version.SourceKey] = true
+		}
+		if version.HDRKey != nil {
+			referenced[*version.HDRKey] = true
+		}
+
+		object, ok := stored[version.S3Key]
+		if !ok {
+			finding := database.ReconciliationFinding{
+				Kind:      database.FindingMissingObject,
+				Key:       version.S3Key,
+				VideoID:   &version.VideoID,
+				VersionID: &version.ID,
+			}
+			if repair {
+				finding.Repair, err = cfg.repairMissingVersionObject(ctx, videosByID[version.VideoID], version, stored)
+				if err != nil {
+					return nil, fmt.Errorf("couldn't repair %s: %w", version.S3Key, err)
+				}
+			}
+			findings = append(findings, finding)
+		} else if version.SizeBytes > 0 && object.Size != version.SizeBytes {
+			finding := database.ReconciliationFinding{
+				Kind:          database.FindingSizeMismatch,
+				Key:           version.S3Key,
+				VideoID:       &version.VideoID,
+				VersionID:     &version.ID,
+				RecordedBytes: version.SizeBytes,
+				StoredBytes:   object.Size,
+			}
+			if repair {
+				// the bucket is what's billed and served
+				if err := db.UpdateVideoVersionSize(version.ID, object.Size); err != nil {
+					return nil, err
+				}
+				finding.Repair = "recorded the stored size"
+			}
+			findings = append(findings, finding)
+		}
+
+		if version.SourceKey != nil {
+			if _, ok := stored[*version.SourceKey]; !ok {
+				// nothing to restore an original from
+				findings = append(findings, database.ReconciliationFinding{
+					Kind:      database.FindingMissingObject,
+					Key:       *version.SourceKey,
+					VideoID:   &version.VideoID,
+					VersionID: &version.ID,
+				})
+			}
+		}
+	}
+
+	exportKeys, err := db.GetAllUserExportKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range exportKeys {
+		referenced[key] = true
+	}
+	videoExportKeys, err := db.GetAllVideoExportKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range videoExportKeys {
+		referenced[key] = true
+	}
+
+	cutoff := time.Now().Add(-reconcileGracePeriod)
+	for _, object := range objects {
+		if referenced[object.Key] || object.LastModified.After(cutoff) {
+			continue
+		}
+		owned, err := cfg.objectOwnedByRecord(ctx, object.Key, videosByID)
+		if err != nil {
+			return nil, err
+		}
+		if owned {
+			continue
+		}
+
+		finding := database.ReconciliationFinding{
+			Kind: database.FindingMissingRecord,
+			Key:  object.Key,
+		}
+		if repair {
+			if err := cfg.deleteObject(ctx, object.Key); err != nil {
+				return nil, fmt.Errorf("couldn't delete %s: %w", object.Key, err)
+			}
+			finding.Repair = "deleted the object"
+		}
+		findings = append(findings, finding)
+	}
+
+	return findings, nil
+}
+
+// objectOwnedByRecord reports whether a key that no record names directly
+// still belongs to one: packaged renditions of a video, or a staged upload
+// of an open session.
+func (cfg *apiConfig) objectOwnedByRecord(ctx context.Context, key string, videos map[uuid.UUID]database.Video) (bool, error) {
+	prefix, rest, _ := strings.Cut(key, "/")
+	switch prefix {
+	case "hls", "drm":
+		idString, _, _ := strings.Cut(rest, "/")
+		id, err := uuid.Parse(idString)
+		if err != nil {
+			return false, nil
+		}
+		_, ok := videos[id]
+		return ok, nil
+	case "uploads":
+		session, err := cfg.db.WithContext(ctx).GetOpenUploadSessionByKey(key)
+		if err != nil {
+			return false, err
+		}
+		return session.ID != uuid.Nil, nil
+	}
+	return false, nil
+}
+
+// repairMissingVersionObject fixes a version whose object is gone. The
+// version a video plays is transcoded again from its original when that's
+// still there, older versions are forgotten. It returns what it did.
+func (cfg *apiConfig) repairMissingVersionObject(ctx context.Context, video database.Video, version database.VideoVersion, stored map[string]storedObject) (string, error) {
+	current := false
+	if video.VideoURL != nil {
+		key, ok := cfg.objectKeyFromURL(*video.VideoURL)
+		current = ok && key == version.S3Key
+	}
+
+	if !current {
+		err := cfg.db.WithContext(ctx).DeleteVideoVersion(version.ID)
+		if err != nil {
+			return "", err
+		}
+		return "deleted the version record", nil
+	}
+
+	if version.SourceKey == nil {
+		return "", nil
+	}
+	if _, ok := stored[*version.SourceKey]; !ok {
+		return "", nil
+	}
+	if _, err := cfg.transcodeProfileByName(version.TranscodeProfile); err != nil {
+		// the profile is gone from the config, use the default
+		version.TranscodeProfile = ""
+	}
+	_, err := cfg.enqueueJob(jobTypeRetranscodeVideo, &video.ID, retranscodeVideoPayload{
+		VideoID: video.ID,
+		Profile: version.TranscodeProfile,
+	})
+	if err != nil {
+		return "", err
+	}
+	return "queued a re-transcode from the original", nil
+}
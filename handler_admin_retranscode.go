@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const jobTypeRetranscodeVideo = "retranscode_video"
+
+// a bulk re-transcode queues at most this many videos, run it again for the
+// rest
+const retranscodeBatchLimit = 500
+
+type retranscodeVideoPayload struct {
+	VideoID uuid.UUID `json:"video_id"`
+	Profile string    `json:"profile"`
+}
+
+func (cfg *apiConfig) handlerAdminVideoRetranscode(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Profile string `json:"profile"`
+	}
+
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	params := parameters{}
+	if r.ContentLength != 0 {
+		decoder := json.NewDecoder(r.Body)
+		err = decoder.Decode(&params)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+			return
+		}
+	}
+	profile, err := cfg.transcodeProfileByName(params.Profile)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidTranscodeProfile, "Invalid transcode profile", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, errCodeVideoFileMissing, "Video has no uploaded file", nil)
+		return
+	}
+
+	job, err := cfg.enqueueJob(jobTypeRetranscodeVideo, &video.ID, retranscodeVideoPayload{
+		VideoID: video.ID,
+		Profile: profile.Name,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create re-transcode job", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, job)
+}
+
+// handlerAdminVideosRetranscode queues a re-transcode of every video
+// matching the filters, e.g. all videos still on an old profile.
+func (cfg *apiConfig) handlerAdminVideosRetranscode(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		database.RetranscodeFilter
+		Profile string `json:"profile"`
+	}
+	type response struct {
+		Queued int `json:"queued"`
+		// More is set when the batch limit was hit and more videos match
+		More bool `json:"more"`
+	}
+
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+	profile, err := cfg.transcodeProfileByName(params.Profile)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidTranscodeProfile, "Invalid transcode profile", err)
+		return
+	}
+	// timestamps are stored in UTC
+	if params.CreatedAfter != nil {
+		createdAfter := params.CreatedAfter.UTC()
+		params.CreatedAfter = &createdAfter
+	}
+	if params.CreatedBefore != nil {
+		createdBefore := params.CreatedBefore.UTC()
+		params.CreatedBefore = &createdBefore
+	}
+
+	videos, err := cfg.db.GetVideosForRetranscode(params.RetranscodeFilter, retranscodeBatchLimit+1)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get videos", err)
+		return
+	}
+	resp := response{}
+	if len(videos) > retranscodeBatchLimit {
+		videos = videos[:retranscodeBatchLimit]
+		resp.More = true
+	}
+
+	for _, video := range videos {
+		_, err := cfg.enqueueJob(jobTypeRetranscodeVideo, &video.ID, retranscodeVideoPayload{
+			VideoID: video.ID,
+			Profile: profile.Name,
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create re-transcode job", err)
+			return
+		}
+		resp.Queued++
+	}
+
+	respondWithJSON(w, http.StatusAccepted, resp)
+}
+
+// runRetranscodeVideoJob processes the source of the video's latest version
+// again. The result becomes a new version, so the old one can be rolled back
+// to.
+func (cfg *apiConfig) runRetranscodeVideoJob(ctx context.Context, job database.Job) error {
+	var payload retranscodeVideoPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+	profile, err := cfg.transcodeProfileByName(payload.Profile)
+	if err != nil {
+		return err
+	}
+
+	video, err := cfg.db.GetVideo(payload.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		// nothing left to do
+		return nil
+	}
+
+	versions, err := cfg.db.GetVideoVersions(video.ID)
+	if err != nil {
+		return err
+	}
+	var sourceKey string
+	switch {
+	case len(versions) > 0 && versions[0].SourceKey != nil:
+		sourceKey = *versions[0].SourceKey
+	case len(versions) > 0:
+		sourceKey = versions[0].S3Key
+	case video.VideoURL != nil:
+		key, ok := cfg.objectKeyFromURL(*video.VideoURL)
+		if !ok {
+			return fmt.Errorf("video %s isn't stored in the bucket", video.ID)
+		}
+		sourceKey = key
+	default:
+		return fmt.Errorf("video %s has no uploaded file", video.ID)
+	}
+
+	tempFile, err := os.CreateTemp("", "tubely-retranscode.mp4")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	err = cfg.downloadObject(ctx, sourceKey, tempFile)
+	if err != nil {
+		return withStage("download", fmt.Errorf("couldn't download source %s: %w", sourceKey, err))
+	}
+
+	// the source is already in the bucket, new versions point at it
+	_, err = cfg.processVideoSource(ctx, video, tempFile.Name(), sourceKey, profile)
+	return err
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// the snapshot of last month is taken on the first run after it ends,
+// checking daily is plenty
+const usageSnapshotInterval = 24 * time.Hour
+
+// snapshotMonthlyUsage stores usage reports of every organization for the
+// previous calendar month. Months that already have a report are skipped, so
+// running it more often is harmless.
+func (cfg *apiConfig) snapshotMonthlyUsage(ctx context.Context) error {
+	now := time.Now().UTC()
+	lastMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -1, 0)
+	period := lastMonth.Format(database.UsagePeriodLayout)
+
+	created, err := cfg.db.WithContext(ctx).SnapshotOrganizationUsage(period)
+	if err != nil {
+		return err
+	}
+	if created > 0 {
+		log.Printf("Stored %d usage reports for %s", created, period)
+	}
+	return nil
+}
+
+// recordVideoDelivery counts a playback URL handed to a viewer towards the
+// owner's bandwidth. Failing to count it doesn't fail playback.
+func (cfg *apiConfig) recordVideoDelivery(ctx context.Context, videoID uuid.UUID) {
+	period := time.Now().UTC().Format(database.UsagePeriodLayout)
+	err := cfg.db.WithContext(ctx).RecordVideoDelivery(videoID, period)
+	if err != nil {
+		log.Printf("Couldn't record delivery of video %s: %v", videoID, err)
+	}
+}
+
+// handlerAdminUsage lists monthly usage reports for billing, as JSON or as
+// CSV with ?format=csv. ?period=YYYY-MM and ?organization_id= filter them.
+func (cfg *apiConfig) handlerAdminUsage(w http.ResponseWriter, r *http.Request) {
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	query := r.URL.Query()
+	period := query.Get("period")
+	if period != "" {
+		if _, err := time.Parse(database.UsagePeriodLayout, period); err != nil {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Period must look like YYYY-MM", err)
+			return
+		}
+	}
+	var orgID *uuid.UUID
+	if orgIDString := query.Get("organization_id"); orgIDString != "" {
+		id, err := uuid.Parse(orgIDString)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid organization ID", err)
+			return
+		}
+		orgID = &id
+	}
+
+	format := query.Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Format must be json or csv", nil)
+		return
+	}
+
+	reports, err := cfg.db.GetUsageReports(period, orgID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get usage reports", err)
+		return
+	}
+
+	if format != "csv" {
+		respondWithJSON(w, http.StatusOK, reports)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="usage.csv"`)
+	w.WriteHeader(http.StatusOK)
+	out := csv.NewWriter(w)
+	out.Write([]string{"period", "organization_id", "videos", "storage_bytes", "bandwidth_bytes", "created_at"})
+	for _, report := range reports {
+		out.Write([]string{
+			report.Period,
+			report.OrganizationID.String(),
+			strconv.Itoa(report.Videos),
+			strconv.FormatInt(report.StorageBytes, 10),
+			strconv.FormatInt(report.BandwidthBytes, 10),
+			report.CreatedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	out.Flush()
+	if err := out.Error(); err != nil {
+		log.Printf("Couldn't write usage CSV: %v", err)
+	}
+}
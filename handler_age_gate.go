@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	ageGateCookieName = "tubely_age_gate"
+	ageGateExpiry     = 30 * 24 * time.Hour
+)
+
+func (cfg *apiConfig) handlerVideoAgeGate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Acknowledged bool `json:"acknowledged"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if !params.Acknowledged {
+		respondWithError(w, http.StatusBadRequest, errCodeAgeConfirmationRequired, "You must confirm you are of age to view this content", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil || (isVideoHidden(video) && !cfg.isVideoOwner(r, video)) {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	expiresAt := time.Now().Add(ageGateExpiry)
+	http.SetCookie(w, &http.Cookie{
+		Name:     ageGateCookieName,
+		Value:    cfg.signAgeGate(expiresAt),
+		Path:     "/",
+		Expires:  expiresAt,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	respondWithJSON(w, http.StatusOK, cfg.withSignedURLs(video))
+}
+
+// signAgeGate returns a cookie value recording that the viewer acknowledged
+// the age gate, valid until expiresAt.
+func (cfg *apiConfig) signAgeGate(expiresAt time.Time) string {
+	expires := strconv.FormatInt(expiresAt.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(cfg.jwtSecret))
+	mac.Write([]byte("age-gate:" + expires))
+	return expires + "." + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (cfg *apiConfig) hasPassedAgeGate(r *http.Request) bool {
+	cookie, err := r.Cookie(ageGateCookieName)
+	if err != nil {
+		return false
+	}
+	expires, _, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return false
+	}
+	expiresUnix, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil || time.Now().Unix() > expiresUnix {
+		return false
+	}
+	expected := cfg.signAgeGate(time.Unix(expiresUnix, 0))
+	return hmac.Equal([]byte(cookie.Value), []byte(expected))
+}
+
+// applyAgeGate swaps in the blurred thumbnail for unauthenticated viewers of
+// an age-restricted video who haven't acknowledged the age gate.
+func (cfg *apiConfig) applyAgeGate(r *http.Request, video database.Video) database.Video {
+	if !video.AgeRestricted || video.BlurredThumbnailURL == nil {
+		return video
+	}
+	if cfg.hasPassedAgeGate(r) {
+		return video
+	}
+	if token, err := auth.GetBearerToken(r.Header); err == nil {
+		if _, err := auth.ValidateJWT(token, cfg.jwtSecret); err == nil {
+			return video
+		}
+	}
+	video.ThumbnailURL = video.BlurredThumbnailURL
+	return video
+}
+
+// ensureBlurredThumbnail generates the blurred variant of an age-restricted
+// video's thumbnail next to the original and records its URL on the video.
+// The caller is responsible for saving the video.
+func (cfg *apiConfig) ensureBlurredThumbnail(ctx context.Context, video *database.Video) error {
+	if !video.AgeRestricted || video.ThumbnailURL == nil {
+		return nil
+	}
+	thumbnailPath, ok := cfg.assetPathFromURL(*video.ThumbnailURL)
+	if !ok {
+		// we can only blur thumbnails we serve ourselves
+		return nil
+	}
+
+	ext := filepath.Ext(thumbnailPath)
+	blurredPath := strings.TrimSuffix(thumbnailPath, ext) + "-blur" + ext
+	blurredURL := strings.TrimSuffix(*video.ThumbnailURL, ext) + "-blur" + ext
+	if video.BlurredThumbnailURL != nil && *video.BlurredThumbnailURL == blurredURL {
+		return nil
+	}
+
+	cmd := ffmpegRunner.Command(ctx, "ffmpeg", "-y", "-i", thumbnailPath, "-vf", "boxblur=luma_radius=min(h\\,w)/10:luma_power=3", blurredPath)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return newCommandError("ffmpeg", err, stderr.Bytes())
+	}
+
+	video.BlurredThumbnailURL = &blurredURL
+	return nil
+}
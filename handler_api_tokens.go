@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	defaultAPITokenLifetime = 90 * 24 * time.Hour
+	maxAPITokenLifetime     = 365 * 24 * time.Hour
+	maxAPITokenNameLength   = 100
+)
+
+// handlerAPITokenCreate issues a scoped token, for CI jobs and other
+// automation that shouldn't hold a token able to do everything. The token is
+// only shown in this response.
+func (cfg *apiConfig) handlerAPITokenCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name          string   `json:"name"`
+		Scopes        []string `json:"scopes"`
+		ExpiresInDays int      `json:"expires_in_days"`
+	}
+	type response struct {
+		database.APIToken
+		Token string `json:"token"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" || len(params.Name) > maxAPITokenNameLength {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("Name must be 1 to %d characters long", maxAPITokenNameLength), nil)
+		return
+	}
+	scopes, ok := validateScopes(params.Scopes)
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("Scopes must be one or more of %s, %s and %s", auth.ScopeUploadVideo, auth.ScopeReadVideo, auth.ScopeAdmin), nil)
+		return
+	}
+	lifetime := defaultAPITokenLifetime
+	if params.ExpiresInDays != 0 {
+		lifetime = time.Duration(params.ExpiresInDays) * 24 * time.Hour
+		if lifetime <= 0 || lifetime > maxAPITokenLifetime {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("Tokens can last 1 to %d days", int(maxAPITokenLifetime.Hours()/24)), nil)
+			return
+		}
+	}
+
+	apiToken, err := cfg.db.CreateAPIToken(database.CreateAPITokenParams{
+		UserID:    userID,
+		Name:      params.Name,
+		Scopes:    scopes,
+		ExpiresAt: time.Now().UTC().Add(lifetime),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save token", err)
+		return
+	}
+	signed, err := auth.MakeScopedJWT(userID, apiToken.ID, scopes, cfg.jwtSecret, lifetime)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create token", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		APIToken: apiToken,
+		Token:    signed,
+	})
+}
+
+func (cfg *apiConfig) handlerAPITokensRetrieve(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	tokens, err := cfg.db.GetAPITokens(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get tokens", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, tokens)
+}
+
+// handlerAPITokenRevoke stops a token from working right away, for when it
+// leaked.
+func (cfg *apiConfig) handlerAPITokenRevoke(w http.ResponseWriter, r *http.Request) {
+	tokenID, err := uuid.Parse(r.PathValue("tokenID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid token ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	revoked, err := cfg.db.RevokeAPIToken(userID, tokenID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't revoke token", err)
+		return
+	}
+	if !revoked {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Token not found", nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/billing"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// Stripe events are small, anything bigger isn't from Stripe
+const maxStripeWebhookBytes = 1 << 20
+
+func (cfg *apiConfig) handlerBillingGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Plan         database.Plan `json:"plan"`
+		StorageBytes int64         `json:"storage_bytes"`
+		// QuotaBytes is 0 for unlimited storage
+		QuotaBytes      int64 `json:"quota_bytes"`
+		OverageBytes    int64 `json:"overage_bytes"`
+		CanUpgrade      bool  `json:"can_upgrade"`
+		HasSubscription bool  `json:"has_subscription"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	userBilling, err := cfg.db.GetUserBilling(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get plan", err)
+		return
+	}
+	plan, limits, err := cfg.userPlan(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get plan", err)
+		return
+	}
+	used, err := cfg.db.GetUserStorageBytes(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get storage usage", err)
+		return
+	}
+
+	resp := response{
+		Plan:            plan,
+		StorageBytes:    used,
+		QuotaBytes:      limits.storageQuota,
+		CanUpgrade:      cfg.stripe != nil && plan == database.PlanFree,
+		HasSubscription: userBilling.StripeSubscriptionID != nil,
+	}
+	if limits.storageQuota > 0 && used > limits.storageQuota {
+		resp.OverageBytes = used - limits.storageQuota
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// handlerBillingCheckout starts a Stripe checkout for the pro plan. The
+// upgrade itself happens when Stripe calls the webhook.
+func (cfg *apiConfig) handlerBillingCheckout(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		CheckoutURL string `json:"checkout_url"`
+	}
+
+	if cfg.stripe == nil {
+		respondWithError(w, http.StatusNotImplemented, errCodeNotImplemented, "Billing isn't configured", nil)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get user", err)
+		return
+	}
+	if user == nil {
+		respondWithError(w, http.StatusNotFound, errCodeUserNotFound, "Couldn't find user", nil)
+		return
+	}
+	userBilling, err := cfg.db.GetUserBilling(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get plan", err)
+		return
+	}
+	if userBilling.Plan == database.PlanPro {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "You're already on the pro plan", nil)
+		return
+	}
+
+	params := billing.CheckoutParams{
+		PriceID:           cfg.stripeProPriceID,
+		ClientReferenceID: userID.String(),
+		CustomerEmail:     user.Email,
+		SuccessURL:        cfg.appBaseURL + "/app/?billing=success",
+		CancelURL:         cfg.appBaseURL + "/app/?billing=cancelled",
+	}
+	if userBilling.StripeCustomerID != nil {
+		params.CustomerID = *userBilling.StripeCustomerID
+	}
+	checkoutURL, err := cfg.stripe.CreateCheckoutSession(r.Context(), params)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, errCodeUpstreamFailed, "Couldn't start checkout", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{CheckoutURL: checkoutURL})
+}
+
+// handlerStripeWebhook moves users between plans as their subscriptions
+// start and end. Stripe retries anything but a 2xx, so events we don't care
+// about are acknowledged too.
+func (cfg *apiConfig) handlerStripeWebhook(w http.ResponseWriter, r *http.Request) {
+	if cfg.stripe == nil {
+		respondWithError(w, http.StatusNotImplemented, errCodeNotImplemented, "Billing isn't configured", nil)
+		return
+	}
+
+	payload, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxStripeWebhookBytes))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't read event", err)
+		return
+	}
+	event, err := cfg.stripe.VerifyWebhook(payload, r.Header.Get("Stripe-Signature"), time.Now())
+	if err != nil {
+		if errors.Is(err, billing.ErrInvalidSignature) {
+			respondWithError(w, http.StatusBadRequest, errCodeInvalidCredentials, "Invalid signature", err)
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode event", err)
+		return
+	}
+
+	switch event.Type {
+	case "checkout.session.completed":
+		var session struct {
+			ClientReferenceID string `json:"client_reference_id"`
+			Customer          string `json:"customer"`
+			Subscription      string `json:"subscription"`
+		}
+		if err := json.Unmarshal(event.Data.Object, &session); err != nil {
+			respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode checkout session", err)
+			return
+		}
+		userID, err := uuid.Parse(session.ClientReferenceID)
+		if err != nil || session.Subscription == "" {
+			// not one of our subscription checkouts
+			log.Printf("Ignoring Stripe checkout %s without a user or subscription", event.ID)
+			break
+		}
+		err = cfg.db.StartSubscription(userID, database.PlanPro, session.Customer, session.Subscription)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't upgrade user", err)
+			return
+		}
+		log.Printf("User %s upgraded to the pro plan", userID)
+
+	case "customer.subscription.updated", "customer.subscription.deleted":
+		var subscription struct {
+			ID     string `json:"id"`
+			Status string `json:"status"`
+		}
+		if err := json.Unmarshal(event.Data.Object, &subscription); err != nil {
+			respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode subscription", err)
+			return
+		}
+		// past_due keeps the plan while Stripe retries the payment
+		ended := event.Type == "customer.subscription.deleted"
+		switch subscription.Status {
+		case "canceled", "unpaid", "incomplete_expired":
+			ended = true
+		}
+		if ended {
+			err := cfg.db.EndSubscription(subscription.ID)
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't downgrade user", err)
+				return
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const jobTypeComposeVideos = "compose_videos"
+
+type compositionLayout string
+
+const (
+	// the camera in a corner of the screen recording
+	compositionPictureInPicture compositionLayout = "pip"
+	// the camera next to the screen recording, both at the same height
+	compositionSideBySide compositionLayout = "side_by_side"
+)
+
+// compositionOptions place the camera video. Position is a corner for
+// picture-in-picture and left or right side by side, Size is the camera's
+// width as a fraction of the screen recording's in picture-in-picture.
+type compositionOptions struct {
+	Layout   compositionLayout `json:"layout"`
+	Position string            `json:"position"`
+	Size     float64           `json:"size"`
+	// CameraOffset delays the camera by this many seconds, for cameras that
+	// started recording after the screen
+	CameraOffset float64 `json:"camera_offset"`
+	// Audio is camera, screen or both, the default
+	Audio string `json:"audio"`
+}
+
+// overlay positions as overlay filter expressions, margins are 2% of the
+// screen width
+var pipPositions = map[string][2]string{
+	"top_left":     {"W*0.02", "W*0.02"},
+	"top_right":    {"W-w-W*0.02", "W*0.02"},
+	"bottom_left":  {"W*0.02", "H-h-W*0.02"},
+	"bottom_right": {"W-w-W*0.02", "H-h-W*0.02"},
+}
+
+func (o *compositionOptions) validate() error {
+	if o.Layout == "" {
+		o.Layout = compositionPictureInPicture
+	}
+	if o.Audio == "" {
+		o.Audio = "both"
+	}
+	switch o.Layout {
+	case compositionPictureInPicture:
+		if o.Position == "" {
+			o.Position = "bottom_right"
+		}
+		if _, ok := pipPositions[o.Position]; !ok {
+			return fmt.Errorf("position must be top_left, top_right, bottom_left or bottom_right for pip")
+		}
+		if o.Size == 0 {
+			o.Size = 0.25
+		}
+		if o.Size < 0.05 || o.Size > 0.5 {
+			return fmt.Errorf("size must be between 0.05 and 0.5")
+		}
+	case compositionSideBySide:
+		if o.Position == "" {
+			o.Position = "right"
+		}
+		if o.Position != "left" && o.Position != "right" {
+			return fmt.Errorf("position must be left or right for side_by_side")
+		}
+		if o.Size != 0 {
+			return fmt.Errorf("size only applies to pip")
+		}
+	default:
+		return fmt.Errorf("layout must be pip or side_by_side")
+	}
+	if o.CameraOffset < 0 || math.IsInf(o.CameraOffset, 0) {
+		return fmt.Errorf("camera_offset must be a non-negative number of seconds")
+	}
+	if o.Audio != "camera" && o.Audio != "screen" && o.Audio != "both" {
+		return fmt.Errorf("audio must be camera, screen or both")
+	}
+	return nil
+}
+
+type composeVideosPayload struct {
+	ScreenVideoID uuid.UUID          `json:"screen_video_id"`
+	CameraVideoID uuid.UUID          `json:"camera_video_id"`
+	Options       compositionOptions `json:"options"`
+}
+
+// handlerVideosCompose creates a new video that puts one of the user's videos,
+// usually a camera recording, onto another, usually a screen recording. Like
+// stitching it runs as a job and ends in the pipeline.
+func (cfg *apiConfig) handlerVideosCompose(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		database.CreateVideoParams
+		ScreenVideoID uuid.UUID `json:"screen_video_id"`
+		CameraVideoID uuid.UUID `json:"camera_video_id"`
+		compositionOptions
+	}
+	type response struct {
+		Video database.Video `json:"video"`
+		Job   database.Job   `json:"job"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+	params.UserID = userID
+
+	err = params.compositionOptions.validate()
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid composition", err)
+		return
+	}
+	if params.ScreenVideoID == params.CameraVideoID {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "The screen and camera videos must differ", nil)
+		return
+	}
+	if !cfg.checkSourceVideo(w, userID, params.ScreenVideoID, "the screen video") ||
+		!cfg.checkSourceVideo(w, userID, params.CameraVideoID, "the camera video") {
+		return
+	}
+
+	err = validateVideoVisibility(&params.CreateVideoParams)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid visibility", err)
+		return
+	}
+	err = validateVideoCountries(&params.CreateVideoParams)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid country list", err)
+		return
+	}
+	err = validateVideoTags(&params.CreateVideoParams)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid tags", err)
+		return
+	}
+	err = validateVideoMetadata(&params.CreateVideoParams)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid metadata", err)
+		return
+	}
+	if !cfg.checkExternalID(w, userID, uuid.Nil, &params.CreateVideoParams) {
+		return
+	}
+	if !cfg.admitUpload(w, userID) {
+		return
+	}
+
+	video, err := cfg.createVideo(r.Context(), params.CreateVideoParams)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create video", err)
+		return
+	}
+
+	job, err := cfg.enqueueJob(jobTypeComposeVideos, &video.ID, composeVideosPayload{
+		ScreenVideoID: params.ScreenVideoID,
+		CameraVideoID: params.CameraVideoID,
+		Options:       params.compositionOptions,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create composition job", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, response{
+		Video: cfg.withSignedURLs(video),
+		Job:   job,
+	})
+}
+
+func (cfg *apiConfig) runComposeVideosJob(ctx context.Context, job database.Job) error {
+	var payload composeVideosPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+	if job.VideoID == nil {
+		return fmt.Errorf("composition job has no video")
+	}
+
+	video, err := cfg.db.GetVideo(*job.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		return fmt.Errorf("video %s no longer exists", *job.VideoID)
+	}
+
+	dir, err := os.MkdirTemp("", "tubely-compose")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	screen, err := cfg.downloadStitchClip(ctx, video.UserID, stitchClip{VideoID: payload.ScreenVideoID}, filepath.Join(dir, "screen.mp4"))
+	if err != nil {
+		return withStage("download", fmt.Errorf("screen video: %w", err))
+	}
+	camera, err := cfg.downloadStitchClip(ctx, video.UserID, stitchClip{VideoID: payload.CameraVideoID}, filepath.Join(dir, "camera.mp4"))
+	if err != nil {
+		return withStage("download", fmt.Errorf("camera video: %w", err))
+	}
+
+	outPath := filepath.Join(dir, "composed.mp4")
+	err = composeVideos(ctx, screen, camera, payload.Options, outPath)
+	if err != nil {
+		return withStage("compose", err)
+	}
+
+	_, err = cfg.processVideoUpload(ctx, video, outPath, cfg.defaultTranscodeProfile())
+	return err
+}
+
+// composeVideos lays the camera over or next to the screen recording. The
+// result runs as long as the screen recording.
+func composeVideos(ctx context.Context, screen, camera stitchInput, opts compositionOptions, outPath string) error {
+	// H.264 needs even dimensions
+	height := screen.height &^ 1
+
+	var filter string
+	switch opts.Layout {
+	case compositionSideBySide:
+		left, right := "[s]", "[c]"
+		if opts.Position == "left" {
+			left, right = right, left
+		}
+		filter = fmt.Sprintf("[0:v]scale=-2:%d,setsar=1[s];[1:v]scale=-2:%d,setsar=1[c];%s%shstack=inputs=2,format=yuv420p[v]",
+			height, height, left, right)
+	default:
+		cameraWidth := int(float64(screen.width)*opts.Size) &^ 1
+		position := pipPositions[opts.Position]
+		// the screen recording keeps going once the camera ends
+		filter = fmt.Sprintf("[0:v]scale=trunc(iw/2)*2:trunc(ih/2)*2,setsar=1[s];[1:v]scale=%d:-2,setsar=1[c];[s][c]overlay=x=%s:y=%s:eof_action=pass,format=yuv420p[v]",
+			cameraWidth, position[0], position[1])
+	}
+
+	audio := ""
+	switch {
+	case opts.Audio == "both" && screen.hasAudio && camera.hasAudio:
+		filter += ";[0:a][1:a]amix=inputs=2:duration=first[a]"
+		audio = "[a]"
+	case (opts.Audio == "camera" || opts.Audio == "both") && camera.hasAudio:
+		audio = "1:a"
+	case (opts.Audio == "screen" || opts.Audio == "both") && screen.hasAudio:
+		audio = "0:a"
+	}
+
+	args := []string{
+		"-y",
+		"-i", screen.path,
+		"-itsoffset", strconv.FormatFloat(opts.CameraOffset, 'f', 3, 64),
+		"-i", camera.path,
+		"-filter_complex", filter,
+		"-map", "[v]",
+	}
+	if audio != "" {
+		args = append(args, "-map", audio)
+	}
+	args = append(args,
+		// the composition ends with the screen recording
+		"-t", strconv.FormatFloat(screen.duration, 'f', 3, 64),
+		// the pipeline transcodes the result again, keep as much as we can
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-crf", "16",
+		"-c:a", "aac",
+		"-b:a", "192k",
+		outPath,
+	)
+	cmd := ffmpegRunner.Command(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return newCommandError("ffmpeg", err, stderr.Bytes())
+	}
+	return nil
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// embed pages are cached by nobody, but a viewer may leave one open for
+	// a while before pressing play
+	embedURLExpiry = 6 * time.Hour
+
+	embedDefaultWidth = 640
+)
+
+var embedTemplate = template.Must(template.New("embed").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+{{if .OEmbedURL}}<link rel="alternate" type="application/json+oembed" href="{{.OEmbedURL}}" title="{{.Title}}">{{end}}
+<style>
+html, body { margin: 0; height: 100%; background: #000; color: #fff; font-family: sans-serif; }
+video { width: 100%; height: 100%; }
+p { display: flex; height: 100%; margin: 0; align-items: center; justify-content: center; text-align: center; }
+</style>
+</head>
+<body>
+{{if .Message}}<p>{{.Message}}</p>{{else}}<video controls playsinline preload="metadata" src="{{.VideoURL}}{{if .Start}}#t={{.Start}}{{end}}"{{if .PosterURL}} poster="{{.PosterURL}}"{{end}}></video>{{end}}
+</body>
+</html>
+`))
+
+type embedPage struct {
+	Title     string
+	VideoURL  string
+	PosterURL string
+	OEmbedURL string
+	Message   string
+	// Start is where playback starts in seconds, as a media fragment
+	Start int
+}
+
+func (cfg *apiConfig) handlerEmbed(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		renderEmbed(w, http.StatusBadRequest, embedPage{Title: "Tubely", Message: "Invalid video ID"})
+		return
+	}
+
+	video, err := cfg.cachedVideo(r.Context(), videoID)
+	if err != nil {
+		log.Printf("Couldn't get video %s for embed: %v", videoID, err)
+		renderEmbed(w, http.StatusInternalServerError, embedPage{Title: "Tubely", Message: "Couldn't load this video"})
+		return
+	}
+	if !isVideoEmbeddable(video) {
+		renderEmbed(w, http.StatusNotFound, embedPage{Title: "Tubely", Message: "This video isn't available"})
+		return
+	}
+	video, err = cfg.localizeVideo(r, video)
+	if err != nil {
+		log.Printf("Couldn't get translations of video %s for embed: %v", videoID, err)
+		renderEmbed(w, http.StatusInternalServerError, embedPage{Title: "Tubely", Message: "Couldn't load this video"})
+		return
+	}
+	if reason, blocked := geoBlockReason(video, cfg.viewerCountry(r)); blocked {
+		renderEmbed(w, http.StatusUnavailableForLegalReasons, embedPage{Title: video.Title, Message: reason})
+		return
+	}
+	// iframes can't start playback sessions, or fetch the viewer's own
+	// watermarked playlist
+	watermarked, err := cfg.isWatermarkProtected(video)
+	if err != nil {
+		log.Printf("Couldn't check watermarking of video %s for embed: %v", videoID, err)
+		renderEmbed(w, http.StatusInternalServerError, embedPage{Title: "Tubely", Message: "Couldn't load this video"})
+		return
+	}
+	if cfg.playbackTokens || watermarked {
+		renderEmbed(w, http.StatusForbidden, embedPage{Title: video.Title, Message: "Sign in to Tubely to watch this video"})
+		return
+	}
+
+	domain, err := cfg.playbackDomain(video.UserID)
+	if err != nil {
+		log.Printf("Couldn't get playback domain for video %s: %v", videoID, err)
+		renderEmbed(w, http.StatusInternalServerError, embedPage{Title: "Tubely", Message: "Couldn't load this video"})
+		return
+	}
+	videoURL, err := cfg.signCDNURL(cfg.withPlaybackDomain(*video.VideoURL, domain), time.Now().Add(embedURLExpiry))
+	if err != nil {
+		log.Printf("Couldn't sign playback URL for video %s: %v", videoID, err)
+		renderEmbed(w, http.StatusInternalServerError, embedPage{Title: "Tubely", Message: "Couldn't load this video"})
+		return
+	}
+	cfg.recordVideoDelivery(r.Context(), video.ID)
+
+	page := embedPage{
+		Title:     video.Title,
+		VideoURL:  videoURL,
+		OEmbedURL: fmt.Sprintf("%s/oembed?format=json&url=%s", cfg.appBaseURL, url.QueryEscape(cfg.embedURL(video.ID))),
+		Start:     playbackStart(r),
+	}
+	// iframes don't carry the viewer's JWT, so only the age gate cookie
+	// reveals the real thumbnail
+	if video = cfg.applyAgeGate(r, video); video.ThumbnailURL != nil {
+		page.PosterURL = cfg.signAssetURL(*video.ThumbnailURL)
+	}
+
+	w.Header().Set("Cache-Control", "private, no-store")
+	renderEmbed(w, http.StatusOK, page)
+}
+
+func renderEmbed(w http.ResponseWriter, code int, page embedPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	// embedding on other sites is the whole point of this page
+	w.Header().Set("Content-Security-Policy", "frame-ancestors *")
+	w.WriteHeader(code)
+	err := embedTemplate.Execute(w, page)
+	if err != nil {
+		log.Printf("Couldn't render embed page: %v", err)
+	}
+}
+
+func (cfg *apiConfig) handlerOEmbed(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Version         string `json:"version"`
+		Type            string `json:"type"`
+		ProviderName    string `json:"provider_name"`
+		ProviderURL     string `json:"provider_url"`
+		Title           string `json:"title"`
+		HTML            string `json:"html"`
+		Width           int    `json:"width"`
+		Height          int    `json:"height"`
+		ThumbnailURL    string `json:"thumbnail_url,omitempty"`
+		ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+		ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+	}
+
+	query := r.URL.Query()
+	if format := query.Get("format"); format != "" && format != "json" {
+		respondWithError(w, http.StatusNotImplemented, errCodeNotImplemented, "Only the json format is supported", nil)
+		return
+	}
+
+	videoID, ok := videoIDFromShareURL(query.Get("url"))
+	if !ok {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Not a Tubely video URL", nil)
+		return
+	}
+
+	video, err := cfg.cachedVideo(r.Context(), videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if !isVideoEmbeddable(video) {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	width, height := embedDimensions(cfg.isPortraitVideo(video), query.Get("maxwidth"), query.Get("maxheight"))
+	resp := response{
+		Version:      "1.0",
+		Type:         "video",
+		ProviderName: "Tubely",
+		ProviderURL:  cfg.appBaseURL,
+		Title:        video.Title,
+		HTML: fmt.Sprintf(`<iframe src="%s" width="%d" height="%d" frameborder="0" allow="autoplay; fullscreen; picture-in-picture" allowfullscreen></iframe>`,
+			template.HTMLEscapeString(cfg.embedURL(video.ID)), width, height),
+		Width:  width,
+		Height: height,
+	}
+	// unfurls are public, so age-restricted videos only show the blurred
+	// thumbnail
+	if video.AgeRestricted {
+		video.ThumbnailURL = video.BlurredThumbnailURL
+	}
+	if video.ThumbnailURL != nil {
+		resp.ThumbnailURL = cfg.signAssetURL(*video.ThumbnailURL)
+		resp.ThumbnailWidth = width
+		resp.ThumbnailHeight = height
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) embedURL(videoID uuid.UUID) string {
+	return fmt.Sprintf("%s/embed/%s", cfg.appBaseURL, videoID)
+}
+
+// isVideoEmbeddable reports whether a video can be shown to anonymous
+// viewers on other sites.
+func isVideoEmbeddable(video database.Video) bool {
+	return video.ID != uuid.Nil && video.DeletedAt == nil && !isVideoHidden(video) && video.VideoURL != nil
+}
+
+// isPortraitVideo uses the orientation probed at upload time, or the
+// storage prefix for files uploaded before it was recorded.
+func (cfg *apiConfig) isPortraitVideo(video database.Video) bool {
+	if video.Orientation != nil {
+		return *video.Orientation == "portrait"
+	}
+	if video.VideoURL == nil {
+		return false
+	}
+	key, ok := cfg.objectKeyFromURL(*video.VideoURL)
+	return ok && strings.HasPrefix(key, "portrait/")
+}
+
+// videoIDFromShareURL accepts the links we hand out for a video, the watch
+// page and the embed page.
+func videoIDFromShareURL(rawURL string) (uuid.UUID, bool) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return uuid.Nil, false
+	}
+	for _, prefix := range []string{"/watch/", "/embed/"} {
+		if idString, ok := strings.CutPrefix(u.Path, prefix); ok {
+			id, err := uuid.Parse(strings.TrimSuffix(idString, "/"))
+			return id, err == nil
+		}
+	}
+	return uuid.Nil, false
+}
+
+// embedDimensions fits the player into the consumer's maximum size while
+// keeping the video's aspect ratio.
+func embedDimensions(portrait bool, maxWidthString, maxHeightString string) (int, int) {
+	ratioW, ratioH := 16, 9
+	if portrait {
+		ratioW, ratioH = 9, 16
+	}
+
+	width := embedDefaultWidth
+	if portrait {
+		width = embedDefaultWidth * ratioW / ratioH
+	}
+	if maxWidth, err := strconv.Atoi(maxWidthString); err == nil && maxWidth > 0 && maxWidth < width {
+		width = maxWidth
+	}
+	height := width * ratioH / ratioW
+	if maxHeight, err := strconv.Atoi(maxHeightString); err == nil && maxHeight > 0 && maxHeight < height {
+		height = maxHeight
+		width = height * ratioW / ratioH
+	}
+	return width, height
+}
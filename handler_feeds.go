@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// podcast apps poll feeds frequently, let shared caches absorb most of it
+const feedCacheControl = "public, max-age=300"
+
+type rssFeed struct {
+	XMLName  xml.Name   `xml:"rss"`
+	Version  string     `xml:"version,attr"`
+	ITunesNS string     `xml:"xmlns:itunes,attr"`
+	AtomNS   string     `xml:"xmlns:atom,attr"`
+	Channel  rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string        `xml:"title"`
+	Link          string        `xml:"link"`
+	Description   string        `xml:"description"`
+	Language      string        `xml:"language"`
+	LastBuildDate string        `xml:"lastBuildDate"`
+	AtomLink      rssAtomLink   `xml:"atom:link"`
+	ITunesImage   *rssITunesRef `xml:"itunes:image,omitempty"`
+	Items         []rssItem     `xml:"item"`
+}
+
+type rssAtomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssITunesRef struct {
+	Href string `xml:"href,attr"`
+}
+
+type rssItem struct {
+	Title          string        `xml:"title"`
+	Link           string        `xml:"link"`
+	Description    string        `xml:"description"`
+	GUID           rssGUID       `xml:"guid"`
+	PubDate        string        `xml:"pubDate"`
+	Enclosure      rssEnclosure  `xml:"enclosure"`
+	ITunesImage    *rssITunesRef `xml:"itunes:image,omitempty"`
+	ITunesExplicit string        `xml:"itunes:explicit"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type rssEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+func (cfg *apiConfig) handlerUserFeed(w http.ResponseWriter, r *http.Request) {
+	// the extension makes the URL look like a file to podcast apps
+	fileName := r.PathValue("feedFile")
+	userIDString, ok := strings.CutSuffix(fileName, ".xml")
+	if !ok {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Feed not found", nil)
+		return
+	}
+	userID, err := uuid.Parse(userIDString)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Feed not found", err)
+		return
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get user", err)
+		return
+	}
+	if user == nil {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Feed not found", nil)
+		return
+	}
+
+	videos, err := cfg.db.GetVideos(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get videos", err)
+		return
+	}
+
+	domain, err := cfg.playbackDomain(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get playback domain", err)
+		return
+	}
+
+	feedURL := fmt.Sprintf("%s/feeds/users/%s.xml", cfg.appBaseURL, userID)
+	channel := rssChannel{
+		Title:       "Tubely videos",
+		Link:        feedURL,
+		Description: "Public videos published on Tubely",
+		Language:    "en",
+		AtomLink: rssAtomLink{
+			Href: feedURL,
+			Rel:  "self",
+			Type: "application/rss+xml",
+		},
+		Items: []rssItem{},
+	}
+
+	var lastUpdated time.Time
+	for _, video := range videos {
+		if !isVideoEmbeddable(video) {
+			continue
+		}
+		// the enclosure would hand out the file without the viewer's
+		// watermark
+		watermarked, err := cfg.isWatermarkProtected(video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't build feed", err)
+			return
+		}
+		if watermarked {
+			continue
+		}
+		item, err := cfg.feedItem(video, domain)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't build feed", err)
+			return
+		}
+		channel.Items = append(channel.Items, item)
+		if video.UpdatedAt.After(lastUpdated) {
+			lastUpdated = video.UpdatedAt
+		}
+		if channel.ITunesImage == nil && item.ITunesImage != nil {
+			channel.ITunesImage = item.ITunesImage
+		}
+	}
+	if lastUpdated.IsZero() {
+		lastUpdated = user.CreatedAt
+	}
+	channel.LastBuildDate = lastUpdated.UTC().Format(time.RFC1123Z)
+
+	body, err := xml.MarshalIndent(rssFeed{
+		Version:  "2.0",
+		ITunesNS: "http://www.itunes.com/dtds/podcast-1.0.dtd",
+		AtomNS:   "http://www.w3.org/2005/Atom",
+		Channel:  channel,
+	}, "", "  ")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't encode feed", err)
+		return
+	}
+	body = append([]byte(xml.Header), body...)
+
+	// the ETag covers the whole feed. Last-Modified would miss videos that
+	// were removed, so conditional requests rely on If-None-Match only.
+	hash := sha256.Sum256(body)
+	w.Header().Set("Content-Type", "application/rss+xml; charset=utf-8")
+	w.Header().Set("Cache-Control", feedCacheControl)
+	w.Header().Set("ETag", `"`+hex.EncodeToString(hash[:16])+`"`)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+func (cfg *apiConfig) feedItem(video database.Video, domain string) (rssItem, error) {
+	var size int64
+	versions, err := cfg.db.GetVideoVersions(video.ID)
+	if err != nil {
+		return rssItem{}, err
+	}
+	if key, ok := cfg.objectKeyFromURL(*video.VideoURL); ok {
+		for _, version := range versions {
+			if version.S3Key == key {
+				size = version.SizeBytes
+				break
+			}
+		}
+	}
+
+	published := video.CreatedAt
+	if video.PublishAt != nil {
+		published = *video.PublishAt
+	}
+
+	item := rssItem{
+		Title:       video.Title,
+		Link:        cfg.watchURL(video.ID),
+		Description: video.Description,
+		GUID: rssGUID{
+			IsPermaLink: false,
+			Value:       video.ID.String(),
+		},
+		PubDate: published.UTC().Format(time.RFC1123Z),
+		Enclosure: rssEnclosure{
+			URL:    cfg.withPlaybackDomain(*video.VideoURL, domain),
+			Length: size,
+			Type:   "video/mp4",
+		},
+		ITunesExplicit: "false",
+	}
+	if video.AgeRestricted {
+		item.ITunesExplicit = "true"
+		video.ThumbnailURL = video.BlurredThumbnailURL
+	}
+	if video.ThumbnailURL != nil {
+		item.ITunesImage = &rssITunesRef{Href: cfg.signAssetURL(*video.ThumbnailURL)}
+	}
+	return item, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	jobTypeImportURL = "import_url"
+
+	importMaxBytes     = 1 << 30
+	importTimeout      = 30 * time.Minute
+	importMaxRedirects = 5
+)
+
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+type importURLPayload struct {
+	URL string `json:"url"`
+}
+
+func (cfg *apiConfig) handlerVideoImportURL(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		URL string `json:"url"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	err = validateImportURL(params.URL)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid import URL", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this video", nil)
+		return
+	}
+	if !cfg.admitUpload(w, userID) {
+		return
+	}
+
+	job, err := cfg.enqueueJob(jobTypeImportURL, &video.ID, importURLPayload{URL: params.URL})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create import job", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, job)
+}
+
+func (cfg *apiConfig) runImportURLJob(ctx context.Context, job database.Job) error {
+	var payload importURLPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+	if job.VideoID == nil {
+		return fmt.Errorf("import job has no video")
+	}
+
+	video, err := cfg.db.GetVideo(*job.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		return fmt.Errorf("video %s no longer exists", *job.VideoID)
+	}
+
+	tempFile, err := os.CreateTemp("", "tubely-import.mp4")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	err = downloadRemoteVideo(ctx, payload.URL, tempFile)
+	if err != nil {
+		return fmt.Errorf("couldn't download %s: %w", payload.URL, err)
+	}
+
+	_, err = cfg.processVideoUpload(ctx, video, tempFile.Name(), cfg.defaultTranscodeProfile())
+	return err
+}
+
+func validateImportURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.New("only http and https URLs are supported")
+	}
+	if u.Hostname() == "" {
+		return errors.New("URL has no host")
+	}
+	return nil
+}
+
+func downloadRemoteVideo(ctx context.Context, rawURL string, dst io.Writer) error {
+	ctx, cancel := context.WithTimeout(ctx, importTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := newImportHTTPClient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("remote server responded with %s", resp.Status)
+	}
+
+	mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("invalid content type: %w", err)
+	}
+	if !sourceMediaTypeAllowed(mediaType, resp.Request.URL.Path) {
+		return fmt.Errorf("media type %q not allowed, only mp4, mov, mkv and webm are supported", mediaType)
+	}
+
+	if resp.ContentLength > importMaxBytes {
+		return fmt.Errorf("remote file is %d bytes, the limit is %d", resp.ContentLength, importMaxBytes)
+	}
+
+	n, err := io.Copy(dst, io.LimitReader(resp.Body, importMaxBytes+1))
+	if err != nil {
+		return err
+	}
+	if n > importMaxBytes {
+		return fmt.Errorf("remote file exceeds the %d byte limit", importMaxBytes)
+	}
+	return nil
+}
+
+// newImportHTTPClient returns a client that refuses to connect to loopback,
+// private and link-local addresses. The check runs on the resolved address
+// at dial time so DNS rebinding and redirects can't reach internal services.
+func newImportHTTPClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return fmt.Errorf("couldn't parse address %q", host)
+			}
+			if !isPublicIP(ip) {
+				return fmt.Errorf("refusing to connect to non-public address %s", ip)
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Transport: &http.Transport{
+			Proxy:                 nil,
+			DialContext:           dialer.DialContext,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ResponseHeaderTimeout: 30 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= importMaxRedirects {
+				return errors.New("too many redirects")
+			}
+			return validateImportURL(req.URL.String())
+		},
+	}
+}
+
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() ||
+		ip.IsPrivate() ||
+		ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() {
+		return false
+	}
+	return !sharedAddressSpace.Contains(ip)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+type liveStreamResponse struct {
+	database.LiveStream
+	IngestURL   string `json:"ingest_url,omitempty"`
+	PlaybackURL string `json:"playback_url"`
+}
+
+func (cfg *apiConfig) liveStreamPlaybackURL(streamID uuid.UUID) string {
+	return fmt.Sprintf("%s/live/%s/index.m3u8", cfg.appBaseURL, streamID)
+}
+
+func (cfg *apiConfig) handlerStreamKeyGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		StreamKey string `json:"stream_key"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	key, err := cfg.db.GetStreamKey(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get stream key", err)
+		return
+	}
+	if key == "" {
+		key, err = cfg.rotateStreamKey(userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create stream key", err)
+			return
+		}
+	}
+
+	respondWithJSON(w, http.StatusOK, response{StreamKey: key})
+}
+
+func (cfg *apiConfig) handlerStreamKeyRotate(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		StreamKey string `json:"stream_key"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	key, err := cfg.rotateStreamKey(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create stream key", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{StreamKey: key})
+}
+
+func (cfg *apiConfig) rotateStreamKey(userID uuid.UUID) (string, error) {
+	dat := make([]byte, 24)
+	_, err := rand.Read(dat)
+	if err != nil {
+		return "", err
+	}
+	key := hex.EncodeToString(dat)
+	return key, cfg.db.SetStreamKey(userID, key)
+}
+
+func (cfg *apiConfig) handlerLiveStreamCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Title string `json:"title"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Title == "" {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Title is required", nil)
+		return
+	}
+
+	streamKey, err := cfg.db.GetStreamKey(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get stream key", err)
+		return
+	}
+	if streamKey == "" {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "Create a stream key first", nil)
+		return
+	}
+
+	port, err := cfg.live.reservePort()
+	if err != nil {
+		respondWithError(w, http.StatusServiceUnavailable, errCodeCapacityExceeded, "Too many live streams right now, try again later", err)
+		return
+	}
+
+	stream, err := cfg.db.CreateLiveStream(database.CreateLiveStreamParams{
+		UserID: userID,
+		Title:  params.Title,
+	}, port)
+	if err != nil {
+		cfg.live.release(port, uuid.Nil)
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create live stream", err)
+		return
+	}
+
+	err = cfg.startLiveIngest(stream, rtmpLiveInput(port, streamKey))
+	if err != nil {
+		cfg.live.release(port, stream.ID)
+		cfg.db.EndLiveStream(stream.ID, database.LiveStreamStatusFailed)
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't start live ingest", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, liveStreamResponse{
+		LiveStream:  stream,
+		IngestURL:   fmt.Sprintf("rtmp://%s:%d/%s/live", cfg.liveRTMPHost, port, streamKey),
+		PlaybackURL: cfg.liveStreamPlaybackURL(stream.ID),
+	})
+}
+
+func (cfg *apiConfig) handlerLiveStreamGet(w http.ResponseWriter, r *http.Request) {
+	streamIDString := r.PathValue("streamID")
+	streamID, err := uuid.Parse(streamIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	stream, err := cfg.db.GetLiveStream(streamID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get live stream", err)
+		return
+	}
+	if stream.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeLiveStreamNotFound, "Couldn't find live stream", nil)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, liveStreamResponse{
+		LiveStream:  stream,
+		PlaybackURL: cfg.liveStreamPlaybackURL(stream.ID),
+	})
+}
+
+func (cfg *apiConfig) handlerLiveStreamStop(w http.ResponseWriter, r *http.Request) {
+	streamIDString := r.PathValue("streamID")
+	streamID, err := uuid.Parse(streamIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	stream, err := cfg.db.GetLiveStream(streamID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get live stream", err)
+		return
+	}
+	if stream.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeLiveStreamNotFound, "Couldn't find live stream", nil)
+		return
+	}
+	if stream.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this live stream", nil)
+		return
+	}
+
+	if !cfg.live.stop(stream.ID) {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "Live stream isn't running", nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
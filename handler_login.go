@@ -2,73 +2,182 @@ package main
 
 import (
 	"encoding/json"
+	"log"
+	"math"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
 )
 
 func (cfg *apiConfig) handlerLogin(w http.ResponseWriter, r *http.Request) {
 	type parameters struct {
 		Password string `json:"password"`
 		Email    string `json:"email"`
+		// one of them is needed once two-factor authentication is enabled
+		TOTPCode     string `json:"totp_code"`
+		RecoveryCode string `json:"recovery_code"`
 	}
 	type response struct {
 		database.User
 		Token        string `json:"token"`
 		RefreshToken string `json:"refresh_token"`
+		// the user's organization won't let them manage it until they set
+		// up two-factor authentication
+		TwoFactorSetupRequired bool `json:"two_factor_setup_required,omitempty"`
 	}
 
 	decoder := json.NewDecoder(r.Body)
 	params := parameters{}
 	err := decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	// locked out keys aren't even checked, so guessing on is pointless
+	addr, _ := cfg.clientIP(r)
+	accountKey := "account:" + strings.ToLower(strings.TrimSpace(params.Email))
+	ipKey := "ip:" + addr.String()
+	if locked, retryAfter := cfg.loginThrottle.locked(accountKey, ipKey); locked {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		respondWithError(w, http.StatusTooManyRequests, errCodeRateLimited, "Too many failed logins, try again later", nil)
 		return
 	}
 
 	user, err := cfg.db.GetUserByEmail(params.Email)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
+		cfg.recordLoginFailure(r, accountKey, ipKey, uuid.Nil)
+		respondWithError(w, http.StatusUnauthorized, errCodeInvalidCredentials, "Incorrect email or password", err)
 		return
 	}
 
 	err = auth.CheckPasswordHash(params.Password, user.Password)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Incorrect email or password", err)
+		cfg.recordLoginFailure(r, accountKey, ipKey, user.ID)
+		respondWithError(w, http.StatusUnauthorized, errCodeInvalidCredentials, "Incorrect email or password", err)
+		return
+	}
+	if user.DeactivatedAt != nil {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "Your account was deactivated", nil)
 		return
 	}
 
-	accessToken, err := auth.MakeJWT(
-		user.ID,
-		cfg.jwtSecret,
-		time.Hour*24*30,
-	)
+	twoFactor, err := cfg.db.GetTwoFactor(user.ID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create access JWT", err)
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get two-factor settings", err)
 		return
 	}
+	setupRequired := false
+	if twoFactor.EnabledAt != nil {
+		if params.TOTPCode == "" && params.RecoveryCode == "" {
+			respondWithError(w, http.StatusUnauthorized, errCodeTwoFactorRequired, "Two-factor code required", nil)
+			return
+		}
+		ok, err := cfg.checkSecondFactor(r, user.ID, twoFactor, params.TOTPCode, params.RecoveryCode)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't check two-factor code", err)
+			return
+		}
+		if !ok {
+			cfg.recordLoginFailure(r, accountKey, ipKey, user.ID)
+			respondWithError(w, http.StatusUnauthorized, errCodeInvalidCredentials, "Incorrect two-factor code", nil)
+			return
+		}
+	} else {
+		setupRequired, err = cfg.twoFactorRequired(user.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get organization", err)
+			return
+		}
+	}
+	// the address keeps its failures, one good account doesn't vouch for the
+	// others it tried
+	cfg.loginThrottle.succeed(accountKey)
 
+	accessToken, refreshToken, ok := cfg.startSession(w, r, user.ID)
+	if !ok {
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		User:                   user,
+		Token:                  accessToken,
+		RefreshToken:           refreshToken,
+		TwoFactorSetupRequired: setupRequired,
+	})
+}
+
+// startSession creates a refresh token for a new session of the user and an
+// access token tied to it. It responds with an error and returns false when
+// it can't.
+func (cfg *apiConfig) startSession(w http.ResponseWriter, r *http.Request, userID uuid.UUID) (string, string, bool) {
 	refreshToken, err := auth.MakeRefreshToken()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create refresh token", err)
-		return
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create refresh token", err)
+		return "", "", false
 	}
 
-	_, err = cfg.db.CreateRefreshToken(database.CreateRefreshTokenParams{
-		UserID:    user.ID,
+	ipAddress := ""
+	if addr, ok := cfg.clientIP(r); ok {
+		ipAddress = addr.String()
+	}
+	session, err := cfg.db.CreateRefreshToken(database.CreateRefreshTokenParams{
+		UserID:    userID,
 		Token:     refreshToken,
 		ExpiresAt: time.Now().UTC().Add(time.Hour * 24 * 60),
+		UserAgent: truncateUserAgent(r.UserAgent()),
+		IPAddress: ipAddress,
 	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't save refresh token", err)
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save refresh token", err)
+		return "", "", false
+	}
+
+	accessToken, err := auth.MakeJWT(
+		userID,
+		session.ID,
+		cfg.jwtSecret,
+		time.Hour*24*30,
+	)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create access JWT", err)
+		return "", "", false
+	}
+	return accessToken, refreshToken, true
+}
+
+// recordLoginFailure counts a failed login against the account and the
+// address. Failures on existing accounts, and the lockouts they cause, go to
+// the audit log; an unknown email has no user to file them under.
+func (cfg *apiConfig) recordLoginFailure(r *http.Request, accountKey, ipKey string, userID uuid.UUID) {
+	accountLockout := cfg.loginThrottle.fail(accountKey, loginAccountFailureLimit)
+	if ipLockout := cfg.loginThrottle.fail(ipKey, loginIPFailureLimit); ipLockout > 0 {
+		log.Printf("Locked out %s from logging in for %s after repeated failures", ipKey, ipLockout)
+	}
+	if userID == uuid.Nil {
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, response{
-		User:         user,
-		Token:        accessToken,
-		RefreshToken: refreshToken,
-	})
+	ipAddress := ""
+	if addr, ok := cfg.clientIP(r); ok {
+		ipAddress = addr.String()
+	}
+	entry := database.CreateAuditLogEntryParams{
+		UserID:    userID,
+		Action:    database.AuditActionLoginFailed,
+		IPAddress: ipAddress,
+	}
+	if accountLockout > 0 {
+		entry.Action = database.AuditActionLoginLocked
+		entry.Detail = "locked for " + accountLockout.String()
+	}
+	// the login fails either way, a missing entry shouldn't change the error
+	if err := cfg.db.CreateAuditLogEntry(entry); err != nil {
+		log.Printf("Couldn't record failed login of user %s: %v", userID, err)
+	}
 }
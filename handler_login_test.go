@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestLoginAddressLockoutIgnoresForgedForwardedFor(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.trustProxyHeaders = true
+	cfg.trustedProxyHops = 1
+	cfg.loginThrottle = newLoginThrottle()
+
+	login := func(i int) int {
+		// a new account every time, so only the address gets locked out
+		body := fmt.Sprintf(`{"email": "guess%d@example.com", "password": "wrong"}`, i)
+		req := httptest.NewRequest(http.MethodPost, "/api/login", strings.NewReader(body))
+		req.RemoteAddr = "10.0.0.2:4321"
+		// the attacker picks the leftmost entry, the load balancer appends
+		// the address it saw
+		req.Header.Set("X-Forwarded-For", fmt.Sprintf("192.0.2.%d, 198.51.100.7", i))
+		rec := httptest.NewRecorder()
+		cfg.handlerLogin(rec, req)
+		return rec.Code
+	}
+
+	for i := 0; i < loginIPFailureLimit; i++ {
+		if code := login(i); code != http.StatusUnauthorized {
+			t.Fatalf("login %d got %d, want 401", i, code)
+		}
+	}
+	if code := login(loginIPFailureLimit); code != http.StatusTooManyRequests {
+		t.Errorf("got %d after %d failures from one address, want 429", code, loginIPFailureLimit)
+	}
+}
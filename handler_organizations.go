@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// custom domains are proven by publishing the verification token in a TXT
+// record under this label
+const domainVerificationLabel = "_tubely-challenge"
+
+type organizationResponse struct {
+	database.Organization
+	Members []database.OrganizationMember `json:"members"`
+	// DNSRecord is the TXT record that proves control of the custom domain,
+	// only present until the domain is verified
+	DNSRecord *dnsRecord `json:"dns_record,omitempty"`
+}
+
+type dnsRecord struct {
+	Type  string `json:"type"`
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+func (cfg *apiConfig) handlerOrganizationCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Name string `json:"name"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Name is required", nil)
+		return
+	}
+
+	member, err := cfg.db.GetOrganizationMember(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get organization", err)
+		return
+	}
+	if member.OrganizationID != uuid.Nil {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "You already belong to an organization", nil)
+		return
+	}
+
+	org, err := cfg.db.CreateOrganization(params.Name, userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create organization", err)
+		return
+	}
+
+	cfg.respondWithOrganization(w, http.StatusCreated, org)
+}
+
+func (cfg *apiConfig) handlerOrganizationGet(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	org, err := cfg.db.GetOrganizationByUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get organization", err)
+		return
+	}
+	if org.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeOrganizationNotFound, "You don't belong to an organization", nil)
+		return
+	}
+
+	cfg.respondWithOrganization(w, http.StatusOK, org)
+}
+
+func (cfg *apiConfig) handlerOrganizationMemberAdd(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Email string `json:"email"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	org, ok := cfg.getOwnedOrganization(w, userID)
+	if !ok {
+		return
+	}
+
+	user, err := cfg.db.GetUserByEmail(params.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get user", err)
+		return
+	}
+	if user.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeUserNotFound, "Couldn't find a user with that email", nil)
+		return
+	}
+
+	member, err := cfg.db.GetOrganizationMember(user.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get organization", err)
+		return
+	}
+	if member.OrganizationID != uuid.Nil {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "User already belongs to an organization", nil)
+		return
+	}
+
+	err = cfg.db.AddOrganizationMember(org.ID, user.ID, database.OrganizationRoleMember)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't add member", err)
+		return
+	}
+
+	cfg.respondWithOrganization(w, http.StatusCreated, org)
+}
+
+func (cfg *apiConfig) handlerOrganizationDomainUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Domain string `json:"domain"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	org, ok := cfg.getOwnedOrganization(w, userID)
+	if !ok {
+		return
+	}
+
+	domain, verificationToken := "", ""
+	if params.Domain != "" {
+		domain, err = normalizeDomain(params.Domain)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid domain", err)
+			return
+		}
+		dat := make([]byte, 16)
+		_, err = rand.Read(dat)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create verification token", err)
+			return
+		}
+		verificationToken = "tubely-verify=" + hex.EncodeToString(dat)
+
+		existing, err := cfg.db.GetOrganizationByDomain(domain)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't check domain", err)
+			return
+		}
+		if existing.ID != uuid.Nil && existing.ID != org.ID {
+			respondWithError(w, http.StatusConflict, errCodeConflict, "Domain is already used by another organization", nil)
+			return
+		}
+	}
+
+	err = cfg.db.SetOrganizationDomain(org.ID, domain, verificationToken)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update domain", err)
+		return
+	}
+
+	org, err = cfg.db.GetOrganization(org.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get organization", err)
+		return
+	}
+	cfg.respondWithOrganization(w, http.StatusOK, org)
+}
+
+// handlerOrganizationForensicWatermark turns per-viewer watermarking of the
+// members' videos on or off. Their videos are packaged again so the change
+// reaches what's already uploaded.
+func (cfg *apiConfig) handlerOrganizationForensicWatermark(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Enabled bool `json:"enabled"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+	// the watermarked variants are the encrypted HLS rendition
+	if params.Enabled && !cfg.hlsEncryption {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "Forensic watermarking needs HLS encryption, which is turned off", nil)
+		return
+	}
+
+	org, ok := cfg.getOwnedOrganization(w, userID)
+	if !ok {
+		return
+	}
+
+	err = cfg.db.SetOrganizationForensicWatermark(org.ID, params.Enabled)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update organization", err)
+		return
+	}
+	org.ForensicWatermark = params.Enabled
+
+	members, err := cfg.db.GetOrganizationMembers(org.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get organization members", err)
+		return
+	}
+	for _, member := range members {
+		videos, err := cfg.db.GetVideos(member.UserID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get videos", err)
+			return
+		}
+		for _, video := range videos {
+			if video.VideoURL != nil && video.HLSWatermarked != params.Enabled {
+				cfg.requestHLSPackaging(video.ID)
+			}
+		}
+	}
+
+	cfg.respondWithOrganization(w, http.StatusOK, org)
+}
+
+// handlerOrganizationRequireTwoFactor sets whether owners need two-factor
+// authentication to manage the organization. Turning it on takes an owner
+// who has it, or they would lock themselves out.
+func (cfg *apiConfig) handlerOrganizationRequireTwoFactor(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Required bool `json:"required"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	org, ok := cfg.getOwnedOrganization(w, userID)
+	if !ok {
+		return
+	}
+	if params.Required {
+		twoFactor, err := cfg.db.GetTwoFactor(userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get two-factor settings", err)
+			return
+		}
+		if twoFactor.EnabledAt == nil {
+			respondWithError(w, http.StatusConflict, errCodeTwoFactorRequired, "Set up two-factor authentication before requiring it", nil)
+			return
+		}
+	}
+
+	err = cfg.db.SetOrganizationRequireTwoFactor(org.ID, params.Required)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update organization", err)
+		return
+	}
+	org.RequireTwoFactor = params.Required
+
+	cfg.respondWithOrganization(w, http.StatusOK, org)
+}
+
+func (cfg *apiConfig) handlerOrganizationDomainVerify(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	org, ok := cfg.getOwnedOrganization(w, userID)
+	if !ok {
+		return
+	}
+	if org.CustomDomain == nil {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "Set a custom domain first", nil)
+		return
+	}
+
+	if org.DomainVerifiedAt == nil {
+		err = verifyDomainTXT(r.Context(), *org.CustomDomain, *org.DomainVerificationToken)
+		if err != nil {
+			respondWithError(w, http.StatusUnprocessableEntity, errCodeDomainNotVerified, "Couldn't verify domain", err)
+			return
+		}
+		err = cfg.db.MarkOrganizationDomainVerified(org.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update domain", err)
+			return
+		}
+	}
+
+	org, err = cfg.db.GetOrganization(org.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get organization", err)
+		return
+	}
+	cfg.respondWithOrganization(w, http.StatusOK, org)
+}
+
+// getOwnedOrganization looks up the organization the user owns, responding
+// with an error when there is none.
+func (cfg *apiConfig) getOwnedOrganization(w http.ResponseWriter, userID uuid.UUID) (database.Organization, bool) {
+	member, err := cfg.db.GetOrganizationMember(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get organization", err)
+		return database.Organization{}, false
+	}
+	if member.OrganizationID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeOrganizationNotFound, "You don't belong to an organization", nil)
+		return database.Organization{}, false
+	}
+	if member.Role != database.OrganizationRoleOwner {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "Only organization owners can do that", nil)
+		return database.Organization{}, false
+	}
+
+	org, err := cfg.db.GetOrganization(member.OrganizationID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get organization", err)
+		return database.Organization{}, false
+	}
+	if org.RequireTwoFactor {
+		twoFactor, err := cfg.db.GetTwoFactor(userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get two-factor settings", err)
+			return database.Organization{}, false
+		}
+		if twoFactor.EnabledAt == nil {
+			respondWithError(w, http.StatusForbidden, errCodeTwoFactorRequired, "Your organization requires two-factor authentication, set it up first", nil)
+			return database.Organization{}, false
+		}
+	}
+	return org, true
+}
+
+func (cfg *apiConfig) respondWithOrganization(w http.ResponseWriter, code int, org database.Organization) {
+	members, err := cfg.db.GetOrganizationMembers(org.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get organization members", err)
+		return
+	}
+
+	resp := organizationResponse{
+		Organization: org,
+		Members:      members,
+	}
+	if org.CustomDomain != nil && org.DomainVerifiedAt == nil {
+		resp.DNSRecord = &dnsRecord{
+			Type:  "TXT",
+			Name:  domainVerificationLabel + "." + *org.CustomDomain,
+			Value: *org.DomainVerificationToken,
+		}
+	}
+	respondWithJSON(w, code, resp)
+}
+
+// normalizeDomain lower-cases a host name and checks it is a plausible
+// public domain.
+func normalizeDomain(domain string) (string, error) {
+	domain = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
+	if len(domain) > 253 || !strings.Contains(domain, ".") {
+		return "", fmt.Errorf("%q is not a fully qualified domain name", domain)
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return "", fmt.Errorf("%q is not a valid domain name", domain)
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '-' {
+				return "", fmt.Errorf("%q is not a valid domain name", domain)
+			}
+		}
+	}
+	return domain, nil
+}
+
+func verifyDomainTXT(ctx context.Context, domain, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	name := domainVerificationLabel + "." + domain
+	records, err := net.DefaultResolver.LookupTXT(ctx, name)
+	if err != nil {
+		return fmt.Errorf("couldn't look up TXT records of %s: %w", name, err)
+	}
+	if !slices.Contains(records, token) {
+		return errors.New("TXT record with the verification token not found")
+	}
+	return nil
+}
+
+// playbackDomain returns the verified custom domain of the organization the
+// user belongs to, or "" when videos should use the default distribution.
+func (cfg *apiConfig) playbackDomain(userID uuid.UUID) (string, error) {
+	org, err := cfg.db.GetOrganizationByUser(userID)
+	if err != nil {
+		return "", err
+	}
+	if org.CustomDomain == nil || org.DomainVerifiedAt == nil {
+		return "", nil
+	}
+	return *org.CustomDomain, nil
+}
+
+// withPlaybackDomain serves a distribution URL from the custom domain
+// instead. The domain has to be set up as an alternate domain name of the
+// distribution for this to work.
+func (cfg *apiConfig) withPlaybackDomain(objectURL, domain string) string {
+	if domain == "" {
+		return objectURL
+	}
+	key, ok := cfg.objectKeyFromURL(objectURL)
+	if !ok {
+		return objectURL
+	}
+	return fmt.Sprintf("https://%s/%s", domain, cfg.storageRoute(key).bucketKey(key))
+}
@@ -0,0 +1,321 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerVideoPlayback(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		// VideoURL is left out for viewers of watermarked videos, they only
+		// get their own HLS playlist
+		VideoURL string `json:"video_url,omitempty"`
+		// HDRURL is an HDR rendition for players that can show it
+		HDRURL *string `json:"hdr_url,omitempty"`
+		// AES-128 encrypted rendition, keys need a logged-in viewer
+		HLSURL *string      `json:"hls_url,omitempty"`
+		DRM    *drmPlayback `json:"drm,omitempty"`
+		// AudioTracks are the dubs players can switch to, the HLS rendition
+		// offers them as alternate audio
+		AudioTracks []audioTrackPlayback `json:"audio_tracks"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+
+	video, err := cfg.cachedVideo(r.Context(), videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	viewerID := cfg.optionalViewerID(r)
+	isOwner := viewerID != uuid.Nil && video.UserID == viewerID
+	if isVideoHidden(video) && !isOwner {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoFileMissing, "Video has no file yet", nil)
+		return
+	}
+
+	// owners can always watch their own uploads
+	if !isOwner {
+		country := cfg.viewerCountry(r)
+		if reason, blocked := geoBlockReason(video, country); blocked {
+			respondWithError(w, http.StatusUnavailableForLegalReasons, errCodeGeoBlocked, reason, nil)
+			return
+		}
+
+		if !cfg.checkPlaybackToken(w, r, viewerID, video.ID) {
+			return
+		}
+	}
+
+	domain, err := cfg.playbackDomain(video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get playback domain", err)
+		return
+	}
+	audioTracks, err := cfg.db.GetAudioTracks(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get audio tracks", err)
+		return
+	}
+
+	watermarked, err := cfg.isWatermarkProtected(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't check watermarking", err)
+		return
+	}
+	if watermarked && !isOwner {
+		if !video.HLSWatermarked {
+			respondWithError(w, http.StatusNotFound, errCodeVideoFileMissing, "Video is still being watermarked", nil)
+			return
+		}
+		cfg.recordVideoDelivery(r.Context(), video.ID)
+		cfg.recordWatchHistory(r.Context(), viewerID, video.ID)
+		cfg.recordVideoView(r.Context(), video.ID)
+		hlsURL := cfg.watermarkedPlaylistURL(video.ID)
+		respondWithJSON(w, http.StatusOK, response{
+			HLSURL:      &hlsURL,
+			AudioTracks: cfg.audioTrackPlayback(audioTracks, domain),
+		})
+		return
+	}
+
+	drmRenditions, err := cfg.videoDRMPlayback(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get DRM renditions", err)
+		return
+	}
+
+	resp := response{
+		VideoURL:    cfg.withPlaybackDomain(*video.VideoURL, domain),
+		DRM:         drmRenditions,
+		AudioTracks: cfg.audioTrackPlayback(audioTracks, domain),
+	}
+	if key, ok := cfg.objectKeyFromURL(*video.VideoURL); ok {
+		version, err := cfg.db.GetVideoVersionByKey(key)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video version", err)
+			return
+		}
+		if version.HDRKey != nil {
+			hdrURL := cfg.withPlaybackDomain(cfg.objectURL(*version.HDRKey), domain)
+			resp.HDRURL = &hdrURL
+		}
+	}
+	if video.HLSWatermarked {
+		hlsURL := cfg.watermarkedPlaylistURL(video.ID)
+		resp.HLSURL = &hlsURL
+	} else if video.HLSPlaylistKey != nil {
+		hlsURL := cfg.withPlaybackDomain(cfg.objectURL(*video.HLSPlaylistKey), domain)
+		resp.HLSURL = &hlsURL
+	}
+	if resp.DRM != nil {
+		resp.DRM.HLSURL = cfg.withPlaybackDomain(resp.DRM.HLSURL, domain)
+		resp.DRM.DASHURL = cfg.withPlaybackDomain(resp.DRM.DASHURL, domain)
+	}
+
+	cfg.recordVideoDelivery(r.Context(), video.ID)
+	cfg.recordWatchHistory(r.Context(), viewerID, video.ID)
+	if !isOwner {
+		cfg.recordVideoView(r.Context(), video.ID)
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) handlerVideoGeoUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		AllowedCountries []string `json:"allowed_countries"`
+		BlockedCountries []string `json:"blocked_countries"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this video", nil)
+		return
+	}
+
+	video.AllowedCountries = params.AllowedCountries
+	video.BlockedCountries = params.BlockedCountries
+	err = validateVideoCountries(&video.CreateVideoParams)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid country list", err)
+		return
+	}
+
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.withSignedURLs(video))
+}
+
+// validateVideoCountries normalizes the allow and block lists to upper case
+// ISO 3166-1 alpha-2 codes.
+func validateVideoCountries(params *database.CreateVideoParams) error {
+	normalize := func(countries []string) ([]string, error) {
+		normalized := make([]string, 0, len(countries))
+		for _, country := range countries {
+			country = strings.ToUpper(strings.TrimSpace(country))
+			if len(country) != 2 || country[0] < 'A' || country[0] > 'Z' || country[1] < 'A' || country[1] > 'Z' {
+				return nil, fmt.Errorf("%q is not a two letter country code", country)
+			}
+			if !slices.Contains(normalized, country) {
+				normalized = append(normalized, country)
+			}
+		}
+		return normalized, nil
+	}
+
+	var err error
+	params.AllowedCountries, err = normalize(params.AllowedCountries)
+	if err != nil {
+		return err
+	}
+	params.BlockedCountries, err = normalize(params.BlockedCountries)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// geoBlockReason checks the viewer's country against the video's rules. An
+// unknown country only passes when the video has no allow list.
+func geoBlockReason(video database.Video, country string) (string, bool) {
+	if country != "" && slices.Contains(video.BlockedCountries, country) {
+		return fmt.Sprintf("This video is not available in your country (%s)", country), true
+	}
+	if len(video.AllowedCountries) > 0 && !slices.Contains(video.AllowedCountries, country) {
+		if country == "" {
+			return "This video is only available in some countries and we couldn't determine yours", true
+		}
+		return fmt.Sprintf("This video is not available in your country (%s)", country), true
+	}
+	return "", false
+}
+
+// optionalViewerID is the logged-in viewer, uuid.Nil for anonymous viewers:
+// they don't have to be logged in for public videos.
+func (cfg *apiConfig) optionalViewerID(r *http.Request) uuid.UUID {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return uuid.Nil
+	}
+	viewerID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		return uuid.Nil
+	}
+	return viewerID
+}
+
+// viewerCountry works out where a request comes from. Behind CloudFront we
+// trust its viewer country header, otherwise we look up the client IP.
+func (cfg *apiConfig) viewerCountry(r *http.Request) string {
+	if cfg.trustProxyHeaders {
+		if country := r.Header.Get("CloudFront-Viewer-Country"); country != "" {
+			return strings.ToUpper(country)
+		}
+	}
+
+	addr, ok := cfg.clientIP(r)
+	if !ok {
+		return ""
+	}
+	return cfg.geoIP.Country(addr)
+}
+
+// clientIP is the address a request comes from. Behind proxies it's the
+// X-Forwarded-For entry trustedProxyHops from the right: every proxy appends
+// the address it got the request from, so the entries left of those are
+// whatever the client sent.
+func (cfg *apiConfig) clientIP(r *http.Request) (netip.Addr, bool) {
+	if cfg.trustProxyHeaders {
+		if addr, ok := forwardedClientIP(r.Header.Values("X-Forwarded-For"), cfg.trustedProxyHops); ok {
+			return addr, true
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr, true
+}
+
+// forwardedClientIP picks the entry hops from the right out of the
+// X-Forwarded-For headers. A request with fewer entries didn't come through
+// every proxy, so none of them can be trusted.
+func forwardedClientIP(headers []string, hops int) (netip.Addr, bool) {
+	var entries []string
+	for _, header := range headers {
+		for _, entry := range strings.Split(header, ",") {
+			entries = append(entries, strings.TrimSpace(entry))
+		}
+	}
+	if hops < 1 || len(entries) < hops {
+		return netip.Addr{}, false
+	}
+	addr, err := netip.ParseAddr(entries[len(entries)-hops])
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr, true
+}
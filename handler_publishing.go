@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const publishInterval = time.Minute
+
+// validateVideoVisibility checks the visibility and schedule of a new video.
+// Videos scheduled for the future stay private until they are published.
+func validateVideoVisibility(params *database.CreateVideoParams) error {
+	switch params.Visibility {
+	case "", database.VisibilityPublic, database.VisibilityPrivate:
+	default:
+		return fmt.Errorf("visibility must be %q or %q", database.VisibilityPublic, database.VisibilityPrivate)
+	}
+
+	if params.PublishAt != nil {
+		if !params.PublishAt.After(time.Now()) {
+			return errors.New("publish_at must be in the future")
+		}
+		// stored as text, so keep every timestamp in UTC for comparisons
+		publishAt := params.PublishAt.UTC()
+		params.PublishAt = &publishAt
+		params.Visibility = database.VisibilityPrivate
+	}
+	return nil
+}
+
+func (cfg *apiConfig) handlerVideoSchedule(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		PublishAt *time.Time `json:"publish_at"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this video", nil)
+		return
+	}
+
+	// clearing the schedule keeps the video private
+	video.PublishAt = params.PublishAt
+	video.Visibility = database.VisibilityPrivate
+	err = validateVideoVisibility(&video.CreateVideoParams)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid schedule", err)
+		return
+	}
+
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.withSignedURLs(video))
+}
+
+// publishScheduledVideos flips scheduled videos to public once their publish
+// time has passed and tells the owner about it.
+func (cfg *apiConfig) publishScheduledVideos(ctx context.Context) error {
+	videos, err := cfg.db.GetVideosDueForPublishing(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+
+	for _, video := range videos {
+		err = cfg.db.PublishVideo(video.ID)
+		if err != nil {
+			return fmt.Errorf("couldn't publish video %s: %w", video.ID, err)
+		}
+
+		video, err = cfg.db.GetVideo(video.ID)
+		if err != nil {
+			return err
+		}
+
+		err = cfg.sendWebhook(ctx, "video.published", video)
+		if err != nil {
+			log.Printf("Couldn't send video.published webhook for %s: %v", video.ID, err)
+		}
+
+		cfg.notify(database.CreateNotificationParams{
+			UserID:  video.UserID,
+			VideoID: &video.ID,
+			Type:    database.NotificationVideoPublished,
+			Title:   fmt.Sprintf("%q is now public", video.Title),
+			Body:    fmt.Sprintf("Your scheduled video %q was published.", video.Title),
+		})
+	}
+	return nil
+}
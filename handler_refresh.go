@@ -14,23 +14,44 @@ func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 
 	refreshToken, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't find token", err)
+		respondWithError(w, http.StatusBadRequest, errCodeUnauthenticated, "Couldn't find token", err)
 		return
 	}
 
 	user, err := cfg.db.GetUserByRefreshToken(refreshToken)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't get user for refresh token", err)
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't get user for refresh token", err)
+		return
+	}
+	// revoked, expired or never issued
+	if user == nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Invalid refresh token", nil)
+		return
+	}
+	session, err := cfg.db.GetRefreshToken(refreshToken)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get session", err)
+		return
+	}
+
+	ipAddress := ""
+	if addr, ok := cfg.clientIP(r); ok {
+		ipAddress = addr.String()
+	}
+	err = cfg.db.TouchRefreshToken(refreshToken, ipAddress)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update session", err)
 		return
 	}
 
 	accessToken, err := auth.MakeJWT(
 		user.ID,
+		session.ID,
 		cfg.jwtSecret,
 		time.Hour,
 	)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate token", err)
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate token", err)
 		return
 	}
 
@@ -42,13 +63,13 @@ func (cfg *apiConfig) handlerRefresh(w http.ResponseWriter, r *http.Request) {
 func (cfg *apiConfig) handlerRevoke(w http.ResponseWriter, r *http.Request) {
 	refreshToken, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't find token", err)
+		respondWithError(w, http.StatusBadRequest, errCodeUnauthenticated, "Couldn't find token", err)
 		return
 	}
 
 	err = cfg.db.RevokeRefreshToken(refreshToken)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't revoke session", err)
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't revoke session", err)
 		return
 	}
 
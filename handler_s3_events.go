@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+)
+
+// SNS messages are at most 256 KiB
+const maxSNSMessageBytes = 256 << 10
+
+// handlerS3Events receives S3 event notifications from an SNS topic over
+// HTTPS. Only signed messages of the configured topic are accepted. SNS
+// retries anything but a 2xx, so failed events are answered with a 500.
+func (cfg *apiConfig) handlerS3Events(w http.ResponseWriter, r *http.Request) {
+	if cfg.s3EventsTopicArn == "" {
+		respondWithError(w, http.StatusNotImplemented, errCodeNotImplemented, "S3 event notifications aren't configured", nil)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSNSMessageBytes))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't read message", err)
+		return
+	}
+	var msg snsMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode message", err)
+		return
+	}
+	if msg.TopicArn != cfg.s3EventsTopicArn {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "Unknown topic", nil)
+		return
+	}
+	err = cfg.snsVerifier.Verify(r.Context(), msg)
+	if err != nil {
+		if errors.Is(err, errInvalidSNSSignature) {
+			respondWithError(w, http.StatusForbidden, errCodeForbidden, "Invalid signature", err)
+			return
+		}
+		respondWithError(w, http.StatusBadGateway, errCodeUpstreamFailed, "Couldn't verify signature", err)
+		return
+	}
+
+	switch msg.Type {
+	case "SubscriptionConfirmation":
+		u, err := url.Parse(msg.SubscribeURL)
+		if err != nil || u.Scheme != "https" || !snsCertHostPattern.MatchString(u.Host) {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid subscribe URL", err)
+			return
+		}
+		req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, msg.SubscribeURL, nil)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't confirm subscription", err)
+			return
+		}
+		resp, err := cfg.snsVerifier.httpClient.Do(req)
+		if err != nil {
+			respondWithError(w, http.StatusBadGateway, errCodeUpstreamFailed, "Couldn't confirm subscription", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			respondWithError(w, http.StatusBadGateway, errCodeUpstreamFailed, "Couldn't confirm subscription: "+resp.Status, nil)
+			return
+		}
+		log.Printf("Subscribed to S3 events of %s", msg.TopicArn)
+
+	case "Notification":
+		err := cfg.handleS3EventMessage(r.Context(), []byte(msg.Message))
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't handle S3 event", err)
+			return
+		}
+
+	case "UnsubscribeConfirmation":
+		log.Printf("Unsubscribed from S3 events of %s", msg.TopicArn)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
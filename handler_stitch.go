@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	jobTypeStitchVideos = "stitch_videos"
+
+	maxStitchClips = 50
+)
+
+// stitchClip is one part of a stitched video. Start and End trim the source
+// video in seconds, an End of 0 runs to its end.
+type stitchClip struct {
+	VideoID uuid.UUID `json:"video_id"`
+	Start   float64   `json:"start"`
+	End     float64   `json:"end"`
+}
+
+type stitchVideosPayload struct {
+	Clips []stitchClip `json:"clips"`
+}
+
+// handlerVideosStitch creates a new video out of clips of the user's videos,
+// joined in the order given. The stitching runs as a job, after which the
+// result goes through the pipeline like an upload.
+func (cfg *apiConfig) handlerVideosStitch(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		database.CreateVideoParams
+		Clips []stitchClip `json:"clips"`
+	}
+	type response struct {
+		Video database.Video `json:"video"`
+		Job   database.Job   `json:"job"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+	params.UserID = userID
+
+	if len(params.Clips) < 2 || len(params.Clips) > maxStitchClips {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("Stitching takes between 2 and %d clips", maxStitchClips), nil)
+		return
+	}
+	for i, clip := range params.Clips {
+		if clip.Start < 0 || clip.End < 0 || (clip.End != 0 && clip.End <= clip.Start) {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("Clip %d must end after it starts", i+1), nil)
+			return
+		}
+
+		if !cfg.checkSourceVideo(w, userID, clip.VideoID, fmt.Sprintf("the video of clip %d", i+1)) {
+			return
+		}
+	}
+
+	err = validateVideoVisibility(&params.CreateVideoParams)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid visibility", err)
+		return
+	}
+	err = validateVideoCountries(&params.CreateVideoParams)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid country list", err)
+		return
+	}
+	err = validateVideoTags(&params.CreateVideoParams)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid tags", err)
+		return
+	}
+	err = validateVideoMetadata(&params.CreateVideoParams)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid metadata", err)
+		return
+	}
+	if !cfg.checkExternalID(w, userID, uuid.Nil, &params.CreateVideoParams) {
+		return
+	}
+	if !cfg.admitUpload(w, userID) {
+		return
+	}
+
+	video, err := cfg.createVideo(r.Context(), params.CreateVideoParams)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create video", err)
+		return
+	}
+
+	job, err := cfg.enqueueJob(jobTypeStitchVideos, &video.ID, stitchVideosPayload{Clips: params.Clips})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create stitch job", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, response{
+		Video: cfg.withSignedURLs(video),
+		Job:   job,
+	})
+}
+
+// checkSourceVideo makes sure a video that's used to make a new one belongs
+// to the user and has a file. It responds with the error itself, naming the
+// video by what it's used as.
+func (cfg *apiConfig) checkSourceVideo(w http.ResponseWriter, userID, videoID uuid.UUID, name string) bool {
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return false
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, fmt.Sprintf("Couldn't find %s", name), nil)
+		return false
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, fmt.Sprintf("You don't own %s", name), nil)
+		return false
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, errCodeVideoFileMissing, fmt.Sprintf("%s has no file yet", strings.ToUpper(name[:1])+name[1:]), nil)
+		return false
+	}
+	return true
+}
+
+func (cfg *apiConfig) runStitchVideosJob(ctx context.Context, job database.Job) error {
+	var payload stitchVideosPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+	if job.VideoID == nil {
+		return fmt.Errorf("stitch job has no video")
+	}
+
+	video, err := cfg.db.GetVideo(*job.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		return fmt.Errorf("video %s no longer exists", *job.VideoID)
+	}
+
+	dir, err := os.MkdirTemp("", "tubely-stitch")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	inputs := make([]stitchInput, 0, len(payload.Clips))
+	for i, clip := range payload.Clips {
+		input, err := cfg.downloadStitchClip(ctx, video.UserID, clip, filepath.Join(dir, fmt.Sprintf("clip%03d.mp4", i)))
+		if err != nil {
+			return withStage("download", fmt.Errorf("clip %d: %w", i+1, err))
+		}
+		inputs = append(inputs, input)
+	}
+
+	outPath := filepath.Join(dir, "stitched.mp4")
+	err = stitchClips(ctx, inputs, outPath)
+	if err != nil {
+		return withStage("stitch", err)
+	}
+
+	_, err = cfg.processVideoUpload(ctx, video, outPath, cfg.defaultTranscodeProfile())
+	return err
+}
+
+// stitchInput is a downloaded clip with what stitching needs to know about
+// it.
+type stitchInput struct {
+	path     string
+	start    float64
+	duration float64
+	width    int
+	height   int
+	hasAudio bool
+	// params are the stream parameters that have to match for files to be
+	// joined without re-encoding
+	params string
+}
+
+// downloadStitchClip fetches the clip's video, which must still belong to the
+// user, and works out which part of it to use.
+func (cfg *apiConfig) downloadStitchClip(ctx context.Context, userID uuid.UUID, clip stitchClip, path string) (stitchInput, error) {
+	source, err := cfg.db.GetVideo(clip.VideoID)
+	if err != nil {
+		return stitchInput{}, err
+	}
+	if source.ID == uuid.Nil || source.DeletedAt != nil || source.UserID != userID || source.VideoURL == nil {
+		return stitchInput{}, &invalidMediaError{
+			reason: fmt.Sprintf("video %s is gone or has no file", clip.VideoID),
+			hint:   "try again without it",
+		}
+	}
+	key, ok := cfg.objectKeyFromURL(*source.VideoURL)
+	if !ok {
+		return stitchInput{}, fmt.Errorf("video %s isn't stored in our bucket", source.ID)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return stitchInput{}, err
+	}
+	err = cfg.downloadObject(ctx, key, file)
+	file.Close()
+	if err != nil {
+		return stitchInput{}, fmt.Errorf("couldn't download %s: %w", key, err)
+	}
+
+	input, err := probeStitchInput(ctx, path)
+	if err != nil {
+		return stitchInput{}, err
+	}
+	if clip.Start >= input.duration {
+		return stitchInput{}, &invalidMediaError{
+			reason: fmt.Sprintf("the clip starts at %.1fs but video %s is only %.1fs long", clip.Start, source.ID, input.duration),
+			hint:   "pick a start within the video",
+		}
+	}
+	end := input.duration
+	if clip.End != 0 {
+		end = min(clip.End, input.duration)
+	}
+	input.start = clip.Start
+	input.duration = end - clip.Start
+	return input, nil
+}
+
+// probeStitchInput reads what joining needs to know about the whole file at
+// path.
+func probeStitchInput(ctx context.Context, path string) (stitchInput, error) {
+	duration, err := getVideoDuration(ctx, path)
+	if err != nil {
+		return stitchInput{}, err
+	}
+	streams, err := probeStreams(ctx, path)
+	if err != nil {
+		return stitchInput{}, err
+	}
+	i := slices.IndexFunc(streams.Streams, func(s Stream) bool { return s.CodecType == "video" })
+	if i < 0 {
+		return stitchInput{}, fmt.Errorf("no video stream found in %s", filepath.Base(path))
+	}
+	v := streams.Streams[i]
+
+	input := stitchInput{
+		path:     path,
+		duration: duration,
+		width:    v.Width,
+		height:   v.Height,
+		params:   fmt.Sprintf("%s/%s/%dx%d/%s/%s", v.CodecName, v.Profile, v.Width, v.Height, v.PixFmt, v.RFrameRate),
+	}
+	if i := slices.IndexFunc(streams.Streams, func(s Stream) bool { return s.CodecType == "audio" }); i >= 0 {
+		a := streams.Streams[i]
+		input.hasAudio = true
+		input.params += fmt.Sprintf(" %s/%s/%d", a.CodecName, a.SampleRate, a.Channels)
+	}
+	return input, nil
+}
+
+// stitchClips joins the inputs with ffmpeg's concat filter. Every clip is
+// fitted into the first one's frame, letterboxed where the aspect ratio
+// differs, and clips without audio get silence so the streams line up.
+func stitchClips(ctx context.Context, inputs []stitchInput, outPath string) error {
+	// H.264 needs even dimensions
+	width, height := inputs[0].width&^1, inputs[0].height&^1
+
+	var args []string
+	var filter, concat strings.Builder
+	for i, input := range inputs {
+		args = append(args, "-i", input.path)
+
+		start := strconv.FormatFloat(input.start, 'f', 3, 64)
+		duration := strconv.FormatFloat(input.duration, 'f', 3, 64)
+		fmt.Fprintf(&filter, "[%d:v]trim=start=%s:duration=%s,setpts=PTS-STARTPTS,"+
+			"scale=%d:%d:force_original_aspect_ratio=decrease,pad=%d:%d:(ow-iw)/2:(oh-ih)/2,setsar=1,format=yuv420p[v%d];",
+			i, start, duration, width, height, width, height, i)
+		if input.hasAudio {
+			fmt.Fprintf(&filter, "[%d:a]atrim=start=%s:duration=%s,asetpts=PTS-STARTPTS,", i, start, duration)
+		} else {
+			fmt.Fprintf(&filter, "anullsrc=r=48000:cl=stereo,atrim=duration=%s,", duration)
+		}
+		fmt.Fprintf(&filter, "aresample=48000,aformat=channel_layouts=stereo[a%d];", i)
+		fmt.Fprintf(&concat, "[v%d][a%d]", i, i)
+	}
+	fmt.Fprintf(&concat, "concat=n=%d:v=1:a=1[v][a]", len(inputs))
+	filter.WriteString(concat.String())
+
+	args = append(args,
+		"-y",
+		"-filter_complex", filter.String(),
+		"-map", "[v]",
+		"-map", "[a]",
+		// the pipeline transcodes the result again, keep as much as we can
+		"-c:v", "libx264",
+		"-preset", "veryfast",
+		"-crf", "16",
+		"-c:a", "aac",
+		"-b:a", "192k",
+		outPath,
+	)
+	cmd := ffmpegRunner.Command(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return newCommandError("ffmpeg", err, stderr.Bytes())
+	}
+	return nil
+}
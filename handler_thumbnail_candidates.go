@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// handlerThumbnailCandidatesRetrieve lists the frames scene detection picked
+// when the video was processed.
+func (cfg *apiConfig) handlerThumbnailCandidatesRetrieve(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this video", nil)
+		return
+	}
+
+	candidates, err := cfg.db.GetThumbnailCandidates(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get thumbnail candidates", err)
+		return
+	}
+	for i := range candidates {
+		candidates[i].ThumbnailURL = cfg.signAssetURL(candidates[i].ThumbnailURL)
+	}
+
+	respondWithJSON(w, http.StatusOK, candidates)
+}
+
+// handlerThumbnailCandidateSelect makes a copy of the candidate the video's
+// thumbnail. The copy counts as the owner's own thumbnail, so processing
+// the video again replaces the candidates but not the choice.
+func (cfg *apiConfig) handlerThumbnailCandidateSelect(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+	candidateID, err := uuid.Parse(r.PathValue("candidateID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid candidate ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this video", nil)
+		return
+	}
+
+	candidate, err := cfg.db.GetThumbnailCandidate(candidateID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get thumbnail candidate", err)
+		return
+	}
+	if candidate.ID == uuid.Nil || candidate.VideoID != video.ID {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Couldn't find thumbnail candidate", nil)
+		return
+	}
+	candidatePath, ok := cfg.assetPathFromURL(candidate.ThumbnailURL)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Thumbnail candidate isn't stored locally", nil)
+		return
+	}
+
+	fileName := fmt.Sprintf("%s-%s.jpg", video.ID, uuid.New())
+	err = copyAsset(candidatePath, filepath.Join(cfg.assetsRoot, fileName))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't copy thumbnail candidate", err)
+		return
+	}
+
+	thumbnailURL := fmt.Sprintf("http://localhost:8091/assets/%s", fileName)
+	video.ThumbnailURL = &thumbnailURL
+	video.ThumbnailGenerated = false
+	video.ThumbnailVariantID = nil
+
+	err = cfg.ensureBlurredThumbnail(r.Context(), &video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't blur thumbnail", err)
+		return
+	}
+
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video", err)
+		return
+	}
+
+	cfg.requestModeration(video.ID)
+
+	respondWithJSON(w, http.StatusOK, cfg.withSignedURLs(video))
+}
+
+func copyAsset(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// handlerThumbnailVariantCreate uploads one of the thumbnails an owner can
+// A/B test. Variants start inactive.
+func (cfg *apiConfig) handlerThumbnailVariantCreate(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this video", nil)
+		return
+	}
+
+	fileName, ok := cfg.receiveThumbnailFile(w, r)
+	if !ok {
+		return
+	}
+	filePath := filepath.Join(cfg.assetsRoot, fileName)
+
+	variant, err := cfg.db.CreateThumbnailVariant(video.ID, fmt.Sprintf("http://localhost:8091/assets/%s", fileName))
+	if err != nil {
+		os.Remove(filePath)
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create thumbnail variant", err)
+		return
+	}
+	if variant.ID == uuid.Nil {
+		os.Remove(filePath)
+		respondWithErrorDetails(w, http.StatusConflict, errCodeCapacityExceeded, fmt.Sprintf("Videos can have at most %d thumbnail variants", database.MaxThumbnailVariants), map[string]int{"max_variants": database.MaxThumbnailVariants}, nil)
+		return
+	}
+
+	variant.ThumbnailURL = cfg.signAssetURL(variant.ThumbnailURL)
+	respondWithJSON(w, http.StatusCreated, variant)
+}
+
+func (cfg *apiConfig) handlerThumbnailVariantsRetrieve(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this video", nil)
+		return
+	}
+
+	variants, err := cfg.db.GetThumbnailVariants(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get thumbnail variants", err)
+		return
+	}
+	for i := range variants {
+		variants[i].ThumbnailURL = cfg.signAssetURL(variants[i].ThumbnailURL)
+	}
+
+	respondWithJSON(w, http.StatusOK, variants)
+}
+
+// handlerThumbnailVariantActivate makes the variant the video's thumbnail.
+func (cfg *apiConfig) handlerThumbnailVariantActivate(w http.ResponseWriter, r *http.Request) {
+	video, variant, ok := cfg.ownedThumbnailVariant(w, r)
+	if !ok {
+		return
+	}
+
+	thumbnailURL := variant.ThumbnailURL
+	video.ThumbnailURL = &thumbnailURL
+	video.ThumbnailGenerated = false
+	video.ThumbnailVariantID = &variant.ID
+
+	err := cfg.ensureBlurredThumbnail(r.Context(), &video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't blur thumbnail", err)
+		return
+	}
+
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video", err)
+		return
+	}
+
+	cfg.requestModeration(video.ID)
+
+	respondWithJSON(w, http.StatusOK, cfg.withSignedURLs(video))
+}
+
+func (cfg *apiConfig) handlerThumbnailVariantDelete(w http.ResponseWriter, r *http.Request) {
+	video, variant, ok := cfg.ownedThumbnailVariant(w, r)
+	if !ok {
+		return
+	}
+	if video.ThumbnailVariantID != nil && *video.ThumbnailVariantID == variant.ID {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "The active variant can't be deleted, activate another one or upload a thumbnail first", nil)
+		return
+	}
+
+	err := cfg.db.DeleteThumbnailVariant(variant.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't delete thumbnail variant", err)
+		return
+	}
+
+	if thumbnailPath, ok := cfg.assetPathFromURL(variant.ThumbnailURL); ok {
+		ext := filepath.Ext(thumbnailPath)
+		for _, path := range []string{thumbnailPath, strings.TrimSuffix(thumbnailPath, ext) + "-blur" + ext} {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				log.Printf("Couldn't remove thumbnail variant %s: %v", path, err)
+			}
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownedThumbnailVariant loads the video and variant named in the path for
+// their owner, responding with the error itself when that fails.
+func (cfg *apiConfig) ownedThumbnailVariant(w http.ResponseWriter, r *http.Request) (database.Video, database.ThumbnailVariant, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return database.Video{}, database.ThumbnailVariant{}, false
+	}
+	variantID, err := uuid.Parse(r.PathValue("variantID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid variant ID", err)
+		return database.Video{}, database.ThumbnailVariant{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return database.Video{}, database.ThumbnailVariant{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return database.Video{}, database.ThumbnailVariant{}, false
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return database.Video{}, database.ThumbnailVariant{}, false
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil)
+		return database.Video{}, database.ThumbnailVariant{}, false
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this video", nil)
+		return database.Video{}, database.ThumbnailVariant{}, false
+	}
+
+	variant, err := cfg.db.GetThumbnailVariant(variantID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get thumbnail variant", err)
+		return database.Video{}, database.ThumbnailVariant{}, false
+	}
+	if variant.ID == uuid.Nil || variant.VideoID != video.ID {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Couldn't find thumbnail variant", nil)
+		return database.Video{}, database.ThumbnailVariant{}, false
+	}
+	return video, variant, true
+}
+
+// handlerThumbnailBeacon counts impressions and clicks of the variant a
+// viewer was shown. It's meant for navigator.sendBeacon, so it needs no auth
+// and never tells the client anything.
+func (cfg *apiConfig) handlerThumbnailBeacon(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		VariantID uuid.UUID               `json:"variant_id"`
+		Event     database.ThumbnailEvent `json:"event"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	// beacons are tiny, anything bigger isn't one
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<10)
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Event != database.ThumbnailEventImpression && params.Event != database.ThumbnailEventClick {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Event must be impression or click", nil)
+		return
+	}
+
+	err = cfg.db.RecordThumbnailEvent(videoID, params.VariantID, params.Event)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't record thumbnail event", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const trashPurgeInterval = time.Hour
+
+func (cfg *apiConfig) handlerVideosTrashRetrieve(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	videos, err := cfg.db.GetTrashedVideos(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't retrieve videos", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.withSignedURLsAll(videos))
+}
+
+func (cfg *apiConfig) handlerVideoRestore(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You can't restore this video", nil)
+		return
+	}
+	if video.DeletedAt == nil {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "Video is not in the trash", nil)
+		return
+	}
+	if time.Since(*video.DeletedAt) > cfg.trashRetention {
+		respondWithError(w, http.StatusGone, errCodeRestoreWindowPassed, "The restore window for this video has passed", nil)
+		return
+	}
+
+	err = cfg.db.RestoreVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't restore video", err)
+		return
+	}
+
+	video, err = cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.withSignedURLs(video))
+}
+
+func (cfg *apiConfig) handlerVideoPurge(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You can't delete this video", nil)
+		return
+	}
+	if video.DeletedAt == nil {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "Only videos in the trash can be purged", nil)
+		return
+	}
+
+	err = cfg.purgeVideo(r.Context(), video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't delete video", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// purgeExpiredTrash permanently deletes videos that have been in the trash for
+// longer than the retention period.
+func (cfg *apiConfig) purgeExpiredTrash(ctx context.Context) error {
+	videos, err := cfg.db.GetVideosTrashedBefore(time.Now().UTC().Add(-cfg.trashRetention))
+	if err != nil {
+		return err
+	}
+
+	for _, video := range videos {
+		err = cfg.purgeVideo(ctx, video)
+		if err != nil {
+			return fmt.Errorf("couldn't purge video %s: %w", video.ID, err)
+		}
+	}
+
+	if len(videos) > 0 {
+		log.Printf("Purged %d videos from the trash", len(videos))
+	}
+	return nil
+}
+
+// purgeVideo deletes the video's files and then the video itself.
+func (cfg *apiConfig) purgeVideo(ctx context.Context, video database.Video) error {
+	err := cfg.deleteVideoAssets(ctx, video)
+	if err != nil {
+		return fmt.Errorf("couldn't delete video files: %w", err)
+	}
+	err = cfg.db.DeleteVideo(video.ID)
+	if err != nil {
+		return err
+	}
+	cfg.publishEvent(ctx, eventVideoDeleted, video, nil)
+	return nil
+}
@@ -0,0 +1,323 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	maxBatchSize = 100
+	// same limit as direct uploads
+	uploadSessionMaxBytes = 1 << 30
+)
+
+func (cfg *apiConfig) handlerVideosBatchCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Videos []database.CreateVideoParams `json:"videos"`
+	}
+	type uploadItem struct {
+		Video     database.Video `json:"video"`
+		SessionID uuid.UUID      `json:"session_id"`
+		// UploadURL takes a multipart/form-data POST of UploadFields followed
+		// by the file field
+		UploadURL    string            `json:"upload_url"`
+		UploadFields map[string]string `json:"upload_fields"`
+		ExpiresAt    time.Time         `json:"expires_at"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	if len(params.Videos) == 0 {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "At least one video is required", nil)
+		return
+	}
+	if len(params.Videos) > maxBatchSize {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("A batch can contain at most %d videos", maxBatchSize), nil)
+		return
+	}
+	for i := range params.Videos {
+		if params.Videos[i].Title == "" {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Every video needs a title", nil)
+			return
+		}
+		err = validateVideoVisibility(&params.Videos[i])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid visibility", err)
+			return
+		}
+		err = validateVideoCountries(&params.Videos[i])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid country list", err)
+			return
+		}
+		err = validateVideoTags(&params.Videos[i])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid tags", err)
+			return
+		}
+		err = validateVideoMetadata(&params.Videos[i])
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid metadata", err)
+			return
+		}
+		if !cfg.checkExternalID(w, userID, uuid.Nil, &params.Videos[i]) {
+			return
+		}
+		for _, other := range params.Videos[:i] {
+			if params.Videos[i].ExternalID != nil && other.ExternalID != nil && *other.ExternalID == *params.Videos[i].ExternalID {
+				respondWithError(w, http.StatusConflict, errCodeConflict, fmt.Sprintf("External ID %q is used twice in the batch", *other.ExternalID), nil)
+				return
+			}
+		}
+	}
+
+	// kept on the sessions for uploads processed from S3 events
+	profile, err := cfg.transcodeProfileFromRequest(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidTranscodeProfile, "Invalid transcode profile", err)
+		return
+	}
+	bumpers, err := cfg.bumpersFromRequest(r, userID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid bumpers", err)
+		return
+	}
+
+	if !cfg.admitUpload(w, userID) {
+		return
+	}
+
+	items := make([]uploadItem, 0, len(params.Videos))
+	for _, videoParams := range params.Videos {
+		videoParams.UserID = userID
+		video, err := cfg.createVideo(r.Context(), videoParams)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create video", err)
+			return
+		}
+
+		key := fmt.Sprintf("%s%s.mp4", uploadStagingPrefix, video.ID)
+		expiresAt := time.Now().UTC().Add(cfg.uploadSessionTTL)
+		uploadURL, uploadFields, err := cfg.presignPostObject(r.Context(), key, "video/mp4", uploadSessionMaxBytes, cfg.uploadSessionTTL)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create upload URL", err)
+			return
+		}
+
+		session, err := cfg.db.CreateUploadSession(database.CreateUploadSessionParams{
+			VideoID:          video.ID,
+			UserID:           userID,
+			S3Key:            key,
+			ExpiresAt:        expiresAt,
+			TranscodeProfile: profile.Name,
+			Bumpers:          bumpers.String(),
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create upload session", err)
+			return
+		}
+
+		items = append(items, uploadItem{
+			Video:        video,
+			SessionID:    session.ID,
+			UploadURL:    uploadURL,
+			UploadFields: uploadFields,
+			ExpiresAt:    session.ExpiresAt,
+		})
+	}
+
+	respondWithJSON(w, http.StatusCreated, items)
+}
+
+func (cfg *apiConfig) handlerUploadSessionComplete(w http.ResponseWriter, r *http.Request) {
+	sessionIDString := r.PathValue("sessionID")
+	sessionID, err := uuid.Parse(sessionIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	session, err := cfg.db.GetUploadSession(sessionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get upload session", err)
+		return
+	}
+	if session.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeUploadSessionNotFound, "Couldn't find upload session", nil)
+		return
+	}
+	if session.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this upload session", nil)
+		return
+	}
+	if session.CompletedAt != nil {
+		// the S3 event of the upload got to it first
+		video, err := cfg.db.GetVideo(session.VideoID)
+		if err != nil {
+			respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", err)
+			return
+		}
+		respondWithJSON(w, http.StatusOK, cfg.withSignedURLs(video))
+		return
+	}
+	if time.Now().UTC().After(session.ExpiresAt) {
+		respondWithError(w, http.StatusGone, errCodeUploadSessionExpired, "Upload session expired", nil)
+		return
+	}
+
+	profile, err := cfg.transcodeProfileFromRequest(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidTranscodeProfile, "Invalid transcode profile", err)
+		return
+	}
+
+	releaseSlot, err := cfg.acquireUploadSlot(r.Context(), userID)
+	if err != nil {
+		respondWithError(w, http.StatusTooManyRequests, errCodeRateLimited, "Too many uploads in progress, wait for one to finish", err)
+		return
+	}
+	defer releaseSlot()
+
+	video, err := cfg.completeUploadSession(cfg.processingContext(r), session, profile)
+	if err != nil {
+		if errors.Is(err, errUploadSessionClaimed) {
+			respondWithError(w, http.StatusConflict, errCodeConflict, "Upload is already being processed", nil)
+			return
+		}
+		if errors.Is(err, errVideoProcessingLocked) {
+			respondWithError(w, http.StatusConflict, errCodeConflict, "Another upload of the video is being processed", nil)
+			return
+		}
+		if errors.Is(err, errEmptyUpload) {
+			respondWithUploadError(w, "Video", err)
+			return
+		}
+		if errors.Is(err, errStagedUploadMissing) {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Couldn't read uploaded object, was the upload finished?", err)
+			return
+		}
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't process video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.withSignedURLs(video))
+}
+
+var (
+	errUploadSessionClaimed = errors.New("upload session is being processed")
+	errStagedUploadMissing  = errors.New("staged upload couldn't be read")
+)
+
+// completeUploadSession processes the staged upload of a session. Clients
+// completing the session and S3 events of the upload both end up here, the
+// session is claimed so only one of them processes it.
+func (cfg *apiConfig) completeUploadSession(ctx context.Context, session database.UploadSession, profile transcodeProfile) (database.Video, error) {
+	claimed, err := cfg.db.WithContext(ctx).ClaimUploadSession(session.ID)
+	if err != nil {
+		return database.Video{}, err
+	}
+	if !claimed {
+		return database.Video{}, errUploadSessionClaimed
+	}
+	// picked when the session was created
+	profile.bumpers, err = parseBumperSelection(session.Bumpers)
+	if err != nil {
+		return database.Video{}, err
+	}
+
+	video, err := cfg.processStagedUpload(ctx, session, profile)
+	if err != nil {
+		// let the client or a retry of the job try again
+		if err := cfg.db.WithContext(context.WithoutCancel(ctx)).ReleaseUploadSession(session.ID); err != nil {
+			log.Printf("Couldn't release upload session %s: %v", session.ID, err)
+		}
+		return database.Video{}, err
+	}
+	return video, nil
+}
+
+func (cfg *apiConfig) processStagedUpload(ctx context.Context, session database.UploadSession, profile transcodeProfile) (database.Video, error) {
+	video, err := cfg.db.GetVideo(session.VideoID)
+	if err != nil {
+		return database.Video{}, err
+	}
+	if video.ID == uuid.Nil {
+		return database.Video{}, fmt.Errorf("video %s no longer exists", session.VideoID)
+	}
+
+	tempFile, err := os.CreateTemp("", "tubely-upload.mp4")
+	if err != nil {
+		return database.Video{}, err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	err = cfg.downloadObject(ctx, session.S3Key, tempFile)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("%w: %v", errStagedUploadMissing, err)
+	}
+	info, err := tempFile.Stat()
+	if err != nil {
+		return database.Video{}, err
+	}
+	if info.Size() == 0 {
+		return database.Video{}, errEmptyUpload
+	}
+
+	video, err = cfg.processVideoUpload(ctx, video, tempFile.Name(), profile)
+	if err != nil {
+		return database.Video{}, err
+	}
+
+	// the video is processed, don't leave the session open because the
+	// client went away
+	ctx = context.WithoutCancel(ctx)
+	err = cfg.db.WithContext(ctx).CompleteUploadSession(session.ID)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("couldn't complete upload session: %w", err)
+	}
+
+	err = cfg.deleteObject(ctx, session.S3Key)
+	if err != nil {
+		log.Printf("Couldn't delete staged upload %s: %v", session.S3Key, err)
+	}
+	return video, nil
+}
@@ -2,63 +2,124 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"mime"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
-	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 
 	"github.com/google/uuid"
 )
 
+const (
+	maxThumbnailBytes = 10 << 20
+	// checksumSHA256Header optionally carries the hex SHA-256 of the uploaded
+	// file
+	checksumSHA256Header = "X-Checksum-SHA256"
+)
+
 func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
 		return
 	}
 
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
 		return
 	}
 
 	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
 		return
 	}
 
 	fmt.Println("uploading thumbnail for video", videoID, "by user", userID)
 
-	const maxMemory = 10 << 20
-	r.ParseMultipartForm(maxMemory)
+	fileName, ok := cfg.receiveThumbnailFile(w, r)
+	if !ok {
+		return
+	}
 
-	file, header, err := r.FormFile("thumbnail")
+	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Unable to parse form file", err)
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", err)
 		return
 	}
-	defer file.Close()
 
-	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this video", nil)
+		return
+	}
+
+	thumbnailURL := fmt.Sprintf("http://localhost:8091/assets/%s", fileName)
+
+	video.ThumbnailURL = &thumbnailURL
+	video.ThumbnailGenerated = false
+	video.ThumbnailVariantID = nil
+
+	err = cfg.ensureBlurredThumbnail(r.Context(), &video)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid content type", err)
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't blur thumbnail", err)
 		return
 	}
 
-	if mediaType != "image/jpeg" && mediaType != "image/png" {
-		respondWithError(w, http.StatusBadRequest, "Media type not allowed. Only jpeg and png are supported", nil)
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video", err)
 		return
 	}
 
+	cfg.requestModeration(video.ID)
+
+	respondWithJSON(w, http.StatusOK, cfg.withSignedURLs(video))
+}
+
+// receiveThumbnailFile validates the "thumbnail" image of a multipart upload
+// and stores it under the assets root. It responds with the error itself and
+// returns false when the upload is rejected.
+func (cfg *apiConfig) receiveThumbnailFile(w http.ResponseWriter, r *http.Request) (string, bool) {
+	// the form holds the image plus a little multipart framing
+	r.Body = http.MaxBytesReader(w, r.Body, maxThumbnailBytes+64<<10)
+	tooLarge := func(err error) {
+		respondWithErrorDetails(w, http.StatusRequestEntityTooLarge, errCodePayloadTooLarge, fmt.Sprintf("Thumbnail is larger than %d bytes", maxThumbnailBytes), map[string]int{"max_bytes": maxThumbnailBytes}, err)
+	}
+
+	part, err := streamFormFile(r, "thumbnail")
+	if err != nil {
+		if isMaxBytesError(err) {
+			tooLarge(err)
+			return "", false
+		}
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Unable to parse form file", err)
+		return "", false
+	}
+	defer part.Close()
+
+	mediaType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeUnsupportedMediaType, "Invalid content type", err)
+		return "", false
+	}
+
+	if mediaType != "image/jpeg" && mediaType != "image/png" {
+		respondWithError(w, http.StatusBadRequest, errCodeUnsupportedMediaType, "Media type not allowed. Only jpeg and png are supported", nil)
+		return "", false
+	}
+
 	var fileExtension string
 	if mediaType == "image/jpeg" {
 		fileExtension = "jpg"
@@ -70,8 +131,8 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 	key := make([]byte, 32)
 	_, err = rand.Read(key)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to fill key", err)
-		return
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Failed to fill key", err)
+		return "", false
 	}
 	randomString := base64.RawURLEncoding.EncodeToString(key)
 	fileName := fmt.Sprintf("%s.%s", randomString, fileExtension)
@@ -79,42 +140,150 @@ func (cfg *apiConfig) handlerUploadThumbnail(w http.ResponseWriter, r *http.Requ
 
 	newFile, err := os.Create(filePath)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to create file", err)
-		return
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Failed to create file", err)
+		return "", false
 	}
 	defer newFile.Close()
 
-	_, err = io.Copy(newFile, file)
+	hash := sha256.New()
+	written, err := io.Copy(io.MultiWriter(newFile, hash), io.LimitReader(part, maxThumbnailBytes+1))
+	if isMaxBytesError(err) {
+		os.Remove(filePath)
+		tooLarge(err)
+		return "", false
+	}
+	if err == nil && written > maxThumbnailBytes {
+		os.Remove(filePath)
+		tooLarge(nil)
+		return "", false
+	}
+	if err := checkPartReceived(part, written, err); err != nil {
+		os.Remove(filePath)
+		respondWithUploadError(w, "Thumbnail", err)
+		return "", false
+	}
+	// clients can send the image's checksum to catch corruption on the way
+	if expected := r.Header.Get(checksumSHA256Header); expected != "" {
+		actual := hex.EncodeToString(hash.Sum(nil))
+		if !strings.EqualFold(expected, actual) {
+			os.Remove(filePath)
+			respondWithError(w, http.StatusBadRequest, errCodeChecksumMismatch, fmt.Sprintf("Thumbnail SHA-256 is %s, not %s", actual, expected), nil)
+			return "", false
+		}
+	}
+	return fileName, true
+}
+
+// thumbnails picked from a frame read the video straight from S3 through a
+// short-lived link
+const thumbnailFrameLinkExpiry = 5 * time.Minute
+
+func (cfg *apiConfig) handlerThumbnailFromFrame(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		// seconds into the video
+		Timestamp *float64 `json:"timestamp"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to write file content", err)
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
 		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't find video", err)
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
 		return
 	}
 
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Timestamp == nil || *params.Timestamp < 0 {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Timestamp must be a non-negative number of seconds", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil)
+		return
+	}
 	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "You don't own this video", nil)
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this video", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, errCodeVideoFileMissing, "Video has no file to take a frame from", nil)
+		return
+	}
+	key, ok := cfg.objectKeyFromURL(*video.VideoURL)
+	if !ok {
+		respondWithError(w, http.StatusConflict, errCodeVideoFileMissing, "Video file isn't stored in our bucket", nil)
 		return
 	}
 
+	sourceURL, err := cfg.presignGetObject(r.Context(), key, thumbnailFrameLinkExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't link video file", err)
+		return
+	}
+	duration, err := getVideoDuration(r.Context(), sourceURL)
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, errCodeUpstreamFailed, "Couldn't read video file", err)
+		return
+	}
+	if *params.Timestamp >= duration {
+		respondWithErrorDetails(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("Timestamp is past the end of the %.1fs video", duration), map[string]float64{"duration": duration}, nil)
+		return
+	}
+
+	randomName := make([]byte, 32)
+	_, err = rand.Read(randomName)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Failed to fill key", err)
+		return
+	}
+	fileName := base64.RawURLEncoding.EncodeToString(randomName) + ".jpg"
+	err = extractFrame(r.Context(), sourceURL, *params.Timestamp, filepath.Join(cfg.assetsRoot, fileName))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't extract frame", err)
+		return
+	}
+
+	// a picked frame counts as the owner's own thumbnail, processing won't
+	// replace it
 	thumbnailURL := fmt.Sprintf("http://localhost:8091/assets/%s", fileName)
+	video.ThumbnailURL = &thumbnailURL
+	video.ThumbnailGenerated = false
+	video.ThumbnailVariantID = nil
+
+	err = cfg.ensureBlurredThumbnail(r.Context(), &video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't blur thumbnail", err)
+		return
+	}
+
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video", err)
+		return
+	}
+
+	cfg.requestModeration(video.ID)
 
-	updatedVideo := cfg.db.UpdateVideo(database.Video{
-		ID:           video.ID,
-		CreatedAt:    video.CreatedAt,
-		UpdatedAt:    video.UpdatedAt,
-		ThumbnailURL: &thumbnailURL,
-		VideoURL:     video.VideoURL,
-		CreateVideoParams: database.CreateVideoParams{
-			Title:       video.Title,
-			Description: video.Description,
-			UserID:      video.UserID,
-		},
-	})
-
-	respondWithJSON(w, http.StatusOK, updatedVideo)
+	respondWithJSON(w, http.StatusOK, cfg.withSignedURLs(video))
 }
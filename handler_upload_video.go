@@ -4,17 +4,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"math"
 	"mime"
 	"net/http"
 	"os"
-	"os/exec"
+	"slices"
+	"time"
 
-	"github.com/aws/aws-sdk-go-v2/aws"
-	"github.com/aws/aws-sdk-go-v2/service/s3"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
 
 	"github.com/google/uuid"
 )
@@ -24,44 +26,71 @@ type FFProbeResult struct {
 }
 
 type Stream struct {
-	Width  int `json:"width`
-	Height int `json:"height"`
+	CodecType  string `json:"codec_type"`
+	CodecName  string `json:"codec_name"`
+	Profile    string `json:"profile"`
+	Width      int    `json:"width"`
+	Height     int    `json:"height"`
+	PixFmt     string `json:"pix_fmt"`
+	RFrameRate string `json:"r_frame_rate"`
+	SampleRate string `json:"sample_rate"`
+	Channels   int    `json:"channels"`
 }
 
-func getVideoAspectRatio(filePath string) (string, error) {
+func probeStreams(ctx context.Context, filePath string) (FFProbeResult, error) {
+	cmd := ffmpegRunner.Command(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
 
-	cmd := exec.Command("ffprobe", "-v", "error", "-print_format", "json", "-show_streams", filePath)
-
-	var out bytes.Buffer
+	var out, stderr bytes.Buffer
 	cmd.Stdout = &out
+	cmd.Stderr = &stderr
 
 	err := cmd.Run()
 	if err != nil {
-		return "", err
+		return FFProbeResult{}, newCommandError("ffprobe", err, stderr.Bytes())
 	}
 
 	var result FFProbeResult
 	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
-		return "", err
+		return FFProbeResult{}, err
 	}
+	return result, nil
+}
 
-	if len(result.Streams) == 0 {
-		return "", fmt.Errorf("no streams found in the video file")
+// getVideoAspectRatio returns 16:9, 9:16 or other, along with whether the
+// video is landscape, portrait or square.
+func getVideoAspectRatio(ctx context.Context, filePath string) (aspectRatio, orientation string, err error) {
+	result, err := probeStreams(ctx, filePath)
+	if err != nil {
+		return "", "", err
 	}
 
-	width := result.Streams[0].Width
-	height := result.Streams[0].Height
+	// other containers don't always put the video first
+	i := slices.IndexFunc(result.Streams, func(s Stream) bool { return s.CodecType == "video" })
+	if i < 0 {
+		return "", "", fmt.Errorf("no video stream found in the video file")
+	}
+
+	width := result.Streams[i].Width
+	height := result.Streams[i].Height
+
+	switch {
+	case width > height:
+		orientation = "landscape"
+	case width < height:
+		orientation = "portrait"
+	default:
+		orientation = "square"
+	}
 
 	if width*9 == height*16 || isApproximately(float64(width)/float64(height), 16.0/9.0) {
-		return "16:9", nil
+		return "16:9", orientation, nil
 	}
 
 	if width*16 == height*9 || isApproximately(float64(width)/float64(height), 9.0/16.0) {
-		return "9:16", nil
+		return "9:16", orientation, nil
 	}
 
-	return "other", nil
-
+	return "other", orientation, nil
 }
 
 func isApproximately(actual, expected float64) bool {
@@ -79,19 +108,25 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	// end users of integrations upload with a grant instead of signing in
+	if grantToken := r.Header.Get(uploadGrantHeader); grantToken != "" {
+		cfg.receiveGrantedUpload(w, r, videoID, grantToken)
 		return
 	}
 
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
 		return
 	}
 
 	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
 		return
 	}
 
@@ -99,122 +134,473 @@ func (cfg *apiConfig) handlerUploadVideo(w http.ResponseWriter, r *http.Request)
 
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't find video", err)
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", err)
 		return
 	}
 
 	if video.UserID != userID {
-		respondWithError(w, http.StatusUnauthorized, "You don't own this video", nil)
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this video", nil)
+		return
+	}
+
+	cfg.receiveVideoFile(w, r, video)
+}
+
+// processingContext is the context an upload is processed under. By default
+// processing stops when the client disconnects or the request times out,
+// with detached processing it runs to completion regardless.
+func (cfg *apiConfig) processingContext(r *http.Request) context.Context {
+	if cfg.detachProcessing {
+		return context.WithoutCancel(r.Context())
+	}
+	return r.Context()
+}
+
+// receiveVideoFile reads the "video" form file of an authorized request,
+// runs it through the processing pipeline and responds with the video.
+func (cfg *apiConfig) receiveVideoFile(w http.ResponseWriter, r *http.Request, video database.Video) {
+	if !cfg.admitUpload(w, video.UserID) {
 		return
 	}
+	releaseSlot, err := cfg.acquireUploadSlot(r.Context(), video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusTooManyRequests, errCodeRateLimited, "Too many uploads in progress, wait for one to finish", err)
+		return
+	}
+	defer releaseSlot()
 
-	file, header, err := r.FormFile("video")
+	profile, err := cfg.transcodeProfileFromRequest(r)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Couldn't parse video", err)
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidTranscodeProfile, "Invalid transcode profile", err)
 		return
 	}
-	defer file.Close()
+	profile.bumpers, err = cfg.bumpersFromRequest(r, video.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid bumpers", err)
+		return
+	}
+
+	part, err := streamFormFile(r, "video")
+	if err != nil {
+		if isMaxBytesError(err) {
+			respondWithError(w, http.StatusRequestEntityTooLarge, errCodePayloadTooLarge, "Video is too large", err)
+			return
+		}
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't parse video", err)
+		return
+	}
+	defer part.Close()
 
-	mediaType, _, err := mime.ParseMediaType(header.Header.Get("Content-Type"))
+	mediaType, _, err := mime.ParseMediaType(part.Header.Get("Content-Type"))
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid content type", err)
+		respondWithError(w, http.StatusBadRequest, errCodeUnsupportedMediaType, "Invalid content type", err)
 		return
 	}
 
-	if mediaType != "video/mp4" {
-		respondWithError(w, http.StatusBadRequest, "Media type not allowed. Only mp4 is supported", nil)
+	if !sourceMediaTypeAllowed(mediaType, part.FileName()) {
+		respondWithError(w, http.StatusBadRequest, errCodeUnsupportedMediaType, "Media type not allowed. Only mp4, mov, mkv and webm are supported", nil)
 		return
 	}
 
 	tempFile, err := os.CreateTemp("", "tubely-upload.mp4")
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create temp file", err)
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create temp file", err)
 		return
 	}
 
 	defer os.Remove(tempFile.Name())
 	defer tempFile.Close()
 
-	_, err = io.Copy(tempFile, file)
+	// the only copy of the upload, ffmpeg needs a seekable file
+	written, err := io.Copy(tempFile, part)
+	if isMaxBytesError(err) {
+		respondWithError(w, http.StatusRequestEntityTooLarge, errCodePayloadTooLarge, "Video is too large", err)
+		return
+	}
+	// nothing half-received gets probed, processed or stored
+	if err := checkPartReceived(part, written, err); err != nil {
+		respondWithUploadError(w, "Video", err)
+		return
+	}
+
+	// reject what we can't convert before the video is marked as processing
+	source, err := probeSource(r.Context(), tempFile.Name())
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to copy file", err)
+		respondWithError(w, http.StatusBadRequest, errCodeUnsupportedMediaType, "Couldn't read the video, is it a video file?", err)
+		return
+	}
+	if err := source.checkSupported(); err != nil {
+		respondWithErrorDetails(w, http.StatusBadRequest, errCodeUnsupportedMediaType, err.Error(), source, nil)
+		return
+	}
+	if err := source.checkIntegrity(); err != nil {
+		respondWithErrorDetails(w, http.StatusBadRequest, errCodeInvalidMedia, err.Error(), source, nil)
 		return
 	}
 
-	processedFilePath, err := processVideoForFastStart(tempFile.Name())
+	video, err = cfg.processVideoUpload(cfg.processingContext(r), video, tempFile.Name(), profile)
+	if errors.Is(err, errVideoProcessingLocked) {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "Another upload of the video is being processed", err)
+		return
+	}
 	if err != nil {
-		fmt.Println("FFmpeg error:", err)
-		respondWithError(w, http.StatusInternalServerError, "Failed to process video for fast start", err)
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't process video", err)
 		return
 	}
+
+	respondWithJSON(w, http.StatusOK, cfg.withSignedURLs(video))
+}
+
+func (cfg *apiConfig) processVideoUpload(ctx context.Context, video database.Video, filePath string, profile transcodeProfile) (database.Video, error) {
+	return cfg.processVideoSource(ctx, video, filePath, "", profile)
+}
+
+// processVideoSource runs a source file through the pipeline and makes the
+// result the video's new version. sourceKey is where the source is already
+// stored in the bucket. When it's empty the untouched source is stored under
+// originals/ unless that's disabled, so the video can be processed again or
+// the original downloaded later.
+func (cfg *apiConfig) processVideoSource(ctx context.Context, video database.Video, filePath, sourceKey string, profile transcodeProfile) (processed database.Video, err error) {
+	unlock, err := cfg.lockVideoProcessing(ctx, video.ID)
+	if err != nil {
+		return database.Video{}, err
+	}
+	defer unlock()
+
+	db := cfg.db.WithContext(ctx)
+	err = db.SetVideoProcessing(video.ID, true)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("failed to mark video as processing: %w", err)
+	}
+	// not bound to ctx, the flag must be cleared even when we were cancelled
+	defer func() {
+		if err := cfg.db.SetVideoProcessing(video.ID, false); err != nil {
+			log.Printf("Couldn't clear processing flag of video %s: %v", video.ID, err)
+		}
+		if err != nil {
+			cfg.publishEvent(ctx, eventVideoProcessed, video, err)
+		} else {
+			cfg.publishEvent(ctx, eventVideoProcessed, processed, nil)
+		}
+	}()
+
+	// clients polling the video get a frame to show until we're done
+	err = cfg.setPlaceholderThumbnail(ctx, &video, filePath)
+	if err != nil {
+		log.Printf("Couldn't grab placeholder thumbnail for video %s: %v", video.ID, err)
+	} else if err := db.UpdateVideo(video); err != nil {
+		return database.Video{}, fmt.Errorf("failed to save placeholder thumbnail: %w", err)
+	}
+
+	source, err := probeSource(ctx, filePath)
+	if err != nil {
+		return database.Video{}, withStage("probe", fmt.Errorf("failed to probe source: %w", err))
+	}
+	if err := source.checkSupported(); err != nil {
+		return database.Video{}, withStage("probe", err)
+	}
+	if err := source.checkIntegrity(); err != nil {
+		return database.Video{}, withStage("validate", err)
+	}
+
+	// the stored original stays the upload, everything else works on the
+	// source with the bumpers
+	originalPath := filePath
+	if !profile.bumpers.empty() {
+		filePath, err = cfg.addBumpers(ctx, video.UserID, filePath, profile.bumpers)
+		if err != nil {
+			return database.Video{}, withStage("bumpers", fmt.Errorf("failed to add bumpers: %w", err))
+		}
+		if filePath != originalPath {
+			defer os.Remove(filePath)
+			source, err = probeSource(ctx, filePath)
+			if err != nil {
+				return database.Video{}, withStage("probe", fmt.Errorf("failed to probe source with bumpers: %w", err))
+			}
+		}
+	}
+
+	var loudness *database.Loudness
+	var measured *loudnormMeasurement
+	if profile.Audio.Loudnorm != nil && len(source.AudioCodecs) > 0 {
+		m, err := measureLoudness(ctx, filePath, *profile.Audio.Loudnorm)
+		if err != nil {
+			return database.Video{}, withStage("loudness", fmt.Errorf("failed to measure loudness: %w", err))
+		}
+		// silent audio can't be normalized linearly, the single pass is fine
+		if loudness, err = m.loudness(); err == nil {
+			measured = &m
+		}
+	}
+
+	sdrProfile := source.normalizedProfile(profile)
+	sdrProfile.loudnessMeasured = measured
+
+	var videoBitrate *int
+	if sdrProfile.Video.PerTitle != nil && source.Duration > 0 {
+		bitrate, err := analyzeComplexity(ctx, filePath, source.Duration, sdrProfile)
+		if err != nil {
+			return database.Video{}, withStage("analyze", fmt.Errorf("failed to analyze video complexity: %w", err))
+		}
+		log.Printf("Per-title encoding picked %dk (peak %dk) for video %s", bitrate.Average, bitrate.Peak, video.ID)
+		sdrProfile.Video = bitrate.apply(sdrProfile.Video)
+		videoBitrate = &bitrate.Average
+	}
+
+	processedFilePath := filePath + ".processing"
+	err = transcodeVideo(ctx, filePath, processedFilePath, sdrProfile)
+	if err != nil {
+		return database.Video{}, withStage("transcode", fmt.Errorf("failed to transcode video with profile %s: %w", profile.Name, err))
+	}
 	fmt.Println("Successfully processed video to:", processedFilePath)
 	defer os.Remove(processedFilePath)
 
-	_, err = tempFile.Seek(0, io.SeekStart)
+	// nothing broken gets published
+	err = validateProcessed(ctx, processedFilePath, source.Duration)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to reset the file position", err)
-		return
+		return database.Video{}, withStage("validate", err)
 	}
 
-	aspectRatio, err := getVideoAspectRatio(tempFile.Name())
+	aspectRatio, orientation, err := getVideoAspectRatio(ctx, filePath)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to determine aspect ratio", err)
-		return
+		return database.Video{}, withStage("probe", fmt.Errorf("failed to determine aspect ratio: %w", err))
 	}
 
-	var prefix string
-	switch aspectRatio {
-	case "16:9":
-		prefix = "landscape/"
-	case "9:16":
-		prefix = "portrait/"
-	default:
-		prefix = "other/"
+	version, err := cfg.nextVideoVersion(ctx, video)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("failed to determine video version: %w", err)
 	}
 
-	key := fmt.Sprintf("%s%s.mp4", prefix, videoID)
+	// every version gets its own key so earlier versions stay available
+	keyParams := videoKeyParams{
+		VideoID:   video.ID,
+		UserID:    video.UserID,
+		Date:      time.Now().UTC(),
+		Aspect:    aspectName(aspectRatio),
+		Version:   version,
+		Rendition: renditionSDR,
+	}
+	key := cfg.keyStrategy.VideoKey(keyParams)
 
-	ctx := context.Background()
+	enc, err := cfg.objectEncryptionForUser(video.UserID)
+	if err != nil {
+		return database.Video{}, err
+	}
+	tags, err := cfg.objectTagsForUser(video.UserID)
+	if err != nil {
+		return database.Video{}, err
+	}
+	videoTags := tags.with(objectTags{"aspect-ratio": aspectRatio, "orientation": orientation})
+
+	if sourceKey == "" && cfg.storeOriginals {
+		sourceKey = fmt.Sprintf("originals/%s/v%d", video.ID, version)
+		err = cfg.uploadVideoOriginal(ctx, sourceKey, originalPath, enc, tags)
+		if err != nil {
+			return database.Video{}, withStage("upload", fmt.Errorf("failed to upload original to S3: %w", err))
+		}
+	}
+	var storedSourceKey *string
+	if sourceKey != "" {
+		storedSourceKey = &sourceKey
+	}
 
 	processedFile, err := os.Open(processedFilePath)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to open processed file", err)
-		return
+		return database.Video{}, fmt.Errorf("failed to open processed file: %w", err)
 	}
 	defer processedFile.Close()
+	processedInfo, err := processedFile.Stat()
+	if err != nil {
+		return database.Video{}, fmt.Errorf("failed to stat processed file: %w", err)
+	}
 
-	putObjectInput := &s3.PutObjectInput{
-		Bucket:      aws.String(cfg.s3Bucket),
-		Key:         aws.String(key),
-		Body:        processedFile,
-		ContentType: aws.String("video/mp4"),
+	checksum, err := cfg.putFileObject(ctx, key, "video/mp4", processedFile, enc, videoTags)
+	if err != nil {
+		return database.Video{}, withStage("upload", fmt.Errorf("failed to upload to S3: %w", err))
 	}
 
-	_, err = cfg.s3Client.PutObject(ctx, putObjectInput)
+	// players that can't show HDR keep the SDR rendition above
+	var hdrKey *string
+	if hdrProfile, ok := source.hdrProfile(profile); ok {
+		hdrProfile.loudnessMeasured = measured
+		keyParams.Rendition = renditionHDR
+		key := cfg.keyStrategy.VideoKey(keyParams)
+		err := cfg.storeHDRRendition(ctx, filePath, key, hdrProfile, enc, videoTags)
+		if err != nil {
+			log.Printf("Couldn't store HDR rendition of video %s: %v", video.ID, err)
+		} else {
+			hdrKey = &key
+		}
+	}
+
+	// the new file is stored, finish recording it even if the caller gives
+	// up now so it isn't left orphaned in the bucket
+	ctx = context.WithoutCancel(ctx)
+	db = cfg.db.WithContext(ctx)
+
+	previousURL := video.VideoURL
+	videoURL := cfg.objectURL(key)
+	video.VideoURL = &videoURL
+	video.ChecksumSHA256 = &checksum
+
+	// the owner may have uploaded a thumbnail while we were busy
+	current, err := db.GetVideo(video.ID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to upload to S3", err)
-		return
+		return database.Video{}, fmt.Errorf("failed to reload video: %w", err)
+	}
+	video.ThumbnailURL = current.ThumbnailURL
+	video.BlurredThumbnailURL = current.BlurredThumbnailURL
+	video.ThumbnailGenerated = current.ThumbnailGenerated
+	candidates, err := cfg.storeThumbnailCandidates(ctx, video, processedFilePath)
+	if err != nil {
+		log.Printf("Couldn't pick thumbnail candidates for video %s: %v", video.ID, err)
+	}
+	err = cfg.setFinalThumbnail(ctx, &video, processedFilePath, candidates)
+	if err != nil {
+		log.Printf("Couldn't generate thumbnail for video %s: %v", video.ID, err)
+	}
+	err = cfg.storePerceptualHashes(ctx, video.ID, processedFilePath, source.Duration)
+	if err != nil {
+		log.Printf("Couldn't check video %s for duplicates: %v", video.ID, err)
 	}
 
-	cloudFrontURL := fmt.Sprintf("%s/%s", cfg.s3CfDistribution, key)
-	video.VideoURL = &cloudFrontURL
+	err = db.UpdateVideo(video)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("failed to update video URL in database: %w", err)
+	}
 
-	err = cfg.db.UpdateVideo(video)
+	var duration *float64
+	if source.Duration > 0 {
+		duration = &source.Duration
+	}
+	_, err = db.CreateVideoVersion(database.CreateVideoVersionParams{
+		VideoID:          video.ID,
+		Version:          version,
+		S3Key:            key,
+		SizeBytes:        processedInfo.Size(),
+		SourceKey:        storedSourceKey,
+		TranscodeProfile: profile.Name,
+		ChecksumSHA256:   &checksum,
+		HDRKey:           hdrKey,
+		Loudness:         loudness,
+		VideoBitrateKbps: videoBitrate,
+		DurationSeconds:  duration,
+	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Failed to update video URL in database", err)
-		return
+		return database.Video{}, fmt.Errorf("failed to record video version: %w", err)
+	}
+
+	err = db.SetVideoAspect(video.ID, aspectRatio, orientation)
+	if err != nil {
+		return database.Video{}, fmt.Errorf("failed to record aspect ratio: %w", err)
+	}
+	video.AspectRatio = &aspectRatio
+	video.Orientation = &orientation
+
+	if previousURL != nil {
+		cfg.invalidateVideoURL(ctx, *previousURL)
 	}
 
-	respondWithJSON(w, http.StatusOK, video)
+	cfg.requestModeration(video.ID)
+	cfg.requestContentIDCheck(video.ID)
+	cfg.requestDRMPackaging(video.ID)
+	cfg.requestHLSPackaging(video.ID)
+	cfg.checkStorageQuota(video.UserID, processedInfo.Size())
+
+	video.Processing = false
+	return video, nil
 }
 
-func processVideoForFastStart(filePath string) (string, error) {
-	outPath := filePath + ".processing"
+func (cfg *apiConfig) storeHDRRendition(ctx context.Context, filePath, key string, profile transcodeProfile, enc objectEncryption, tags objectTags) error {
+	outPath := filePath + ".hdr"
+	err := transcodeVideo(ctx, filePath, outPath, profile)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(outPath)
+
+	f, err := os.Open(outPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = cfg.putFileObject(ctx, key, "video/mp4", f, enc, tags)
+	return err
+}
+
+// uploadVideoOriginal stores the source as uploaded. Imports aren't
+// necessarily MP4, so the content type is sniffed.
+func (cfg *apiConfig) uploadVideoOriginal(ctx context.Context, key, filePath string, enc objectEncryption, tags objectTags) error {
+	originalFile, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer originalFile.Close()
+
+	head := make([]byte, 512)
+	n, err := io.ReadFull(originalFile, head)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	contentType := http.DetectContentType(head[:n])
+	if _, err := originalFile.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = cfg.putFileObject(ctx, key, contentType, originalFile, enc, tags)
+	return err
+}
+
+// nextVideoVersion returns the version number for a new upload of the video.
+// Videos uploaded before versioning existed get their current file recorded
+// as version 1 first.
+func (cfg *apiConfig) nextVideoVersion(ctx context.Context, video database.Video) (int, error) {
+	db := cfg.db.WithContext(ctx)
+	versions, err := db.GetVideoVersions(video.ID)
+	if err != nil {
+		return 0, err
+	}
+	if len(versions) > 0 {
+		return versions[0].Version + 1, nil
+	}
+	if video.VideoURL == nil {
+		return 1, nil
+	}
+
+	key, ok := cfg.objectKeyFromURL(*video.VideoURL)
+	if !ok {
+		return 1, nil
+	}
+	_, err = db.CreateVideoVersion(database.CreateVideoVersionParams{
+		VideoID:          video.ID,
+		Version:          1,
+		S3Key:            key,
+		TranscodeProfile: originalTranscodeProfile,
+	})
+	if err != nil {
+		return 0, err
+	}
+	return 2, nil
+}
+
+func (cfg *apiConfig) invalidateVideoURL(ctx context.Context, videoURL string) {
+	key, ok := cfg.objectKeyFromURL(videoURL)
+	if !ok {
+		return
+	}
+	err := cfg.invalidateCDNKeys(ctx, key)
+	if err != nil {
+		log.Printf("Couldn't invalidate CDN cache for %s: %v", key, err)
+	}
+}
 
+// transcodeVideo writes the file processed with the profile next to it and
+// returns the new path.
+func transcodeVideo(ctx context.Context, filePath, outPath string, profile transcodeProfile) error {
 	fmt.Println("Input file:", filePath)
 	fmt.Println("Output file:", outPath)
 
-	cmd := exec.Command("ffmpeg", "-i", filePath, "-c", "copy", "-movflags", "faststart", "-f", "mp4", outPath)
+	args := slices.Concat([]string{"-y", "-i", filePath}, profile.ffmpegArgs(), []string{outPath})
+	cmd := ffmpegRunner.Command(ctx, "ffmpeg", args...)
 
 	var stdout, stderr bytes.Buffer
 	cmd.Stdout = &stdout
@@ -222,8 +608,8 @@ func processVideoForFastStart(filePath string) (string, error) {
 
 	err := cmd.Run()
 	if err != nil {
-		return "", fmt.Errorf("ffmpeg error: %v: %s", err, stderr.String())
+		return newCommandError("ffmpeg", err, stderr.Bytes())
 	}
 
-	return outPath, nil
+	return nil
 }
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	jobTypeUserExport = "user_export"
+
+	// SigV4 presigned URLs are valid for at most seven days
+	exportLinkExpiry = 7 * 24 * time.Hour
+)
+
+type userExportPayload struct {
+	ExportID uuid.UUID `json:"export_id"`
+}
+
+func (cfg *apiConfig) handlerUserExportCreate(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	export, err := cfg.db.CreateUserExport(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create export", err)
+		return
+	}
+
+	_, err = cfg.enqueueJob(jobTypeUserExport, nil, userExportPayload{ExportID: export.ID})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create export job", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, export)
+}
+
+func (cfg *apiConfig) handlerUserExportGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		database.UserExport
+		DownloadURL *string `json:"download_url"`
+	}
+
+	exportIDString := r.PathValue("exportID")
+	exportID, err := uuid.Parse(exportIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	export, err := cfg.db.GetUserExport(exportID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get export", err)
+		return
+	}
+	if export.ID == uuid.Nil || export.UserID != userID {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Couldn't find export", nil)
+		return
+	}
+
+	resp := response{UserExport: export}
+	if export.Status == database.UserExportStatusReady && export.S3Key != nil {
+		downloadURL, err := cfg.presignGetObject(r.Context(), *export.S3Key, exportLinkExpiry)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create download URL", err)
+			return
+		}
+		resp.DownloadURL = &downloadURL
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) handlerUserDelete(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Password string `json:"password"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get user", err)
+		return
+	}
+	if user == nil {
+		respondWithError(w, http.StatusNotFound, errCodeUserNotFound, "Couldn't find user", nil)
+		return
+	}
+
+	// erasure can't be undone, so ask for the password again
+	err = auth.CheckPasswordHash(params.Password, user.Password)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeInvalidCredentials, "Incorrect password", err)
+		return
+	}
+
+	// half a deletion is worse than a slow one, keep going if the client
+	// disconnects
+	ctx := context.WithoutCancel(r.Context())
+
+	videos, err := cfg.db.GetVideos(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't retrieve videos", err)
+		return
+	}
+	trashedVideos, err := cfg.db.GetTrashedVideos(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't retrieve videos", err)
+		return
+	}
+	for _, video := range append(videos, trashedVideos...) {
+		err = cfg.deleteVideoAssets(ctx, video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't delete video files", err)
+			return
+		}
+	}
+
+	exportKeys, err := cfg.db.GetUserExportKeys(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't retrieve exports", err)
+		return
+	}
+	for _, key := range exportKeys {
+		err = cfg.deleteObject(ctx, key)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't delete export", err)
+			return
+		}
+	}
+
+	err = cfg.db.DeleteUserData(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't delete user", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) runUserExportJob(ctx context.Context, job database.Job) error {
+	var payload userExportPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+
+	export, err := cfg.db.GetUserExport(payload.ExportID)
+	if err != nil {
+		return err
+	}
+	if export.ID == uuid.Nil {
+		return fmt.Errorf("export %s no longer exists", payload.ExportID)
+	}
+
+	err = cfg.buildUserExport(ctx, export)
+	if err != nil {
+		if failErr := cfg.db.FailUserExport(export.ID, err.Error()); failErr != nil {
+			return failErr
+		}
+		return err
+	}
+	return nil
+}
+
+func (cfg *apiConfig) buildUserExport(ctx context.Context, export database.UserExport) error {
+	type userData struct {
+		ID        uuid.UUID `json:"id"`
+		Email     string    `json:"email"`
+		CreatedAt time.Time `json:"created_at"`
+		UpdatedAt time.Time `json:"updated_at"`
+	}
+	type videoLink struct {
+		VideoID     uuid.UUID `json:"video_id"`
+		Title       string    `json:"title"`
+		DownloadURL string    `json:"download_url"`
+		ExpiresAt   time.Time `json:"expires_at"`
+	}
+
+	user, err := cfg.db.GetUser(export.UserID)
+	if err != nil {
+		return err
+	}
+	if user == nil {
+		return fmt.Errorf("user %s no longer exists", export.UserID)
+	}
+
+	videos, err := cfg.db.GetVideos(user.ID)
+	if err != nil {
+		return err
+	}
+	trashedVideos, err := cfg.db.GetTrashedVideos(user.ID)
+	if err != nil {
+		return err
+	}
+	videos = append(videos, trashedVideos...)
+
+	tempFile, err := os.CreateTemp("", "tubely-export.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	archive := zip.NewWriter(tempFile)
+
+	err = writeZipJSON(archive, "user.json", userData{
+		ID:        user.ID,
+		Email:     user.Email,
+		CreatedAt: user.CreatedAt,
+		UpdatedAt: user.UpdatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = writeZipJSON(archive, "videos.json", videos)
+	if err != nil {
+		return err
+	}
+
+	translations := []database.VideoTranslation{}
+	for _, video := range videos {
+		t, err := cfg.db.GetVideoTranslations(video.ID)
+		if err != nil {
+			return err
+		}
+		translations = append(translations, t...)
+	}
+	err = writeZipJSON(archive, "video_translations.json", translations)
+	if err != nil {
+		return err
+	}
+
+	history, err := cfg.db.GetWatchHistory(user.ID, nil, 0)
+	if err != nil {
+		return err
+	}
+	err = writeZipJSON(archive, "watch_history.json", history)
+	if err != nil {
+		return err
+	}
+
+	links := []videoLink{}
+	expiresAt := time.Now().UTC().Add(exportLinkExpiry)
+	for _, video := range videos {
+		if video.VideoURL != nil {
+			if key, ok := cfg.objectKeyFromURL(*video.VideoURL); ok {
+				downloadURL, err := cfg.presignGetObject(ctx, key, exportLinkExpiry)
+				if err != nil {
+					return err
+				}
+				links = append(links, videoLink{
+					VideoID:     video.ID,
+					Title:       video.Title,
+					DownloadURL: downloadURL,
+					ExpiresAt:   expiresAt,
+				})
+			}
+		}
+
+		if video.ThumbnailURL != nil {
+			if thumbnailPath, ok := cfg.assetPathFromURL(*video.ThumbnailURL); ok {
+				name := fmt.Sprintf("thumbnails/%s%s", video.ID, filepath.Ext(thumbnailPath))
+				err = copyFileToZip(archive, name, thumbnailPath)
+				if err != nil && !os.IsNotExist(err) {
+					return err
+				}
+			}
+		}
+	}
+
+	err = writeZipJSON(archive, "video_links.json", links)
+	if err != nil {
+		return err
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return err
+	}
+
+	_, err = tempFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	enc, err := cfg.objectEncryptionForUser(user.ID)
+	if err != nil {
+		return err
+	}
+	tags, err := cfg.objectTagsForUser(user.ID)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("exports/%s/%s.zip", user.ID, export.ID)
+	err = cfg.putObject(ctx, key, "application/zip", tempFile, enc, tags)
+	if err != nil {
+		return fmt.Errorf("couldn't upload export: %w", err)
+	}
+
+	err = cfg.db.CompleteUserExport(export.ID, key)
+	if err != nil {
+		return err
+	}
+
+	downloadURL, err := cfg.presignGetObject(ctx, key, exportLinkExpiry)
+	if err != nil {
+		return err
+	}
+
+	err = cfg.mailer.Send(
+		user.Email,
+		"Your Tubely data export is ready",
+		fmt.Sprintf("Your data export is ready. Download it within the next 7 days:\n\n%s\n", downloadURL),
+	)
+	if err != nil {
+		// the export itself succeeded, the user can still fetch it from the API
+		log.Printf("Couldn't send export email: %v", err)
+	}
+	return nil
+}
+
+func writeZipJSON(archive *zip.Writer, name string, v any) error {
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+func copyFileToZip(archive *zip.Writer, name, filePath string) error {
+	src, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	f, err := archive.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, src)
+	return err
+}
@@ -18,18 +18,18 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 	params := parameters{}
 	err := decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
 		return
 	}
 
 	if params.Password == "" || params.Email == "" {
-		respondWithError(w, http.StatusBadRequest, "Email and password are required", nil)
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Email and password are required", nil)
 		return
 	}
 
 	hashedPassword, err := auth.HashPassword(params.Password)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't hash password", err)
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't hash password", err)
 		return
 	}
 
@@ -38,7 +38,7 @@ func (cfg *apiConfig) handlerUsersCreate(w http.ResponseWriter, r *http.Request)
 		Password: hashedPassword,
 	})
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create user", err)
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create user", err)
 		return
 	}
 
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// frames extracted per viewer and minute, cached frames don't count
+	frameExtractionsPerMinute = 30
+	maxFrameWidth             = 3840
+	minFrameWidth             = 16
+	// cached frames that haven't been requested for this long are removed
+	frameCacheTTL           = 24 * time.Hour
+	frameCacheCleanInterval = time.Hour
+)
+
+// handlerVideoFrame returns the frame at t seconds, scaled to w pixels wide
+// when w is given. Anyone who can see the video can get its frames, they're
+// cached on disk per file so scrubbing back and forth stays cheap.
+func (cfg *apiConfig) handlerVideoFrame(w http.ResponseWriter, r *http.Request) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+
+	timestamp, err := strconv.ParseFloat(r.URL.Query().Get("t"), 64)
+	if err != nil || timestamp < 0 || math.IsInf(timestamp, 0) || math.IsNaN(timestamp) {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "t must be a non-negative number of seconds", err)
+		return
+	}
+	width := 0
+	if widthString := r.URL.Query().Get("w"); widthString != "" {
+		width, err = strconv.Atoi(widthString)
+		if err != nil || width < minFrameWidth || width > maxFrameWidth {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("w must be between %d and %d", minFrameWidth, maxFrameWidth), err)
+			return
+		}
+	}
+
+	userID := cfg.optionalViewerID(r)
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", nil)
+		return
+	}
+	isOwner := userID != uuid.Nil && video.UserID == userID
+	if isVideoHidden(video) && !isOwner {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoFileMissing, "Video has no file yet", nil)
+		return
+	}
+	if !isOwner {
+		if reason, blocked := geoBlockReason(video, cfg.viewerCountry(r)); blocked {
+			respondWithError(w, http.StatusUnavailableForLegalReasons, errCodeGeoBlocked, reason, nil)
+			return
+		}
+		if video.AgeRestricted && userID == uuid.Nil && !cfg.hasPassedAgeGate(r) {
+			respondWithError(w, http.StatusForbidden, errCodeAgeConfirmationRequired, "Confirm your age to see frames of this video", nil)
+			return
+		}
+		// frames would be copies without the viewer's watermark
+		watermarked, err := cfg.isWatermarkProtected(video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't check watermarking", err)
+			return
+		}
+		if watermarked {
+			respondWithError(w, http.StatusForbidden, errCodeForbidden, "Frames of watermarked videos are only available to the owner", nil)
+			return
+		}
+	}
+
+	key, ok := cfg.objectKeyFromURL(*video.VideoURL)
+	if !ok {
+		respondWithError(w, http.StatusConflict, errCodeVideoFileMissing, "Video file isn't stored in our bucket", nil)
+		return
+	}
+
+	framePath := cfg.frameCachePath(video.ID, *video.VideoURL, timestamp, width)
+	if _, err := os.Stat(framePath); err != nil {
+		if !os.IsNotExist(err) {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't read frame cache", err)
+			return
+		}
+
+		limitKey := "user:" + userID.String()
+		if userID == uuid.Nil {
+			addr, _ := cfg.clientIP(r)
+			limitKey = "ip:" + addr.String()
+		}
+		if ok, retryAfter := cfg.frameLimiter.allow(limitKey); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+			respondWithError(w, http.StatusTooManyRequests, errCodeRateLimited, "Too many frames requested, try again shortly", nil)
+			return
+		}
+
+		status, err := cfg.extractCachedFrame(r.Context(), key, timestamp, width, framePath)
+		if err != nil {
+			if status == http.StatusBadRequest {
+				respondWithError(w, status, errCodeValidationFailed, err.Error(), nil)
+				return
+			}
+			respondWithError(w, status, errCodeUpstreamFailed, "Couldn't extract frame", err)
+			return
+		}
+	} else {
+		// keeps frames that are still in use out of the cleanup
+		now := time.Now()
+		os.Chtimes(framePath, now, now)
+	}
+
+	frame, err := os.Open(framePath)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't read frame", err)
+		return
+	}
+	defer frame.Close()
+
+	// the URL stays the same when the file is replaced, so don't cache long
+	if isVideoHidden(video) || video.AgeRestricted {
+		w.Header().Set("Cache-Control", "private, max-age=3600")
+	} else {
+		w.Header().Set("Cache-Control", "public, max-age=3600")
+	}
+	w.Header().Set("Content-Type", "image/jpeg")
+	http.ServeContent(w, r, "", time.Time{}, frame)
+}
+
+// frameCachePath names a cached frame after the file it was taken from, a
+// new file gets new frames.
+func (cfg *apiConfig) frameCachePath(videoID uuid.UUID, videoURL string, timestamp float64, width int) string {
+	fileHash := sha256.Sum256([]byte(videoURL))
+	millis := int64(math.Round(timestamp * 1000))
+	name := fmt.Sprintf("%s-%s-%d-%d.jpg", videoID, hex.EncodeToString(fileHash[:8]), millis, width)
+	return filepath.Join(cfg.frameCacheDir, name)
+}
+
+// extractCachedFrame extracts the frame into framePath. The returned status
+// tells the client's mistakes apart from failures on our side.
+func (cfg *apiConfig) extractCachedFrame(ctx context.Context, key string, timestamp float64, width int, framePath string) (int, error) {
+	sourceURL, err := cfg.presignGetObject(ctx, key, thumbnailFrameLinkExpiry)
+	if err != nil {
+		return http.StatusInternalServerError, err
+	}
+	duration, err := getVideoDuration(ctx, sourceURL)
+	if err != nil {
+		return http.StatusBadGateway, err
+	}
+	if timestamp >= duration {
+		return http.StatusBadRequest, fmt.Errorf("t is past the end of the %.1fs video", duration)
+	}
+
+	// concurrent requests for the same frame each write their own file, the
+	// rename makes sure nobody serves a half-written one
+	tmpPath := fmt.Sprintf("%s.%s.jpg", strings.TrimSuffix(framePath, ".jpg"), uuid.New())
+	err = extractScaledFrame(ctx, sourceURL, timestamp, width, tmpPath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return http.StatusBadGateway, err
+	}
+	err = os.Rename(tmpPath, framePath)
+	if err != nil {
+		os.Remove(tmpPath)
+		return http.StatusInternalServerError, err
+	}
+	return http.StatusOK, nil
+}
+
+// cleanUpFrameCache removes frames nobody requested within frameCacheTTL.
+func (cfg *apiConfig) cleanUpFrameCache(ctx context.Context) error {
+	entries, err := os.ReadDir(cfg.frameCacheDir)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-frameCacheTTL)
+	removed := 0
+	for _, entry := range entries {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(cutoff) {
+			continue
+		}
+		err = os.Remove(filepath.Join(cfg.frameCacheDir, entry.Name()))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		removed++
+	}
+	if removed > 0 {
+		log.Printf("Removed %d cached frames", removed)
+	}
+	return nil
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"slices"
 
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
@@ -17,12 +19,12 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
 		return
 	}
 	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
 		return
 	}
 
@@ -30,52 +32,91 @@ func (cfg *apiConfig) handlerVideoMetaCreate(w http.ResponseWriter, r *http.Requ
 	params := parameters{}
 	err = decoder.Decode(&params)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't decode parameters", err)
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
 		return
 	}
 	params.UserID = userID
 
-	video, err := cfg.db.CreateVideo(params.CreateVideoParams)
+	err = validateVideoVisibility(&params.CreateVideoParams)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't create video", err)
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid visibility", err)
+		return
+	}
+	err = validateVideoCountries(&params.CreateVideoParams)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid country list", err)
+		return
+	}
+	err = validateVideoTags(&params.CreateVideoParams)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid tags", err)
+		return
+	}
+	err = validateVideoMetadata(&params.CreateVideoParams)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid metadata", err)
+		return
+	}
+	if !cfg.checkExternalID(w, userID, uuid.Nil, &params.CreateVideoParams) {
+		return
+	}
+
+	video, err := cfg.createVideo(r.Context(), params.CreateVideoParams)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create video", err)
 		return
 	}
 
-	respondWithJSON(w, http.StatusCreated, video)
+	respondWithJSON(w, http.StatusCreated, cfg.withSignedURLs(video))
+}
+
+// createVideo creates the video and publishes video.created.
+func (cfg *apiConfig) createVideo(ctx context.Context, params database.CreateVideoParams) (database.Video, error) {
+	video, err := cfg.db.CreateVideo(params)
+	if err != nil {
+		return database.Video{}, err
+	}
+	cfg.publishEvent(ctx, eventVideoCreated, video, nil)
+	return video, nil
 }
 
 func (cfg *apiConfig) handlerVideoMetaDelete(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid ID", err)
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
 		return
 	}
 
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
 		return
 	}
 	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
 		return
 	}
 
 	video, err := cfg.db.GetVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", err)
 		return
 	}
 	if video.UserID != userID {
-		respondWithError(w, http.StatusForbidden, "You can't delete this video", err)
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You can't delete this video", err)
+		return
+	}
+
+	if video.DeletedAt != nil {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "Video is already in the trash", nil)
 		return
 	}
 
-	err = cfg.db.DeleteVideo(videoID)
+	err = cfg.db.TrashVideo(videoID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't delete video", err)
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't delete video", err)
 		return
 	}
 
@@ -86,38 +127,128 @@ func (cfg *apiConfig) handlerVideoGet(w http.ResponseWriter, r *http.Request) {
 	videoIDString := r.PathValue("videoID")
 	videoID, err := uuid.Parse(videoIDString)
 	if err != nil {
-		respondWithError(w, http.StatusBadRequest, "Invalid video ID", err)
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
 		return
 	}
 
-	video, err := cfg.db.GetVideo(videoID)
+	video, err := cfg.cachedVideo(r.Context(), videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", nil)
+		return
+	}
+	if isVideoHidden(video) && !cfg.isVideoOwner(r, video) {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	video, err = cfg.withViewerRestrictions(r, video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't check watermarking", err)
+		return
+	}
+	video, err = cfg.localizeVideo(r, video)
 	if err != nil {
-		respondWithError(w, http.StatusNotFound, "Couldn't get video", err)
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get translations", err)
 		return
 	}
+	w.Header().Add("Vary", "Accept-Language")
+
+	// logged-in viewers see where they left off
+	if token, err := auth.GetBearerToken(r.Header); err == nil {
+		if userID, err := auth.ValidateJWT(token, cfg.jwtSecret); err == nil {
+			videos, err := cfg.withResumePositions(userID, []database.Video{video})
+			if err != nil {
+				respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get watch progress", err)
+				return
+			}
+			video = videos[0]
+		}
+	}
 
-	respondWithJSON(w, http.StatusOK, video)
+	respondWithJSON(w, http.StatusOK, cfg.withSignedURLs(cfg.applyAgeGate(r, video)))
 }
 
 func (cfg *apiConfig) handlerVideosRetrieve(w http.ResponseWriter, r *http.Request) {
 	token, err := auth.GetBearerToken(r.Header)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't find JWT", err)
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
 		return
 	}
 	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
 	if err != nil {
-		respondWithError(w, http.StatusUnauthorized, "Couldn't validate JWT", err)
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
 		return
 	}
 
 	videos, err := cfg.db.GetVideos(userID)
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't retrieve videos", err)
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't retrieve videos", err)
+		return
+	}
+	if filter := metadataFilter(r.URL.Query()); len(filter) > 0 {
+		videos = slices.DeleteFunc(videos, func(video database.Video) bool {
+			return !matchesMetadata(video, filter)
+		})
+	}
+	if aspectRatio := r.URL.Query().Get("aspect_ratio"); aspectRatio != "" {
+		videos = slices.DeleteFunc(videos, func(video database.Video) bool {
+			return video.AspectRatio == nil || *video.AspectRatio != aspectRatio
+		})
+	}
+	if orientation := r.URL.Query().Get("orientation"); orientation != "" {
+		videos = slices.DeleteFunc(videos, func(video database.Video) bool {
+			return video.Orientation == nil || *video.Orientation != orientation
+		})
+	}
+	videos, err = cfg.withResumePositions(userID, videos)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get watch progress", err)
 		return
 	}
 
 	fmt.Printf("Retrieved videos with URLs: %+v\n", videos)
 
-	respondWithJSON(w, http.StatusOK, videos)
+	respondWithJSON(w, http.StatusOK, cfg.withSignedURLsAll(videos))
+}
+
+// withViewerRestrictions drops the file URL for viewers other than the
+// owner where it's only handed out through the playback endpoint: to viewers
+// in blocked countries or when playback needs a token, and never to viewers
+// of watermarked videos.
+func (cfg *apiConfig) withViewerRestrictions(r *http.Request, video database.Video) (database.Video, error) {
+	if cfg.isVideoOwner(r, video) {
+		return video, nil
+	}
+	if cfg.playbackTokens {
+		video.VideoURL = nil
+	}
+	if _, blocked := geoBlockReason(video, cfg.viewerCountry(r)); blocked {
+		video.VideoURL = nil
+	}
+	watermarked, err := cfg.isWatermarkProtected(video)
+	if err != nil {
+		return database.Video{}, err
+	}
+	if watermarked {
+		video.VideoURL = nil
+	}
+	return video, nil
+}
+
+// isVideoOwner reports whether the request carries a valid JWT for the
+// owner of the video. Missing or invalid tokens just mean "not the owner".
+func (cfg *apiConfig) isVideoOwner(r *http.Request, video database.Video) bool {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		return false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		return false
+	}
+	return video.UserID == userID
 }
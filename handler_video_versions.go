@@ -0,0 +1,281 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func (cfg *apiConfig) handlerVideoReplace(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1<<30)
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this video", nil)
+		return
+	}
+	if video.VideoURL == nil {
+		respondWithError(w, http.StatusConflict, errCodeVideoFileMissing, "Video has no file to replace yet, upload one first", nil)
+		return
+	}
+
+	cfg.receiveVideoFile(w, r, video)
+}
+
+func (cfg *apiConfig) handlerVideoVersionsRetrieve(w http.ResponseWriter, r *http.Request) {
+	type versionResponse struct {
+		Version        int     `json:"version"`
+		S3Key          string  `json:"s3_key"`
+		VideoURL       string  `json:"video_url"`
+		ChecksumSHA256 *string `json:"checksum_sha256"`
+		// Loudness was measured when the profile normalized it
+		Loudness *database.Loudness `json:"loudness"`
+		// VideoBitrateKbps was picked by per-title encoding
+		VideoBitrateKbps *int      `json:"video_bitrate_kbps"`
+		Current          bool      `json:"current"`
+		CreatedAt        time.Time `json:"created_at"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this video", nil)
+		return
+	}
+
+	versions, err := cfg.db.GetVideoVersions(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't retrieve versions", err)
+		return
+	}
+
+	resp := make([]versionResponse, 0, len(versions))
+	for _, version := range versions {
+		videoURL := cfg.objectURL(version.S3Key)
+		resp = append(resp, versionResponse{
+			Version:          version.Version,
+			S3Key:            version.S3Key,
+			VideoURL:         videoURL,
+			ChecksumSHA256:   version.ChecksumSHA256,
+			Loudness:         version.Loudness,
+			VideoBitrateKbps: version.VideoBitrateKbps,
+			Current:          video.VideoURL != nil && *video.VideoURL == videoURL,
+			CreatedAt:        version.CreatedAt,
+		})
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) handlerVideoVersionRollback(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	versionNumber, err := strconv.Atoi(r.PathValue("version"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid version", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", err)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this video", nil)
+		return
+	}
+
+	version, err := cfg.db.GetVideoVersion(videoID, versionNumber)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get version", err)
+		return
+	}
+	if version.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Couldn't find version", nil)
+		return
+	}
+
+	previousURL := video.VideoURL
+	videoURL := cfg.objectURL(version.S3Key)
+	video.VideoURL = &videoURL
+	video.ChecksumSHA256 = version.ChecksumSHA256
+
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video", err)
+		return
+	}
+
+	if previousURL != nil && *previousURL != videoURL {
+		cfg.invalidateVideoURL(r.Context(), *previousURL)
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.withSignedURLs(video))
+}
+
+// originals are only fetched by their owner, a short lived link is enough
+const originalLinkExpiry = time.Hour
+
+// handlerVideoSourceGet returns a download link of the untouched upload the
+// current version was processed from. Only the owner gets one, and every
+// link handed out is recorded in the audit log.
+func (cfg *apiConfig) handlerVideoSourceGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Version     int       `json:"version"`
+		DownloadURL string    `json:"download_url"`
+		ExpiresAt   time.Time `json:"expires_at"`
+	}
+
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil)
+		return
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this video", nil)
+		return
+	}
+
+	versions, err := cfg.db.GetVideoVersions(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't retrieve versions", err)
+		return
+	}
+	if len(versions) == 0 {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Video has no uploaded file", nil)
+		return
+	}
+	version := cfg.currentVideoVersion(video, versions)
+	if version.SourceKey == nil {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Original isn't stored", nil)
+		return
+	}
+
+	ipAddress := ""
+	if addr, ok := cfg.clientIP(r); ok {
+		ipAddress = addr.String()
+	}
+	// no link without a record of who got it
+	err = cfg.db.CreateAuditLogEntry(database.CreateAuditLogEntryParams{
+		UserID:    userID,
+		Action:    database.AuditActionSourceDownload,
+		VideoID:   &video.ID,
+		IPAddress: ipAddress,
+		Detail:    *version.SourceKey,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't record download", err)
+		return
+	}
+
+	downloadURL, err := cfg.presignGetObject(r.Context(), *version.SourceKey, originalLinkExpiry)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create download URL", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Version:     version.Version,
+		DownloadURL: downloadURL,
+		ExpiresAt:   time.Now().UTC().Add(originalLinkExpiry),
+	})
+}
+
+// currentVideoVersion picks the version the video plays from versions,
+// newest first: the newest one unless the video was rolled back.
+func (cfg *apiConfig) currentVideoVersion(video database.Video, versions []database.VideoVersion) database.VideoVersion {
+	if video.VideoURL != nil {
+		for _, v := range versions {
+			if cfg.objectURL(v.S3Key) == *video.VideoURL {
+				return v
+			}
+		}
+	}
+	return versions[0]
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/google/uuid"
+)
+
+// the watch page is what people share. Crawlers read its Open Graph and
+// Twitter Card tags to render previews, people get the embedded player.
+var watchTemplate = template.Must(template.New("watch").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Title}}</title>
+{{if .Found}}<meta name="description" content="{{.Description}}">
+<link rel="canonical" href="{{.URL}}">
+<link rel="alternate" type="application/json+oembed" href="{{.OEmbedURL}}" title="{{.Title}}">
+<meta property="og:site_name" content="Tubely">
+<meta property="og:type" content="video.other">
+<meta property="og:url" content="{{.URL}}">
+<meta property="og:title" content="{{.Title}}">
+<meta property="og:description" content="{{.Description}}">
+{{if .ImageURL}}<meta property="og:image" content="{{.ImageURL}}">
+{{end}}<meta property="og:video" content="{{.PlayerURL}}">
+<meta property="og:video:secure_url" content="{{.PlayerURL}}">
+<meta property="og:video:type" content="text/html">
+<meta property="og:video:width" content="{{.Width}}">
+<meta property="og:video:height" content="{{.Height}}">
+<meta name="twitter:card" content="player">
+<meta name="twitter:title" content="{{.Title}}">
+<meta name="twitter:description" content="{{.Description}}">
+{{if .ImageURL}}<meta name="twitter:image" content="{{.ImageURL}}">
+{{end}}<meta name="twitter:player" content="{{.PlayerURL}}">
+<meta name="twitter:player:width" content="{{.Width}}">
+<meta name="twitter:player:height" content="{{.Height}}">
+{{else}}<meta name="robots" content="noindex">
+{{end}}<style>
+body { margin: 0 auto; max-width: 960px; padding: 16px; font-family: sans-serif; }
+iframe { width: 100%; aspect-ratio: {{.Width}} / {{.Height}}; border: 0; }
+</style>
+</head>
+<body>
+{{if .Found}}<iframe src="{{.PlayerURL}}{{if .Start}}?t={{.Start}}{{end}}" allow="autoplay; fullscreen; picture-in-picture" allowfullscreen></iframe>
+<h1>{{.Title}}</h1>
+<p>{{.Description}}</p>
+{{else}}<h1>This video isn't available</h1>
+{{end}}</body>
+</html>
+`))
+
+type watchPage struct {
+	Found       bool
+	Title       string
+	Description string
+	URL         string
+	ImageURL    string
+	PlayerURL   string
+	OEmbedURL   string
+	Width       int
+	Height      int
+	// Start is where playback starts in seconds, from the t parameter
+	Start int
+}
+
+func (cfg *apiConfig) handlerWatch(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		renderWatch(w, http.StatusNotFound, watchPage{Title: "Tubely"})
+		return
+	}
+
+	video, err := cfg.cachedVideo(r.Context(), videoID)
+	if err != nil {
+		log.Printf("Couldn't get video %s for watch page: %v", videoID, err)
+		renderWatch(w, http.StatusInternalServerError, watchPage{Title: "Tubely"})
+		return
+	}
+	// previews follow the same rules as embeds, private and flagged videos
+	// don't leak their title or thumbnail
+	if !isVideoEmbeddable(video) {
+		renderWatch(w, http.StatusNotFound, watchPage{Title: "Tubely"})
+		return
+	}
+	video, err = cfg.localizeVideo(r, video)
+	if err != nil {
+		log.Printf("Couldn't get translations of video %s for watch page: %v", videoID, err)
+		renderWatch(w, http.StatusInternalServerError, watchPage{Title: "Tubely"})
+		return
+	}
+	w.Header().Add("Vary", "Accept-Language")
+
+	width, height := embedDimensions(cfg.isPortraitVideo(video), "", "")
+	page := watchPage{
+		Found:       true,
+		Title:       video.Title,
+		Description: video.Description,
+		URL:         cfg.watchURL(video.ID),
+		PlayerURL:   cfg.embedURL(video.ID),
+		OEmbedURL:   fmt.Sprintf("%s/oembed?format=json&url=%s", cfg.appBaseURL, url.QueryEscape(cfg.watchURL(video.ID))),
+		Width:       width,
+		Height:      height,
+		Start:       playbackStart(r),
+	}
+	// crawlers never pass the age gate
+	if video.AgeRestricted {
+		video.ThumbnailURL = video.BlurredThumbnailURL
+	}
+	if video.ThumbnailURL != nil {
+		page.ImageURL = cfg.signAssetURL(*video.ThumbnailURL)
+	}
+
+	renderWatch(w, http.StatusOK, page)
+}
+
+func renderWatch(w http.ResponseWriter, code int, page watchPage) {
+	if page.Width == 0 {
+		page.Width, page.Height = embedDimensions(false, "", "")
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	err := watchTemplate.Execute(w, page)
+	if err != nil {
+		log.Printf("Couldn't render watch page: %v", err)
+	}
+}
+
+func (cfg *apiConfig) watchURL(videoID uuid.UUID) string {
+	return fmt.Sprintf("%s/watch/%s", cfg.appBaseURL, videoID)
+}
+
+// watchURLAt links to the watch page starting playback seconds in.
+func (cfg *apiConfig) watchURLAt(videoID uuid.UUID, seconds int) string {
+	if seconds <= 0 {
+		return cfg.watchURL(videoID)
+	}
+	return fmt.Sprintf("%s?t=%d", cfg.watchURL(videoID), seconds)
+}
+
+// playbackStart reads the t parameter of watch and embed pages, whole
+// seconds into the video. Anything else starts at the beginning.
+func playbackStart(r *http.Request) int {
+	seconds, err := strconv.Atoi(r.URL.Query().Get("t"))
+	if err != nil || seconds < 0 {
+		return 0
+	}
+	return seconds
+}
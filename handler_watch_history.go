@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	watchHistoryDefaultLimit = 20
+	watchHistoryMaxLimit     = 100
+	// starting a video again within this long doesn't add another entry
+	watchHistoryRepeatWindow = 30 * time.Minute
+)
+
+// recordWatchHistory notes that the viewer started the video. History is a
+// convenience, so failures are only logged.
+func (cfg *apiConfig) recordWatchHistory(ctx context.Context, userID, videoID uuid.UUID) {
+	if userID == uuid.Nil {
+		return
+	}
+	if err := cfg.db.RecordWatchHistory(userID, videoID, watchHistoryRepeatWindow); err != nil {
+		log.Printf("Couldn't record watch history of video %s: %v", videoID, err)
+	}
+}
+
+// handlerWatchHistoryRetrieve lists the videos the user started, newest
+// first. Pages continue with the cursor of the previous page; videos that
+// were deleted or hidden since are left out, so pages may come up short.
+func (cfg *apiConfig) handlerWatchHistoryRetrieve(w http.ResponseWriter, r *http.Request) {
+	type entry struct {
+		database.WatchHistoryEntry
+		Video database.Video `json:"video"`
+	}
+	type response struct {
+		Enabled bool    `json:"enabled"`
+		Entries []entry `json:"entries"`
+		// NextCursor is nil on the last page
+		NextCursor *uuid.UUID `json:"next_cursor"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	query := r.URL.Query()
+	limit := watchHistoryDefaultLimit
+	if limitString := query.Get("limit"); limitString != "" {
+		limit, err = strconv.Atoi(limitString)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid limit", err)
+			return
+		}
+		limit = min(max(limit, 1), watchHistoryMaxLimit)
+	}
+	var cursor *uuid.UUID
+	if cursorString := query.Get("cursor"); cursorString != "" {
+		id, err := uuid.Parse(cursorString)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid cursor", err)
+			return
+		}
+		exists, err := cfg.db.WatchHistoryEntryExists(userID, id)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get watch history", err)
+			return
+		}
+		if !exists {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Cursor is no longer in your history, start from the first page", nil)
+			return
+		}
+		cursor = &id
+	}
+
+	enabled, err := cfg.db.GetWatchHistoryEnabled(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get watch history settings", err)
+		return
+	}
+	// one extra tells whether there's another page
+	history, err := cfg.db.GetWatchHistory(userID, cursor, limit+1)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get watch history", err)
+		return
+	}
+
+	resp := response{Enabled: enabled, Entries: []entry{}}
+	if len(history) > limit {
+		history = history[:limit]
+		resp.NextCursor = &history[limit-1].ID
+	}
+	for _, e := range history {
+		video, err := cfg.db.GetVideo(e.VideoID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+			return
+		}
+		if video.ID == uuid.Nil || video.DeletedAt != nil || (isVideoHidden(video) && video.UserID != userID) {
+			continue
+		}
+		if video.UserID != userID {
+			// history links to the video page, playback URLs come from there
+			video.VideoURL = nil
+		}
+		video, err = cfg.localizeVideo(r, video)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get translations", err)
+			return
+		}
+		resp.Entries = append(resp.Entries, entry{
+			WatchHistoryEntry: e,
+			Video:             cfg.withSignedURLs(cfg.applyAgeGate(r, video)),
+		})
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) handlerWatchHistoryClear(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	err = cfg.db.ClearWatchHistory(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't clear watch history", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerWatchHistorySettingsUpdate turns recording of the user's history
+// on or off. Turning it off keeps what's already there, clearing is
+// separate.
+func (cfg *apiConfig) handlerWatchHistorySettingsUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Enabled bool `json:"enabled"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	err = cfg.db.SetWatchHistoryEnabled(userID, params.Enabled)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update watch history settings", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, params)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// progress nobody updated for this long is forgotten
+	watchProgressRetention       = 180 * 24 * time.Hour
+	watchProgressCompactInterval = 24 * time.Hour
+)
+
+// handlerVideoProgressUpdate records where the viewer is in the video so
+// players can resume there. Players call it every few seconds while
+// playing; 0 seconds forgets the position, for example once the video is
+// finished.
+func (cfg *apiConfig) handlerVideoProgressUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Seconds *float64 `json:"seconds"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.Seconds == nil || *params.Seconds < 0 || math.IsInf(*params.Seconds, 0) || math.IsNaN(*params.Seconds) {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "seconds must be a non-negative number", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil || (isVideoHidden(video) && video.UserID != userID) {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", nil)
+		return
+	}
+
+	if *params.Seconds == 0 {
+		err = cfg.db.DeleteWatchProgress(userID, video.ID)
+	} else {
+		err = cfg.db.SetWatchProgress(userID, video.ID, *params.Seconds)
+	}
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save progress", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// withResumePositions fills in where the user left off in each video.
+func (cfg *apiConfig) withResumePositions(userID uuid.UUID, videos []database.Video) ([]database.Video, error) {
+	ids := make([]uuid.UUID, 0, len(videos))
+	for _, video := range videos {
+		ids = append(ids, video.ID)
+	}
+	positions, err := cfg.db.GetWatchProgress(userID, ids)
+	if err != nil {
+		return nil, err
+	}
+	for i := range videos {
+		if seconds, ok := positions[videos[i].ID]; ok {
+			videos[i].ResumePosition = &seconds
+		}
+	}
+	return videos, nil
+}
+
+// compactWatchProgress drops progress nobody will resume from.
+func (cfg *apiConfig) compactWatchProgress(ctx context.Context) error {
+	removed, err := cfg.db.CompactWatchProgress(watchProgressRetention)
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		log.Printf("Removed %d stale watch progress entries", removed)
+	}
+	return nil
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// WebRTC itself is terminated by an external WHIP gateway such as MediaMTX.
+// We authenticate the broadcaster with their stream key, hand the SDP offer
+// to the gateway under the stream's ID and pull the published stream back
+// over RTSP into the regular live ingest, so WHIP streams get the same HLS
+// output, DVR window and archiving as RTMP ones.
+
+const maxSDPSize = 1 << 16
+
+func (cfg *apiConfig) handlerWHIPPublish(w http.ResponseWriter, r *http.Request) {
+	if cfg.whipGatewayURL == "" {
+		respondWithError(w, http.StatusServiceUnavailable, errCodeUnavailable, "WHIP ingest isn't enabled", nil)
+		return
+	}
+
+	streamKey, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeInvalidStreamKey, "Couldn't find stream key", err)
+		return
+	}
+	userID, err := cfg.db.GetUserIDByStreamKey(streamKey)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't check stream key", err)
+		return
+	}
+	if userID == uuid.Nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeInvalidStreamKey, "Invalid stream key", nil)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/sdp" {
+		respondWithError(w, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, "Expected an application/sdp offer", err)
+		return
+	}
+	offer, err := io.ReadAll(io.LimitReader(r.Body, maxSDPSize))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't read SDP offer", err)
+		return
+	}
+
+	title := r.URL.Query().Get("title")
+	if title == "" {
+		title = "Live stream"
+	}
+
+	// WHIP streams don't listen for RTMP, so they don't need a port
+	stream, err := cfg.db.CreateLiveStream(database.CreateLiveStreamParams{
+		UserID: userID,
+		Title:  title,
+	}, 0)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create live stream", err)
+		return
+	}
+
+	answer, sessionURL, err := cfg.publishToWHIPGateway(r.Context(), stream.ID, offer)
+	if err != nil {
+		cfg.db.EndLiveStream(stream.ID, database.LiveStreamStatusFailed)
+		respondWithError(w, http.StatusBadGateway, errCodeUpstreamFailed, "Couldn't negotiate with the WebRTC gateway", err)
+		return
+	}
+
+	err = cfg.startLiveIngest(stream, liveInput{
+		args: []string{"-rtsp_transport", "tcp", "-i", fmt.Sprintf("%s/%s", cfg.whipGatewayRTSPURL, stream.ID)},
+		pull: true,
+	})
+	if err != nil {
+		if sessionURL != "" {
+			cfg.deleteWHIPGatewaySession(sessionURL)
+		}
+		cfg.db.EndLiveStream(stream.ID, database.LiveStreamStatusFailed)
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't start live ingest", err)
+		return
+	}
+	cfg.live.setWHIPSession(stream.ID, sessionURL)
+
+	w.Header().Set("Content-Type", "application/sdp")
+	w.Header().Set("Location", fmt.Sprintf("/api/live/whip/%s", stream.ID))
+	w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"alternate\"; type=\"application/vnd.apple.mpegurl\"", cfg.liveStreamPlaybackURL(stream.ID)))
+	w.WriteHeader(http.StatusCreated)
+	w.Write(answer)
+}
+
+func (cfg *apiConfig) handlerWHIPDelete(w http.ResponseWriter, r *http.Request) {
+	streamIDString := r.PathValue("streamID")
+	streamID, err := uuid.Parse(streamIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	streamKey, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeInvalidStreamKey, "Couldn't find stream key", err)
+		return
+	}
+	userID, err := cfg.db.GetUserIDByStreamKey(streamKey)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't check stream key", err)
+		return
+	}
+
+	stream, err := cfg.db.GetLiveStream(streamID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get live stream", err)
+		return
+	}
+	if stream.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeLiveStreamNotFound, "Couldn't find live stream", nil)
+		return
+	}
+	if userID == uuid.Nil || stream.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this live stream", nil)
+		return
+	}
+
+	sessionURL := cfg.live.whipSession(stream.ID)
+	if !cfg.live.stop(stream.ID) {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Live stream isn't running", nil)
+		return
+	}
+	if sessionURL != "" {
+		cfg.deleteWHIPGatewaySession(sessionURL)
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// publishToWHIPGateway forwards the broadcaster's offer and returns the
+// gateway's answer along with the URL of the session it created.
+func (cfg *apiConfig) publishToWHIPGateway(ctx context.Context, streamID uuid.UUID, offer []byte) ([]byte, string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	endpoint := fmt.Sprintf("%s/%s/whip", cfg.whipGatewayURL, streamID)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(offer))
+	if err != nil {
+		return nil, "", err
+	}
+	req.Header.Set("Content-Type", "application/sdp")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, maxSDPSize))
+	if err != nil {
+		return nil, "", err
+	}
+	if resp.StatusCode != http.StatusCreated {
+		return nil, "", fmt.Errorf("gateway returned %s: %s", resp.Status, bytes.TrimSpace(answer))
+	}
+
+	// the session location is usually relative to the WHIP endpoint
+	location, err := resp.Location()
+	if err != nil {
+		if err == http.ErrNoLocation {
+			return answer, "", nil
+		}
+		return nil, "", err
+	}
+	return answer, location.String(), nil
+}
+
+// deleteWHIPGatewaySession tears down the WebRTC session on the gateway. It
+// only logs failures, the ingest is stopped either way.
+func (cfg *apiConfig) deleteWHIPGatewaySession(sessionURL string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, sessionURL, nil)
+	if err != nil {
+		log.Printf("Couldn't end WHIP gateway session %s: %v", sessionURL, err)
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("Couldn't end WHIP gateway session %s: %v", sessionURL, err)
+		return
+	}
+	resp.Body.Close()
+}
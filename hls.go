@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	jobTypePackageHLS = "package_hls"
+
+	hlsSegmentSeconds = 6
+	// a new key every ten segments, roughly once a minute of playback
+	hlsKeyRotationSegments = 10
+)
+
+type packageHLSPayload struct {
+	VideoID uuid.UUID `json:"video_id"`
+}
+
+// requestHLSPackaging queues an AES-128 encrypted HLS rendition of the
+// video's current file when HLS encryption is enabled.
+func (cfg *apiConfig) requestHLSPackaging(videoID uuid.UUID) {
+	if !cfg.hlsEncryption {
+		return
+	}
+	_, err := cfg.enqueueJob(jobTypePackageHLS, &videoID, packageHLSPayload{VideoID: videoID})
+	if err != nil {
+		log.Printf("Couldn't queue HLS packaging for video %s: %v", videoID, err)
+	}
+}
+
+func (cfg *apiConfig) runPackageHLSJob(ctx context.Context, job database.Job) error {
+	var payload packageHLSPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+
+	video, err := cfg.db.GetVideo(payload.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.VideoURL == nil {
+		return fmt.Errorf("video %s has no file to package", payload.VideoID)
+	}
+	key, ok := cfg.objectKeyFromURL(*video.VideoURL)
+	if !ok {
+		return fmt.Errorf("video %s isn't stored in our bucket", payload.VideoID)
+	}
+
+	dir, err := os.MkdirTemp("", "tubely-hls")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	srcPath := filepath.Join(dir, "source.mp4")
+	srcFile, err := os.Create(srcPath)
+	if err != nil {
+		return err
+	}
+	err = cfg.downloadObject(ctx, key, srcFile)
+	srcFile.Close()
+	if err != nil {
+		return fmt.Errorf("couldn't download %s: %w", key, err)
+	}
+
+	org, err := cfg.db.GetOrganizationByUser(video.UserID)
+	if err != nil {
+		return err
+	}
+
+	outDir := filepath.Join(dir, "out")
+	playlist := "index.m3u8"
+	var keys [][]byte
+	if org.ForensicWatermark {
+		keys, err = cfg.packageWatermarkedHLS(ctx, srcPath, outDir, video.ID)
+		if err != nil {
+			return err
+		}
+		// the A variant's playlist stands in for both, segment names match
+		playlist = watermarkVariantA + "/index.m3u8"
+	} else {
+		err = segmentHLS(ctx, srcPath, outDir, "-c", "copy")
+		if err != nil {
+			return err
+		}
+		keys, err = cfg.encryptHLS(outDir, video.ID, nil)
+		if err != nil {
+			return err
+		}
+		// viewers of watermarked videos get a media playlist of their own,
+		// they find the alternate audio in the playback response instead
+		keys, playlist, err = cfg.packageAudioTracks(ctx, video, srcPath, outDir, keys)
+		if err != nil {
+			return err
+		}
+	}
+
+	enc, err := cfg.objectEncryptionForUser(video.UserID)
+	if err != nil {
+		return err
+	}
+	tags, err := cfg.objectTagsForUser(video.UserID)
+	if err != nil {
+		return err
+	}
+	prefix := fmt.Sprintf("hls/%s/%s", video.ID, uuid.New())
+	err = cfg.uploadDirectory(ctx, outDir, prefix, enc, tags)
+	if err != nil {
+		return err
+	}
+
+	return cfg.db.ReplaceHLSKeys(video.ID, prefix+"/"+playlist, org.ForensicWatermark, keys)
+}
+
+// segmentHLS splits the source into plain MPEG-TS segments and a VOD
+// playlist named plain.m3u8, encoding it with codecArgs.
+func segmentHLS(ctx context.Context, srcPath, outDir string, codecArgs ...string) error {
+	err := os.MkdirAll(outDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"-i", srcPath}
+	args = append(args, codecArgs...)
+	args = append(args,
+		"-f", "hls",
+		"-hls_time", strconv.Itoa(hlsSegmentSeconds),
+		"-hls_playlist_type", "vod",
+		"-hls_segment_filename", filepath.Join(outDir, "segment%05d.ts"),
+		filepath.Join(outDir, "plain.m3u8"),
+	)
+	cmd := ffmpegRunner.Command(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return newCommandError("ffmpeg", err, stderr.Bytes())
+	}
+	return nil
+}
+
+// encryptHLS encrypts the segments in place and writes index.m3u8, which
+// references the app's key endpoint. Keys rotate every
+// hlsKeyRotationSegments segments; each segment uses its media sequence
+// number as IV, the HLS default when the key tag has no IV attribute. Keys
+// already in keys are reused, new ones are appended as needed.
+func (cfg *apiConfig) encryptHLS(dir string, videoID uuid.UUID, keys [][]byte) ([][]byte, error) {
+	plainPath := filepath.Join(dir, "plain.m3u8")
+	plain, err := os.ReadFile(plainPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		playlist strings.Builder
+		segment  int
+	)
+	scanner := bufio.NewScanner(bytes.NewReader(plain))
+	for scanner.Scan() {
+		line := scanner.Text()
+		keyIndex := segment / hlsKeyRotationSegments
+
+		if strings.HasPrefix(line, "#EXTINF") && segment%hlsKeyRotationSegments == 0 {
+			if keyIndex == len(keys) {
+				key := make([]byte, 16)
+				if _, err := rand.Read(key); err != nil {
+					return nil, err
+				}
+				keys = append(keys, key)
+			}
+			fmt.Fprintf(&playlist, "#EXT-X-KEY:METHOD=AES-128,URI=\"%s/api/videos/%s/key?index=%d\"\n", cfg.appBaseURL, videoID, keyIndex)
+		}
+
+		if line != "" && !strings.HasPrefix(line, "#") {
+			err := encryptSegment(filepath.Join(dir, line), keys[keyIndex], segment)
+			if err != nil {
+				return nil, err
+			}
+			segment++
+		}
+
+		playlist.WriteString(line)
+		playlist.WriteString("\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(filepath.Join(dir, "index.m3u8"), []byte(playlist.String()), 0644)
+	if err != nil {
+		return nil, err
+	}
+	// only the encrypted playlist gets uploaded
+	return keys, os.Remove(plainPath)
+}
+
+func encryptSegment(segmentPath string, key []byte, sequence int) error {
+	data, err := os.ReadFile(segmentPath)
+	if err != nil {
+		return err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+
+	// PKCS#7 padding as required for AES-128 HLS segments
+	padding := aes.BlockSize - len(data)%aes.BlockSize
+	data = append(data, bytes.Repeat([]byte{byte(padding)}, padding)...)
+
+	iv := make([]byte, aes.BlockSize)
+	binary.BigEndian.PutUint64(iv[8:], uint64(sequence))
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(data, data)
+
+	return os.WriteFile(segmentPath, data, 0644)
+}
+
+func (cfg *apiConfig) handlerVideoHLSKey(w http.ResponseWriter, r *http.Request) {
+	videoIDString := r.PathValue("videoID")
+	videoID, err := uuid.Parse(videoIDString)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	index, err := strconv.Atoi(r.URL.Query().Get("index"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid key index", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.cachedVideo(r.Context(), videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil || (isVideoHidden(video) && video.UserID != userID) {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", nil)
+		return
+	}
+	if video.UserID != userID {
+		if reason, blocked := geoBlockReason(video, cfg.viewerCountry(r)); blocked {
+			respondWithError(w, http.StatusUnavailableForLegalReasons, errCodeGeoBlocked, reason, nil)
+			return
+		}
+		if !cfg.checkPlaybackToken(w, r, userID, video.ID) {
+			return
+		}
+	}
+
+	key, err := cfg.db.GetHLSKey(videoID, index)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get key", err)
+		return
+	}
+	if key == nil {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Couldn't find key", nil)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(key)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	// signed asset URLs stay valid at least this long
+	assetURLExpiry = 12 * time.Hour
+	// expiries are rounded up to this so URLs, and browser caches, stay the
+	// same across requests
+	assetURLExpiryWindow = time.Hour
+)
+
+// assetProtection keeps other sites from hotlinking files under /assets/.
+// Either check is optional: with a secret every URL needs a valid signature,
+// with allowed hosts requests referred by any other site are refused.
+type assetProtection struct {
+	secret       []byte
+	allowedHosts []string
+}
+
+func (p assetProtection) enabled() bool {
+	return len(p.secret) > 0 || len(p.allowedHosts) > 0
+}
+
+func (p assetProtection) signature(path string, expires int64) string {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write([]byte(path + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// signAssetURL adds an expiry and signature to URLs served by the /assets/
+// handler. Other URLs, and all URLs when no secret is set, are unchanged.
+func (cfg *apiConfig) signAssetURL(rawURL string) string {
+	if len(cfg.assetProtection.secret) == 0 {
+		return rawURL
+	}
+	if _, ok := cfg.assetPathFromURL(rawURL); !ok {
+		return rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+
+	expires := time.Now().Add(assetURLExpiry).Truncate(assetURLExpiryWindow).Add(assetURLExpiryWindow).Unix()
+	query := u.Query()
+	query.Set("expires", strconv.FormatInt(expires, 10))
+	query.Set("sig", cfg.assetProtection.signature(u.Path, expires))
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// withSignedURLs returns the video with its thumbnails signed for the
+// /assets/ handler and its file signed for CloudFront, for handing to
+// clients. It must not be saved afterwards.
+func (cfg *apiConfig) withSignedURLs(video database.Video) database.Video {
+	if video.ThumbnailURL != nil {
+		thumbnailURL := cfg.signAssetURL(*video.ThumbnailURL)
+		video.ThumbnailURL = &thumbnailURL
+	}
+	if video.BlurredThumbnailURL != nil {
+		blurredURL := cfg.signAssetURL(*video.BlurredThumbnailURL)
+		video.BlurredThumbnailURL = &blurredURL
+	}
+	if video.VideoURL != nil && cfg.cdnURLSigner != nil {
+		expires := time.Now().Add(assetURLExpiry).Truncate(assetURLExpiryWindow).Add(assetURLExpiryWindow)
+		if videoURL, err := cfg.cachedSignCDNURL(*video.VideoURL, expires); err == nil {
+			video.VideoURL = &videoURL
+		}
+	}
+	return video
+}
+
+func (cfg *apiConfig) withSignedURLsAll(videos []database.Video) []database.Video {
+	signed := make([]database.Video, len(videos))
+	for i, video := range videos {
+		signed[i] = cfg.withSignedURLs(video)
+	}
+	return signed
+}
+
+// hotlinkProtectionMiddleware guards the /assets/ handler, it expects the
+// request path to still include the /assets prefix.
+func (cfg *apiConfig) hotlinkProtectionMiddleware(next http.Handler) http.Handler {
+	if !cfg.assetProtection.enabled() {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// requests without a Referer are let through, browsers and privacy
+		// tools strip it and signatures cover direct links
+		if len(cfg.assetProtection.allowedHosts) > 0 && r.Referer() != "" {
+			referrer, err := url.Parse(r.Referer())
+			if err != nil || !slices.Contains(cfg.assetProtection.allowedHosts, strings.ToLower(referrer.Hostname())) {
+				respondWithError(w, http.StatusForbidden, errCodeForbidden, "Hotlinking isn't allowed", nil)
+				return
+			}
+		}
+
+		if len(cfg.assetProtection.secret) > 0 {
+			query := r.URL.Query()
+			expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+			if err != nil || time.Now().Unix() > expires {
+				respondWithError(w, http.StatusForbidden, errCodeForbidden, "Asset link is missing or expired", err)
+				return
+			}
+			expected := cfg.assetProtection.signature(r.URL.Path, expires)
+			if !hmac.Equal([]byte(query.Get("sig")), []byte(expected)) {
+				respondWithError(w, http.StatusForbidden, errCodeForbidden, "Invalid asset signature", nil)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
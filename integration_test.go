@@ -0,0 +1,337 @@
+//go:build integration
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// The integration tests run the app against a real S3-compatible store
+// with a fake ffmpeg. Start one with
+//
+//	docker compose -f docker-compose.test.yml up -d
+//	go test -tags integration -run Integration .
+//
+// INTEGRATION_S3_ENDPOINT, INTEGRATION_S3_REGION and the usual AWS
+// credential variables point them elsewhere, e.g. at LocalStack on
+// http://localhost:4566. Every test works in a bucket of its own.
+
+const integrationJWTSecret = "integration-secret"
+
+func integrationEnv(name, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// newIntegrationConfig returns a config storing objects in a new bucket,
+// which is emptied and removed when the test ends.
+func newIntegrationConfig(t *testing.T) (*apiConfig, *fakeFFmpeg) {
+	t.Helper()
+	endpoint := strings.TrimSuffix(integrationEnv("INTEGRATION_S3_ENDPOINT", "http://localhost:9000"), "/")
+	region := integrationEnv("INTEGRATION_S3_REGION", "us-east-1")
+	// the credentials of the compose file's MinIO
+	if os.Getenv("AWS_ACCESS_KEY_ID") == "" {
+		t.Setenv("AWS_ACCESS_KEY_ID", "minioadmin")
+		t.Setenv("AWS_SECRET_ACCESS_KEY", "minioadmin")
+	}
+
+	ctx := context.Background()
+	awsConfig, err := config.LoadDefaultConfig(ctx, config.WithRegion(region))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := newS3Client(awsConfig, s3EndpointConfig{URL: endpoint, PathStyle: true})
+
+	bucket := "tubely-it-" + strings.ReplaceAll(uuid.NewString(), "-", "")[:12]
+	_, err = client.CreateBucket(ctx, &s3.CreateBucketInput{Bucket: aws.String(bucket)})
+	if err != nil {
+		t.Fatalf("Couldn't create bucket at %s, is the store up? %v", endpoint, err)
+	}
+	t.Cleanup(func() { removeBucket(t, client, bucket) })
+
+	routes, err := loadStorageRoutes("", storageRoute{Bucket: bucket, CDNURL: endpoint + "/" + bucket})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyStrategy, err := newKeyStrategy("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := newTestConfig(t)
+	cfg.jwtSecret = integrationJWTSecret
+	cfg.platform = "dev"
+	cfg.assetsRoot = t.TempDir()
+	cfg.s3Bucket = bucket
+	cfg.s3Region = region
+	cfg.s3Client = client
+	cfg.storageRoutes = routes
+	cfg.keyStrategy = keyStrategy
+	cfg.storeOriginals = true
+	cfg.hlsEncryption = true
+	cfg.appBaseURL = "http://tubely.test"
+	cfg.mailer = logMailer{}
+	cfg.locker = newMemoryLocker()
+	cfg.metadataCache = newLRUCache(100)
+	cfg.jobQueue = dbJobQueue{db: cfg.db, visibilityTimeout: time.Minute}
+	return cfg, useFakeFFmpeg(t)
+}
+
+func removeBucket(t *testing.T, client *s3.Client, bucket string) {
+	ctx := context.Background()
+	paginator := s3.NewListObjectsV2Paginator(client, &s3.ListObjectsV2Input{Bucket: aws.String(bucket)})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			t.Logf("Couldn't list bucket %s: %v", bucket, err)
+			return
+		}
+		for _, object := range page.Contents {
+			client.DeleteObject(ctx, &s3.DeleteObjectInput{Bucket: aws.String(bucket), Key: object.Key})
+		}
+	}
+	if _, err := client.DeleteBucket(ctx, &s3.DeleteBucketInput{Bucket: aws.String(bucket)}); err != nil {
+		t.Logf("Couldn't remove bucket %s: %v", bucket, err)
+	}
+}
+
+// callAs runs the handler with the user signed in and returns the recorded
+// response.
+func callAs(t *testing.T, handler http.HandlerFunc, req *http.Request, userID uuid.UUID, pathValues ...string) *httptest.ResponseRecorder {
+	t.Helper()
+	token, err := auth.MakeJWT(userID, uuid.New(), integrationJWTSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	for i := 0; i+1 < len(pathValues); i += 2 {
+		req.SetPathValue(pathValues[i], pathValues[i+1])
+	}
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func videoUploadRequest(t *testing.T, videoID uuid.UUID, content []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="video"; filename="boots.mp4"`)
+	header.Set("Content-Type", "video/mp4")
+	part, err := form.CreatePart(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(content)
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/video_upload/"+videoID.String(), &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+func (cfg *apiConfig) objectExists(t *testing.T, key string) bool {
+	t.Helper()
+	route := cfg.storageRoute(key)
+	_, err := cfg.s3Client.HeadObject(context.Background(), &s3.HeadObjectInput{
+		Bucket: aws.String(route.Bucket),
+		Key:    aws.String(route.bucketKey(key)),
+	})
+	var notFound *types.NotFound
+	if errors.As(err, &notFound) {
+		return false
+	}
+	if err != nil {
+		t.Fatalf("HeadObject %s: %v", key, err)
+	}
+	return true
+}
+
+// bucketKeys lists every object in the test's bucket.
+func (cfg *apiConfig) bucketKeys(t *testing.T) []string {
+	t.Helper()
+	out, err := cfg.s3Client.ListObjectsV2(context.Background(), &s3.ListObjectsV2Input{Bucket: aws.String(cfg.s3Bucket)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{}
+	for _, object := range out.Contents {
+		keys = append(keys, aws.ToString(object.Key))
+	}
+	return keys
+}
+
+func TestIntegrationUploadPlaybackDelete(t *testing.T) {
+	cfg, fake := newIntegrationConfig(t)
+	user, err := cfg.db.CreateUser(database.CreateUserParams{Email: "ann@example.com", Password: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// create
+	w := callAs(t, cfg.handlerVideoMetaCreate, httptest.NewRequest(http.MethodPost, "/api/videos", strings.NewReader(`{"title":"Boots","description":"New boots"}`)), user.ID)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("create: status %d: %s", w.Code, w.Body)
+	}
+	var video database.Video
+	if err := json.NewDecoder(w.Body).Decode(&video); err != nil {
+		t.Fatal(err)
+	}
+
+	// upload and process
+	content := []byte("fake mp4 payload")
+	w = callAs(t, cfg.handlerUploadVideo, videoUploadRequest(t, video.ID, content), user.ID, "videoID", video.ID.String())
+	if w.Code != http.StatusOK {
+		t.Fatalf("upload: status %d: %s", w.Code, w.Body)
+	}
+	versions, err := cfg.db.GetVideoVersions(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].SourceKey == nil {
+		t.Fatalf("versions %+v, want one with its original", versions)
+	}
+	version := versions[0]
+	for _, key := range []string{version.S3Key, *version.SourceKey} {
+		if !cfg.objectExists(t, key) {
+			t.Errorf("%s wasn't stored", key)
+		}
+	}
+	transcoded := false
+	for _, args := range fake.calls(t) {
+		if args[0] == "ffmpeg" && strings.HasSuffix(args[len(args)-1], ".processing") {
+			transcoded = true
+		}
+	}
+	if !transcoded {
+		t.Error("the upload wasn't transcoded")
+	}
+
+	// background processing, as a worker would run it
+	jobs, err := cfg.db.GetJobsByStatus(database.JobStatusPending, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packaged := false
+	for _, job := range jobs {
+		if job.Type != jobTypePackageHLS {
+			continue
+		}
+		if err := cfg.runJob(context.Background(), cfg.jobHandlers(), job); err != nil {
+			t.Fatalf("HLS packaging: %v", err)
+		}
+		packaged = true
+	}
+	if !packaged {
+		t.Fatal("HLS packaging wasn't queued")
+	}
+
+	// playback
+	w = callAs(t, cfg.handlerVideoPlayback, httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String()+"/playback", nil), user.ID, "videoID", video.ID.String())
+	if w.Code != http.StatusOK {
+		t.Fatalf("playback: status %d: %s", w.Code, w.Body)
+	}
+	var playback struct {
+		VideoURL string  `json:"video_url"`
+		HLSURL   *string `json:"hls_url"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&playback); err != nil {
+		t.Fatal(err)
+	}
+	key, ok := cfg.objectKeyFromURL(playback.VideoURL)
+	if !ok || key != version.S3Key {
+		t.Fatalf("playback URL %s, want one for %s", playback.VideoURL, version.S3Key)
+	}
+	route := cfg.storageRoute(key)
+	object, err := cfg.s3Client.GetObject(context.Background(), &s3.GetObjectInput{
+		Bucket: aws.String(route.Bucket),
+		Key:    aws.String(route.bucketKey(key)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	played, err := io.ReadAll(object.Body)
+	object.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the fake transcodes by copying
+	if !bytes.Equal(played, content) {
+		t.Errorf("playback URL serves %q, want the processed upload", played)
+	}
+	if playback.HLSURL == nil {
+		t.Fatal("playback has no HLS URL")
+	}
+	playlistKey, ok := cfg.objectKeyFromURL(*playback.HLSURL)
+	if !ok || !cfg.objectExists(t, playlistKey) {
+		t.Fatalf("HLS URL %s doesn't point at a stored playlist", *playback.HLSURL)
+	}
+
+	// delete: to the trash, then for good
+	w = callAs(t, cfg.handlerVideoMetaDelete, httptest.NewRequest(http.MethodDelete, "/api/videos/"+video.ID.String(), nil), user.ID, "videoID", video.ID.String())
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("delete: status %d: %s", w.Code, w.Body)
+	}
+	if !cfg.objectExists(t, version.S3Key) {
+		t.Error("trashing the video deleted its file")
+	}
+	w = callAs(t, cfg.handlerVideoPurge, httptest.NewRequest(http.MethodDelete, "/api/videos/"+video.ID.String()+"/purge", nil), user.ID, "videoID", video.ID.String())
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("purge: status %d: %s", w.Code, w.Body)
+	}
+	if keys := cfg.bucketKeys(t); len(keys) != 0 {
+		t.Errorf("still stored after purging: %v", keys)
+	}
+	deleted, err := cfg.db.GetVideo(video.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted.ID != uuid.Nil {
+		t.Error("the video record is still there")
+	}
+}
+
+func TestIntegrationUploadRejectsUnreadableFiles(t *testing.T) {
+	cfg, _ := newIntegrationConfig(t)
+	user, err := cfg.db.CreateUser(database.CreateUserParams{Email: "ann@example.com", Password: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Boots", UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is stored for an upload that can't be processed
+	w := callAs(t, cfg.handlerUploadVideo, videoUploadRequest(t, video.ID, nil), user.ID, "videoID", video.ID.String())
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400: %s", w.Code, w.Body)
+	}
+
+	if keys := cfg.bucketKeys(t); len(keys) != 0 {
+		t.Errorf("stored %v for a rejected upload", keys)
+	}
+}
@@ -20,8 +20,23 @@ const (
 	TokenTypeAccess TokenType = "tubely-access"
 )
 
+// scopes limit what an access token may do, tokens without any may do
+// everything their user can
+const (
+	ScopeUploadVideo = "upload:video"
+	ScopeReadVideo   = "read:video"
+	ScopeAdmin       = "admin"
+)
+
 var ErrNoAuthHeaderIncluded = errors.New("no auth header included in request")
 
+// accessClaims are the claims of an access token. Scope is space separated,
+// like OAuth scopes.
+type accessClaims struct {
+	jwt.RegisteredClaims
+	Scope string `json:"scope,omitempty"`
+}
+
 func HashPassword(password string) (string, error) {
 	dat, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
 	if err != nil {
@@ -34,8 +49,12 @@ func CheckPasswordHash(password, hash string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
 }
 
+// MakeJWT issues an access token for the user. sessionID names the session
+// (refresh token) it was issued for, so the session list can tell which one
+// is current.
 func MakeJWT(
 	userID uuid.UUID,
+	sessionID uuid.UUID,
 	tokenSecret string,
 	expiresIn time.Duration,
 ) (string, error) {
@@ -45,6 +64,7 @@ func MakeJWT(
 		IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
 		ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
 		Subject:   userID.String(),
+		ID:        sessionID.String(),
 	})
 	return token.SignedString(signingKey)
 }
@@ -80,6 +100,69 @@ func ValidateJWT(tokenString, tokenSecret string) (uuid.UUID, error) {
 	return id, nil
 }
 
+// MakeScopedJWT issues an access token limited to scopes. tokenID names the
+// stored token, so it can be revoked before it expires.
+func MakeScopedJWT(
+	userID uuid.UUID,
+	tokenID uuid.UUID,
+	scopes []string,
+	tokenSecret string,
+	expiresIn time.Duration,
+) (string, error) {
+	signingKey := []byte(tokenSecret)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, accessClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    string(TokenTypeAccess),
+			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(expiresIn)),
+			Subject:   userID.String(),
+			ID:        tokenID.String(),
+		},
+		Scope: strings.Join(scopes, " "),
+	})
+	return token.SignedString(signingKey)
+}
+
+// GetJWTScopes returns the ID and scopes of a valid access token. Unscoped
+// tokens return no scopes.
+func GetJWTScopes(tokenString, tokenSecret string) (uuid.UUID, []string, error) {
+	claimsStruct := accessClaims{}
+	_, err := jwt.ParseWithClaims(
+		tokenString,
+		&claimsStruct,
+		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+	)
+	if err != nil {
+		return uuid.Nil, nil, err
+	}
+	if claimsStruct.Scope == "" {
+		return uuid.Nil, nil, nil
+	}
+	tokenID, err := uuid.Parse(claimsStruct.ID)
+	if err != nil {
+		return uuid.Nil, nil, fmt.Errorf("invalid token ID: %w", err)
+	}
+	return tokenID, strings.Fields(claimsStruct.Scope), nil
+}
+
+// GetJWTSessionID returns the session a valid access token was issued for,
+// uuid.Nil for tokens from before sessions were recorded in them.
+func GetJWTSessionID(tokenString, tokenSecret string) (uuid.UUID, error) {
+	claimsStruct := jwt.RegisteredClaims{}
+	_, err := jwt.ParseWithClaims(
+		tokenString,
+		&claimsStruct,
+		func(token *jwt.Token) (interface{}, error) { return []byte(tokenSecret), nil },
+	)
+	if err != nil {
+		return uuid.Nil, err
+	}
+	if claimsStruct.ID == "" {
+		return uuid.Nil, nil
+	}
+	return uuid.Parse(claimsStruct.ID)
+}
+
 func GetBearerToken(headers http.Header) (string, error) {
 	authHeader := headers.Get("Authorization")
 	if authHeader == "" {
@@ -0,0 +1,41 @@
+package contentid
+
+import (
+	"context"
+)
+
+// Fingerprints is what a checker is given of a video. FrameHashes are
+// 64-bit difference hashes of frames sampled evenly over the video, and
+// AudioPath, when not empty, is a mono AAC extract of its soundtrack.
+type Fingerprints struct {
+	VideoID         string
+	DurationSeconds float64
+	FrameHashes     []uint64
+	AudioPath       string
+}
+
+// Match is a registered work found in a video. Media is "audio" or
+// "video", Confidence a percentage between 0 and 100, and the seconds are
+// where in the video the work appears.
+type Match struct {
+	ReferenceID  string  `json:"reference_id"`
+	Title        string  `json:"title"`
+	Owner        string  `json:"owner"`
+	Media        string  `json:"media"`
+	Confidence   float64 `json:"confidence"`
+	StartSeconds float64 `json:"start_seconds"`
+	EndSeconds   float64 `json:"end_seconds"`
+}
+
+// Checker looks a video's fingerprints up in a registry of copyrighted
+// works. Implementations must be safe for concurrent use.
+type Checker interface {
+	Check(ctx context.Context, fingerprints Fingerprints) ([]Match, error)
+}
+
+// Noop never matches anything. It's used when no registry is configured.
+type Noop struct{}
+
+func (Noop) Check(ctx context.Context, fingerprints Fingerprints) ([]Match, error) {
+	return nil, nil
+}
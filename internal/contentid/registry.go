@@ -0,0 +1,111 @@
+package contentid
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Registry calls an external fingerprinting service. It posts a multipart
+// form with a "fingerprints" JSON part and, if the video has sound, an
+// "audio" file part, and expects {"matches": [...]} back.
+type Registry struct {
+	endpoint   string
+	token      string
+	httpClient *http.Client
+}
+
+func NewRegistry(endpoint, token string) *Registry {
+	return &Registry{
+		endpoint: endpoint,
+		token:    token,
+		// audio of long videos takes a while to upload and match
+		httpClient: &http.Client{Timeout: 5 * time.Minute},
+	}
+}
+
+func (r *Registry) Check(ctx context.Context, fingerprints Fingerprints) ([]Match, error) {
+	type metadata struct {
+		VideoID         string   `json:"video_id"`
+		DurationSeconds float64  `json:"duration_seconds"`
+		FrameHashes     []string `json:"frame_hashes"`
+	}
+	type response struct {
+		Matches []Match `json:"matches"`
+	}
+
+	meta := metadata{
+		VideoID:         fingerprints.VideoID,
+		DurationSeconds: fingerprints.DurationSeconds,
+		FrameHashes:     make([]string, 0, len(fingerprints.FrameHashes)),
+	}
+	for _, hash := range fingerprints.FrameHashes {
+		meta.FrameHashes = append(meta.FrameHashes, fmt.Sprintf("%016x", hash))
+	}
+
+	// stream the form so the audio isn't held in memory
+	body, pw := io.Pipe()
+	form := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeForm(form, meta, fingerprints.AudioPath))
+	}()
+	defer body.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if r.token != "" {
+		req.Header.Set("Authorization", "Bearer "+r.token)
+	}
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("content ID registry responded with %s: %s", resp.Status, msg)
+	}
+
+	var out response
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	if err != nil {
+		return nil, err
+	}
+	return out.Matches, nil
+}
+
+func writeForm(form *multipart.Writer, meta any, audioPath string) error {
+	part, err := form.CreateFormField("fingerprints")
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(part).Encode(meta); err != nil {
+		return err
+	}
+
+	if audioPath != "" {
+		audio, err := os.Open(audioPath)
+		if err != nil {
+			return err
+		}
+		defer audio.Close()
+		part, err := form.CreateFormFile("audio", "audio.m4a")
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(part, audio); err != nil {
+			return err
+		}
+	}
+	return form.Close()
+}
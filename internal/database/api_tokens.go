@@ -0,0 +1,125 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// APIToken is a scoped access token for automation. The token itself is a
+// JWT that isn't stored, the row lets it be listed and revoked.
+type APIToken struct {
+	ID        uuid.UUID  `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	RevokedAt *time.Time `json:"revoked_at"`
+	CreateAPITokenParams
+}
+
+type CreateAPITokenParams struct {
+	UserID    uuid.UUID `json:"user_id"`
+	Name      string    `json:"name"`
+	Scopes    []string  `json:"scopes"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+const apiTokenColumns = `
+		id,
+		created_at,
+		revoked_at,
+		user_id,
+		name,
+		scopes,
+		expires_at
+`
+
+func scanAPIToken(row interface{ Scan(...any) error }) (APIToken, error) {
+	var t APIToken
+	var scopes string
+	err := row.Scan(
+		&t.ID,
+		&t.CreatedAt,
+		&t.RevokedAt,
+		&t.UserID,
+		&t.Name,
+		&scopes,
+		&t.ExpiresAt,
+	)
+	t.Scopes = splitList(scopes)
+	return t, err
+}
+
+func (c Client) CreateAPIToken(params CreateAPITokenParams) (APIToken, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO api_tokens (
+		id,
+		created_at,
+		user_id,
+		name,
+		scopes,
+		expires_at
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+	_, err := c.db.ExecContext(c.context(), query, id, params.UserID, params.Name, joinList(params.Scopes), params.ExpiresAt)
+	if err != nil {
+		return APIToken{}, err
+	}
+	return c.GetAPIToken(id)
+}
+
+// GetAPIToken returns the token, or a zero APIToken if there is none.
+func (c Client) GetAPIToken(id uuid.UUID) (APIToken, error) {
+	query := `
+	SELECT` + apiTokenColumns + `
+	FROM api_tokens
+	WHERE id = ?
+	`
+	t, err := scanAPIToken(c.db.QueryRowContext(c.context(), query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIToken{}, nil
+	}
+	return t, err
+}
+
+// GetAPITokens lists the user's tokens that haven't expired, newest first.
+func (c Client) GetAPITokens(userID uuid.UUID) ([]APIToken, error) {
+	query := `
+	SELECT` + apiTokenColumns + `
+	FROM api_tokens
+	WHERE user_id = ? AND expires_at > ?
+	ORDER BY created_at DESC
+	`
+	rows, err := c.db.QueryContext(c.context(), query, userID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []APIToken{}
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// RevokeAPIToken revokes one of the user's tokens. It returns false when the
+// user has no such unrevoked token.
+func (c Client) RevokeAPIToken(userID, id uuid.UUID) (bool, error) {
+	query := `
+	UPDATE api_tokens
+	SET revoked_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND user_id = ? AND revoked_at IS NULL
+	`
+	result, err := c.db.ExecContext(c.context(), query, id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
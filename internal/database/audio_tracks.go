@@ -0,0 +1,132 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// AudioTrack is an alternate audio track of a video, a dub or a commentary,
+// in one language. The video's own audio isn't one.
+type AudioTrack struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	VideoID   uuid.UUID `json:"video_id"`
+	// Language is a BCP 47 tag like "en" or "pt-BR"
+	Language string `json:"language"`
+	Label    string `json:"label"`
+	S3Key    string `json:"-"`
+}
+
+const audioTrackColumns = `
+		id,
+		created_at,
+		video_id,
+		language,
+		label,
+		s3_key
+`
+
+func scanAudioTrack(row interface{ Scan(...any) error }) (AudioTrack, error) {
+	var t AudioTrack
+	err := row.Scan(
+		&t.ID,
+		&t.CreatedAt,
+		&t.VideoID,
+		&t.Language,
+		&t.Label,
+		&t.S3Key,
+	)
+	return t, err
+}
+
+// PutAudioTrack adds the video's track in the language or replaces it. It
+// returns the key of the replaced track's file, if any.
+func (c Client) PutAudioTrack(videoID uuid.UUID, language, label, s3Key string) (AudioTrack, *string, error) {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return AudioTrack{}, nil, err
+	}
+	defer tx.Rollback()
+
+	var previous *string
+	err = tx.QueryRowContext(c.context(), "SELECT s3_key FROM audio_tracks WHERE video_id = ? AND language = ?", videoID, language).Scan(&previous)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return AudioTrack{}, nil, err
+	}
+
+	query := `
+	INSERT INTO audio_tracks (
+		id,
+		created_at,
+		video_id,
+		language,
+		label,
+		s3_key
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	ON CONFLICT (video_id, language) DO UPDATE SET
+		created_at = CURRENT_TIMESTAMP,
+		label = excluded.label,
+		s3_key = excluded.s3_key
+	`
+	_, err = tx.ExecContext(c.context(), query, uuid.New(), videoID, language, label, s3Key)
+	if err != nil {
+		return AudioTrack{}, nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return AudioTrack{}, nil, err
+	}
+
+	track, err := c.GetAudioTrack(videoID, language)
+	return track, previous, err
+}
+
+func (c Client) GetAudioTrack(videoID uuid.UUID, language string) (AudioTrack, error) {
+	query := `
+	SELECT` + audioTrackColumns + `
+	FROM audio_tracks
+	WHERE video_id = ? AND language = ?
+	`
+
+	t, err := scanAudioTrack(c.db.QueryRowContext(c.context(), query, videoID, language))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return AudioTrack{}, nil
+		}
+		return AudioTrack{}, err
+	}
+	return t, nil
+}
+
+// GetAudioTracks returns the tracks of a video ordered by language.
+func (c Client) GetAudioTracks(videoID uuid.UUID) ([]AudioTrack, error) {
+	query := `
+	SELECT` + audioTrackColumns + `
+	FROM audio_tracks
+	WHERE video_id = ?
+	ORDER BY language ASC
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tracks := []AudioTrack{}
+	for rows.Next() {
+		t, err := scanAudioTrack(rows)
+		if err != nil {
+			return nil, err
+		}
+		tracks = append(tracks, t)
+	}
+	return tracks, rows.Err()
+}
+
+func (c Client) DeleteAudioTrack(id uuid.UUID) error {
+	_, err := c.db.ExecContext(c.context(), "DELETE FROM audio_tracks WHERE id = ?", id)
+	return err
+}
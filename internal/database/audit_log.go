@@ -0,0 +1,153 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// audit actions, part of the admin API once published
+const (
+	AuditActionSourceDownload = "video.source_download"
+	// a viewer was handed their watermarked playlist
+	AuditActionWatermarkedPlayback = "video.watermarked_playback"
+	AuditActionLoginFailed         = "user.login_failed"
+	// the account failed so often that logins are refused for a while
+	AuditActionLoginLocked = "user.login_locked"
+	// a recovery code stood in for the authenticator
+	AuditActionRecoveryCodeUsed = "user.recovery_code_used"
+	// signed in through their organization's identity provider
+	AuditActionSSOLogin = "user.sso_login"
+)
+
+// AuditLogEntry records a sensitive action. Entries outlive the videos they
+// mention, so VideoID may name one that's gone.
+type AuditLogEntry struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	CreateAuditLogEntryParams
+}
+
+type CreateAuditLogEntryParams struct {
+	// UserID is who performed the action
+	UserID    uuid.UUID  `json:"user_id"`
+	Action    string     `json:"action"`
+	VideoID   *uuid.UUID `json:"video_id"`
+	IPAddress string     `json:"ip_address"`
+	// Detail is free-form context, like the object that was accessed
+	Detail string `json:"detail"`
+}
+
+// AuditLogFilter narrows down the entries listed. Zero fields match every
+// entry.
+type AuditLogFilter struct {
+	UserID  *uuid.UUID
+	VideoID *uuid.UUID
+	Action  string
+}
+
+const auditLogColumns = `
+		id,
+		created_at,
+		user_id,
+		action,
+		video_id,
+		ip_address,
+		detail
+`
+
+func scanAuditLogEntry(row interface{ Scan(...any) error }) (AuditLogEntry, error) {
+	var e AuditLogEntry
+	err := row.Scan(
+		&e.ID,
+		&e.CreatedAt,
+		&e.UserID,
+		&e.Action,
+		&e.VideoID,
+		&e.IPAddress,
+		&e.Detail,
+	)
+	return e, err
+}
+
+func (c Client) CreateAuditLogEntry(params CreateAuditLogEntryParams) error {
+	query := `
+	INSERT INTO audit_log (
+		id,
+		created_at,
+		user_id,
+		action,
+		video_id,
+		ip_address,
+		detail
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.ExecContext(c.context(), query, uuid.New(), params.UserID, params.Action, params.VideoID, params.IPAddress, params.Detail)
+	return err
+}
+
+// GetAuditLogEntries returns up to limit entries matching filter, newest
+// first.
+func (c Client) GetAuditLogEntries(filter AuditLogFilter, limit int) ([]AuditLogEntry, error) {
+	query := `
+	SELECT` + auditLogColumns + `
+	FROM audit_log
+	WHERE (? IS NULL OR user_id = ?)
+		AND (? IS NULL OR video_id = ?)
+		AND (? = '' OR action = ?)
+	ORDER BY created_at DESC, rowid DESC
+	LIMIT ?
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query,
+		filter.UserID, filter.UserID,
+		filter.VideoID, filter.VideoID,
+		filter.Action, filter.Action,
+		limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditLogEntry{}
+	for rows.Next() {
+		e, err := scanAuditLogEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// GetAuditLogUserIDs returns every user with an entry matching filter.
+func (c Client) GetAuditLogUserIDs(filter AuditLogFilter) ([]uuid.UUID, error) {
+	query := `
+	SELECT DISTINCT user_id
+	FROM audit_log
+	WHERE (? IS NULL OR user_id = ?)
+		AND (? IS NULL OR video_id = ?)
+		AND (? = '' OR action = ?)
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query,
+		filter.UserID, filter.UserID,
+		filter.VideoID, filter.VideoID,
+		filter.Action, filter.Action,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	userIDs := []uuid.UUID{}
+	for rows.Next() {
+		var userID uuid.UUID
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		userIDs = append(userIDs, userID)
+	}
+	return userIDs, rows.Err()
+}
@@ -0,0 +1,77 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+type Plan string
+
+const (
+	PlanFree Plan = "free"
+	PlanPro  Plan = "pro"
+)
+
+type UserBilling struct {
+	UserID uuid.UUID `json:"user_id"`
+	Plan   Plan      `json:"plan"`
+	// Stripe IDs are set once the user has checked out
+	StripeCustomerID     *string `json:"-"`
+	StripeSubscriptionID *string `json:"-"`
+}
+
+// GetUserBilling returns a zero UserBilling when the user doesn't exist.
+func (c Client) GetUserBilling(userID uuid.UUID) (UserBilling, error) {
+	query := `
+	SELECT id, plan, stripe_customer_id, stripe_subscription_id
+	FROM users
+	WHERE id = ?
+	`
+	var billing UserBilling
+	err := c.db.QueryRowContext(c.context(), query, userID).Scan(
+		&billing.UserID,
+		&billing.Plan,
+		&billing.StripeCustomerID,
+		&billing.StripeSubscriptionID,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UserBilling{}, nil
+		}
+		return UserBilling{}, err
+	}
+	return billing, nil
+}
+
+// StartSubscription moves the user to plan, paid for by the Stripe
+// subscription.
+func (c Client) StartSubscription(userID uuid.UUID, plan Plan, customerID, subscriptionID string) error {
+	query := `
+	UPDATE users
+	SET
+		plan = ?,
+		stripe_customer_id = ?,
+		stripe_subscription_id = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, plan, customerID, subscriptionID, userID)
+	return err
+}
+
+// EndSubscription puts whoever paid with the Stripe subscription back on the
+// free plan. The customer ID is kept for their next checkout.
+func (c Client) EndSubscription(subscriptionID string) error {
+	query := `
+	UPDATE users
+	SET
+		plan = ?,
+		stripe_subscription_id = NULL,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE stripe_subscription_id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, PlanFree, subscriptionID)
+	return err
+}
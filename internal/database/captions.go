@@ -0,0 +1,199 @@
+package database
+
+import (
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// CaptionCue is one cue of a video's captions in a language: text shown
+// from StartMS until EndMS into the video.
+type CaptionCue struct {
+	VideoID  uuid.UUID `json:"video_id"`
+	Language string    `json:"language"`
+	StartMS  int64     `json:"start_ms"`
+	EndMS    int64     `json:"end_ms"`
+	// Text is plain text, lines separated by \n
+	Text string `json:"text"`
+}
+
+// CaptionMatch is a video whose captions contain a searched phrase, with
+// the cues that do.
+type CaptionMatch struct {
+	VideoID uuid.UUID
+	Cues    []CaptionCue
+}
+
+const captionCueColumns = `
+		video_id,
+		language,
+		start_ms,
+		end_ms,
+		text
+`
+
+func scanCaptionCue(row interface{ Scan(...any) error }) (CaptionCue, error) {
+	var cue CaptionCue
+	err := row.Scan(
+		&cue.VideoID,
+		&cue.Language,
+		&cue.StartMS,
+		&cue.EndMS,
+		&cue.Text,
+	)
+	return cue, err
+}
+
+// PutCaptions replaces the video's captions in the language with the cues.
+func (c Client) PutCaptions(videoID uuid.UUID, language string, cues []CaptionCue) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(c.context(), "DELETE FROM caption_cues WHERE video_id = ? AND language = ?", videoID, language)
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.PrepareContext(c.context(), `
+	INSERT INTO caption_cues (
+		video_id,
+		language,
+		position,
+		start_ms,
+		end_ms,
+		text
+	) VALUES (?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for i, cue := range cues {
+		_, err = stmt.ExecContext(c.context(), videoID, language, i, cue.StartMS, cue.EndMS, cue.Text)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetCaptions returns the video's cues in the language in playback order,
+// none if it has no captions in it.
+func (c Client) GetCaptions(videoID uuid.UUID, language string) ([]CaptionCue, error) {
+	query := `
+	SELECT` + captionCueColumns + `
+	FROM caption_cues
+	WHERE video_id = ? AND language = ?
+	ORDER BY start_ms ASC, position ASC
+	`
+	return c.queryCaptionCues(query, videoID, language)
+}
+
+// GetCaptionLanguages returns the languages the video has captions in,
+// in alphabetical order.
+func (c Client) GetCaptionLanguages(videoID uuid.UUID) ([]string, error) {
+	rows, err := c.db.QueryContext(c.context(), "SELECT DISTINCT language FROM caption_cues WHERE video_id = ? ORDER BY language ASC", videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	languages := []string{}
+	for rows.Next() {
+		var language string
+		if err := rows.Scan(&language); err != nil {
+			return nil, err
+		}
+		languages = append(languages, language)
+	}
+	return languages, rows.Err()
+}
+
+// DeleteCaptions removes the video's captions in the language. It reports
+// false if there were none.
+func (c Client) DeleteCaptions(videoID uuid.UUID, language string) (bool, error) {
+	result, err := c.db.ExecContext(c.context(), "DELETE FROM caption_cues WHERE video_id = ? AND language = ?", videoID, language)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// SearchCaptions finds public videos whose captions contain the phrase,
+// ignoring ASCII case. Videos with the most matching cues come first, each
+// with at most cuesPerVideo of them in playback order.
+func (c Client) SearchCaptions(phrase string, limit, offset, cuesPerVideo int) ([]CaptionMatch, error) {
+	pattern := "%" + escapeLike(phrase) + "%"
+	query := `
+	SELECT caption_cues.video_id
+	FROM caption_cues
+	JOIN videos ON videos.id = caption_cues.video_id
+	WHERE caption_cues.text LIKE ? ESCAPE '\'
+		AND videos.deleted_at IS NULL
+		AND videos.visibility = ?
+	GROUP BY caption_cues.video_id
+	ORDER BY COUNT(*) DESC, MAX(videos.created_at) DESC
+	LIMIT ? OFFSET ?
+	`
+	rows, err := c.db.QueryContext(c.context(), query, pattern, VisibilityPublic, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	matches := make([]CaptionMatch, 0, len(ids))
+	for _, id := range ids {
+		query := `
+		SELECT` + captionCueColumns + `
+		FROM caption_cues
+		WHERE video_id = ? AND text LIKE ? ESCAPE '\'
+		ORDER BY start_ms ASC, language ASC
+		LIMIT ?
+		`
+		cues, err := c.queryCaptionCues(query, id, pattern, cuesPerVideo)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, CaptionMatch{VideoID: id, Cues: cues})
+	}
+	return matches, nil
+}
+
+func (c Client) queryCaptionCues(query string, args ...any) ([]CaptionCue, error) {
+	rows, err := c.db.QueryContext(c.context(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cues := []CaptionCue{}
+	for rows.Next() {
+		cue, err := scanCaptionCue(rows)
+		if err != nil {
+			return nil, err
+		}
+		cues = append(cues, cue)
+	}
+	return cues, rows.Err()
+}
+
+// escapeLike makes the wildcards of a LIKE pattern match literally, with
+// \ as the escape character.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
@@ -0,0 +1,71 @@
+package database
+
+import (
+	"github.com/google/uuid"
+)
+
+// Chapter marks where a named part of a video starts. Generated chapters
+// were segmented from its captions, the owner's edits are not.
+type Chapter struct {
+	StartMS   int64  `json:"start_ms"`
+	Title     string `json:"title"`
+	Generated bool   `json:"generated"`
+}
+
+// GetChapters returns the video's chapters in playback order.
+func (c Client) GetChapters(videoID uuid.UUID) ([]Chapter, error) {
+	query := `
+	SELECT start_ms, title, generated
+	FROM video_chapters
+	WHERE video_id = ?
+	ORDER BY start_ms ASC
+	`
+	rows, err := c.db.QueryContext(c.context(), query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	chapters := []Chapter{}
+	for rows.Next() {
+		var ch Chapter
+		if err := rows.Scan(&ch.StartMS, &ch.Title, &ch.Generated); err != nil {
+			return nil, err
+		}
+		chapters = append(chapters, ch)
+	}
+	return chapters, rows.Err()
+}
+
+// ReplaceChapters sets the video's chapters. Unless force is set, generated
+// chapters don't replace ones the owner edited, and it reports false.
+func (c Client) ReplaceChapters(videoID uuid.UUID, chapters []Chapter, force bool) (bool, error) {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	if !force {
+		var edited int
+		err = tx.QueryRowContext(c.context(), "SELECT COUNT(*) FROM video_chapters WHERE video_id = ? AND NOT generated", videoID).Scan(&edited)
+		if err != nil {
+			return false, err
+		}
+		if edited > 0 {
+			return false, nil
+		}
+	}
+
+	_, err = tx.ExecContext(c.context(), "DELETE FROM video_chapters WHERE video_id = ?", videoID)
+	if err != nil {
+		return false, err
+	}
+	for _, ch := range chapters {
+		_, err = tx.ExecContext(c.context(), "INSERT INTO video_chapters (video_id, start_ms, title, generated) VALUES (?, ?, ?, ?)", videoID, ch.StartMS, ch.Title, ch.Generated)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit()
+}
@@ -0,0 +1,110 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ContentIDMatch is a registered work a video's fingerprints matched.
+// Confidence is a percentage between 0 and 100, and the seconds are where
+// in the video the match is.
+type ContentIDMatch struct {
+	ReferenceID  string  `json:"reference_id"`
+	Title        string  `json:"title"`
+	Owner        string  `json:"owner"`
+	Media        string  `json:"media"`
+	Confidence   float64 `json:"confidence"`
+	StartSeconds float64 `json:"start_seconds"`
+	EndSeconds   float64 `json:"end_seconds"`
+}
+
+// ContentIDReport is the outcome of the last content ID check of a video.
+// Blocked records whether the check blocked it, a review may have released
+// it since.
+type ContentIDReport struct {
+	VideoID   uuid.UUID        `json:"video_id"`
+	CheckedAt time.Time        `json:"checked_at"`
+	Matches   []ContentIDMatch `json:"matches"`
+	Blocked   bool             `json:"blocked"`
+}
+
+// PutContentIDReport replaces the video's report with the result of a new
+// check.
+func (c Client) PutContentIDReport(videoID uuid.UUID, matches []ContentIDMatch, blocked bool) error {
+	if matches == nil {
+		matches = []ContentIDMatch{}
+	}
+	encoded, err := json.Marshal(matches)
+	if err != nil {
+		return err
+	}
+	query := `
+	INSERT INTO content_id_reports (video_id, checked_at, matches, blocked)
+	VALUES (?, CURRENT_TIMESTAMP, ?, ?)
+	ON CONFLICT (video_id) DO UPDATE SET
+		checked_at = CURRENT_TIMESTAMP,
+		matches = excluded.matches,
+		blocked = excluded.blocked
+	`
+	_, err = c.db.ExecContext(c.context(), query, videoID, string(encoded), blocked)
+	return err
+}
+
+// GetContentIDReport returns the video's report, or nil if it was never
+// checked.
+func (c Client) GetContentIDReport(videoID uuid.UUID) (*ContentIDReport, error) {
+	query := `
+	SELECT video_id, checked_at, matches, blocked
+	FROM content_id_reports
+	WHERE video_id = ?
+	`
+	var report ContentIDReport
+	var matches string
+	err := c.db.QueryRowContext(c.context(), query, videoID).Scan(&report.VideoID, &report.CheckedAt, &matches, &report.Blocked)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(matches), &report.Matches); err != nil {
+		return nil, err
+	}
+	return &report, nil
+}
+
+// GetMatchedContentIDReports returns the reports that found matches on
+// videos that aren't deleted, most recently checked first.
+func (c Client) GetMatchedContentIDReports(limit, offset int) ([]ContentIDReport, error) {
+	query := `
+	SELECT content_id_reports.video_id, content_id_reports.checked_at, content_id_reports.matches, content_id_reports.blocked
+	FROM content_id_reports
+	JOIN videos ON videos.id = content_id_reports.video_id
+	WHERE videos.deleted_at IS NULL AND content_id_reports.matches != '[]'
+	ORDER BY content_id_reports.checked_at DESC
+	LIMIT ? OFFSET ?
+	`
+	rows, err := c.db.QueryContext(c.context(), query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []ContentIDReport{}
+	for rows.Next() {
+		var report ContentIDReport
+		var matches string
+		if err := rows.Scan(&report.VideoID, &report.CheckedAt, &matches, &report.Blocked); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(matches), &report.Matches); err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
@@ -1,22 +1,48 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
+	"strings"
 
+	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
 )
 
 type Client struct {
-	db *sql.DB
+	db  *sql.DB
+	ctx context.Context
+	// onVideoChange is told about every video row a write changed
+	onVideoChange func(id uuid.UUID)
+	// testData marks the users and videos the client creates as test data
+	testData bool
+}
+
+// WithContext returns a client whose queries are cancelled along with ctx.
+func (c Client) WithContext(ctx context.Context) Client {
+	c.ctx = ctx
+	return c
+}
+
+func (c Client) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
 }
 
 func NewClient(pathToDB string) (Client, error) {
+	// background job workers write concurrently with request handlers, so
+	// wait for locks instead of failing immediately with SQLITE_BUSY
+	if !strings.Contains(pathToDB, "?") {
+		pathToDB += "?_busy_timeout=5000"
+	}
 	db, err := sql.Open("sqlite3", pathToDB)
 	if err != nil {
 		return Client{}, err
 	}
-	c := Client{db}
+	c := Client{db: db}
 	err = c.autoMigrate()
 	if err != nil {
 		return Client{}, err
@@ -35,7 +61,7 @@ func (c *Client) autoMigrate() error {
 		email TEXT UNIQUE NOT NULL
 	);
 	`
-	_, err := c.db.Exec(userTable)
+	_, err := c.db.ExecContext(c.context(), userTable)
 	if err != nil {
 		return err
 	}
@@ -50,7 +76,7 @@ func (c *Client) autoMigrate() error {
 		FOREIGN KEY(user_id) REFERENCES users(id)
 	);
 	`
-	_, err = c.db.Exec(refreshTokenTable)
+	_, err = c.db.ExecContext(c.context(), refreshTokenTable)
 	if err != nil {
 		return err
 	}
@@ -68,22 +94,1124 @@ func (c *Client) autoMigrate() error {
 		FOREIGN KEY(user_id) REFERENCES users(id)
 	);
 	`
-	_, err = c.db.Exec(videoTable)
+	_, err = c.db.ExecContext(c.context(), videoTable)
 	if err != nil {
 		return err
 	}
-	return nil
-}
 
-func (c Client) Reset() error {
-	if _, err := c.db.Exec("DELETE FROM refresh_tokens"); err != nil {
-		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
+	uploadSessionTable := `
+	CREATE TABLE IF NOT EXISTS upload_sessions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		s3_key TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		completed_at TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), uploadSessionTable)
+	if err != nil {
+		return err
 	}
-	if _, err := c.db.Exec("DELETE FROM users"); err != nil {
-		return fmt.Errorf("failed to reset table users: %w", err)
+
+	jobTable := `
+	CREATE TABLE IF NOT EXISTS jobs (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		type TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		payload TEXT NOT NULL,
+		video_id TEXT,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		error TEXT,
+		started_at TIMESTAMP,
+		finished_at TIMESTAMP
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), jobTable)
+	if err != nil {
+		return err
+	}
+
+	userExportTable := `
+	CREATE TABLE IF NOT EXISTS user_exports (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		user_id TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		s3_key TEXT,
+		error TEXT,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), userExportTable)
+	if err != nil {
+		return err
+	}
+
+	videoVersionTable := `
+	CREATE TABLE IF NOT EXISTS video_versions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		s3_key TEXT NOT NULL,
+		UNIQUE(video_id, version),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), videoVersionTable)
+	if err != nil {
+		return err
+	}
+
+	moderationLabelTable := `
+	CREATE TABLE IF NOT EXISTS moderation_labels (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		source TEXT NOT NULL,
+		name TEXT NOT NULL,
+		parent_name TEXT NOT NULL DEFAULT '',
+		confidence REAL NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), moderationLabelTable)
+	if err != nil {
+		return err
+	}
+
+	videoDRMTable := `
+	CREATE TABLE IF NOT EXISTS video_drm (
+		video_id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		key_id TEXT NOT NULL,
+		hls_key TEXT NOT NULL,
+		dash_key TEXT NOT NULL,
+		fairplay_key_uri TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), videoDRMTable)
+	if err != nil {
+		return err
+	}
+
+	hlsKeyTable := `
+	CREATE TABLE IF NOT EXISTS hls_keys (
+		video_id TEXT NOT NULL,
+		key_index INTEGER NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		key BLOB NOT NULL,
+		PRIMARY KEY(video_id, key_index),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), hlsKeyTable)
+	if err != nil {
+		return err
+	}
+
+	liveStreamTable := `
+	CREATE TABLE IF NOT EXISTS live_streams (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		user_id TEXT NOT NULL,
+		title TEXT NOT NULL,
+		status TEXT NOT NULL,
+		port INTEGER NOT NULL,
+		started_at TIMESTAMP,
+		ended_at TIMESTAMP,
+		video_id TEXT,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), liveStreamTable)
+	if err != nil {
+		return err
+	}
+
+	streamKeyTable := `
+	CREATE TABLE IF NOT EXISTS stream_keys (
+		user_id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		stream_key TEXT UNIQUE NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), streamKeyTable)
+	if err != nil {
+		return err
+	}
+
+	organizationTable := `
+	CREATE TABLE IF NOT EXISTS organizations (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		name TEXT NOT NULL,
+		custom_domain TEXT UNIQUE,
+		domain_verification_token TEXT,
+		domain_verified_at TIMESTAMP
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), organizationTable)
+	if err != nil {
+		return err
+	}
+
+	organizationMemberTable := `
+	CREATE TABLE IF NOT EXISTS organization_members (
+		user_id TEXT PRIMARY KEY,
+		organization_id TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		role TEXT NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id),
+		FOREIGN KEY(organization_id) REFERENCES organizations(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), organizationMemberTable)
+	if err != nil {
+		return err
+	}
+
+	notificationTable := `
+	CREATE TABLE IF NOT EXISTS notifications (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		read_at TIMESTAMP,
+		user_id TEXT NOT NULL,
+		video_id TEXT,
+		type TEXT NOT NULL,
+		title TEXT NOT NULL,
+		body TEXT NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), notificationTable)
+	if err != nil {
+		return err
+	}
+
+	thumbnailVariantTable := `
+	CREATE TABLE IF NOT EXISTS thumbnail_variants (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		thumbnail_url TEXT NOT NULL,
+		impressions INTEGER NOT NULL DEFAULT 0,
+		clicks INTEGER NOT NULL DEFAULT 0,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), thumbnailVariantTable)
+	if err != nil {
+		return err
+	}
+
+	thumbnailCandidateTable := `
+	CREATE TABLE IF NOT EXISTS thumbnail_candidates (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		thumbnail_url TEXT NOT NULL,
+		timestamp REAL NOT NULL,
+		scene_score REAL NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), thumbnailCandidateTable)
+	if err != nil {
+		return err
+	}
+
+	bandwidthUsageTable := `
+	CREATE TABLE IF NOT EXISTS bandwidth_usage (
+		user_id TEXT NOT NULL,
+		period TEXT NOT NULL,
+		bytes INTEGER NOT NULL DEFAULT 0,
+		PRIMARY KEY(user_id, period),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), bandwidthUsageTable)
+	if err != nil {
+		return err
+	}
+
+	usageReportTable := `
+	CREATE TABLE IF NOT EXISTS usage_reports (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		organization_id TEXT NOT NULL,
+		period TEXT NOT NULL,
+		videos INTEGER NOT NULL,
+		storage_bytes INTEGER NOT NULL,
+		bandwidth_bytes INTEGER NOT NULL,
+		UNIQUE(organization_id, period),
+		FOREIGN KEY(organization_id) REFERENCES organizations(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), usageReportTable)
+	if err != nil {
+		return err
+	}
+
+	reconciliationReportTable := `
+	CREATE TABLE IF NOT EXISTS reconciliation_reports (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		repair BOOLEAN NOT NULL DEFAULT FALSE,
+		status TEXT NOT NULL DEFAULT 'pending',
+		findings TEXT,
+		error TEXT,
+		completed_at TIMESTAMP
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), reconciliationReportTable)
+	if err != nil {
+		return err
+	}
+
+	auditLogTable := `
+	CREATE TABLE IF NOT EXISTS audit_log (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		user_id TEXT NOT NULL,
+		action TEXT NOT NULL,
+		video_id TEXT,
+		ip_address TEXT NOT NULL DEFAULT '',
+		detail TEXT NOT NULL DEFAULT ''
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), auditLogTable)
+	if err != nil {
+		return err
+	}
+
+	audioTrackTable := `
+	CREATE TABLE IF NOT EXISTS audio_tracks (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		language TEXT NOT NULL,
+		label TEXT NOT NULL DEFAULT '',
+		s3_key TEXT NOT NULL,
+		UNIQUE(video_id, language),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), audioTrackTable)
+	if err != nil {
+		return err
+	}
+
+	captionCueTable := `
+	CREATE TABLE IF NOT EXISTS caption_cues (
+		video_id TEXT NOT NULL,
+		language TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		start_ms INTEGER NOT NULL,
+		end_ms INTEGER NOT NULL,
+		text TEXT NOT NULL,
+		PRIMARY KEY(video_id, language, position),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), captionCueTable)
+	if err != nil {
+		return err
+	}
+
+	chapterTable := `
+	CREATE TABLE IF NOT EXISTS video_chapters (
+		video_id TEXT NOT NULL,
+		start_ms INTEGER NOT NULL,
+		title TEXT NOT NULL,
+		generated BOOLEAN NOT NULL DEFAULT FALSE,
+		PRIMARY KEY(video_id, start_ms),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), chapterTable)
+	if err != nil {
+		return err
+	}
+
+	perceptualHashTable := `
+	CREATE TABLE IF NOT EXISTS perceptual_hashes (
+		video_id TEXT NOT NULL,
+		position INTEGER NOT NULL,
+		hash INTEGER NOT NULL,
+		PRIMARY KEY(video_id, position),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), perceptualHashTable)
+	if err != nil {
+		return err
+	}
+
+	duplicateVideoTable := `
+	CREATE TABLE IF NOT EXISTS duplicate_videos (
+		video_id TEXT NOT NULL,
+		duplicate_of TEXT NOT NULL,
+		score REAL NOT NULL,
+		detected_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		PRIMARY KEY(video_id, duplicate_of),
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(duplicate_of) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), duplicateVideoTable)
+	if err != nil {
+		return err
+	}
+
+	videoExportTable := `
+	CREATE TABLE IF NOT EXISTS video_exports (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT 'pending',
+		options TEXT NOT NULL DEFAULT '{}',
+		s3_key TEXT,
+		error TEXT,
+		expires_at TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), videoExportTable)
+	if err != nil {
+		return err
+	}
+
+	contentIDReportTable := `
+	CREATE TABLE IF NOT EXISTS content_id_reports (
+		video_id TEXT PRIMARY KEY,
+		checked_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		matches TEXT NOT NULL DEFAULT '[]',
+		blocked BOOLEAN NOT NULL DEFAULT FALSE,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), contentIDReportTable)
+	if err != nil {
+		return err
+	}
+
+	playbackSessionTable := `
+	CREATE TABLE IF NOT EXISTS playback_sessions (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		user_id TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		device_hash TEXT NOT NULL,
+		last_seen_at TIMESTAMP NOT NULL,
+		ended_at TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), playbackSessionTable)
+	if err != nil {
+		return err
+	}
+
+	watchProgressTable := `
+	CREATE TABLE IF NOT EXISTS watch_progress (
+		user_id TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		position_seconds REAL NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		PRIMARY KEY(user_id, video_id),
+		FOREIGN KEY(user_id) REFERENCES users(id),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), watchProgressTable)
+	if err != nil {
+		return err
+	}
+
+	watchHistoryTable := `
+	CREATE TABLE IF NOT EXISTS watch_history (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		video_id TEXT NOT NULL,
+		watched_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(user_id) REFERENCES users(id),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), watchHistoryTable)
+	if err != nil {
+		return err
+	}
+
+	videoViewTable := `
+	CREATE TABLE IF NOT EXISTS video_views (
+		video_id TEXT NOT NULL,
+		day TEXT NOT NULL,
+		views INTEGER NOT NULL,
+		PRIMARY KEY(video_id, day),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), videoViewTable)
+	if err != nil {
+		return err
+	}
+
+	trendingVideoTable := `
+	CREATE TABLE IF NOT EXISTS trending_videos (
+		video_id TEXT PRIMARY KEY,
+		score REAL NOT NULL,
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), trendingVideoTable)
+	if err != nil {
+		return err
+	}
+
+	relatedVideoTable := `
+	CREATE TABLE IF NOT EXISTS related_videos (
+		video_id TEXT NOT NULL,
+		related_video_id TEXT NOT NULL,
+		score REAL NOT NULL,
+		PRIMARY KEY(video_id, related_video_id),
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(related_video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), relatedVideoTable)
+	if err != nil {
+		return err
+	}
+
+	videoTranslationTable := `
+	CREATE TABLE IF NOT EXISTS video_translations (
+		video_id TEXT NOT NULL,
+		language TEXT NOT NULL,
+		title TEXT NOT NULL,
+		description TEXT NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		PRIMARY KEY(video_id, language),
+		FOREIGN KEY(video_id) REFERENCES videos(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), videoTranslationTable)
+	if err != nil {
+		return err
+	}
+
+	uploadGrantTable := `
+	CREATE TABLE IF NOT EXISTS upload_grants (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL,
+		video_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		token_hash TEXT UNIQUE NOT NULL,
+		max_bytes INTEGER NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		used_at TIMESTAMP,
+		FOREIGN KEY(video_id) REFERENCES videos(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), uploadGrantTable)
+	if err != nil {
+		return err
+	}
+
+	recoveryCodeTable := `
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		user_id TEXT NOT NULL,
+		code_hash TEXT NOT NULL,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		used_at TIMESTAMP,
+		PRIMARY KEY(user_id, code_hash),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), recoveryCodeTable)
+	if err != nil {
+		return err
+	}
+
+	apiTokenTable := `
+	CREATE TABLE IF NOT EXISTS api_tokens (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		scopes TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		revoked_at TIMESTAMP,
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), apiTokenTable)
+	if err != nil {
+		return err
+	}
+
+	organizationSAMLTable := `
+	CREATE TABLE IF NOT EXISTS organization_saml (
+		organization_id TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		idp_entity_id TEXT NOT NULL,
+		idp_sso_url TEXT NOT NULL,
+		idp_certificate TEXT NOT NULL,
+		email_attribute TEXT NOT NULL DEFAULT '',
+		role_attribute TEXT NOT NULL DEFAULT '',
+		owner_values TEXT NOT NULL DEFAULT '',
+		FOREIGN KEY(organization_id) REFERENCES organizations(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), organizationSAMLTable)
+	if err != nil {
+		return err
+	}
+
+	samlRequestTable := `
+	CREATE TABLE IF NOT EXISTS saml_requests (
+		id TEXT PRIMARY KEY,
+		organization_id TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL,
+		FOREIGN KEY(organization_id) REFERENCES organizations(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), samlRequestTable)
+	if err != nil {
+		return err
+	}
+
+	organizationSCIMTable := `
+	CREATE TABLE IF NOT EXISTS organization_scim (
+		organization_id TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		token_hash TEXT UNIQUE NOT NULL,
+		owner_groups TEXT NOT NULL DEFAULT '',
+		video_successor_id TEXT,
+		FOREIGN KEY(organization_id) REFERENCES organizations(id),
+		FOREIGN KEY(video_successor_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), organizationSCIMTable)
+	if err != nil {
+		return err
+	}
+
+	scimGroupTable := `
+	CREATE TABLE IF NOT EXISTS scim_groups (
+		id TEXT PRIMARY KEY,
+		created_at TIMESTAMP NOT NULL,
+		updated_at TIMESTAMP NOT NULL,
+		organization_id TEXT NOT NULL,
+		display_name TEXT NOT NULL,
+		external_id TEXT,
+		FOREIGN KEY(organization_id) REFERENCES organizations(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), scimGroupTable)
+	if err != nil {
+		return err
+	}
+
+	scimGroupMemberTable := `
+	CREATE TABLE IF NOT EXISTS scim_group_members (
+		group_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		PRIMARY KEY(group_id, user_id),
+		FOREIGN KEY(group_id) REFERENCES scim_groups(id),
+		FOREIGN KEY(user_id) REFERENCES users(id)
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), scimGroupMemberTable)
+	if err != nil {
+		return err
+	}
+
+	leaseTable := `
+	CREATE TABLE IF NOT EXISTS leases (
+		name TEXT PRIMARY KEY,
+		holder TEXT NOT NULL,
+		expires_at TIMESTAMP NOT NULL
+	);
+	`
+	_, err = c.db.ExecContext(c.context(), leaseTable)
+	if err != nil {
+		return err
+	}
+
+	err = c.addColumnIfNotExists("users", "email_notifications", "BOOLEAN NOT NULL DEFAULT TRUE")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "deleted_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "visibility", "TEXT NOT NULL DEFAULT 'public'")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "publish_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "moderation_status", "TEXT NOT NULL DEFAULT 'none'")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "age_restricted", "BOOLEAN NOT NULL DEFAULT FALSE")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "blurred_thumbnail_url", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "hls_playlist_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "allowed_countries", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "blocked_countries", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("video_versions", "size_bytes", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "processing", "BOOLEAN NOT NULL DEFAULT FALSE")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "thumbnail_generated", "BOOLEAN NOT NULL DEFAULT FALSE")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("jobs", "failure_stage", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("jobs", "failure_exit_code", "INTEGER")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("jobs", "failure_stderr", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("jobs", "heartbeat_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("jobs", "priority", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("organizations", "job_priority", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("video_versions", "source_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	// versions before transcode profiles existed were all remuxed
+	err = c.addColumnIfNotExists("video_versions", "transcode_profile", "TEXT NOT NULL DEFAULT 'original'")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("video_versions", "checksum_sha256", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "checksum_sha256", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("organizations", "kms_key_arn", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "thumbnail_variant_id", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "plan", "TEXT NOT NULL DEFAULT 'free'")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "stripe_customer_id", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "stripe_subscription_id", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("upload_sessions", "claimed_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("upload_sessions", "transcode_profile", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("upload_sessions", "abandoned_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("video_versions", "confirmed_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("video_versions", "hdr_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	for _, column := range []string{"loudness_integrated", "loudness_true_peak", "loudness_range"} {
+		err = c.addColumnIfNotExists("video_versions", column, "REAL")
+		if err != nil {
+			return err
+		}
+	}
+	err = c.addColumnIfNotExists("video_versions", "video_bitrate_kbps", "INTEGER")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("organizations", "forensic_watermark", "BOOLEAN NOT NULL DEFAULT FALSE")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "hls_watermarked", "BOOLEAN NOT NULL DEFAULT FALSE")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("organizations", "intro_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("organizations", "outro_key", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("upload_sessions", "bumpers", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "watch_history_enabled", "BOOLEAN NOT NULL DEFAULT TRUE")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "tags", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("video_versions", "duration_seconds", "REAL")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "metadata", "TEXT NOT NULL DEFAULT '{}'")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "external_id", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "totp_secret", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "totp_enabled_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "totp_last_step", "INTEGER NOT NULL DEFAULT 0")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("organizations", "require_two_factor", "BOOLEAN NOT NULL DEFAULT FALSE")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("refresh_tokens", "id", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.backfillRefreshTokenIDs()
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("refresh_tokens", "user_agent", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("refresh_tokens", "ip_address", "TEXT NOT NULL DEFAULT ''")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("refresh_tokens", "last_used_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "sso_organization_id", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "scim_external_id", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "deactivated_at", "TIMESTAMP")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "aspect_ratio", "TEXT")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "orientation", "TEXT")
+	if err != nil {
+		return err
+	}
+	// videos from before the columns only had their aspect in the key
+	_, err = c.db.ExecContext(c.context(), `
+	UPDATE videos
+	SET
+		aspect_ratio = CASE
+			WHEN video_url LIKE '%/landscape/%' THEN '16:9'
+			WHEN video_url LIKE '%/portrait/%' THEN '9:16'
+			ELSE 'other'
+		END,
+		orientation = CASE
+			WHEN video_url LIKE '%/landscape/%' THEN 'landscape'
+			WHEN video_url LIKE '%/portrait/%' THEN 'portrait'
+		END
+	WHERE aspect_ratio IS NULL AND video_url IS NOT NULL
+	`)
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "copyright_blocked", "BOOLEAN NOT NULL DEFAULT FALSE")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("videos", "test_data", "BOOLEAN NOT NULL DEFAULT FALSE")
+	if err != nil {
+		return err
+	}
+	err = c.addColumnIfNotExists("users", "test_data", "BOOLEAN NOT NULL DEFAULT FALSE")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// addColumnIfNotExists lets autoMigrate extend tables of databases that were
+// created before the column existed.
+func (c *Client) addColumnIfNotExists(table, column, definition string) error {
+	rows, err := c.db.QueryContext(c.context(), fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid       int
+			name      string
+			colType   string
+			notNull   bool
+			dfltValue sql.NullString
+			pk        int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &dfltValue, &pk); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	_, err = c.db.ExecContext(c.context(), fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
+// Snapshot writes a consistent copy of the database to a new file at path
+// while it stays in use.
+func (c Client) Snapshot(path string) error {
+	_, err := c.db.ExecContext(c.context(), "VACUUM INTO ?", path)
+	return err
+}
+
+// Close closes the database, for tools that are done with it.
+func (c Client) Close() error {
+	return c.db.Close()
+}
+
+func (c Client) Reset() error {
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM notifications"); err != nil {
+		return fmt.Errorf("failed to reset table notifications: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM organization_members"); err != nil {
+		return fmt.Errorf("failed to reset table organization_members: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM reconciliation_reports"); err != nil {
+		return fmt.Errorf("failed to reset table reconciliation_reports: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM audit_log"); err != nil {
+		return fmt.Errorf("failed to reset table audit_log: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM usage_reports"); err != nil {
+		return fmt.Errorf("failed to reset table usage_reports: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM bandwidth_usage"); err != nil {
+		return fmt.Errorf("failed to reset table bandwidth_usage: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM scim_group_members"); err != nil {
+		return fmt.Errorf("failed to reset table scim_group_members: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM scim_groups"); err != nil {
+		return fmt.Errorf("failed to reset table scim_groups: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM organization_scim"); err != nil {
+		return fmt.Errorf("failed to reset table organization_scim: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM saml_requests"); err != nil {
+		return fmt.Errorf("failed to reset table saml_requests: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM organization_saml"); err != nil {
+		return fmt.Errorf("failed to reset table organization_saml: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM organizations"); err != nil {
+		return fmt.Errorf("failed to reset table organizations: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM live_streams"); err != nil {
+		return fmt.Errorf("failed to reset table live_streams: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM stream_keys"); err != nil {
+		return fmt.Errorf("failed to reset table stream_keys: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM hls_keys"); err != nil {
+		return fmt.Errorf("failed to reset table hls_keys: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM video_drm"); err != nil {
+		return fmt.Errorf("failed to reset table video_drm: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM moderation_labels"); err != nil {
+		return fmt.Errorf("failed to reset table moderation_labels: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM api_tokens"); err != nil {
+		return fmt.Errorf("failed to reset table api_tokens: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM recovery_codes"); err != nil {
+		return fmt.Errorf("failed to reset table recovery_codes: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM upload_grants"); err != nil {
+		return fmt.Errorf("failed to reset table upload_grants: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM video_translations"); err != nil {
+		return fmt.Errorf("failed to reset table video_translations: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM related_videos"); err != nil {
+		return fmt.Errorf("failed to reset table related_videos: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM trending_videos"); err != nil {
+		return fmt.Errorf("failed to reset table trending_videos: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM video_views"); err != nil {
+		return fmt.Errorf("failed to reset table video_views: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM watch_history"); err != nil {
+		return fmt.Errorf("failed to reset table watch_history: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM watch_progress"); err != nil {
+		return fmt.Errorf("failed to reset table watch_progress: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM playback_sessions"); err != nil {
+		return fmt.Errorf("failed to reset table playback_sessions: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM audio_tracks"); err != nil {
+		return fmt.Errorf("failed to reset table audio_tracks: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM caption_cues"); err != nil {
+		return fmt.Errorf("failed to reset table caption_cues: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM video_chapters"); err != nil {
+		return fmt.Errorf("failed to reset table video_chapters: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM perceptual_hashes"); err != nil {
+		return fmt.Errorf("failed to reset table perceptual_hashes: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM duplicate_videos"); err != nil {
+		return fmt.Errorf("failed to reset table duplicate_videos: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM content_id_reports"); err != nil {
+		return fmt.Errorf("failed to reset table content_id_reports: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM video_exports"); err != nil {
+		return fmt.Errorf("failed to reset table video_exports: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM thumbnail_variants"); err != nil {
+		return fmt.Errorf("failed to reset table thumbnail_variants: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM thumbnail_candidates"); err != nil {
+		return fmt.Errorf("failed to reset table thumbnail_candidates: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM video_versions"); err != nil {
+		return fmt.Errorf("failed to reset table video_versions: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM user_exports"); err != nil {
+		return fmt.Errorf("failed to reset table user_exports: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM jobs"); err != nil {
+		return fmt.Errorf("failed to reset table jobs: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM upload_sessions"); err != nil {
+		return fmt.Errorf("failed to reset table upload_sessions: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM refresh_tokens"); err != nil {
+		return fmt.Errorf("failed to reset table refresh_tokens: %w", err)
+	}
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM users"); err != nil {
+		return fmt.Errorf("failed to reset table users: %w", err)
+	}
+	changed, err := c.changingVideos("SELECT id FROM videos")
+	if err != nil {
+		return err
 	}
-	if _, err := c.db.Exec("DELETE FROM videos"); err != nil {
+	if _, err := c.db.ExecContext(c.context(), "DELETE FROM videos"); err != nil {
 		return fmt.Errorf("failed to reset table videos: %w", err)
 	}
+	c.videosChanged(changed)
 	return nil
 }
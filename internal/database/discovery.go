@@ -0,0 +1,148 @@
+package database
+
+import (
+	"github.com/google/uuid"
+)
+
+// VideoViewDayLayout is the format of the day video views are counted in.
+const VideoViewDayLayout = "2006-01-02"
+
+// VideoViews is how often a video was played on one day.
+type VideoViews struct {
+	VideoID uuid.UUID
+	Day     string
+	Views   int
+}
+
+// ScoredVideo is a video ranked by a precomputed score, higher first.
+type ScoredVideo struct {
+	VideoID uuid.UUID
+	Score   float64
+}
+
+// RecordVideoView counts a play of the video on day.
+func (c Client) RecordVideoView(videoID uuid.UUID, day string) error {
+	query := `
+	INSERT INTO video_views (video_id, day, views)
+	VALUES (?, ?, 1)
+	ON CONFLICT(video_id, day) DO UPDATE SET
+		views = views + 1
+	`
+	_, err := c.db.ExecContext(c.context(), query, videoID, day)
+	return err
+}
+
+// GetVideoViewsSince returns the daily views of all videos from day on.
+func (c Client) GetVideoViewsSince(day string) ([]VideoViews, error) {
+	rows, err := c.db.QueryContext(c.context(), "SELECT video_id, day, views FROM video_views WHERE day >= ?", day)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	views := []VideoViews{}
+	for rows.Next() {
+		var v VideoViews
+		if err := rows.Scan(&v.VideoID, &v.Day, &v.Views); err != nil {
+			return nil, err
+		}
+		views = append(views, v)
+	}
+	return views, rows.Err()
+}
+
+// DeleteVideoViewsBefore drops the daily views before day and returns how
+// many rows were removed.
+func (c Client) DeleteVideoViewsBefore(day string) (int64, error) {
+	result, err := c.db.ExecContext(c.context(), "DELETE FROM video_views WHERE day < ?", day)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// ReplaceTrendingVideos swaps the trending list for videos.
+func (c Client) ReplaceTrendingVideos(videos []ScoredVideo) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(c.context(), "DELETE FROM trending_videos"); err != nil {
+		return err
+	}
+	for _, v := range videos {
+		_, err := tx.ExecContext(c.context(), "INSERT INTO trending_videos (video_id, score) VALUES (?, ?)", v.VideoID, v.Score)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetTrendingVideos returns up to limit trending videos, highest score
+// first.
+func (c Client) GetTrendingVideos(limit int) ([]ScoredVideo, error) {
+	query := `
+	SELECT video_id, score
+	FROM trending_videos
+	ORDER BY score DESC, video_id
+	LIMIT ?
+	`
+	return c.queryScoredVideos(query, limit)
+}
+
+// ReplaceRelatedVideos swaps the related videos of every video for related,
+// videos missing from it end up with none.
+func (c Client) ReplaceRelatedVideos(related map[uuid.UUID][]ScoredVideo) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(c.context(), "DELETE FROM related_videos"); err != nil {
+		return err
+	}
+	for videoID, videos := range related {
+		for _, v := range videos {
+			query := "INSERT INTO related_videos (video_id, related_video_id, score) VALUES (?, ?, ?)"
+			if _, err := tx.ExecContext(c.context(), query, videoID, v.VideoID, v.Score); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+// GetRelatedVideos returns up to limit videos related to the video, most
+// related first.
+func (c Client) GetRelatedVideos(videoID uuid.UUID, limit int) ([]ScoredVideo, error) {
+	query := `
+	SELECT related_video_id, score
+	FROM related_videos
+	WHERE video_id = ?
+	ORDER BY score DESC, related_video_id
+	LIMIT ?
+	`
+	return c.queryScoredVideos(query, videoID, limit)
+}
+
+func (c Client) queryScoredVideos(query string, args ...any) ([]ScoredVideo, error) {
+	rows, err := c.db.QueryContext(c.context(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	videos := []ScoredVideo{}
+	for rows.Next() {
+		var v ScoredVideo
+		if err := rows.Scan(&v.VideoID, &v.Score); err != nil {
+			return nil, err
+		}
+		videos = append(videos, v)
+	}
+	return videos, rows.Err()
+}
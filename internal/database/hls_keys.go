@@ -0,0 +1,78 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+// ReplaceHLSKeys stores the AES-128 keys of a freshly encrypted HLS rendition
+// and points the video at its playlist. Keys of earlier renditions are
+// dropped, which also invalidates their old segments. Watermarked renditions
+// share their keys between the A and B variants of each segment.
+func (c Client) ReplaceHLSKeys(videoID uuid.UUID, playlistKey string, watermarked bool, keys [][]byte) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(c.context(), "DELETE FROM hls_keys WHERE video_id = ?", videoID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO hls_keys (
+		video_id,
+		key_index,
+		created_at,
+		key
+	) VALUES (?, ?, CURRENT_TIMESTAMP, ?)
+	`
+	for i, key := range keys {
+		_, err = tx.ExecContext(c.context(), query, videoID, i, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	query = `
+	UPDATE videos
+	SET
+		hls_playlist_key = ?,
+		hls_watermarked = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err = tx.ExecContext(c.context(), query, playlistKey, watermarked, videoID)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	c.videoChanged(videoID)
+	return nil
+}
+
+// GetHLSKey returns nil when the key doesn't exist.
+func (c Client) GetHLSKey(videoID uuid.UUID, index int) ([]byte, error) {
+	query := `
+	SELECT key
+	FROM hls_keys
+	WHERE video_id = ? AND key_index = ?
+	`
+
+	var key []byte
+	err := c.db.QueryRowContext(c.context(), query, videoID, index).Scan(&key)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return key, nil
+}
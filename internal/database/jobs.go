@@ -0,0 +1,386 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type JobStatus string
+
+const (
+	JobStatusPending   JobStatus = "pending"
+	JobStatusRunning   JobStatus = "running"
+	JobStatusCompleted JobStatus = "completed"
+	JobStatusFailed    JobStatus = "failed"
+	// JobStatusDead is the dead-letter state of jobs that used up their
+	// attempts. They stay there until an admin retries or purges them.
+	JobStatusDead JobStatus = "dead"
+)
+
+type Job struct {
+	ID         uuid.UUID  `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	Status     JobStatus  `json:"status"`
+	Attempts   int        `json:"attempts"`
+	Error      *string    `json:"error"`
+	StartedAt  *time.Time `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	// set when the job failed, nil otherwise
+	FailureStage    *string `json:"failure_stage"`
+	FailureExitCode *int    `json:"failure_exit_code"`
+	FailureStderr   *string `json:"failure_stderr"`
+	CreateJobParams
+}
+
+// JobFailure describes why a job failed. ExitCode and Stderr are only known
+// when an external command failed.
+type JobFailure struct {
+	Error    string
+	Stage    string
+	ExitCode *int
+	Stderr   *string
+}
+
+type CreateJobParams struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload"`
+	VideoID *uuid.UUID      `json:"video_id"`
+	// higher priorities run first
+	Priority int `json:"priority"`
+}
+
+const jobColumns = `
+		id,
+		created_at,
+		updated_at,
+		type,
+		status,
+		payload,
+		video_id,
+		attempts,
+		error,
+		started_at,
+		finished_at,
+		failure_stage,
+		failure_exit_code,
+		failure_stderr,
+		priority
+`
+
+func scanJob(row interface{ Scan(...any) error }) (Job, error) {
+	var job Job
+	var payload string
+	err := row.Scan(
+		&job.ID,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.Type,
+		&job.Status,
+		&payload,
+		&job.VideoID,
+		&job.Attempts,
+		&job.Error,
+		&job.StartedAt,
+		&job.FinishedAt,
+		&job.FailureStage,
+		&job.FailureExitCode,
+		&job.FailureStderr,
+		&job.Priority,
+	)
+	if err != nil {
+		return Job{}, err
+	}
+	job.Payload = json.RawMessage(payload)
+	return job, nil
+}
+
+func (c Client) CreateJob(params CreateJobParams) (Job, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO jobs (
+		id,
+		created_at,
+		updated_at,
+		type,
+		status,
+		payload,
+		video_id,
+		priority
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.ExecContext(c.context(), query, id, params.Type, JobStatusPending, string(params.Payload), params.VideoID, params.Priority)
+	if err != nil {
+		return Job{}, err
+	}
+
+	return c.GetJob(id)
+}
+
+func (c Client) GetJob(id uuid.UUID) (Job, error) {
+	query := `SELECT ` + jobColumns + ` FROM jobs WHERE id = ?`
+
+	job, err := scanJob(c.db.QueryRowContext(c.context(), query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Job{}, nil
+		}
+		return Job{}, err
+	}
+	return job, nil
+}
+
+// NextJobID returns the most urgent job that's ready to run: pending jobs,
+// failed jobs once retryDelay passed since they failed, and running jobs
+// whose worker stopped sending heartbeats for longer than visibilityTimeout.
+// Jobs gain a point of priority for every agingInterval they wait, so low
+// priority jobs can't starve. It returns uuid.Nil when there is nothing to
+// do.
+func (c Client) NextJobID(retryDelay, visibilityTimeout, agingInterval time.Duration) (uuid.UUID, error) {
+	// finished_at and heartbeat_at are written with CURRENT_TIMESTAMP, so
+	// compare them to SQLite's clock in the same format
+	query := `
+	SELECT id FROM jobs
+	WHERE status = ?
+		OR (status = ? AND finished_at <= datetime('now', ?))
+		OR (status = ? AND (heartbeat_at IS NULL OR heartbeat_at <= datetime('now', ?)))
+	ORDER BY
+		priority + (julianday('now') - julianday(created_at)) * 86400 / ? DESC,
+		created_at
+	LIMIT 1
+	`
+	var id uuid.UUID
+	err := c.db.QueryRowContext(
+		c.context(),
+		query,
+		JobStatusPending,
+		JobStatusFailed,
+		secondsAgo(retryDelay),
+		JobStatusRunning,
+		secondsAgo(visibilityTimeout),
+		agingInterval.Seconds(),
+	).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return uuid.Nil, nil
+	}
+	return id, err
+}
+
+// ClaimJob marks the job as running for the calling worker. It reports false
+// when the job is done, dead, or running on a worker that's still alive, so
+// the same job delivered twice only runs once at a time.
+func (c Client) ClaimJob(id uuid.UUID, visibilityTimeout time.Duration) (bool, error) {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		attempts = attempts + 1,
+		started_at = CURRENT_TIMESTAMP,
+		heartbeat_at = CURRENT_TIMESTAMP,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND (
+		status IN (?, ?)
+		OR (status = ? AND (heartbeat_at IS NULL OR heartbeat_at <= datetime('now', ?)))
+	)
+	`
+	result, err := c.db.ExecContext(
+		c.context(),
+		query,
+		JobStatusRunning,
+		id,
+		JobStatusPending,
+		JobStatusFailed,
+		JobStatusRunning,
+		secondsAgo(visibilityTimeout),
+	)
+	if err != nil {
+		return false, err
+	}
+	claimed, err := result.RowsAffected()
+	return claimed == 1, err
+}
+
+// HeartbeatJob tells other workers that the job's worker is still alive.
+func (c Client) HeartbeatJob(id uuid.UUID) error {
+	query := `
+	UPDATE jobs
+	SET heartbeat_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND status = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, id, JobStatusRunning)
+	return err
+}
+
+func secondsAgo(d time.Duration) string {
+	return fmt.Sprintf("-%d seconds", int(d.Seconds()))
+}
+
+func (c Client) CompleteJob(id uuid.UUID) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		error = NULL,
+		failure_stage = NULL,
+		failure_exit_code = NULL,
+		failure_stderr = NULL,
+		finished_at = CURRENT_TIMESTAMP,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, JobStatusCompleted, id)
+	return err
+}
+
+// FailJob records the failure. Jobs that reached maxAttempts move to the
+// dead-letter state, others stay failed until they are retried.
+func (c Client) FailJob(id uuid.UUID, failure JobFailure, maxAttempts int) error {
+	query := `
+	UPDATE jobs
+	SET
+		status = CASE WHEN attempts >= ? THEN ? ELSE ? END,
+		error = ?,
+		failure_stage = ?,
+		failure_exit_code = ?,
+		failure_stderr = ?,
+		finished_at = CURRENT_TIMESTAMP,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(
+		c.context(),
+		query,
+		maxAttempts,
+		JobStatusDead,
+		JobStatusFailed,
+		failure.Error,
+		failure.Stage,
+		failure.ExitCode,
+		failure.Stderr,
+		id,
+	)
+	return err
+}
+
+// RetryJob puts a failed or dead job back into the queue with a fresh set of
+// attempts. It reports false when the job doesn't exist or hasn't failed.
+// The failure details are kept until the job runs again.
+func (c Client) RetryJob(id uuid.UUID) (bool, error) {
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		attempts = 0,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND status IN (?, ?)
+	`
+	result, err := c.db.ExecContext(c.context(), query, JobStatusPending, id, JobStatusFailed, JobStatusDead)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// RetryFailedJobs puts every failed job back into the queue and returns
+// their IDs.
+func (c Client) RetryFailedJobs() ([]uuid.UUID, error) {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(c.context(), "SELECT id FROM jobs WHERE status = ?", JobStatusFailed)
+	if err != nil {
+		return nil, err
+	}
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query := `
+	UPDATE jobs
+	SET
+		status = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE status = ?
+	`
+	_, err = tx.ExecContext(c.context(), query, JobStatusPending, JobStatusFailed)
+	if err != nil {
+		return nil, err
+	}
+	return ids, tx.Commit()
+}
+
+// GetJobsByStatus returns jobs in the given status, most recently updated
+// first.
+func (c Client) GetJobsByStatus(status JobStatus, limit int) ([]Job, error) {
+	query := `
+	SELECT` + jobColumns + `
+	FROM jobs
+	WHERE status = ?
+	ORDER BY updated_at DESC
+	LIMIT ?
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// DeleteJobsByStatus removes all jobs in the given status and returns how
+// many there were.
+func (c Client) DeleteJobsByStatus(status JobStatus) (int64, error) {
+	result, err := c.db.ExecContext(c.context(), "DELETE FROM jobs WHERE status = ?", status)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (c Client) CountJobsByStatus() (map[JobStatus]int, error) {
+	rows, err := c.db.QueryContext(c.context(), "SELECT status, COUNT(*) FROM jobs GROUP BY status")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	counts := map[JobStatus]int{}
+	for rows.Next() {
+		var status JobStatus
+		var count int
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, err
+		}
+		counts[status] = count
+	}
+	return counts, rows.Err()
+}
@@ -0,0 +1,38 @@
+package database
+
+import "time"
+
+// TryAcquireLease makes holder the holder of the named lease until expiresAt
+// when nobody holds it or the previous holder let it run out before now. It
+// reports whether holder got it.
+func (c Client) TryAcquireLease(name, holder string, expiresAt, now time.Time) (bool, error) {
+	query := `
+	INSERT INTO leases (name, holder, expires_at) VALUES (?, ?, ?)
+	ON CONFLICT(name) DO UPDATE SET
+		holder = excluded.holder,
+		expires_at = excluded.expires_at
+	WHERE leases.expires_at <= ?
+	`
+	result, err := c.db.ExecContext(c.context(), query, name, holder, expiresAt.UTC(), now.UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ExtendLease moves the expiry of a lease holder still holds, it reports
+// false when the lease went to someone else.
+func (c Client) ExtendLease(name, holder string, expiresAt time.Time) (bool, error) {
+	result, err := c.db.ExecContext(c.context(), "UPDATE leases SET expires_at = ? WHERE name = ? AND holder = ?", expiresAt.UTC(), name, holder)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (c Client) ReleaseLease(name, holder string) error {
+	_, err := c.db.ExecContext(c.context(), "DELETE FROM leases WHERE name = ? AND holder = ?", name, holder)
+	return err
+}
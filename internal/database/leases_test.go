@@ -0,0 +1,68 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T) Client {
+	t.Helper()
+	c, err := NewClient(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("NewClient: %v", err)
+	}
+	t.Cleanup(func() { c.db.Close() })
+	return c
+}
+
+func TestLeaseTakenOverOnlyOnceExpired(t *testing.T) {
+	c := newTestClient(t)
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	expires := now.Add(time.Minute)
+
+	ok, err := c.TryAcquireLease("leader", "a", expires, now)
+	if err != nil || !ok {
+		t.Fatalf("first acquire = %v, %v, want true", ok, err)
+	}
+	ok, err = c.TryAcquireLease("leader", "b", now.Add(2*time.Minute), now.Add(30*time.Second))
+	if err != nil || ok {
+		t.Fatalf("acquire while held = %v, %v, want false", ok, err)
+	}
+
+	// a lease that ran out right now can be taken
+	ok, err = c.TryAcquireLease("leader", "b", now.Add(2*time.Minute), expires)
+	if err != nil || !ok {
+		t.Fatalf("acquire once expired = %v, %v, want true", ok, err)
+	}
+
+	held, err := c.ExtendLease("leader", "a", now.Add(3*time.Minute))
+	if err != nil || held {
+		t.Fatalf("previous holder extend = %v, %v, want false", held, err)
+	}
+	held, err = c.ExtendLease("leader", "b", now.Add(3*time.Minute))
+	if err != nil || !held {
+		t.Fatalf("new holder extend = %v, %v, want true", held, err)
+	}
+}
+
+func TestLeaseReleaseOnlyByHolder(t *testing.T) {
+	c := newTestClient(t)
+	now := time.Now()
+
+	if ok, err := c.TryAcquireLease("leader", "a", now.Add(time.Minute), now); err != nil || !ok {
+		t.Fatalf("acquire = %v, %v, want true", ok, err)
+	}
+	if err := c.ReleaseLease("leader", "b"); err != nil {
+		t.Fatalf("ReleaseLease: %v", err)
+	}
+	if ok, _ := c.TryAcquireLease("leader", "b", now.Add(time.Minute), now); ok {
+		t.Fatal("lease released by someone who didn't hold it")
+	}
+	if err := c.ReleaseLease("leader", "a"); err != nil {
+		t.Fatalf("ReleaseLease: %v", err)
+	}
+	if ok, err := c.TryAcquireLease("leader", "b", now.Add(time.Minute), now); err != nil || !ok {
+		t.Fatalf("acquire after release = %v, %v, want true", ok, err)
+	}
+}
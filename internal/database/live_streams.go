@@ -0,0 +1,222 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type LiveStreamStatus string
+
+const (
+	LiveStreamStatusWaiting LiveStreamStatus = "waiting"
+	LiveStreamStatusLive    LiveStreamStatus = "live"
+	LiveStreamStatusEnded   LiveStreamStatus = "ended"
+	LiveStreamStatusFailed  LiveStreamStatus = "failed"
+)
+
+type LiveStream struct {
+	ID        uuid.UUID        `json:"id"`
+	CreatedAt time.Time        `json:"created_at"`
+	UpdatedAt time.Time        `json:"updated_at"`
+	Status    LiveStreamStatus `json:"status"`
+	Port      int              `json:"port"`
+	StartedAt *time.Time       `json:"started_at"`
+	EndedAt   *time.Time       `json:"ended_at"`
+	// VideoID is the archived recording, set once the stream has ended
+	VideoID *uuid.UUID `json:"video_id"`
+	CreateLiveStreamParams
+}
+
+type CreateLiveStreamParams struct {
+	UserID uuid.UUID `json:"user_id"`
+	Title  string    `json:"title"`
+}
+
+const liveStreamColumns = `
+		id,
+		created_at,
+		updated_at,
+		user_id,
+		title,
+		status,
+		port,
+		started_at,
+		ended_at,
+		video_id
+`
+
+func scanLiveStream(row interface{ Scan(...any) error }) (LiveStream, error) {
+	var stream LiveStream
+	err := row.Scan(
+		&stream.ID,
+		&stream.CreatedAt,
+		&stream.UpdatedAt,
+		&stream.UserID,
+		&stream.Title,
+		&stream.Status,
+		&stream.Port,
+		&stream.StartedAt,
+		&stream.EndedAt,
+		&stream.VideoID,
+	)
+	return stream, err
+}
+
+func (c Client) CreateLiveStream(params CreateLiveStreamParams, port int) (LiveStream, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO live_streams (
+		id,
+		created_at,
+		updated_at,
+		user_id,
+		title,
+		status,
+		port
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+	_, err := c.db.ExecContext(c.context(), query, id, params.UserID, params.Title, LiveStreamStatusWaiting, port)
+	if err != nil {
+		return LiveStream{}, err
+	}
+
+	return c.GetLiveStream(id)
+}
+
+func (c Client) GetLiveStream(id uuid.UUID) (LiveStream, error) {
+	query := `
+	SELECT` + liveStreamColumns + `
+	FROM live_streams
+	WHERE id = ?
+	`
+
+	stream, err := scanLiveStream(c.db.QueryRowContext(c.context(), query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LiveStream{}, nil
+		}
+		return LiveStream{}, err
+	}
+	return stream, nil
+}
+
+// GetActiveLiveStreams returns streams that are waiting for or receiving a
+// broadcast.
+func (c Client) GetActiveLiveStreams() ([]LiveStream, error) {
+	query := `
+	SELECT` + liveStreamColumns + `
+	FROM live_streams
+	WHERE status IN (?, ?)
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query, LiveStreamStatusWaiting, LiveStreamStatusLive)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	streams := []LiveStream{}
+	for rows.Next() {
+		stream, err := scanLiveStream(rows)
+		if err != nil {
+			return nil, err
+		}
+		streams = append(streams, stream)
+	}
+	return streams, rows.Err()
+}
+
+func (c Client) MarkLiveStreamLive(id uuid.UUID) error {
+	query := `
+	UPDATE live_streams
+	SET
+		status = ?,
+		started_at = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND status = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, LiveStreamStatusLive, time.Now().UTC(), id, LiveStreamStatusWaiting)
+	return err
+}
+
+func (c Client) EndLiveStream(id uuid.UUID, status LiveStreamStatus) error {
+	query := `
+	UPDATE live_streams
+	SET
+		status = ?,
+		ended_at = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, status, time.Now().UTC(), id)
+	return err
+}
+
+func (c Client) SetLiveStreamVideo(id, videoID uuid.UUID) error {
+	query := `
+	UPDATE live_streams
+	SET
+		video_id = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, videoID, id)
+	return err
+}
+
+// GetStreamKey returns "" when the user hasn't generated a key yet.
+func (c Client) GetStreamKey(userID uuid.UUID) (string, error) {
+	query := `
+	SELECT stream_key
+	FROM stream_keys
+	WHERE user_id = ?
+	`
+
+	var key string
+	err := c.db.QueryRowContext(c.context(), query, userID).Scan(&key)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+	return key, nil
+}
+
+// SetStreamKey stores a new stream key for the user, replacing any old one.
+func (c Client) SetStreamKey(userID uuid.UUID, key string) error {
+	query := `
+	INSERT INTO stream_keys (
+		user_id,
+		created_at,
+		stream_key
+	) VALUES (?, CURRENT_TIMESTAMP, ?)
+	ON CONFLICT(user_id) DO UPDATE SET
+		created_at = CURRENT_TIMESTAMP,
+		stream_key = excluded.stream_key
+	`
+	_, err := c.db.ExecContext(c.context(), query, userID, key)
+	return err
+}
+
+// GetUserIDByStreamKey returns uuid.Nil when no user has the key.
+func (c Client) GetUserIDByStreamKey(key string) (uuid.UUID, error) {
+	query := `
+	SELECT user_id
+	FROM stream_keys
+	WHERE stream_key = ?
+	`
+
+	var userID uuid.UUID
+	err := c.db.QueryRowContext(c.context(), query, key).Scan(&userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return uuid.Nil, nil
+		}
+		return uuid.Nil, err
+	}
+	return userID, nil
+}
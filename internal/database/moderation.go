@@ -0,0 +1,120 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type ModerationStatus string
+
+const (
+	ModerationStatusNone        ModerationStatus = "none"
+	ModerationStatusClean       ModerationStatus = "clean"
+	ModerationStatusQuarantined ModerationStatus = "quarantined"
+	ModerationStatusApproved    ModerationStatus = "approved"
+	ModerationStatusRejected    ModerationStatus = "rejected"
+)
+
+type ModerationLabel struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	CreateModerationLabelParams
+}
+
+type CreateModerationLabelParams struct {
+	VideoID uuid.UUID `json:"video_id"`
+	// Source is what was scanned, e.g. "thumbnail" or "frame@12.5s"
+	Source     string  `json:"source"`
+	Name       string  `json:"name"`
+	ParentName string  `json:"parent_name"`
+	Confidence float64 `json:"confidence"`
+}
+
+// ReplaceModerationLabels swaps the stored labels of a video for the result
+// of a new scan.
+func (c Client) ReplaceModerationLabels(videoID uuid.UUID, labels []CreateModerationLabelParams) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(c.context(), "DELETE FROM moderation_labels WHERE video_id = ?", videoID)
+	if err != nil {
+		return err
+	}
+
+	query := `
+	INSERT INTO moderation_labels (
+		id,
+		created_at,
+		video_id,
+		source,
+		name,
+		parent_name,
+		confidence
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	`
+	for _, label := range labels {
+		_, err = tx.ExecContext(c.context(), query, uuid.New(), videoID, label.Source, label.Name, label.ParentName, label.Confidence)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+func (c Client) GetModerationLabels(videoID uuid.UUID) ([]ModerationLabel, error) {
+	query := `
+	SELECT id, created_at, video_id, source, name, parent_name, confidence
+	FROM moderation_labels
+	WHERE video_id = ?
+	ORDER BY confidence DESC
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	labels := []ModerationLabel{}
+	for rows.Next() {
+		var l ModerationLabel
+		if err := rows.Scan(&l.ID, &l.CreatedAt, &l.VideoID, &l.Source, &l.Name, &l.ParentName, &l.Confidence); err != nil {
+			return nil, err
+		}
+		labels = append(labels, l)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+func (c Client) SetVideoModerationStatus(id uuid.UUID, status ModerationStatus) error {
+	query := `
+	UPDATE videos
+	SET
+		moderation_status = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, status, id)
+	c.videoChanged(id)
+	return err
+}
+
+// GetVideosByModerationStatus returns videos in the given moderation state,
+// oldest first so reviewers work through the queue in order.
+func (c Client) GetVideosByModerationStatus(status ModerationStatus) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE moderation_status = ? AND deleted_at IS NULL
+	ORDER BY updated_at ASC
+	`
+	return c.queryVideos(query, status)
+}
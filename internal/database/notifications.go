@@ -0,0 +1,162 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type NotificationType string
+
+const (
+	NotificationProcessingFinished NotificationType = "processing_finished"
+	NotificationProcessingFailed   NotificationType = "processing_failed"
+	NotificationQuotaWarning       NotificationType = "quota_warning"
+	NotificationVideoPublished     NotificationType = "video_published"
+	NotificationVideoFileDeleted   NotificationType = "video_file_deleted"
+)
+
+type Notification struct {
+	ID        uuid.UUID  `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadAt    *time.Time `json:"read_at"`
+	CreateNotificationParams
+}
+
+type CreateNotificationParams struct {
+	UserID  uuid.UUID        `json:"user_id"`
+	VideoID *uuid.UUID       `json:"video_id"`
+	Type    NotificationType `json:"type"`
+	Title   string           `json:"title"`
+	Body    string           `json:"body"`
+}
+
+func (c Client) CreateNotification(params CreateNotificationParams) (Notification, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO notifications (
+		id,
+		created_at,
+		user_id,
+		video_id,
+		type,
+		title,
+		body
+	) VALUES (?, ?, ?, ?, ?, ?, ?)
+	`
+	createdAt := time.Now().UTC()
+	_, err := c.db.ExecContext(c.context(), query, id, createdAt, params.UserID, params.VideoID, params.Type, params.Title, params.Body)
+	if err != nil {
+		return Notification{}, err
+	}
+
+	return Notification{
+		ID:                       id,
+		CreatedAt:                createdAt,
+		CreateNotificationParams: params,
+	}, nil
+}
+
+// GetNotifications returns the user's most recent notifications, newest
+// first.
+func (c Client) GetNotifications(userID uuid.UUID, unreadOnly bool, limit int) ([]Notification, error) {
+	query := `
+	SELECT id, created_at, read_at, user_id, video_id, type, title, body
+	FROM notifications
+	WHERE user_id = ? AND (? = FALSE OR read_at IS NULL)
+	ORDER BY created_at DESC
+	LIMIT ?
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query, userID, unreadOnly, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		var n Notification
+		err := rows.Scan(&n.ID, &n.CreatedAt, &n.ReadAt, &n.UserID, &n.VideoID, &n.Type, &n.Title, &n.Body)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+func (c Client) CountUnreadNotifications(userID uuid.UUID) (int, error) {
+	query := `
+	SELECT COUNT(*)
+	FROM notifications
+	WHERE user_id = ? AND read_at IS NULL
+	`
+	var count int
+	err := c.db.QueryRowContext(c.context(), query, userID).Scan(&count)
+	return count, err
+}
+
+// MarkNotificationRead reports false when the user has no such notification.
+func (c Client) MarkNotificationRead(id, userID uuid.UUID) (bool, error) {
+	query := `
+	UPDATE notifications
+	SET read_at = COALESCE(read_at, ?)
+	WHERE id = ? AND user_id = ?
+	`
+	result, err := c.db.ExecContext(c.context(), query, time.Now().UTC(), id, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+func (c Client) MarkAllNotificationsRead(userID uuid.UUID) error {
+	query := `
+	UPDATE notifications
+	SET read_at = ?
+	WHERE user_id = ? AND read_at IS NULL
+	`
+	_, err := c.db.ExecContext(c.context(), query, time.Now().UTC(), userID)
+	return err
+}
+
+// GetEmailNotifications reports whether the user wants notifications
+// emailed to them, which they do unless they opted out.
+func (c Client) GetEmailNotifications(userID uuid.UUID) (bool, error) {
+	query := `
+	SELECT email_notifications
+	FROM users
+	WHERE id = ?
+	`
+	var enabled bool
+	err := c.db.QueryRowContext(c.context(), query, userID).Scan(&enabled)
+	return enabled, err
+}
+
+func (c Client) SetEmailNotifications(userID uuid.UUID, enabled bool) error {
+	query := `
+	UPDATE users
+	SET
+		email_notifications = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, enabled, userID)
+	return err
+}
+
+// GetUserStorageBytes adds up the stored video versions of the user's
+// videos, including trashed ones that haven't been purged yet.
+func (c Client) GetUserStorageBytes(userID uuid.UUID) (int64, error) {
+	query := `
+	SELECT COALESCE(SUM(vv.size_bytes), 0)
+	FROM video_versions vv
+	JOIN videos v ON v.id = vv.video_id
+	WHERE v.user_id = ?
+	`
+	var total int64
+	err := c.db.QueryRowContext(c.context(), query, userID).Scan(&total)
+	return total, err
+}
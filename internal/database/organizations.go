@@ -0,0 +1,363 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type OrganizationRole string
+
+const (
+	OrganizationRoleOwner  OrganizationRole = "owner"
+	OrganizationRoleMember OrganizationRole = "member"
+)
+
+type Organization struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Name      string    `json:"name"`
+	// CustomDomain is only used for playback URLs once DomainVerifiedAt is set
+	CustomDomain            *string    `json:"custom_domain"`
+	DomainVerificationToken *string    `json:"domain_verification_token,omitempty"`
+	DomainVerifiedAt        *time.Time `json:"domain_verified_at"`
+	// JobPriority is added to the priority of the members' background jobs
+	JobPriority int `json:"job_priority"`
+	// KMSKeyARN encrypts the members' objects instead of the default
+	// server-side encryption
+	KMSKeyARN *string `json:"kms_key_arn"`
+	// ForensicWatermark packages the members' videos with per-viewer
+	// watermarks, see Video.HLSWatermarked
+	ForensicWatermark bool `json:"forensic_watermark"`
+	// IntroKey and OutroKey are the bumper clips uploads can ask to be
+	// wrapped in
+	IntroKey *string `json:"intro_key"`
+	OutroKey *string `json:"outro_key"`
+	// RequireTwoFactor keeps owners without two-factor authentication from
+	// managing the organization
+	RequireTwoFactor bool `json:"require_two_factor"`
+}
+
+type BumperPosition string
+
+const (
+	BumperIntro BumperPosition = "intro"
+	BumperOutro BumperPosition = "outro"
+)
+
+type OrganizationMember struct {
+	UserID         uuid.UUID        `json:"user_id"`
+	OrganizationID uuid.UUID        `json:"organization_id"`
+	CreatedAt      time.Time        `json:"created_at"`
+	Role           OrganizationRole `json:"role"`
+}
+
+const organizationColumns = `
+		id,
+		created_at,
+		updated_at,
+		name,
+		custom_domain,
+		domain_verification_token,
+		domain_verified_at,
+		job_priority,
+		kms_key_arn,
+		forensic_watermark,
+		intro_key,
+		outro_key,
+		require_two_factor
+`
+
+func scanOrganization(row interface{ Scan(...any) error }) (Organization, error) {
+	var org Organization
+	err := row.Scan(
+		&org.ID,
+		&org.CreatedAt,
+		&org.UpdatedAt,
+		&org.Name,
+		&org.CustomDomain,
+		&org.DomainVerificationToken,
+		&org.DomainVerifiedAt,
+		&org.JobPriority,
+		&org.KMSKeyARN,
+		&org.ForensicWatermark,
+		&org.IntroKey,
+		&org.OutroKey,
+		&org.RequireTwoFactor,
+	)
+	return org, err
+}
+
+// CreateOrganization creates the organization with the user as its owner.
+func (c Client) CreateOrganization(name string, ownerID uuid.UUID) (Organization, error) {
+	id := uuid.New()
+
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return Organization{}, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(c.context(), `
+	INSERT INTO organizations (
+		id,
+		created_at,
+		updated_at,
+		name
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?)
+	`, id, name)
+	if err != nil {
+		return Organization{}, err
+	}
+
+	_, err = tx.ExecContext(c.context(), `
+	INSERT INTO organization_members (
+		user_id,
+		organization_id,
+		created_at,
+		role
+	) VALUES (?, ?, CURRENT_TIMESTAMP, ?)
+	`, ownerID, id, OrganizationRoleOwner)
+	if err != nil {
+		return Organization{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return Organization{}, err
+	}
+	return c.GetOrganization(id)
+}
+
+func (c Client) GetOrganization(id uuid.UUID) (Organization, error) {
+	query := `
+	SELECT` + organizationColumns + `
+	FROM organizations
+	WHERE id = ?
+	`
+
+	org, err := scanOrganization(c.db.QueryRowContext(c.context(), query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Organization{}, nil
+		}
+		return Organization{}, err
+	}
+	return org, nil
+}
+
+// GetOrganizationMember returns a zero member when the user doesn't belong
+// to an organization. Users belong to at most one.
+func (c Client) GetOrganizationMember(userID uuid.UUID) (OrganizationMember, error) {
+	query := `
+	SELECT user_id, organization_id, created_at, role
+	FROM organization_members
+	WHERE user_id = ?
+	`
+
+	var member OrganizationMember
+	err := c.db.QueryRowContext(c.context(), query, userID).Scan(&member.UserID, &member.OrganizationID, &member.CreatedAt, &member.Role)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return OrganizationMember{}, nil
+		}
+		return OrganizationMember{}, err
+	}
+	return member, nil
+}
+
+func (c Client) GetOrganizationMembers(orgID uuid.UUID) ([]OrganizationMember, error) {
+	query := `
+	SELECT user_id, organization_id, created_at, role
+	FROM organization_members
+	WHERE organization_id = ?
+	ORDER BY created_at
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []OrganizationMember{}
+	for rows.Next() {
+		var member OrganizationMember
+		err := rows.Scan(&member.UserID, &member.OrganizationID, &member.CreatedAt, &member.Role)
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+func (c Client) AddOrganizationMember(orgID, userID uuid.UUID, role OrganizationRole) error {
+	query := `
+	INSERT INTO organization_members (
+		user_id,
+		organization_id,
+		created_at,
+		role
+	) VALUES (?, ?, CURRENT_TIMESTAMP, ?)
+	`
+	_, err := c.db.ExecContext(c.context(), query, userID, orgID, role)
+	return err
+}
+
+// GetOrganizationByUser returns a zero organization when the user doesn't
+// belong to one.
+func (c Client) GetOrganizationByUser(userID uuid.UUID) (Organization, error) {
+	query := `
+	SELECT` + organizationColumns + `
+	FROM organizations
+	WHERE id = (SELECT organization_id FROM organization_members WHERE user_id = ?)
+	`
+
+	org, err := scanOrganization(c.db.QueryRowContext(c.context(), query, userID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Organization{}, nil
+		}
+		return Organization{}, err
+	}
+	return org, nil
+}
+
+func (c Client) GetOrganizationByDomain(domain string) (Organization, error) {
+	query := `
+	SELECT` + organizationColumns + `
+	FROM organizations
+	WHERE custom_domain = ?
+	`
+
+	org, err := scanOrganization(c.db.QueryRowContext(c.context(), query, domain))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Organization{}, nil
+		}
+		return Organization{}, err
+	}
+	return org, nil
+}
+
+// SetOrganizationDomain stores a new custom domain awaiting verification with
+// the given token. An empty domain removes the custom domain.
+func (c Client) SetOrganizationDomain(id uuid.UUID, domain, token string) error {
+	query := `
+	UPDATE organizations
+	SET
+		custom_domain = NULLIF(?, ''),
+		domain_verification_token = NULLIF(?, ''),
+		domain_verified_at = NULL,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, domain, token, id)
+	return err
+}
+
+func (c Client) MarkOrganizationDomainVerified(id uuid.UUID) error {
+	query := `
+	UPDATE organizations
+	SET
+		domain_verified_at = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, time.Now().UTC(), id)
+	return err
+}
+
+func (c Client) SetOrganizationJobPriority(id uuid.UUID, priority int) error {
+	query := `
+	UPDATE organizations
+	SET
+		job_priority = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, priority, id)
+	return err
+}
+
+// SetOrganizationKMSKey sets the organization's KMS key, nil removes it.
+func (c Client) SetOrganizationKMSKey(id uuid.UUID, keyARN *string) error {
+	query := `
+	UPDATE organizations
+	SET
+		kms_key_arn = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, keyARN, id)
+	return err
+}
+
+// SetOrganizationForensicWatermark turns per-viewer watermarking of the
+// members' videos on or off.
+func (c Client) SetOrganizationForensicWatermark(id uuid.UUID, enabled bool) error {
+	query := `
+	UPDATE organizations
+	SET
+		forensic_watermark = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, enabled, id)
+	return err
+}
+
+// SetOrganizationBumper sets the key of the organization's intro or outro,
+// nil removes it.
+func (c Client) SetOrganizationBumper(id uuid.UUID, position BumperPosition, key *string) error {
+	var column string
+	switch position {
+	case BumperIntro:
+		column = "intro_key"
+	case BumperOutro:
+		column = "outro_key"
+	default:
+		return fmt.Errorf("unknown bumper position %q", position)
+	}
+
+	query := `
+	UPDATE organizations
+	SET
+		` + column + ` = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, key, id)
+	return err
+}
+
+// SetOrganizationRequireTwoFactor turns the two-factor requirement for the
+// organization's owners on or off.
+func (c Client) SetOrganizationRequireTwoFactor(id uuid.UUID, required bool) error {
+	query := `
+	UPDATE organizations
+	SET
+		require_two_factor = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, required, id)
+	return err
+}
+
+// SetOrganizationMemberRole changes the role of a member of the
+// organization.
+func (c Client) SetOrganizationMemberRole(orgID, userID uuid.UUID, role OrganizationRole) error {
+	query := `
+	UPDATE organization_members
+	SET role = ?
+	WHERE organization_id = ? AND user_id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, role, orgID, userID)
+	return err
+}
@@ -0,0 +1,132 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// DuplicateVideo flags a video whose frames look like those of an older
+// one. Score is the share of its sampled frames with a close match.
+type DuplicateVideo struct {
+	VideoID     uuid.UUID `json:"video_id"`
+	DuplicateOf uuid.UUID `json:"duplicate_of"`
+	Score       float64   `json:"score"`
+	DetectedAt  time.Time `json:"detected_at"`
+}
+
+// ReplacePerceptualHashes sets the hashes of the video's sampled frames, in
+// playback order, and forgets the duplicates flagged with the old ones.
+func (c Client) ReplacePerceptualHashes(videoID uuid.UUID, hashes []uint64) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(c.context(), "DELETE FROM perceptual_hashes WHERE video_id = ?", videoID)
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(c.context(), "DELETE FROM duplicate_videos WHERE video_id = ? OR duplicate_of = ?", videoID, videoID)
+	if err != nil {
+		return err
+	}
+	for i, hash := range hashes {
+		// SQLite integers are signed, the bits are what matter
+		_, err = tx.ExecContext(c.context(), "INSERT INTO perceptual_hashes (video_id, position, hash) VALUES (?, ?, ?)", videoID, i, int64(hash))
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetPerceptualHashes returns the frame hashes of every video that isn't
+// deleted, by video.
+func (c Client) GetPerceptualHashes() (map[uuid.UUID][]uint64, error) {
+	query := `
+	SELECT perceptual_hashes.video_id, perceptual_hashes.hash
+	FROM perceptual_hashes
+	JOIN videos ON videos.id = perceptual_hashes.video_id
+	WHERE videos.deleted_at IS NULL
+	ORDER BY perceptual_hashes.video_id, perceptual_hashes.position
+	`
+	rows, err := c.db.QueryContext(c.context(), query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hashes := map[uuid.UUID][]uint64{}
+	for rows.Next() {
+		var videoID uuid.UUID
+		var hash int64
+		if err := rows.Scan(&videoID, &hash); err != nil {
+			return nil, err
+		}
+		hashes[videoID] = append(hashes[videoID], uint64(hash))
+	}
+	return hashes, rows.Err()
+}
+
+// GetVideoPerceptualHashes returns the hashes of the video's sampled frames
+// in playback order.
+func (c Client) GetVideoPerceptualHashes(videoID uuid.UUID) ([]uint64, error) {
+	rows, err := c.db.QueryContext(c.context(), "SELECT hash FROM perceptual_hashes WHERE video_id = ? ORDER BY position", videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var hashes []uint64
+	for rows.Next() {
+		var hash int64
+		if err := rows.Scan(&hash); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, uint64(hash))
+	}
+	return hashes, rows.Err()
+}
+
+func (c Client) CreateDuplicateVideo(videoID, duplicateOf uuid.UUID, score float64) error {
+	query := `
+	INSERT INTO duplicate_videos (video_id, duplicate_of, score, detected_at)
+	VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+	ON CONFLICT (video_id, duplicate_of) DO UPDATE SET
+		score = excluded.score,
+		detected_at = CURRENT_TIMESTAMP
+	`
+	_, err := c.db.ExecContext(c.context(), query, videoID, duplicateOf, score)
+	return err
+}
+
+// GetDuplicateVideos returns the flagged duplicates of videos that aren't
+// deleted, most recently detected first.
+func (c Client) GetDuplicateVideos(limit, offset int) ([]DuplicateVideo, error) {
+	query := `
+	SELECT duplicate_videos.video_id, duplicate_videos.duplicate_of, duplicate_videos.score, duplicate_videos.detected_at
+	FROM duplicate_videos
+	JOIN videos ON videos.id = duplicate_videos.video_id
+	JOIN videos AS originals ON originals.id = duplicate_videos.duplicate_of
+	WHERE videos.deleted_at IS NULL AND originals.deleted_at IS NULL
+	ORDER BY duplicate_videos.detected_at DESC, duplicate_videos.score DESC
+	LIMIT ? OFFSET ?
+	`
+	rows, err := c.db.QueryContext(c.context(), query, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	duplicates := []DuplicateVideo{}
+	for rows.Next() {
+		var d DuplicateVideo
+		if err := rows.Scan(&d.VideoID, &d.DuplicateOf, &d.Score, &d.DetectedAt); err != nil {
+			return nil, err
+		}
+		duplicates = append(duplicates, d)
+	}
+	return duplicates, rows.Err()
+}
@@ -0,0 +1,199 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// PlaybackSession is a user watching on one device. It counts as a stream
+// until it ends or isn't seen for a while.
+type PlaybackSession struct {
+	ID         uuid.UUID  `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UserID     uuid.UUID  `json:"user_id"`
+	VideoID    uuid.UUID  `json:"video_id"`
+	DeviceHash string     `json:"-"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	EndedAt    *time.Time `json:"ended_at"`
+}
+
+const playbackSessionColumns = `
+		id,
+		created_at,
+		user_id,
+		video_id,
+		device_hash,
+		last_seen_at,
+		ended_at
+`
+
+func scanPlaybackSession(row interface{ Scan(...any) error }) (PlaybackSession, error) {
+	var s PlaybackSession
+	err := row.Scan(
+		&s.ID,
+		&s.CreatedAt,
+		&s.UserID,
+		&s.VideoID,
+		&s.DeviceHash,
+		&s.LastSeenAt,
+		&s.EndedAt,
+	)
+	return s, err
+}
+
+// StartPlaybackSession opens a session for the user on the device, taking
+// over the device's session if it still has one. Sessions seen within idle
+// count as streams; when the user's other devices already have limit of
+// them it returns a zero session and how many there are. A limit of 0 is
+// unlimited.
+func (c Client) StartPlaybackSession(userID, videoID uuid.UUID, deviceHash string, idle time.Duration, limit int) (PlaybackSession, int, error) {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return PlaybackSession{}, 0, err
+	}
+	defer tx.Rollback()
+
+	active, err := c.countActivePlaybackDevices(tx, userID, deviceHash, idle)
+	if err != nil {
+		return PlaybackSession{}, 0, err
+	}
+	if limit > 0 && active >= limit {
+		return PlaybackSession{}, active, nil
+	}
+
+	// a device streams one video at a time
+	query := `
+	UPDATE playback_sessions
+	SET ended_at = CURRENT_TIMESTAMP
+	WHERE user_id = ? AND device_hash = ? AND ended_at IS NULL
+	`
+	_, err = tx.ExecContext(c.context(), query, userID, deviceHash)
+	if err != nil {
+		return PlaybackSession{}, 0, err
+	}
+
+	id := uuid.New()
+	query = `
+	INSERT INTO playback_sessions (
+		id,
+		created_at,
+		user_id,
+		video_id,
+		device_hash,
+		last_seen_at
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, CURRENT_TIMESTAMP)
+	`
+	_, err = tx.ExecContext(c.context(), query, id, userID, videoID, deviceHash)
+	if err != nil {
+		return PlaybackSession{}, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return PlaybackSession{}, 0, err
+	}
+
+	session, err := c.GetPlaybackSession(id)
+	return session, active + 1, err
+}
+
+func (c Client) GetPlaybackSession(id uuid.UUID) (PlaybackSession, error) {
+	query := `
+	SELECT` + playbackSessionColumns + `
+	FROM playback_sessions
+	WHERE id = ?
+	`
+
+	s, err := scanPlaybackSession(c.db.QueryRowContext(c.context(), query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return PlaybackSession{}, nil
+		}
+		return PlaybackSession{}, err
+	}
+	return s, nil
+}
+
+// TouchPlaybackSession marks the session as seen. A session that was idle
+// for longer than idle only resumes while the user's other devices have
+// fewer than limit streams, otherwise it's ended and false returned. Ended
+// sessions stay ended.
+func (c Client) TouchPlaybackSession(id uuid.UUID, idle time.Duration, limit int) (bool, error) {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	session, err := scanPlaybackSession(tx.QueryRowContext(c.context(), `SELECT`+playbackSessionColumns+`FROM playback_sessions WHERE id = ?`, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, err
+	}
+	if session.EndedAt != nil {
+		return false, nil
+	}
+
+	var stale bool
+	err = tx.QueryRowContext(c.context(), "SELECT last_seen_at <= datetime('now', ?) FROM playback_sessions WHERE id = ?", secondsAgo(idle), id).Scan(&stale)
+	if err != nil {
+		return false, err
+	}
+	if limit > 0 && stale {
+		active, err := c.countActivePlaybackDevices(tx, session.UserID, session.DeviceHash, idle)
+		if err != nil {
+			return false, err
+		}
+		if active >= limit {
+			_, err = tx.ExecContext(c.context(), "UPDATE playback_sessions SET ended_at = CURRENT_TIMESTAMP WHERE id = ?", id)
+			if err != nil {
+				return false, err
+			}
+			return false, tx.Commit()
+		}
+	}
+
+	_, err = tx.ExecContext(c.context(), "UPDATE playback_sessions SET last_seen_at = CURRENT_TIMESTAMP WHERE id = ?", id)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// countActivePlaybackDevices counts the devices other than deviceHash the
+// user streams on.
+func (c Client) countActivePlaybackDevices(tx *sql.Tx, userID uuid.UUID, deviceHash string, idle time.Duration) (int, error) {
+	// last_seen_at is written with CURRENT_TIMESTAMP, so compare it to
+	// SQLite's clock in the same format
+	query := `
+	SELECT COUNT(DISTINCT device_hash)
+	FROM playback_sessions
+	WHERE user_id = ? AND device_hash != ? AND ended_at IS NULL AND last_seen_at > datetime('now', ?)
+	`
+	var active int
+	err := tx.QueryRowContext(c.context(), query, userID, deviceHash, secondsAgo(idle)).Scan(&active)
+	return active, err
+}
+
+func (c Client) EndPlaybackSession(id uuid.UUID) error {
+	query := `
+	UPDATE playback_sessions
+	SET ended_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND ended_at IS NULL
+	`
+	_, err := c.db.ExecContext(c.context(), query, id)
+	return err
+}
+
+// DeletePlaybackSessionsOlderThan removes sessions last seen more than age
+// ago and returns how many there were.
+func (c Client) DeletePlaybackSessionsOlderThan(age time.Duration) (int64, error) {
+	result, err := c.db.ExecContext(c.context(), "DELETE FROM playback_sessions WHERE last_seen_at < datetime('now', ?)", secondsAgo(age))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
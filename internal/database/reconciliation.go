@@ -0,0 +1,144 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type ReconciliationStatus string
+
+const (
+	ReconciliationStatusPending   ReconciliationStatus = "pending"
+	ReconciliationStatusCompleted ReconciliationStatus = "completed"
+	ReconciliationStatusFailed    ReconciliationStatus = "failed"
+)
+
+type ReconciliationFindingKind string
+
+const (
+	// a video version whose object isn't in the bucket
+	FindingMissingObject ReconciliationFindingKind = "missing_object"
+	// an object in the bucket nothing in the database refers to
+	FindingMissingRecord ReconciliationFindingKind = "missing_record"
+	// a video version whose object has another size than recorded
+	FindingSizeMismatch ReconciliationFindingKind = "size_mismatch"
+)
+
+type ReconciliationFinding struct {
+	Kind      ReconciliationFindingKind `json:"kind"`
+	Key       string                    `json:"key"`
+	VideoID   *uuid.UUID                `json:"video_id,omitempty"`
+	VersionID *uuid.UUID                `json:"version_id,omitempty"`
+	// sizes are only set on size mismatches
+	RecordedBytes int64 `json:"recorded_bytes,omitempty"`
+	StoredBytes   int64 `json:"stored_bytes,omitempty"`
+	// Repair describes what was done about it, empty when nothing was
+	Repair string `json:"repair,omitempty"`
+}
+
+type ReconciliationReport struct {
+	ID          uuid.UUID               `json:"id"`
+	CreatedAt   time.Time               `json:"created_at"`
+	UpdatedAt   time.Time               `json:"updated_at"`
+	Repair      bool                    `json:"repair"`
+	Status      ReconciliationStatus    `json:"status"`
+	Findings    []ReconciliationFinding `json:"findings"`
+	Error       *string                 `json:"error"`
+	CompletedAt *time.Time              `json:"completed_at"`
+}
+
+func (c Client) CreateReconciliationReport(repair bool) (ReconciliationReport, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO reconciliation_reports (
+		id,
+		created_at,
+		updated_at,
+		repair,
+		status
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
+	`
+	_, err := c.db.ExecContext(c.context(), query, id, repair, ReconciliationStatusPending)
+	if err != nil {
+		return ReconciliationReport{}, err
+	}
+
+	return c.GetReconciliationReport(id)
+}
+
+func (c Client) GetReconciliationReport(id uuid.UUID) (ReconciliationReport, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		updated_at,
+		repair,
+		status,
+		findings,
+		error,
+		completed_at
+	FROM reconciliation_reports
+	WHERE id = ?
+	`
+	var report ReconciliationReport
+	var findings []byte
+	err := c.db.QueryRowContext(c.context(), query, id).Scan(
+		&report.ID,
+		&report.CreatedAt,
+		&report.UpdatedAt,
+		&report.Repair,
+		&report.Status,
+		&findings,
+		&report.Error,
+		&report.CompletedAt,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ReconciliationReport{}, nil
+		}
+		return ReconciliationReport{}, err
+	}
+
+	report.Findings = []ReconciliationFinding{}
+	if len(findings) > 0 {
+		if err := json.Unmarshal(findings, &report.Findings); err != nil {
+			return ReconciliationReport{}, err
+		}
+	}
+	return report, nil
+}
+
+func (c Client) CompleteReconciliationReport(id uuid.UUID, findings []ReconciliationFinding) error {
+	dat, err := json.Marshal(findings)
+	if err != nil {
+		return err
+	}
+	query := `
+	UPDATE reconciliation_reports
+	SET
+		status = ?,
+		findings = ?,
+		completed_at = CURRENT_TIMESTAMP,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err = c.db.ExecContext(c.context(), query, ReconciliationStatusCompleted, dat, id)
+	return err
+}
+
+func (c Client) FailReconciliationReport(id uuid.UUID, errMsg string) error {
+	query := `
+	UPDATE reconciliation_reports
+	SET
+		status = ?,
+		error = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, ReconciliationStatusFailed, errMsg, id)
+	return err
+}
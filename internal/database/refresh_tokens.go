@@ -8,29 +8,51 @@ import (
 )
 
 type RefreshToken struct {
+	// ID names the session in the API, the token itself is never shown
+	// again after login
+	ID uuid.UUID `json:"id"`
 	CreateRefreshTokenParams
-	CreatedAt time.Time  `json:"created_at"`
-	UpdatedAt time.Time  `json:"updated_at"`
-	RevokedAt *time.Time `json:"revoked_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	RevokedAt  *time.Time `json:"revoked_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
 }
 
 type CreateRefreshTokenParams struct {
 	Token     string    `json:"token"`
 	UserID    uuid.UUID `json:"user_id"`
 	ExpiresAt time.Time `json:"expires_at"`
+	// UserAgent and IPAddress describe the device that signed in, IPAddress
+	// is updated whenever the session refreshes
+	UserAgent string `json:"user_agent"`
+	IPAddress string `json:"ip_address"`
+}
+
+// Session is a refresh token as its owner sees it in their session list.
+type Session struct {
+	ID         uuid.UUID  `json:"id"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+	UserAgent  string     `json:"user_agent"`
+	IPAddress  string     `json:"ip_address"`
+	Current    bool       `json:"current"`
 }
 
 func (c Client) CreateRefreshToken(params CreateRefreshTokenParams) (RefreshToken, error) {
 	query := `
 		INSERT INTO refresh_tokens (
 			token,
+			id,
 			created_at,
 			updated_at,
 			user_id,
-			expires_at
-		) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
+			expires_at,
+			user_agent,
+			ip_address
+		) VALUES (?, ?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, params.Token, params.UserID.String(), params.ExpiresAt)
+	_, err := c.db.ExecContext(c.context(), query, params.Token, uuid.New(), params.UserID.String(), params.ExpiresAt, params.UserAgent, params.IPAddress)
 	if err != nil {
 		return RefreshToken{}, err
 	}
@@ -44,20 +66,20 @@ func (c Client) RevokeRefreshToken(token string) error {
 		SET revoked_at = CURRENT_TIMESTAMP
 		WHERE token = ?
 	`
-	_, err := c.db.Exec(query, token)
+	_, err := c.db.ExecContext(c.context(), query, token)
 	return err
 }
 
 func (c Client) GetRefreshToken(token string) (RefreshToken, error) {
 	query := `
-		SELECT token, created_at, updated_at, user_id, expires_at, revoked_at
+		SELECT token, id, created_at, updated_at, user_id, expires_at, revoked_at, user_agent, ip_address, last_used_at
 		FROM refresh_tokens
 		WHERE token = ?
 	`
 	var rt RefreshToken
 	var userID string
-	err := c.db.QueryRow(query, token).
-		Scan(&rt.Token, &rt.CreatedAt, &rt.UpdatedAt, &userID, &rt.ExpiresAt, &rt.RevokedAt)
+	err := c.db.QueryRowContext(c.context(), query, token).
+		Scan(&rt.Token, &rt.ID, &rt.CreatedAt, &rt.UpdatedAt, &userID, &rt.ExpiresAt, &rt.RevokedAt, &rt.UserAgent, &rt.IPAddress, &rt.LastUsedAt)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			return RefreshToken{}, nil
@@ -78,6 +100,119 @@ func (c Client) DeleteRefreshToken(token string) error {
 		DELETE FROM refresh_tokens
 		WHERE token = ?
 	`
-	_, err := c.db.Exec(query, token)
+	_, err := c.db.ExecContext(c.context(), query, token)
 	return err
 }
+
+// TouchRefreshToken records that the session was just used from ipAddress.
+func (c Client) TouchRefreshToken(token, ipAddress string) error {
+	query := `
+		UPDATE refresh_tokens
+		SET
+			last_used_at = CURRENT_TIMESTAMP,
+			ip_address = ?
+		WHERE token = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, ipAddress, token)
+	return err
+}
+
+// GetActiveSessions lists the user's sessions that are neither revoked nor
+// expired, most recently used first.
+func (c Client) GetActiveSessions(userID uuid.UUID) ([]Session, error) {
+	query := `
+		SELECT id, created_at, last_used_at, expires_at, user_agent, ip_address
+		FROM refresh_tokens
+		WHERE user_id = ? AND revoked_at IS NULL AND expires_at > ?
+		ORDER BY COALESCE(last_used_at, created_at) DESC
+	`
+	rows, err := c.db.QueryContext(c.context(), query, userID, time.Now().UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var s Session
+		if err := rows.Scan(&s.ID, &s.CreatedAt, &s.LastUsedAt, &s.ExpiresAt, &s.UserAgent, &s.IPAddress); err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeSession revokes one of the user's sessions. It returns false when the
+// user has no such active session.
+func (c Client) RevokeSession(userID, sessionID uuid.UUID) (bool, error) {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = CURRENT_TIMESTAMP
+		WHERE id = ? AND user_id = ? AND revoked_at IS NULL
+	`
+	result, err := c.db.ExecContext(c.context(), query, sessionID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// RevokeOtherSessions revokes every session of the user except keep and
+// returns how many were revoked.
+func (c Client) RevokeOtherSessions(userID, keep uuid.UUID) (int64, error) {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = CURRENT_TIMESTAMP
+		WHERE user_id = ? AND id != ? AND revoked_at IS NULL
+	`
+	result, err := c.db.ExecContext(c.context(), query, userID, keep)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// IsSessionRevoked reports whether the session was revoked, or no longer
+// exists because its user was deleted.
+func (c Client) IsSessionRevoked(sessionID uuid.UUID) (bool, error) {
+	var revokedAt *time.Time
+	err := c.db.QueryRowContext(c.context(), "SELECT revoked_at FROM refresh_tokens WHERE id = ?", sessionID).Scan(&revokedAt)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return revokedAt != nil, nil
+}
+
+// backfillRefreshTokenIDs gives sessions from before refresh tokens had IDs
+// one, so they can be listed and revoked too.
+func (c Client) backfillRefreshTokenIDs() error {
+	rows, err := c.db.QueryContext(c.context(), "SELECT token FROM refresh_tokens WHERE id IS NULL")
+	if err != nil {
+		return err
+	}
+	tokens := []string{}
+	for rows.Next() {
+		var token string
+		if err := rows.Scan(&token); err != nil {
+			rows.Close()
+			return err
+		}
+		tokens = append(tokens, token)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		if _, err := c.db.ExecContext(c.context(), "UPDATE refresh_tokens SET id = ? WHERE token = ?", uuid.New(), token); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SAMLConfig is an organization's identity provider and how its assertions
+// map to members.
+type SAMLConfig struct {
+	OrganizationID uuid.UUID `json:"organization_id"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	IDPEntityID    string    `json:"idp_entity_id"`
+	IDPSSOURL      string    `json:"idp_sso_url"`
+	// IDPCertificate is the PEM certificate the IdP signs with
+	IDPCertificate string `json:"idp_certificate"`
+	// EmailAttribute names the attribute holding the email, the NameID is
+	// used when it's empty
+	EmailAttribute string `json:"email_attribute"`
+	// RoleAttribute names the attribute deciding the member's role on every
+	// login; members with any of OwnerValues become owners. Roles aren't
+	// touched when it's empty.
+	RoleAttribute string   `json:"role_attribute"`
+	OwnerValues   []string `json:"owner_values"`
+}
+
+// GetSAMLConfig returns a zero config when the organization has none.
+func (c Client) GetSAMLConfig(orgID uuid.UUID) (SAMLConfig, error) {
+	query := `
+	SELECT
+		organization_id,
+		created_at,
+		updated_at,
+		idp_entity_id,
+		idp_sso_url,
+		idp_certificate,
+		email_attribute,
+		role_attribute,
+		owner_values
+	FROM organization_saml
+	WHERE organization_id = ?
+	`
+
+	var config SAMLConfig
+	var ownerValues string
+	err := c.db.QueryRowContext(c.context(), query, orgID).Scan(
+		&config.OrganizationID,
+		&config.CreatedAt,
+		&config.UpdatedAt,
+		&config.IDPEntityID,
+		&config.IDPSSOURL,
+		&config.IDPCertificate,
+		&config.EmailAttribute,
+		&config.RoleAttribute,
+		&ownerValues,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return SAMLConfig{}, nil
+		}
+		return SAMLConfig{}, err
+	}
+	config.OwnerValues = splitList(ownerValues)
+	return config, nil
+}
+
+// SetSAMLConfig creates or replaces the organization's config.
+func (c Client) SetSAMLConfig(config SAMLConfig) (SAMLConfig, error) {
+	query := `
+	INSERT INTO organization_saml (
+		organization_id,
+		created_at,
+		updated_at,
+		idp_entity_id,
+		idp_sso_url,
+		idp_certificate,
+		email_attribute,
+		role_attribute,
+		owner_values
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?)
+	ON CONFLICT(organization_id) DO UPDATE SET
+		updated_at = CURRENT_TIMESTAMP,
+		idp_entity_id = excluded.idp_entity_id,
+		idp_sso_url = excluded.idp_sso_url,
+		idp_certificate = excluded.idp_certificate,
+		email_attribute = excluded.email_attribute,
+		role_attribute = excluded.role_attribute,
+		owner_values = excluded.owner_values
+	`
+	_, err := c.db.ExecContext(c.context(), query,
+		config.OrganizationID,
+		config.IDPEntityID,
+		config.IDPSSOURL,
+		config.IDPCertificate,
+		config.EmailAttribute,
+		config.RoleAttribute,
+		joinList(config.OwnerValues),
+	)
+	if err != nil {
+		return SAMLConfig{}, err
+	}
+	return c.GetSAMLConfig(config.OrganizationID)
+}
+
+// DeleteSAMLConfig turns single sign-on off. Members it created keep their
+// accounts but can't sign in until it's set up again.
+func (c Client) DeleteSAMLConfig(orgID uuid.UUID) (bool, error) {
+	result, err := c.db.ExecContext(c.context(), "DELETE FROM organization_saml WHERE organization_id = ?", orgID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// CreateSAMLRequest remembers an AuthnRequest sent to the organization's
+// IdP, so only answers to it are accepted.
+func (c Client) CreateSAMLRequest(id string, orgID uuid.UUID, expiresAt time.Time) error {
+	query := `
+	INSERT INTO saml_requests (id, organization_id, expires_at)
+	VALUES (?, ?, ?)
+	`
+	_, err := c.db.ExecContext(c.context(), query, id, orgID, expiresAt)
+	return err
+}
+
+// UseSAMLRequest claims a pending request, reporting false when it's
+// unknown, expired or already answered.
+func (c Client) UseSAMLRequest(id string, orgID uuid.UUID) (bool, error) {
+	result, err := c.db.ExecContext(c.context(), "DELETE FROM saml_requests WHERE id = ? AND organization_id = ? AND expires_at > ?", id, orgID, time.Now().UTC())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+func (c Client) DeleteSAMLRequestsExpiredBefore(cutoff time.Time) (int64, error) {
+	result, err := c.db.ExecContext(c.context(), "DELETE FROM saml_requests WHERE expires_at < ?", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+type CreateSSOUserParams struct {
+	Email string
+	// Password is the hash of a random password, they can only sign in
+	// through the IdP
+	Password       string
+	OrganizationID uuid.UUID
+	Role           OrganizationRole
+	// ExternalID is the IdP's ID for users provisioned over SCIM
+	ExternalID string
+}
+
+// CreateSSOUser creates a user managed by the organization's IdP and makes
+// them a member.
+func (c Client) CreateSSOUser(params CreateSSOUserParams) (*User, error) {
+	id := uuid.New()
+
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	query := `
+	INSERT INTO users
+		(id, created_at, updated_at, email, password, sso_organization_id, scim_external_id, test_data)
+	VALUES
+		(?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, NULLIF(?, ''), ?)
+	`
+	if _, err := tx.ExecContext(c.context(), query, id.String(), params.Email, params.Password, params.OrganizationID, params.ExternalID, c.testData); err != nil {
+		return nil, err
+	}
+	query = `
+	INSERT INTO organization_members (
+		user_id,
+		organization_id,
+		created_at,
+		role
+	) VALUES (?, ?, CURRENT_TIMESTAMP, ?)
+	`
+	if _, err := tx.ExecContext(c.context(), query, id.String(), params.OrganizationID, params.Role); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return c.GetUser(id)
+}
+
+// GetSSOOrganizationID returns the organization whose IdP manages the user,
+// uuid.Nil for local accounts.
+func (c Client) GetSSOOrganizationID(userID uuid.UUID) (uuid.UUID, error) {
+	var orgID *uuid.UUID
+	err := c.db.QueryRowContext(c.context(), "SELECT sso_organization_id FROM users WHERE id = ?", userID.String()).Scan(&orgID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return uuid.Nil, nil
+		}
+		return uuid.Nil, err
+	}
+	if orgID == nil {
+		return uuid.Nil, nil
+	}
+	return *orgID, nil
+}
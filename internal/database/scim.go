@@ -0,0 +1,531 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SCIMConfig is how an organization's IdP provisions its members.
+type SCIMConfig struct {
+	OrganizationID uuid.UUID `json:"organization_id"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	// OwnerGroups are the display names of the groups whose members are
+	// owners, every other provisioned user is a plain member
+	OwnerGroups []string `json:"owner_groups"`
+	// VideoSuccessorID takes over the videos of deleted users, they keep
+	// them when it's nil
+	VideoSuccessorID *uuid.UUID `json:"video_successor_id"`
+}
+
+// ManagedUser is a user whose account the organization's IdP manages.
+type ManagedUser struct {
+	ID            uuid.UUID  `json:"id"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	Email         string     `json:"email"`
+	ExternalID    string     `json:"external_id"`
+	DeactivatedAt *time.Time `json:"deactivated_at"`
+}
+
+type SCIMGroup struct {
+	ID             uuid.UUID         `json:"id"`
+	CreatedAt      time.Time         `json:"created_at"`
+	UpdatedAt      time.Time         `json:"updated_at"`
+	OrganizationID uuid.UUID         `json:"organization_id"`
+	DisplayName    string            `json:"display_name"`
+	ExternalID     string            `json:"external_id"`
+	Members        []SCIMGroupMember `json:"members"`
+}
+
+type SCIMGroupMember struct {
+	UserID uuid.UUID `json:"user_id"`
+	Email  string    `json:"email"`
+}
+
+// SCIMFilter narrows down listed users or groups. Name matches the email of
+// users and the display name of groups. Zero fields match everything.
+type SCIMFilter struct {
+	Name       string
+	ExternalID string
+}
+
+const scimConfigColumns = `
+		organization_id,
+		created_at,
+		updated_at,
+		owner_groups,
+		video_successor_id
+`
+
+func scanSCIMConfig(row interface{ Scan(...any) error }) (SCIMConfig, error) {
+	var config SCIMConfig
+	var ownerGroups string
+	err := row.Scan(
+		&config.OrganizationID,
+		&config.CreatedAt,
+		&config.UpdatedAt,
+		&ownerGroups,
+		&config.VideoSuccessorID,
+	)
+	config.OwnerGroups = splitList(ownerGroups)
+	return config, err
+}
+
+// GetSCIMConfig returns a zero config when the organization has none.
+func (c Client) GetSCIMConfig(orgID uuid.UUID) (SCIMConfig, error) {
+	config, err := scanSCIMConfig(c.db.QueryRowContext(c.context(), `SELECT`+scimConfigColumns+`FROM organization_scim WHERE organization_id = ?`, orgID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return SCIMConfig{}, nil
+		}
+		return SCIMConfig{}, err
+	}
+	return config, nil
+}
+
+// GetSCIMConfigByTokenHash finds the organization a SCIM token belongs to,
+// a zero config when none does.
+func (c Client) GetSCIMConfigByTokenHash(tokenHash string) (SCIMConfig, error) {
+	config, err := scanSCIMConfig(c.db.QueryRowContext(c.context(), `SELECT`+scimConfigColumns+`FROM organization_scim WHERE token_hash = ?`, tokenHash))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return SCIMConfig{}, nil
+		}
+		return SCIMConfig{}, err
+	}
+	return config, nil
+}
+
+// SetSCIMToken turns provisioning on with a new token, or replaces the
+// token, which stops the old one from working.
+func (c Client) SetSCIMToken(orgID uuid.UUID, tokenHash string) error {
+	query := `
+	INSERT INTO organization_scim (
+		organization_id,
+		created_at,
+		updated_at,
+		token_hash
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?)
+	ON CONFLICT(organization_id) DO UPDATE SET
+		updated_at = CURRENT_TIMESTAMP,
+		token_hash = excluded.token_hash
+	`
+	_, err := c.db.ExecContext(c.context(), query, orgID, tokenHash)
+	return err
+}
+
+func (c Client) UpdateSCIMConfig(orgID uuid.UUID, ownerGroups []string, videoSuccessorID *uuid.UUID) error {
+	query := `
+	UPDATE organization_scim
+	SET
+		owner_groups = ?,
+		video_successor_id = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE organization_id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, joinList(ownerGroups), videoSuccessorID, orgID)
+	return err
+}
+
+// DeleteSCIMConfig turns provisioning off along with the groups it pushed.
+// Provisioned users keep their accounts and roles.
+func (c Client) DeleteSCIMConfig(orgID uuid.UUID) (bool, error) {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(c.context(), "DELETE FROM organization_scim WHERE organization_id = ?", orgID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	_, err = tx.ExecContext(c.context(), "DELETE FROM scim_group_members WHERE group_id IN (SELECT id FROM scim_groups WHERE organization_id = ?)", orgID)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.ExecContext(c.context(), "DELETE FROM scim_groups WHERE organization_id = ?", orgID)
+	if err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+const managedUserColumns = `
+		id,
+		created_at,
+		updated_at,
+		email,
+		COALESCE(scim_external_id, ''),
+		deactivated_at
+`
+
+func scanManagedUser(row interface{ Scan(...any) error }) (ManagedUser, error) {
+	var user ManagedUser
+	err := row.Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.UpdatedAt,
+		&user.Email,
+		&user.ExternalID,
+		&user.DeactivatedAt,
+	)
+	return user, err
+}
+
+// GetManagedUsers returns a page of the organization's provisioned users and
+// how many match the filter in total.
+func (c Client) GetManagedUsers(orgID uuid.UUID, filter SCIMFilter, offset, limit int) ([]ManagedUser, int, error) {
+	where := `
+	WHERE sso_organization_id = ?
+		AND (? = '' OR email = ?)
+		AND (? = '' OR scim_external_id = ?)
+	`
+	args := []any{orgID, filter.Name, filter.Name, filter.ExternalID, filter.ExternalID}
+
+	var total int
+	err := c.db.QueryRowContext(c.context(), `SELECT COUNT(*) FROM users`+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := c.db.QueryContext(c.context(), `SELECT`+managedUserColumns+`FROM users`+where+`ORDER BY created_at, id LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	users := []ManagedUser{}
+	for rows.Next() {
+		user, err := scanManagedUser(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		users = append(users, user)
+	}
+	return users, total, rows.Err()
+}
+
+// GetManagedUser returns a zero user when the organization doesn't manage
+// one with the ID.
+func (c Client) GetManagedUser(orgID, userID uuid.UUID) (ManagedUser, error) {
+	user, err := scanManagedUser(c.db.QueryRowContext(c.context(), `SELECT`+managedUserColumns+`FROM users WHERE id = ? AND sso_organization_id = ?`, userID.String(), orgID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ManagedUser{}, nil
+		}
+		return ManagedUser{}, err
+	}
+	return user, nil
+}
+
+func (c Client) UpdateManagedUser(userID uuid.UUID, email, externalID string) error {
+	query := `
+	UPDATE users
+	SET
+		email = ?,
+		scim_external_id = NULLIF(?, ''),
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, email, externalID, userID.String())
+	return err
+}
+
+// DeactivateUser keeps the user from signing in and ends their sessions and
+// API tokens. Their data stays, so they can be reactivated.
+func (c Client) DeactivateUser(userID uuid.UUID) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		"UPDATE users SET deactivated_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP WHERE id = ? AND deactivated_at IS NULL",
+		"UPDATE refresh_tokens SET revoked_at = CURRENT_TIMESTAMP, updated_at = CURRENT_TIMESTAMP WHERE user_id = ? AND revoked_at IS NULL",
+		"UPDATE api_tokens SET revoked_at = CURRENT_TIMESTAMP WHERE user_id = ? AND revoked_at IS NULL",
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(c.context(), statement, userID.String()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ReactivateUser lets a deactivated user sign in again. Revoked sessions and
+// tokens stay revoked.
+func (c Client) ReactivateUser(userID uuid.UUID) error {
+	_, err := c.db.ExecContext(c.context(), "UPDATE users SET deactivated_at = NULL, updated_at = CURRENT_TIMESTAMP WHERE id = ?", userID.String())
+	return err
+}
+
+// IsUserDeactivated reports whether the user was deactivated. Unknown users
+// aren't.
+func (c Client) IsUserDeactivated(userID uuid.UUID) (bool, error) {
+	var deactivated bool
+	err := c.db.QueryRowContext(c.context(), "SELECT deactivated_at IS NOT NULL FROM users WHERE id = ?", userID.String()).Scan(&deactivated)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return deactivated, err
+}
+
+// ReassignVideos hands all of a user's videos to another user. It returns
+// how many were moved.
+func (c Client) ReassignVideos(fromUserID, toUserID uuid.UUID) (int64, error) {
+	changed, err := c.changingVideos("SELECT id FROM videos WHERE user_id = ?", fromUserID.String())
+	if err != nil {
+		return 0, err
+	}
+	result, err := c.db.ExecContext(c.context(), "UPDATE videos SET user_id = ?, updated_at = CURRENT_TIMESTAMP WHERE user_id = ?", toUserID.String(), fromUserID.String())
+	if err != nil {
+		return 0, err
+	}
+	c.videosChanged(changed)
+	return result.RowsAffected()
+}
+
+const scimGroupColumns = `
+		id,
+		created_at,
+		updated_at,
+		organization_id,
+		display_name,
+		COALESCE(external_id, '')
+`
+
+func scanSCIMGroup(row interface{ Scan(...any) error }) (SCIMGroup, error) {
+	var group SCIMGroup
+	err := row.Scan(
+		&group.ID,
+		&group.CreatedAt,
+		&group.UpdatedAt,
+		&group.OrganizationID,
+		&group.DisplayName,
+		&group.ExternalID,
+	)
+	return group, err
+}
+
+func (c Client) getSCIMGroupMembers(groupID uuid.UUID) ([]SCIMGroupMember, error) {
+	query := `
+	SELECT u.id, u.email
+	FROM scim_group_members gm
+	JOIN users u ON u.id = gm.user_id
+	WHERE gm.group_id = ?
+	ORDER BY u.email
+	`
+	rows, err := c.db.QueryContext(c.context(), query, groupID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []SCIMGroupMember{}
+	for rows.Next() {
+		var member SCIMGroupMember
+		if err := rows.Scan(&member.UserID, &member.Email); err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return members, rows.Err()
+}
+
+// CreateSCIMGroup creates a group with the given members, who must be users
+// the organization manages.
+func (c Client) CreateSCIMGroup(orgID uuid.UUID, displayName, externalID string, memberIDs []uuid.UUID) (SCIMGroup, error) {
+	id := uuid.New()
+
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return SCIMGroup{}, err
+	}
+	defer tx.Rollback()
+
+	query := `
+	INSERT INTO scim_groups (
+		id,
+		created_at,
+		updated_at,
+		organization_id,
+		display_name,
+		external_id
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, NULLIF(?, ''))
+	`
+	if _, err := tx.ExecContext(c.context(), query, id, orgID, displayName, externalID); err != nil {
+		return SCIMGroup{}, err
+	}
+	if err := c.addSCIMGroupMembers(tx, id, memberIDs); err != nil {
+		return SCIMGroup{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return SCIMGroup{}, err
+	}
+	return c.GetSCIMGroup(orgID, id)
+}
+
+// GetSCIMGroup returns a zero group when the organization has none with the
+// ID.
+func (c Client) GetSCIMGroup(orgID, id uuid.UUID) (SCIMGroup, error) {
+	group, err := scanSCIMGroup(c.db.QueryRowContext(c.context(), `SELECT`+scimGroupColumns+`FROM scim_groups WHERE id = ? AND organization_id = ?`, id, orgID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return SCIMGroup{}, nil
+		}
+		return SCIMGroup{}, err
+	}
+	group.Members, err = c.getSCIMGroupMembers(group.ID)
+	if err != nil {
+		return SCIMGroup{}, err
+	}
+	return group, nil
+}
+
+// GetSCIMGroups returns a page of the organization's groups and how many
+// match the filter in total.
+func (c Client) GetSCIMGroups(orgID uuid.UUID, filter SCIMFilter, offset, limit int) ([]SCIMGroup, int, error) {
+	where := `
+	WHERE organization_id = ?
+		AND (? = '' OR display_name = ?)
+		AND (? = '' OR external_id = ?)
+	`
+	args := []any{orgID, filter.Name, filter.Name, filter.ExternalID, filter.ExternalID}
+
+	var total int
+	err := c.db.QueryRowContext(c.context(), `SELECT COUNT(*) FROM scim_groups`+where, args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	rows, err := c.db.QueryContext(c.context(), `SELECT`+scimGroupColumns+`FROM scim_groups`+where+`ORDER BY created_at, id LIMIT ? OFFSET ?`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	groups := []SCIMGroup{}
+	for rows.Next() {
+		group, err := scanSCIMGroup(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	rows.Close()
+
+	for i := range groups {
+		groups[i].Members, err = c.getSCIMGroupMembers(groups[i].ID)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+	return groups, total, nil
+}
+
+// UpdateSCIMGroup replaces the group's name and members.
+func (c Client) UpdateSCIMGroup(id uuid.UUID, displayName, externalID string, memberIDs []uuid.UUID) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+	UPDATE scim_groups
+	SET
+		display_name = ?,
+		external_id = NULLIF(?, ''),
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	if _, err := tx.ExecContext(c.context(), query, displayName, externalID, id); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(c.context(), "DELETE FROM scim_group_members WHERE group_id = ?", id); err != nil {
+		return err
+	}
+	if err := c.addSCIMGroupMembers(tx, id, memberIDs); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (c Client) addSCIMGroupMembers(tx *sql.Tx, id uuid.UUID, memberIDs []uuid.UUID) error {
+	for _, memberID := range memberIDs {
+		if _, err := tx.ExecContext(c.context(), "INSERT OR IGNORE INTO scim_group_members (group_id, user_id) VALUES (?, ?)", id, memberID.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveUserFromSCIMGroups takes a user out of every group.
+func (c Client) RemoveUserFromSCIMGroups(userID uuid.UUID) error {
+	_, err := c.db.ExecContext(c.context(), "DELETE FROM scim_group_members WHERE user_id = ?", userID.String())
+	return err
+}
+
+func (c Client) DeleteSCIMGroup(orgID, id uuid.UUID) (bool, error) {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(c.context(), "DELETE FROM scim_groups WHERE id = ? AND organization_id = ?", id, orgID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.ExecContext(c.context(), "DELETE FROM scim_group_members WHERE group_id = ?", id); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// SyncSCIMRoles makes the organization's provisioned members owners when
+// they're in one of the owner groups and plain members otherwise. Local
+// members keep their roles.
+func (c Client) SyncSCIMRoles(orgID uuid.UUID, ownerGroups []string) error {
+	ownerGroupsQuery := "SELECT NULL WHERE 0"
+	args := []any{}
+	if len(ownerGroups) > 0 {
+		ownerGroupsQuery = `
+		SELECT gm.user_id
+		FROM scim_group_members gm
+		JOIN scim_groups g ON g.id = gm.group_id
+		WHERE g.organization_id = ? AND g.display_name IN (?` + strings.Repeat(", ?", len(ownerGroups)-1) + `)`
+		args = append(args, orgID)
+		for _, group := range ownerGroups {
+			args = append(args, group)
+		}
+	}
+
+	query := `
+	UPDATE organization_members
+	SET role = CASE WHEN user_id IN (` + ownerGroupsQuery + `) THEN ? ELSE ? END
+	WHERE organization_id = ?
+		AND user_id IN (SELECT id FROM users WHERE sso_organization_id = ?)
+	`
+	args = append(args, OrganizationRoleOwner, OrganizationRoleMember, orgID, orgID)
+	_, err := c.db.ExecContext(c.context(), query, args...)
+	return err
+}
@@ -0,0 +1,36 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	c := newTestClient(t)
+	user, err := c.CreateUser(CreateUserParams{Email: "ann@example.com", Password: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "snapshot.db")
+	if err := c.Snapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	// a snapshot is never written over
+	if err := c.Snapshot(path); err == nil {
+		t.Error("snapshot overwrote an existing file")
+	}
+
+	restored, err := NewClient(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer restored.Close()
+	got, err := restored.GetUser(user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got == nil || got.Email != "ann@example.com" {
+		t.Errorf("restored user %+v", got)
+	}
+}
@@ -0,0 +1,129 @@
+package database
+
+import (
+	"github.com/google/uuid"
+)
+
+type SystemStats struct {
+	Users         int   `json:"users"`
+	Videos        int   `json:"videos"`
+	TrashedVideos int   `json:"trashed_videos"`
+	StorageBytes  int64 `json:"storage_bytes"`
+	// Processing counts uploads currently going through the pipeline
+	Processing  int `json:"processing"`
+	JobsPending int `json:"jobs_pending"`
+	JobsRunning int `json:"jobs_running"`
+	JobsFailed  int `json:"jobs_failed"`
+	JobsDead    int `json:"jobs_dead"`
+	LiveStreams int `json:"live_streams"`
+}
+
+type UserUsage struct {
+	UserID       uuid.UUID `json:"user_id"`
+	Email        string    `json:"email"`
+	Videos       int       `json:"videos"`
+	StorageBytes int64     `json:"storage_bytes"`
+}
+
+func (c Client) GetSystemStats() (SystemStats, error) {
+	query := `
+	SELECT
+		(SELECT COUNT(*) FROM users),
+		(SELECT COUNT(*) FROM videos WHERE deleted_at IS NULL),
+		(SELECT COUNT(*) FROM videos WHERE deleted_at IS NOT NULL),
+		(SELECT COALESCE(SUM(size_bytes), 0) FROM video_versions),
+		(SELECT COUNT(*) FROM videos WHERE processing),
+		(SELECT COUNT(*) FROM jobs WHERE status = ?),
+		(SELECT COUNT(*) FROM jobs WHERE status = ?),
+		(SELECT COUNT(*) FROM jobs WHERE status = ?),
+		(SELECT COUNT(*) FROM jobs WHERE status = ?),
+		(SELECT COUNT(*) FROM live_streams WHERE status IN (?, ?))
+	`
+
+	var stats SystemStats
+	err := c.db.QueryRowContext(
+		c.context(),
+		query,
+		JobStatusPending,
+		JobStatusRunning,
+		JobStatusFailed,
+		JobStatusDead,
+		LiveStreamStatusWaiting,
+		LiveStreamStatusLive,
+	).Scan(
+		&stats.Users,
+		&stats.Videos,
+		&stats.TrashedVideos,
+		&stats.StorageBytes,
+		&stats.Processing,
+		&stats.JobsPending,
+		&stats.JobsRunning,
+		&stats.JobsFailed,
+		&stats.JobsDead,
+		&stats.LiveStreams,
+	)
+	return stats, err
+}
+
+// GetRecentFailedJobs returns the latest failed jobs, newest first.
+func (c Client) GetRecentFailedJobs(limit int) ([]Job, error) {
+	query := `
+	SELECT` + jobColumns + `
+	FROM jobs
+	WHERE status = ?
+	ORDER BY finished_at DESC
+	LIMIT ?
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query, JobStatusFailed, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// GetTopStorageConsumers returns the users storing the most bytes of video.
+func (c Client) GetTopStorageConsumers(limit int) ([]UserUsage, error) {
+	query := `
+	SELECT
+		u.id,
+		u.email,
+		(SELECT COUNT(*) FROM videos v WHERE v.user_id = u.id AND v.deleted_at IS NULL),
+		COALESCE((
+			SELECT SUM(vv.size_bytes)
+			FROM video_versions vv
+			JOIN videos v ON v.id = vv.video_id
+			WHERE v.user_id = u.id
+		), 0) AS storage_bytes
+	FROM users u
+	ORDER BY storage_bytes DESC
+	LIMIT ?
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := []UserUsage{}
+	for rows.Next() {
+		var u UserUsage
+		err := rows.Scan(&u.UserID, &u.Email, &u.Videos, &u.StorageBytes)
+		if err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
@@ -0,0 +1,41 @@
+package database
+
+import (
+	"github.com/google/uuid"
+)
+
+// WithTestData returns a client that marks the users and videos it creates
+// as test data, so they can be purged without touching real ones.
+func (c Client) WithTestData() Client {
+	c.testData = true
+	return c
+}
+
+// GetTestDataVideoIDs returns the videos created as test data, trashed
+// ones included.
+func (c Client) GetTestDataVideoIDs() ([]uuid.UUID, error) {
+	return c.queryIDs("SELECT id FROM videos WHERE test_data")
+}
+
+// GetTestDataUserIDs returns the users created as test data.
+func (c Client) GetTestDataUserIDs() ([]uuid.UUID, error) {
+	return c.queryIDs("SELECT id FROM users WHERE test_data")
+}
+
+func (c Client) queryIDs(query string) ([]uuid.UUID, error) {
+	rows, err := c.db.QueryContext(c.context(), query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
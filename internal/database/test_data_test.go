@@ -0,0 +1,42 @@
+package database
+
+import (
+	"testing"
+)
+
+func TestTestDataIsMarked(t *testing.T) {
+	c := newTestClient(t)
+	owner, err := c.CreateUser(CreateUserParams{Email: "ann@example.com", Password: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CreateVideo(CreateVideoParams{Title: "Real", UserID: owner.ID}); err != nil {
+		t.Fatal(err)
+	}
+
+	test := c.WithTestData()
+	testUser, err := test.CreateUser(CreateUserParams{Email: "load-1@example.com", Password: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a test run may upload as a real user too
+	testVideo, err := test.CreateVideo(CreateVideoParams{Title: "Load", UserID: owner.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	users, err := c.GetTestDataUserIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0] != testUser.ID {
+		t.Errorf("test users %v, want %s", users, testUser.ID)
+	}
+	videos, err := c.GetTestDataVideoIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(videos) != 1 || videos[0] != testVideo.ID {
+		t.Errorf("test videos %v, want %s", videos, testVideo.ID)
+	}
+}
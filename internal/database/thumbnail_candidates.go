@@ -0,0 +1,131 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// ThumbnailCandidate is a frame scene detection picked from a video, which
+// the owner can choose as the thumbnail.
+type ThumbnailCandidate struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	CreateThumbnailCandidateParams
+}
+
+type CreateThumbnailCandidateParams struct {
+	VideoID      uuid.UUID `json:"video_id"`
+	ThumbnailURL string    `json:"thumbnail_url"`
+	// Timestamp is the frame's position in seconds
+	Timestamp float64 `json:"timestamp"`
+	// SceneScore is how much the frame differs from the one before it,
+	// between 0 and 1
+	SceneScore float64 `json:"scene_score"`
+}
+
+const thumbnailCandidateColumns = `
+		id,
+		created_at,
+		video_id,
+		thumbnail_url,
+		timestamp,
+		scene_score
+`
+
+func scanThumbnailCandidate(row interface{ Scan(...any) error }) (ThumbnailCandidate, error) {
+	var t ThumbnailCandidate
+	err := row.Scan(
+		&t.ID,
+		&t.CreatedAt,
+		&t.VideoID,
+		&t.ThumbnailURL,
+		&t.Timestamp,
+		&t.SceneScore,
+	)
+	return t, err
+}
+
+// ReplaceThumbnailCandidates swaps the candidates of a video for new ones. It
+// returns the candidates it removed so their files can be deleted.
+func (c Client) ReplaceThumbnailCandidates(videoID uuid.UUID, candidates []CreateThumbnailCandidateParams) ([]ThumbnailCandidate, error) {
+	previous, err := c.GetThumbnailCandidates(videoID)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(c.context(), "DELETE FROM thumbnail_candidates WHERE video_id = ?", videoID)
+	if err != nil {
+		return nil, err
+	}
+	query := `
+	INSERT INTO thumbnail_candidates (
+		id,
+		created_at,
+		video_id,
+		thumbnail_url,
+		timestamp,
+		scene_score
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+	for _, candidate := range candidates {
+		_, err := tx.ExecContext(c.context(), query, uuid.New(), videoID, candidate.ThumbnailURL, candidate.Timestamp, candidate.SceneScore)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return previous, tx.Commit()
+}
+
+func (c Client) GetThumbnailCandidate(id uuid.UUID) (ThumbnailCandidate, error) {
+	query := `
+	SELECT` + thumbnailCandidateColumns + `
+	FROM thumbnail_candidates
+	WHERE id = ?
+	`
+
+	t, err := scanThumbnailCandidate(c.db.QueryRowContext(c.context(), query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ThumbnailCandidate{}, nil
+		}
+		return ThumbnailCandidate{}, err
+	}
+	return t, nil
+}
+
+// GetThumbnailCandidates returns the candidates of a video in the order they
+// appear in it.
+func (c Client) GetThumbnailCandidates(videoID uuid.UUID) ([]ThumbnailCandidate, error) {
+	query := `
+	SELECT` + thumbnailCandidateColumns + `
+	FROM thumbnail_candidates
+	WHERE video_id = ?
+	ORDER BY timestamp ASC
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	candidates := []ThumbnailCandidate{}
+	for rows.Next() {
+		t, err := scanThumbnailCandidate(rows)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, t)
+	}
+	return candidates, rows.Err()
+}
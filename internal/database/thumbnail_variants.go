@@ -0,0 +1,152 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// MaxThumbnailVariants is how many thumbnails a video can experiment with at
+// once.
+const MaxThumbnailVariants = 3
+
+type ThumbnailVariant struct {
+	ID           uuid.UUID `json:"id"`
+	CreatedAt    time.Time `json:"created_at"`
+	VideoID      uuid.UUID `json:"video_id"`
+	ThumbnailURL string    `json:"thumbnail_url"`
+	// Active means the video currently shows this variant, it's derived from
+	// the video's thumbnail_variant_id
+	Active      bool  `json:"active"`
+	Impressions int64 `json:"impressions"`
+	Clicks      int64 `json:"clicks"`
+}
+
+type ThumbnailEvent string
+
+const (
+	ThumbnailEventImpression ThumbnailEvent = "impression"
+	ThumbnailEventClick      ThumbnailEvent = "click"
+)
+
+const thumbnailVariantColumns = `
+		t.id,
+		t.created_at,
+		t.video_id,
+		t.thumbnail_url,
+		COALESCE(v.thumbnail_variant_id = t.id, FALSE),
+		t.impressions,
+		t.clicks
+`
+
+func scanThumbnailVariant(row interface{ Scan(...any) error }) (ThumbnailVariant, error) {
+	var t ThumbnailVariant
+	err := row.Scan(
+		&t.ID,
+		&t.CreatedAt,
+		&t.VideoID,
+		&t.ThumbnailURL,
+		&t.Active,
+		&t.Impressions,
+		&t.Clicks,
+	)
+	return t, err
+}
+
+// CreateThumbnailVariant adds an inactive variant. It returns a zero variant
+// when the video already has MaxThumbnailVariants.
+func (c Client) CreateThumbnailVariant(videoID uuid.UUID, thumbnailURL string) (ThumbnailVariant, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO thumbnail_variants (
+		id,
+		created_at,
+		video_id,
+		thumbnail_url,
+		impressions,
+		clicks
+	)
+	SELECT ?, CURRENT_TIMESTAMP, ?, ?, 0, 0
+	WHERE (SELECT COUNT(*) FROM thumbnail_variants WHERE video_id = ?) < ?
+	`
+	result, err := c.db.ExecContext(c.context(), query, id, videoID, thumbnailURL, videoID, MaxThumbnailVariants)
+	if err != nil {
+		return ThumbnailVariant{}, err
+	}
+	created, err := result.RowsAffected()
+	if err != nil {
+		return ThumbnailVariant{}, err
+	}
+	if created == 0 {
+		return ThumbnailVariant{}, nil
+	}
+	return c.GetThumbnailVariant(id)
+}
+
+func (c Client) GetThumbnailVariant(id uuid.UUID) (ThumbnailVariant, error) {
+	query := `
+	SELECT` + thumbnailVariantColumns + `
+	FROM thumbnail_variants t
+	LEFT JOIN videos v ON v.id = t.video_id
+	WHERE t.id = ?
+	`
+
+	t, err := scanThumbnailVariant(c.db.QueryRowContext(c.context(), query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return ThumbnailVariant{}, nil
+		}
+		return ThumbnailVariant{}, err
+	}
+	return t, nil
+}
+
+// GetThumbnailVariants returns the variants of a video, oldest first.
+func (c Client) GetThumbnailVariants(videoID uuid.UUID) ([]ThumbnailVariant, error) {
+	query := `
+	SELECT` + thumbnailVariantColumns + `
+	FROM thumbnail_variants t
+	LEFT JOIN videos v ON v.id = t.video_id
+	WHERE t.video_id = ?
+	ORDER BY t.created_at ASC, t.rowid ASC
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	variants := []ThumbnailVariant{}
+	for rows.Next() {
+		t, err := scanThumbnailVariant(rows)
+		if err != nil {
+			return nil, err
+		}
+		variants = append(variants, t)
+	}
+	return variants, rows.Err()
+}
+
+func (c Client) DeleteThumbnailVariant(id uuid.UUID) error {
+	_, err := c.db.ExecContext(c.context(), "DELETE FROM thumbnail_variants WHERE id = ?", id)
+	return err
+}
+
+// RecordThumbnailEvent counts an impression or click for a variant of the
+// video. Events for variants of other videos are ignored.
+func (c Client) RecordThumbnailEvent(videoID, variantID uuid.UUID, event ThumbnailEvent) error {
+	column := "impressions"
+	if event == ThumbnailEventClick {
+		column = "clicks"
+	}
+	query := `
+	UPDATE thumbnail_variants
+	SET ` + column + ` = ` + column + ` + 1
+	WHERE id = ? AND video_id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, variantID, videoID)
+	return err
+}
@@ -0,0 +1,170 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// TwoFactor is the user's TOTP setup. A secret without EnabledAt is an
+// enrollment that wasn't confirmed with a code yet.
+type TwoFactor struct {
+	Secret    *string
+	EnabledAt *time.Time
+	// LastStep is the TOTP period of the last accepted code, codes can't be
+	// used twice
+	LastStep          int64
+	RecoveryCodesLeft int
+}
+
+func (c Client) GetTwoFactor(userID uuid.UUID) (TwoFactor, error) {
+	query := `
+	SELECT
+		totp_secret,
+		totp_enabled_at,
+		totp_last_step,
+		(SELECT COUNT(*) FROM recovery_codes WHERE user_id = users.id AND used_at IS NULL)
+	FROM users
+	WHERE id = ?
+	`
+	var tf TwoFactor
+	err := c.db.QueryRowContext(c.context(), query, userID).Scan(&tf.Secret, &tf.EnabledAt, &tf.LastStep, &tf.RecoveryCodesLeft)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TwoFactor{}, nil
+	}
+	return tf, err
+}
+
+// StartTOTPEnrollment stores a new secret for the user to confirm. It
+// returns false when two-factor authentication is already enabled.
+func (c Client) StartTOTPEnrollment(userID uuid.UUID, secret string) (bool, error) {
+	query := `
+	UPDATE users
+	SET
+		totp_secret = ?,
+		totp_last_step = 0,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND totp_enabled_at IS NULL
+	`
+	result, err := c.db.ExecContext(c.context(), query, secret, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// EnableTOTP finishes the enrollment with the step of the confirming code and
+// hands the user a fresh set of recovery codes.
+func (c Client) EnableTOTP(userID uuid.UUID, step int64, codeHashes []string) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+	UPDATE users
+	SET
+		totp_enabled_at = ?,
+		totp_last_step = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	if _, err := tx.ExecContext(c.context(), query, time.Now().UTC(), step, userID); err != nil {
+		return err
+	}
+	if err := c.replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// DisableTOTP removes the secret and the recovery codes.
+func (c Client) DisableTOTP(userID uuid.UUID) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+	UPDATE users
+	SET
+		totp_secret = NULL,
+		totp_enabled_at = NULL,
+		totp_last_step = 0,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	if _, err := tx.ExecContext(c.context(), query, userID); err != nil {
+		return err
+	}
+	if err := c.replaceRecoveryCodes(tx, userID, nil); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UseTOTPStep records that a code of the step was accepted. It returns false
+// when a code of this or a later step was accepted before, so a code seen
+// over someone's shoulder can't be replayed.
+func (c Client) UseTOTPStep(userID uuid.UUID, step int64) (bool, error) {
+	query := `
+	UPDATE users
+	SET totp_last_step = ?
+	WHERE id = ? AND totp_last_step < ?
+	`
+	result, err := c.db.ExecContext(c.context(), query, step, userID, step)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
+
+// ReplaceRecoveryCodes swaps all of the user's recovery codes, used or not,
+// for new ones.
+func (c Client) ReplaceRecoveryCodes(userID uuid.UUID, codeHashes []string) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := c.replaceRecoveryCodes(tx, userID, codeHashes); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (c Client) replaceRecoveryCodes(tx *sql.Tx, userID uuid.UUID, codeHashes []string) error {
+	if _, err := tx.ExecContext(c.context(), "DELETE FROM recovery_codes WHERE user_id = ?", userID); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		_, err := tx.ExecContext(c.context(), "INSERT INTO recovery_codes (user_id, code_hash) VALUES (?, ?)", userID, hash)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UseRecoveryCode marks the code used. It returns false when the user has no
+// such unused code.
+func (c Client) UseRecoveryCode(userID uuid.UUID, codeHash string) (bool, error) {
+	query := `
+	UPDATE recovery_codes
+	SET used_at = ?
+	WHERE user_id = ? AND code_hash = ? AND used_at IS NULL
+	`
+	result, err := c.db.ExecContext(c.context(), query, time.Now().UTC(), userID, codeHash)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
@@ -0,0 +1,115 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UploadGrant lets whoever holds its token upload one file to a video
+// without signing in. Only a hash of the token is stored.
+type UploadGrant struct {
+	ID        uuid.UUID  `json:"id"`
+	CreatedAt time.Time  `json:"created_at"`
+	VideoID   uuid.UUID  `json:"video_id"`
+	UserID    uuid.UUID  `json:"user_id"`
+	TokenHash string     `json:"-"`
+	MaxBytes  int64      `json:"max_bytes"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+}
+
+type CreateUploadGrantParams struct {
+	VideoID   uuid.UUID
+	UserID    uuid.UUID
+	TokenHash string
+	MaxBytes  int64
+	ExpiresAt time.Time
+}
+
+const uploadGrantColumns = `
+		id,
+		created_at,
+		video_id,
+		user_id,
+		token_hash,
+		max_bytes,
+		expires_at,
+		used_at
+`
+
+func scanUploadGrant(row interface{ Scan(...any) error }) (UploadGrant, error) {
+	var g UploadGrant
+	err := row.Scan(
+		&g.ID,
+		&g.CreatedAt,
+		&g.VideoID,
+		&g.UserID,
+		&g.TokenHash,
+		&g.MaxBytes,
+		&g.ExpiresAt,
+		&g.UsedAt,
+	)
+	return g, err
+}
+
+func (c Client) CreateUploadGrant(params CreateUploadGrantParams) (UploadGrant, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO upload_grants (
+		id,
+		created_at,
+		video_id,
+		user_id,
+		token_hash,
+		max_bytes,
+		expires_at
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.ExecContext(c.context(), query, id, params.VideoID, params.UserID, params.TokenHash, params.MaxBytes, params.ExpiresAt)
+	if err != nil {
+		return UploadGrant{}, err
+	}
+
+	g, err := scanUploadGrant(c.db.QueryRowContext(c.context(), `SELECT`+uploadGrantColumns+`FROM upload_grants WHERE id = ?`, id))
+	return g, err
+}
+
+// ClaimUploadGrant uses up the grant with the token hash for an upload to
+// the video. It returns a zero UploadGrant when there's no such grant or it
+// was used or expired before now.
+func (c Client) ClaimUploadGrant(tokenHash string, videoID uuid.UUID, now time.Time) (UploadGrant, error) {
+	g, err := scanUploadGrant(c.db.QueryRowContext(c.context(), `SELECT`+uploadGrantColumns+`FROM upload_grants WHERE token_hash = ?`, tokenHash))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UploadGrant{}, nil
+		}
+		return UploadGrant{}, err
+	}
+	if g.VideoID != videoID || g.UsedAt != nil || !g.ExpiresAt.After(now) {
+		return UploadGrant{}, nil
+	}
+
+	// only one of concurrent uploads with the same token gets it
+	result, err := c.db.ExecContext(c.context(), "UPDATE upload_grants SET used_at = CURRENT_TIMESTAMP WHERE id = ? AND used_at IS NULL", g.ID)
+	if err != nil {
+		return UploadGrant{}, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil || n == 0 {
+		return UploadGrant{}, err
+	}
+	return g, nil
+}
+
+// DeleteUploadGrantsExpiredBefore removes grants that can't be used anymore
+// and returns how many there were.
+func (c Client) DeleteUploadGrantsExpiredBefore(cutoff time.Time) (int64, error) {
+	result, err := c.db.ExecContext(c.context(), "DELETE FROM upload_grants WHERE expires_at < ?", cutoff)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
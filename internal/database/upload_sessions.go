@@ -0,0 +1,232 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type UploadSession struct {
+	ID          uuid.UUID  `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UpdatedAt   time.Time  `json:"updated_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	// ClaimedAt is set while the upload is being processed, so a client
+	// completing the session and the S3 event of the upload don't both
+	// process it
+	ClaimedAt *time.Time `json:"-"`
+	// AbandonedAt is when the session expired without an upload and its
+	// staged object was cleaned up
+	AbandonedAt *time.Time `json:"abandoned_at"`
+	CreateUploadSessionParams
+}
+
+type CreateUploadSessionParams struct {
+	VideoID   uuid.UUID `json:"video_id"`
+	UserID    uuid.UUID `json:"user_id"`
+	S3Key     string    `json:"s3_key"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// TranscodeProfile is used when the upload is processed without the
+	// client completing it, empty for the default
+	TranscodeProfile string `json:"transcode_profile"`
+	// Bumpers lists the organization bumpers the upload is wrapped in,
+	// comma separated
+	Bumpers string `json:"bumpers"`
+}
+
+const uploadSessionColumns = `
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		s3_key,
+		expires_at,
+		completed_at,
+		claimed_at,
+		abandoned_at,
+		transcode_profile,
+		bumpers
+`
+
+func scanUploadSession(row interface{ Scan(...any) error }) (UploadSession, error) {
+	var session UploadSession
+	err := row.Scan(
+		&session.ID,
+		&session.CreatedAt,
+		&session.UpdatedAt,
+		&session.VideoID,
+		&session.UserID,
+		&session.S3Key,
+		&session.ExpiresAt,
+		&session.CompletedAt,
+		&session.ClaimedAt,
+		&session.AbandonedAt,
+		&session.TranscodeProfile,
+		&session.Bumpers,
+	)
+	return session, err
+}
+
+func (c Client) CreateUploadSession(params CreateUploadSessionParams) (UploadSession, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO upload_sessions (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		s3_key,
+		expires_at,
+		transcode_profile,
+		bumpers
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?)
+	`
+	_, err := c.db.ExecContext(c.context(), query, id, params.VideoID, params.UserID, params.S3Key, params.ExpiresAt, params.TranscodeProfile, params.Bumpers)
+	if err != nil {
+		return UploadSession{}, err
+	}
+
+	return c.GetUploadSession(id)
+}
+
+func (c Client) GetUploadSession(id uuid.UUID) (UploadSession, error) {
+	query := `
+	SELECT` + uploadSessionColumns + `
+	FROM upload_sessions
+	WHERE id = ?
+	`
+
+	session, err := scanUploadSession(c.db.QueryRowContext(c.context(), query, id))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UploadSession{}, nil
+		}
+		return UploadSession{}, err
+	}
+
+	return session, nil
+}
+
+// GetOpenUploadSessionByKey returns the newest session still waiting for an
+// upload to key.
+func (c Client) GetOpenUploadSessionByKey(key string) (UploadSession, error) {
+	query := `
+	SELECT` + uploadSessionColumns + `
+	FROM upload_sessions
+	WHERE s3_key = ? AND completed_at IS NULL AND abandoned_at IS NULL
+	ORDER BY created_at DESC
+	LIMIT 1
+	`
+
+	session, err := scanUploadSession(c.db.QueryRowContext(c.context(), query, key))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UploadSession{}, nil
+		}
+		return UploadSession{}, err
+	}
+
+	return session, nil
+}
+
+// ClaimUploadSession marks an open session as being processed. It reports
+// false when the session is completed or claimed already.
+func (c Client) ClaimUploadSession(id uuid.UUID) (bool, error) {
+	query := `
+	UPDATE upload_sessions
+	SET
+		claimed_at = CURRENT_TIMESTAMP,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND completed_at IS NULL AND claimed_at IS NULL
+	`
+	result, err := c.db.ExecContext(c.context(), query, id)
+	if err != nil {
+		return false, err
+	}
+	claimed, err := result.RowsAffected()
+	return claimed == 1, err
+}
+
+// ReleaseUploadSession lets a session whose processing failed be completed
+// again.
+func (c Client) ReleaseUploadSession(id uuid.UUID) error {
+	query := `
+	UPDATE upload_sessions
+	SET
+		claimed_at = NULL,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, id)
+	return err
+}
+
+func (c Client) CompleteUploadSession(id uuid.UUID) error {
+	query := `
+	UPDATE upload_sessions
+	SET
+		completed_at = CURRENT_TIMESTAMP,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, id)
+	return err
+}
+
+// GetUploadSessionsExpiredBefore returns the sessions that expired before
+// cutoff without being completed, processed or cleaned up.
+func (c Client) GetUploadSessionsExpiredBefore(cutoff time.Time) ([]UploadSession, error) {
+	query := `
+	SELECT` + uploadSessionColumns + `
+	FROM upload_sessions
+	WHERE expires_at < ?
+		AND completed_at IS NULL
+		AND claimed_at IS NULL
+		AND abandoned_at IS NULL
+	ORDER BY expires_at ASC
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query, cutoff)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []UploadSession{}
+	for rows.Next() {
+		session, err := scanUploadSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// AbandonUploadSession marks an expired session as cleaned up. It reports
+// false when the session was completed or claimed in the meantime.
+func (c Client) AbandonUploadSession(id uuid.UUID) (bool, error) {
+	query := `
+	UPDATE upload_sessions
+	SET
+		abandoned_at = CURRENT_TIMESTAMP,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND completed_at IS NULL AND claimed_at IS NULL AND abandoned_at IS NULL
+	`
+	result, err := c.db.ExecContext(c.context(), query, id)
+	if err != nil {
+		return false, err
+	}
+	abandoned, err := result.RowsAffected()
+	return abandoned == 1, err
+}
+
+func (c Client) CountAbandonedUploadSessions() (int64, error) {
+	var count int64
+	err := c.db.QueryRowContext(c.context(), "SELECT COUNT(*) FROM upload_sessions WHERE abandoned_at IS NOT NULL").Scan(&count)
+	return count, err
+}
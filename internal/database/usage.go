@@ -0,0 +1,176 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// UsagePeriodLayout formats the calendar months usage is aggregated by.
+const UsagePeriodLayout = "2006-01"
+
+// UsageReport is an organization's usage for one calendar month. Storage is
+// what its members had stored when the snapshot was taken, bandwidth is the
+// size of the files handed to viewers during the month.
+type UsageReport struct {
+	ID             uuid.UUID `json:"id"`
+	CreatedAt      time.Time `json:"created_at"`
+	OrganizationID uuid.UUID `json:"organization_id"`
+	Period         string    `json:"period"`
+	Videos         int       `json:"videos"`
+	StorageBytes   int64     `json:"storage_bytes"`
+	BandwidthBytes int64     `json:"bandwidth_bytes"`
+}
+
+// RecordVideoDelivery adds the size of the video's current version to its
+// owner's bandwidth for period. Viewers may not fetch the whole file, so
+// this is an upper bound.
+func (c Client) RecordVideoDelivery(videoID uuid.UUID, period string) error {
+	query := `
+	INSERT INTO bandwidth_usage (user_id, period, bytes)
+	SELECT
+		v.user_id,
+		?,
+		COALESCE((
+			SELECT vv.size_bytes
+			FROM video_versions vv
+			WHERE vv.video_id = v.id
+			ORDER BY vv.version DESC
+			LIMIT 1
+		), 0)
+	FROM videos v
+	WHERE v.id = ?
+	ON CONFLICT(user_id, period) DO UPDATE SET
+		bytes = bytes + excluded.bytes
+	`
+	_, err := c.db.ExecContext(c.context(), query, period, videoID)
+	return err
+}
+
+// SnapshotOrganizationUsage stores a usage report for period for every
+// organization that doesn't have one yet and returns how many were created.
+func (c Client) SnapshotOrganizationUsage(period string) (int, error) {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `
+	SELECT
+		o.id,
+		(
+			SELECT COUNT(*)
+			FROM videos v
+			JOIN organization_members m ON m.user_id = v.user_id
+			WHERE m.organization_id = o.id AND v.deleted_at IS NULL
+		),
+		COALESCE((
+			SELECT SUM(vv.size_bytes)
+			FROM video_versions vv
+			JOIN videos v ON v.id = vv.video_id
+			JOIN organization_members m ON m.user_id = v.user_id
+			WHERE m.organization_id = o.id
+		), 0),
+		COALESCE((
+			SELECT SUM(b.bytes)
+			FROM bandwidth_usage b
+			JOIN organization_members m ON m.user_id = b.user_id
+			WHERE m.organization_id = o.id AND b.period = ?
+		), 0)
+	FROM organizations o
+	WHERE NOT EXISTS (
+		SELECT 1 FROM usage_reports r WHERE r.organization_id = o.id AND r.period = ?
+	)
+	`
+	rows, err := tx.QueryContext(c.context(), query, period, period)
+	if err != nil {
+		return 0, err
+	}
+	reports := []UsageReport{}
+	for rows.Next() {
+		report := UsageReport{ID: uuid.New(), Period: period}
+		err := rows.Scan(&report.OrganizationID, &report.Videos, &report.StorageBytes, &report.BandwidthBytes)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		reports = append(reports, report)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	insert := `
+	INSERT INTO usage_reports (
+		id,
+		created_at,
+		organization_id,
+		period,
+		videos,
+		storage_bytes,
+		bandwidth_bytes
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?)
+	`
+	for _, report := range reports {
+		_, err := tx.ExecContext(
+			c.context(),
+			insert,
+			report.ID,
+			report.OrganizationID,
+			report.Period,
+			report.Videos,
+			report.StorageBytes,
+			report.BandwidthBytes,
+		)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(reports), tx.Commit()
+}
+
+// GetUsageReports returns the reports of period, or of every period when it's
+// empty, newest first. orgID narrows them down to one organization.
+func (c Client) GetUsageReports(period string, orgID *uuid.UUID) ([]UsageReport, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		organization_id,
+		period,
+		videos,
+		storage_bytes,
+		bandwidth_bytes
+	FROM usage_reports
+	WHERE (? = '' OR period = ?)
+	AND (? IS NULL OR organization_id = ?)
+	ORDER BY period DESC, organization_id
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query, period, period, orgID, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reports := []UsageReport{}
+	for rows.Next() {
+		var report UsageReport
+		err := rows.Scan(
+			&report.ID,
+			&report.CreatedAt,
+			&report.OrganizationID,
+			&report.Period,
+			&report.Videos,
+			&report.StorageBytes,
+			&report.BandwidthBytes,
+		)
+		if err != nil {
+			return nil, err
+		}
+		reports = append(reports, report)
+	}
+	return reports, rows.Err()
+}
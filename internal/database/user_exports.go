@@ -0,0 +1,150 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type UserExportStatus string
+
+const (
+	UserExportStatusPending UserExportStatus = "pending"
+	UserExportStatusReady   UserExportStatus = "ready"
+	UserExportStatusFailed  UserExportStatus = "failed"
+)
+
+type UserExport struct {
+	ID        uuid.UUID        `json:"id"`
+	CreatedAt time.Time        `json:"created_at"`
+	UpdatedAt time.Time        `json:"updated_at"`
+	UserID    uuid.UUID        `json:"user_id"`
+	Status    UserExportStatus `json:"status"`
+	S3Key     *string          `json:"-"`
+	Error     *string          `json:"error"`
+}
+
+func (c Client) CreateUserExport(userID uuid.UUID) (UserExport, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO user_exports (
+		id,
+		created_at,
+		updated_at,
+		user_id,
+		status
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
+	`
+	_, err := c.db.ExecContext(c.context(), query, id, userID, UserExportStatusPending)
+	if err != nil {
+		return UserExport{}, err
+	}
+
+	return c.GetUserExport(id)
+}
+
+func (c Client) GetUserExport(id uuid.UUID) (UserExport, error) {
+	query := `
+	SELECT
+		id,
+		created_at,
+		updated_at,
+		user_id,
+		status,
+		s3_key,
+		error
+	FROM user_exports
+	WHERE id = ?
+	`
+
+	var export UserExport
+	err := c.db.QueryRowContext(c.context(), query, id).Scan(
+		&export.ID,
+		&export.CreatedAt,
+		&export.UpdatedAt,
+		&export.UserID,
+		&export.Status,
+		&export.S3Key,
+		&export.Error,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UserExport{}, nil
+		}
+		return UserExport{}, err
+	}
+
+	return export, nil
+}
+
+func (c Client) GetUserExportKeys(userID uuid.UUID) ([]string, error) {
+	query := `
+	SELECT s3_key
+	FROM user_exports
+	WHERE user_id = ? AND s3_key IS NOT NULL
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return keys, nil
+}
+
+func (c Client) CompleteUserExport(id uuid.UUID, s3Key string) error {
+	query := `
+	UPDATE user_exports
+	SET
+		status = ?,
+		s3_key = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, UserExportStatusReady, s3Key, id)
+	return err
+}
+
+func (c Client) FailUserExport(id uuid.UUID, errMsg string) error {
+	query := `
+	UPDATE user_exports
+	SET
+		status = ?,
+		error = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, UserExportStatusFailed, errMsg, id)
+	return err
+}
+
+// GetAllUserExportKeys returns the keys of every stored export.
+func (c Client) GetAllUserExportKeys() ([]string, error) {
+	rows, err := c.db.QueryContext(c.context(), "SELECT s3_key FROM user_exports WHERE s3_key IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
@@ -12,6 +12,9 @@ type User struct {
 	ID        uuid.UUID `json:"id"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
+	// DeactivatedAt is set once the organization's IdP deprovisioned the
+	// user, who can't sign in anymore
+	DeactivatedAt *time.Time `json:"deactivated_at,omitempty"`
 	CreateUserParams
 }
 
@@ -28,7 +31,7 @@ func (c Client) GetUsers() ([]User, error) {
 		FROM users
 	`
 
-	rows, err := c.db.Query(query)
+	rows, err := c.db.QueryContext(c.context(), query)
 	if err != nil {
 		return nil, err
 	}
@@ -53,13 +56,13 @@ func (c Client) GetUsers() ([]User, error) {
 
 func (c Client) GetUserByEmail(email string) (User, error) {
 	query := `
-		SELECT id, created_at, updated_at, email, password
+		SELECT id, created_at, updated_at, email, password, deactivated_at
 		FROM users
 		WHERE email = ?
 	`
 	var user User
 	var id string
-	err := c.db.QueryRow(query, email).Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	err := c.db.QueryRowContext(c.context(), query, email).Scan(&id, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password, &user.DeactivatedAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return User{}, nil
@@ -73,17 +76,19 @@ func (c Client) GetUserByEmail(email string) (User, error) {
 	return user, nil
 }
 
+// GetUserByRefreshToken returns the user of a refresh token that is neither
+// revoked nor expired, nil for any other and for deactivated users.
 func (c Client) GetUserByRefreshToken(token string) (*User, error) {
 	query := `
 		SELECT u.id, u.email, u.created_at, u.updated_at, u.password
 		FROM users u
 		JOIN refresh_tokens rt ON u.id = rt.user_id
-		WHERE rt.token = ?
+		WHERE rt.token = ? AND rt.revoked_at IS NULL AND rt.expires_at > ? AND u.deactivated_at IS NULL
 	`
 
 	var user User
 	var id string
-	err := c.db.QueryRow(query, token).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Password)
+	err := c.db.QueryRowContext(c.context(), query, token, time.Now().UTC()).Scan(&id, &user.Email, &user.CreatedAt, &user.UpdatedAt, &user.Password)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -103,11 +108,11 @@ func (c Client) CreateUser(params CreateUserParams) (*User, error) {
 
 	query := `
 		INSERT INTO users
-		    (id, created_at, updated_at, email, password)
+		    (id, created_at, updated_at, email, password, test_data)
 		VALUES
-		    (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?)
+		    (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id.String(), params.Email, params.Password)
+	_, err := c.db.ExecContext(c.context(), query, id.String(), params.Email, params.Password, c.testData)
 	if err != nil {
 		return nil, err
 	}
@@ -117,13 +122,13 @@ func (c Client) CreateUser(params CreateUserParams) (*User, error) {
 
 func (c Client) GetUser(id uuid.UUID) (*User, error) {
 	query := `
-		SELECT id, created_at, updated_at, email, password
+		SELECT id, created_at, updated_at, email, password, deactivated_at
 		FROM users
 		WHERE id = ?
 	`
 	var user User
 	var idStr string
-	err := c.db.QueryRow(query, id.String()).Scan(&idStr, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password)
+	err := c.db.QueryRowContext(c.context(), query, id.String()).Scan(&idStr, &user.CreatedAt, &user.UpdatedAt, &user.Email, &user.Password, &user.DeactivatedAt)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, nil
@@ -142,6 +147,113 @@ func (c Client) DeleteUser(id uuid.UUID) error {
 		DELETE FROM users
 		WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id.String())
+	_, err := c.db.ExecContext(c.context(), query, id.String())
 	return err
 }
+
+// DeleteUserData removes the user together with every row that references
+// them. Objects in storage have to be removed by the caller beforehand.
+// Their audit log entries are kept for the record, without the addresses
+// they came from.
+func (c Client) DeleteUserData(id uuid.UUID) error {
+	changed, err := c.changingVideos("SELECT id FROM videos WHERE user_id = ?", id.String())
+	if err != nil {
+		return err
+	}
+
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		"DELETE FROM jobs WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM video_versions WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM moderation_labels WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM video_drm WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM hls_keys WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM thumbnail_variants WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM thumbnail_candidates WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM audio_tracks WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM caption_cues WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM video_chapters WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM perceptual_hashes WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM duplicate_videos WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM duplicate_videos WHERE duplicate_of IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM content_id_reports WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM video_exports WHERE user_id = ?",
+		"DELETE FROM upload_sessions WHERE user_id = ?",
+		"DELETE FROM upload_grants WHERE user_id = ?",
+		"DELETE FROM user_exports WHERE user_id = ?",
+		"DELETE FROM refresh_tokens WHERE user_id = ?",
+		"DELETE FROM recovery_codes WHERE user_id = ?",
+		"DELETE FROM api_tokens WHERE user_id = ?",
+		"DELETE FROM scim_group_members WHERE user_id = ?",
+		"UPDATE organization_scim SET video_successor_id = NULL WHERE video_successor_id = ?",
+		"DELETE FROM playback_sessions WHERE user_id = ?",
+		"DELETE FROM watch_progress WHERE user_id = ?",
+		"DELETE FROM watch_progress WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM watch_history WHERE user_id = ?",
+		"DELETE FROM watch_history WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM video_views WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM trending_videos WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM related_videos WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM related_videos WHERE related_video_id IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM video_translations WHERE video_id IN (SELECT id FROM videos WHERE user_id = ?)",
+		"DELETE FROM live_streams WHERE user_id = ?",
+		"DELETE FROM stream_keys WHERE user_id = ?",
+		"DELETE FROM organization_members WHERE user_id = ?",
+		"DELETE FROM notifications WHERE user_id = ?",
+		"DELETE FROM bandwidth_usage WHERE user_id = ?",
+		// the audit trail stays, but not where the user was
+		"UPDATE audit_log SET ip_address = '' WHERE user_id = ?",
+		"DELETE FROM videos WHERE user_id = ?",
+		"DELETE FROM users WHERE id = ?",
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(c.context(), statement, id.String()); err != nil {
+			return err
+		}
+	}
+
+	// organizations go away with their last member, and with them their
+	// IdP settings and SCIM credentials
+	rows, err := tx.QueryContext(c.context(), "SELECT id FROM organizations WHERE id NOT IN (SELECT organization_id FROM organization_members)")
+	if err != nil {
+		return err
+	}
+	var orphanedOrgIDs []string
+	for rows.Next() {
+		var orgID string
+		if err := rows.Scan(&orgID); err != nil {
+			rows.Close()
+			return err
+		}
+		orphanedOrgIDs = append(orphanedOrgIDs, orgID)
+	}
+	if err := rows.Close(); err != nil {
+		return err
+	}
+	orgStatements := []string{
+		"DELETE FROM organization_saml WHERE organization_id = ?",
+		"DELETE FROM saml_requests WHERE organization_id = ?",
+		"DELETE FROM organization_scim WHERE organization_id = ?",
+		"DELETE FROM scim_group_members WHERE group_id IN (SELECT id FROM scim_groups WHERE organization_id = ?)",
+		"DELETE FROM scim_groups WHERE organization_id = ?",
+		"DELETE FROM organizations WHERE id = ?",
+	}
+	for _, orgID := range orphanedOrgIDs {
+		for _, statement := range orgStatements {
+			if _, err := tx.ExecContext(c.context(), statement, orgID); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	c.videosChanged(changed)
+	return nil
+}
@@ -0,0 +1,56 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestDeleteUserDataRemovesOrganizationIdentitySettings(t *testing.T) {
+	c := newTestClient(t)
+	owner, err := c.CreateUser(CreateUserParams{Email: "owner@example.com", Password: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	org, err := c.CreateOrganization("Acme", owner.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.SetSAMLConfig(SAMLConfig{OrganizationID: org.ID, IDPEntityID: "https://idp.example.com", IDPSSOURL: "https://idp.example.com/sso", IDPCertificate: "cert"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetSCIMToken(org.ID, "token-hash"); err != nil {
+		t.Fatal(err)
+	}
+	group, err := c.CreateSCIMGroup(org.ID, "Editors", "", []uuid.UUID{owner.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.DeleteUserData(owner.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	scim, err := c.GetSCIMConfigByTokenHash("token-hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if scim.OrganizationID != uuid.Nil {
+		t.Error("the SCIM token still works for the deleted organization")
+	}
+	saml, err := c.GetSAMLConfig(org.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saml.IDPEntityID != "" {
+		t.Error("the deleted organization still has an IdP")
+	}
+	group, err = c.GetSCIMGroup(org.ID, group.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if group.ID != uuid.Nil {
+		t.Error("the deleted organization still has its SCIM group")
+	}
+}
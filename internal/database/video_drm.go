@@ -0,0 +1,69 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoDRM records where the encrypted renditions of a video live and which
+// key they were packaged with. The key itself stays with the key server.
+type VideoDRM struct {
+	VideoID        uuid.UUID `json:"video_id"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+	KeyID          uuid.UUID `json:"key_id"`
+	HLSKey         string    `json:"hls_key"`
+	DASHKey        string    `json:"dash_key"`
+	FairPlayKeyURI string    `json:"fairplay_key_uri"`
+}
+
+func (c Client) UpsertVideoDRM(drm VideoDRM) error {
+	query := `
+	INSERT INTO video_drm (
+		video_id,
+		created_at,
+		updated_at,
+		key_id,
+		hls_key,
+		dash_key,
+		fairplay_key_uri
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	ON CONFLICT(video_id) DO UPDATE SET
+		updated_at = CURRENT_TIMESTAMP,
+		key_id = excluded.key_id,
+		hls_key = excluded.hls_key,
+		dash_key = excluded.dash_key,
+		fairplay_key_uri = excluded.fairplay_key_uri
+	`
+	_, err := c.db.ExecContext(c.context(), query, drm.VideoID, drm.KeyID, drm.HLSKey, drm.DASHKey, drm.FairPlayKeyURI)
+	return err
+}
+
+func (c Client) GetVideoDRM(videoID uuid.UUID) (VideoDRM, error) {
+	query := `
+	SELECT video_id, created_at, updated_at, key_id, hls_key, dash_key, fairplay_key_uri
+	FROM video_drm
+	WHERE video_id = ?
+	`
+
+	var drm VideoDRM
+	err := c.db.QueryRowContext(c.context(), query, videoID).Scan(
+		&drm.VideoID,
+		&drm.CreatedAt,
+		&drm.UpdatedAt,
+		&drm.KeyID,
+		&drm.HLSKey,
+		&drm.DASHKey,
+		&drm.FairPlayKeyURI,
+	)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return VideoDRM{}, nil
+		}
+		return VideoDRM{}, err
+	}
+	return drm, nil
+}
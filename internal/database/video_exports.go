@@ -0,0 +1,195 @@
+package database
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type VideoExportStatus string
+
+const (
+	VideoExportStatusPending VideoExportStatus = "pending"
+	VideoExportStatusReady   VideoExportStatus = "ready"
+	VideoExportStatusFailed  VideoExportStatus = "failed"
+)
+
+// VideoExportOptions picks what goes in a download bundle besides the
+// metadata JSON.
+type VideoExportOptions struct {
+	// Renditions of the current version: sdr, hdr or original
+	Renditions []string `json:"renditions"`
+	// Captions are the languages of the captions included, nil for all
+	Captions  []string `json:"captions"`
+	Thumbnail bool     `json:"thumbnail"`
+}
+
+// VideoExport is a zip of a video's files assembled for download. The zip
+// is deleted at ExpiresAt, which is set once it's ready.
+type VideoExport struct {
+	ID        uuid.UUID          `json:"id"`
+	CreatedAt time.Time          `json:"created_at"`
+	UpdatedAt time.Time          `json:"updated_at"`
+	VideoID   uuid.UUID          `json:"video_id"`
+	UserID    uuid.UUID          `json:"user_id"`
+	Status    VideoExportStatus  `json:"status"`
+	Options   VideoExportOptions `json:"options"`
+	S3Key     *string            `json:"-"`
+	Error     *string            `json:"error"`
+	ExpiresAt *time.Time         `json:"expires_at"`
+}
+
+func (c Client) CreateVideoExport(videoID, userID uuid.UUID, options VideoExportOptions) (VideoExport, error) {
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		return VideoExport{}, err
+	}
+	id := uuid.New()
+	query := `
+	INSERT INTO video_exports (
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		status,
+		options
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?)
+	`
+	_, err = c.db.ExecContext(c.context(), query, id, videoID, userID, VideoExportStatusPending, string(encoded))
+	if err != nil {
+		return VideoExport{}, err
+	}
+
+	return c.GetVideoExport(id)
+}
+
+const videoExportColumns = `
+		id,
+		created_at,
+		updated_at,
+		video_id,
+		user_id,
+		status,
+		options,
+		s3_key,
+		error,
+		expires_at
+`
+
+func scanVideoExport(row interface{ Scan(...any) error }) (VideoExport, error) {
+	var export VideoExport
+	var options string
+	err := row.Scan(
+		&export.ID,
+		&export.CreatedAt,
+		&export.UpdatedAt,
+		&export.VideoID,
+		&export.UserID,
+		&export.Status,
+		&options,
+		&export.S3Key,
+		&export.Error,
+		&export.ExpiresAt,
+	)
+	if err != nil {
+		return VideoExport{}, err
+	}
+	if err := json.Unmarshal([]byte(options), &export.Options); err != nil {
+		return VideoExport{}, err
+	}
+	return export, nil
+}
+
+// GetVideoExport returns a zero VideoExport if there's none with the ID.
+func (c Client) GetVideoExport(id uuid.UUID) (VideoExport, error) {
+	query := `
+	SELECT` + videoExportColumns + `
+	FROM video_exports
+	WHERE id = ?
+	`
+	export, err := scanVideoExport(c.db.QueryRowContext(c.context(), query, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return VideoExport{}, nil
+	}
+	return export, err
+}
+
+func (c Client) CompleteVideoExport(id uuid.UUID, s3Key string, expiresAt time.Time) error {
+	query := `
+	UPDATE video_exports
+	SET
+		status = ?,
+		s3_key = ?,
+		expires_at = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, VideoExportStatusReady, s3Key, expiresAt.UTC(), id)
+	return err
+}
+
+func (c Client) FailVideoExport(id uuid.UUID, errMsg string) error {
+	query := `
+	UPDATE video_exports
+	SET
+		status = ?,
+		error = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, VideoExportStatusFailed, errMsg, id)
+	return err
+}
+
+// GetExpiredVideoExports returns the exports whose zip expired before the
+// time.
+func (c Client) GetExpiredVideoExports(before time.Time) ([]VideoExport, error) {
+	query := `
+	SELECT` + videoExportColumns + `
+	FROM video_exports
+	WHERE expires_at IS NOT NULL AND expires_at < ?
+	`
+	rows, err := c.db.QueryContext(c.context(), query, before.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	exports := []VideoExport{}
+	for rows.Next() {
+		export, err := scanVideoExport(rows)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, export)
+	}
+	return exports, rows.Err()
+}
+
+func (c Client) DeleteVideoExport(id uuid.UUID) error {
+	_, err := c.db.ExecContext(c.context(), "DELETE FROM video_exports WHERE id = ?", id)
+	return err
+}
+
+// GetAllVideoExportKeys returns the keys of every stored video export.
+func (c Client) GetAllVideoExportKeys() ([]string, error) {
+	rows, err := c.db.QueryContext(c.context(), "SELECT s3_key FROM video_exports WHERE s3_key IS NOT NULL")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
@@ -0,0 +1,86 @@
+package database
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// VideoTranslation is the title and description of a video in another
+// language than the one it was published in.
+type VideoTranslation struct {
+	VideoID uuid.UUID `json:"video_id"`
+	// Language is a BCP 47 tag like "en" or "pt-BR"
+	Language    string    `json:"language"`
+	Title       string    `json:"title"`
+	Description string    `json:"description"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// PutVideoTranslation adds the video's translation in the language or
+// replaces it.
+func (c Client) PutVideoTranslation(videoID uuid.UUID, language, title, description string) (VideoTranslation, error) {
+	query := `
+	INSERT INTO video_translations (
+		video_id,
+		language,
+		title,
+		description,
+		updated_at
+	) VALUES (?, ?, ?, ?, CURRENT_TIMESTAMP)
+	ON CONFLICT (video_id, language) DO UPDATE SET
+		title = excluded.title,
+		description = excluded.description,
+		updated_at = CURRENT_TIMESTAMP
+	`
+	_, err := c.db.ExecContext(c.context(), query, videoID, language, title, description)
+	if err != nil {
+		return VideoTranslation{}, err
+	}
+
+	var t VideoTranslation
+	query = `
+	SELECT video_id, language, title, description, updated_at
+	FROM video_translations
+	WHERE video_id = ? AND language = ?
+	`
+	err = c.db.QueryRowContext(c.context(), query, videoID, language).Scan(&t.VideoID, &t.Language, &t.Title, &t.Description, &t.UpdatedAt)
+	return t, err
+}
+
+// GetVideoTranslations returns the video's translations ordered by
+// language.
+func (c Client) GetVideoTranslations(videoID uuid.UUID) ([]VideoTranslation, error) {
+	query := `
+	SELECT video_id, language, title, description, updated_at
+	FROM video_translations
+	WHERE video_id = ?
+	ORDER BY language
+	`
+	rows, err := c.db.QueryContext(c.context(), query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	translations := []VideoTranslation{}
+	for rows.Next() {
+		var t VideoTranslation
+		if err := rows.Scan(&t.VideoID, &t.Language, &t.Title, &t.Description, &t.UpdatedAt); err != nil {
+			return nil, err
+		}
+		translations = append(translations, t)
+	}
+	return translations, rows.Err()
+}
+
+// DeleteVideoTranslation removes the video's translation in the language and
+// reports whether there was one.
+func (c Client) DeleteVideoTranslation(videoID uuid.UUID, language string) (bool, error) {
+	result, err := c.db.ExecContext(c.context(), "DELETE FROM video_translations WHERE video_id = ? AND language = ?", videoID, language)
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n > 0, err
+}
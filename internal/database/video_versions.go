@@ -0,0 +1,301 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type VideoVersion struct {
+	ID        uuid.UUID `json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	// ConfirmedAt is when an S3 event reported the object as created, nil
+	// without S3 event notifications
+	ConfirmedAt *time.Time `json:"confirmed_at"`
+	CreateVideoVersionParams
+}
+
+type CreateVideoVersionParams struct {
+	VideoID uuid.UUID `json:"video_id"`
+	Version int       `json:"version"`
+	S3Key   string    `json:"s3_key"`
+	// SizeBytes is 0 for versions uploaded before sizes were recorded
+	SizeBytes int64 `json:"size_bytes"`
+	// SourceKey is the untouched upload the version was processed from, nil
+	// when originals weren't kept
+	SourceKey        *string `json:"source_key"`
+	TranscodeProfile string  `json:"transcode_profile"`
+	// ChecksumSHA256 is the hex SHA-256 of the object at S3Key, nil for
+	// versions uploaded before checksums were recorded
+	ChecksumSHA256 *string `json:"checksum_sha256"`
+	// HDRKey is an HDR rendition of HDR sources, S3Key is always SDR
+	HDRKey *string `json:"hdr_key"`
+	// Loudness is what the source measured before loudness normalization,
+	// nil when the profile doesn't normalize
+	Loudness *Loudness `json:"loudness"`
+	// VideoBitrateKbps is the bitrate per-title encoding picked, nil for
+	// profiles with a fixed quality
+	VideoBitrateKbps *int `json:"video_bitrate_kbps"`
+	// DurationSeconds is nil for versions uploaded before durations were
+	// recorded or when the source didn't say
+	DurationSeconds *float64 `json:"duration_seconds"`
+}
+
+// Loudness is an EBU R128 measurement.
+type Loudness struct {
+	IntegratedLUFS float64 `json:"integrated_lufs"`
+	TruePeakDBTP   float64 `json:"true_peak_dbtp"`
+	RangeLU        float64 `json:"range_lu"`
+}
+
+const videoVersionColumns = `
+		id,
+		created_at,
+		video_id,
+		version,
+		s3_key,
+		size_bytes,
+		source_key,
+		transcode_profile,
+		checksum_sha256,
+		hdr_key,
+		loudness_integrated,
+		loudness_true_peak,
+		loudness_range,
+		video_bitrate_kbps,
+		duration_seconds,
+		confirmed_at
+`
+
+func scanVideoVersion(row interface{ Scan(...any) error }) (VideoVersion, error) {
+	var v VideoVersion
+	var integrated, truePeak, loudnessRange sql.NullFloat64
+	err := row.Scan(
+		&v.ID,
+		&v.CreatedAt,
+		&v.VideoID,
+		&v.Version,
+		&v.S3Key,
+		&v.SizeBytes,
+		&v.SourceKey,
+		&v.TranscodeProfile,
+		&v.ChecksumSHA256,
+		&v.HDRKey,
+		&integrated,
+		&truePeak,
+		&loudnessRange,
+		&v.VideoBitrateKbps,
+		&v.DurationSeconds,
+		&v.ConfirmedAt,
+	)
+	if integrated.Valid {
+		v.Loudness = &Loudness{
+			IntegratedLUFS: integrated.Float64,
+			TruePeakDBTP:   truePeak.Float64,
+			RangeLU:        loudnessRange.Float64,
+		}
+	}
+	return v, err
+}
+
+func (c Client) CreateVideoVersion(params CreateVideoVersionParams) (VideoVersion, error) {
+	id := uuid.New()
+	query := `
+	INSERT INTO video_versions (
+		id,
+		created_at,
+		video_id,
+		version,
+		s3_key,
+		size_bytes,
+		source_key,
+		transcode_profile,
+		checksum_sha256,
+		hdr_key,
+		loudness_integrated,
+		loudness_true_peak,
+		loudness_range,
+		video_bitrate_kbps,
+		duration_seconds
+	) VALUES (?, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`
+	var integrated, truePeak, loudnessRange *float64
+	if params.Loudness != nil {
+		integrated = &params.Loudness.IntegratedLUFS
+		truePeak = &params.Loudness.TruePeakDBTP
+		loudnessRange = &params.Loudness.RangeLU
+	}
+	_, err := c.db.ExecContext(
+		c.context(),
+		query,
+		id,
+		params.VideoID,
+		params.Version,
+		params.S3Key,
+		params.SizeBytes,
+		params.SourceKey,
+		params.TranscodeProfile,
+		params.ChecksumSHA256,
+		params.HDRKey,
+		integrated,
+		truePeak,
+		loudnessRange,
+		params.VideoBitrateKbps,
+		params.DurationSeconds,
+	)
+	if err != nil {
+		return VideoVersion{}, err
+	}
+
+	return c.GetVideoVersion(params.VideoID, params.Version)
+}
+
+func (c Client) GetVideoVersion(videoID uuid.UUID, version int) (VideoVersion, error) {
+	query := `
+	SELECT` + videoVersionColumns + `
+	FROM video_versions
+	WHERE video_id = ? AND version = ?
+	`
+
+	v, err := scanVideoVersion(c.db.QueryRowContext(c.context(), query, videoID, version))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return VideoVersion{}, nil
+		}
+		return VideoVersion{}, err
+	}
+	return v, nil
+}
+
+// GetVideoVersions returns the versions of a video, newest first.
+func (c Client) GetVideoVersions(videoID uuid.UUID) ([]VideoVersion, error) {
+	query := `
+	SELECT` + videoVersionColumns + `
+	FROM video_versions
+	WHERE video_id = ?
+	ORDER BY version DESC
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query, videoID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []VideoVersion{}
+	for rows.Next() {
+		v, err := scanVideoVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+
+	return versions, rows.Err()
+}
+
+// GetVideoVersionByKey returns the version stored at key, a zero VideoVersion
+// if there's none.
+func (c Client) GetVideoVersionByKey(key string) (VideoVersion, error) {
+	query := `
+	SELECT` + videoVersionColumns + `
+	FROM video_versions
+	WHERE s3_key = ?
+	`
+	v, err := scanVideoVersion(c.db.QueryRowContext(c.context(), query, key))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return VideoVersion{}, nil
+		}
+		return VideoVersion{}, err
+	}
+	return v, nil
+}
+
+func (c Client) ConfirmVideoVersion(id uuid.UUID) error {
+	query := `
+	UPDATE video_versions
+	SET confirmed_at = CURRENT_TIMESTAMP
+	WHERE id = ? AND confirmed_at IS NULL
+	`
+	_, err := c.db.ExecContext(c.context(), query, id)
+	return err
+}
+
+// GetAllVideoVersions returns the versions of every video, trashed ones
+// included.
+func (c Client) GetAllVideoVersions() ([]VideoVersion, error) {
+	query := `
+	SELECT` + videoVersionColumns + `
+	FROM video_versions
+	ORDER BY video_id, version
+	`
+	rows, err := c.db.QueryContext(c.context(), query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := []VideoVersion{}
+	for rows.Next() {
+		v, err := scanVideoVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+func (c Client) UpdateVideoVersionSize(id uuid.UUID, sizeBytes int64) error {
+	query := `
+	UPDATE video_versions
+	SET size_bytes = ?
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, sizeBytes, id)
+	return err
+}
+
+// MoveVideoVersion records new keys for the objects of a version. The video
+// follows when it plays the version, that is when its URL is still
+// oldVideoURL.
+func (c Client) MoveVideoVersion(id uuid.UUID, s3Key string, hdrKey *string, oldVideoURL, newVideoURL string) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+	UPDATE video_versions
+	SET s3_key = ?, hdr_key = ?
+	WHERE id = ?
+	`
+	if _, err := tx.ExecContext(c.context(), query, s3Key, hdrKey, id); err != nil {
+		return err
+	}
+	query = `
+	UPDATE videos
+	SET video_url = ?, updated_at = CURRENT_TIMESTAMP
+	WHERE id = (SELECT video_id FROM video_versions WHERE id = ?) AND video_url = ?
+	`
+	if _, err := tx.ExecContext(c.context(), query, newVideoURL, id, oldVideoURL); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	ids, err := c.changingVideos("SELECT video_id FROM video_versions WHERE id = ?", id)
+	c.videosChanged(ids)
+	return err
+}
+
+// DeleteVideoVersion removes the record of a single version, its objects
+// are left alone.
+func (c Client) DeleteVideoVersion(id uuid.UUID) error {
+	_, err := c.db.ExecContext(c.context(), "DELETE FROM video_versions WHERE id = ?", id)
+	return err
+}
@@ -2,6 +2,7 @@ package database
 
 import (
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"strings"
@@ -15,33 +16,180 @@ type Video struct {
 	CreatedAt    time.Time `json:"created_at"`
 	UpdatedAt    time.Time `json:"updated_at"`
 	ThumbnailURL *string   `json:"thumbnail_url"`
-	VideoURL     *string   `json:"video_url"`
+	// BlurredThumbnailURL is served instead of ThumbnailURL to viewers who
+	// haven't passed the age gate of an age-restricted video
+	BlurredThumbnailURL *string `json:"blurred_thumbnail_url"`
+	VideoURL            *string `json:"video_url"`
+	// ChecksumSHA256 is the hex SHA-256 of the file at VideoURL, so clients
+	// can verify their download
+	ChecksumSHA256 *string    `json:"checksum_sha256"`
+	DeletedAt      *time.Time `json:"deleted_at,omitempty"`
+	// ModerationStatus is only changed through SetVideoModerationStatus
+	ModerationStatus ModerationStatus `json:"moderation_status"`
+	// HLSPlaylistKey is only changed through ReplaceHLSKeys
+	HLSPlaylistKey *string `json:"-"`
+	// HLSWatermarked means the HLS rendition has A and B variants of every
+	// segment and its playlist is only served per viewer
+	HLSWatermarked bool `json:"-"`
+	// Processing is set while an uploaded file goes through the pipeline and
+	// is only changed through SetVideoProcessing
+	Processing bool `json:"processing"`
+	// ThumbnailGenerated means the thumbnail was grabbed from the video
+	// rather than uploaded, so it may be replaced by a better frame
+	ThumbnailGenerated bool `json:"thumbnail_generated"`
+	// ThumbnailVariantID is the A/B thumbnail variant being shown, nil when
+	// the thumbnail isn't one of the variants
+	ThumbnailVariantID *uuid.UUID `json:"thumbnail_variant_id"`
+	// AspectRatio is 16:9, 9:16 or other, and Orientation landscape,
+	// portrait or square. Both are probed from the uploaded file, nil
+	// before the first upload, and only changed through SetVideoAspect.
+	AspectRatio *string `json:"aspect_ratio"`
+	Orientation *string `json:"orientation"`
+	// CopyrightBlocked hides the video from everyone but its owner because
+	// it matched a registered work. It's only changed through
+	// SetVideoCopyrightBlocked.
+	CopyrightBlocked bool `json:"copyright_blocked"`
+	// ResumePosition is where the requesting user left off in seconds. It
+	// isn't stored with the video, handlers fill it in from watch progress.
+	ResumePosition *float64 `json:"resume_position,omitempty"`
+	// Language is the translation handlers showed the requesting viewer the
+	// title and description in, empty for the original. It isn't stored
+	// either.
+	Language string `json:"language,omitempty"`
 	CreateVideoParams
 }
 
+type Visibility string
+
+const (
+	VisibilityPublic  Visibility = "public"
+	VisibilityPrivate Visibility = "private"
+)
+
 type CreateVideoParams struct {
-	Title       string    `json:"title"`
-	Description string    `json:"description"`
-	UserID      uuid.UUID `json:"user_id"`
+	Title         string     `json:"title"`
+	Description   string     `json:"description"`
+	UserID        uuid.UUID  `json:"user_id"`
+	Visibility    Visibility `json:"visibility"`
+	PublishAt     *time.Time `json:"publish_at"`
+	AgeRestricted bool       `json:"age_restricted"`
+	// ISO 3166-1 alpha-2 country codes. An empty allow list allows everywhere
+	// that isn't on the block list.
+	AllowedCountries []string `json:"allowed_countries"`
+	BlockedCountries []string `json:"blocked_countries"`
+	// Tags are lower case, they relate videos to each other
+	Tags []string `json:"tags"`
+	// Metadata holds the integrator's own fields, like a course ID
+	Metadata map[string]string `json:"metadata"`
+	// ExternalID is the integrator's own ID for the video, unique among the
+	// videos of the owner's organization
+	ExternalID *string `json:"external_id"`
 }
 
-func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
-	query := `
-	SELECT
+const videoColumns = `
 		id,
 		created_at,
 		updated_at,
 		title,
 		description,
 		thumbnail_url,
+		blurred_thumbnail_url,
 		video_url,
-		user_id
-	FROM videos
-	WHERE user_id = ?
-	ORDER BY created_at DESC
-	`
+		user_id,
+		deleted_at,
+		visibility,
+		publish_at,
+		moderation_status,
+		age_restricted,
+		allowed_countries,
+		blocked_countries,
+		hls_playlist_key,
+		hls_watermarked,
+		processing,
+		thumbnail_generated,
+		checksum_sha256,
+		thumbnail_variant_id,
+		tags,
+		metadata,
+		external_id,
+		aspect_ratio,
+		orientation,
+		copyright_blocked
+`
+
+func scanVideo(row interface{ Scan(...any) error }) (Video, error) {
+	var (
+		video            Video
+		allowedCountries string
+		blockedCountries string
+		tags             string
+		metadata         []byte
+	)
+	err := row.Scan(
+		&video.ID,
+		&video.CreatedAt,
+		&video.UpdatedAt,
+		&video.Title,
+		&video.Description,
+		&video.ThumbnailURL,
+		&video.BlurredThumbnailURL,
+		&video.VideoURL,
+		&video.UserID,
+		&video.DeletedAt,
+		&video.Visibility,
+		&video.PublishAt,
+		&video.ModerationStatus,
+		&video.AgeRestricted,
+		&allowedCountries,
+		&blockedCountries,
+		&video.HLSPlaylistKey,
+		&video.HLSWatermarked,
+		&video.Processing,
+		&video.ThumbnailGenerated,
+		&video.ChecksumSHA256,
+		&video.ThumbnailVariantID,
+		&tags,
+		&metadata,
+		&video.ExternalID,
+		&video.AspectRatio,
+		&video.Orientation,
+		&video.CopyrightBlocked,
+	)
+	if err != nil {
+		return Video{}, err
+	}
+	video.AllowedCountries = splitList(allowedCountries)
+	video.BlockedCountries = splitList(blockedCountries)
+	video.Tags = splitList(tags)
+	video.Metadata = map[string]string{}
+	if err := json.Unmarshal(metadata, &video.Metadata); err != nil {
+		return Video{}, err
+	}
+	return video, nil
+}
+
+// country and tag lists are stored comma separated
+func joinList(list []string) string {
+	return strings.Join(list, ",")
+}
+
+func encodeMetadata(metadata map[string]string) (string, error) {
+	if metadata == nil {
+		metadata = map[string]string{}
+	}
+	dat, err := json.Marshal(metadata)
+	return string(dat), err
+}
+
+func splitList(list string) []string {
+	if list == "" {
+		return []string{}
+	}
+	return strings.Split(list, ",")
+}
 
-	rows, err := c.db.Query(query, userID)
+func (c Client) queryVideos(query string, args ...any) ([]Video, error) {
+	rows, err := c.db.QueryContext(c.context(), query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -49,17 +197,8 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 
 	videos := []Video{}
 	for rows.Next() {
-		var video Video
-		if err := rows.Scan(
-			&video.ID,
-			&video.CreatedAt,
-			&video.UpdatedAt,
-			&video.Title,
-			&video.Description,
-			&video.ThumbnailURL,
-			&video.VideoURL,
-			&video.UserID,
-		); err != nil {
+		video, err := scanVideo(rows)
+		if err != nil {
 			return nil, err
 		}
 
@@ -71,11 +210,105 @@ func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
 		videos = append(videos, video)
 	}
 
-	return videos, nil
+	return videos, rows.Err()
+}
+
+func (c Client) GetVideos(userID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ? AND deleted_at IS NULL
+	ORDER BY created_at DESC
+	`
+	return c.queryVideos(query, userID)
+}
+
+// GetPublicVideos returns the public videos of all users that aren't in the
+// trash, newest first. Moderation isn't checked.
+func (c Client) GetPublicVideos() ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE visibility = ? AND deleted_at IS NULL
+	ORDER BY created_at DESC
+	`
+	return c.queryVideos(query, VisibilityPublic)
+}
+
+// GetVideoByExternalID returns the video with the external ID among the
+// videos of the user's organization, or of the user alone when they aren't
+// in one. Trashed videos are included. It returns a zero Video if there's
+// none.
+func (c Client) GetVideoByExternalID(userID uuid.UUID, externalID string) (Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE external_id = ? AND user_id IN (
+		SELECT ?
+		UNION
+		SELECT user_id
+		FROM organization_members
+		WHERE organization_id = (SELECT organization_id FROM organization_members WHERE user_id = ?)
+	)
+	LIMIT 1
+	`
+	video, err := scanVideo(c.db.QueryRowContext(c.context(), query, externalID, userID, userID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Video{}, nil
+		}
+		return Video{}, err
+	}
+	return video, nil
+}
+
+func (c Client) GetTrashedVideos(userID uuid.UUID) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE user_id = ? AND deleted_at IS NOT NULL
+	ORDER BY deleted_at DESC
+	`
+	return c.queryVideos(query, userID)
+}
+
+// GetVideosTrashedBefore returns trashed videos of all users whose restore
+// window ended before the given time.
+func (c Client) GetVideosTrashedBefore(before time.Time) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE deleted_at IS NOT NULL AND deleted_at < ?
+	`
+	return c.queryVideos(query, before)
+}
+
+// GetAllVideos returns the videos of all users, trashed ones included.
+func (c Client) GetAllVideos() ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	ORDER BY created_at
+	`
+	return c.queryVideos(query)
+}
+
+// GetVideosDueForPublishing returns scheduled videos whose publish time has
+// passed.
+func (c Client) GetVideosDueForPublishing(now time.Time) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE publish_at IS NOT NULL AND publish_at <= ? AND deleted_at IS NULL
+	`
+	return c.queryVideos(query, now)
 }
 
 func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 	id := uuid.New()
+	if params.Visibility == "" {
+		params.Visibility = VisibilityPublic
+	}
 	query := `
 	INSERT INTO videos (
 		id,
@@ -83,42 +316,55 @@ func (c Client) CreateVideo(params CreateVideoParams) (Video, error) {
 		updated_at,
 		title,
 		description,
-		user_id
-	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?)
+		user_id,
+		visibility,
+		publish_at,
+		age_restricted,
+		allowed_countries,
+		blocked_countries,
+		tags,
+		metadata,
+		external_id,
+		test_data
+	) VALUES (?, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`
-	_, err := c.db.Exec(query, id, params.Title, params.Description, params.UserID)
+	metadata, err := encodeMetadata(params.Metadata)
 	if err != nil {
 		return Video{}, err
 	}
+	_, err = c.db.ExecContext(
+		c.context(),
+		query,
+		id,
+		params.Title,
+		params.Description,
+		params.UserID,
+		params.Visibility,
+		params.PublishAt,
+		params.AgeRestricted,
+		joinList(params.AllowedCountries),
+		joinList(params.BlockedCountries),
+		joinList(params.Tags),
+		metadata,
+		params.ExternalID,
+		c.testData,
+	)
+	if err != nil {
+		return Video{}, err
+	}
+	c.videoChanged(id)
 
 	return c.GetVideo(id)
 }
 
 func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	query := `
-	SELECT
-		id,
-		created_at,
-		updated_at,
-		title,
-		description,
-		thumbnail_url,
-		video_url,
-		user_id
+	SELECT` + videoColumns + `
 	FROM videos
 	WHERE id = ?
 	`
 
-	var video Video
-	err := c.db.QueryRow(query, id).Scan(
-		&video.ID,
-		&video.CreatedAt,
-		&video.UpdatedAt,
-		&video.Title,
-		&video.Description,
-		&video.ThumbnailURL,
-		&video.VideoURL,
-		&video.UserID)
+	video, err := scanVideo(c.db.QueryRowContext(c.context(), query, id))
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return Video{}, nil
@@ -129,6 +375,47 @@ func (c Client) GetVideo(id uuid.UUID) (Video, error) {
 	return video, nil
 }
 
+// WithVideoChangeHook returns a client that calls fn with the ID of every
+// video whose row it changes, so caches of videos can drop them.
+func (c Client) WithVideoChangeHook(fn func(id uuid.UUID)) Client {
+	c.onVideoChange = fn
+	return c
+}
+
+func (c Client) videoChanged(id uuid.UUID) {
+	if c.onVideoChange != nil {
+		c.onVideoChange(id)
+	}
+}
+
+// changingVideos selects the IDs of the videos a write that changes many at
+// once is about to change, nil when nobody listens for changes.
+func (c Client) changingVideos(query string, args ...any) ([]uuid.UUID, error) {
+	if c.onVideoChange == nil {
+		return nil, nil
+	}
+	rows, err := c.db.QueryContext(c.context(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (c Client) videosChanged(ids []uuid.UUID) {
+	for _, id := range ids {
+		c.videoChanged(id)
+	}
+}
+
 func (c Client) UpdateVideo(video Video) error {
 	query := `
 	UPDATE videos
@@ -136,28 +423,223 @@ func (c Client) UpdateVideo(video Video) error {
 		title = ?,
 		description = ?,
 		thumbnail_url = ?,
+		blurred_thumbnail_url = ?,
 		video_url = ?,
-		user_id = ?
+		checksum_sha256 = ?,
+		user_id = ?,
+		visibility = ?,
+		publish_at = ?,
+		age_restricted = ?,
+		allowed_countries = ?,
+		blocked_countries = ?,
+		thumbnail_generated = ?,
+		thumbnail_variant_id = ?,
+		tags = ?,
+		metadata = ?,
+		external_id = ?
 	WHERE id = ?
 	`
 
-	_, err := c.db.Exec(
+	metadata, err := encodeMetadata(video.Metadata)
+	if err != nil {
+		return err
+	}
+	_, err = c.db.ExecContext(
+		c.context(),
 		query,
 		video.Title,
 		video.Description,
 		&video.ThumbnailURL,
+		&video.BlurredThumbnailURL,
 		&video.VideoURL,
+		video.ChecksumSHA256,
 		video.UserID,
+		video.Visibility,
+		video.PublishAt,
+		video.AgeRestricted,
+		joinList(video.AllowedCountries),
+		joinList(video.BlockedCountries),
+		video.ThumbnailGenerated,
+		video.ThumbnailVariantID,
+		joinList(video.Tags),
+		metadata,
+		video.ExternalID,
 		video.ID,
 	)
+	c.videoChanged(video.ID)
 	return err
 }
 
-func (c Client) DeleteVideo(id uuid.UUID) error {
+func (c Client) SetVideoProcessing(id uuid.UUID, processing bool) error {
+	query := `
+	UPDATE videos
+	SET
+		processing = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, processing, id)
+	c.videoChanged(id)
+	return err
+}
+
+// SetVideoAspect records the shape of the video's current file.
+func (c Client) SetVideoAspect(id uuid.UUID, aspectRatio, orientation string) error {
+	query := `
+	UPDATE videos
+	SET
+		aspect_ratio = ?,
+		orientation = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, aspectRatio, orientation, id)
+	c.videoChanged(id)
+	return err
+}
+
+// SetVideoCopyrightBlocked blocks or releases the video after a content ID
+// check or a review of one.
+func (c Client) SetVideoCopyrightBlocked(id uuid.UUID, blocked bool) error {
 	query := `
-	DELETE FROM videos
+	UPDATE videos
+	SET
+		copyright_blocked = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, blocked, id)
+	c.videoChanged(id)
+	return err
+}
+
+// PublishVideo makes a scheduled video public and clears its schedule.
+func (c Client) PublishVideo(id uuid.UUID) error {
+	query := `
+	UPDATE videos
+	SET
+		visibility = ?,
+		publish_at = NULL,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, VisibilityPublic, id)
+	c.videoChanged(id)
+	return err
+}
+
+func (c Client) TrashVideo(id uuid.UUID) error {
+	query := `
+	UPDATE videos
+	SET
+		deleted_at = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, time.Now().UTC(), id)
+	c.videoChanged(id)
+	return err
+}
+
+func (c Client) RestoreVideo(id uuid.UUID) error {
+	query := `
+	UPDATE videos
+	SET
+		deleted_at = NULL,
+		updated_at = CURRENT_TIMESTAMP
 	WHERE id = ?
 	`
-	_, err := c.db.Exec(query, id)
+	_, err := c.db.ExecContext(c.context(), query, id)
+	c.videoChanged(id)
 	return err
 }
+
+// DeleteVideo permanently removes the video and the rows that reference it.
+func (c Client) DeleteVideo(id uuid.UUID) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		"DELETE FROM jobs WHERE video_id = ?",
+		"DELETE FROM upload_sessions WHERE video_id = ?",
+		"DELETE FROM upload_grants WHERE video_id = ?",
+		"DELETE FROM video_versions WHERE video_id = ?",
+		"DELETE FROM moderation_labels WHERE video_id = ?",
+		"DELETE FROM thumbnail_variants WHERE video_id = ?",
+		"DELETE FROM thumbnail_candidates WHERE video_id = ?",
+		"DELETE FROM video_drm WHERE video_id = ?",
+		"DELETE FROM hls_keys WHERE video_id = ?",
+		"DELETE FROM audio_tracks WHERE video_id = ?",
+		"DELETE FROM caption_cues WHERE video_id = ?",
+		"DELETE FROM video_chapters WHERE video_id = ?",
+		"DELETE FROM perceptual_hashes WHERE video_id = ?",
+		"DELETE FROM duplicate_videos WHERE video_id = ?",
+		"DELETE FROM duplicate_videos WHERE duplicate_of = ?",
+		"DELETE FROM content_id_reports WHERE video_id = ?",
+		"DELETE FROM video_exports WHERE video_id = ?",
+		"DELETE FROM watch_progress WHERE video_id = ?",
+		"DELETE FROM watch_history WHERE video_id = ?",
+		"DELETE FROM video_views WHERE video_id = ?",
+		"DELETE FROM trending_videos WHERE video_id = ?",
+		"DELETE FROM related_videos WHERE video_id = ?",
+		"DELETE FROM related_videos WHERE related_video_id = ?",
+		"DELETE FROM video_translations WHERE video_id = ?",
+		"DELETE FROM videos WHERE id = ?",
+	}
+	for _, statement := range statements {
+		if _, err := tx.ExecContext(c.context(), statement, id); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	c.videoChanged(id)
+	return nil
+}
+
+// RetranscodeFilter narrows down the videos a bulk re-transcode applies to.
+// Zero fields match every video.
+type RetranscodeFilter struct {
+	UserID        *uuid.UUID `json:"user_id"`
+	CreatedAfter  *time.Time `json:"created_after"`
+	CreatedBefore *time.Time `json:"created_before"`
+	// CurrentProfile matches videos whose latest version was processed with
+	// this transcode profile
+	CurrentProfile string `json:"current_profile"`
+}
+
+// GetVideosForRetranscode returns videos with an uploaded file that aren't
+// in the trash and match the filter, oldest first.
+func (c Client) GetVideosForRetranscode(filter RetranscodeFilter, limit int) ([]Video, error) {
+	query := `
+	SELECT` + videoColumns + `
+	FROM videos
+	WHERE video_url IS NOT NULL
+		AND deleted_at IS NULL
+		AND (? IS NULL OR user_id = ?)
+		AND (? IS NULL OR created_at > ?)
+		AND (? IS NULL OR created_at < ?)
+		AND (? = '' OR ? = (
+			SELECT transcode_profile
+			FROM video_versions
+			WHERE video_id = videos.id
+			ORDER BY version DESC
+			LIMIT 1
+		))
+	ORDER BY created_at
+	LIMIT ?
+	`
+	return c.queryVideos(
+		query,
+		filter.UserID, filter.UserID,
+		filter.CreatedAfter, filter.CreatedAfter,
+		filter.CreatedBefore, filter.CreatedBefore,
+		filter.CurrentProfile, filter.CurrentProfile,
+		limit,
+	)
+}
@@ -0,0 +1,131 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// WatchHistoryEntry is a video the user started playing.
+type WatchHistoryEntry struct {
+	ID        uuid.UUID `json:"id"`
+	WatchedAt time.Time `json:"watched_at"`
+	VideoID   uuid.UUID `json:"video_id"`
+}
+
+// RecordWatchHistory adds the video to the user's history unless they
+// turned history off. Starting the same video again within window only
+// moves its entry to the top.
+func (c Client) RecordWatchHistory(userID, videoID uuid.UUID, window time.Duration) error {
+	tx, err := c.db.BeginTx(c.context(), nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// watched_at is written with CURRENT_TIMESTAMP, so compare it to
+	// SQLite's clock in the same format
+	query := `
+	UPDATE watch_history
+	SET watched_at = CURRENT_TIMESTAMP
+	WHERE user_id = ? AND video_id = ? AND watched_at > datetime('now', ?)
+		AND (SELECT watch_history_enabled FROM users WHERE id = ?)
+	`
+	result, err := tx.ExecContext(c.context(), query, userID, videoID, secondsAgo(window), userID)
+	if err != nil {
+		return err
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if updated == 0 {
+		query = `
+		INSERT INTO watch_history (
+			id,
+			user_id,
+			video_id,
+			watched_at
+		)
+		SELECT ?, ?, ?, CURRENT_TIMESTAMP
+		WHERE (SELECT watch_history_enabled FROM users WHERE id = ?)
+		`
+		_, err = tx.ExecContext(c.context(), query, uuid.New(), userID, videoID, userID)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetWatchHistory returns up to limit of the user's entries, newest first,
+// starting after the entry with the ID after. A limit of 0 returns them all.
+func (c Client) GetWatchHistory(userID uuid.UUID, after *uuid.UUID, limit int) ([]WatchHistoryEntry, error) {
+	if limit <= 0 {
+		// SQLite's way of saying no limit
+		limit = -1
+	}
+	query := `
+	SELECT id, watched_at, video_id
+	FROM watch_history
+	WHERE user_id = ?
+		AND (? IS NULL OR (watched_at, id) < (SELECT watched_at, id FROM watch_history WHERE id = ?))
+	ORDER BY watched_at DESC, id DESC
+	LIMIT ?
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query, userID, after, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []WatchHistoryEntry{}
+	for rows.Next() {
+		var e WatchHistoryEntry
+		if err := rows.Scan(&e.ID, &e.WatchedAt, &e.VideoID); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// WatchHistoryEntryExists tells cursors of the user's history apart from
+// stale or foreign ones.
+func (c Client) WatchHistoryEntryExists(userID, id uuid.UUID) (bool, error) {
+	var exists bool
+	err := c.db.QueryRowContext(c.context(), "SELECT TRUE FROM watch_history WHERE id = ? AND user_id = ?", id, userID).Scan(&exists)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return exists, err
+}
+
+func (c Client) ClearWatchHistory(userID uuid.UUID) error {
+	_, err := c.db.ExecContext(c.context(), "DELETE FROM watch_history WHERE user_id = ?", userID)
+	return err
+}
+
+func (c Client) GetWatchHistoryEnabled(userID uuid.UUID) (bool, error) {
+	var enabled bool
+	err := c.db.QueryRowContext(c.context(), "SELECT watch_history_enabled FROM users WHERE id = ?", userID).Scan(&enabled)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+	return enabled, err
+}
+
+func (c Client) SetWatchHistoryEnabled(userID uuid.UUID, enabled bool) error {
+	query := `
+	UPDATE users
+	SET
+		watch_history_enabled = ?,
+		updated_at = CURRENT_TIMESTAMP
+	WHERE id = ?
+	`
+	_, err := c.db.ExecContext(c.context(), query, enabled, userID)
+	return err
+}
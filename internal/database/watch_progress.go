@@ -0,0 +1,83 @@
+package database
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// SetWatchProgress records where the user is in the video, in seconds.
+func (c Client) SetWatchProgress(userID, videoID uuid.UUID, seconds float64) error {
+	query := `
+	INSERT INTO watch_progress (
+		user_id,
+		video_id,
+		position_seconds,
+		updated_at
+	) VALUES (?, ?, ?, CURRENT_TIMESTAMP)
+	ON CONFLICT (user_id, video_id) DO UPDATE SET
+		position_seconds = excluded.position_seconds,
+		updated_at = CURRENT_TIMESTAMP
+	`
+	_, err := c.db.ExecContext(c.context(), query, userID, videoID, seconds)
+	return err
+}
+
+func (c Client) DeleteWatchProgress(userID, videoID uuid.UUID) error {
+	_, err := c.db.ExecContext(c.context(), "DELETE FROM watch_progress WHERE user_id = ? AND video_id = ?", userID, videoID)
+	return err
+}
+
+// GetWatchProgress returns the user's positions in the videos, videos they
+// haven't watched are left out.
+func (c Client) GetWatchProgress(userID uuid.UUID, videoIDs []uuid.UUID) (map[uuid.UUID]float64, error) {
+	positions := map[uuid.UUID]float64{}
+	if len(videoIDs) == 0 {
+		return positions, nil
+	}
+
+	args := []any{userID}
+	for _, id := range videoIDs {
+		args = append(args, id)
+	}
+	query := `
+	SELECT video_id, position_seconds
+	FROM watch_progress
+	WHERE user_id = ? AND video_id IN (?` + strings.Repeat(", ?", len(videoIDs)-1) + `)
+	`
+
+	rows, err := c.db.QueryContext(c.context(), query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			videoID uuid.UUID
+			seconds float64
+		)
+		if err := rows.Scan(&videoID, &seconds); err != nil {
+			return nil, err
+		}
+		positions[videoID] = seconds
+	}
+	return positions, rows.Err()
+}
+
+// CompactWatchProgress drops progress in videos that are trashed or gone
+// and progress nobody updated for longer than age. It returns how many rows
+// were removed.
+func (c Client) CompactWatchProgress(age time.Duration) (int64, error) {
+	query := `
+	DELETE FROM watch_progress
+	WHERE updated_at < datetime('now', ?)
+		OR video_id NOT IN (SELECT id FROM videos WHERE deleted_at IS NULL)
+	`
+	result, err := c.db.ExecContext(c.context(), query, secondsAgo(age))
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,92 @@
+package geoip
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/netip"
+	"os"
+	"sort"
+	"strings"
+)
+
+// DB maps IP addresses to ISO 3166-1 alpha-2 country codes. It's loaded from
+// a CSV file with "ip_start,ip_end,country" rows, the format of the free
+// DB-IP "IP to Country Lite" database. Both IPv4 and IPv6 ranges are supported.
+type DB struct {
+	ranges []ipRange
+}
+
+type ipRange struct {
+	start   netip.Addr
+	end     netip.Addr
+	country string
+}
+
+func Open(path string) (*DB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+
+	db := &DB{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 3 {
+			return nil, fmt.Errorf("line %d: expected ip_start,ip_end,country", line)
+		}
+
+		start, err := netip.ParseAddr(record[0])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		end, err := netip.ParseAddr(record[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		db.ranges = append(db.ranges, ipRange{
+			start:   start.Unmap(),
+			end:     end.Unmap(),
+			country: strings.ToUpper(record[2]),
+		})
+	}
+
+	sort.Slice(db.ranges, func(i, j int) bool {
+		return db.ranges[i].start.Less(db.ranges[j].start)
+	})
+	return db, nil
+}
+
+// Country returns the country code for the address, or "" when it isn't
+// covered by the database.
+func (db *DB) Country(addr netip.Addr) string {
+	if db == nil {
+		return ""
+	}
+	addr = addr.Unmap()
+
+	// find the last range starting at or before addr
+	i := sort.Search(len(db.ranges), func(i int) bool {
+		return addr.Less(db.ranges[i].start)
+	}) - 1
+	if i < 0 {
+		return ""
+	}
+	r := db.ranges[i]
+	if addr.BitLen() != r.start.BitLen() || r.end.Less(addr) {
+		return ""
+	}
+	return r.country
+}
@@ -0,0 +1,26 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+)
+
+// Provider answers a prompt with a large language model, following the
+// system instructions. Implementations must be safe for concurrent use.
+type Provider interface {
+	Complete(ctx context.Context, system, prompt string) (string, error)
+}
+
+// DecodeJSON decodes the JSON object in a reply. Models like to wrap it in
+// a code fence or a sentence, so anything around the outermost braces is
+// ignored.
+func DecodeJSON(reply string, v any) error {
+	start := strings.Index(reply, "{")
+	end := strings.LastIndex(reply, "}")
+	if start < 0 || end < start {
+		return errors.New("reply has no JSON object")
+	}
+	return json.Unmarshal([]byte(reply[start:end+1]), v)
+}
@@ -0,0 +1,26 @@
+package moderation
+
+import (
+	"context"
+)
+
+// Label is a single finding returned by a moderation provider. Confidence is
+// a percentage between 0 and 100.
+type Label struct {
+	Name       string  `json:"name"`
+	ParentName string  `json:"parent_name,omitempty"`
+	Confidence float64 `json:"confidence"`
+}
+
+// Moderator scans an image and returns the moderation labels it found.
+// Implementations must be safe for concurrent use.
+type Moderator interface {
+	ScanImage(ctx context.Context, image []byte) ([]Label, error)
+}
+
+// Noop never flags anything. It's used when no provider is configured.
+type Noop struct{}
+
+func (Noop) ScanImage(ctx context.Context, image []byte) ([]Label, error) {
+	return nil, nil
+}
@@ -0,0 +1,104 @@
+package moderation
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+)
+
+// Rekognition calls the AWS Rekognition DetectModerationLabels API. The
+// request is signed directly so we don't pull in the whole service client
+// for a single operation.
+type Rekognition struct {
+	awsConfig     aws.Config
+	minConfidence float64
+	httpClient    *http.Client
+}
+
+func NewRekognition(awsConfig aws.Config, minConfidence float64) *Rekognition {
+	return &Rekognition{
+		awsConfig:     awsConfig,
+		minConfidence: minConfidence,
+		httpClient:    &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+func (r *Rekognition) ScanImage(ctx context.Context, image []byte) ([]Label, error) {
+	type imageParam struct {
+		Bytes []byte `json:"Bytes"`
+	}
+	type request struct {
+		Image         imageParam `json:"Image"`
+		MinConfidence float64    `json:"MinConfidence"`
+	}
+	type response struct {
+		ModerationLabels []struct {
+			Name       string  `json:"Name"`
+			ParentName string  `json:"ParentName"`
+			Confidence float64 `json:"Confidence"`
+		} `json:"ModerationLabels"`
+	}
+
+	// encoding/json base64-encodes byte slices, which is what the API expects
+	body, err := json.Marshal(request{
+		Image:         imageParam{Bytes: image},
+		MinConfidence: r.minConfidence,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := fmt.Sprintf("https://rekognition.%s.amazonaws.com/", r.awsConfig.Region)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "RekognitionService.DetectModerationLabels")
+
+	creds, err := r.awsConfig.Credentials.Retrieve(ctx)
+	if err != nil {
+		return nil, err
+	}
+	payloadHash := sha256.Sum256(body)
+	err = v4.NewSigner().SignHTTP(ctx, creds, req, hex.EncodeToString(payloadHash[:]), "rekognition", r.awsConfig.Region, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("rekognition responded with %s: %s", resp.Status, msg)
+	}
+
+	var out response
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	if err != nil {
+		return nil, err
+	}
+
+	labels := make([]Label, 0, len(out.ModerationLabels))
+	for _, l := range out.ModerationLabels {
+		labels = append(labels, Label{
+			Name:       l.Name,
+			ParentName: l.ParentName,
+			Confidence: l.Confidence,
+		})
+	}
+	return labels, nil
+}
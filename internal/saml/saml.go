@@ -0,0 +1,402 @@
+// Package saml is a minimal SAML 2.0 service provider: it builds
+// AuthnRequests for the HTTP-Redirect binding, describes itself in metadata
+// and checks signed Responses that arrive over the HTTP-POST binding.
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	nsProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	nsAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	nsMetadata  = "urn:oasis:names:tc:SAML:2.0:metadata"
+
+	bindingPOST = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+
+	statusSuccess      = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	methodBearer       = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+	nameIDFormatEmail  = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	nameIDFormatEntity = "urn:oasis:names:tc:SAML:2.0:nameid-format:entity"
+
+	// how far the IdP's clock may be from ours
+	clockSkew = 3 * time.Minute
+	// largest Response accepted, decoded
+	maxResponseBytes = 256 << 10
+)
+
+// ServiceProvider is our side of a trust relationship with one IdP.
+type ServiceProvider struct {
+	EntityID       string
+	ACSURL         string
+	IDPEntityID    string
+	IDPSSOURL      string
+	IDPCertificate *x509.Certificate
+}
+
+// Assertion is what a verified Response says about the user.
+type Assertion struct {
+	InResponseTo string
+	NameID       string
+	Attributes   map[string][]string
+}
+
+// NewRequestID returns an ID for an AuthnRequest. XML IDs can't start with a
+// digit, hence the prefix.
+func NewRequestID() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "id-" + hex.EncodeToString(b), nil
+}
+
+// ParseCertificate reads a certificate as PEM, or as the bare base64 DER
+// found in IdP metadata.
+func ParseCertificate(s string) (*x509.Certificate, error) {
+	var der []byte
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("expected a certificate, got %s", block.Type)
+		}
+		der = block.Bytes
+	} else {
+		decoded, err := decodeBase64(s)
+		if err != nil {
+			return nil, errors.New("certificate is neither PEM nor base64")
+		}
+		der = decoded
+	}
+	return x509.ParseCertificate(der)
+}
+
+// Metadata describes the SP, for the IdP administrator to import.
+func (sp ServiceProvider) Metadata() ([]byte, error) {
+	type acs struct {
+		Binding  string `xml:"Binding,attr"`
+		Location string `xml:"Location,attr"`
+		Index    int    `xml:"index,attr"`
+	}
+	type spDescriptor struct {
+		AuthnRequestsSigned      bool     `xml:"AuthnRequestsSigned,attr"`
+		WantAssertionsSigned     bool     `xml:"WantAssertionsSigned,attr"`
+		ProtocolSupport          string   `xml:"protocolSupportEnumeration,attr"`
+		NameIDFormat             []string `xml:"md:NameIDFormat"`
+		AssertionConsumerService acs      `xml:"md:AssertionConsumerService"`
+	}
+	type entityDescriptor struct {
+		XMLName  xml.Name     `xml:"md:EntityDescriptor"`
+		XMLNS    string       `xml:"xmlns:md,attr"`
+		EntityID string       `xml:"entityID,attr"`
+		SP       spDescriptor `xml:"md:SPSSODescriptor"`
+	}
+
+	out, err := xml.MarshalIndent(entityDescriptor{
+		XMLNS:    nsMetadata,
+		EntityID: sp.EntityID,
+		SP: spDescriptor{
+			WantAssertionsSigned: true,
+			ProtocolSupport:      nsProtocol,
+			NameIDFormat:         []string{nameIDFormatEmail},
+			AssertionConsumerService: acs{
+				Binding:  bindingPOST,
+				Location: sp.ACSURL,
+				Index:    0,
+			},
+		},
+	}, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), out...), nil
+}
+
+// AuthnRequestURL is where to send the browser to sign in at the IdP, with
+// the request in the query as the HTTP-Redirect binding wants it. The
+// request is unsigned; the IdP sends the user back to our registered ACS.
+func (sp ServiceProvider) AuthnRequestURL(requestID, relayState string, now time.Time) (string, error) {
+	type issuer struct {
+		XMLNS string `xml:"xmlns:saml,attr"`
+		Value string `xml:",chardata"`
+	}
+	type nameIDPolicy struct {
+		Format      string `xml:"Format,attr"`
+		AllowCreate bool   `xml:"AllowCreate,attr"`
+	}
+	type authnRequest struct {
+		XMLName                     xml.Name     `xml:"samlp:AuthnRequest"`
+		XMLNS                       string       `xml:"xmlns:samlp,attr"`
+		ID                          string       `xml:"ID,attr"`
+		Version                     string       `xml:"Version,attr"`
+		IssueInstant                string       `xml:"IssueInstant,attr"`
+		Destination                 string       `xml:"Destination,attr"`
+		ProtocolBinding             string       `xml:"ProtocolBinding,attr"`
+		AssertionConsumerServiceURL string       `xml:"AssertionConsumerServiceURL,attr"`
+		Issuer                      issuer       `xml:"saml:Issuer"`
+		NameIDPolicy                nameIDPolicy `xml:"samlp:NameIDPolicy"`
+	}
+
+	out, err := xml.Marshal(authnRequest{
+		XMLNS:                       nsProtocol,
+		ID:                          requestID,
+		Version:                     "2.0",
+		IssueInstant:                now.UTC().Format(time.RFC3339),
+		Destination:                 sp.IDPSSOURL,
+		ProtocolBinding:             bindingPOST,
+		AssertionConsumerServiceURL: sp.ACSURL,
+		Issuer:                      issuer{XMLNS: nsAssertion, Value: sp.EntityID},
+		NameIDPolicy:                nameIDPolicy{Format: nameIDFormatEmail, AllowCreate: true},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var deflated bytes.Buffer
+	w, err := flate.NewWriter(&deflated, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(out); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(sp.IDPSSOURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid IdP SSO URL: %w", err)
+	}
+	query := u.Query()
+	query.Set("SAMLRequest", base64.StdEncoding.EncodeToString(deflated.Bytes()))
+	if relayState != "" {
+		query.Set("RelayState", relayState)
+	}
+	u.RawQuery = query.Encode()
+	return u.String(), nil
+}
+
+// ParseResponse checks a base64 encoded Response from the ACS form post and
+// returns its assertion. The Response or the assertion must be signed by
+// the IdP; the user is only ever read from a signed assertion.
+func (sp ServiceProvider) ParseResponse(encoded string, now time.Time) (*Assertion, error) {
+	if sp.IDPCertificate == nil {
+		return nil, errors.New("no IdP certificate")
+	}
+	// leaves room for line breaks in the base64
+	if len(encoded) > 2*maxResponseBytes {
+		return nil, errors.New("response is too large")
+	}
+	data, err := decodeBase64(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("response isn't base64: %w", err)
+	}
+	root, err := parseXML(data)
+	if err != nil {
+		return nil, fmt.Errorf("response isn't valid XML: %w", err)
+	}
+	if !root.is(nsProtocol, "Response") {
+		return nil, errors.New("not a SAML response")
+	}
+
+	// signature wrapping attacks rely on an ID appearing twice
+	ids := map[string]bool{}
+	duplicate := false
+	root.walk(func(e *element) {
+		if id, ok := e.attr("ID"); ok {
+			duplicate = duplicate || ids[id]
+			ids[id] = true
+		}
+	})
+	if duplicate {
+		return nil, errors.New("duplicate IDs in response")
+	}
+
+	if version, _ := root.attr("Version"); version != "2.0" {
+		return nil, errors.New("unsupported SAML version")
+	}
+	if destination, ok := root.attr("Destination"); ok && destination != sp.ACSURL {
+		return nil, errors.New("response is meant for another destination")
+	}
+	if status := root.child(nsProtocol, "Status"); status != nil {
+		code := status.child(nsProtocol, "StatusCode")
+		if code == nil {
+			return nil, errors.New("response has no status code")
+		}
+		if value, _ := code.attr("Value"); value != statusSuccess {
+			return nil, fmt.Errorf("IdP refused the login: %s", value)
+		}
+	} else {
+		return nil, errors.New("response has no status")
+	}
+
+	if len(root.childElements(nsAssertion, "EncryptedAssertion")) > 0 {
+		return nil, errors.New("encrypted assertions aren't supported")
+	}
+	assertion := root.child(nsAssertion, "Assertion")
+	if assertion == nil {
+		return nil, errors.New("response must hold exactly one assertion")
+	}
+
+	responseErr := verifySignature(root, sp.IDPCertificate)
+	if responseErr != nil && responseErr != errNotSigned {
+		return nil, fmt.Errorf("response: %w", responseErr)
+	}
+	assertionErr := verifySignature(assertion, sp.IDPCertificate)
+	if assertionErr != nil && assertionErr != errNotSigned {
+		return nil, fmt.Errorf("assertion: %w", assertionErr)
+	}
+	if responseErr == errNotSigned && assertionErr == errNotSigned {
+		return nil, errors.New("response isn't signed")
+	}
+
+	if issuer := root.child(nsAssertion, "Issuer"); issuer != nil && issuer.text() != sp.IDPEntityID {
+		return nil, errors.New("response is from another IdP")
+	}
+	return sp.checkAssertion(assertion, root, now)
+}
+
+func (sp ServiceProvider) checkAssertion(assertion, response *element, now time.Time) (*Assertion, error) {
+	issuer := assertion.child(nsAssertion, "Issuer")
+	if issuer == nil || issuer.text() != sp.IDPEntityID {
+		return nil, errors.New("assertion is from another IdP")
+	}
+
+	conditions := assertion.child(nsAssertion, "Conditions")
+	if conditions == nil {
+		return nil, errors.New("assertion has no conditions")
+	}
+	if err := checkWindow(conditions, now); err != nil {
+		return nil, err
+	}
+	audienceOK := false
+	for _, restriction := range conditions.childElements(nsAssertion, "AudienceRestriction") {
+		for _, audience := range restriction.childElements(nsAssertion, "Audience") {
+			if audience.text() == sp.EntityID {
+				audienceOK = true
+			}
+		}
+	}
+	if !audienceOK {
+		return nil, errors.New("assertion is meant for another audience")
+	}
+
+	subject := assertion.child(nsAssertion, "Subject")
+	if subject == nil {
+		return nil, errors.New("assertion has no subject")
+	}
+	nameID := subject.child(nsAssertion, "NameID")
+	if nameID == nil || nameID.text() == "" {
+		return nil, errors.New("assertion has no NameID")
+	}
+	if format, _ := nameID.attr("Format"); format == nameIDFormatEntity {
+		return nil, errors.New("NameID doesn't identify a user")
+	}
+
+	// a bearer confirmation says who may present the assertion, and until
+	// when
+	inResponseTo := ""
+	confirmed := false
+	for _, confirmation := range subject.childElements(nsAssertion, "SubjectConfirmation") {
+		if method, _ := confirmation.attr("Method"); method != methodBearer {
+			continue
+		}
+		data := confirmation.child(nsAssertion, "SubjectConfirmationData")
+		if data == nil {
+			continue
+		}
+		if recipient, _ := data.attr("Recipient"); recipient != sp.ACSURL {
+			continue
+		}
+		notOnOrAfter, ok := data.attr("NotOnOrAfter")
+		if !ok {
+			continue
+		}
+		expires, err := time.Parse(time.RFC3339, notOnOrAfter)
+		if err != nil || !now.Before(expires.Add(clockSkew)) {
+			continue
+		}
+		// bearer data with NotBefore is invalid per the profile
+		if _, ok := data.attr("NotBefore"); ok {
+			continue
+		}
+		inResponseTo, _ = data.attr("InResponseTo")
+		confirmed = true
+		break
+	}
+	if !confirmed {
+		return nil, errors.New("assertion has no valid bearer confirmation")
+	}
+	if responseTo, ok := response.attr("InResponseTo"); ok && responseTo != inResponseTo {
+		return nil, errors.New("response and assertion answer different requests")
+	}
+	if inResponseTo == "" {
+		return nil, errors.New("IdP initiated logins aren't supported")
+	}
+
+	attributes := map[string][]string{}
+	for _, statement := range assertion.childElements(nsAssertion, "AttributeStatement") {
+		for _, attribute := range statement.childElements(nsAssertion, "Attribute") {
+			name, _ := attribute.attr("Name")
+			if name == "" {
+				continue
+			}
+			for _, value := range attribute.childElements(nsAssertion, "AttributeValue") {
+				attributes[name] = append(attributes[name], value.text())
+			}
+		}
+	}
+
+	return &Assertion{
+		InResponseTo: inResponseTo,
+		NameID:       nameID.text(),
+		Attributes:   attributes,
+	}, nil
+}
+
+// checkWindow checks now is within the NotBefore and NotOnOrAfter of the
+// element, allowing for clock skew.
+func checkWindow(e *element, now time.Time) error {
+	if value, ok := e.attr("NotBefore"); ok {
+		notBefore, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return fmt.Errorf("invalid NotBefore: %w", err)
+		}
+		if now.Add(clockSkew).Before(notBefore) {
+			return errors.New("assertion isn't valid yet")
+		}
+	}
+	if value, ok := e.attr("NotOnOrAfter"); ok {
+		notOnOrAfter, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return fmt.Errorf("invalid NotOnOrAfter: %w", err)
+		}
+		if !now.Add(-clockSkew).Before(notOnOrAfter) {
+			return errors.New("assertion has expired")
+		}
+	}
+	return nil
+}
+
+// FirstAttribute returns the first value of an attribute, case-insensitively
+// by name since IdPs differ.
+func (a *Assertion) FirstAttribute(name string) string {
+	for n, values := range a.Attributes {
+		if strings.EqualFold(n, name) && len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,294 @@
+package saml
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testSPEntityID  = "https://tubely.example.com/saml/org/metadata"
+	testACSURL      = "https://tubely.example.com/saml/org/acs"
+	testIDPEntityID = "https://idp.example.com"
+	testRequestID   = "id-4f6e0c0b2a"
+)
+
+var testNow = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func testSP(idp testIdP) ServiceProvider {
+	return ServiceProvider{
+		EntityID:       testSPEntityID,
+		ACSURL:         testACSURL,
+		IDPEntityID:    testIDPEntityID,
+		IDPSSOURL:      "https://idp.example.com/sso",
+		IDPCertificate: idp.cert,
+	}
+}
+
+// testAssertion is an assertion about nameID, with a signature marker.
+func testAssertion(id, nameID string) string {
+	return `<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="` + id + `" Version="2.0" IssueInstant="2026-03-01T11:59:50Z">` +
+		`<saml:Issuer>` + testIDPEntityID + `</saml:Issuer>` +
+		sigMarker(id) +
+		`<saml:Subject>` +
+		`<saml:NameID Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress">` + nameID + `</saml:NameID>` +
+		`<saml:SubjectConfirmation Method="urn:oasis:names:tc:SAML:2.0:cm:bearer">` +
+		`<saml:SubjectConfirmationData InResponseTo="` + testRequestID + `" NotOnOrAfter="2026-03-01T12:05:00Z" Recipient="` + testACSURL + `"/>` +
+		`</saml:SubjectConfirmation>` +
+		`</saml:Subject>` +
+		`<saml:Conditions NotBefore="2026-03-01T11:59:00Z" NotOnOrAfter="2026-03-01T12:05:00Z">` +
+		`<saml:AudienceRestriction><saml:Audience>` + testSPEntityID + `</saml:Audience></saml:AudienceRestriction>` +
+		`</saml:Conditions>` +
+		`<saml:AttributeStatement>` +
+		`<saml:Attribute Name="displayName"><saml:AttributeValue>Test User</saml:AttributeValue></saml:Attribute>` +
+		`</saml:AttributeStatement>` +
+		`</saml:Assertion>`
+}
+
+// testResponse wraps the body in a successful response with a signature
+// marker.
+func testResponse(id, body string) string {
+	return `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="` + id + `" Version="2.0" IssueInstant="2026-03-01T11:59:50Z" Destination="` + testACSURL + `" InResponseTo="` + testRequestID + `">` +
+		`<saml:Issuer xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">` + testIDPEntityID + `</saml:Issuer>` +
+		sigMarker(id) +
+		`<samlp:Status><samlp:StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></samlp:Status>` +
+		body +
+		`</samlp:Response>`
+}
+
+// dropMarkers removes signature markers of elements left unsigned.
+func dropMarkers(doc string) string {
+	for strings.Contains(doc, "{{sig:") {
+		start := strings.Index(doc, "{{sig:")
+		end := strings.Index(doc[start:], "}}")
+		doc = doc[:start] + doc[start+end+2:]
+	}
+	return doc
+}
+
+func parseTestResponse(sp ServiceProvider, doc string) (*Assertion, error) {
+	return sp.ParseResponse(base64.StdEncoding.EncodeToString([]byte(dropMarkers(doc))), testNow)
+}
+
+// signedAssertion is the signed assertion alone, as an attacker could copy
+// it out of a response they got for themselves.
+func signedAssertion(t *testing.T, idp testIdP, id, nameID string) string {
+	t.Helper()
+	return idp.sign(t, testAssertion(id, nameID), id)
+}
+
+func TestParseResponseSignedAssertion(t *testing.T) {
+	idp := newTestIdP(t)
+	doc := testResponse("r1", signedAssertion(t, idp, "a1", "user@example.com"))
+
+	assertion, err := parseTestResponse(testSP(idp), doc)
+	if err != nil {
+		t.Fatalf("ParseResponse: %v", err)
+	}
+	if assertion.NameID != "user@example.com" {
+		t.Errorf("NameID = %q", assertion.NameID)
+	}
+	if assertion.InResponseTo != testRequestID {
+		t.Errorf("InResponseTo = %q", assertion.InResponseTo)
+	}
+	if got := assertion.FirstAttribute("DISPLAYNAME"); got != "Test User" {
+		t.Errorf("displayName = %q", got)
+	}
+}
+
+func TestParseResponseSignedResponseUnsignedAssertion(t *testing.T) {
+	idp := newTestIdP(t)
+	// the response signature covers the assertion in it
+	doc := idp.sign(t, testResponse("r1", testAssertion("a1", "user@example.com")), "r1")
+
+	assertion, err := parseTestResponse(testSP(idp), doc)
+	if err != nil {
+		t.Fatalf("ParseResponse: %v", err)
+	}
+	if assertion.NameID != "user@example.com" {
+		t.Errorf("NameID = %q", assertion.NameID)
+	}
+
+	tampered := strings.Replace(doc, "user@example.com", "admin@example.com", 1)
+	if _, err := parseTestResponse(testSP(idp), tampered); err == nil {
+		t.Error("accepted an assertion changed after the response was signed")
+	}
+}
+
+func TestParseResponseBothSigned(t *testing.T) {
+	idp := newTestIdP(t)
+	doc := idp.sign(t, testResponse("r1", signedAssertion(t, idp, "a1", "user@example.com")), "r1")
+	if _, err := parseTestResponse(testSP(idp), doc); err != nil {
+		t.Fatalf("ParseResponse: %v", err)
+	}
+}
+
+func TestParseResponseRefusesUnsigned(t *testing.T) {
+	idp := newTestIdP(t)
+	doc := testResponse("r1", testAssertion("a1", "user@example.com"))
+	if _, err := parseTestResponse(testSP(idp), doc); err == nil {
+		t.Error("accepted an unsigned response")
+	}
+
+	other := newTestIdP(t)
+	doc = testResponse("r1", signedAssertion(t, other, "a1", "user@example.com"))
+	if _, err := parseTestResponse(testSP(idp), doc); err == nil {
+		t.Error("accepted an assertion signed by another IdP")
+	}
+}
+
+func TestParseResponseRefusesTampering(t *testing.T) {
+	idp := newTestIdP(t)
+	legit := signedAssertion(t, idp, "a1", "user@example.com")
+	signature := legit[strings.Index(legit, "<ds:Signature") : strings.Index(legit, "</ds:Signature>")+len("</ds:Signature>")]
+	// a response signed without an assertion, one added afterwards isn't
+	// covered by the signature
+	emptySigned := idp.sign(t, testResponse("r1", ""), "r1")
+	unsigned := dropMarkers(testAssertion("a2", "victim@example.com"))
+
+	tests := map[string]string{
+		"duplicate assertion":     testResponse("r1", legit+legit),
+		"stripped signature":      testResponse("r1", strings.Replace(legit, signature, "", 1)),
+		"reference to another ID": testResponse("r1", strings.Replace(legit, `URI="#a1"`, `URI="#r1"`, 1)),
+		"signed response wrapping an unsigned assertion": strings.Replace(emptySigned,
+			"</samlp:Response>", unsigned+"</samlp:Response>", 1),
+	}
+	for name, doc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assertion, err := parseTestResponse(testSP(idp), doc)
+			if err == nil {
+				t.Errorf("accepted it, NameID %q", assertion.NameID)
+			}
+		})
+	}
+}
+
+// TestParseResponseSignatureWrapping tries the XML signature wrapping
+// attacks: the attacker keeps a validly signed assertion for themselves in
+// the response, so a signature is found, and adds one about the victim that
+// they hope gets read instead.
+func TestParseResponseSignatureWrapping(t *testing.T) {
+	idp := newTestIdP(t)
+	legit := signedAssertion(t, idp, "a1", "attacker@example.com")
+	evil := dropMarkers(testAssertion("a2", "victim@example.com"))
+	signatureOf := func(doc string) string {
+		return doc[strings.Index(doc, "<ds:Signature") : strings.Index(doc, "</ds:Signature>")+len("</ds:Signature>")]
+	}
+
+	tests := map[string]string{
+		"evil assertion next to the signed one": testResponse("r1", evil+legit),
+		"signed one after the evil one":         testResponse("r1", legit+evil),
+		"signed one hidden in extensions": testResponse("r1",
+			`<samlp:Extensions>`+legit+`</samlp:Extensions>`+evil),
+		"signed one inside the evil one": testResponse("r1",
+			strings.Replace(evil, "</saml:Assertion>", legit+"</saml:Assertion>", 1)),
+		"evil one inside the signed one": testResponse("r1",
+			strings.Replace(legit, "</saml:Assertion>", evil+"</saml:Assertion>", 1)),
+		"signature copied into the evil one": testResponse("r1",
+			strings.Replace(evil, "<saml:Subject>", signatureOf(legit)+"<saml:Subject>", 1)),
+		"evil one takes the signed one's ID": testResponse("r1",
+			strings.Replace(strings.Replace(evil, `ID="a2"`, `ID="a1"`, 1), "<saml:Subject>", signatureOf(legit)+"<saml:Subject>", 1)+
+				`<samlp:Extensions>`+legit+`</samlp:Extensions>`),
+	}
+	for name, doc := range tests {
+		t.Run(name, func(t *testing.T) {
+			assertion, err := parseTestResponse(testSP(idp), doc)
+			if err == nil {
+				t.Errorf("accepted a wrapped response, NameID %q", assertion.NameID)
+			}
+		})
+	}
+
+	// a signed response around a swapped assertion is no better
+	signedResponse := idp.sign(t, testResponse("r1", dropMarkers(testAssertion("a1", "attacker@example.com"))), "r1")
+	swapped := strings.Replace(signedResponse, "attacker@example.com", "victim@example.com", 1)
+	if _, err := parseTestResponse(testSP(idp), swapped); err == nil {
+		t.Error("accepted a signed response whose assertion was swapped")
+	}
+}
+
+func TestParseResponseDuplicateIDs(t *testing.T) {
+	idp := newTestIdP(t)
+
+	// the response and the assertion share an ID, so a reference to it
+	// could be resolved to either
+	doc := idp.sign(t, testResponse("x1", strings.Replace(testAssertion("x1", "user@example.com"), sigMarker("x1"), "", 1)), "x1")
+	if _, err := parseTestResponse(testSP(idp), doc); err == nil || !strings.Contains(err.Error(), "duplicate IDs") {
+		t.Errorf("response and assertion with one ID: got %v, want duplicate IDs", err)
+	}
+
+	// an unrelated element somewhere in the response with the signed ID
+	doc = testResponse("r1", signedAssertion(t, idp, "a1", "user@example.com"))
+	doc = strings.Replace(doc, `<samlp:Status>`, `<samlp:Extensions><Decoy ID="a1"/></samlp:Extensions><samlp:Status>`, 1)
+	if _, err := parseTestResponse(testSP(idp), doc); err == nil || !strings.Contains(err.Error(), "duplicate IDs") {
+		t.Errorf("decoy with the assertion's ID: got %v, want duplicate IDs", err)
+	}
+}
+
+// TestParseResponseCommentInNameID is the comment injection attack: the
+// attacker registers victim@example.com.evil.example at the IdP and puts a
+// comment into the NameID of the assertion they get. Canonicalization drops
+// comments, so the signature still holds, and a parser that only reads the
+// first text node would log them in as victim@example.com.
+func TestParseResponseCommentInNameID(t *testing.T) {
+	idp := newTestIdP(t)
+	doc := testResponse("r1", signedAssertion(t, idp, "a1", "victim@example.com.evil.example"))
+	injected := strings.Replace(doc, "victim@example.com.evil.example", "victim@example.com<!---->.evil.example", 1)
+
+	assertion, err := parseTestResponse(testSP(idp), injected)
+	if err != nil {
+		t.Fatalf("ParseResponse: %v", err)
+	}
+	if assertion.NameID != "victim@example.com.evil.example" {
+		t.Errorf("NameID = %q, want the whole signed value", assertion.NameID)
+	}
+}
+
+func TestParseResponseDefaultNamespaces(t *testing.T) {
+	idp := newTestIdP(t)
+	// some IdPs write default namespaces instead of prefixes, redeclared on
+	// the assertion
+	assertion := testAssertion("a1", "user@example.com")
+	assertion = strings.ReplaceAll(assertion, "saml:", "")
+	assertion = strings.Replace(assertion, `xmlns:saml=`, `xmlns=`, 1)
+	doc := `<Response xmlns="urn:oasis:names:tc:SAML:2.0:protocol" ID="r1" Version="2.0" Destination="` + testACSURL + `" InResponseTo="` + testRequestID + `">` +
+		`<Status><StatusCode Value="urn:oasis:names:tc:SAML:2.0:status:Success"/></Status>` +
+		idp.sign(t, assertion, "a1") +
+		`</Response>`
+
+	got, err := parseTestResponse(testSP(idp), doc)
+	if err != nil {
+		t.Fatalf("ParseResponse: %v", err)
+	}
+	if got.NameID != "user@example.com" {
+		t.Errorf("NameID = %q", got.NameID)
+	}
+}
+
+func TestParseResponseChecksConditions(t *testing.T) {
+	idp := newTestIdP(t)
+	tests := map[string][2]string{
+		"other audience":  {"<saml:Audience>" + testSPEntityID, "<saml:Audience>https://other.example.com"},
+		"other recipient": {`Recipient="` + testACSURL, `Recipient="https://other.example.com/acs`},
+		"expired":         {`NotOnOrAfter="2026-03-01T12:05:00Z">`, `NotOnOrAfter="2026-03-01T11:00:00Z">`},
+		"other issuer":    {"<saml:Issuer>" + testIDPEntityID, "<saml:Issuer>https://other.example.com"},
+		"not a bearer":    {"cm:bearer", "cm:holder-of-key"},
+		"IdP initiated":   {`InResponseTo="` + testRequestID + `" NotOnOrAfter`, `NotOnOrAfter`},
+	}
+	for name, change := range tests {
+		t.Run(name, func(t *testing.T) {
+			assertion := strings.Replace(testAssertion("a1", "user@example.com"), change[0], change[1], 1)
+			if assertion == testAssertion("a1", "user@example.com") {
+				t.Fatalf("%q isn't in the assertion", change[0])
+			}
+			response := testResponse("r1", idp.sign(t, assertion, "a1"))
+			if name == "IdP initiated" {
+				response = strings.Replace(response, ` InResponseTo="`+testRequestID+`"`, "", 1)
+			}
+			if _, err := parseTestResponse(testSP(idp), response); err == nil {
+				t.Error("ParseResponse accepted it")
+			}
+		})
+	}
+}
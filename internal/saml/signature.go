@@ -0,0 +1,181 @@
+package saml
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	nsDSig = "http://www.w3.org/2000/09/xmldsig#"
+
+	algExcC14N      = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	algEnveloped    = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	algRSASHA256    = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	algRSASHA512    = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha512"
+	algDigestSHA256 = "http://www.w3.org/2001/04/xmlenc#sha256"
+	algDigestSHA512 = "http://www.w3.org/2001/04/xmlenc#sha512"
+)
+
+var errNotSigned = errors.New("element is not signed")
+
+// verifySignature checks the enveloped signature of e against the IdP
+// certificate. Only what IdPs use today is accepted: exclusive
+// canonicalization, RSA with SHA-256 or SHA-512 and a single reference to e
+// itself. Anything else fails, rather than being skipped.
+func verifySignature(e *element, cert *x509.Certificate) error {
+	signatures := e.childElements(nsDSig, "Signature")
+	if len(signatures) == 0 {
+		return errNotSigned
+	}
+	if len(signatures) > 1 {
+		return errors.New("more than one signature")
+	}
+	signature := signatures[0]
+
+	signedInfo := signature.child(nsDSig, "SignedInfo")
+	if signedInfo == nil {
+		return errors.New("signature has no SignedInfo")
+	}
+	c14nMethod := signedInfo.child(nsDSig, "CanonicalizationMethod")
+	if c14nMethod == nil {
+		return errors.New("signature has no canonicalization method")
+	}
+	if alg, _ := c14nMethod.attr("Algorithm"); alg != algExcC14N {
+		return fmt.Errorf("unsupported canonicalization %q", alg)
+	}
+	signatureMethod := signedInfo.child(nsDSig, "SignatureMethod")
+	if signatureMethod == nil {
+		return errors.New("signature has no signature method")
+	}
+	var hash crypto.Hash
+	switch alg, _ := signatureMethod.attr("Algorithm"); alg {
+	case algRSASHA256:
+		hash = crypto.SHA256
+	case algRSASHA512:
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported signature algorithm %q", alg)
+	}
+
+	// a reference to anything but e would let a signed element be wrapped
+	// around an unsigned one
+	reference := signedInfo.child(nsDSig, "Reference")
+	if reference == nil {
+		return errors.New("signature must have exactly one reference")
+	}
+	id, ok := e.attr("ID")
+	if !ok || id == "" {
+		return errors.New("signed element has no ID")
+	}
+	if uri, _ := reference.attr("URI"); uri != "#"+id {
+		return errors.New("signature doesn't reference the signed element")
+	}
+
+	var inclusivePrefixes []string
+	transforms := reference.child(nsDSig, "Transforms")
+	if transforms == nil {
+		return errors.New("reference has no transforms")
+	}
+	enveloped := false
+	for _, c := range transforms.children {
+		transform, ok := c.(*element)
+		if !ok {
+			continue
+		}
+		if !transform.is(nsDSig, "Transform") {
+			return errors.New("unexpected element in transforms")
+		}
+		switch alg, _ := transform.attr("Algorithm"); alg {
+		case algEnveloped:
+			enveloped = true
+		case algExcC14N:
+			inclusivePrefixes = prefixList(transform)
+		default:
+			return fmt.Errorf("unsupported transform %q", alg)
+		}
+	}
+	if !enveloped {
+		return errors.New("signature isn't enveloped")
+	}
+
+	digestMethod := reference.child(nsDSig, "DigestMethod")
+	if digestMethod == nil {
+		return errors.New("reference has no digest method")
+	}
+	var digestHash crypto.Hash
+	switch alg, _ := digestMethod.attr("Algorithm"); alg {
+	case algDigestSHA256:
+		digestHash = crypto.SHA256
+	case algDigestSHA512:
+		digestHash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported digest algorithm %q", alg)
+	}
+	digestValue := reference.child(nsDSig, "DigestValue")
+	if digestValue == nil {
+		return errors.New("reference has no digest")
+	}
+	wantDigest, err := decodeBase64(digestValue.text())
+	if err != nil {
+		return fmt.Errorf("invalid digest: %w", err)
+	}
+	gotDigest := sum(digestHash, canonicalize(e, signature, inclusivePrefixes))
+	if subtle.ConstantTimeCompare(gotDigest, wantDigest) != 1 {
+		return errors.New("digest mismatch")
+	}
+
+	signatureValue := signature.child(nsDSig, "SignatureValue")
+	if signatureValue == nil {
+		return errors.New("signature has no value")
+	}
+	sig, err := decodeBase64(signatureValue.text())
+	if err != nil {
+		return fmt.Errorf("invalid signature value: %w", err)
+	}
+	publicKey, ok := cert.PublicKey.(*rsa.PublicKey)
+	if !ok {
+		return errors.New("IdP certificate doesn't hold an RSA key")
+	}
+	hashed := sum(hash, canonicalize(signedInfo, nil, prefixList(c14nMethod)))
+	if err := rsa.VerifyPKCS1v15(publicKey, hash, hashed, sig); err != nil {
+		return fmt.Errorf("invalid signature: %w", err)
+	}
+	return nil
+}
+
+// prefixList reads the InclusiveNamespaces PrefixList of an exclusive
+// canonicalization method.
+func prefixList(method *element) []string {
+	for _, c := range method.children {
+		if e, ok := c.(*element); ok && e.is(algExcC14N, "InclusiveNamespaces") {
+			list, _ := e.attr("PrefixList")
+			return strings.Fields(list)
+		}
+	}
+	return nil
+}
+
+func sum(hash crypto.Hash, data []byte) []byte {
+	switch hash {
+	case crypto.SHA512:
+		s := sha512.Sum512(data)
+		return s[:]
+	default:
+		s := sha256.Sum256(data)
+		return s[:]
+	}
+}
+
+// decodeBase64 decodes base64 that may be wrapped over several lines.
+func decodeBase64(s string) ([]byte, error) {
+	s = strings.Join(strings.Fields(s), "")
+	return base64.StdEncoding.DecodeString(s)
+}
@@ -0,0 +1,255 @@
+package saml
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testIdP signs documents the way an IdP does, so tests can build
+// responses. Signatures are made with our own canonicalization, which
+// TestVerifySignatureRealIdP checks against a real IdP.
+type testIdP struct {
+	key  *rsa.PrivateKey
+	cert *x509.Certificate
+}
+
+func newTestIdP(t *testing.T) testIdP {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "idp.example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testIdP{key: key, cert: cert}
+}
+
+// sigMarker is where the signature of the element with the ID goes.
+func sigMarker(id string) string {
+	return "{{sig:" + id + "}}"
+}
+
+// sign replaces the signature marker of the element with the ID by its
+// enveloped signature. Markers that are left are dropped first, so inner
+// elements have to be signed before the ones around them.
+func (idp testIdP) sign(t *testing.T, doc, id string, inclusivePrefixes ...string) string {
+	t.Helper()
+	unsigned := doc
+	for strings.Contains(unsigned, "{{sig:") {
+		start := strings.Index(unsigned, "{{sig:")
+		end := strings.Index(unsigned[start:], "}}")
+		unsigned = unsigned[:start] + unsigned[start+end+2:]
+	}
+	e := findByID(mustParseXML(t, unsigned), id)
+	if e == nil {
+		t.Fatalf("no element with ID %s", id)
+	}
+
+	inclusive := ""
+	if len(inclusivePrefixes) > 0 {
+		inclusive = `<ec:InclusiveNamespaces xmlns:ec="` + algExcC14N + `" PrefixList="` + strings.Join(inclusivePrefixes, " ") + `"/>`
+	}
+	digest := sum(crypto.SHA256, canonicalize(e, nil, inclusivePrefixes))
+	signedInfo := `<ds:SignedInfo>` +
+		`<ds:CanonicalizationMethod Algorithm="` + algExcC14N + `"/>` +
+		`<ds:SignatureMethod Algorithm="` + algRSASHA256 + `"/>` +
+		`<ds:Reference URI="#` + id + `"><ds:Transforms>` +
+		`<ds:Transform Algorithm="` + algEnveloped + `"/>` +
+		`<ds:Transform Algorithm="` + algExcC14N + `">` + inclusive + `</ds:Transform>` +
+		`</ds:Transforms>` +
+		`<ds:DigestMethod Algorithm="` + algDigestSHA256 + `"/>` +
+		`<ds:DigestValue>` + base64.StdEncoding.EncodeToString(digest) + `</ds:DigestValue>` +
+		`</ds:Reference></ds:SignedInfo>`
+
+	// SignedInfo is canonicalized in the scope the signature puts it in
+	wrapper := mustParseXML(t, `<ds:Signature xmlns:ds="`+nsDSig+`">`+signedInfo+`</ds:Signature>`)
+	hashed := sum(crypto.SHA256, canonicalize(wrapper.child(nsDSig, "SignedInfo"), nil, nil))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, idp.key, crypto.SHA256, hashed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := `<ds:Signature xmlns:ds="` + nsDSig + `">` + signedInfo +
+		`<ds:SignatureValue>` + base64.StdEncoding.EncodeToString(sig) + `</ds:SignatureValue></ds:Signature>`
+
+	if !strings.Contains(doc, sigMarker(id)) {
+		t.Fatalf("no signature marker for %s", id)
+	}
+	return strings.Replace(doc, sigMarker(id), signature, 1)
+}
+
+func TestVerifySignatureRealIdP(t *testing.T) {
+	data, err := os.ReadFile("testdata/samltest_artifact_response.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := mustParseXML(t, string(data))
+
+	// both signatures carry the IdP's certificate
+	var cert *x509.Certificate
+	root.walk(func(e *element) {
+		if cert == nil && e.is(nsDSig, "X509Certificate") {
+			cert, err = ParseCertificate(e.text())
+			if err != nil {
+				t.Fatalf("ParseCertificate: %v", err)
+			}
+		}
+	})
+	if cert == nil {
+		t.Fatal("no certificate in the test response")
+	}
+
+	for _, id := range []string{"_8eb377539b3d78acc68a8bc42ae5ea05", "_dcd1286ff0c71d4dfe859095ffea58f8"} {
+		e := findByID(root, id)
+		if e == nil {
+			t.Fatalf("no element with ID %s", id)
+		}
+		if err := verifySignature(e, cert); err != nil {
+			t.Errorf("verifySignature of %s %s: %v", e.local, id, err)
+		}
+	}
+
+	other := newTestIdP(t)
+	if err := verifySignature(findByID(root, "_dcd1286ff0c71d4dfe859095ffea58f8"), other.cert); err == nil {
+		t.Error("signature verified against another certificate")
+	}
+}
+
+func TestVerifySignatureRealIdPTampered(t *testing.T) {
+	data, err := os.ReadFile("testdata/samltest_artifact_response.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	doc := string(data)
+
+	tests := map[string][2]string{
+		"destination": {`Destination="http://localhost:8000/saml/acs"`, `Destination="http://evil.example/saml/acs"`},
+		"issuer":      {`>https://samltest.id/saml/idp</saml2:Issuer><ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:SignedInfo><ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/><ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"/><ds:Reference URI="#_dcd1`, `>https://evil.example/idp</saml2:Issuer><ds:Signature xmlns:ds="http://www.w3.org/2000/09/xmldsig#"><ds:SignedInfo><ds:CanonicalizationMethod Algorithm="http://www.w3.org/2001/10/xml-exc-c14n#"/><ds:SignatureMethod Algorithm="http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"/><ds:Reference URI="#_dcd1`},
+		"digest":      {`KYwjbB62U5e5h6/C2RRnzQeGbWmUzeyAtJJOwgvEjD8=`, `LYwjbB62U5e5h6/C2RRnzQeGbWmUzeyAtJJOwgvEjD8=`},
+		"namespace":   {`<saml2p:Status xmlns:saml2p="urn:oasis:names:tc:SAML:2.0:protocol">`, `<saml2p:Status xmlns:saml2p="urn:evil">`},
+	}
+	for name, change := range tests {
+		t.Run(name, func(t *testing.T) {
+			if strings.Count(doc, change[0]) != 1 {
+				t.Fatalf("%q isn't in the test response exactly once", change[0])
+			}
+			root := mustParseXML(t, strings.Replace(doc, change[0], change[1], 1))
+			var cert *x509.Certificate
+			root.walk(func(e *element) {
+				if cert == nil && e.is(nsDSig, "X509Certificate") {
+					cert, _ = ParseCertificate(e.text())
+				}
+			})
+			if err := verifySignature(findByID(root, "_dcd1286ff0c71d4dfe859095ffea58f8"), cert); err == nil {
+				t.Error("tampered response verified")
+			}
+		})
+	}
+}
+
+func TestVerifySignatureRefuses(t *testing.T) {
+	idp := newTestIdP(t)
+	doc := `<a:A xmlns:a="urn:a" ID="a1">` + sigMarker("a1") + `<a:B>text</a:B></a:A>`
+	signed := idp.sign(t, doc, "a1")
+	if err := verifySignature(mustParseXML(t, signed), idp.cert); err != nil {
+		t.Fatalf("verifySignature: %v", err)
+	}
+
+	tests := map[string][2]string{
+		"reference to another element": {`URI="#a1"`, `URI="#other"`},
+		"sha1 signature":               {algRSASHA256, "http://www.w3.org/2000/09/xmldsig#rsa-sha1"},
+		"sha1 digest":                  {algDigestSHA256, "http://www.w3.org/2000/09/xmldsig#sha1"},
+		"inclusive canonicalization":   {`<ds:CanonicalizationMethod Algorithm="` + algExcC14N, `<ds:CanonicalizationMethod Algorithm="http://www.w3.org/TR/2001/REC-xml-c14n-20010315`},
+		"not enveloped":                {`<ds:Transform Algorithm="` + algEnveloped + `"/>`, ``},
+		"unknown transform":            {`<ds:Transform Algorithm="` + algEnveloped + `"/>`, `<ds:Transform Algorithm="` + algEnveloped + `"/><ds:Transform Algorithm="http://www.w3.org/TR/1999/REC-xpath-19991116"/>`},
+		"changed content":              {`<a:B>text</a:B>`, `<a:B>other</a:B>`},
+	}
+	for name, change := range tests {
+		t.Run(name, func(t *testing.T) {
+			if !strings.Contains(signed, change[0]) {
+				t.Fatalf("%q isn't in the signed document", change[0])
+			}
+			root := mustParseXML(t, strings.Replace(signed, change[0], change[1], 1))
+			if err := verifySignature(root, idp.cert); err == nil {
+				t.Error("verifySignature accepted it")
+			}
+		})
+	}
+
+	twice := strings.Replace(signed, "<a:B>", signed[strings.Index(signed, "<ds:Signature"):strings.Index(signed, "</ds:Signature>")+len("</ds:Signature>")]+"<a:B>", 1)
+	if err := verifySignature(mustParseXML(t, twice), idp.cert); err == nil {
+		t.Error("verifySignature accepted two signatures")
+	}
+	if err := verifySignature(mustParseXML(t, strings.Replace(doc, sigMarker("a1"), "", 1)), idp.cert); err != errNotSigned {
+		t.Errorf("unsigned element: got %v, want errNotSigned", err)
+	}
+}
+
+func TestVerifySignatureInclusiveNamespaces(t *testing.T) {
+	idp := newTestIdP(t)
+	// xs is only used in an attribute value, which is what the prefix list
+	// is for
+	doc := `<p:R xmlns:p="urn:p" xmlns:xs="http://www.w3.org/2001/XMLSchema" xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">` +
+		`<p:A ID="a1">` + sigMarker("a1") + `<p:V xsi:type="xs:string">value</p:V></p:A></p:R>`
+
+	withList := idp.sign(t, doc, "a1", "xs")
+	if err := verifySignature(findByID(mustParseXML(t, withList), "a1"), idp.cert); err != nil {
+		t.Fatalf("verifySignature: %v", err)
+	}
+	// the prefix list puts xs under the signature even though it's declared
+	// outside the signed element
+	moved := strings.Replace(withList, `xmlns:xs="http://www.w3.org/2001/XMLSchema"`, `xmlns:xs="urn:evil"`, 1)
+	if err := verifySignature(findByID(mustParseXML(t, moved), "a1"), idp.cert); err == nil {
+		t.Error("changing an inclusive namespace outside the element kept the signature valid")
+	}
+
+	withoutList := idp.sign(t, doc, "a1")
+	moved = strings.Replace(withoutList, `xmlns:xs="http://www.w3.org/2001/XMLSchema"`, `xmlns:xs="urn:other"`, 1)
+	if err := verifySignature(findByID(mustParseXML(t, moved), "a1"), idp.cert); err != nil {
+		t.Errorf("namespace not visibly used broke the signature: %v", err)
+	}
+}
+
+func TestVerifySignatureDefaultNamespace(t *testing.T) {
+	idp := newTestIdP(t)
+	// the signed element redeclares the default namespace of its parent
+	doc := `<Response xmlns="urn:p"><Assertion xmlns="urn:a" ID="a1">` + sigMarker("a1") + `<Subject>s</Subject><Inner xmlns=""/></Assertion></Response>`
+	signed := idp.sign(t, doc, "a1")
+	root := mustParseXML(t, signed)
+	if err := verifySignature(findByID(root, "a1"), idp.cert); err != nil {
+		t.Fatalf("verifySignature: %v", err)
+	}
+
+	// moving the element under another default namespace changes nothing
+	// it renders, the signature still holds
+	rehomed := strings.Replace(signed, `<Response xmlns="urn:p">`, `<Response xmlns="urn:other">`, 1)
+	if err := verifySignature(findByID(mustParseXML(t, rehomed), "a1"), idp.cert); err != nil {
+		t.Errorf("verifySignature after changing the parent's default namespace: %v", err)
+	}
+
+	// but the element's own namespace is signed
+	changed := strings.Replace(signed, `<Assertion xmlns="urn:a"`, `<Assertion xmlns="urn:evil"`, 1)
+	if err := verifySignature(findByID(mustParseXML(t, changed), "a1"), idp.cert); err == nil {
+		t.Error("changing the element's default namespace kept the signature valid")
+	}
+}
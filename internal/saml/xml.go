@@ -0,0 +1,307 @@
+package saml
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+
+// element is a parsed XML element that remembers the prefixes and namespace
+// declarations as written, which canonicalization needs and encoding/xml
+// throws away.
+type element struct {
+	prefix string
+	local  string
+	// space is the namespace URI the prefix resolves to
+	space    string
+	attrs    []attribute
+	nsDecls  map[string]string
+	children []any // *element or string
+	parent   *element
+}
+
+type attribute struct {
+	prefix string
+	local  string
+	space  string
+	value  string
+}
+
+// parseXML reads a document into a tree. Comments and processing
+// instructions are dropped, DTDs are refused.
+func parseXML(data []byte) (*element, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var root, current *element
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if root != nil && current == nil {
+				return nil, errors.New("more than one root element")
+			}
+			e := &element{
+				prefix:  t.Name.Space,
+				local:   t.Name.Local,
+				nsDecls: map[string]string{},
+				parent:  current,
+			}
+			for _, a := range t.Attr {
+				switch {
+				case a.Name.Space == "" && a.Name.Local == "xmlns":
+					e.nsDecls[""] = a.Value
+				case a.Name.Space == "xmlns":
+					e.nsDecls[a.Name.Local] = a.Value
+				default:
+					e.attrs = append(e.attrs, attribute{prefix: a.Name.Space, local: a.Name.Local, value: a.Value})
+				}
+			}
+			space, ok := e.lookupNamespace(e.prefix)
+			if !ok {
+				return nil, fmt.Errorf("undeclared namespace prefix %q", e.prefix)
+			}
+			e.space = space
+			for i, a := range e.attrs {
+				// attributes without a prefix are in no namespace
+				if a.prefix == "" {
+					continue
+				}
+				space, ok := e.lookupNamespace(a.prefix)
+				if !ok {
+					return nil, fmt.Errorf("undeclared namespace prefix %q", a.prefix)
+				}
+				e.attrs[i].space = space
+			}
+
+			if current == nil {
+				root = e
+			} else {
+				current.children = append(current.children, e)
+			}
+			current = e
+		case xml.EndElement:
+			if current == nil || t.Name.Space != current.prefix || t.Name.Local != current.local {
+				return nil, fmt.Errorf("unexpected end element %s", t.Name.Local)
+			}
+			current = current.parent
+		case xml.CharData:
+			if current != nil {
+				current.children = append(current.children, string(t))
+			} else if len(bytes.TrimSpace(t)) > 0 {
+				return nil, errors.New("text outside the root element")
+			}
+		case xml.Directive:
+			return nil, errors.New("DTDs are not allowed")
+		}
+	}
+	if root == nil {
+		return nil, errors.New("empty document")
+	}
+	if current != nil {
+		return nil, errors.New("unexpected end of document")
+	}
+	return root, nil
+}
+
+// lookupNamespace resolves a prefix in the element's scope. The empty
+// prefix resolves to the default namespace, which may be empty.
+func (e *element) lookupNamespace(prefix string) (string, bool) {
+	if prefix == "xml" {
+		return xmlNamespace, true
+	}
+	for el := e; el != nil; el = el.parent {
+		if space, ok := el.nsDecls[prefix]; ok {
+			return space, true
+		}
+	}
+	return "", prefix == ""
+}
+
+func (e *element) is(space, local string) bool {
+	return e.space == space && e.local == local
+}
+
+func (e *element) attr(local string) (string, bool) {
+	for _, a := range e.attrs {
+		if a.space == "" && a.local == local {
+			return a.value, true
+		}
+	}
+	return "", false
+}
+
+// childElements returns the child elements with the name.
+func (e *element) childElements(space, local string) []*element {
+	children := []*element{}
+	for _, c := range e.children {
+		if child, ok := c.(*element); ok && child.is(space, local) {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// child returns the only child element with the name, nil when there is
+// none or more than one.
+func (e *element) child(space, local string) *element {
+	children := e.childElements(space, local)
+	if len(children) != 1 {
+		return nil
+	}
+	return children[0]
+}
+
+func (e *element) text() string {
+	var b strings.Builder
+	for _, c := range e.children {
+		if s, ok := c.(string); ok {
+			b.WriteString(s)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// walk calls fn for the element and all its descendants.
+func (e *element) walk(fn func(*element)) {
+	fn(e)
+	for _, c := range e.children {
+		if child, ok := c.(*element); ok {
+			child.walk(fn)
+		}
+	}
+}
+
+// canonicalize serializes the element with Exclusive XML Canonicalization
+// without comments (http://www.w3.org/2001/10/xml-exc-c14n#), leaving out
+// the exclude element, which is how the enveloped signature transform drops
+// the signature. inclusivePrefixes are the InclusiveNamespaces PrefixList.
+func canonicalize(e, exclude *element, inclusivePrefixes []string) []byte {
+	var b bytes.Buffer
+	writeCanonical(&b, e, exclude, inclusivePrefixes, map[string]string{})
+	return b.Bytes()
+}
+
+func writeCanonical(b *bytes.Buffer, e, exclude *element, inclusivePrefixes []string, rendered map[string]string) {
+	// namespaces visibly used by the element and its attributes, plus the
+	// inclusive ones that are in scope
+	prefixes := []string{e.prefix}
+	for _, a := range e.attrs {
+		if a.prefix != "" {
+			prefixes = append(prefixes, a.prefix)
+		}
+	}
+	for _, p := range inclusivePrefixes {
+		if p == "#default" {
+			p = ""
+		}
+		if _, ok := e.lookupNamespace(p); ok {
+			prefixes = append(prefixes, p)
+		}
+	}
+
+	decls := map[string]string{}
+	for _, p := range prefixes {
+		if p == "xml" {
+			continue
+		}
+		space, _ := e.lookupNamespace(p)
+		previous, ok := rendered[p]
+		if p == "" && space == "" {
+			// xmlns="" only undoes a default namespace rendered above
+			if ok && previous != "" {
+				decls[p] = ""
+			}
+			continue
+		}
+		if !ok || previous != space {
+			decls[p] = space
+		}
+	}
+
+	names := make([]string, 0, len(decls))
+	for p := range decls {
+		names = append(names, p)
+	}
+	sort.Strings(names)
+
+	attrs := append([]attribute(nil), e.attrs...)
+	sort.Slice(attrs, func(i, j int) bool {
+		if attrs[i].space != attrs[j].space {
+			return attrs[i].space < attrs[j].space
+		}
+		return attrs[i].local < attrs[j].local
+	})
+
+	b.WriteByte('<')
+	b.WriteString(qualifiedName(e.prefix, e.local))
+	for _, p := range names {
+		if p == "" {
+			b.WriteString(` xmlns="`)
+		} else {
+			b.WriteString(` xmlns:` + p + `="`)
+		}
+		b.WriteString(escapeAttr(decls[p]))
+		b.WriteByte('"')
+	}
+	for _, a := range attrs {
+		b.WriteString(" " + qualifiedName(a.prefix, a.local) + `="`)
+		b.WriteString(escapeAttr(a.value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('>')
+
+	childRendered := rendered
+	if len(decls) > 0 {
+		childRendered = make(map[string]string, len(rendered)+len(decls))
+		for p, space := range rendered {
+			childRendered[p] = space
+		}
+		for p, space := range decls {
+			childRendered[p] = space
+		}
+	}
+	for _, c := range e.children {
+		switch c := c.(type) {
+		case string:
+			b.WriteString(escapeText(c))
+		case *element:
+			if c != exclude {
+				writeCanonical(b, c, exclude, inclusivePrefixes, childRendered)
+			}
+		}
+	}
+
+	b.WriteString("</" + qualifiedName(e.prefix, e.local) + ">")
+}
+
+func qualifiedName(prefix, local string) string {
+	if prefix == "" {
+		return local
+	}
+	return prefix + ":" + local
+}
+
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
+
+func escapeText(s string) string {
+	return textEscaper.Replace(s)
+}
+
+func escapeAttr(s string) string {
+	return attrEscaper.Replace(s)
+}
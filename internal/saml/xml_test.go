@@ -0,0 +1,158 @@
+package saml
+
+import "testing"
+
+func mustParseXML(t *testing.T, data string) *element {
+	t.Helper()
+	root, err := parseXML([]byte(data))
+	if err != nil {
+		t.Fatalf("parseXML: %v", err)
+	}
+	return root
+}
+
+// findByID returns the element with the ID attribute, nil when there's none.
+func findByID(root *element, id string) *element {
+	var found *element
+	root.walk(func(e *element) {
+		if v, ok := e.attr("ID"); ok && v == id && found == nil {
+			found = e
+		}
+	})
+	return found
+}
+
+func TestCanonicalize(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		prefixes []string
+		want     string
+	}{
+		{
+			name:  "namespaces move to where they're used, comments go",
+			input: `<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_88a9" Version="2.0" IssueInstant="2016-04-28T15:37:17"><!-- Some Comment --><saml:Issuer>https://sp.example.com</saml:Issuer><samlp:NameIDPolicy AllowCreate="true" Format=""/></samlp:AuthnRequest>`,
+			want:  `<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" ID="_88a9" IssueInstant="2016-04-28T15:37:17" Version="2.0"><saml:Issuer xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">https://sp.example.com</saml:Issuer><samlp:NameIDPolicy AllowCreate="true" Format=""></samlp:NameIDPolicy></samlp:AuthnRequest>`,
+		},
+		{
+			name:  "declarations before attributes",
+			input: `<Foo ID="id1" xmlns:bar="urn:bar" xmlns="urn:foo"><bar:Baz></bar:Baz></Foo>`,
+			want:  `<Foo xmlns="urn:foo" ID="id1"><bar:Baz xmlns:bar="urn:bar"></bar:Baz></Foo>`,
+		},
+		{
+			name:  "unused default namespace",
+			input: `<foo:Foo xmlns="urn:baz" xmlns:foo="urn:foo"><foo:Bar></foo:Bar></foo:Foo>`,
+			want:  `<foo:Foo xmlns:foo="urn:foo"><foo:Bar></foo:Bar></foo:Foo>`,
+		},
+		{
+			name:  "redundant redeclaration, like Shibboleth writes",
+			input: `<p:A xmlns:p="urn:p"><p:B xmlns:p="urn:p"/></p:A>`,
+			want:  `<p:A xmlns:p="urn:p"><p:B></p:B></p:A>`,
+		},
+		{
+			name:  "prefix redeclared to another namespace",
+			input: `<p:A xmlns:p="urn:p"><p:B xmlns:p="urn:q"/></p:A>`,
+			want:  `<p:A xmlns:p="urn:p"><p:B xmlns:p="urn:q"></p:B></p:A>`,
+		},
+		{
+			name:  "default namespace redeclared",
+			input: `<Foo xmlns="urn:foo"><Bar xmlns="urn:bar"></Bar></Foo>`,
+			want:  `<Foo xmlns="urn:foo"><Bar xmlns="urn:bar"></Bar></Foo>`,
+		},
+		{
+			name:  "default namespace undone",
+			input: `<Foo xmlns="urn:foo"><Bar xmlns=""></Bar></Foo>`,
+			want:  `<Foo xmlns="urn:foo"><Bar xmlns=""></Bar></Foo>`,
+		},
+		{
+			name:  "empty default namespace that was never rendered",
+			input: `<x:Foo xmlns:x="urn:x" xmlns="urn:unused"><Bar xmlns=""/></x:Foo>`,
+			want:  `<x:Foo xmlns:x="urn:x"><Bar></Bar></x:Foo>`,
+		},
+		{
+			name:     "inclusive prefix used only in an attribute value",
+			input:    `<foo:Foo xmlns:foo="urn:foo" xmlns:xs="http://www.w3.org/2001/XMLSchema"><foo:Bar xmlns:xs="http://www.w3.org/2001/XMLSchema">xs:string</foo:Bar></foo:Foo>`,
+			prefixes: []string{"xs"},
+			want:     `<foo:Foo xmlns:foo="urn:foo" xmlns:xs="http://www.w3.org/2001/XMLSchema"><foo:Bar>xs:string</foo:Bar></foo:Foo>`,
+		},
+		{
+			name:  "attributes sorted by namespace URI, then name",
+			input: `<e xmlns:b="urn:b" xmlns:a="urn:a" z="1" b:y="2" a:x="3" a="4"/>`,
+			want:  `<e xmlns:a="urn:a" xmlns:b="urn:b" a="4" z="1" a:x="3" b:y="2"></e>`,
+		},
+		{
+			name:  "escaping",
+			input: "<e a=\"&lt;&amp;&quot;&#9;&#10;&#13;>\">&lt;&amp;&gt;&#13;\"'</e>",
+			want:  "<e a=\"&lt;&amp;&quot;&#x9;&#xA;&#xD;>\">&lt;&amp;&gt;&#xD;\"'</e>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := mustParseXML(t, tt.input)
+			got := string(canonicalize(root, nil, tt.prefixes))
+			if got != tt.want {
+				t.Errorf("canonicalize =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonicalizeSubtree(t *testing.T) {
+	// namespaces of ancestors are only rendered where the subtree uses
+	// them, or when they're inclusive
+	doc := `<r:Root xmlns:r="urn:r" xmlns="urn:default" xmlns:xs="urn:xs"><Child ID="c"><r:Grandchild/></Child></r:Root>`
+	child := findByID(mustParseXML(t, doc), "c")
+
+	got := string(canonicalize(child, nil, nil))
+	want := `<Child xmlns="urn:default" ID="c"><r:Grandchild xmlns:r="urn:r"></r:Grandchild></Child>`
+	if got != want {
+		t.Errorf("canonicalize =\n%s\nwant\n%s", got, want)
+	}
+
+	got = string(canonicalize(child, nil, []string{"xs", "#default"}))
+	want = `<Child xmlns="urn:default" xmlns:xs="urn:xs" ID="c"><r:Grandchild xmlns:r="urn:r"></r:Grandchild></Child>`
+	if got != want {
+		t.Errorf("canonicalize with prefixes =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCanonicalizeExcludesSignature(t *testing.T) {
+	doc := `<a:A xmlns:a="urn:a" xmlns:ds="http://www.w3.org/2000/09/xmldsig#" ID="x"><ds:Signature><ds:SignedInfo/></ds:Signature><a:B>text</a:B></a:A>`
+	root := mustParseXML(t, doc)
+	signature := root.child(nsDSig, "Signature")
+
+	got := string(canonicalize(root, signature, nil))
+	want := `<a:A xmlns:a="urn:a" ID="x"><a:B>text</a:B></a:A>`
+	if got != want {
+		t.Errorf("canonicalize =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestParseXMLCommentsJoinText(t *testing.T) {
+	// a comment splits the text, but it's still read as one
+	root := mustParseXML(t, `<NameID>victim@example.com<!---->.evil.example</NameID>`)
+	if got := root.text(); got != "victim@example.com.evil.example" {
+		t.Errorf("text() = %q", got)
+	}
+	if got := string(canonicalize(root, nil, nil)); got != `<NameID>victim@example.com.evil.example</NameID>` {
+		t.Errorf("canonicalize = %s", got)
+	}
+}
+
+func TestParseXMLRefuses(t *testing.T) {
+	tests := map[string]string{
+		"DTD":               `<!DOCTYPE r [<!ENTITY x "y">]><r>&x;</r>`,
+		"undeclared prefix": `<p:r/>`,
+		"undeclared attr":   `<r p:a="1"/>`,
+		"two roots":         `<a/><b/>`,
+		"text outside root": `<a/>text`,
+		"mismatched end":    `<a></b>`,
+		"unexpected end":    `<a><b></b>`,
+		"empty":             ``,
+	}
+	for name, doc := range tests {
+		if _, err := parseXML([]byte(doc)); err == nil {
+			t.Errorf("%s: parseXML accepted %q", name, doc)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// priority lanes of background jobs, higher runs first
+const (
+	jobPriorityLow    = -10
+	jobPriorityNormal = 0
+	jobPriorityHigh   = 10
+)
+
+const (
+	// waiting jobs gain a point of priority this often, so a low priority
+	// job overtakes fresh high priority ones after a bit over an hour and a
+	// half
+	jobPriorityAgingInterval = 5 * time.Minute
+
+	// packaging videos up to this size jumps the queue, anything past
+	// jobLargeVideoBytes waits for the smaller ones
+	jobSmallVideoBytes = 200 << 20
+	jobLargeVideoBytes = 2 << 30
+)
+
+// jobPriority picks the lane of a new job: quick jobs and small videos go
+// ahead of packaging long, high bitrate ones. Jobs of videos get their
+// owner's plan priority and their organization's priority on top.
+func (cfg *apiConfig) jobPriority(jobType string, videoID *uuid.UUID) int {
+	priority := jobPriorityNormal
+	if videoID == nil {
+		return priority
+	}
+
+	switch jobType {
+	case jobTypeModerateVideo:
+		// only grabs a handful of frames
+		priority = jobPriorityHigh
+	case jobTypePackageHLS, jobTypePackageDRM:
+		priority = cfg.videoSizePriority(*videoID)
+	case jobTypeRetranscodeVideo:
+		// backfills shouldn't hold up new uploads
+		priority = jobPriorityLow
+	}
+
+	video, err := cfg.db.GetVideo(*videoID)
+	if err != nil {
+		log.Printf("Couldn't get video %s to prioritize its job: %v", videoID, err)
+		return priority
+	}
+	if video.ID == uuid.Nil {
+		return priority
+	}
+	_, limits, err := cfg.userPlan(video.UserID)
+	if err != nil {
+		log.Printf("Couldn't get plan of user %s to prioritize a job: %v", video.UserID, err)
+	}
+	priority += limits.jobPriority
+
+	org, err := cfg.db.GetOrganizationByUser(video.UserID)
+	if err != nil {
+		log.Printf("Couldn't get organization of user %s to prioritize a job: %v", video.UserID, err)
+		return priority
+	}
+	return priority + org.JobPriority
+}
+
+// videoSizePriority uses the size of the current version as a stand-in for
+// how long packaging it takes.
+func (cfg *apiConfig) videoSizePriority(videoID uuid.UUID) int {
+	versions, err := cfg.db.GetVideoVersions(videoID)
+	if err != nil {
+		log.Printf("Couldn't get versions of video %s to prioritize its job: %v", videoID, err)
+		return jobPriorityNormal
+	}
+	if len(versions) == 0 || versions[0].SizeBytes == 0 {
+		return jobPriorityNormal
+	}
+
+	switch size := versions[0].SizeBytes; {
+	case size <= jobSmallVideoBytes:
+		return jobPriorityHigh
+	case size >= jobLargeVideoBytes:
+		return jobPriorityLow
+	default:
+		return jobPriorityNormal
+	}
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os/exec"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	jobPollInterval = 2 * time.Second
+	// failed jobs wait this long before they are attempted again
+	jobRetryDelay = time.Minute
+	// how much of a failed command's stderr is kept on the job
+	jobStderrExcerptLines = 20
+)
+
+type jobHandler func(ctx context.Context, job database.Job) error
+
+func (cfg *apiConfig) jobHandlers() map[string]jobHandler {
+	return map[string]jobHandler{
+		jobTypeImportS3Prefix:    cfg.runImportS3PrefixJob,
+		jobTypeImportS3Object:    cfg.runImportS3ObjectJob,
+		jobTypeImportURL:         cfg.runImportURLJob,
+		jobTypeUserExport:        cfg.runUserExportJob,
+		jobTypeModerateVideo:     cfg.runModerateVideoJob,
+		jobTypePackageDRM:        cfg.runPackageDRMJob,
+		jobTypePackageHLS:        cfg.runPackageHLSJob,
+		jobTypeArchiveLiveStream: cfg.runArchiveLiveStreamJob,
+		jobTypeRetranscodeVideo:  cfg.runRetranscodeVideoJob,
+		jobTypeCompleteUpload:    cfg.runCompleteUploadJob,
+		jobTypeReconcileStorage:  cfg.runReconcileStorageJob,
+		jobTypeStitchVideos:      cfg.runStitchVideosJob,
+		jobTypeComposeVideos:     cfg.runComposeVideosJob,
+		jobTypeMigrateVideoKeys:  cfg.runMigrateVideoKeysJob,
+		jobTypeTagObjects:        cfg.runTagObjectsJob,
+		jobTypeDispatchEvent:     cfg.runDispatchEventJob,
+		jobTypeReindexSearch:     cfg.runReindexSearchJob,
+		jobTypeGenerateChapters:  cfg.runGenerateChaptersJob,
+		jobTypeCheckContentID:    cfg.runCheckContentIDJob,
+		jobTypeVideoExport:       cfg.runVideoExportJob,
+	}
+}
+
+func (cfg *apiConfig) enqueueJob(jobType string, videoID *uuid.UUID, payload any) (database.Job, error) {
+	dat, err := json.Marshal(payload)
+	if err != nil {
+		return database.Job{}, err
+	}
+	job, err := cfg.db.CreateJob(database.CreateJobParams{
+		Type:     jobType,
+		Payload:  dat,
+		VideoID:  videoID,
+		Priority: cfg.jobPriority(jobType, videoID),
+	})
+	if err != nil {
+		return database.Job{}, err
+	}
+
+	err = cfg.jobQueue.Publish(context.Background(), job.ID)
+	if err != nil {
+		// park it in the dead-letter queue where an admin can retry it
+		failure := database.JobFailure{Error: err.Error(), Stage: "queue"}
+		if err := cfg.db.FailJob(job.ID, failure, 0); err != nil {
+			log.Printf("Couldn't mark job %s as failed: %v", job.ID, err)
+		}
+		return database.Job{}, fmt.Errorf("couldn't queue job: %w", err)
+	}
+	return job, nil
+}
+
+func (cfg *apiConfig) startJobWorkers(ctx context.Context, workers int) {
+	handlers := cfg.jobHandlers()
+	for i := 0; i < workers; i++ {
+		go cfg.runJobWorker(ctx, handlers)
+	}
+	log.Printf("Started %d job workers", workers)
+}
+
+func (cfg *apiConfig) runJobWorker(ctx context.Context, handlers map[string]jobHandler) {
+	for {
+		delivery, err := cfg.jobQueue.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Couldn't receive job: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(jobPollInterval):
+			}
+			continue
+		}
+
+		cfg.handleJobDelivery(ctx, handlers, delivery)
+	}
+}
+
+func (cfg *apiConfig) handleJobDelivery(ctx context.Context, handlers map[string]jobHandler, delivery jobDelivery) {
+	jobID := delivery.JobID()
+	claimed, err := cfg.db.ClaimJob(jobID, cfg.jobVisibilityTimeout)
+	if err != nil {
+		// the queue hands it out again once the visibility timeout passes
+		log.Printf("Couldn't claim job %s: %v", jobID, err)
+		return
+	}
+	job, err := cfg.db.GetJob(jobID)
+	if err != nil {
+		log.Printf("Couldn't get job %s: %v", jobID, err)
+		return
+	}
+	if !claimed {
+		// a duplicate delivery of a job that's finished or gone. Jobs still
+		// running on another worker are left alone so they come back if
+		// that worker dies.
+		if job.ID == uuid.Nil || job.Status == database.JobStatusCompleted || job.Status == database.JobStatusDead {
+			ackJobDelivery(ctx, delivery)
+		}
+		return
+	}
+
+	stopHeartbeat := cfg.startJobHeartbeat(ctx, delivery)
+	err = cfg.runJob(ctx, handlers, job)
+	stopHeartbeat()
+
+	if err != nil {
+		log.Printf("Job %s (%s) failed: %v", job.ID, job.Type, err)
+		maxAttempts := cfg.jobMaxAttempts
+		if isBadMediaError(err) {
+			// the file won't get any better by trying again
+			maxAttempts = job.Attempts
+		}
+		if err := cfg.db.FailJob(job.ID, jobFailure(job, err), maxAttempts); err != nil {
+			log.Printf("Couldn't mark job %s as failed: %v", job.ID, err)
+			return
+		}
+		if job.Attempts >= maxAttempts {
+			ackJobDelivery(ctx, delivery)
+			return
+		}
+		if err := delivery.Retry(ctx, jobRetryDelay); err != nil {
+			log.Printf("Couldn't schedule retry of job %s: %v", job.ID, err)
+		}
+		return
+	}
+
+	if err := cfg.db.CompleteJob(job.ID); err != nil {
+		log.Printf("Couldn't mark job %s as completed: %v", job.ID, err)
+		return
+	}
+	ackJobDelivery(ctx, delivery)
+}
+
+// startJobHeartbeat keeps the job claimed while it runs, both in the
+// database and in the queue. The returned func stops it.
+func (cfg *apiConfig) startJobHeartbeat(ctx context.Context, delivery jobDelivery) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(cfg.jobVisibilityTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := cfg.db.HeartbeatJob(delivery.JobID()); err != nil {
+				log.Printf("Couldn't record heartbeat of job %s: %v", delivery.JobID(), err)
+			}
+			if err := delivery.Extend(ctx, cfg.jobVisibilityTimeout); err != nil {
+				log.Printf("Couldn't extend visibility of job %s: %v", delivery.JobID(), err)
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func ackJobDelivery(ctx context.Context, delivery jobDelivery) {
+	if err := delivery.Ack(ctx); err != nil {
+		log.Printf("Couldn't acknowledge job %s: %v", delivery.JobID(), err)
+	}
+}
+
+func (cfg *apiConfig) runJob(ctx context.Context, handlers map[string]jobHandler, job database.Job) (err error) {
+	handler, ok := handlers[job.Type]
+	if !ok {
+		return fmt.Errorf("unknown job type %q", job.Type)
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("job panicked: %v", r)
+		}
+	}()
+	return handler(ctx, job)
+}
+
+// commandError is returned when an external tool like ffmpeg fails. It keeps
+// stderr around so the failure can be inspected on the job afterwards.
+type commandError struct {
+	name   string
+	err    error
+	stderr []byte
+}
+
+func newCommandError(name string, err error, stderr []byte) *commandError {
+	return &commandError{name: name, err: err, stderr: stderr}
+}
+
+func (e *commandError) Error() string {
+	return fmt.Sprintf("%s error: %v: %s", e.name, e.err, e.stderr)
+}
+
+func (e *commandError) Unwrap() error {
+	return e.err
+}
+
+// stageError records which step of a multi-step job failed.
+type stageError struct {
+	stage string
+	err   error
+}
+
+func withStage(stage string, err error) error {
+	return &stageError{stage: stage, err: err}
+}
+
+func (e *stageError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stageError) Unwrap() error {
+	return e.err
+}
+
+// jobFailure collects what's known about why the job failed. The stage
+// defaults to the job type when the error doesn't say which step failed.
+func jobFailure(job database.Job, err error) database.JobFailure {
+	failure := database.JobFailure{
+		Error: err.Error(),
+		Stage: job.Type,
+	}
+
+	var stageErr *stageError
+	if errors.As(err, &stageErr) {
+		failure.Stage = stageErr.stage
+	}
+
+	var cmdErr *commandError
+	if errors.As(err, &cmdErr) {
+		stderr := string(lastLines(cmdErr.stderr, jobStderrExcerptLines))
+		failure.Stderr = &stderr
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode := exitErr.ExitCode()
+		failure.ExitCode = &exitCode
+	}
+	return failure
+}
@@ -6,18 +6,34 @@ import (
 	"net/http"
 )
 
-func respondWithError(w http.ResponseWriter, code int, msg string, err error) {
+// errorResponse is the body of every API error. Code is stable and meant to
+// be branched on, Message is for people and may change.
+type errorResponse struct {
+	Code      apiErrorCode `json:"code"`
+	Message   string       `json:"message"`
+	Details   any          `json:"details,omitempty"`
+	RequestID string       `json:"request_id,omitempty"`
+}
+
+func respondWithError(w http.ResponseWriter, status int, code apiErrorCode, msg string, err error) {
+	respondWithErrorDetails(w, status, code, msg, nil, err)
+}
+
+// respondWithErrorDetails is respondWithError with machine-readable context
+// about the failure, e.g. the limit that was exceeded.
+func respondWithErrorDetails(w http.ResponseWriter, status int, code apiErrorCode, msg string, details any, err error) {
+	requestID := w.Header().Get(requestIDHeader)
 	if err != nil {
-		log.Println(err)
-	}
-	if code > 499 {
-		log.Printf("Responding with 5XX error: %s", msg)
+		log.Printf("[%s] %v", requestID, err)
 	}
-	type errorResponse struct {
-		Error string `json:"error"`
+	if status > 499 {
+		log.Printf("[%s] Responding with 5XX error: %s", requestID, msg)
 	}
-	respondWithJSON(w, code, errorResponse{
-		Error: msg,
+	respondWithJSON(w, status, errorResponse{
+		Code:      code,
+		Message:   msg,
+		Details:   details,
+		RequestID: requestID,
 	})
 }
 
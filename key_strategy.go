@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	renditionSDR = "sdr"
+	renditionHDR = "hdr"
+)
+
+// videoKeyParams is what a video file's key can be built from.
+type videoKeyParams struct {
+	VideoID uuid.UUID
+	UserID  uuid.UUID
+	// Date is when the version was uploaded
+	Date time.Time
+	// Aspect is landscape, portrait or other
+	Aspect  string
+	Version int
+	// Rendition is sdr or hdr
+	Rendition string
+}
+
+// keyStrategy names the objects processed videos are stored under.
+type keyStrategy interface {
+	VideoKey(p videoKeyParams) string
+}
+
+// aspectName is the aspect segment of keys for an aspect ratio.
+func aspectName(aspectRatio string) string {
+	switch aspectRatio {
+	case "16:9":
+		return "landscape"
+	case "9:16":
+		return "portrait"
+	}
+	return "other"
+}
+
+// defaultKeyStrategy is the layout videos have always been stored with:
+// landscape/<id>.mp4, landscape/<id>-v2.mp4, landscape/<id>-v2-hdr.mp4.
+type defaultKeyStrategy struct{}
+
+func (defaultKeyStrategy) VideoKey(p videoKeyParams) string {
+	key := fmt.Sprintf("%s/%s", p.Aspect, p.VideoID)
+	if p.Version > 1 {
+		key = fmt.Sprintf("%s-v%d", key, p.Version)
+	}
+	if p.Rendition == renditionHDR {
+		key += "-hdr"
+	}
+	return key + ".mp4"
+}
+
+// templateKeyStrategy fills a pattern like
+// {aspect}/{userID}/{date}/{videoID}-v{version}-{rendition}.mp4.
+type templateKeyStrategy struct {
+	pattern string
+}
+
+var (
+	keyPatternPlaceholderRegexp = regexp.MustCompile(`\{[^}]*\}`)
+	keyPatternLiteralRegexp     = regexp.MustCompile(`^[A-Za-z0-9/_.-]*$`)
+
+	keyPatternPlaceholders = []string{"{videoID}", "{userID}", "{date}", "{aspect}", "{version}", "{rendition}"}
+	// each version and rendition needs a key of its own
+	keyPatternRequired = []string{"{videoID}", "{version}", "{rendition}"}
+)
+
+// newKeyStrategy returns the strategy for a VIDEO_KEY_PATTERN, the default
+// layout when it's empty. Patterns start with {aspect}/: the storage layer
+// recognizes renditions by it and embeds are sized from it.
+func newKeyStrategy(pattern string) (keyStrategy, error) {
+	if pattern == "" {
+		return defaultKeyStrategy{}, nil
+	}
+
+	for _, placeholder := range keyPatternPlaceholderRegexp.FindAllString(pattern, -1) {
+		if !slices.Contains(keyPatternPlaceholders, placeholder) {
+			return nil, fmt.Errorf("unknown placeholder %s, must be one of %s", placeholder, strings.Join(keyPatternPlaceholders, ", "))
+		}
+	}
+	for _, placeholder := range keyPatternRequired {
+		if !strings.Contains(pattern, placeholder) {
+			return nil, fmt.Errorf("pattern must contain %s", placeholder)
+		}
+	}
+	literal := keyPatternPlaceholderRegexp.ReplaceAllString(pattern, "")
+	if !keyPatternLiteralRegexp.MatchString(literal) {
+		return nil, errors.New("pattern can only contain letters, digits, slashes, dots, dashes and underscores")
+	}
+	if !strings.HasPrefix(pattern, "{aspect}/") {
+		return nil, errors.New("pattern must start with {aspect}/")
+	}
+	if !strings.HasSuffix(pattern, ".mp4") {
+		return nil, errors.New("pattern must end with .mp4")
+	}
+	if strings.Contains(pattern, "//") || strings.Contains(pattern, "..") {
+		return nil, errors.New("pattern can't contain empty or relative segments")
+	}
+	return templateKeyStrategy{pattern: pattern}, nil
+}
+
+func (s templateKeyStrategy) VideoKey(p videoKeyParams) string {
+	return strings.NewReplacer(
+		"{videoID}", p.VideoID.String(),
+		"{userID}", p.UserID.String(),
+		"{date}", p.Date.UTC().Format("2006-01-02"),
+		"{aspect}", p.Aspect,
+		"{version}", strconv.Itoa(p.Version),
+		"{rendition}", p.Rendition,
+	).Replace(s.pattern)
+}
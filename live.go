@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	jobTypeArchiveLiveStream = "archive_live_stream"
+
+	// how long a started stream waits for the broadcaster to connect
+	liveConnectTimeout = 10 * time.Minute
+	liveSegmentSeconds = 2
+	liveSegmentPattern = "segment%06d.ts"
+)
+
+var errNoLivePorts = errors.New("no free live ingest ports")
+
+type archiveLiveStreamPayload struct {
+	StreamID uuid.UUID `json:"stream_id"`
+}
+
+// liveManager keeps track of the ffmpeg ingest processes running in this
+// server. Every stream gets its own RTMP port from the configured range
+// because an ffmpeg listener only accepts a single publisher.
+type liveManager struct {
+	mu      sync.Mutex
+	minPort int
+	maxPort int
+	ports   map[int]uuid.UUID
+	cancels map[uuid.UUID]context.CancelFunc
+	// WHIP streams remember their session on the WebRTC gateway
+	whipSessions map[uuid.UUID]string
+}
+
+func newLiveManager(minPort, maxPort int) *liveManager {
+	return &liveManager{
+		minPort:      minPort,
+		maxPort:      maxPort,
+		ports:        map[int]uuid.UUID{},
+		cancels:      map[uuid.UUID]context.CancelFunc{},
+		whipSessions: map[uuid.UUID]string{},
+	}
+}
+
+func (m *liveManager) reservePort() (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for port := m.minPort; port <= m.maxPort; port++ {
+		if _, ok := m.ports[port]; !ok {
+			m.ports[port] = uuid.Nil
+			return port, nil
+		}
+	}
+	return 0, errNoLivePorts
+}
+
+// start records a running ingest. Streams that don't listen for RTMP use
+// port 0.
+func (m *liveManager) start(port int, streamID uuid.UUID, cancel context.CancelFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if port != 0 {
+		m.ports[port] = streamID
+	}
+	m.cancels[streamID] = cancel
+}
+
+func (m *liveManager) release(port int, streamID uuid.UUID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if port != 0 {
+		delete(m.ports, port)
+	}
+	delete(m.cancels, streamID)
+	delete(m.whipSessions, streamID)
+}
+
+func (m *liveManager) setWHIPSession(streamID uuid.UUID, sessionURL string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.whipSessions[streamID] = sessionURL
+}
+
+func (m *liveManager) whipSession(streamID uuid.UUID) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.whipSessions[streamID]
+}
+
+// stop asks the ingest of a stream to finish. It reports false when the
+// stream isn't running on this server.
+func (m *liveManager) stop(streamID uuid.UUID) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	cancel, ok := m.cancels[streamID]
+	if ok {
+		cancel()
+	}
+	return ok
+}
+
+func (cfg *apiConfig) liveStreamDir(streamID uuid.UUID) string {
+	return filepath.Join(cfg.liveRoot, streamID.String())
+}
+
+// liveInput is the ffmpeg input of a live stream.
+type liveInput struct {
+	args []string
+	// pulled inputs are retried until the publisher shows up, listeners
+	// simply wait for it
+	pull bool
+}
+
+// rtmpLiveInput listens for the broadcaster on the stream's port. The stream
+// key is used as the RTMP application name, so ffmpeg rejects publishers
+// that don't know it.
+func rtmpLiveInput(port int, streamKey string) liveInput {
+	return liveInput{
+		args: []string{"-listen", "1", "-i", fmt.Sprintf("rtmp://0.0.0.0:%d/%s/live", port, streamKey)},
+	}
+}
+
+// startLiveIngest runs ffmpeg over the stream's input in the background. The
+// broadcast is packaged to short-segment HLS under /live/{streamID}/. The
+// playlist only lists the DVR window, but every segment stays on disk so the
+// whole broadcast can be archived.
+func (cfg *apiConfig) startLiveIngest(stream database.LiveStream, input liveInput) error {
+	dir := cfg.liveStreamDir(stream.ID)
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg.live.start(stream.Port, stream.ID, cancel)
+
+	go cfg.watchLiveIngest(ctx, cancel, stream.ID, dir)
+	go func() {
+		defer cfg.live.release(stream.Port, stream.ID)
+		defer cancel()
+
+		cfg.runLiveIngest(ctx, stream.ID, dir, input)
+		cfg.finishLiveStream(stream.ID)
+	}()
+	return nil
+}
+
+func (cfg *apiConfig) runLiveIngest(ctx context.Context, streamID uuid.UUID, dir string, input liveInput) {
+	for {
+		args := slices.Concat(
+			cfg.h264Encoder.inputArgs,
+			input.args,
+			[]string{"-map", "0:v:0", "-map", "0:a:0?"},
+			cfg.h264Encoder.outputArgs,
+			[]string{
+				"-g", strconv.Itoa(liveSegmentSeconds * 30),
+				"-c:a", "aac",
+				"-f", "hls",
+				"-hls_time", strconv.Itoa(liveSegmentSeconds),
+				"-hls_list_size", strconv.Itoa(cfg.liveDVRSegments()),
+				"-hls_flags", "independent_segments+program_date_time",
+				"-hls_segment_filename", filepath.Join(dir, liveSegmentPattern),
+				filepath.Join(dir, "index.m3u8"),
+			},
+		)
+		cmd := ffmpegRunner.Command(ctx, "ffmpeg", args...)
+		// let ffmpeg finalize its outputs instead of killing it outright
+		cmd.Cancel = func() error {
+			return cmd.Process.Signal(os.Interrupt)
+		}
+		cmd.WaitDelay = 30 * time.Second
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+
+		err := cmd.Run()
+		if err == nil || ctx.Err() != nil {
+			return
+		}
+		segments, _ := cfg.liveSegments(streamID)
+		if !input.pull || len(segments) > 0 {
+			log.Printf("Live ingest for stream %s exited: %v: %s", streamID, err, lastLines(stderr.Bytes(), 5))
+			return
+		}
+
+		// the publisher hasn't reached the source yet, watchLiveIngest
+		// cancels us if it never does
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(2 * time.Second):
+		}
+	}
+}
+
+// watchLiveIngest flips the stream to live once the first playlist shows up,
+// and gives up on broadcasters that never connect.
+func (cfg *apiConfig) watchLiveIngest(ctx context.Context, cancel context.CancelFunc, streamID uuid.UUID, dir string) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	deadline := time.After(liveConnectTimeout)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-deadline:
+			log.Printf("Nobody connected to live stream %s, stopping it", streamID)
+			cancel()
+			return
+		case <-ticker.C:
+			if _, err := os.Stat(filepath.Join(dir, "index.m3u8")); err == nil {
+				if err := cfg.db.MarkLiveStreamLive(streamID); err != nil {
+					log.Printf("Couldn't mark live stream %s as live: %v", streamID, err)
+				}
+				return
+			}
+		}
+	}
+}
+
+// liveDVRSegments is the number of segments kept in the live playlist, so
+// viewers can seek back through the DVR window.
+func (cfg *apiConfig) liveDVRSegments() int {
+	return max(int(cfg.liveDVRWindow/(liveSegmentSeconds*time.Second)), 3)
+}
+
+// liveSegments returns the segment files of a stream in broadcast order.
+func (cfg *apiConfig) liveSegments(streamID uuid.UUID) ([]string, error) {
+	segments, err := filepath.Glob(filepath.Join(cfg.liveStreamDir(streamID), "segment*.ts"))
+	if err != nil {
+		return nil, err
+	}
+	// the zero padded names sort chronologically
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// finishLiveStream ends the stream and queues archiving of its segments.
+func (cfg *apiConfig) finishLiveStream(streamID uuid.UUID) {
+	err := cfg.db.EndLiveStream(streamID, database.LiveStreamStatusEnded)
+	if err != nil {
+		log.Printf("Couldn't end live stream %s: %v", streamID, err)
+	}
+
+	segments, err := cfg.liveSegments(streamID)
+	if err != nil || len(segments) == 0 {
+		// nothing was broadcast
+		os.RemoveAll(cfg.liveStreamDir(streamID))
+		return
+	}
+
+	_, err = cfg.enqueueJob(jobTypeArchiveLiveStream, nil, archiveLiveStreamPayload{StreamID: streamID})
+	if err != nil {
+		log.Printf("Couldn't queue archiving of live stream %s: %v", streamID, err)
+	}
+}
+
+// recoverLiveStreams cleans up streams that were running when the server
+// last stopped. Their ingest processes are gone, but segments are archived.
+func (cfg *apiConfig) recoverLiveStreams() error {
+	streams, err := cfg.db.GetActiveLiveStreams()
+	if err != nil {
+		return err
+	}
+	for _, stream := range streams {
+		cfg.finishLiveStream(stream.ID)
+	}
+	return nil
+}
+
+func (cfg *apiConfig) runArchiveLiveStreamJob(ctx context.Context, job database.Job) error {
+	var payload archiveLiveStreamPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+
+	stream, err := cfg.db.GetLiveStream(payload.StreamID)
+	if err != nil {
+		return err
+	}
+	if stream.ID == uuid.Nil {
+		return fmt.Errorf("live stream %s no longer exists", payload.StreamID)
+	}
+	if stream.VideoID != nil {
+		return nil
+	}
+
+	dir := cfg.liveStreamDir(stream.ID)
+	recordingPath, err := cfg.concatLiveSegments(ctx, stream.ID)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(recordingPath)
+
+	video, err := cfg.createVideo(ctx, database.CreateVideoParams{
+		Title:       stream.Title,
+		Description: fmt.Sprintf("Recorded live on %s", stream.CreatedAt.Format("January 2, 2006")),
+		UserID:      stream.UserID,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = cfg.processVideoUpload(ctx, video, recordingPath, cfg.defaultTranscodeProfile())
+	if err != nil {
+		return err
+	}
+
+	err = cfg.db.SetLiveStreamVideo(stream.ID, video.ID)
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// concatLiveSegments joins every segment of the broadcast into a single MP4
+// without re-encoding.
+func (cfg *apiConfig) concatLiveSegments(ctx context.Context, streamID uuid.UUID) (string, error) {
+	segments, err := cfg.liveSegments(streamID)
+	if err != nil {
+		return "", err
+	}
+	if len(segments) == 0 {
+		return "", fmt.Errorf("live stream %s has no segments", streamID)
+	}
+
+	var list strings.Builder
+	for _, segment := range segments {
+		fmt.Fprintf(&list, "file '%s'\n", filepath.Base(segment))
+	}
+	dir := cfg.liveStreamDir(streamID)
+	listPath := filepath.Join(dir, "segments.txt")
+	err = os.WriteFile(listPath, []byte(list.String()), 0644)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(listPath)
+
+	recordingPath := filepath.Join(dir, "recording.mp4")
+	cmd := ffmpegRunner.Command(ctx, "ffmpeg",
+		"-y",
+		"-f", "concat",
+		"-safe", "0",
+		"-i", listPath,
+		"-c", "copy",
+		"-bsf:a", "aac_adtstoasc",
+		recordingPath,
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if err != nil {
+		return "", newCommandError("ffmpeg", err, stderr.Bytes())
+	}
+	return recordingPath, nil
+}
+
+func lastLines(output []byte, n int) []byte {
+	lines := bytes.Split(bytes.TrimSpace(output), []byte("\n"))
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return bytes.Join(lines, []byte("\n"))
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	// how often pressure is measured
+	loadSampleInterval = 5 * time.Second
+	// shedding for a resource stops once it is back under this share of
+	// its threshold, so uploads don't flap in and out around it
+	loadShedRecoveryRatio = 0.9
+	// clients are told to retry shed uploads after this long
+	loadShedRetryAfter = 30 * time.Second
+)
+
+// uploadsShed counts the uploads refused, or that would have been in dry
+// run mode, because of pressure.
+var uploadsShed atomic.Int64
+
+type loadResource string
+
+const (
+	loadResourceCPU        loadResource = "cpu"
+	loadResourceMemory     loadResource = "memory"
+	loadResourceQueueDepth loadResource = "queue_depth"
+)
+
+var loadResources = []loadResource{loadResourceCPU, loadResourceMemory, loadResourceQueueDepth}
+
+// loadThresholds are the pressures past which new uploads are shed, 0
+// turns a check off. CPU and memory are percentages of what the host or
+// the container's cgroup has, queue depth is the number of pending jobs.
+type loadThresholds struct {
+	CPUPercent    float64
+	MemoryPercent float64
+	QueueDepth    int
+}
+
+func (t loadThresholds) of(resource loadResource) float64 {
+	switch resource {
+	case loadResourceCPU:
+		return t.CPUPercent
+	case loadResourceMemory:
+		return t.MemoryPercent
+	default:
+		return float64(t.QueueDepth)
+	}
+}
+
+// loadPressure is a measurement of every resource.
+type loadPressure struct {
+	CPUPercent    float64
+	MemoryPercent float64
+	QueueDepth    int
+}
+
+func (p loadPressure) of(resource loadResource) float64 {
+	switch resource {
+	case loadResourceCPU:
+		return p.CPUPercent
+	case loadResourceMemory:
+		return p.MemoryPercent
+	default:
+		return float64(p.QueueDepth)
+	}
+}
+
+// loadShedder refuses new uploads while the process's host is under
+// pressure. Metadata, playback and everything else keep being served, only
+// the expensive way in is closed.
+type loadShedder struct {
+	thresholds loadThresholds
+	// dryRun logs and counts uploads that would be shed but lets them in
+	dryRun bool
+
+	mu       sync.Mutex
+	pressure loadPressure
+	// resources over their threshold, uploads are shed while any is
+	shedding map[loadResource]bool
+	// CPU time counters of the previous sample, usage is the difference
+	lastCPU cpuTimes
+}
+
+func newLoadShedder(thresholds loadThresholds, dryRun bool) *loadShedder {
+	return &loadShedder{thresholds: thresholds, dryRun: dryRun, shedding: map[loadResource]bool{}}
+}
+
+// update records a measurement and starts or stops shedding for the
+// resources it moved past their thresholds.
+func (s *loadShedder) update(pressure loadPressure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pressure = pressure
+	for _, resource := range loadResources {
+		threshold := s.thresholds.of(resource)
+		if threshold <= 0 {
+			continue
+		}
+		value := pressure.of(resource)
+		switch {
+		case !s.shedding[resource] && value >= threshold:
+			s.shedding[resource] = true
+			log.Printf("Shedding uploads: %s is at %g, over %g", resource, value, threshold)
+		case s.shedding[resource] && value < threshold*loadShedRecoveryRatio:
+			delete(s.shedding, resource)
+			log.Printf("Stopped shedding uploads for %s, back to %g", resource, value)
+		}
+	}
+}
+
+// overloaded returns the resources uploads are being shed for.
+func (s *loadShedder) overloaded() []loadResource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resources := []loadResource{}
+	for _, resource := range loadResources {
+		if s.shedding[resource] {
+			resources = append(resources, resource)
+		}
+	}
+	return resources
+}
+
+func (s *loadShedder) snapshot() (loadPressure, map[loadResource]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	shedding := make(map[loadResource]bool, len(s.shedding))
+	for resource, on := range s.shedding {
+		shedding[resource] = on
+	}
+	return s.pressure, shedding
+}
+
+// admitUploadUnderLoad refuses a new upload with 503 while the shedder is
+// shedding, responding with the error itself.
+func (cfg *apiConfig) admitUploadUnderLoad(w http.ResponseWriter) bool {
+	if cfg.loadShedder == nil {
+		return true
+	}
+	resources := cfg.loadShedder.overloaded()
+	if len(resources) == 0 {
+		return true
+	}
+	uploadsShed.Add(1)
+	if cfg.loadShedder.dryRun {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(loadShedRetryAfter.Seconds())))
+	respondWithErrorDetails(w, http.StatusServiceUnavailable, errCodeCapacityExceeded,
+		"The server is too busy to take uploads right now, try again in a little while",
+		map[string]any{"overloaded": resources}, nil)
+	return false
+}
+
+// sampleLoad measures CPU, memory and the job queue for the shedder.
+func (cfg *apiConfig) sampleLoad(ctx context.Context) error {
+	s := cfg.loadShedder
+	var pressure loadPressure
+	var errs []error
+
+	if s.thresholds.CPUPercent > 0 {
+		times, err := readCPUTimes()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cpu: %w", err))
+		} else {
+			s.mu.Lock()
+			pressure.CPUPercent = times.busyPercentSince(s.lastCPU)
+			s.lastCPU = times
+			s.mu.Unlock()
+		}
+	}
+	if s.thresholds.MemoryPercent > 0 {
+		percent, err := readMemoryPercent()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("memory: %w", err))
+		}
+		pressure.MemoryPercent = percent
+	}
+	if s.thresholds.QueueDepth > 0 {
+		counts, err := cfg.db.WithContext(ctx).CountJobsByStatus()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("queue depth: %w", err))
+		}
+		pressure.QueueDepth = counts[database.JobStatusPending]
+	}
+
+	// a resource that couldn't be measured reads as idle, it never stops
+	// uploads on its own
+	s.update(pressure)
+	return errors.Join(errs...)
+}
+
+// cpuTimes are the jiffies the CPUs spent busy and in total since boot.
+type cpuTimes struct {
+	busy  uint64
+	total uint64
+}
+
+func (t cpuTimes) busyPercentSince(previous cpuTimes) float64 {
+	if previous.total == 0 || t.total <= previous.total {
+		return 0
+	}
+	return 100 * float64(t.busy-previous.busy) / float64(t.total-previous.total)
+}
+
+func readCPUTimes() (cpuTimes, error) {
+	f, err := os.Open("/proc/stat")
+	if err != nil {
+		return cpuTimes{}, err
+	}
+	defer f.Close()
+	return parseCPUTimes(f)
+}
+
+// parseCPUTimes reads the aggregate cpu line of /proc/stat. Idle and
+// iowait count as idle, guest time is already part of user time.
+func parseCPUTimes(r io.Reader) (cpuTimes, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 || fields[0] != "cpu" {
+			continue
+		}
+		var times cpuTimes
+		for i, field := range fields[1:] {
+			// guest and guest_nice
+			if i >= 8 {
+				break
+			}
+			n, err := strconv.ParseUint(field, 10, 64)
+			if err != nil {
+				return cpuTimes{}, fmt.Errorf("invalid cpu line %q", scanner.Text())
+			}
+			times.total += n
+			if i != 3 && i != 4 {
+				times.busy += n
+			}
+		}
+		return times, nil
+	}
+	if err := scanner.Err(); err != nil {
+		return cpuTimes{}, err
+	}
+	return cpuTimes{}, errors.New("no cpu line in /proc/stat")
+}
+
+// readMemoryPercent returns how much of the container's memory limit is
+// used, or of the host's memory when there's no limit.
+func readMemoryPercent() (float64, error) {
+	limit, err := os.ReadFile("/sys/fs/cgroup/memory.max")
+	if err == nil && strings.TrimSpace(string(limit)) != "max" {
+		current, err := os.ReadFile("/sys/fs/cgroup/memory.current")
+		if err != nil {
+			return 0, err
+		}
+		return cgroupMemoryPercent(string(current), string(limit))
+	}
+
+	f, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	return parseMemInfoPercent(f)
+}
+
+func cgroupMemoryPercent(current, limit string) (float64, error) {
+	used, err := strconv.ParseUint(strings.TrimSpace(current), 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid memory.current %q", current)
+	}
+	max, err := strconv.ParseUint(strings.TrimSpace(limit), 10, 64)
+	if err != nil || max == 0 {
+		return 0, fmt.Errorf("invalid memory.max %q", limit)
+	}
+	return 100 * float64(used) / float64(max), nil
+}
+
+// parseMemInfoPercent reads /proc/meminfo. Memory the kernel can reclaim,
+// like the page cache, counts as available.
+func parseMemInfoPercent(r io.Reader) (float64, error) {
+	values := map[string]uint64{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		name, rest, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) == 0 {
+			continue
+		}
+		if n, err := strconv.ParseUint(fields[0], 10, 64); err == nil {
+			values[name] = n
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, err
+	}
+	total, available := values["MemTotal"], values["MemAvailable"]
+	if total == 0 || available > total {
+		return 0, errors.New("no MemTotal and MemAvailable in /proc/meminfo")
+	}
+	return 100 * float64(total-available) / float64(total), nil
+}
+
+// writeLoadMetrics adds the shedder's gauges to the metrics.
+func (cfg *apiConfig) writeLoadMetrics(w io.Writer) {
+	writeMetricHeader(w, "tubely_load_shed_uploads_total", "counter", "Uploads refused, or let in by a dry run, because the server was under pressure.")
+	fmt.Fprintf(w, "tubely_load_shed_uploads_total %d\n", uploadsShed.Load())
+	if cfg.loadShedder == nil {
+		return
+	}
+
+	pressure, shedding := cfg.loadShedder.snapshot()
+	writeMetricHeader(w, "tubely_load_pressure", "gauge", "Last measured CPU and memory use in percent, and pending jobs.")
+	for _, resource := range loadResources {
+		if cfg.loadShedder.thresholds.of(resource) > 0 {
+			fmt.Fprintf(w, "tubely_load_pressure{resource=%q} %g\n", resource, math.Round(pressure.of(resource)*100)/100)
+		}
+	}
+	writeMetricHeader(w, "tubely_load_shed_threshold", "gauge", "Pressure past which uploads are shed, by resource.")
+	for _, resource := range loadResources {
+		if threshold := cfg.loadShedder.thresholds.of(resource); threshold > 0 {
+			fmt.Fprintf(w, "tubely_load_shed_threshold{resource=%q} %g\n", resource, threshold)
+		}
+	}
+	writeMetricHeader(w, "tubely_load_shedding", "gauge", "Whether uploads are being shed because of the resource.")
+	for _, resource := range loadResources {
+		if cfg.loadShedder.thresholds.of(resource) > 0 {
+			fmt.Fprintf(w, "tubely_load_shedding{resource=%q} %d\n", resource, boolMetric(shedding[resource]))
+		}
+	}
+}
+
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+func TestLoadShedderHysteresis(t *testing.T) {
+	s := newLoadShedder(loadThresholds{CPUPercent: 80, QueueDepth: 10}, false)
+
+	s.update(loadPressure{CPUPercent: 79, MemoryPercent: 99, QueueDepth: 3})
+	if got := s.overloaded(); len(got) != 0 {
+		t.Fatalf("shedding under the thresholds: %v", got)
+	}
+	s.update(loadPressure{CPUPercent: 85, QueueDepth: 10})
+	if got := s.overloaded(); len(got) != 2 {
+		t.Fatalf("shedding for %v, want cpu and queue_depth", got)
+	}
+	// under the threshold but not under 90% of it yet
+	s.update(loadPressure{CPUPercent: 75, QueueDepth: 2})
+	if got := s.overloaded(); len(got) != 1 || got[0] != loadResourceCPU {
+		t.Fatalf("shedding for %v, want cpu", got)
+	}
+	s.update(loadPressure{CPUPercent: 70})
+	if got := s.overloaded(); len(got) != 0 {
+		t.Fatalf("still shedding for %v", got)
+	}
+}
+
+func TestParseCPUTimes(t *testing.T) {
+	stat := "cpu  100 5 50 800 20 3 2 0 40 0\ncpu0 50 2 25 400 10 1 1 0 20 0\nintr 12345\n"
+	times, err := parseCPUTimes(strings.NewReader(stat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// guest time is left out, it's counted in user time already
+	if times.busy != 160 || times.total != 980 {
+		t.Errorf("got %+v", times)
+	}
+
+	next := cpuTimes{busy: times.busy + 30, total: times.total + 100}
+	if got := next.busyPercentSince(times); got != 30 {
+		t.Errorf("busy %g%%, want 30%%", got)
+	}
+	if got := times.busyPercentSince(cpuTimes{}); got != 0 {
+		t.Errorf("first sample busy %g%%, want 0", got)
+	}
+
+	if _, err := parseCPUTimes(strings.NewReader("intr 12345\n")); err == nil {
+		t.Error("parsed a stat without a cpu line")
+	}
+}
+
+func TestMemoryPercent(t *testing.T) {
+	meminfo := "MemTotal:       16000000 kB\nMemFree:         1000000 kB\nMemAvailable:    4000000 kB\n"
+	percent, err := parseMemInfoPercent(strings.NewReader(meminfo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if percent != 75 {
+		t.Errorf("meminfo %g%%, want 75%%", percent)
+	}
+
+	percent, err = cgroupMemoryPercent("268435456\n", "536870912\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if percent != 50 {
+		t.Errorf("cgroup %g%%, want 50%%", percent)
+	}
+	if _, err := cgroupMemoryPercent("1", "max"); err == nil {
+		t.Error("parsed an unlimited cgroup")
+	}
+}
+
+func TestSheddingRefusesUploadsButNotReads(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.metadataCache = newLRUCache(10)
+	cfg.loadShedder = newLoadShedder(loadThresholds{QueueDepth: 1}, false)
+
+	user, err := cfg.db.CreateUser(database.CreateUserParams{Email: "shed@example.com", Password: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Busy", UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.db.CreateJob(database.CreateJobParams{Type: "noop", Payload: json.RawMessage(`{}`)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.sampleLoad(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	shedBefore := uploadsShed.Load()
+	rec := httptest.NewRecorder()
+	if cfg.admitUpload(rec, user.ID) {
+		t.Fatal("admitted an upload while shedding")
+	}
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("got %d with Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+	var body struct {
+		Code string `json:"code"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &body)
+	if body.Code != string(errCodeCapacityExceeded) {
+		t.Errorf("error code %q", body.Code)
+	}
+	if uploadsShed.Load() != shedBefore+1 {
+		t.Error("shed upload wasn't counted")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/videos/"+video.ID.String(), nil)
+	req.SetPathValue("videoID", video.ID.String())
+	rec = httptest.NewRecorder()
+	cfg.handlerVideoGet(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Errorf("metadata read got %d: %s", rec.Code, rec.Body)
+	}
+
+	// dry runs count the upload and let it in
+	cfg.loadShedder.dryRun = true
+	if !cfg.admitUpload(httptest.NewRecorder(), user.ID) {
+		t.Error("dry run refused an upload")
+	}
+	if uploadsShed.Load() != shedBefore+2 {
+		t.Error("dry run upload wasn't counted")
+	}
+
+	rec = httptest.NewRecorder()
+	cfg.writeLoadMetrics(rec)
+	for _, line := range []string{
+		`tubely_load_pressure{resource="queue_depth"} 1`,
+		`tubely_load_shed_threshold{resource="queue_depth"} 1`,
+		`tubely_load_shedding{resource="queue_depth"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), line+"\n") {
+			t.Errorf("metrics are missing %q:\n%s", line, rec.Body)
+		}
+	}
+	if strings.Contains(rec.Body.String(), `resource="cpu"`) {
+		t.Error("metrics include the cpu check, which is off")
+	}
+}
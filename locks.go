@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// leases run out this long after their holder stopped extending them,
+	// so a crashed process doesn't hold on to a key for good
+	leaseTTL = 30 * time.Second
+)
+
+var (
+	errVideoProcessingLocked = errors.New("video is already being processed")
+	errTooManyUploads        = errors.New("too many uploads in progress")
+)
+
+// locker hands out leases on keys, so only one holder at a time works on
+// something.
+type locker interface {
+	tryLock(ctx context.Context, key, token string, ttl time.Duration) (bool, error)
+	// extend reports false when the lease was lost to another holder
+	extend(ctx context.Context, key, token string, ttl time.Duration) (bool, error)
+	unlock(ctx context.Context, key, token string) error
+}
+
+// memoryLocker only excludes holders within the same process.
+type memoryLocker struct {
+	mu     sync.Mutex
+	leases map[string]memoryLease
+}
+
+type memoryLease struct {
+	token   string
+	expires time.Time
+}
+
+func newMemoryLocker() *memoryLocker {
+	return &memoryLocker{leases: map[string]memoryLease{}}
+}
+
+func (l *memoryLocker) tryLock(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	if lease, ok := l.leases[key]; ok && now.Before(lease.expires) {
+		return false, nil
+	}
+	l.leases[key] = memoryLease{token: token, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (l *memoryLocker) extend(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if lease, ok := l.leases[key]; !ok || lease.token != token {
+		return false, nil
+	}
+	l.leases[key] = memoryLease{token: token, expires: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (l *memoryLocker) unlock(ctx context.Context, key, token string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if lease, ok := l.leases[key]; ok && lease.token == token {
+		delete(l.leases, key)
+	}
+	return nil
+}
+
+// redisLocker excludes holders across every instance and worker.
+type redisLocker struct {
+	client *redisClient
+}
+
+// only the holder may extend or release its lease
+const (
+	redisExtendScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`
+	redisUnlockScript = `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`
+)
+
+func (l redisLocker) tryLock(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	reply, err := l.client.do(ctx, "SET", redisKeyPrefix+"lock:"+key, token, "NX", "PX", redisMillis(ttl))
+	if err != nil {
+		return false, err
+	}
+	// a nil reply means the key is taken
+	return reply == "OK", nil
+}
+
+func (l redisLocker) extend(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	reply, err := l.client.eval(ctx, redisExtendScript, []string{redisKeyPrefix + "lock:" + key}, token, redisMillis(ttl))
+	if err != nil {
+		return false, err
+	}
+	return reply == int64(1), nil
+}
+
+func (l redisLocker) unlock(ctx context.Context, key, token string) error {
+	_, err := l.client.eval(ctx, redisUnlockScript, []string{redisKeyPrefix + "lock:" + key}, token)
+	return err
+}
+
+// dbLocker excludes holders across every process sharing the database. It's
+// slower than Redis, so it's only used for leases that change hands rarely.
+type dbLocker struct {
+	db database.Client
+}
+
+func (l dbLocker) tryLock(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	now := time.Now()
+	return l.db.WithContext(ctx).TryAcquireLease(key, token, now.Add(ttl), now)
+}
+
+func (l dbLocker) extend(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	return l.db.WithContext(ctx).ExtendLease(key, token, time.Now().Add(ttl))
+}
+
+func (l dbLocker) unlock(ctx context.Context, key, token string) error {
+	return l.db.WithContext(ctx).ReleaseLease(key, token)
+}
+
+// acquireLease takes the lock on key and keeps extending it until the
+// returned release is called.
+func (cfg *apiConfig) acquireLease(ctx context.Context, key string) (release func(), ok bool, err error) {
+	token := uuid.NewString()
+	ok, err = cfg.locker.tryLock(ctx, key, token, leaseTTL)
+	if err != nil || !ok {
+		return nil, false, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(leaseTTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+				held, err := cfg.locker.extend(ctx, key, token, leaseTTL)
+				cancel()
+				if err != nil {
+					log.Printf("Couldn't extend lease on %s: %v", key, err)
+				} else if !held {
+					log.Printf("Lost lease on %s", key)
+					return
+				}
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+			defer cancel()
+			if err := cfg.locker.unlock(ctx, key, token); err != nil {
+				log.Printf("Couldn't release lease on %s: %v", key, err)
+			}
+		})
+	}, true, nil
+}
+
+// lockVideoProcessing makes sure only one process at a time runs a video
+// through the pipeline. Unlike the rate limits it fails closed.
+func (cfg *apiConfig) lockVideoProcessing(ctx context.Context, videoID uuid.UUID) (func(), error) {
+	release, ok, err := cfg.acquireLease(ctx, "processing:"+videoID.String())
+	if err != nil {
+		return nil, fmt.Errorf("couldn't lock video: %w", err)
+	}
+	if !ok {
+		return nil, errVideoProcessingLocked
+	}
+	return release, nil
+}
+
+// acquireUploadSlot takes one of the slots the user's uploads are processed
+// in while they wait, errTooManyUploads when they're all taken. Slots are
+// leases on numbered keys, so they're shared the same way locks are.
+// Without a limit every upload gets one, and so does every upload while
+// Redis is unreachable.
+func (cfg *apiConfig) acquireUploadSlot(ctx context.Context, userID uuid.UUID) (func(), error) {
+	if cfg.uploadConcurrency <= 0 {
+		return func() {}, nil
+	}
+	for slot := range cfg.uploadConcurrency {
+		release, ok, err := cfg.acquireLease(ctx, "upload:"+userID.String()+":"+strconv.Itoa(slot))
+		if err != nil {
+			log.Printf("Couldn't check upload slots of user %s: %v", userID, err)
+			return func() {}, nil
+		}
+		if ok {
+			return release, nil
+		}
+	}
+	return nil, errTooManyUploads
+}
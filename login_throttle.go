@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// failed logins in a row before an account is locked
+	loginAccountFailureLimit = 5
+	// an address guessing across many accounts gets more room, offices and
+	// carrier NAT share one
+	loginIPFailureLimit = 20
+	loginLockout        = time.Minute
+	maxLoginLockout     = time.Hour
+	// failures this old are forgotten
+	loginFailureMemory = 24 * time.Hour
+)
+
+// loginThrottle tracks failed logins per account and per address and locks
+// a key out once it fails too often, doubling the lockout with every further
+// failure.
+type loginThrottle interface {
+	// locked reports whether any of the keys is locked out and how long
+	// until all of them can try again.
+	locked(keys ...string) (bool, time.Duration)
+	// fail records a failed login for key, which may fail limit times
+	// before it is locked out. It returns the lockout the failure started,
+	// zero if none.
+	fail(key string, limit int) time.Duration
+	// succeed forgets the failures of key.
+	succeed(key string)
+}
+
+// loginLockoutAfter is how long key is locked out after its count-th
+// failure in a row: 1m, 2m, 4m, ... capped at maxLoginLockout.
+func loginLockoutAfter(count, limit int) time.Duration {
+	if count < limit {
+		return 0
+	}
+	if doublings := count - limit; doublings < 6 {
+		return min(loginLockout<<doublings, maxLoginLockout)
+	}
+	return maxLoginLockout
+}
+
+// memoryLoginThrottle lives in memory, so every server instance counts on
+// its own.
+type memoryLoginThrottle struct {
+	mu        sync.Mutex
+	failures  map[string]loginFailures
+	lastPrune time.Time
+}
+
+type loginFailures struct {
+	count       int
+	last        time.Time
+	lockedUntil time.Time
+}
+
+func newLoginThrottle() *memoryLoginThrottle {
+	return &memoryLoginThrottle{
+		failures: map[string]loginFailures{},
+	}
+}
+
+func (t *memoryLoginThrottle) locked(keys ...string) (bool, time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, key := range keys {
+		if until := t.failures[key].lockedUntil; until.After(now) {
+			wait = max(wait, until.Sub(now))
+		}
+	}
+	return wait > 0, wait
+}
+
+func (t *memoryLoginThrottle) fail(key string, limit int) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(t.lastPrune) >= time.Minute {
+		t.prune(now)
+	}
+	f := t.failures[key]
+	if now.Sub(f.last) >= loginFailureMemory {
+		f = loginFailures{}
+	}
+	f.count++
+	f.last = now
+
+	lockout := loginLockoutAfter(f.count, limit)
+	if lockout > 0 {
+		f.lockedUntil = now.Add(lockout)
+	}
+	t.failures[key] = f
+	return lockout
+}
+
+func (t *memoryLoginThrottle) succeed(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.failures, key)
+}
+
+// prune drops keys that haven't failed in a while, so addresses trying once
+// don't pile up.
+func (t *memoryLoginThrottle) prune(now time.Time) {
+	t.lastPrune = now
+	for key, f := range t.failures {
+		if now.Sub(f.last) >= loginFailureMemory && now.After(f.lockedUntil) {
+			delete(t.failures, key)
+		}
+	}
+}
+
+// redisLoginThrottle counts failures in Redis, so an account or address is
+// locked out on every instance at once. Failures are counted in one key
+// that expires loginFailureMemory after the last of them, lockouts are keys
+// that expire when they end. When Redis can't be reached logins are let
+// through, like with rate limits.
+type redisLoginThrottle struct {
+	client *redisClient
+}
+
+// returns the longest time left on any of the lockouts, 0 when none is on
+const redisLoginLockedScript = `
+local wait = 0
+for _, key in ipairs(KEYS) do
+	local ttl = redis.call('PTTL', key)
+	if ttl > wait then wait = ttl end
+end
+return wait
+`
+
+// counts a failure and returns how many there were in a row
+const redisLoginFailScript = `
+local count = redis.call('INCR', KEYS[1])
+redis.call('PEXPIRE', KEYS[1], ARGV[1])
+return count
+`
+
+func (t redisLoginThrottle) failuresKey(key string) string {
+	return redisKeyPrefix + "login:failures:" + key
+}
+
+func (t redisLoginThrottle) lockoutKey(key string) string {
+	return redisKeyPrefix + "login:lockout:" + key
+}
+
+func (t redisLoginThrottle) locked(keys ...string) (bool, time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	lockoutKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		lockoutKeys = append(lockoutKeys, t.lockoutKey(key))
+	}
+	reply, err := t.client.eval(ctx, redisLoginLockedScript, lockoutKeys)
+	if err != nil {
+		log.Printf("Couldn't check login lockouts in Redis: %v", err)
+		return false, 0
+	}
+	wait, _ := reply.(int64)
+	return wait > 0, time.Duration(wait) * time.Millisecond
+}
+
+func (t redisLoginThrottle) fail(key string, limit int) time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	reply, err := t.client.eval(ctx, redisLoginFailScript, []string{t.failuresKey(key)}, redisMillis(loginFailureMemory))
+	if err != nil {
+		log.Printf("Couldn't record failed login in Redis: %v", err)
+		return 0
+	}
+	count, _ := reply.(int64)
+
+	lockout := loginLockoutAfter(int(count), limit)
+	if lockout > 0 {
+		_, err = t.client.do(ctx, "SET", t.lockoutKey(key), strconv.FormatInt(count, 10), "PX", redisMillis(lockout))
+		if err != nil {
+			log.Printf("Couldn't lock out login in Redis: %v", err)
+		}
+	}
+	return lockout
+}
+
+func (t redisLoginThrottle) succeed(key string) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	_, err := t.client.do(ctx, "DEL", t.failuresKey(key), t.lockoutKey(key))
+	if err != nil {
+		log.Printf("Couldn't reset failed logins in Redis: %v", err)
+	}
+}
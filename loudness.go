@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// EBU R128 targets used when a profile's loudnorm leaves them out. -16 LUFS
+// is what most streaming platforms normalize to.
+const (
+	defaultLoudnormIntegrated = -16.0
+	defaultLoudnormTruePeak   = -1.5
+	defaultLoudnormRange      = 11.0
+)
+
+// loudnormOptions are the targets of a profile's loudness normalization.
+type loudnormOptions struct {
+	// Integrated is the target loudness in LUFS
+	Integrated float64 `json:"integrated,omitempty"`
+	// TruePeak is the maximum true peak in dBTP
+	TruePeak float64 `json:"true_peak,omitempty"`
+	// Range is the target loudness range in LU
+	Range float64 `json:"range,omitempty"`
+}
+
+func (o loudnormOptions) withDefaults() loudnormOptions {
+	if o.Integrated == 0 {
+		o.Integrated = defaultLoudnormIntegrated
+	}
+	if o.TruePeak == 0 {
+		o.TruePeak = defaultLoudnormTruePeak
+	}
+	if o.Range == 0 {
+		o.Range = defaultLoudnormRange
+	}
+	return o
+}
+
+func (o loudnormOptions) validate() error {
+	o = o.withDefaults()
+	if o.Integrated < -70 || o.Integrated > -5 {
+		return errors.New("loudnorm integrated must be between -70 and -5 LUFS")
+	}
+	if o.TruePeak < -9 || o.TruePeak > 0 {
+		return errors.New("loudnorm true_peak must be between -9 and 0 dBTP")
+	}
+	if o.Range < 1 || o.Range > 50 {
+		return errors.New("loudnorm range must be between 1 and 50 LU")
+	}
+	return nil
+}
+
+// loudnormMeasurement is the first pass of ffmpeg's loudnorm filter. Feeding
+// it to the second pass normalizes linearly instead of compressing dynamics.
+type loudnormMeasurement struct {
+	InputI       string `json:"input_i"`
+	InputTP      string `json:"input_tp"`
+	InputLRA     string `json:"input_lra"`
+	InputThresh  string `json:"input_thresh"`
+	TargetOffset string `json:"target_offset"`
+}
+
+// filter returns the loudnorm filter normalizing to o, using the measured
+// values of the first pass when there are any.
+func (o loudnormOptions) filter(measured *loudnormMeasurement) string {
+	o = o.withDefaults()
+	filter := fmt.Sprintf("loudnorm=I=%g:TP=%g:LRA=%g", o.Integrated, o.TruePeak, o.Range)
+	if measured != nil {
+		filter += fmt.Sprintf(":measured_I=%s:measured_TP=%s:measured_LRA=%s:measured_thresh=%s:offset=%s:linear=true",
+			measured.InputI, measured.InputTP, measured.InputLRA, measured.InputThresh, measured.TargetOffset)
+	}
+	return filter
+}
+
+// measureLoudness runs the first loudnorm pass over the audio of filePath.
+func measureLoudness(ctx context.Context, filePath string, o loudnormOptions) (loudnormMeasurement, error) {
+	args := []string{"-hide_banner", "-nostats", "-i", filePath, "-vn", "-af", o.filter(nil) + ":print_format=json", "-f", "null", "-"}
+	cmd := ffmpegRunner.Command(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return loudnormMeasurement{}, newCommandError("ffmpeg", err, stderr.Bytes())
+	}
+
+	// the JSON comes last, after ffmpeg's own logging
+	out := stderr.Bytes()
+	start := bytes.LastIndexByte(out, '{')
+	end := bytes.LastIndexByte(out, '}')
+	if start < 0 || end < start {
+		return loudnormMeasurement{}, errors.New("loudnorm printed no measurement")
+	}
+	var measured loudnormMeasurement
+	if err := json.Unmarshal(out[start:end+1], &measured); err != nil {
+		return loudnormMeasurement{}, fmt.Errorf("couldn't decode loudnorm measurement: %w", err)
+	}
+	return measured, nil
+}
+
+// loudness converts the measurement for storing. Silent audio measures
+// -inf, which isn't stored.
+func (m loudnormMeasurement) loudness() (*database.Loudness, error) {
+	integrated, err := strconv.ParseFloat(m.InputI, 64)
+	if err != nil {
+		return nil, err
+	}
+	truePeak, err := strconv.ParseFloat(m.InputTP, 64)
+	if err != nil {
+		return nil, err
+	}
+	loudnessRange, err := strconv.ParseFloat(m.InputLRA, 64)
+	if err != nil {
+		return nil, err
+	}
+	return &database.Loudness{
+		IntegratedLUFS: integrated,
+		TruePeakDBTP:   truePeak,
+		RangeLU:        loudnessRange,
+	}, nil
+}
@@ -2,30 +2,103 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
+	"io/fs"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/billing"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/contentid"
 	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/drm"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/geoip"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/llm"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/moderation"
 
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 type apiConfig struct {
-	db               database.Client
-	jwtSecret        string
-	platform         string
-	filepathRoot     string
-	assetsRoot       string
-	s3Bucket         string
-	s3Region         string
-	s3CfDistribution string
-	port             string
-	s3Client         *s3.Client
+	db                   database.Client
+	jwtSecret            string
+	platform             string
+	filepathRoot         string
+	assetsRoot           string
+	s3Bucket             string
+	objectEncryption     objectEncryption
+	s3Region             string
+	storageRoutes        storageRoutes
+	keyStrategy          keyStrategy
+	cdnURLSigner         *cdnURLSigner
+	assetProtection      assetProtection
+	port                 string
+	awsConfig            aws.Config
+	s3Client             *s3.Client
+	adminAPIKey          string
+	mailer               Mailer
+	trashRetention       time.Duration
+	uploadSessionTTL     time.Duration
+	plans                map[database.Plan]planLimits
+	stripe               *billing.Stripe
+	stripeProPriceID     string
+	jobMaxAttempts       int
+	jobVisibilityTimeout time.Duration
+	jobQueue             jobQueue
+	s3EventsTopicArn     string
+	snsVerifier          *snsVerifier
+	h264Encoder          videoEncoder
+	transcodeProfiles    transcodeProfiles
+	storeOriginals       bool
+	detachProcessing     bool
+	webhookURL           string
+	webhookSecret        string
+	eventDispatch        string
+	eventBroker          eventBroker
+	search               *searchIndex
+	moderator            moderation.Moderator
+	moderationThreshold  float64
+	contentID            contentid.Checker
+	contentIDConfidence  float64
+	contentIDBlock       bool
+	llm                  llm.Provider
+	chapterSegmenter     chapterSegmenter
+	geoIP                *geoip.DB
+	trustProxyHeaders    bool
+	trustedProxyHops     int
+	ipAllowlist          ipList
+	ipDenylist           ipList
+	drmKeyServer         *drm.KeyServer
+	drmLicenseServers    drmLicenseServers
+	packagerBin          string
+	hlsEncryption        bool
+	playbackTokens       bool
+	appBaseURL           string
+	liveRoot             string
+	liveRTMPHost         string
+	liveDVRWindow        time.Duration
+	whipGatewayURL       string
+	whipGatewayRTSPURL   string
+	live                 *liveManager
+	frameCacheDir        string
+	frameLimiter         rateLimiter
+	suggestionLimiter    rateLimiter
+	loginThrottle        loginThrottle
+	sitemap              *sitemapCache
+	metadataCache        metadataCache
+	locker               locker
+	uploadConcurrency    int
+	loadShedder          *loadShedder
 }
 
 func main() {
@@ -51,9 +124,19 @@ func main() {
 		log.Fatal("PLATFORM environment variable is not set")
 	}
 
+	// the web UI is built into the binary, FILEPATH_ROOT serves it from disk
+	// instead while working on it
+	appFiles, err := fs.Sub(embeddedApp, "app")
+	if err != nil {
+		log.Fatalf("Couldn't open embedded web UI: %v", err)
+	}
 	filepathRoot := os.Getenv("FILEPATH_ROOT")
-	if filepathRoot == "" {
-		log.Fatal("FILEPATH_ROOT environment variable is not set")
+	if filepathRoot != "" {
+		appFiles = os.DirFS(filepathRoot)
+	}
+	webUI, err := newFrontend(appFiles)
+	if err != nil {
+		log.Fatalf("Couldn't load web UI: %v", err)
 	}
 
 	assetsRoot := os.Getenv("ASSETS_ROOT")
@@ -71,39 +154,605 @@ func main() {
 		log.Fatal("S3_REGION environment variable is not set")
 	}
 
+	// optional, for S3-compatible stores like MinIO, Ceph or Backblaze B2
+	s3Endpoint := s3EndpointConfig{
+		URL:                strings.TrimSuffix(os.Getenv("S3_ENDPOINT"), "/"),
+		PathStyle:          os.Getenv("S3_FORCE_PATH_STYLE") == "true",
+		InsecureSkipVerify: os.Getenv("S3_INSECURE_SKIP_VERIFY") == "true",
+	}
+	if s3Endpoint.URL != "" {
+		endpointURL, err := url.Parse(s3Endpoint.URL)
+		if err != nil || (endpointURL.Scheme != "https" && endpointURL.Scheme != "http") || endpointURL.Host == "" {
+			log.Fatal("S3_ENDPOINT must be an absolute http(s) URL")
+		}
+	}
+	if s3Endpoint.InsecureSkipVerify && platform != "dev" {
+		log.Fatal("S3_INSECURE_SKIP_VERIFY is only allowed when PLATFORM is dev")
+	}
+
+	// optional, otherwise the bucket's default encryption applies
+	objectEncryption, err := parseObjectEncryption(os.Getenv("S3_SSE"), os.Getenv("S3_SSE_KMS_KEY_ID"))
+	if err != nil {
+		log.Fatalf("Invalid server-side encryption config: %v", err)
+	}
+
 	s3CfDistribution := os.Getenv("S3_CF_DISTRO")
 	if s3CfDistribution == "" {
 		log.Fatal("S3_CF_DISTRO environment variable is not set")
 	}
 
+	// optional, enables CDN cache invalidation when videos are replaced
+	cfDistributionID := os.Getenv("CF_DISTRIBUTION_ID")
+
+	// optional, stores originals, renditions and exports apart from the rest
+	storageRoutesPath := os.Getenv("STORAGE_ROUTES_PATH")
+	storageRoutes, err := loadStorageRoutes(storageRoutesPath, storageRoute{
+		Bucket:           s3Bucket,
+		CDNURL:           s3CfDistribution,
+		CFDistributionID: cfDistributionID,
+	})
+	if err != nil {
+		log.Fatalf("Couldn't load storage routes: %v", err)
+	}
+
+	// optional, for load and integration tests against real infrastructure:
+	// every object is written under test-data/ of TEST_DATA_BUCKET and new
+	// users and videos are marked, so cmd/purge-test-data can remove them
+	testDataMode := os.Getenv("TEST_DATA_MODE") == "true"
+	if testDataMode {
+		testDataBucket := os.Getenv("TEST_DATA_BUCKET")
+		if testDataBucket == "" {
+			testDataBucket = s3Bucket
+		}
+		storageRoutes = storageRoutes.forTestData(testDataBucket, os.Getenv("TEST_DATA_CDN_URL"))
+		db = db.WithTestData()
+		log.Printf("Test data mode: writing to s3://%s/%s", testDataBucket, testDataPrefix)
+	}
+
+	// optional, the default keeps landscape/<id>.mp4 and friends
+	keyStrategy, err := newKeyStrategy(os.Getenv("VIDEO_KEY_PATTERN"))
+	if err != nil {
+		log.Fatalf("Invalid VIDEO_KEY_PATTERN: %v", err)
+	}
+
+	// optional, signs the playback URLs handed to embedded players
+	var urlSigner *cdnURLSigner
+	if keyPairID := os.Getenv("CF_KEY_PAIR_ID"); keyPairID != "" {
+		urlSigner, err = loadCDNURLSigner(keyPairID, os.Getenv("CF_PRIVATE_KEY_PATH"))
+		if err != nil {
+			log.Fatalf("Couldn't load CloudFront signing key: %v", err)
+		}
+	}
+
+	// optional hotlink protection for /assets/, see hotlink.go
+	assetProtect := assetProtection{secret: []byte(os.Getenv("ASSET_URL_SECRET"))}
+	if referrers := os.Getenv("ASSET_ALLOWED_REFERRERS"); referrers != "" {
+		for _, host := range strings.Split(referrers, ",") {
+			if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+				assetProtect.allowedHosts = append(assetProtect.allowedHosts, host)
+			}
+		}
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		log.Fatal("PORT environment variable is not set")
 	}
 
+	// optional TLS, either from certificate files or from an ACME CA like
+	// Let's Encrypt
+	tlsCertFile := os.Getenv("TLS_CERT_FILE")
+	tlsKeyFile := os.Getenv("TLS_KEY_FILE")
+	if (tlsCertFile == "") != (tlsKeyFile == "") {
+		log.Fatal("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	var acmeCerts *autocert.Manager
+	if acmeDomains := os.Getenv("TLS_ACME_DOMAINS"); acmeDomains != "" {
+		if tlsCertFile != "" {
+			log.Fatal("TLS_ACME_DOMAINS can't be combined with TLS_CERT_FILE")
+		}
+		acmeCacheDir := os.Getenv("TLS_ACME_CACHE_DIR")
+		if acmeCacheDir == "" {
+			acmeCacheDir = "./certs"
+		}
+		acmeCerts, err = newACMECertManager(os.Getenv("TLS_ACME_DIRECTORY_URL"), os.Getenv("TLS_ACME_EMAIL"), strings.Split(acmeDomains, ","), acmeCacheDir)
+		if err != nil {
+			log.Fatalf("Couldn't set up ACME certificates: %v", err)
+		}
+	}
+	// plain HTTP is redirected to HTTPS from this port, ACME challenges are
+	// answered on it too so it has to be 80 for them
+	httpRedirectPort := os.Getenv("HTTP_REDIRECT_PORT")
+	if httpRedirectPort == "" && acmeCerts != nil {
+		httpRedirectPort = "80"
+	}
+
+	adminAPIKey := os.Getenv("ADMIN_API_KEY")
+
+	// where clients reach this server, used in links we hand out such as
+	// HLS key URIs
+	appBaseURL := strings.TrimSuffix(os.Getenv("APP_BASE_URL"), "/")
+	if appBaseURL == "" {
+		appBaseURL = "http://localhost:" + port
+	}
+	if len(assetProtect.allowedHosts) > 0 {
+		// our own pages always embed our thumbnails
+		if u, err := url.Parse(appBaseURL); err == nil {
+			assetProtect.allowedHosts = append(assetProtect.allowedHosts, strings.ToLower(u.Hostname()))
+		}
+	}
+	hlsEncryption := os.Getenv("HLS_ENCRYPTION") == "true"
+
+	liveRoot := os.Getenv("LIVE_ROOT")
+	if liveRoot == "" {
+		liveRoot = "./live"
+	}
+	liveRTMPHost := os.Getenv("LIVE_RTMP_HOST")
+	if liveRTMPHost == "" {
+		liveRTMPHost = "localhost"
+	}
+	liveDVRWindow := 30 * time.Minute
+	if dvrWindowString := os.Getenv("LIVE_DVR_WINDOW"); dvrWindowString != "" {
+		liveDVRWindow, err = time.ParseDuration(dvrWindowString)
+		if err != nil {
+			log.Fatalf("LIVE_DVR_WINDOW must be a duration like 30m: %v", err)
+		}
+	}
+	whipGatewayURL := strings.TrimSuffix(os.Getenv("WHIP_GATEWAY_URL"), "/")
+	whipGatewayRTSPURL := strings.TrimSuffix(os.Getenv("WHIP_GATEWAY_RTSP_URL"), "/")
+	if whipGatewayURL != "" && whipGatewayRTSPURL == "" {
+		log.Fatal("WHIP_GATEWAY_RTSP_URL must be set when WHIP_GATEWAY_URL is")
+	}
+	liveMinPort, liveMaxPort := 1935, 1944
+	if portRange := os.Getenv("LIVE_RTMP_PORTS"); portRange != "" {
+		minString, maxString, _ := strings.Cut(portRange, "-")
+		liveMinPort, err = strconv.Atoi(minString)
+		if err == nil {
+			liveMaxPort, err = strconv.Atoi(maxString)
+		}
+		if err != nil || liveMinPort > liveMaxPort {
+			log.Fatal("LIVE_RTMP_PORTS must be a port range like 1935-1944")
+		}
+	}
+
+	// optional, receives events such as video.published
+	webhookURL := os.Getenv("WEBHOOK_URL")
+	webhookSecret := os.Getenv("WEBHOOK_SECRET")
+
+	// optional storage quotas of the plans, users are notified when their
+	// videos near them. Free users can't upload past theirs, pro storage past
+	// the quota is billed as overage.
+	plans := map[database.Plan]planLimits{
+		database.PlanFree: {},
+		database.PlanPro:  {overagesAllowed: true, jobPriority: proPlanJobPriority},
+	}
+	for plan, env := range map[database.Plan]string{database.PlanFree: "STORAGE_QUOTA_BYTES", database.PlanPro: "PRO_STORAGE_QUOTA_BYTES"} {
+		quotaString := os.Getenv(env)
+		if quotaString == "" {
+			continue
+		}
+		limits := plans[plan]
+		limits.storageQuota, err = strconv.ParseInt(quotaString, 10, 64)
+		if err != nil || limits.storageQuota < 0 {
+			log.Fatalf("%s must be a non-negative number of bytes", env)
+		}
+		plans[plan] = limits
+	}
+	for plan, env := range map[database.Plan]string{database.PlanFree: "MAX_CONCURRENT_STREAMS", database.PlanPro: "PRO_MAX_CONCURRENT_STREAMS"} {
+		streamsString := os.Getenv(env)
+		if streamsString == "" {
+			continue
+		}
+		limits := plans[plan]
+		limits.concurrentStreams, err = strconv.Atoi(streamsString)
+		if err != nil || limits.concurrentStreams < 0 {
+			log.Fatalf("%s must be a non-negative number of streams", env)
+		}
+		plans[plan] = limits
+	}
+	// requires viewers to start a playback session per device before they
+	// get playback URLs or HLS keys
+	playbackTokens := os.Getenv("PLAYBACK_TOKENS") == "true"
+
+	// optional, lets users upgrade to the pro plan through Stripe checkout
+	var stripe *billing.Stripe
+	stripeProPriceID := os.Getenv("STRIPE_PRO_PRICE_ID")
+
+	// S3 event notifications arrive on an SQS queue, or from an SNS topic
+	// subscribed to POST /api/s3/events
+	s3EventsQueueURL := os.Getenv("S3_EVENTS_QUEUE_URL")
+	s3EventsTopicArn := os.Getenv("S3_EVENTS_SNS_TOPIC_ARN")
+	if stripeSecretKey := os.Getenv("STRIPE_SECRET_KEY"); stripeSecretKey != "" {
+		stripeWebhookSecret := os.Getenv("STRIPE_WEBHOOK_SECRET")
+		if stripeWebhookSecret == "" || stripeProPriceID == "" {
+			log.Fatal("STRIPE_WEBHOOK_SECRET and STRIPE_PRO_PRICE_ID are required with STRIPE_SECRET_KEY")
+		}
+		stripe = billing.NewStripe(stripeSecretKey, stripeWebhookSecret)
+	}
+
+	var mailer Mailer = logMailer{}
+	if smtpHost := os.Getenv("SMTP_HOST"); smtpHost != "" {
+		smtpPort := os.Getenv("SMTP_PORT")
+		if smtpPort == "" {
+			smtpPort = "587"
+		}
+		smtpFrom := os.Getenv("SMTP_FROM")
+		if smtpFrom == "" {
+			log.Fatal("SMTP_FROM environment variable is not set")
+		}
+		mailer = smtpMailer{
+			host:     smtpHost,
+			port:     smtpPort,
+			username: os.Getenv("SMTP_USERNAME"),
+			password: os.Getenv("SMTP_PASSWORD"),
+			from:     smtpFrom,
+		}
+	}
+
+	trashRetention := 30 * 24 * time.Hour
+	if trashRetentionString := os.Getenv("TRASH_RETENTION"); trashRetentionString != "" {
+		trashRetention, err = time.ParseDuration(trashRetentionString)
+		if err != nil {
+			log.Fatalf("TRASH_RETENTION must be a duration like 720h: %v", err)
+		}
+	}
+
+	frameCacheDir := os.Getenv("FRAME_CACHE_DIR")
+	if frameCacheDir == "" {
+		frameCacheDir = "./frames"
+	}
+
+	uploadSessionTTL := time.Hour
+	if ttlString := os.Getenv("UPLOAD_SESSION_TTL"); ttlString != "" {
+		uploadSessionTTL, err = time.ParseDuration(ttlString)
+		if err != nil || uploadSessionTTL <= 0 {
+			log.Fatalf("UPLOAD_SESSION_TTL must be a positive duration like 1h: %v", err)
+		}
+	}
+
+	jobWorkers := 2
+	if jobWorkersString := os.Getenv("JOB_WORKERS"); jobWorkersString != "" {
+		jobWorkers, err = strconv.Atoi(jobWorkersString)
+		if err != nil || jobWorkers < 1 {
+			log.Fatal("JOB_WORKERS must be a positive integer")
+		}
+	}
+
+	// optional, 0 lets users process any number of uploads at once
+	uploadConcurrency := 0
+	if concurrencyString := os.Getenv("UPLOAD_CONCURRENCY_PER_USER"); concurrencyString != "" {
+		uploadConcurrency, err = strconv.Atoi(concurrencyString)
+		if err != nil || uploadConcurrency < 0 {
+			log.Fatal("UPLOAD_CONCURRENCY_PER_USER must be a non-negative integer")
+		}
+	}
+
+	// optional, new uploads are refused with 503 while CPU or memory use in
+	// percent or the number of pending jobs is at its threshold. 0 turns a
+	// check off.
+	var loadShedThresholds loadThresholds
+	if cpuString := os.Getenv("LOAD_SHED_CPU_PERCENT"); cpuString != "" {
+		loadShedThresholds.CPUPercent, err = strconv.ParseFloat(cpuString, 64)
+		if err != nil || loadShedThresholds.CPUPercent < 0 || loadShedThresholds.CPUPercent > 100 {
+			log.Fatal("LOAD_SHED_CPU_PERCENT must be a number between 0 and 100")
+		}
+	}
+	if memoryString := os.Getenv("LOAD_SHED_MEMORY_PERCENT"); memoryString != "" {
+		loadShedThresholds.MemoryPercent, err = strconv.ParseFloat(memoryString, 64)
+		if err != nil || loadShedThresholds.MemoryPercent < 0 || loadShedThresholds.MemoryPercent > 100 {
+			log.Fatal("LOAD_SHED_MEMORY_PERCENT must be a number between 0 and 100")
+		}
+	}
+	if queueString := os.Getenv("LOAD_SHED_QUEUE_DEPTH"); queueString != "" {
+		loadShedThresholds.QueueDepth, err = strconv.Atoi(queueString)
+		if err != nil || loadShedThresholds.QueueDepth < 0 {
+			log.Fatal("LOAD_SHED_QUEUE_DEPTH must be a non-negative integer")
+		}
+	}
+	if loadShedThresholds.CPUPercent > 0 {
+		if _, err := readCPUTimes(); err != nil {
+			log.Fatalf("LOAD_SHED_CPU_PERCENT is set but CPU use can't be read: %v", err)
+		}
+	}
+	if loadShedThresholds.MemoryPercent > 0 {
+		if _, err := readMemoryPercent(); err != nil {
+			log.Fatalf("LOAD_SHED_MEMORY_PERCENT is set but memory use can't be read: %v", err)
+		}
+	}
+	// logs and counts the uploads that would be shed without refusing them,
+	// for tuning the thresholds
+	loadShedDryRun := os.Getenv("LOAD_SHED_DRY_RUN") == "true"
+
+	jobMaxAttempts := 3
+	if maxAttemptsString := os.Getenv("JOB_MAX_ATTEMPTS"); maxAttemptsString != "" {
+		jobMaxAttempts, err = strconv.Atoi(maxAttemptsString)
+		if err != nil || jobMaxAttempts < 1 {
+			log.Fatal("JOB_MAX_ATTEMPTS must be a positive integer")
+		}
+	}
+
+	// running jobs without a heartbeat for this long are handed to another
+	// worker
+	jobVisibilityTimeout := 5 * time.Minute
+	if timeoutString := os.Getenv("JOB_VISIBILITY_TIMEOUT"); timeoutString != "" {
+		jobVisibilityTimeout, err = time.ParseDuration(timeoutString)
+		if err != nil || jobVisibilityTimeout < 30*time.Second || jobVisibilityTimeout > 12*time.Hour {
+			log.Fatal("JOB_VISIBILITY_TIMEOUT must be a duration between 30s and 12h")
+		}
+	}
+
+	// hardware encoders are detected by encoding a test frame with each
+	encoderAccel := os.Getenv("VIDEO_ENCODER_ACCEL")
+	if encoderAccel == "" {
+		encoderAccel = encoderAccelAuto
+	}
+	vaapiDevice := os.Getenv("VAAPI_DEVICE")
+	if vaapiDevice == "" {
+		vaapiDevice = "/dev/dri/renderD128"
+	}
+	h264Encoder, err := detectVideoEncoder("h264", encoderAccel, vaapiDevice)
+	if err != nil {
+		log.Fatalf("VIDEO_ENCODER_ACCEL must be auto, none, nvenc, qsv or vaapi: %v", err)
+	}
+	log.Printf("Encoding H.264 with %s", h264Encoder.name)
+
+	transcodeProfiles, err := loadTranscodeProfiles(os.Getenv("TRANSCODE_PROFILES_PATH"))
+	if err != nil {
+		log.Fatalf("Couldn't load transcode profiles: %v", err)
+	}
+
+	// untouched uploads are kept next to the processed files unless disabled
+	storeOriginals := os.Getenv("STORE_ORIGINALS") != "false"
+
+	// uploads are processed while the client waits, by default a client
+	// that goes away cancels the work
+	detachProcessing := os.Getenv("DETACH_PROCESSING") == "true"
+
+	// sync runs event subscribers in the publishing request, async queues
+	// them as jobs
+	eventDispatch := os.Getenv("EVENT_DISPATCH")
+	if eventDispatch == "" {
+		eventDispatch = eventDispatchSync
+	}
+	if eventDispatch != eventDispatchSync && eventDispatch != eventDispatchAsync {
+		log.Fatal("EVENT_DISPATCH must be sync or async")
+	}
+
+	// optional, mirrors public videos into OpenSearch for GET /api/search
+	var search *searchIndex
+	if searchURL := os.Getenv("SEARCH_URL"); searchURL != "" {
+		search, err = newSearchIndex(searchURL, os.Getenv("SEARCH_INDEX"))
+		if err != nil {
+			log.Fatalf("Invalid SEARCH_URL: %v", err)
+		}
+	}
+
+	// optional, forwards events to Kafka or NATS
+	var broker eventBroker
+	if kind := os.Getenv("EVENT_BROKER"); kind != "" {
+		broker, err = newEventBroker(kind, os.Getenv("EVENT_BROKER_URL"), os.Getenv("EVENT_BROKER_TOPIC"))
+		if err != nil {
+			log.Fatalf("Couldn't set up event broker: %v", err)
+		}
+	}
+
+	// api serves HTTP only, worker runs jobs only, all does both
+	processRole := os.Getenv("PROCESS_ROLE")
+	if processRole == "" {
+		processRole = "all"
+	}
+	if processRole != "all" && processRole != "api" && processRole != "worker" {
+		log.Fatal("PROCESS_ROLE must be all, api or worker")
+	}
+
+	// optional, without it only CloudFront's country header is used
+	var geoIP *geoip.DB
+	if geoIPPath := os.Getenv("GEOIP_DB_PATH"); geoIPPath != "" {
+		geoIP, err = geoip.Open(geoIPPath)
+		if err != nil {
+			log.Fatalf("Couldn't load GeoIP database: %v", err)
+		}
+	}
+	trustProxyHeaders := os.Getenv("TRUST_PROXY_HEADERS") == "true"
+	// the number of proxies in front of the server that append to
+	// X-Forwarded-For, e.g. 2 for CloudFront in front of a load balancer
+	trustedProxyHops := 1
+	if hopsString := os.Getenv("TRUSTED_PROXY_HOPS"); hopsString != "" {
+		trustedProxyHops, err = strconv.Atoi(hopsString)
+		if err != nil || trustedProxyHops < 1 {
+			log.Fatal("TRUSTED_PROXY_HOPS must be a positive integer")
+		}
+	}
+
+	// without an allowlist every address not denied is let in
+	ipAllowlist, err := parseIPList(os.Getenv("IP_ALLOWLIST"))
+	if err != nil {
+		log.Fatalf("IP_ALLOWLIST must be comma separated IPs or CIDR ranges: %v", err)
+	}
+	ipDenylist, err := parseIPList(os.Getenv("IP_DENYLIST"))
+	if err != nil {
+		log.Fatalf("IP_DENYLIST must be comma separated IPs or CIDR ranges: %v", err)
+	}
+
+	// optional, packages encrypted HLS/DASH renditions for premium content
+	var drmKeyServer *drm.KeyServer
+	if keyServerURL := os.Getenv("DRM_KEY_SERVER_URL"); keyServerURL != "" {
+		drmKeyServer = drm.NewKeyServer(keyServerURL, os.Getenv("DRM_KEY_SERVER_TOKEN"))
+	}
+	licenseServers := drmLicenseServers{
+		WidevineLicenseURL:     os.Getenv("DRM_WIDEVINE_LICENSE_URL"),
+		FairPlayLicenseURL:     os.Getenv("DRM_FAIRPLAY_LICENSE_URL"),
+		FairPlayCertificateURL: os.Getenv("DRM_FAIRPLAY_CERTIFICATE_URL"),
+	}
+	packagerBin := os.Getenv("PACKAGER_BIN")
+	if packagerBin == "" {
+		packagerBin = "packager"
+	}
+
+	moderationThreshold := 80.0
+	if thresholdString := os.Getenv("MODERATION_THRESHOLD"); thresholdString != "" {
+		moderationThreshold, err = strconv.ParseFloat(thresholdString, 64)
+		if err != nil || moderationThreshold < 0 || moderationThreshold > 100 {
+			log.Fatal("MODERATION_THRESHOLD must be a number between 0 and 100")
+		}
+	}
+
 	cfig, err := config.LoadDefaultConfig(context.TODO(), config.WithRegion(s3Region))
 	if err != nil {
 		panic(fmt.Sprintf("failed loading config, %v", err))
 	}
 
-	NwCfig := s3.NewFromConfig(cfig)
+	NwCfig := newS3Client(cfig, s3Endpoint)
 
 	if NwCfig == nil {
 		log.Fatal("Failed to create S3 client")
 	}
-	log.Printf("S3 client initialized successfully with region: %s and bucket: %s", s3Region, s3Bucket)
+	var moderator moderation.Moderator = moderation.Noop{}
+	switch provider := os.Getenv("MODERATION_PROVIDER"); provider {
+	case "":
+	case "rekognition":
+		// keep lower-confidence labels too so reviewers see the full picture
+		moderator = moderation.NewRekognition(cfig, 50)
+	default:
+		log.Fatalf("Unknown MODERATION_PROVIDER %q", provider)
+	}
+
+	var contentIDChecker contentid.Checker = contentid.Noop{}
+	switch provider := os.Getenv("CONTENT_ID_PROVIDER"); provider {
+	case "":
+	case "registry":
+		registryURL := os.Getenv("CONTENT_ID_URL")
+		if registryURL == "" {
+			log.Fatal("CONTENT_ID_URL must be set to use a content ID registry")
+		}
+		contentIDChecker = contentid.NewRegistry(registryURL, os.Getenv("CONTENT_ID_TOKEN"))
+	default:
+		log.Fatalf("Unknown CONTENT_ID_PROVIDER %q", provider)
+	}
+	contentIDConfidence := 90.0
+	if confidenceString := os.Getenv("CONTENT_ID_MIN_CONFIDENCE"); confidenceString != "" {
+		contentIDConfidence, err = strconv.ParseFloat(confidenceString, 64)
+		if err != nil || contentIDConfidence < 0 || contentIDConfidence > 100 {
+			log.Fatal("CONTENT_ID_MIN_CONFIDENCE must be a number between 0 and 100")
+		}
+	}
+	var contentIDBlock bool
+	switch action := os.Getenv("CONTENT_ID_ACTION"); action {
+	case "", "flag":
+	case "block":
+		contentIDBlock = true
+	default:
+		log.Fatalf("Unknown CONTENT_ID_ACTION %q, must be flag or block", action)
+	}
+
+	// optional, a language model for generating chapters and suggesting
+	// metadata
+	var llmProvider llm.Provider
+	switch provider := os.Getenv("LLM_PROVIDER"); provider {
+	case "":
+	case "openai":
+		baseURL := os.Getenv("LLM_BASE_URL")
+		apiKey := os.Getenv("LLM_API_KEY")
+		if apiKey == "" && (baseURL == "" || baseURL == llm.DefaultOpenAIBaseURL) {
+			log.Fatal("LLM_API_KEY must be set to use OpenAI")
+		}
+		model := os.Getenv("LLM_MODEL")
+		if model == "" {
+			model = "gpt-4o-mini"
+		}
+		llmProvider = llm.NewOpenAI(baseURL, apiKey, model)
+	default:
+		log.Fatalf("Unknown LLM_PROVIDER %q", provider)
+	}
+	var segmenter chapterSegmenter = heuristicSegmenter{}
+	switch kind := os.Getenv("CHAPTER_SEGMENTER"); kind {
+	case "", "heuristic":
+	case "llm":
+		if llmProvider == nil {
+			log.Fatal("CHAPTER_SEGMENTER=llm needs an LLM_PROVIDER")
+		}
+		segmenter = llmSegmenter{provider: llmProvider}
+	default:
+		log.Fatalf("Unknown CHAPTER_SEGMENTER %q, must be heuristic or llm", kind)
+	}
+
+	if s3Endpoint.URL != "" {
+		log.Printf("S3 client initialized successfully with endpoint: %s, region: %s and bucket: %s", s3Endpoint.URL, s3Region, s3Bucket)
+	} else {
+		log.Printf("S3 client initialized successfully with region: %s and bucket: %s", s3Region, s3Bucket)
+	}
 
 	cfg := apiConfig{
-		db:               db,
-		jwtSecret:        jwtSecret,
-		platform:         platform,
-		filepathRoot:     filepathRoot,
-		assetsRoot:       assetsRoot,
-		s3Bucket:         s3Bucket,
-		s3Region:         s3Region,
-		s3CfDistribution: s3CfDistribution,
-		port:             port,
-		s3Client:         NwCfig,
+		db:                   db,
+		jwtSecret:            jwtSecret,
+		platform:             platform,
+		filepathRoot:         filepathRoot,
+		assetsRoot:           assetsRoot,
+		s3Bucket:             s3Bucket,
+		objectEncryption:     objectEncryption,
+		s3Region:             s3Region,
+		storageRoutes:        storageRoutes,
+		keyStrategy:          keyStrategy,
+		cdnURLSigner:         urlSigner,
+		assetProtection:      assetProtect,
+		port:                 port,
+		awsConfig:            cfig,
+		s3Client:             NwCfig,
+		adminAPIKey:          adminAPIKey,
+		mailer:               mailer,
+		trashRetention:       trashRetention,
+		uploadSessionTTL:     uploadSessionTTL,
+		plans:                plans,
+		stripe:               stripe,
+		stripeProPriceID:     stripeProPriceID,
+		jobMaxAttempts:       jobMaxAttempts,
+		jobVisibilityTimeout: jobVisibilityTimeout,
+		s3EventsTopicArn:     s3EventsTopicArn,
+		snsVerifier:          newSNSVerifier(),
+		h264Encoder:          h264Encoder,
+		transcodeProfiles:    transcodeProfiles,
+		storeOriginals:       storeOriginals,
+		detachProcessing:     detachProcessing,
+		eventDispatch:        eventDispatch,
+		eventBroker:          broker,
+		search:               search,
+		webhookURL:           webhookURL,
+		webhookSecret:        webhookSecret,
+		moderator:            moderator,
+		moderationThreshold:  moderationThreshold,
+		contentID:            contentIDChecker,
+		contentIDConfidence:  contentIDConfidence,
+		contentIDBlock:       contentIDBlock,
+		llm:                  llmProvider,
+		chapterSegmenter:     segmenter,
+		geoIP:                geoIP,
+		trustProxyHeaders:    trustProxyHeaders,
+		trustedProxyHops:     trustedProxyHops,
+		ipAllowlist:          ipAllowlist,
+		ipDenylist:           ipDenylist,
+		drmKeyServer:         drmKeyServer,
+		drmLicenseServers:    licenseServers,
+		packagerBin:          packagerBin,
+		hlsEncryption:        hlsEncryption,
+		playbackTokens:       playbackTokens,
+		appBaseURL:           appBaseURL,
+		liveRoot:             liveRoot,
+		liveRTMPHost:         liveRTMPHost,
+		liveDVRWindow:        liveDVRWindow,
+		whipGatewayURL:       whipGatewayURL,
+		whipGatewayRTSPURL:   whipGatewayRTSPURL,
+		live:                 newLiveManager(liveMinPort, liveMaxPort),
+		frameCacheDir:        frameCacheDir,
+		frameLimiter:         newRateLimiter(frameExtractionsPerMinute, time.Minute),
+		suggestionLimiter:    newRateLimiter(metadataSuggestionsPerHour, time.Hour),
+		loginThrottle:        newLoginThrottle(),
+		sitemap:              &sitemapCache{},
+		locker:               newMemoryLocker(),
+		uploadConcurrency:    uploadConcurrency,
+	}
+	if loadShedThresholds != (loadThresholds{}) {
+		cfg.loadShedder = newLoadShedder(loadShedThresholds, loadShedDryRun)
+		runPeriodically(context.Background(), "sample load", loadSampleInterval, cfg.sampleLoad)
 	}
 
 	err = cfg.ensureAssetsDir()
@@ -111,33 +760,328 @@ func main() {
 		log.Fatalf("Couldn't create assets directory: %v", err)
 	}
 
+	// scheduler leadership goes through the database unless there's Redis
+	var schedulerLocker locker = dbLocker{db: db}
+
+	// optional, shares the metadata cache, rate limits, login lockouts and
+	// locks between instances and workers. Without it every process keeps
+	// its own.
+	if redisURL := os.Getenv("REDIS_URL"); redisURL != "" {
+		redis, err := newRedisClient(redisURL)
+		if err != nil {
+			log.Fatalf("Invalid REDIS_URL: %v", err)
+		}
+		cfg.metadataCache = redisCache{client: redis}
+		cfg.frameLimiter = newRedisRateLimiter(redis, "frames", frameExtractionsPerMinute, time.Minute)
+		cfg.suggestionLimiter = newRedisRateLimiter(redis, "suggestions", metadataSuggestionsPerHour, time.Hour)
+		cfg.loginThrottle = redisLoginThrottle{client: redis}
+		cfg.locker = redisLocker{client: redis}
+		schedulerLocker = cfg.locker
+	} else {
+		cfg.metadataCache = newLRUCache(metadataCacheEntries)
+	}
+	cfg.db = cfg.db.WithVideoChangeHook(cfg.videoChanged)
+	if cfg.search != nil {
+		// searches fail until the index exists, the reindex job retries it
+		if err := cfg.search.ensureIndex(context.Background()); err != nil {
+			log.Printf("Couldn't create search index: %v", err)
+		}
+		// every process writes videos, so every process flushes its changes
+		runPeriodically(context.Background(), "flush search index", searchIndexFlushInterval, cfg.flushSearchIndex)
+	}
+
+	switch backend := os.Getenv("JOB_QUEUE"); backend {
+	case "", "db":
+		cfg.jobQueue = dbJobQueue{db: db, visibilityTimeout: jobVisibilityTimeout}
+	case "sqs":
+		cfg.jobQueue, err = newSQSJobQueue(cfig, os.Getenv("JOB_QUEUE_SQS_URL"), jobVisibilityTimeout)
+		if err != nil {
+			log.Fatalf("Couldn't set up SQS job queue: %v", err)
+		}
+	default:
+		log.Fatalf("Unknown JOB_QUEUE %q, must be db or sqs", backend)
+	}
+
+	if processRole != "api" {
+		cfg.startJobWorkers(context.Background(), jobWorkers)
+
+		if s3EventsQueueURL != "" {
+			queue, err := newSQSJobQueue(cfig, s3EventsQueueURL, s3EventsVisibilityTimeout)
+			if err != nil {
+				log.Fatalf("Couldn't set up S3 events queue: %v", err)
+			}
+			go cfg.consumeS3Events(context.Background(), queue)
+			log.Printf("Consuming S3 events from %s", s3EventsQueueURL)
+		}
+	}
+	if processRole == "worker" {
+		log.Printf("Running as a job worker only")
+		select {}
+	}
+
+	err = os.MkdirAll(liveRoot, 0755)
+	if err != nil {
+		log.Fatalf("Couldn't create live directory: %v", err)
+	}
+	err = cfg.recoverLiveStreams()
+	if err != nil {
+		log.Fatalf("Couldn't recover live streams: %v", err)
+	}
+	err = os.MkdirAll(frameCacheDir, 0755)
+	if err != nil {
+		log.Fatalf("Couldn't create frame cache directory: %v", err)
+	}
+	if storageRoutesPath != "" && !testDataMode {
+		// the buckets keep working with their old rules if this fails
+		err = cfg.applyStorageLifecycles(context.Background())
+		if err != nil {
+			log.Printf("Couldn't apply storage lifecycle rules: %v", err)
+		}
+	}
+
+	jobs := &scheduler{locker: schedulerLocker}
+	jobs.every("purge trash", trashPurgeInterval, cfg.purgeExpiredTrash)
+	jobs.every("purge expired video exports", videoExportPurgeInterval, cfg.purgeExpiredVideoExports)
+	jobs.every("publish scheduled videos", publishInterval, cfg.publishScheduledVideos)
+	jobs.every("snapshot monthly usage", usageSnapshotInterval, cfg.snapshotMonthlyUsage)
+	jobs.every("clean up abandoned uploads", uploadGCInterval, cfg.cleanUpAbandonedUploads)
+	jobs.every("clean up playback sessions", playbackSessionGCInterval, cfg.cleanUpPlaybackSessions)
+	jobs.every("compact watch progress", watchProgressCompactInterval, cfg.compactWatchProgress)
+	jobs.every("refresh trending and related videos", discoveryRefreshInterval, cfg.refreshDiscovery)
+	jobs.every("clean up SAML requests", samlRequestGCInterval, cfg.cleanUpSAMLRequests)
+	jobs.everyInstance("clean up frame cache", frameCacheCleanInterval, cfg.cleanUpFrameCache)
+	jobs.everyInstance("refresh sitemap", sitemapRefreshInterval, cfg.refreshSitemap)
+	jobs.start(context.Background())
+
 	mux := http.NewServeMux()
-	appHandler := http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))
-	mux.Handle("/app/", appHandler)
+	mux.Handle("/app/", http.StripPrefix("/app", webUI))
 
 	assetsHandler := http.StripPrefix("/assets", http.FileServer(http.Dir(assetsRoot)))
-	mux.Handle("/assets/", noCacheMiddleware(assetsHandler))
+	mux.Handle("/assets/", cfg.hotlinkProtectionMiddleware(noCacheMiddleware(assetsHandler)))
+
+	liveHandler := http.StripPrefix("/live", http.FileServer(http.Dir(liveRoot)))
+	mux.Handle("GET /live/", noCacheMiddleware(liveHandler))
+
+	mux.HandleFunc("GET /watch/{videoID}", cfg.handlerWatch)
+	mux.HandleFunc("GET /feeds/users/{feedFile}", cfg.handlerUserFeed)
+	mux.HandleFunc("GET /embed/{videoID}", cfg.handlerEmbed)
+	mux.HandleFunc("GET /oembed", cfg.handlerOEmbed)
+	mux.HandleFunc("GET /sitemap.xml", cfg.handlerSitemap)
+	mux.HandleFunc("GET /robots.txt", cfg.handlerRobots)
+
+	mux.HandleFunc("GET /saml/{organizationID}/metadata", cfg.handlerSAMLMetadata)
+	mux.HandleFunc("GET /saml/{organizationID}/login", cfg.handlerSAMLLogin)
+	mux.HandleFunc("POST /saml/{organizationID}/acs", cfg.handlerSAMLACS)
+
+	mux.HandleFunc("GET /scim/v2/ServiceProviderConfig", cfg.handlerSCIMServiceProviderConfig)
+	mux.HandleFunc("GET /scim/v2/Users", cfg.handlerSCIMUsersList)
+	mux.HandleFunc("POST /scim/v2/Users", cfg.handlerSCIMUserCreate)
+	mux.HandleFunc("GET /scim/v2/Users/{userID}", cfg.handlerSCIMUserGet)
+	mux.HandleFunc("PUT /scim/v2/Users/{userID}", cfg.handlerSCIMUserReplace)
+	mux.HandleFunc("PATCH /scim/v2/Users/{userID}", cfg.handlerSCIMUserPatch)
+	mux.HandleFunc("DELETE /scim/v2/Users/{userID}", cfg.handlerSCIMUserDelete)
+	mux.HandleFunc("GET /scim/v2/Groups", cfg.handlerSCIMGroupsList)
+	mux.HandleFunc("POST /scim/v2/Groups", cfg.handlerSCIMGroupCreate)
+	mux.HandleFunc("GET /scim/v2/Groups/{groupID}", cfg.handlerSCIMGroupGet)
+	mux.HandleFunc("PUT /scim/v2/Groups/{groupID}", cfg.handlerSCIMGroupReplace)
+	mux.HandleFunc("PATCH /scim/v2/Groups/{groupID}", cfg.handlerSCIMGroupPatch)
+	mux.HandleFunc("DELETE /scim/v2/Groups/{groupID}", cfg.handlerSCIMGroupDelete)
 
 	mux.HandleFunc("POST /api/login", cfg.handlerLogin)
 	mux.HandleFunc("POST /api/refresh", cfg.handlerRefresh)
 	mux.HandleFunc("POST /api/revoke", cfg.handlerRevoke)
 
 	mux.HandleFunc("POST /api/users", cfg.handlerUsersCreate)
+	mux.HandleFunc("DELETE /api/users/me", cfg.handlerUserDelete)
+	mux.HandleFunc("POST /api/users/me/export", cfg.handlerUserExportCreate)
+	mux.HandleFunc("GET /api/users/me/history", cfg.handlerWatchHistoryRetrieve)
+	mux.HandleFunc("DELETE /api/users/me/history", cfg.handlerWatchHistoryClear)
+	mux.HandleFunc("PUT /api/users/me/history/settings", cfg.handlerWatchHistorySettingsUpdate)
+	mux.HandleFunc("GET /api/users/me/exports/{exportID}", cfg.handlerUserExportGet)
+	mux.HandleFunc("GET /api/users/me/sessions", cfg.handlerSessionsRetrieve)
+	mux.HandleFunc("DELETE /api/users/me/sessions", cfg.handlerSessionsRevokeOthers)
+	mux.HandleFunc("DELETE /api/users/me/sessions/{sessionID}", cfg.handlerSessionRevoke)
+	mux.HandleFunc("POST /api/tokens", cfg.handlerAPITokenCreate)
+	mux.HandleFunc("GET /api/tokens", cfg.handlerAPITokensRetrieve)
+	mux.HandleFunc("DELETE /api/tokens/{tokenID}", cfg.handlerAPITokenRevoke)
+	mux.HandleFunc("POST /api/users/me/totp", cfg.handlerTOTPEnroll)
+	mux.HandleFunc("POST /api/users/me/totp/confirm", cfg.handlerTOTPConfirm)
+	mux.HandleFunc("DELETE /api/users/me/totp", cfg.handlerTOTPDisable)
+	mux.HandleFunc("POST /api/users/me/totp/recovery_codes", cfg.handlerRecoveryCodesRegenerate)
+
+	mux.HandleFunc("POST /api/organizations", cfg.handlerOrganizationCreate)
+	mux.HandleFunc("GET /api/organizations/me", cfg.handlerOrganizationGet)
+	mux.HandleFunc("POST /api/organizations/me/members", cfg.handlerOrganizationMemberAdd)
+	mux.HandleFunc("PUT /api/organizations/me/domain", cfg.handlerOrganizationDomainUpdate)
+	mux.HandleFunc("POST /api/organizations/me/domain/verify", cfg.handlerOrganizationDomainVerify)
+	mux.HandleFunc("PUT /api/organizations/me/forensic_watermark", cfg.handlerOrganizationForensicWatermark)
+	mux.HandleFunc("PUT /api/organizations/me/require_two_factor", cfg.handlerOrganizationRequireTwoFactor)
+	mux.HandleFunc("GET /api/organizations/me/saml", cfg.handlerOrganizationSAMLGet)
+	mux.HandleFunc("PUT /api/organizations/me/saml", cfg.handlerOrganizationSAMLUpdate)
+	mux.HandleFunc("DELETE /api/organizations/me/saml", cfg.handlerOrganizationSAMLDelete)
+	mux.HandleFunc("POST /api/organizations/me/scim/token", cfg.handlerOrganizationSCIMToken)
+	mux.HandleFunc("GET /api/organizations/me/scim", cfg.handlerOrganizationSCIMGet)
+	mux.HandleFunc("PUT /api/organizations/me/scim", cfg.handlerOrganizationSCIMUpdate)
+	mux.HandleFunc("DELETE /api/organizations/me/scim", cfg.handlerOrganizationSCIMDelete)
+	mux.HandleFunc("PUT /api/organizations/me/bumpers/{position}", cfg.handlerOrganizationBumperUpload)
+	mux.HandleFunc("DELETE /api/organizations/me/bumpers/{position}", cfg.handlerOrganizationBumperDelete)
+
+	mux.HandleFunc("GET /api/notifications", cfg.handlerNotificationsRetrieve)
+	mux.HandleFunc("POST /api/notifications/read", cfg.handlerNotificationsReadAll)
+	mux.HandleFunc("POST /api/notifications/{notificationID}/read", cfg.handlerNotificationRead)
+	mux.HandleFunc("GET /api/billing", cfg.handlerBillingGet)
+	mux.HandleFunc("POST /api/billing/checkout", cfg.handlerBillingCheckout)
+	mux.HandleFunc("POST /api/s3/events", cfg.handlerS3Events)
+	mux.HandleFunc("POST /api/billing/webhook", cfg.handlerStripeWebhook)
+	mux.HandleFunc("PUT /api/notifications/settings", cfg.handlerNotificationSettingsUpdate)
+
+	mux.HandleFunc("GET /api/live/key", cfg.handlerStreamKeyGet)
+	mux.HandleFunc("POST /api/live/key", cfg.handlerStreamKeyRotate)
+	mux.HandleFunc("POST /api/live/streams", cfg.handlerLiveStreamCreate)
+	mux.HandleFunc("GET /api/live/streams/{streamID}", cfg.handlerLiveStreamGet)
+	mux.HandleFunc("POST /api/live/streams/{streamID}/stop", cfg.handlerLiveStreamStop)
+	mux.HandleFunc("POST /api/live/whip", cfg.handlerWHIPPublish)
+	mux.HandleFunc("DELETE /api/live/whip/{streamID}", cfg.handlerWHIPDelete)
+
+	mux.HandleFunc("GET /api/transcode_profiles", cfg.handlerTranscodeProfilesRetrieve)
 
 	mux.HandleFunc("POST /api/videos", cfg.handlerVideoMetaCreate)
+	mux.HandleFunc("POST /api/videos/stitch", cfg.handlerVideosStitch)
+	mux.HandleFunc("POST /api/videos/compose", cfg.handlerVideosCompose)
+	mux.HandleFunc("POST /api/videos/batch", cfg.handlerVideosBatchCreate)
+	mux.HandleFunc("POST /api/upload_sessions/{sessionID}/complete", cfg.handlerUploadSessionComplete)
 	mux.HandleFunc("POST /api/thumbnail_upload/{videoID}", cfg.handlerUploadThumbnail)
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail/from-frame", cfg.handlerThumbnailFromFrame)
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail_variants", cfg.handlerThumbnailVariantCreate)
+	mux.HandleFunc("GET /api/videos/{videoID}/thumbnail_variants", cfg.handlerThumbnailVariantsRetrieve)
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail_variants/{variantID}/activate", cfg.handlerThumbnailVariantActivate)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/thumbnail_variants/{variantID}", cfg.handlerThumbnailVariantDelete)
+	mux.HandleFunc("GET /api/videos/{videoID}/audio_tracks", cfg.handlerVideoAudioTracksRetrieve)
+	mux.HandleFunc("PUT /api/videos/{videoID}/audio_tracks/{language}", cfg.handlerVideoAudioTrackUpload)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/audio_tracks/{language}", cfg.handlerVideoAudioTrackDelete)
+	mux.HandleFunc("GET /api/videos/{videoID}/thumbnail_candidates", cfg.handlerThumbnailCandidatesRetrieve)
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail_candidates/{candidateID}/select", cfg.handlerThumbnailCandidateSelect)
+	mux.HandleFunc("POST /api/videos/{videoID}/thumbnail_beacon", cfg.handlerThumbnailBeacon)
 	mux.HandleFunc("POST /api/video_upload/{videoID}", cfg.handlerUploadVideo)
+	mux.HandleFunc("POST /api/videos/{videoID}/upload_grants", cfg.handlerUploadGrantCreate)
+	mux.HandleFunc("POST /api/videos/{videoID}/import", cfg.handlerVideoImportURL)
+	mux.HandleFunc("POST /api/videos/{videoID}/replace", cfg.handlerVideoReplace)
+	mux.HandleFunc("GET /api/videos/{videoID}/versions", cfg.handlerVideoVersionsRetrieve)
+	mux.HandleFunc("GET /api/videos/{videoID}/source", cfg.handlerVideoSourceGet)
+	// the earlier name of the source endpoint
+	mux.HandleFunc("GET /api/videos/{videoID}/original", cfg.handlerVideoSourceGet)
+	mux.HandleFunc("POST /api/videos/{videoID}/versions/{version}/rollback", cfg.handlerVideoVersionRollback)
 	mux.HandleFunc("GET /api/videos", cfg.handlerVideosRetrieve)
+	mux.HandleFunc("GET /api/videos/trash", cfg.handlerVideosTrashRetrieve)
+	mux.HandleFunc("GET /api/external-ids/{externalID}/video", cfg.handlerVideoByExternalIDGet)
+	mux.HandleFunc("GET /api/videos/{videoID}/playback", cfg.handlerVideoPlayback)
+	mux.HandleFunc("PUT /api/videos/{videoID}/progress", cfg.handlerVideoProgressUpdate)
+	mux.HandleFunc("POST /api/videos/{videoID}/playback_token", cfg.handlerPlaybackTokenCreate)
+	mux.HandleFunc("POST /api/playback_token/heartbeat", cfg.handlerPlaybackTokenHeartbeat)
+	mux.HandleFunc("DELETE /api/playback_token", cfg.handlerPlaybackTokenRevoke)
+	mux.HandleFunc("GET /api/videos/{videoID}/frame", cfg.handlerVideoFrame)
+	mux.HandleFunc("GET /api/videos/{videoID}/key", cfg.handlerVideoHLSKey)
+	mux.HandleFunc("GET /api/videos/{videoID}/hls/index.m3u8", cfg.handlerVideoWatermarkedPlaylist)
+	mux.HandleFunc("PUT /api/videos/{videoID}/geo", cfg.handlerVideoGeoUpdate)
+	mux.HandleFunc("PUT /api/videos/{videoID}/tags", cfg.handlerVideoTagsUpdate)
+	mux.HandleFunc("GET /api/videos/{videoID}/translations", cfg.handlerVideoTranslationsRetrieve)
+	mux.HandleFunc("PUT /api/videos/{videoID}/translations/{language}", cfg.handlerVideoTranslationPut)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/translations/{language}", cfg.handlerVideoTranslationDelete)
+	mux.HandleFunc("GET /api/videos/{videoID}/captions/{language}", cfg.handlerVideoCaptionsGet)
+	mux.HandleFunc("PUT /api/videos/{videoID}/captions/{language}", cfg.handlerVideoCaptionsPut)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/captions/{language}", cfg.handlerVideoCaptionsDelete)
+	mux.HandleFunc("GET /api/videos/search/transcript", cfg.handlerTranscriptSearch)
+	mux.HandleFunc("GET /api/videos/{videoID}/chapters", cfg.handlerVideoChaptersGet)
+	mux.HandleFunc("PUT /api/videos/{videoID}/chapters", cfg.handlerVideoChaptersPut)
+	mux.HandleFunc("POST /api/videos/{videoID}/chapters/generate", cfg.handlerVideoChaptersGenerate)
+	mux.HandleFunc("POST /api/videos/{videoID}/suggest-metadata", cfg.handlerVideoSuggestMetadata)
+	mux.HandleFunc("GET /api/videos/{videoID}/content-id", cfg.handlerVideoContentID)
+	mux.HandleFunc("POST /api/videos/{videoID}/export", cfg.handlerVideoExportCreate)
+	mux.HandleFunc("GET /api/videos/{videoID}/exports/{exportID}", cfg.handlerVideoExportGet)
+	mux.HandleFunc("GET /api/videos/trending", cfg.handlerVideosTrending)
+	mux.HandleFunc("GET /api/search", cfg.handlerSearch)
+	mux.HandleFunc("GET /api/videos/{videoID}/related", cfg.handlerVideoRelated)
+	mux.HandleFunc("POST /api/videos/{videoID}/age_gate", cfg.handlerVideoAgeGate)
+	mux.HandleFunc("PUT /api/videos/{videoID}/schedule", cfg.handlerVideoSchedule)
+	mux.HandleFunc("POST /api/videos/{videoID}/restore", cfg.handlerVideoRestore)
+	mux.HandleFunc("DELETE /api/videos/{videoID}/purge", cfg.handlerVideoPurge)
 	mux.HandleFunc("GET /api/videos/{videoID}", cfg.handlerVideoGet)
+	mux.HandleFunc("PATCH /api/videos/{videoID}", cfg.handlerVideoUpdate)
 	mux.HandleFunc("DELETE /api/videos/{videoID}", cfg.handlerVideoMetaDelete)
 
+	mux.HandleFunc("POST /api/admin/imports", cfg.handlerAdminImportCreate)
+	mux.HandleFunc("POST /api/admin/videos/{videoID}/retranscode", cfg.handlerAdminVideoRetranscode)
+	mux.HandleFunc("POST /api/admin/videos/retranscode", cfg.handlerAdminVideosRetranscode)
+	mux.HandleFunc("GET /api/admin/jobs/{jobID}", cfg.handlerAdminJobGet)
+	mux.HandleFunc("POST /api/admin/jobs/{jobID}/retry", cfg.handlerAdminJobRetry)
+	mux.HandleFunc("POST /api/admin/jobs/retry_failed", cfg.handlerAdminJobsRetryFailed)
+	mux.HandleFunc("GET /api/admin/jobs/dead", cfg.handlerAdminDeadJobsRetrieve)
+	mux.HandleFunc("DELETE /api/admin/jobs/dead", cfg.handlerAdminDeadJobsPurge)
+	mux.HandleFunc("PUT /api/admin/organizations/{organizationID}/job_priority", cfg.handlerAdminOrganizationJobPriority)
+	mux.HandleFunc("PUT /api/admin/organizations/{organizationID}/kms_key", cfg.handlerAdminOrganizationKMSKey)
+	mux.HandleFunc("GET /api/admin/overview", cfg.handlerAdminOverview)
+	mux.HandleFunc("GET /metrics", cfg.handlerMetrics)
+	mux.HandleFunc("GET /api/admin/errors", cfg.handlerAdminErrors)
+	mux.HandleFunc("GET /api/admin/top_users", cfg.handlerAdminTopUsers)
+	mux.HandleFunc("GET /api/admin/usage", cfg.handlerAdminUsage)
+	mux.HandleFunc("POST /api/admin/reconciliation", cfg.handlerAdminReconciliationCreate)
+	mux.HandleFunc("GET /api/admin/reconciliation/{reportID}", cfg.handlerAdminReconciliationGet)
+	mux.HandleFunc("POST /api/admin/storage/key_migration", cfg.handlerAdminKeyMigrationCreate)
+	mux.HandleFunc("POST /api/admin/storage/tagging", cfg.handlerAdminObjectTaggingCreate)
+	mux.HandleFunc("POST /api/admin/search/reindex", cfg.handlerAdminSearchReindex)
+	mux.HandleFunc("GET /api/admin/audit_log", cfg.handlerAdminAuditLog)
+	mux.HandleFunc("POST /api/admin/videos/{videoID}/watermark/identify", cfg.handlerAdminWatermarkIdentify)
+	mux.HandleFunc("GET /api/admin/moderation", cfg.handlerAdminModerationQueue)
+	mux.HandleFunc("POST /api/admin/moderation/{videoID}", cfg.handlerAdminModerationReview)
+	mux.HandleFunc("GET /api/admin/duplicates", cfg.handlerAdminDuplicates)
+	mux.HandleFunc("GET /api/admin/content-id", cfg.handlerAdminContentIDMatches)
+	mux.HandleFunc("POST /api/admin/content-id/{videoID}", cfg.handlerAdminContentIDReview)
+
 	mux.HandleFunc("POST /admin/reset", cfg.handlerReset)
 
 	srv := &http.Server{
-		Addr:    ":" + port,
-		Handler: mux,
+		Addr:              ":" + port,
+		Handler:           requestIDMiddleware(recoveryMiddleware(cfg.firewallMiddleware(cfg.deactivatedUserMiddleware(cfg.revokedSessionMiddleware(cfg.scopeMiddleware(mux, timeoutMiddleware(mux))))))),
+		ReadHeaderTimeout: serverReadHeaderTimeout,
+		MaxHeaderBytes:    maxRequestHeaderBytes,
+		// routes with longer limits extend these per request
+		ReadTimeout:  defaultRouteTimeout,
+		WriteTimeout: defaultRouteTimeout + routeWriteGrace,
+		IdleTimeout:  serverIdleTimeout,
+	}
+
+	if tlsCertFile == "" && acmeCerts == nil {
+		log.Printf("Serving on: http://localhost:%s/app/\n", port)
+		log.Fatal(srv.ListenAndServe())
+	}
+
+	// HTTP/2 is negotiated over TLS by ALPN
+	srv.TLSConfig = &tls.Config{
+		NextProtos: []string{"h2", "http/1.1"},
+	}
+	if acmeCerts != nil {
+		// also answers TLS-ALPN-01 challenges
+		srv.TLSConfig = acmeCerts.TLSConfig()
+	}
+	srv.TLSConfig.MinVersion = tls.VersionTLS12
+	if httpRedirectPort != "" {
+		var redirect http.Handler = httpsRedirectHandler(port)
+		if acmeCerts != nil {
+			redirect = acmeCerts.HTTPHandler(redirect)
+		}
+		redirectSrv := &http.Server{
+			Addr:              ":" + httpRedirectPort,
+			Handler:           redirect,
+			ReadHeaderTimeout: serverReadHeaderTimeout,
+			ReadTimeout:       defaultRouteTimeout,
+			WriteTimeout:      defaultRouteTimeout,
+			IdleTimeout:       serverIdleTimeout,
+		}
+		go func() {
+			log.Fatal(redirectSrv.ListenAndServe())
+		}()
 	}
 
-	log.Printf("Serving on: http://localhost:%s/app/\n", port)
-	log.Fatal(srv.ListenAndServe())
+	log.Printf("Serving on: https://localhost:%s/app/\n", port)
+	log.Fatal(srv.ListenAndServeTLS(tlsCertFile, tlsKeyFile))
 }
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	// anything shorter is an accidental recording or a broken export
+	minVideoSeconds = 0.5
+	// a video stream this much shorter than its container was cut off
+	truncatedStreamRatio = 0.9
+	// seconds decoded at each sampled position
+	decodeSampleSeconds = 2.0
+	// black frames may add up to a little less than the whole video because
+	// of rounding at the ends
+	blackVideoTolerance = 0.5
+)
+
+// invalidMediaError is returned for files that would publish as a broken
+// video. Hint tells the owner what to do about it, err is what ffmpeg said
+// when it's the one that noticed.
+type invalidMediaError struct {
+	reason string
+	hint   string
+	err    error
+}
+
+func (e *invalidMediaError) Error() string {
+	return e.reason + ", " + e.hint
+}
+
+func (e *invalidMediaError) Unwrap() error {
+	return e.err
+}
+
+// isBadMediaError reports whether err is about the file itself rather than
+// the pipeline, so processing it again would fail the same way.
+func isBadMediaError(err error) bool {
+	var invalidErr *invalidMediaError
+	var unsupportedErr *unsupportedSourceError
+	return errors.As(err, &invalidErr) || errors.As(err, &unsupportedErr) || errors.Is(err, errEmptyUpload)
+}
+
+// checkIntegrity rejects sources without a usable duration or whose video
+// stream ends well before the file says it does.
+func (info sourceInfo) checkIntegrity() error {
+	if info.Duration <= 0 {
+		return &invalidMediaError{
+			reason: "the file has no duration",
+			hint:   "it may be a still image or an incomplete recording, export it again",
+		}
+	}
+	if info.Duration < minVideoSeconds {
+		return &invalidMediaError{
+			reason: fmt.Sprintf("the video is only %.2fs long", info.Duration),
+			hint:   fmt.Sprintf("videos must be at least %gs", minVideoSeconds),
+		}
+	}
+	if info.VideoDuration > 0 && info.VideoDuration < info.Duration*truncatedStreamRatio {
+		return &invalidMediaError{
+			reason: fmt.Sprintf("the video stream ends at %.1fs but the file is %.1fs long", info.VideoDuration, info.Duration),
+			hint:   "the file looks truncated, upload it again",
+		}
+	}
+	return nil
+}
+
+// validateProcessed checks a processed file before it's published: it must
+// be about as long as its source, decode cleanly at the start, middle and
+// end, and show more than black frames.
+func validateProcessed(ctx context.Context, filePath string, sourceDuration float64) error {
+	duration, err := getVideoDuration(ctx, filePath)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return &invalidMediaError{
+			reason: "the processed video can't be read",
+			hint:   "the source may be corrupt, export it again",
+			err:    err,
+		}
+	}
+	if duration < minVideoSeconds {
+		return &invalidMediaError{
+			reason: fmt.Sprintf("the processed video is only %.2fs long", duration),
+			hint:   "the source may be corrupt, export it again",
+		}
+	}
+	if sourceDuration > 0 && duration < sourceDuration*truncatedStreamRatio {
+		return &invalidMediaError{
+			reason: fmt.Sprintf("only %.1fs of the %.1fs source could be processed", duration, sourceDuration),
+			hint:   "the source is probably truncated or damaged after that point, upload it again",
+		}
+	}
+
+	positions := []float64{0, duration / 2, max(duration-decodeSampleSeconds, 0)}
+	for _, position := range positions {
+		if err := decodeSample(ctx, filePath, position); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return &invalidMediaError{
+				reason: fmt.Sprintf("the video can't be decoded at %.1fs", position),
+				hint:   "the source may be corrupt, export it again",
+				err:    err,
+			}
+		}
+	}
+
+	black, err := blackSeconds(ctx, filePath)
+	if err != nil {
+		return err
+	}
+	if black >= duration-blackVideoTolerance {
+		return &invalidMediaError{
+			reason: "the video is entirely black",
+			hint:   "check that the camera or screen recording captured a picture",
+		}
+	}
+	return nil
+}
+
+// decodeSample decodes a few seconds from position, failing on anything
+// ffmpeg reports as an error.
+func decodeSample(ctx context.Context, filePath string, position float64) error {
+	cmd := ffmpegRunner.Command(ctx, "ffmpeg",
+		"-v", "error",
+		"-ss", strconv.FormatFloat(position, 'f', 3, 64),
+		"-t", strconv.FormatFloat(decodeSampleSeconds, 'f', 3, 64),
+		"-i", filePath,
+		"-f", "null", "-",
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return newCommandError("ffmpeg", err, stderr.Bytes())
+	}
+	if stderr.Len() > 0 {
+		return newCommandError("ffmpeg", errors.New("decoding errors"), stderr.Bytes())
+	}
+	return nil
+}
+
+var blackDurationRegexp = regexp.MustCompile(`black_duration:([0-9.]+)`)
+
+// blackSeconds returns how many seconds of the video are black.
+func blackSeconds(ctx context.Context, filePath string) (float64, error) {
+	cmd := ffmpegRunner.Command(ctx, "ffmpeg",
+		"-nostats",
+		"-i", filePath,
+		"-an", "-sn", "-dn",
+		// the picture only needs to be big enough to tell black apart
+		"-vf", "scale=160:-2,blackdetect=d=0.1:pix_th=0.1",
+		"-f", "null", "-",
+	)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return 0, newCommandError("ffmpeg", err, stderr.Bytes())
+	}
+
+	total := 0.0
+	for _, line := range strings.Split(stderr.String(), "\n") {
+		match := blackDurationRegexp.FindStringSubmatch(line)
+		if match == nil {
+			continue
+		}
+		if seconds, err := strconv.ParseFloat(match[1], 64); err == nil {
+			total += seconds
+		}
+	}
+	return total, nil
+}
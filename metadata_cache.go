@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// writes drop cached videos, the TTL only bounds how stale a video
+	// changed by another process can get without Redis
+	videoCacheTTL = time.Minute
+	// playlists are never rewritten in place, repackaging uses a new key
+	playlistCacheTTL = 10 * time.Minute
+	// entries the in-memory cache holds before evicting the least recently
+	// used
+	metadataCacheEntries = 10000
+	metadataCacheTimeout = 500 * time.Millisecond
+)
+
+// metadataCache holds hot metadata so popular videos don't cost a database
+// query or an S3 request on every view. It's only ever an optimization:
+// failures are logged and treated as misses.
+type metadataCache interface {
+	Get(ctx context.Context, key string) ([]byte, bool)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration)
+	Delete(ctx context.Context, key string)
+}
+
+// lruCache keeps entries in memory, so every server instance has its own.
+type lruCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	order      *list.List
+	entries    map[string]*list.Element
+}
+
+type lruEntry struct {
+	key     string
+	value   []byte
+	expires time.Time
+}
+
+func newLRUCache(maxEntries int) *lruCache {
+	return &lruCache{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+func (c *lruCache) Get(ctx context.Context, key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.value, true
+}
+
+func (c *lruCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(ttl)
+	if elem, ok := c.entries[key]; ok {
+		entry := elem.Value.(*lruEntry)
+		entry.value = value
+		entry.expires = expires
+		c.order.MoveToFront(elem)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, value: value, expires: expires})
+	for c.order.Len() > c.maxEntries {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+}
+
+func (c *lruCache) Delete(ctx context.Context, key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+}
+
+func videoCacheKey(id uuid.UUID) string {
+	return "video:" + id.String()
+}
+
+// cachedVideo is GetVideo for read-only paths that serve a video to viewers.
+// Handlers that change the video read it from the database instead.
+func (cfg *apiConfig) cachedVideo(ctx context.Context, id uuid.UUID) (database.Video, error) {
+	key := videoCacheKey(id)
+	if dat, ok := cfg.metadataCache.Get(ctx, key); ok {
+		var video database.Video
+		if err := gob.NewDecoder(bytes.NewReader(dat)).Decode(&video); err == nil {
+			return video, nil
+		}
+	}
+
+	video, err := cfg.db.WithContext(ctx).GetVideo(id)
+	if err != nil || video.ID == uuid.Nil {
+		return video, err
+	}
+	// gob, unlike JSON, keeps the fields the API hides
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(video); err != nil {
+		log.Printf("Couldn't cache video %s: %v", id, err)
+		return video, nil
+	}
+	cfg.metadataCache.Set(ctx, key, buf.Bytes(), videoCacheTTL)
+	return video, nil
+}
+
+// forgetVideo drops the video's cached metadata after a write.
+func (cfg *apiConfig) forgetVideo(id uuid.UUID) {
+	ctx, cancel := context.WithTimeout(context.Background(), metadataCacheTimeout)
+	defer cancel()
+	cfg.metadataCache.Delete(ctx, videoCacheKey(id))
+}
+
+// cachedPlaylist downloads a playlist, keeping it for the next viewer.
+func (cfg *apiConfig) cachedPlaylist(ctx context.Context, key string) ([]byte, error) {
+	cacheKey := "playlist:" + key
+	if dat, ok := cfg.metadataCache.Get(ctx, cacheKey); ok {
+		return dat, nil
+	}
+	var buf bytes.Buffer
+	if err := cfg.downloadObject(ctx, key, &buf); err != nil {
+		return nil, err
+	}
+	cfg.metadataCache.Set(ctx, cacheKey, buf.Bytes(), playlistCacheTTL)
+	return buf.Bytes(), nil
+}
+
+// cachedSignCDNURL reuses the signature of a URL for as long as it's valid,
+// signing is an RSA operation per URL.
+func (cfg *apiConfig) cachedSignCDNURL(rawURL string, expires time.Time) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), metadataCacheTimeout)
+	defer cancel()
+
+	hash := sha256.Sum256([]byte(rawURL))
+	key := fmt.Sprintf("signed:%s:%d", hex.EncodeToString(hash[:]), expires.Unix())
+	if dat, ok := cfg.metadataCache.Get(ctx, key); ok {
+		return string(dat), nil
+	}
+	signed, err := cfg.signCDNURL(rawURL, expires)
+	if err != nil {
+		return "", err
+	}
+	cfg.metadataCache.Set(ctx, key, []byte(signed), time.Until(expires))
+	return signed, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/llm"
+)
+
+const (
+	// every suggestion is a paid model call
+	metadataSuggestionsPerHour = 10
+	maxSuggestions             = 3
+	// transcripts are cut to this many bytes before they're sent to a model
+	maxSuggestionTranscriptBytes = 30_000
+)
+
+const suggestMetadataSystemPrompt = `You write metadata for online videos from their transcripts.
+Reply with JSON only, like {"titles":["..."],"descriptions":["..."],"tags":["..."]}.
+Give 3 titles of at most 80 characters, 3 descriptions of 1 to 3 sentences, and up to 10 lowercase tags of one or two words.
+Write in the language of the transcript. Don't invent facts that aren't in it.`
+
+// handlerVideoSuggestMetadata asks the LLM_PROVIDER for titles,
+// descriptions and tags from the video's captions in the language query
+// parameter, or its first captions. Nothing is saved: the owner accepts
+// suggestions with PATCH /api/videos/{videoID}.
+func (cfg *apiConfig) handlerVideoSuggestMetadata(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Language     string   `json:"language"`
+		Titles       []string `json:"titles"`
+		Descriptions []string `json:"descriptions"`
+		Tags         []string `json:"tags"`
+	}
+
+	if cfg.llm == nil {
+		respondWithError(w, http.StatusNotImplemented, errCodeNotImplemented, "Metadata suggestions aren't configured", nil)
+		return
+	}
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	language := r.URL.Query().Get("language")
+	if language == "" {
+		languages, err := cfg.db.GetCaptionLanguages(video.ID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get captions", err)
+			return
+		}
+		if len(languages) > 0 {
+			language = languages[0]
+		}
+	}
+	cues, err := cfg.db.GetCaptions(video.ID, language)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get captions", err)
+		return
+	}
+	if len(cues) == 0 {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "The video has no captions to suggest metadata from", nil)
+		return
+	}
+
+	if ok, retryAfter := cfg.suggestionLimiter.allow("user:" + video.UserID.String()); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		respondWithError(w, http.StatusTooManyRequests, errCodeRateLimited, "Too many suggestions requested, try again later", nil)
+		return
+	}
+
+	reply, err := cfg.llm.Complete(r.Context(), suggestMetadataSystemPrompt, suggestionPrompt(video, cues))
+	if err != nil {
+		respondWithError(w, http.StatusBadGateway, errCodeUpstreamFailed, "Couldn't get suggestions", err)
+		return
+	}
+	var out struct {
+		Titles       []string `json:"titles"`
+		Descriptions []string `json:"descriptions"`
+		Tags         []string `json:"tags"`
+	}
+	if err := llm.DecodeJSON(reply, &out); err != nil {
+		respondWithError(w, http.StatusBadGateway, errCodeUpstreamFailed, "Couldn't read suggestions", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{
+		Language:     language,
+		Titles:       cleanSuggestions(out.Titles, maxTranslationTitleLength),
+		Descriptions: cleanSuggestions(out.Descriptions, maxTranslationDescriptionLength),
+		Tags:         suggestedTags(out.Tags),
+	})
+}
+
+func suggestionPrompt(video database.Video, cues []database.CaptionCue) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Current title: %s\n\nTranscript:\n", video.Title)
+	for _, cue := range cues {
+		line := strings.ReplaceAll(cue.Text, "\n", " ") + "\n"
+		if b.Len()+len(line) > maxSuggestionTranscriptBytes {
+			break
+		}
+		b.WriteString(line)
+	}
+	return b.String()
+}
+
+// cleanSuggestions keeps the first few distinct suggestions that would
+// pass validation as they are.
+func cleanSuggestions(suggestions []string, maxLength int) []string {
+	cleaned := []string{}
+	for _, s := range suggestions {
+		s = strings.TrimSpace(s)
+		if s == "" || len(s) > maxLength || slices.ContainsFunc(cleaned, func(c string) bool { return strings.EqualFold(c, s) }) {
+			continue
+		}
+		cleaned = append(cleaned, s)
+		if len(cleaned) == maxSuggestions {
+			break
+		}
+	}
+	return cleaned
+}
+
+// suggestedTags drops the tags PUT /api/videos/{videoID}/tags would refuse.
+func suggestedTags(suggestions []string) []string {
+	tags := []string{}
+	for _, tag := range suggestions {
+		params := database.CreateVideoParams{Tags: append(tags, tag)}
+		if validateVideoTags(&params) != nil {
+			continue
+		}
+		tags = params.Tags
+	}
+	return tags
+}
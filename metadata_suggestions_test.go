@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestHandlerVideoSuggestMetadata(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.jwtSecret = "secret"
+	cfg.suggestionLimiter = newRateLimiter(1, time.Hour)
+
+	userID := uuid.New()
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "untitled", UserID: userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.MakeJWT(userID, uuid.New(), cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	suggest := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/suggest-metadata", nil)
+		req.SetPathValue("videoID", video.ID.String())
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		cfg.handlerVideoSuggestMetadata(w, req)
+		return w
+	}
+
+	if w := suggest(); w.Code != http.StatusNotImplemented {
+		t.Errorf("without a provider: status %d, want 501", w.Code)
+	}
+
+	provider := &fakeLLM{reply: `{"titles":["Boot care 101","boot care 101","",""],"descriptions":["How to keep leather boots going."],"tags":["Boots","leather care","a,b","boots"]}`}
+	cfg.llm = provider
+	if w := suggest(); w.Code != http.StatusConflict {
+		t.Errorf("without captions: status %d, want 409", w.Code)
+	}
+
+	if err := cfg.db.PutCaptions(video.ID, "en", []database.CaptionCue{{StartMS: 0, EndMS: 2000, Text: "Polish your\nboots"}}); err != nil {
+		t.Fatal(err)
+	}
+	w := suggest()
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var resp struct {
+		Language     string   `json:"language"`
+		Titles       []string `json:"titles"`
+		Descriptions []string `json:"descriptions"`
+		Tags         []string `json:"tags"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Language != "en" || !slices.Equal(resp.Titles, []string{"Boot care 101"}) || len(resp.Descriptions) != 1 || !slices.Equal(resp.Tags, []string{"boots", "leather care"}) {
+		t.Errorf("suggestions = %+v", resp)
+	}
+	if provider.prompt != "Current title: untitled\n\nTranscript:\nPolish your boots\n" {
+		t.Errorf("prompt = %q", provider.prompt)
+	}
+
+	if w := suggest(); w.Code != http.StatusTooManyRequests {
+		t.Errorf("over the limit: status %d, want 429", w.Code)
+	}
+}
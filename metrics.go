@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+var metricJobStatuses = []database.JobStatus{
+	database.JobStatusPending,
+	database.JobStatusRunning,
+	database.JobStatusCompleted,
+	database.JobStatusFailed,
+	database.JobStatusDead,
+}
+
+// handlerMetrics serves gauges in the Prometheus text format. Scrapers
+// authenticate with the admin API key like the other admin endpoints.
+func (cfg *apiConfig) handlerMetrics(w http.ResponseWriter, r *http.Request) {
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	jobCounts, err := cfg.db.CountJobsByStatus()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't count jobs", err)
+		return
+	}
+	abandonedUploads, err := cfg.db.CountAbandonedUploadSessions()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't count abandoned uploads", err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	writeMetricHeader(w, "tubely_jobs", "gauge", "Background jobs by status.")
+	for _, status := range metricJobStatuses {
+		fmt.Fprintf(w, "tubely_jobs{status=%q} %d\n", status, jobCounts[status])
+	}
+	writeMetricHeader(w, "tubely_dead_letter_jobs", "gauge", "Jobs that used up their attempts and wait in the dead-letter queue.")
+	fmt.Fprintf(w, "tubely_dead_letter_jobs %d\n", jobCounts[database.JobStatusDead])
+	writeMetricHeader(w, "tubely_http_panics_total", "counter", "Handler panics recovered into 500 responses.")
+	fmt.Fprintf(w, "tubely_http_panics_total %d\n", panicsRecovered.Load())
+	writeMetricHeader(w, "tubely_http_blocked_requests_total", "counter", "Requests refused by the IP lists or request filters.")
+	fmt.Fprintf(w, "tubely_http_blocked_requests_total %d\n", requestsBlocked.Load())
+	writeMetricHeader(w, "tubely_abandoned_upload_sessions", "gauge", "Upload sessions that expired without an upload and were cleaned up.")
+	fmt.Fprintf(w, "tubely_abandoned_upload_sessions %d\n", abandonedUploads)
+	writeMetricHeader(w, "tubely_aborted_multipart_uploads_total", "counter", "Stale multipart uploads of staged uploads that were aborted.")
+	fmt.Fprintf(w, "tubely_aborted_multipart_uploads_total %d\n", abortedMultipartUploads.Load())
+	writeMetricHeader(w, "tubely_video_events_total", "counter", "Video events handled by this process.")
+	for _, name := range []string{eventVideoCreated, eventVideoProcessed, eventVideoDeleted} {
+		fmt.Fprintf(w, "tubely_video_events_total{event=%q} %d\n", name, videoEventCounts[name].Load())
+	}
+	cfg.writeLoadMetrics(w)
+}
+
+func writeMetricHeader(w io.Writer, name, metricType, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/moderation"
+	"github.com/google/uuid"
+)
+
+const (
+	jobTypeModerateVideo = "moderate_video"
+
+	// number of frames sampled evenly across the video
+	moderationFrameCount = 5
+)
+
+type moderateVideoPayload struct {
+	VideoID uuid.UUID `json:"video_id"`
+}
+
+// requestModeration queues a moderation scan of the video's current thumbnail
+// and file. Failing to queue it is logged rather than failing the upload.
+func (cfg *apiConfig) requestModeration(videoID uuid.UUID) {
+	if _, ok := cfg.moderator.(moderation.Noop); ok {
+		return
+	}
+	_, err := cfg.enqueueJob(jobTypeModerateVideo, &videoID, moderateVideoPayload{VideoID: videoID})
+	if err != nil {
+		log.Printf("Couldn't queue moderation for video %s: %v", videoID, err)
+	}
+}
+
+func (cfg *apiConfig) runModerateVideoJob(ctx context.Context, job database.Job) error {
+	var payload moderateVideoPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+
+	video, err := cfg.db.GetVideo(payload.VideoID)
+	if err != nil {
+		return err
+	}
+
+	var labels []database.CreateModerationLabelParams
+	scan := func(source string, image []byte) error {
+		found, err := cfg.moderator.ScanImage(ctx, image)
+		if err != nil {
+			return fmt.Errorf("couldn't scan %s: %w", source, err)
+		}
+		for _, label := range found {
+			labels = append(labels, database.CreateModerationLabelParams{
+				VideoID:    video.ID,
+				Source:     source,
+				Name:       label.Name,
+				ParentName: label.ParentName,
+				Confidence: label.Confidence,
+			})
+		}
+		return nil
+	}
+
+	if video.ThumbnailURL != nil {
+		if thumbnailPath, ok := cfg.assetPathFromURL(*video.ThumbnailURL); ok {
+			image, err := os.ReadFile(thumbnailPath)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			if err == nil {
+				if err := scan("thumbnail", image); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	if video.VideoURL != nil {
+		if key, ok := cfg.objectKeyFromURL(*video.VideoURL); ok {
+			frames, err := cfg.sampleVideoFrames(ctx, key)
+			if err != nil {
+				return err
+			}
+			for _, frame := range frames {
+				if err := scan(frame.source, frame.image); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	err = cfg.db.ReplaceModerationLabels(video.ID, labels)
+	if err != nil {
+		return err
+	}
+
+	status := database.ModerationStatusClean
+	for _, label := range labels {
+		if label.Confidence >= cfg.moderationThreshold {
+			status = database.ModerationStatusQuarantined
+			break
+		}
+	}
+
+	err = cfg.db.SetVideoModerationStatus(video.ID, status)
+	if err != nil {
+		return err
+	}
+
+	if status == database.ModerationStatusQuarantined {
+		log.Printf("Video %s quarantined pending review", video.ID)
+
+		// flagged content stays age-restricted even if a reviewer approves it
+		video.AgeRestricted = true
+		err = cfg.ensureBlurredThumbnail(ctx, &video)
+		if err != nil {
+			return err
+		}
+		err = cfg.db.UpdateVideo(video)
+		if err != nil {
+			return err
+		}
+
+		err = cfg.sendWebhook(ctx, "video.quarantined", video)
+		if err != nil {
+			log.Printf("Couldn't send video.quarantined webhook for %s: %v", video.ID, err)
+		}
+	}
+	return nil
+}
+
+type videoFrame struct {
+	source string
+	image  []byte
+}
+
+// sampleVideoFrames downloads the object and grabs a handful of JPEG frames
+// spread evenly over its duration.
+func (cfg *apiConfig) sampleVideoFrames(ctx context.Context, key string) ([]videoFrame, error) {
+	dir, err := os.MkdirTemp("", "tubely-moderation")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	videoPath := filepath.Join(dir, "video.mp4")
+	videoFile, err := os.Create(videoPath)
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.downloadObject(ctx, key, videoFile)
+	videoFile.Close()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't download %s: %w", key, err)
+	}
+
+	duration, err := getVideoDuration(ctx, videoPath)
+	if err != nil {
+		return nil, err
+	}
+
+	frames := make([]videoFrame, 0, moderationFrameCount)
+	for i := 1; i <= moderationFrameCount; i++ {
+		offset := duration * float64(i) / float64(moderationFrameCount+1)
+		framePath := filepath.Join(dir, fmt.Sprintf("frame-%d.jpg", i))
+
+		cmd := ffmpegRunner.Command(ctx, "ffmpeg",
+			"-ss", strconv.FormatFloat(offset, 'f', 3, 64),
+			"-i", videoPath,
+			"-frames:v", "1",
+			"-q:v", "3",
+			framePath,
+		)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		if err := cmd.Run(); err != nil {
+			return nil, newCommandError("ffmpeg", err, stderr.Bytes())
+		}
+
+		image, err := os.ReadFile(framePath)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, videoFrame{
+			source: fmt.Sprintf("frame@%.1fs", offset),
+			image:  image,
+		})
+	}
+	return frames, nil
+}
+
+func getVideoDuration(ctx context.Context, filePath string) (float64, error) {
+	cmd := ffmpegRunner.Command(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_format", filePath)
+
+	var out bytes.Buffer
+	cmd.Stdout = &out
+
+	err := cmd.Run()
+	if err != nil {
+		return 0, err
+	}
+
+	var result struct {
+		Format struct {
+			Duration string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		return 0, err
+	}
+
+	duration, err := strconv.ParseFloat(result.Format.Duration, 64)
+	if err != nil {
+		return 0, fmt.Errorf("couldn't parse duration %q: %w", result.Format.Duration, err)
+	}
+	return duration, nil
+}
+
+// isVideoHidden reports whether a video should only be visible to its owner.
+func isVideoHidden(video database.Video) bool {
+	if video.CopyrightBlocked {
+		return true
+	}
+	switch video.ModerationStatus {
+	case database.ModerationStatusQuarantined, database.ModerationStatusRejected:
+		return true
+	}
+	return video.Visibility == database.VisibilityPrivate
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+)
+
+var (
+	errFormFileMissing  = errors.New("form file missing")
+	errEmptyUpload      = errors.New("uploaded file is empty")
+	errIncompleteUpload = errors.New("upload ended before the whole file was received")
+)
+
+// streamFormFile returns the part of a multipart/form-data request holding
+// the file field. Nothing is buffered, the part reads straight from the
+// request body, so fields after it can't be read anymore. Fields before it
+// are skipped.
+func streamFormFile(r *http.Request, field string) (*multipart.Part, error) {
+	reader, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil, fmt.Errorf("%w: %q", errFormFileMissing, field)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == field && part.FileName() != "" {
+			return part, nil
+		}
+		part.Close()
+	}
+}
+
+// isMaxBytesError reports whether reading the body failed because it's
+// larger than its http.MaxBytesReader allows.
+func isMaxBytesError(err error) bool {
+	var maxBytesErr *http.MaxBytesError
+	return errors.As(err, &maxBytesErr)
+}
+
+// checkPartReceived compares the bytes read from a file part with what the
+// client sent. A dropped connection shows up as an unexpected EOF from the
+// body or the multipart reader, or as fewer bytes than the part's
+// Content-Length.
+func checkPartReceived(part *multipart.Part, received int64, readErr error) error {
+	if errors.Is(readErr, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w after %d bytes", errIncompleteUpload, received)
+	}
+	if readErr != nil {
+		return readErr
+	}
+	if received == 0 {
+		return errEmptyUpload
+	}
+	if declared := part.Header.Get("Content-Length"); declared != "" {
+		declaredSize, err := strconv.ParseInt(declared, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid part Content-Length %q", declared)
+		}
+		if declaredSize != received {
+			return fmt.Errorf("%w: received %d of %d bytes", errIncompleteUpload, received, declaredSize)
+		}
+	}
+	return nil
+}
+
+// respondWithUploadError answers an upload checkPartReceived rejected.
+// Clients can retry incomplete uploads as they are, empty ones need the
+// file picked again.
+func respondWithUploadError(w http.ResponseWriter, name string, err error) {
+	switch {
+	case errors.Is(err, errEmptyUpload):
+		respondWithError(w, http.StatusBadRequest, errCodeEmptyUpload, fmt.Sprintf("%s is empty, select the file again", name), err)
+	case errors.Is(err, errIncompleteUpload):
+		respondWithError(w, http.StatusBadRequest, errCodeIncompleteUpload, fmt.Sprintf("%s upload was cut off before it finished, retry it", name), err)
+	default:
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Upload is truncated or malformed", err)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// users are warned once their stored videos pass this share of the quota
+const storageQuotaWarningRatio = 0.9
+
+// notify records an in-app notification and emails it unless the user opted
+// out. Failures are logged rather than failing whatever triggered it.
+func (cfg *apiConfig) notify(params database.CreateNotificationParams) {
+	_, err := cfg.db.CreateNotification(params)
+	if err != nil {
+		log.Printf("Couldn't create %s notification for user %s: %v", params.Type, params.UserID, err)
+		return
+	}
+
+	enabled, err := cfg.db.GetEmailNotifications(params.UserID)
+	if err != nil {
+		log.Printf("Couldn't get email settings of user %s: %v", params.UserID, err)
+		return
+	}
+	if !enabled {
+		return
+	}
+	user, err := cfg.db.GetUser(params.UserID)
+	if err != nil || user == nil {
+		log.Printf("Couldn't get user %s to email a notification: %v", params.UserID, err)
+		return
+	}
+	err = cfg.mailer.Send(user.Email, params.Title, params.Body+"\n")
+	if err != nil {
+		log.Printf("Couldn't email %s notification to user %s: %v", params.Type, params.UserID, err)
+	}
+}
+
+func (cfg *apiConfig) notifyProcessingFinished(video database.Video) {
+	cfg.notify(database.CreateNotificationParams{
+		UserID:  video.UserID,
+		VideoID: &video.ID,
+		Type:    database.NotificationProcessingFinished,
+		Title:   fmt.Sprintf("%q is ready", video.Title),
+		Body:    fmt.Sprintf("Your video %q finished processing and can be watched now.", video.Title),
+	})
+}
+
+func (cfg *apiConfig) notifyProcessingFailed(video database.Video, reason string) {
+	cfg.notify(database.CreateNotificationParams{
+		UserID:  video.UserID,
+		VideoID: &video.ID,
+		Type:    database.NotificationProcessingFailed,
+		Title:   fmt.Sprintf("%q couldn't be processed", video.Title),
+		Body:    fmt.Sprintf("Processing your video %q failed: %s", video.Title, reason),
+	})
+}
+
+// checkStorageQuota warns the user when an upload of addedBytes took their
+// storage past the warning threshold of their plan's quota.
+func (cfg *apiConfig) checkStorageQuota(userID uuid.UUID, addedBytes int64) {
+	_, limits, err := cfg.userPlan(userID)
+	if err != nil {
+		log.Printf("Couldn't get plan of user %s: %v", userID, err)
+		return
+	}
+	if limits.storageQuota <= 0 {
+		return
+	}
+	used, err := cfg.db.GetUserStorageBytes(userID)
+	if err != nil {
+		log.Printf("Couldn't get storage usage of user %s: %v", userID, err)
+		return
+	}
+
+	threshold := int64(float64(limits.storageQuota) * storageQuotaWarningRatio)
+	if used < threshold || used-addedBytes >= threshold {
+		return
+	}
+	body := fmt.Sprintf("Your videos use %d%% of your %s storage quota. Delete old videos or versions to make room.",
+		used*100/limits.storageQuota, formatBytes(limits.storageQuota))
+	if limits.overagesAllowed {
+		body = fmt.Sprintf("Your videos use %d%% of the %s storage included in your plan. Storage past it is billed as overage.",
+			used*100/limits.storageQuota, formatBytes(limits.storageQuota))
+	}
+	cfg.notify(database.CreateNotificationParams{
+		UserID: userID,
+		Type:   database.NotificationQuotaWarning,
+		Title:  "You're running out of storage",
+		Body:   body,
+	})
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
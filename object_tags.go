@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const jobTypeTagObjects = "tag_objects"
+
+// tags activated as cost allocation tags break storage spend down by them
+const (
+	objectTagUserID       = "user-id"
+	objectTagOrgID        = "org-id"
+	objectTagContentClass = "content-class"
+)
+
+// objectTags are the S3 tags of an object. putObject adds the content class
+// from the key, callers pass who the object is billed to.
+type objectTags map[string]string
+
+// with returns a copy of the tags with more added.
+func (t objectTags) with(more objectTags) objectTags {
+	merged := maps.Clone(t)
+	if merged == nil {
+		merged = objectTags{}
+	}
+	maps.Copy(merged, more)
+	return merged
+}
+
+// encode is the form PutObject takes tags in.
+func (t objectTags) encode() string {
+	values := url.Values{}
+	for k, v := range t {
+		values.Set(k, v)
+	}
+	return values.Encode()
+}
+
+// ownerTags returns the tags of objects belonging to the user and, if they
+// have one, the user's organization.
+func ownerTags(userID, orgID uuid.UUID) objectTags {
+	tags := objectTags{}
+	if userID != uuid.Nil {
+		tags[objectTagUserID] = userID.String()
+	}
+	if orgID != uuid.Nil {
+		tags[objectTagOrgID] = orgID.String()
+	}
+	return tags
+}
+
+// objectTagsForUser returns the tags of objects owned by the user.
+func (cfg *apiConfig) objectTagsForUser(userID uuid.UUID) (objectTags, error) {
+	org, err := cfg.db.GetOrganizationByUser(userID)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't get organization of user %s: %w", userID, err)
+	}
+	return ownerTags(userID, org.ID), nil
+}
+
+// mergeObjectTags adds tags to an object, keeping the ones it already has.
+// PutObjectTagging replaces the whole set, so the current tags are read
+// first. It reports whether anything changed.
+func (cfg *apiConfig) mergeObjectTags(ctx context.Context, key string, tags objectTags) (bool, error) {
+	route := cfg.storageRoute(key)
+	out, err := cfg.s3Client.GetObjectTagging(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(route.Bucket),
+		Key:    aws.String(route.bucketKey(key)),
+	})
+	if err != nil {
+		return false, err
+	}
+	current := objectTags{}
+	for _, tag := range out.TagSet {
+		current[aws.ToString(tag.Key)] = aws.ToString(tag.Value)
+	}
+	merged := current.with(tags)
+	if maps.Equal(merged, current) {
+		return false, nil
+	}
+
+	tagSet := make([]types.Tag, 0, len(merged))
+	for k, v := range merged {
+		tagSet = append(tagSet, types.Tag{Key: aws.String(k), Value: aws.String(v)})
+	}
+	_, err = cfg.s3Client.PutObjectTagging(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  aws.String(route.Bucket),
+		Key:     aws.String(route.bucketKey(key)),
+		Tagging: &types.Tagging{TagSet: tagSet},
+	})
+	return err == nil, err
+}
+
+// handlerAdminObjectTaggingCreate queues a job tagging the objects stored
+// before uploads were tagged. Follow it with the jobs API.
+func (cfg *apiConfig) handlerAdminObjectTaggingCreate(w http.ResponseWriter, r *http.Request) {
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+
+	job, err := cfg.enqueueJob(jobTypeTagObjects, nil, struct{}{})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create tagging job", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, job)
+}
+
+// runTagObjectsJob tags every stored object whose owner can be told from
+// the database. Objects already tagged are skipped, so a failed run can
+// just be retried.
+func (cfg *apiConfig) runTagObjectsJob(ctx context.Context, job database.Job) error {
+	owners, err := cfg.objectOwners(ctx)
+	if err != nil {
+		return err
+	}
+	objects, err := cfg.listStoredObjects(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't list objects: %w", err)
+	}
+
+	orgs := map[uuid.UUID]uuid.UUID{}
+	tagged, unknown := 0, 0
+	for _, object := range objects {
+		owner, ok := owners.ownerOf(object.Key)
+		if !ok {
+			unknown++
+			continue
+		}
+		if owner.userID != uuid.Nil {
+			orgID, ok := orgs[owner.userID]
+			if !ok {
+				org, err := cfg.db.WithContext(ctx).GetOrganizationByUser(owner.userID)
+				if err != nil {
+					return err
+				}
+				orgID = org.ID
+				orgs[owner.userID] = orgID
+			}
+			owner.orgID = orgID
+		}
+
+		tags := ownerTags(owner.userID, owner.orgID).with(objectTags{
+			objectTagContentClass: string(contentClassOfKey(object.Key)),
+		})
+		changed, err := cfg.mergeObjectTags(ctx, object.Key, tags)
+		if err != nil {
+			return fmt.Errorf("couldn't tag %s: %w", object.Key, err)
+		}
+		if changed {
+			tagged++
+		}
+	}
+	log.Printf("Tagged %d objects, %d have no known owner", tagged, unknown)
+	return nil
+}
+
+type objectOwner struct {
+	userID uuid.UUID
+	orgID  uuid.UUID
+}
+
+// storedObjectOwners finds who objects belong to, by the keys recorded for
+// video versions or by the ID in the key's second segment.
+type storedObjectOwners struct {
+	byKey       map[string]uuid.UUID
+	videoOwners map[uuid.UUID]uuid.UUID
+}
+
+func (cfg *apiConfig) objectOwners(ctx context.Context) (storedObjectOwners, error) {
+	db := cfg.db.WithContext(ctx)
+	owners := storedObjectOwners{
+		byKey:       map[string]uuid.UUID{},
+		videoOwners: map[uuid.UUID]uuid.UUID{},
+	}
+
+	videos, err := db.GetAllVideos()
+	if err != nil {
+		return storedObjectOwners{}, err
+	}
+	for _, video := range videos {
+		owners.videoOwners[video.ID] = video.UserID
+	}
+	versions, err := db.GetAllVideoVersions()
+	if err != nil {
+		return storedObjectOwners{}, err
+	}
+	for _, version := range versions {
+		userID := owners.videoOwners[version.VideoID]
+		owners.byKey[version.S3Key] = userID
+		if version.HDRKey != nil {
+			owners.byKey[*version.HDRKey] = userID
+		}
+		if version.SourceKey != nil {
+			owners.byKey[*version.SourceKey] = userID
+		}
+	}
+	return owners, nil
+}
+
+func (o storedObjectOwners) ownerOf(key string) (objectOwner, bool) {
+	if userID, ok := o.byKey[key]; ok {
+		return objectOwner{userID: userID}, userID != uuid.Nil
+	}
+
+	parts := strings.SplitN(key, "/", 3)
+	if len(parts) < 3 {
+		return objectOwner{}, false
+	}
+	id, err := uuid.Parse(parts[1])
+	if err != nil {
+		return objectOwner{}, false
+	}
+	switch parts[0] {
+	case "originals", "hls", "drm", "audio":
+		userID, ok := o.videoOwners[id]
+		return objectOwner{userID: userID}, ok
+	case "exports":
+		return objectOwner{userID: id}, true
+	case "bumpers":
+		return objectOwner{orgID: id}, true
+	}
+	return objectOwner{}, false
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// samples spread over the source, short enough that analysis takes a
+	// fraction of the transcode
+	perTitleSamples       = 5
+	perTitleSampleSeconds = 4.0
+	defaultPerTitleCRF    = 23
+)
+
+// perTitleOptions bound the bitrate per-title encoding picks. Simple content
+// like slides or animation gets close to MinBitrate, grain and fast motion
+// get up to MaxBitrate.
+type perTitleOptions struct {
+	// CRF is the quality the samples are measured at, the bitrate they need
+	// for it is what the video is encoded with
+	CRF        int    `json:"crf,omitempty"`
+	MinBitrate string `json:"min_bitrate"`
+	MaxBitrate string `json:"max_bitrate"`
+}
+
+func (o perTitleOptions) withDefaults() perTitleOptions {
+	if o.CRF == 0 {
+		o.CRF = defaultPerTitleCRF
+	}
+	return o
+}
+
+func (o perTitleOptions) validate() error {
+	o = o.withDefaults()
+	if o.CRF < 1 || o.CRF > 51 {
+		return errors.New("per_title crf must be between 1 and 51")
+	}
+	if !transcodeBitrateRegexp.MatchString(o.MinBitrate) || !transcodeBitrateRegexp.MatchString(o.MaxBitrate) {
+		return errors.New("per_title min_bitrate and max_bitrate must look like 2500k or 5M")
+	}
+	if bitrateKbps(o.MinBitrate) > bitrateKbps(o.MaxBitrate) {
+		return errors.New("per_title min_bitrate can't be above max_bitrate")
+	}
+	return nil
+}
+
+// bitrateKbps converts a bitrate like 2500k or 5M, already validated, to
+// kbit/s.
+func bitrateKbps(bitrate string) int {
+	n, _ := strconv.Atoi(bitrate[:len(bitrate)-1])
+	if strings.HasSuffix(bitrate, "M") {
+		return n * 1000
+	}
+	return n
+}
+
+// perTitleBitrate is what per-title analysis picked for a video, in kbit/s.
+type perTitleBitrate struct {
+	Average int
+	Peak    int
+}
+
+// apply sets the picked bitrate on the video options. The peak lets the
+// encoder spend more on the most complex scenes.
+func (b perTitleBitrate) apply(video transcodeVideoOptions) transcodeVideoOptions {
+	video.Bitrate = fmt.Sprintf("%dk", b.Average)
+	video.MaxBitrate = fmt.Sprintf("%dk", b.Peak)
+	return video
+}
+
+// analyzeComplexity encodes samples spread over the source at the profile's
+// per-title quality. The bitrate the samples needed to reach it is how
+// complex the content is: their average becomes the target bitrate and the
+// most demanding one the peak, both kept within the profile's bounds.
+func analyzeComplexity(ctx context.Context, filePath string, duration float64, profile transcodeProfile) (perTitleBitrate, error) {
+	options := profile.Video.PerTitle.withDefaults()
+	sample := profile
+	sample.Video.PerTitle = nil
+	sample.Video.CRF = &options.CRF
+	sample.Video.Bitrate = ""
+	sample.Video.MaxBitrate = ""
+
+	samples, length := perTitleSamples, perTitleSampleSeconds
+	if duration < perTitleSamples*perTitleSampleSeconds {
+		// short videos are measured whole
+		samples, length = 1, duration
+	}
+
+	rates := make([]int, 0, samples)
+	for i := range samples {
+		start := 0.0
+		if samples > 1 {
+			start = duration*(float64(i)+0.5)/float64(samples) - length/2
+		}
+		rate, err := sampleBitrate(ctx, filePath, start, length, sample)
+		if err != nil {
+			return perTitleBitrate{}, err
+		}
+		rates = append(rates, rate)
+	}
+
+	total := 0
+	for _, rate := range rates {
+		total += rate
+	}
+	minKbps, maxKbps := bitrateKbps(options.MinBitrate), bitrateKbps(options.MaxBitrate)
+	return perTitleBitrate{
+		Average: min(max(total/len(rates), minKbps), maxKbps),
+		Peak:    min(max(slices.Max(rates), minKbps), maxKbps),
+	}, nil
+}
+
+// sampleBitrate encodes length seconds of the source from start and returns
+// the bitrate the encode came out at.
+func sampleBitrate(ctx context.Context, filePath string, start, length float64, profile transcodeProfile) (int, error) {
+	args := slices.Concat(
+		[]string{
+			"-ss", strconv.FormatFloat(start, 'f', 3, 64),
+			"-t", strconv.FormatFloat(length, 'f', 3, 64),
+			"-i", filePath,
+		},
+		profile.videoArgs(),
+		// only the size matters, Matroska can be written to a pipe
+		[]string{"-an", "-sn", "-dn", "-f", "matroska", "pipe:1"},
+	)
+	cmd := ffmpegRunner.Command(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+	if err := cmd.Start(); err != nil {
+		return 0, err
+	}
+	n, copyErr := io.Copy(io.Discard, stdout)
+	if err := cmd.Wait(); err != nil {
+		return 0, newCommandError("ffmpeg", err, stderr.Bytes())
+	}
+	if copyErr != nil {
+		return 0, copyErr
+	}
+	return int(float64(n) * 8 / 1000 / length), nil
+}
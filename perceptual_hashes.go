@@ -0,0 +1,202 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math/bits"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// frames hashed, spread evenly over the video
+	perceptualHashFrames = 8
+	// hashes at most this many bits apart are of the same picture, give or
+	// take re-encoding, scaling and a watermark
+	perceptualHashMaxDistance = 10
+	// share of frames that must match for a video to be flagged
+	duplicateVideoMinScore = 0.75
+)
+
+// storePerceptualHashes hashes frames sampled from the processed file and
+// flags the video if they match those of an older one. Trims and crops
+// defeat it, it's meant to catch plain re-uploads.
+func (cfg *apiConfig) storePerceptualHashes(ctx context.Context, videoID uuid.UUID, filePath string, duration float64) error {
+	if duration <= 0 {
+		return nil
+	}
+	hashes := make([]uint64, 0, perceptualHashFrames)
+	for i := 1; i <= perceptualHashFrames; i++ {
+		offset := duration * float64(i) / float64(perceptualHashFrames+1)
+		hash, err := frameDifferenceHash(ctx, filePath, offset)
+		if err != nil {
+			return err
+		}
+		hashes = append(hashes, hash)
+	}
+	return cfg.flagDuplicateVideos(videoID, hashes)
+}
+
+// flagDuplicateVideos stores the video's frame hashes and compares them
+// with the library's.
+func (cfg *apiConfig) flagDuplicateVideos(videoID uuid.UUID, hashes []uint64) error {
+	err := cfg.db.ReplacePerceptualHashes(videoID, hashes)
+	if err != nil {
+		return err
+	}
+
+	library, err := cfg.db.GetPerceptualHashes()
+	if err != nil {
+		return err
+	}
+	for otherID, other := range library {
+		if otherID == videoID {
+			continue
+		}
+		score := perceptualHashScore(hashes, other)
+		if score < duplicateVideoMinScore {
+			continue
+		}
+		// flag the newer of the two, the older one is the likely original
+		flagged, original, err := cfg.newerVideo(videoID, otherID)
+		if err != nil {
+			return err
+		}
+		log.Printf("Video %s looks like a duplicate of %s (score %.2f)", flagged, original, score)
+		err = cfg.db.CreateDuplicateVideo(flagged, original, score)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cfg *apiConfig) newerVideo(a, b uuid.UUID) (newer, older uuid.UUID, err error) {
+	videoA, err := cfg.db.GetVideo(a)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, err
+	}
+	videoB, err := cfg.db.GetVideo(b)
+	if err != nil {
+		return uuid.Nil, uuid.Nil, err
+	}
+	if videoB.CreatedAt.After(videoA.CreatedAt) {
+		return b, a, nil
+	}
+	return a, b, nil
+}
+
+// frameDifferenceHash computes the dHash of the frame at offset seconds:
+// ffmpeg shrinks it to 9x8 gray pixels, and each bit tells whether a pixel
+// is brighter than its right neighbour.
+func frameDifferenceHash(ctx context.Context, filePath string, offset float64) (uint64, error) {
+	cmd := ffmpegRunner.Command(ctx, "ffmpeg",
+		"-ss", strconv.FormatFloat(offset, 'f', 3, 64),
+		"-i", filePath,
+		"-frames:v", "1",
+		"-vf", "scale=9:8:flags=area,format=gray",
+		"-f", "rawvideo",
+		"-",
+	)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return 0, newCommandError("ffmpeg", err, stderr.Bytes())
+	}
+	return differenceHash(stdout.Bytes())
+}
+
+func differenceHash(pixels []byte) (uint64, error) {
+	if len(pixels) != 9*8 {
+		return 0, fmt.Errorf("expected 72 gray pixels, got %d bytes", len(pixels))
+	}
+	var hash uint64
+	for row := 0; row < 8; row++ {
+		for col := 0; col < 8; col++ {
+			hash <<= 1
+			if pixels[row*9+col] > pixels[row*9+col+1] {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
+
+// perceptualHashScore is the lower of the two videos' shares of frames with
+// a close match in the other, so a short clip of a long video scores low.
+func perceptualHashScore(a, b []uint64) float64 {
+	return min(matchedFrames(a, b), matchedFrames(b, a))
+}
+
+func matchedFrames(hashes, other []uint64) float64 {
+	if len(hashes) == 0 || len(other) == 0 {
+		return 0
+	}
+	matched := 0
+	for _, hash := range hashes {
+		for _, o := range other {
+			if bits.OnesCount64(hash^o) <= perceptualHashMaxDistance {
+				matched++
+				break
+			}
+		}
+	}
+	return float64(matched) / float64(len(hashes))
+}
+
+// handlerAdminDuplicates lists videos flagged as likely re-uploads of older
+// ones, for moderators to review.
+func (cfg *apiConfig) handlerAdminDuplicates(w http.ResponseWriter, r *http.Request) {
+	type duplicate struct {
+		Video       database.Video `json:"video"`
+		DuplicateOf database.Video `json:"duplicate_of"`
+		Score       float64        `json:"score"`
+		DetectedAt  time.Time      `json:"detected_at"`
+	}
+
+	err := cfg.authorizeAdmin(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate admin API key", err)
+		return
+	}
+	limit, offset, err := searchPage(r.URL.Query())
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid page", err)
+		return
+	}
+
+	flagged, err := cfg.db.GetDuplicateVideos(limit, offset)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't retrieve duplicates", err)
+		return
+	}
+
+	duplicates := make([]duplicate, 0, len(flagged))
+	for _, d := range flagged {
+		video, err := cfg.db.GetVideo(d.VideoID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't retrieve video", err)
+			return
+		}
+		original, err := cfg.db.GetVideo(d.DuplicateOf)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't retrieve video", err)
+			return
+		}
+		duplicates = append(duplicates, duplicate{
+			Video:       cfg.withSignedURLs(video),
+			DuplicateOf: cfg.withSignedURLs(original),
+			Score:       d.Score,
+			DetectedAt:  d.DetectedAt,
+		})
+	}
+
+	respondWithJSON(w, http.StatusOK, duplicates)
+}
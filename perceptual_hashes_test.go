@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestDifferenceHash(t *testing.T) {
+	pixels := make([]byte, 9*8)
+	// the first row gets darker to the right, the rest is flat
+	for col := 0; col < 9; col++ {
+		pixels[col] = byte(255 - col*10)
+	}
+	hash, err := differenceHash(pixels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash != 0xff00000000000000 {
+		t.Errorf("hash = %#x", hash)
+	}
+	if _, err := differenceHash(pixels[:10]); err == nil {
+		t.Error("hashed a partial frame")
+	}
+}
+
+func TestFlagDuplicateVideos(t *testing.T) {
+	cfg := newTestConfig(t)
+	create := func() uuid.UUID {
+		t.Helper()
+		video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Boots", UserID: uuid.New()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return video.ID
+	}
+	original, reupload, unrelated := create(), create(), create()
+
+	frames := []uint64{0x0f0f0f0f0f0f0f0f, 0xf0f0f0f0f0f0f0f0, 0x00ff00ff00ff00ff, 0xff00ff00ff00ff00}
+	if err := cfg.flagDuplicateVideos(original, frames); err != nil {
+		t.Fatal(err)
+	}
+	// re-encoding flips a few bits, and one frame changed entirely
+	reencoded := []uint64{frames[0] ^ 0b101, frames[1] ^ 0b1, frames[2], 0x123456789abcdef0}
+	if err := cfg.flagDuplicateVideos(reupload, reencoded); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.flagDuplicateVideos(unrelated, []uint64{0x5555555555555555, 0x3333333333333333}); err != nil {
+		t.Fatal(err)
+	}
+
+	duplicates, err := cfg.db.GetDuplicateVideos(10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(duplicates) != 1 || duplicates[0].VideoID != reupload || duplicates[0].DuplicateOf != original || duplicates[0].Score != 0.75 {
+		t.Fatalf("duplicates = %+v", duplicates)
+	}
+
+	// the original being replaced with something else clears the flag
+	if err := cfg.flagDuplicateVideos(original, []uint64{0xaaaaaaaaaaaaaaaa}); err != nil {
+		t.Fatal(err)
+	}
+	if duplicates, err := cfg.db.GetDuplicateVideos(10, 0); err != nil || len(duplicates) != 0 {
+		t.Errorf("duplicates = %+v, %v", duplicates, err)
+	}
+}
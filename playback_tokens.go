@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	playbackTokenHeader = "X-Playback-Token"
+	deviceIDHeader      = "X-Device-ID"
+
+	playbackTokenExpiry = 6 * time.Hour
+	// a session that isn't seen for this long stops counting as a stream,
+	// players send heartbeats well within it
+	playbackSessionIdle       = 2 * time.Minute
+	playbackHeartbeatInterval = 30 * time.Second
+	// ended and idle sessions are kept this long for support questions
+	playbackSessionRetention  = 7 * 24 * time.Hour
+	playbackSessionGCInterval = time.Hour
+
+	minDeviceIDLength = 8
+	maxDeviceIDLength = 200
+)
+
+// playbackDeviceHash identifies the device a token is bound to. The device
+// ID is generated and kept by the player, the user agent makes a copied
+// token fail on other kinds of devices even with the ID.
+func playbackDeviceHash(r *http.Request, deviceID string) string {
+	sum := sha256.Sum256([]byte(deviceID + "\n" + r.UserAgent()))
+	return hex.EncodeToString(sum[:])
+}
+
+func (cfg *apiConfig) playbackTokenSignature(sessionID uuid.UUID, deviceHash string, expires int64) string {
+	mac := hmac.New(sha256.New, []byte(cfg.jwtSecret))
+	mac.Write([]byte("playback\n" + sessionID.String() + "\n" + deviceHash + "\n" + strconv.FormatInt(expires, 10)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// makePlaybackToken signs the session for the device as
+// "<session>.<expires>.<signature>".
+func (cfg *apiConfig) makePlaybackToken(session database.PlaybackSession, expires time.Time) string {
+	unix := expires.Unix()
+	return fmt.Sprintf("%s.%d.%s", session.ID, unix, cfg.playbackTokenSignature(session.ID, session.DeviceHash, unix))
+}
+
+// playbackSessionFromRequest checks the request's playback token against
+// its device and the viewer, responding with the error itself.
+func (cfg *apiConfig) playbackSessionFromRequest(w http.ResponseWriter, r *http.Request, userID uuid.UUID) (database.PlaybackSession, bool) {
+	token := r.Header.Get(playbackTokenHeader)
+	deviceID := r.Header.Get(deviceIDHeader)
+	if token == "" || deviceID == "" {
+		respondWithError(w, http.StatusUnauthorized, errCodeInvalidPlaybackToken, fmt.Sprintf("Playback needs the %s and %s headers", playbackTokenHeader, deviceIDHeader), nil)
+		return database.PlaybackSession{}, false
+	}
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		respondWithError(w, http.StatusUnauthorized, errCodeInvalidPlaybackToken, "Malformed playback token", nil)
+		return database.PlaybackSession{}, false
+	}
+	sessionID, err := uuid.Parse(parts[0])
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeInvalidPlaybackToken, "Malformed playback token", err)
+		return database.PlaybackSession{}, false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		respondWithError(w, http.StatusUnauthorized, errCodeInvalidPlaybackToken, "Playback token expired", err)
+		return database.PlaybackSession{}, false
+	}
+	expected := cfg.playbackTokenSignature(sessionID, playbackDeviceHash(r, deviceID), expires)
+	if !hmac.Equal([]byte(parts[2]), []byte(expected)) {
+		respondWithError(w, http.StatusUnauthorized, errCodeInvalidPlaybackToken, "Playback token isn't valid on this device", nil)
+		return database.PlaybackSession{}, false
+	}
+
+	session, err := cfg.db.GetPlaybackSession(sessionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get playback session", err)
+		return database.PlaybackSession{}, false
+	}
+	if session.ID == uuid.Nil || session.UserID != userID {
+		respondWithError(w, http.StatusUnauthorized, errCodeInvalidPlaybackToken, "Playback token isn't yours", nil)
+		return database.PlaybackSession{}, false
+	}
+	return session, true
+}
+
+// checkPlaybackToken lets requests for the video's streams through when
+// playback tokens are off or the request carries a live session for it.
+// Every check counts as activity of the session. It responds with the error
+// itself.
+func (cfg *apiConfig) checkPlaybackToken(w http.ResponseWriter, r *http.Request, userID, videoID uuid.UUID) bool {
+	if !cfg.playbackTokens {
+		return true
+	}
+	if userID == uuid.Nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Log in to watch this video", nil)
+		return false
+	}
+
+	session, ok := cfg.playbackSessionFromRequest(w, r, userID)
+	if !ok {
+		return false
+	}
+	if session.VideoID != videoID {
+		respondWithError(w, http.StatusForbidden, errCodeInvalidPlaybackToken, "Playback token is for another video", nil)
+		return false
+	}
+	return cfg.touchPlaybackSession(w, session)
+}
+
+func (cfg *apiConfig) touchPlaybackSession(w http.ResponseWriter, session database.PlaybackSession) bool {
+	_, limits, err := cfg.userPlan(session.UserID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get plan", err)
+		return false
+	}
+	live, err := cfg.db.TouchPlaybackSession(session.ID, playbackSessionIdle, limits.concurrentStreams)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update playback session", err)
+		return false
+	}
+	if !live {
+		respondWithError(w, http.StatusForbidden, errCodeStreamLimitReached, "This playback session has ended, start a new one to keep watching", nil)
+		return false
+	}
+	return true
+}
+
+// handlerPlaybackTokenCreate starts a playback session of the video on the
+// viewer's device. Each device counts as one stream towards the plan's
+// limit; starting another video on the same device replaces its session.
+func (cfg *apiConfig) handlerPlaybackTokenCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		DeviceID string `json:"device_id"`
+	}
+	type response struct {
+		Token     string    `json:"token"`
+		ExpiresAt time.Time `json:"expires_at"`
+		// HeartbeatIntervalSeconds is how often players should check in
+		// while playing
+		HeartbeatIntervalSeconds int                      `json:"heartbeat_interval_seconds"`
+		Session                  database.PlaybackSession `json:"session"`
+	}
+
+	if !cfg.playbackTokens {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Playback tokens aren't enabled", nil)
+		return
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if len(params.DeviceID) < minDeviceIDLength || len(params.DeviceID) > maxDeviceIDLength {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("device_id must be between %d and %d characters", minDeviceIDLength, maxDeviceIDLength), nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil || (isVideoHidden(video) && video.UserID != userID) {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't get video", nil)
+		return
+	}
+	if video.UserID != userID {
+		if reason, blocked := geoBlockReason(video, cfg.viewerCountry(r)); blocked {
+			respondWithError(w, http.StatusUnavailableForLegalReasons, errCodeGeoBlocked, reason, nil)
+			return
+		}
+	}
+
+	plan, limits, err := cfg.userPlan(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get plan", err)
+		return
+	}
+	session, active, err := cfg.db.StartPlaybackSession(userID, video.ID, playbackDeviceHash(r, params.DeviceID), playbackSessionIdle, limits.concurrentStreams)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't start playback session", err)
+		return
+	}
+	if session.ID == uuid.Nil {
+		respondWithErrorDetails(w, http.StatusForbidden, errCodeStreamLimitReached,
+			fmt.Sprintf("You're already watching on %d devices, the most the %s plan allows", active, plan),
+			map[string]any{"plan": plan, "active_streams": active, "max_streams": limits.concurrentStreams}, nil)
+		return
+	}
+
+	expires := time.Now().Add(playbackTokenExpiry)
+	respondWithJSON(w, http.StatusCreated, response{
+		Token:                    cfg.makePlaybackToken(session, expires),
+		ExpiresAt:                expires.UTC(),
+		HeartbeatIntervalSeconds: int(playbackHeartbeatInterval.Seconds()),
+		Session:                  session,
+	})
+}
+
+// handlerPlaybackTokenHeartbeat keeps the request's playback session
+// counted as a stream.
+func (cfg *apiConfig) handlerPlaybackTokenHeartbeat(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	session, ok := cfg.playbackSessionFromRequest(w, r, userID)
+	if !ok {
+		return
+	}
+	if !cfg.touchPlaybackSession(w, session) {
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerPlaybackTokenRevoke ends the request's playback session, freeing
+// its stream for another device right away.
+func (cfg *apiConfig) handlerPlaybackTokenRevoke(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	session, ok := cfg.playbackSessionFromRequest(w, r, userID)
+	if !ok {
+		return
+	}
+	err = cfg.db.EndPlaybackSession(session.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't end playback session", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cleanUpPlaybackSessions removes sessions nobody has used for
+// playbackSessionRetention.
+func (cfg *apiConfig) cleanUpPlaybackSessions(ctx context.Context) error {
+	removed, err := cfg.db.DeletePlaybackSessionsOlderThan(playbackSessionRetention)
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		log.Printf("Removed %d old playback sessions", removed)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// jobQueue delivers job IDs to workers. Job state lives in the database
+// either way; the queue only decides which worker gets to claim what, so
+// workers can run in other processes than the API server. Deliveries are
+// at-least-once: workers claim the job in the database before running it
+// and ignore deliveries of jobs that are done or still running elsewhere.
+type jobQueue interface {
+	// Publish makes a newly created or retried job available to workers.
+	Publish(ctx context.Context, jobID uuid.UUID) error
+	// Receive blocks until a job is available or ctx is done.
+	Receive(ctx context.Context) (jobDelivery, error)
+}
+
+type jobDelivery interface {
+	JobID() uuid.UUID
+	// Extend keeps the job hidden from other workers for another d.
+	Extend(ctx context.Context, d time.Duration) error
+	// Ack removes the job from the queue for good.
+	Ack(ctx context.Context) error
+	// Retry hands the job out again after delay.
+	Retry(ctx context.Context, delay time.Duration) error
+}
+
+// dbJobQueue polls the jobs table. It needs no extra infrastructure but
+// every worker has to share the database with the API server. It's the only
+// backend that honors job priorities.
+type dbJobQueue struct {
+	db                database.Client
+	visibilityTimeout time.Duration
+}
+
+func (q dbJobQueue) Publish(ctx context.Context, jobID uuid.UUID) error {
+	// pending rows are picked up by the next poll
+	return nil
+}
+
+func (q dbJobQueue) Receive(ctx context.Context) (jobDelivery, error) {
+	for {
+		id, err := q.db.NextJobID(jobRetryDelay, q.visibilityTimeout, jobPriorityAgingInterval)
+		if err != nil {
+			return nil, err
+		}
+		if id != uuid.Nil {
+			return dbJobDelivery{id: id}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(jobPollInterval):
+		}
+	}
+}
+
+// dbJobDelivery has nothing to acknowledge, the job's status and heartbeat
+// in the database decide when it's handed out again.
+type dbJobDelivery struct {
+	id uuid.UUID
+}
+
+func (d dbJobDelivery) JobID() uuid.UUID {
+	return d.id
+}
+
+func (d dbJobDelivery) Extend(ctx context.Context, timeout time.Duration) error {
+	return nil
+}
+
+func (d dbJobDelivery) Ack(ctx context.Context) error {
+	return nil
+}
+
+func (d dbJobDelivery) Retry(ctx context.Context, delay time.Duration) error {
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	v4 "github.com/aws/aws-sdk-go-v2/aws/signer/v4"
+	"github.com/google/uuid"
+)
+
+// SQS long polling waits at most this long for a message
+const sqsWaitSeconds = 20
+
+// sqsJobQueue talks to the SQS JSON API directly, signing requests with the
+// app's AWS credentials. SQS hands messages out in roughly the order they
+// were sent, so job priorities are ignored.
+type sqsJobQueue struct {
+	queueURL          string
+	endpoint          string
+	region            string
+	credentials       aws.CredentialsProvider
+	signer            *v4.Signer
+	httpClient        *http.Client
+	visibilityTimeout time.Duration
+}
+
+type sqsJobMessage struct {
+	JobID uuid.UUID `json:"job_id"`
+}
+
+func newSQSJobQueue(awsConfig aws.Config, queueURL string, visibilityTimeout time.Duration) (*sqsJobQueue, error) {
+	u, err := url.Parse(queueURL)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("invalid SQS queue URL %q", queueURL)
+	}
+	return &sqsJobQueue{
+		queueURL:    queueURL,
+		endpoint:    u.Scheme + "://" + u.Host + "/",
+		region:      awsConfig.Region,
+		credentials: awsConfig.Credentials,
+		signer:      v4.NewSigner(),
+		// long polls hold the connection open for sqsWaitSeconds
+		httpClient:        &http.Client{Timeout: (sqsWaitSeconds + 10) * time.Second},
+		visibilityTimeout: visibilityTimeout,
+	}, nil
+}
+
+func (q *sqsJobQueue) Publish(ctx context.Context, jobID uuid.UUID) error {
+	body, err := json.Marshal(sqsJobMessage{JobID: jobID})
+	if err != nil {
+		return err
+	}
+	return q.call(ctx, "SendMessage", map[string]any{
+		"QueueUrl":    q.queueURL,
+		"MessageBody": string(body),
+	}, nil)
+}
+
+func (q *sqsJobQueue) Receive(ctx context.Context) (jobDelivery, error) {
+	for {
+		messages, err := q.receiveMessages(ctx, 1)
+		if err != nil {
+			return nil, err
+		}
+		if len(messages) == 0 {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			continue
+		}
+
+		msg := messages[0]
+		delivery := &sqsJobDelivery{queue: q, receiptHandle: msg.ReceiptHandle}
+		var body sqsJobMessage
+		if err := json.Unmarshal([]byte(msg.Body), &body); err != nil || body.JobID == uuid.Nil {
+			// nothing will ever be able to run it, drop it
+			if err := delivery.Ack(ctx); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		delivery.jobID = body.JobID
+		return delivery, nil
+	}
+}
+
+type sqsMessage struct {
+	ReceiptHandle string `json:"ReceiptHandle"`
+	Body          string `json:"Body"`
+}
+
+// receiveMessages long polls for up to max messages. It returns none when
+// the poll times out.
+func (q *sqsJobQueue) receiveMessages(ctx context.Context, max int) ([]sqsMessage, error) {
+	var resp struct {
+		Messages []sqsMessage `json:"Messages"`
+	}
+	err := q.call(ctx, "ReceiveMessage", map[string]any{
+		"QueueUrl":            q.queueURL,
+		"MaxNumberOfMessages": max,
+		"WaitTimeSeconds":     sqsWaitSeconds,
+		"VisibilityTimeout":   int(q.visibilityTimeout.Seconds()),
+	}, &resp)
+	return resp.Messages, err
+}
+
+func (q *sqsJobQueue) deleteMessage(ctx context.Context, receiptHandle string) error {
+	return q.call(ctx, "DeleteMessage", map[string]any{
+		"QueueUrl":      q.queueURL,
+		"ReceiptHandle": receiptHandle,
+	}, nil)
+}
+
+type sqsJobDelivery struct {
+	queue         *sqsJobQueue
+	receiptHandle string
+	jobID         uuid.UUID
+}
+
+func (d *sqsJobDelivery) JobID() uuid.UUID {
+	return d.jobID
+}
+
+func (d *sqsJobDelivery) Extend(ctx context.Context, timeout time.Duration) error {
+	return d.changeVisibility(ctx, timeout)
+}
+
+func (d *sqsJobDelivery) Ack(ctx context.Context) error {
+	return d.queue.deleteMessage(ctx, d.receiptHandle)
+}
+
+func (d *sqsJobDelivery) Retry(ctx context.Context, delay time.Duration) error {
+	return d.changeVisibility(ctx, delay)
+}
+
+func (d *sqsJobDelivery) changeVisibility(ctx context.Context, timeout time.Duration) error {
+	return d.queue.call(ctx, "ChangeMessageVisibility", map[string]any{
+		"QueueUrl":          d.queue.queueURL,
+		"ReceiptHandle":     d.receiptHandle,
+		"VisibilityTimeout": int(timeout.Seconds()),
+	}, nil)
+}
+
+func (q *sqsJobQueue) call(ctx context.Context, action string, params any, out any) error {
+	body, err := json.Marshal(params)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, q.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "AmazonSQS."+action)
+
+	creds, err := q.credentials.Retrieve(ctx)
+	if err != nil {
+		return fmt.Errorf("couldn't get AWS credentials: %w", err)
+	}
+	payloadHash := sha256.Sum256(body)
+	err = q.signer.SignHTTP(ctx, creds, req, hex.EncodeToString(payloadHash[:]), "sqs", q.region, time.Now())
+	if err != nil {
+		return err
+	}
+
+	resp, err := q.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dat, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var apiErr struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		json.Unmarshal(dat, &apiErr)
+		if apiErr.Type == "" {
+			return fmt.Errorf("SQS %s returned %s", action, resp.Status)
+		}
+		return fmt.Errorf("SQS %s failed: %s: %s", action, apiErr.Type, apiErr.Message)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.Unmarshal(dat, out); err != nil {
+		return fmt.Errorf("couldn't decode SQS %s response: %w", action, err)
+	}
+	return nil
+}
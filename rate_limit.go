@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter allows up to a limit of events per key in fixed windows.
+type rateLimiter interface {
+	// allow records an event for key. When the key is over its limit it
+	// returns false and how long until the next window starts.
+	allow(key string) (bool, time.Duration)
+}
+
+// memoryRateLimiter lives in memory, so every server instance counts on its
+// own.
+type memoryRateLimiter struct {
+	mu      sync.Mutex
+	limit   int
+	window  time.Duration
+	windows map[string]rateWindow
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(limit int, window time.Duration) *memoryRateLimiter {
+	return &memoryRateLimiter{
+		limit:   limit,
+		window:  window,
+		windows: map[string]rateWindow{},
+	}
+}
+
+func (l *memoryRateLimiter) allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	w, ok := l.windows[key]
+	if !ok || now.Sub(w.start) >= l.window {
+		l.prune(now)
+		w = rateWindow{start: now}
+	}
+	if w.count >= l.limit {
+		return false, w.start.Add(l.window).Sub(now)
+	}
+	w.count++
+	l.windows[key] = w
+	return true, 0
+}
+
+// prune drops windows that are over, so keys seen once don't pile up.
+func (l *memoryRateLimiter) prune(now time.Time) {
+	for key, w := range l.windows {
+		if now.Sub(w.start) >= l.window {
+			delete(l.windows, key)
+		}
+	}
+}
+
+// redisRateLimiter counts in Redis, so the limit holds across instances.
+// When Redis can't be reached events are let through.
+type redisRateLimiter struct {
+	client *redisClient
+	name   string
+	limit  int
+	window time.Duration
+}
+
+func newRedisRateLimiter(client *redisClient, name string, limit int, window time.Duration) *redisRateLimiter {
+	return &redisRateLimiter{client: client, name: name, limit: limit, window: window}
+}
+
+// returns 0 when the event is allowed, otherwise the milliseconds until
+// the window ends
+const redisRateLimitScript = `
+local count = tonumber(redis.call('GET', KEYS[1]) or '0')
+if count >= tonumber(ARGV[2]) then
+	local ttl = redis.call('PTTL', KEYS[1])
+	if ttl < 1 then ttl = 1 end
+	return ttl
+end
+if redis.call('INCR', KEYS[1]) == 1 then
+	redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return 0
+`
+
+func (l *redisRateLimiter) allow(key string) (bool, time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisTimeout)
+	defer cancel()
+
+	reply, err := l.client.eval(ctx, redisRateLimitScript,
+		[]string{redisKeyPrefix + "rate:" + l.name + ":" + key},
+		redisMillis(l.window), strconv.Itoa(l.limit))
+	if err != nil {
+		log.Printf("Couldn't check rate limit %s in Redis: %v", l.name, err)
+		return true, 0
+	}
+	wait, _ := reply.(int64)
+	if wait > 0 {
+		return false, time.Duration(wait) * time.Millisecond
+	}
+	return true, 0
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// panicsRecovered counts handler panics since the process started.
+var panicsRecovered atomic.Int64
+
+// statusRecorder remembers whether the handler already started the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.wroteHeader = true
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// recoveryMiddleware turns a panicking handler into a 500 error response
+// instead of a dropped connection. It has to run inside requestIDMiddleware
+// so the logged stack can be matched to the response.
+func recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// the server's way of aborting a response on purpose
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			panicsRecovered.Add(1)
+			log.Printf("[%s] panic serving %s %s: %v\n%s", w.Header().Get(requestIDHeader), r.Method, r.URL.Path, v, debug.Stack())
+			if rec.wroteHeader {
+				// part of the response is out, a truncated body is all we can
+				// do, so make sure the client sees the connection fail
+				panic(http.ErrAbortHandler)
+			}
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Internal server error", nil)
+		}()
+		next.ServeHTTP(rec, r)
+	})
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	redisKeyPrefix = "tubely:"
+	redisIdleConns = 16
+	redisTimeout   = 500 * time.Millisecond
+)
+
+// redisClient is what instances and job workers coordinate through when
+// REDIS_URL is set. It speaks just enough of the Redis protocol for simple
+// commands and scripts, replies are strings, integers or bulk strings.
+type redisClient struct {
+	addr     string
+	username string
+	password string
+	db       int
+	tls      bool
+	idle     chan *redisConn
+}
+
+type redisConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+// newRedisClient takes a URL like redis://:password@host:6379/0, rediss://
+// for TLS.
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("unsupported scheme %q, must be redis or rediss", u.Scheme)
+	}
+	c := &redisClient{
+		addr: u.Host,
+		tls:  u.Scheme == "rediss",
+		idle: make(chan *redisConn, redisIdleConns),
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		c.db, err = strconv.Atoi(db)
+		if err != nil {
+			return nil, fmt.Errorf("invalid database %q", db)
+		}
+	}
+	return c, nil
+}
+
+// redisCache shares the metadata cache, so a write in any process drops the
+// cached copy for all.
+type redisCache struct {
+	client *redisClient
+}
+
+func (c redisCache) Get(ctx context.Context, key string) ([]byte, bool) {
+	reply, err := c.client.do(ctx, "GET", redisKeyPrefix+"cache:"+key)
+	if err != nil {
+		log.Printf("Couldn't get %s from Redis: %v", key, err)
+		return nil, false
+	}
+	value, ok := reply.([]byte)
+	return value, ok
+}
+
+func (c redisCache) Set(ctx context.Context, key string, value []byte, ttl time.Duration) {
+	if ttl < time.Millisecond {
+		return
+	}
+	_, err := c.client.do(ctx, "SET", redisKeyPrefix+"cache:"+key, string(value), "PX", redisMillis(ttl))
+	if err != nil {
+		log.Printf("Couldn't set %s in Redis: %v", key, err)
+	}
+}
+
+func (c redisCache) Delete(ctx context.Context, key string) {
+	_, err := c.client.do(ctx, "DEL", redisKeyPrefix+"cache:"+key)
+	if err != nil {
+		log.Printf("Couldn't delete %s from Redis: %v", key, err)
+	}
+}
+
+func redisMillis(d time.Duration) string {
+	return strconv.FormatInt(d.Milliseconds(), 10)
+}
+
+// eval runs a Lua script, which Redis runs atomically.
+func (c *redisClient) eval(ctx context.Context, script string, keys []string, args ...string) (any, error) {
+	cmd := append([]string{"EVAL", script, strconv.Itoa(len(keys))}, keys...)
+	return c.do(ctx, append(cmd, args...)...)
+}
+
+// do runs a command and returns its reply: a string, an int64, []byte for
+// bulk strings or nil. Connections are only reused after a clean reply.
+func (c *redisClient) do(ctx context.Context, args ...string) (any, error) {
+	conn, err := c.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.command(ctx, args...)
+	var redisErr redisError
+	if err != nil && !errors.As(err, &redisErr) {
+		conn.Close()
+		return nil, err
+	}
+	select {
+	case c.idle <- conn:
+	default:
+		conn.Close()
+	}
+	return reply, err
+}
+
+func (c *redisClient) conn(ctx context.Context) (*redisConn, error) {
+	select {
+	case conn := <-c.idle:
+		return conn, nil
+	default:
+	}
+
+	dialer := &net.Dialer{Timeout: redisTimeout}
+	var netConn net.Conn
+	var err error
+	if c.tls {
+		host, _, _ := net.SplitHostPort(c.addr)
+		netConn, err = (&tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}).DialContext(ctx, "tcp", c.addr)
+	} else {
+		netConn, err = dialer.DialContext(ctx, "tcp", c.addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{Conn: netConn, r: bufio.NewReader(netConn)}
+
+	if c.password != "" {
+		args := []string{"AUTH", c.password}
+		if c.username != "" {
+			args = []string{"AUTH", c.username, c.password}
+		}
+		if _, err := conn.command(ctx, args...); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("couldn't authenticate: %w", err)
+		}
+	}
+	if c.db != 0 {
+		if _, err := conn.command(ctx, "SELECT", strconv.Itoa(c.db)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("couldn't select database %d: %w", c.db, err)
+		}
+	}
+	return conn, nil
+}
+
+type redisError string
+
+func (e redisError) Error() string {
+	return string(e)
+}
+
+func (conn *redisConn) command(ctx context.Context, args ...string) (any, error) {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(redisTimeout)
+	}
+	conn.SetDeadline(deadline)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(conn, b.String()); err != nil {
+		return nil, err
+	}
+	return conn.reply()
+}
+
+func (conn *redisConn) reply() (any, error) {
+	line, err := conn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(conn.r, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
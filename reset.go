@@ -4,14 +4,13 @@ import "net/http"
 
 func (cfg *apiConfig) handlerReset(w http.ResponseWriter, r *http.Request) {
 	if cfg.platform != "dev" {
-		w.WriteHeader(http.StatusForbidden)
-		w.Write([]byte("Reset is only allowed in dev environment."))
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "Reset is only allowed in dev environment.", nil)
 		return
 	}
 
 	err := cfg.db.Reset()
 	if err != nil {
-		respondWithError(w, http.StatusInternalServerError, "Couldn't reset database", err)
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't reset database", err)
 		return
 	}
 	w.WriteHeader(http.StatusOK)
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	jobTypeCompleteUpload = "complete_upload"
+	// the consumer only looks up and enqueues, it never holds a message long
+	s3EventsVisibilityTimeout = time.Minute
+	s3EventsBatchSize         = 10
+)
+
+type s3EventKind int
+
+const (
+	s3ObjectCreated s3EventKind = iota + 1
+	s3ObjectRemoved
+)
+
+type s3ObjectEvent struct {
+	Kind   s3EventKind
+	Bucket string
+	Key    string
+}
+
+// parseS3Events decodes a message of the S3 events queue. S3 can send its
+// notifications straight to SQS, through an SNS topic, or through
+// EventBridge, each wraps them differently. Test events and events that
+// aren't about objects come back empty.
+func parseS3Events(body []byte) ([]s3ObjectEvent, error) {
+	var envelope struct {
+		// SNS
+		Type    string `json:"Type"`
+		Message string `json:"Message"`
+		// EventBridge
+		Source     string `json:"source"`
+		DetailType string `json:"detail-type"`
+		Detail     struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key string `json:"key"`
+			} `json:"object"`
+		} `json:"detail"`
+		// S3
+		Records []struct {
+			EventName string `json:"eventName"`
+			S3        struct {
+				Bucket struct {
+					Name string `json:"name"`
+				} `json:"bucket"`
+				Object struct {
+					Key string `json:"key"`
+				} `json:"object"`
+			} `json:"s3"`
+		} `json:"Records"`
+	}
+	if err := json.Unmarshal(body, &envelope); err != nil {
+		return nil, err
+	}
+
+	if envelope.Type == "Notification" {
+		return parseS3Events([]byte(envelope.Message))
+	}
+
+	if envelope.Source == "aws.s3" {
+		event := s3ObjectEvent{
+			Bucket: envelope.Detail.Bucket.Name,
+			// EventBridge keys aren't URL encoded
+			Key: envelope.Detail.Object.Key,
+		}
+		switch envelope.DetailType {
+		case "Object Created":
+			event.Kind = s3ObjectCreated
+		case "Object Deleted":
+			event.Kind = s3ObjectRemoved
+		default:
+			return nil, nil
+		}
+		return []s3ObjectEvent{event}, nil
+	}
+
+	var events []s3ObjectEvent
+	for _, record := range envelope.Records {
+		var kind s3EventKind
+		switch {
+		case strings.HasPrefix(record.EventName, "ObjectCreated:"):
+			kind = s3ObjectCreated
+		case strings.HasPrefix(record.EventName, "ObjectRemoved:"):
+			kind = s3ObjectRemoved
+		default:
+			continue
+		}
+		// S3 notifications encode keys like form values
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %w", record.S3.Object.Key, err)
+		}
+		events = append(events, s3ObjectEvent{
+			Kind:   kind,
+			Bucket: record.S3.Bucket.Name,
+			Key:    key,
+		})
+	}
+	return events, nil
+}
+
+// consumeS3Events handles the S3 events queue until ctx is done. Messages
+// that fail are left on the queue for SQS to hand out again, or to move to
+// its dead-letter queue.
+func (cfg *apiConfig) consumeS3Events(ctx context.Context, queue *sqsJobQueue) {
+	for {
+		messages, err := queue.receiveMessages(ctx, s3EventsBatchSize)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("Couldn't receive S3 events: %v", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(jobPollInterval):
+			}
+			continue
+		}
+
+		for _, msg := range messages {
+			err := cfg.handleS3EventMessage(ctx, []byte(msg.Body))
+			if err != nil {
+				log.Printf("Couldn't handle S3 event: %v", err)
+				continue
+			}
+			if err := queue.deleteMessage(ctx, msg.ReceiptHandle); err != nil {
+				log.Printf("Couldn't delete S3 event message: %v", err)
+			}
+		}
+	}
+}
+
+func (cfg *apiConfig) handleS3EventMessage(ctx context.Context, body []byte) error {
+	events, err := parseS3Events(body)
+	if err != nil {
+		// it will never parse, drop it
+		log.Printf("Dropping malformed S3 event: %v", err)
+		return nil
+	}
+	for _, event := range events {
+		if err := cfg.handleS3Event(ctx, event); err != nil {
+			return fmt.Errorf("%s: %w", event.Key, err)
+		}
+	}
+	return nil
+}
+
+func (cfg *apiConfig) handleS3Event(ctx context.Context, event s3ObjectEvent) error {
+	// the bucket may notify about objects of other apps too
+	key, ok := cfg.keyFromBucketKey(event.Bucket, event.Key)
+	if !ok {
+		return nil
+	}
+	switch event.Kind {
+	case s3ObjectCreated:
+		return cfg.handleS3ObjectCreated(ctx, key)
+	case s3ObjectRemoved:
+		return cfg.handleS3ObjectRemoved(ctx, key)
+	}
+	return nil
+}
+
+// handleS3ObjectCreated processes direct uploads as soon as they land,
+// without waiting for the client to complete the session, and confirms
+// objects we wrote ourselves.
+func (cfg *apiConfig) handleS3ObjectCreated(ctx context.Context, key string) error {
+	db := cfg.db.WithContext(ctx)
+
+	session, err := db.GetOpenUploadSessionByKey(key)
+	if err != nil {
+		return err
+	}
+	if session.ID != uuid.Nil {
+		_, err := cfg.enqueueJob(jobTypeCompleteUpload, &session.VideoID, completeUploadPayload{SessionID: session.ID})
+		return err
+	}
+
+	version, err := db.GetVideoVersionByKey(key)
+	if err != nil {
+		return err
+	}
+	if version.ID != uuid.Nil {
+		return db.ConfirmVideoVersion(version.ID)
+	}
+	return nil
+}
+
+// handleS3ObjectRemoved reports videos whose playable file was deleted
+// behind our back. Our own deletes remove the version first, so they aren't
+// found here.
+func (cfg *apiConfig) handleS3ObjectRemoved(ctx context.Context, key string) error {
+	db := cfg.db.WithContext(ctx)
+
+	version, err := db.GetVideoVersionByKey(key)
+	if err != nil {
+		return err
+	}
+	if version.ID == uuid.Nil {
+		return nil
+	}
+	video, err := db.GetVideo(version.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil || video.VideoURL == nil {
+		return nil
+	}
+	if currentKey, ok := cfg.objectKeyFromURL(*video.VideoURL); !ok || currentKey != key {
+		// an older version, the video still plays
+		return nil
+	}
+
+	log.Printf("File of video %s was deleted from S3 outside the app: %s", video.ID, key)
+	err = cfg.sendWebhook(ctx, "video.file_deleted", video)
+	if err != nil {
+		log.Printf("Couldn't send video.file_deleted webhook for %s: %v", video.ID, err)
+	}
+	cfg.notify(database.CreateNotificationParams{
+		UserID:  video.UserID,
+		VideoID: &video.ID,
+		Type:    database.NotificationVideoFileDeleted,
+		Title:   fmt.Sprintf("%q can't be played", video.Title),
+		Body:    fmt.Sprintf("The file of your video %q was deleted from storage. Upload it again to restore it.", video.Title),
+	})
+	return nil
+}
+
+type completeUploadPayload struct {
+	SessionID uuid.UUID `json:"session_id"`
+}
+
+func (cfg *apiConfig) runCompleteUploadJob(ctx context.Context, job database.Job) error {
+	var payload completeUploadPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+
+	session, err := cfg.db.GetUploadSession(payload.SessionID)
+	if err != nil {
+		return err
+	}
+	if session.ID == uuid.Nil || session.CompletedAt != nil {
+		// gone with its video, or the client completed it
+		return nil
+	}
+	profile, err := cfg.transcodeProfileByName(session.TranscodeProfile)
+	if err != nil {
+		// the profile was removed from the config since
+		profile = cfg.defaultTranscodeProfile()
+	}
+
+	_, err = cfg.completeUploadSession(ctx, session, profile)
+	if errors.Is(err, errUploadSessionClaimed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,497 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/saml"
+	"github.com/google/uuid"
+)
+
+const (
+	// how long the user has to sign in at the IdP
+	samlRequestLifetime   = 10 * time.Minute
+	samlRequestGCInterval = time.Hour
+
+	// largest ACS form post, well over what a signed response takes
+	maxSAMLResponseBytes = 1 << 20
+)
+
+var samlLoginTemplate = template.Must(template.New("saml_login").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Tubely</title>
+</head>
+<body>
+{{if .Message}}<p>{{.Message}}</p><p><a href="/app/">Back to Tubely</a></p>{{else}}<p>Signing you in...</p>
+<script>
+localStorage.setItem('token', {{.Token}});
+window.location.replace('/app/');
+</script>{{end}}
+</body>
+</html>
+`))
+
+type samlLoginPage struct {
+	Token   string
+	Message string
+}
+
+type samlConfigResponse struct {
+	database.SAMLConfig
+	// what the IdP administrator needs to set up the application
+	SPEntityID  string `json:"sp_entity_id"`
+	ACSURL      string `json:"acs_url"`
+	MetadataURL string `json:"metadata_url"`
+	LoginURL    string `json:"login_url"`
+}
+
+// samlURL is the URL of one of the organization's SAML endpoints.
+func (cfg *apiConfig) samlURL(orgID uuid.UUID, endpoint string) string {
+	return cfg.appBaseURL + "/saml/" + orgID.String() + "/" + endpoint
+}
+
+// serviceProvider is the SP for the organization. The entity ID is the
+// metadata URL, as IdPs expect.
+func (cfg *apiConfig) serviceProvider(orgID uuid.UUID, config database.SAMLConfig) (saml.ServiceProvider, error) {
+	sp := saml.ServiceProvider{
+		EntityID:    cfg.samlURL(orgID, "metadata"),
+		ACSURL:      cfg.samlURL(orgID, "acs"),
+		IDPEntityID: config.IDPEntityID,
+		IDPSSOURL:   config.IDPSSOURL,
+	}
+	if config.IDPCertificate == "" {
+		return sp, nil
+	}
+	cert, err := saml.ParseCertificate(config.IDPCertificate)
+	if err != nil {
+		return saml.ServiceProvider{}, err
+	}
+	sp.IDPCertificate = cert
+	return sp, nil
+}
+
+// handlerSAMLMetadata serves the SP metadata to import into the IdP. It's
+// available before single sign-on is configured, since setting up the IdP
+// comes first.
+func (cfg *apiConfig) handlerSAMLMetadata(w http.ResponseWriter, r *http.Request) {
+	orgID, err := uuid.Parse(r.PathValue("organizationID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid organization ID", err)
+		return
+	}
+	org, err := cfg.db.GetOrganization(orgID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get organization", err)
+		return
+	}
+	if org.ID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeOrganizationNotFound, "Organization not found", nil)
+		return
+	}
+
+	sp, err := cfg.serviceProvider(org.ID, database.SAMLConfig{})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create metadata", err)
+		return
+	}
+	metadata, err := sp.Metadata()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create metadata", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/samlmetadata+xml")
+	w.Write(metadata)
+}
+
+// handlerSAMLLogin sends the browser to the organization's IdP to sign in.
+func (cfg *apiConfig) handlerSAMLLogin(w http.ResponseWriter, r *http.Request) {
+	orgID, err := uuid.Parse(r.PathValue("organizationID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid organization ID", err)
+		return
+	}
+	config, err := cfg.db.GetSAMLConfig(orgID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get single sign-on settings", err)
+		return
+	}
+	if config.OrganizationID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Single sign-on isn't set up for this organization", nil)
+		return
+	}
+	sp, err := cfg.serviceProvider(orgID, config)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Single sign-on is misconfigured", err)
+		return
+	}
+
+	requestID, err := saml.NewRequestID()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create request", err)
+		return
+	}
+	now := time.Now().UTC()
+	err = cfg.db.CreateSAMLRequest(requestID, orgID, now.Add(samlRequestLifetime))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save request", err)
+		return
+	}
+	redirectURL, err := sp.AuthnRequestURL(requestID, "", now)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create request", err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	http.Redirect(w, r, redirectURL, http.StatusFound)
+}
+
+// handlerSAMLACS signs in the user the IdP vouches for, creating their
+// account and membership on first sign in. Only answers to requests we sent
+// are accepted, and each only once.
+func (cfg *apiConfig) handlerSAMLACS(w http.ResponseWriter, r *http.Request) {
+	orgID, err := uuid.Parse(r.PathValue("organizationID"))
+	if err != nil {
+		renderSAMLLogin(w, http.StatusBadRequest, samlLoginPage{Message: "Invalid organization ID"})
+		return
+	}
+	config, err := cfg.db.GetSAMLConfig(orgID)
+	if err != nil {
+		log.Printf("Couldn't get SAML settings of organization %s: %v", orgID, err)
+		renderSAMLLogin(w, http.StatusInternalServerError, samlLoginPage{Message: "Something went wrong, try again later"})
+		return
+	}
+	if config.OrganizationID == uuid.Nil {
+		renderSAMLLogin(w, http.StatusNotFound, samlLoginPage{Message: "Single sign-on isn't set up for this organization"})
+		return
+	}
+	sp, err := cfg.serviceProvider(orgID, config)
+	if err != nil {
+		log.Printf("Invalid SAML settings of organization %s: %v", orgID, err)
+		renderSAMLLogin(w, http.StatusInternalServerError, samlLoginPage{Message: "Single sign-on is misconfigured"})
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxSAMLResponseBytes)
+	assertion, err := sp.ParseResponse(r.PostFormValue("SAMLResponse"), time.Now())
+	if err != nil {
+		log.Printf("Refused SAML response for organization %s: %v", orgID, err)
+		renderSAMLLogin(w, http.StatusForbidden, samlLoginPage{Message: "Your identity provider's response couldn't be verified"})
+		return
+	}
+	used, err := cfg.db.UseSAMLRequest(assertion.InResponseTo, orgID)
+	if err != nil {
+		log.Printf("Couldn't claim SAML request %s: %v", assertion.InResponseTo, err)
+		renderSAMLLogin(w, http.StatusInternalServerError, samlLoginPage{Message: "Something went wrong, try again later"})
+		return
+	}
+	if !used {
+		renderSAMLLogin(w, http.StatusForbidden, samlLoginPage{Message: "This sign in expired or was already used, start over"})
+		return
+	}
+
+	email := assertion.NameID
+	if config.EmailAttribute != "" {
+		email = assertion.FirstAttribute(config.EmailAttribute)
+	}
+	email = strings.TrimSpace(email)
+	if !strings.Contains(email, "@") {
+		renderSAMLLogin(w, http.StatusForbidden, samlLoginPage{Message: "Your identity provider didn't send an email address"})
+		return
+	}
+	role := database.OrganizationRoleMember
+	if config.RoleAttribute != "" {
+		for name, values := range assertion.Attributes {
+			if !strings.EqualFold(name, config.RoleAttribute) {
+				continue
+			}
+			for _, value := range values {
+				if slices.Contains(config.OwnerValues, value) {
+					role = database.OrganizationRoleOwner
+				}
+			}
+		}
+	}
+
+	userID, message, err := cfg.provisionSSOUser(orgID, config, email, role)
+	if err != nil {
+		log.Printf("Couldn't sign in %s through organization %s: %v", email, orgID, err)
+		renderSAMLLogin(w, http.StatusInternalServerError, samlLoginPage{Message: "Something went wrong, try again later"})
+		return
+	}
+	if message != "" {
+		renderSAMLLogin(w, http.StatusConflict, samlLoginPage{Message: message})
+		return
+	}
+
+	// the IdP handles the second factor
+	accessToken, _, ok := cfg.startSession(w, r, userID)
+	if !ok {
+		return
+	}
+
+	ipAddress := ""
+	if addr, ok := cfg.clientIP(r); ok {
+		ipAddress = addr.String()
+	}
+	err = cfg.db.CreateAuditLogEntry(database.CreateAuditLogEntryParams{
+		UserID:    userID,
+		Action:    database.AuditActionSSOLogin,
+		IPAddress: ipAddress,
+		Detail:    "organization " + orgID.String(),
+	})
+	if err != nil {
+		log.Printf("Couldn't record SSO login of user %s: %v", userID, err)
+	}
+
+	renderSAMLLogin(w, http.StatusOK, samlLoginPage{Token: accessToken})
+}
+
+// provisionSSOUser finds or creates the user for an asserted email and
+// brings their membership in line with the assertion. Local accounts with
+// the email are left alone: the organization's IdP may not take over an
+// account it didn't create. The message explains a refusal.
+func (cfg *apiConfig) provisionSSOUser(orgID uuid.UUID, config database.SAMLConfig, email string, role database.OrganizationRole) (uuid.UUID, string, error) {
+	user, err := cfg.db.GetUserByEmail(email)
+	if err != nil {
+		return uuid.Nil, "", err
+	}
+	if user.ID == uuid.Nil {
+		password := make([]byte, 32)
+		if _, err := rand.Read(password); err != nil {
+			return uuid.Nil, "", err
+		}
+		hash, err := auth.HashPassword(hex.EncodeToString(password))
+		if err != nil {
+			return uuid.Nil, "", err
+		}
+		created, err := cfg.db.CreateSSOUser(database.CreateSSOUserParams{
+			Email:          email,
+			Password:       hash,
+			OrganizationID: orgID,
+			Role:           role,
+		})
+		if err != nil {
+			return uuid.Nil, "", err
+		}
+		return created.ID, "", nil
+	}
+
+	ssoOrgID, err := cfg.db.GetSSOOrganizationID(user.ID)
+	if err != nil {
+		return uuid.Nil, "", err
+	}
+	if ssoOrgID != orgID {
+		return uuid.Nil, "An account with this email already exists, sign in with your password", nil
+	}
+	if user.DeactivatedAt != nil {
+		return uuid.Nil, "Your account was deactivated", nil
+	}
+
+	member, err := cfg.db.GetOrganizationMember(user.ID)
+	if err != nil {
+		return uuid.Nil, "", err
+	}
+	switch {
+	case member.OrganizationID == uuid.Nil:
+		// removed by an owner since, the IdP still says they belong
+		err = cfg.db.AddOrganizationMember(orgID, user.ID, role)
+	case member.OrganizationID != orgID:
+		return uuid.Nil, "Your account belongs to another organization", nil
+	case config.RoleAttribute != "" && member.Role != role:
+		err = cfg.db.SetOrganizationMemberRole(orgID, user.ID, role)
+	}
+	if err != nil {
+		return uuid.Nil, "", err
+	}
+	return user.ID, "", nil
+}
+
+func renderSAMLLogin(w http.ResponseWriter, code int, page samlLoginPage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	err := samlLoginTemplate.Execute(w, page)
+	if err != nil {
+		log.Printf("Couldn't render SAML login page: %v", err)
+	}
+}
+
+func (cfg *apiConfig) handlerOrganizationSAMLGet(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	org, ok := cfg.getOwnedOrganization(w, userID)
+	if !ok {
+		return
+	}
+	config, err := cfg.db.GetSAMLConfig(org.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get single sign-on settings", err)
+		return
+	}
+	if config.OrganizationID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Single sign-on isn't set up", nil)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.samlConfigResponse(config))
+}
+
+// handlerOrganizationSAMLUpdate sets up single sign-on with the
+// organization's IdP, or changes it.
+func (cfg *apiConfig) handlerOrganizationSAMLUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		IDPEntityID    string   `json:"idp_entity_id"`
+		IDPSSOURL      string   `json:"idp_sso_url"`
+		IDPCertificate string   `json:"idp_certificate"`
+		EmailAttribute string   `json:"email_attribute"`
+		RoleAttribute  string   `json:"role_attribute"`
+		OwnerValues    []string `json:"owner_values"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	org, ok := cfg.getOwnedOrganization(w, userID)
+	if !ok {
+		return
+	}
+
+	params.IDPEntityID = strings.TrimSpace(params.IDPEntityID)
+	if params.IDPEntityID == "" {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "IdP entity ID is required", nil)
+		return
+	}
+	ssoURL, err := url.Parse(strings.TrimSpace(params.IDPSSOURL))
+	if err != nil || (ssoURL.Scheme != "https" && ssoURL.Scheme != "http") || ssoURL.Host == "" {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "IdP SSO URL must be an absolute http(s) URL", err)
+		return
+	}
+	cert, err := saml.ParseCertificate(params.IDPCertificate)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "IdP certificate must be a PEM or base64 encoded X.509 certificate", err)
+		return
+	}
+	ownerValues := []string{}
+	for _, value := range params.OwnerValues {
+		value = strings.TrimSpace(value)
+		if value == "" || strings.Contains(value, ",") {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Owner values can't be empty or contain commas", nil)
+			return
+		}
+		ownerValues = append(ownerValues, value)
+	}
+	params.RoleAttribute = strings.TrimSpace(params.RoleAttribute)
+	if len(ownerValues) > 0 && params.RoleAttribute == "" {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Owner values need a role attribute", nil)
+		return
+	}
+
+	config, err := cfg.db.SetSAMLConfig(database.SAMLConfig{
+		OrganizationID: org.ID,
+		IDPEntityID:    params.IDPEntityID,
+		IDPSSOURL:      ssoURL.String(),
+		IDPCertificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		EmailAttribute: strings.TrimSpace(params.EmailAttribute),
+		RoleAttribute:  params.RoleAttribute,
+		OwnerValues:    ownerValues,
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save single sign-on settings", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.samlConfigResponse(config))
+}
+
+// handlerOrganizationSAMLDelete turns single sign-on off. Members keep their
+// accounts and membership.
+func (cfg *apiConfig) handlerOrganizationSAMLDelete(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	org, ok := cfg.getOwnedOrganization(w, userID)
+	if !ok {
+		return
+	}
+	deleted, err := cfg.db.DeleteSAMLConfig(org.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't delete single sign-on settings", err)
+		return
+	}
+	if !deleted {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Single sign-on isn't set up", nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (cfg *apiConfig) samlConfigResponse(config database.SAMLConfig) samlConfigResponse {
+	return samlConfigResponse{
+		SAMLConfig:  config,
+		SPEntityID:  cfg.samlURL(config.OrganizationID, "metadata"),
+		ACSURL:      cfg.samlURL(config.OrganizationID, "acs"),
+		MetadataURL: cfg.samlURL(config.OrganizationID, "metadata"),
+		LoginURL:    cfg.samlURL(config.OrganizationID, "login"),
+	}
+}
+
+// cleanUpSAMLRequests forgets sign ins that were never completed.
+func (cfg *apiConfig) cleanUpSAMLRequests(ctx context.Context) error {
+	removed, err := cfg.db.DeleteSAMLRequestsExpiredBefore(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if removed > 0 {
+		log.Printf("Removed %d expired SAML requests", removed)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// whoever holds this lease runs the jobs that must only run once across
+	// all instances
+	schedulerLeaderKey = "scheduler:leader"
+	// the database waits up to 5s for SQLite locks, so allow for that when
+	// leadership goes through it
+	schedulerLockTimeout = 6 * time.Second
+)
+
+// runPeriodically calls fn every interval until ctx is cancelled. Errors are
+// logged and the next run happens as scheduled.
+func runPeriodically(ctx context.Context, name string, interval time.Duration, fn func(ctx context.Context) error) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			if err := fn(ctx); err != nil {
+				log.Printf("Scheduled job %s failed: %v", name, err)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+type scheduledJob struct {
+	name     string
+	interval time.Duration
+	fn       func(ctx context.Context) error
+}
+
+// scheduler runs periodic jobs. Jobs registered with every run on the one
+// instance elected leader through locker, so cleanups and aggregations
+// aren't repeated by every instance. Jobs that look after state kept in the
+// process or on local disk are registered with everyInstance instead.
+type scheduler struct {
+	locker locker
+	// how long leadership lasts without being extended, leaseTTL when zero
+	ttl          time.Duration
+	leaderJobs   []scheduledJob
+	instanceJobs []scheduledJob
+}
+
+func (s *scheduler) every(name string, interval time.Duration, fn func(ctx context.Context) error) {
+	s.leaderJobs = append(s.leaderJobs, scheduledJob{name: name, interval: interval, fn: fn})
+}
+
+func (s *scheduler) everyInstance(name string, interval time.Duration, fn func(ctx context.Context) error) {
+	s.instanceJobs = append(s.instanceJobs, scheduledJob{name: name, interval: interval, fn: fn})
+}
+
+// start runs the instance jobs right away and the leader jobs whenever this
+// instance is the leader, until ctx is cancelled.
+func (s *scheduler) start(ctx context.Context) {
+	for _, job := range s.instanceJobs {
+		runPeriodically(ctx, job.name, job.interval, job.fn)
+	}
+	go s.lead(ctx)
+}
+
+// lead keeps trying to become the leader, and once it is, keeps extending
+// the lease. Leadership is given up when the lease is lost, or when it
+// couldn't be extended for half as long as it lasts, before it runs out
+// and another instance takes over.
+func (s *scheduler) lead(ctx context.Context) {
+	ttl := s.ttl
+	if ttl == 0 {
+		ttl = leaseTTL
+	}
+	token := uuid.NewString()
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+
+	var stopJobs context.CancelFunc
+	var extendedAt time.Time
+	stepDown := func() {
+		stopJobs()
+		stopJobs = nil
+	}
+
+	for {
+		lockCtx, cancel := context.WithTimeout(ctx, schedulerLockTimeout)
+		if stopJobs == nil {
+			ok, err := s.locker.tryLock(lockCtx, schedulerLeaderKey, token, ttl)
+			if err != nil {
+				log.Printf("Couldn't take scheduler leadership: %v", err)
+			} else if ok {
+				log.Printf("Elected scheduler leader, running %d jobs", len(s.leaderJobs))
+				extendedAt = time.Now()
+				var jobsCtx context.Context
+				jobsCtx, stopJobs = context.WithCancel(ctx)
+				for _, job := range s.leaderJobs {
+					runPeriodically(jobsCtx, job.name, job.interval, job.fn)
+				}
+			}
+		} else {
+			held, err := s.locker.extend(lockCtx, schedulerLeaderKey, token, ttl)
+			switch {
+			case err == nil && held:
+				extendedAt = time.Now()
+			case err == nil:
+				log.Printf("Lost scheduler leadership")
+				stepDown()
+			case time.Since(extendedAt) > ttl/2:
+				log.Printf("Giving up scheduler leadership, couldn't extend it: %v", err)
+				stepDown()
+			default:
+				log.Printf("Couldn't extend scheduler leadership: %v", err)
+			}
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			if stopJobs != nil {
+				stepDown()
+				unlockCtx, cancel := context.WithTimeout(context.Background(), schedulerLockTimeout)
+				if err := s.locker.unlock(unlockCtx, schedulerLeaderKey, token); err != nil {
+					log.Printf("Couldn't release scheduler leadership: %v", err)
+				}
+				cancel()
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
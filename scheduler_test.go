@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyLocker is a memoryLocker whose extends can be made to fail, like a
+// lock store that became unreachable.
+type flakyLocker struct {
+	*memoryLocker
+	mu         sync.Mutex
+	failExtend bool
+}
+
+func (l *flakyLocker) setFailExtend(fail bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.failExtend = fail
+}
+
+func (l *flakyLocker) extend(ctx context.Context, key, token string, ttl time.Duration) (bool, error) {
+	l.mu.Lock()
+	fail := l.failExtend
+	l.mu.Unlock()
+	if fail {
+		return false, errors.New("lock store unreachable")
+	}
+	return l.memoryLocker.extend(ctx, key, token, ttl)
+}
+
+// runningJob counts how many schedulers are running it right now.
+type runningJob struct {
+	running atomic.Int32
+	ran     atomic.Int32
+}
+
+func (j *runningJob) fn(ctx context.Context) error {
+	j.ran.Add(1)
+	j.running.Add(1)
+	go func() {
+		<-ctx.Done()
+		j.running.Add(-1)
+	}()
+	return nil
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSchedulerRunsLeaderJobsOnce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	locker := newMemoryLocker()
+	var leaderRuns, instanceRuns atomic.Int32
+	for range 3 {
+		s := &scheduler{locker: locker, ttl: 60 * time.Millisecond}
+		s.every("leader", time.Hour, func(ctx context.Context) error {
+			leaderRuns.Add(1)
+			return nil
+		})
+		s.everyInstance("instance", time.Hour, func(ctx context.Context) error {
+			instanceRuns.Add(1)
+			return nil
+		})
+		s.start(ctx)
+	}
+
+	waitFor(t, "instance jobs", func() bool { return instanceRuns.Load() == 3 })
+	time.Sleep(100 * time.Millisecond)
+	if n := leaderRuns.Load(); n != 1 {
+		t.Errorf("leader job ran %d times, want 1", n)
+	}
+}
+
+func TestSchedulerStepsDownAndAnotherTakesOver(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	const ttl = 60 * time.Millisecond
+	locker := &flakyLocker{memoryLocker: newMemoryLocker()}
+	var first, second runningJob
+
+	aCtx, stopA := context.WithCancel(ctx)
+	defer stopA()
+	a := &scheduler{locker: locker, ttl: ttl}
+	a.every("job", time.Hour, first.fn)
+	a.start(aCtx)
+	waitFor(t, "first leader", func() bool { return first.running.Load() == 1 })
+
+	// the second instance only starts once the first leads, so it has to
+	// wait for the lease
+	b := &scheduler{locker: locker, ttl: ttl}
+	b.every("job", time.Hour, second.fn)
+	b.start(ctx)
+	time.Sleep(2 * ttl)
+	if second.ran.Load() != 0 {
+		t.Fatal("second instance ran the job while the first held the lease")
+	}
+
+	// the first can't extend anymore, so it has to stop its jobs before the
+	// lease runs out. It's shut down then without releasing the lease, so
+	// the second only takes over once the lease expired.
+	locker.setFailExtend(true)
+	waitFor(t, "first to step down", func() bool { return first.running.Load() == 0 })
+	stopA()
+	locker.setFailExtend(false)
+	waitFor(t, "second to take over", func() bool { return second.running.Load() == 1 })
+	if first.running.Load() != 0 {
+		t.Error("both instances are running the job")
+	}
+}
+
+func TestSchedulerStepsDownWhenLeaseIsLost(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	locker := newMemoryLocker()
+	var job runningJob
+	s := &scheduler{locker: locker, ttl: 60 * time.Millisecond}
+	s.every("job", time.Hour, job.fn)
+	s.start(ctx)
+	waitFor(t, "leader", func() bool { return job.running.Load() == 1 })
+
+	// someone else holds the lease now
+	locker.mu.Lock()
+	locker.leases[schedulerLeaderKey] = memoryLease{token: "other", expires: time.Now().Add(time.Hour)}
+	locker.mu.Unlock()
+
+	waitFor(t, "step down", func() bool { return job.running.Load() == 0 })
+}
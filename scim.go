@@ -0,0 +1,1209 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// SCIM 2.0 (RFC 7643 and 7644) lets an organization's IdP create, update and
+// deactivate its members' accounts, and push groups that decide who's an
+// owner. Only what IdPs use is supported: no bulk operations, sorting or
+// filters beyond equality on one attribute.
+
+const (
+	scimSchemaUser         = "urn:ietf:params:scim:schemas:core:2.0:User"
+	scimSchemaGroup        = "urn:ietf:params:scim:schemas:core:2.0:Group"
+	scimSchemaListResponse = "urn:ietf:params:scim:api:messages:2.0:ListResponse"
+	scimSchemaError        = "urn:ietf:params:scim:api:messages:2.0:Error"
+	scimSchemaSPConfig     = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+
+	scimDefaultPageSize = 100
+	scimMaxPageSize     = 200
+)
+
+var (
+	scimFilterPattern     = regexp.MustCompile(`(?i)^\s*([a-z.]+)\s+eq\s+("(?:[^"\\]|\\.)*")\s*$`)
+	scimMemberPathPattern = regexp.MustCompile(`(?i)^members\[value eq "([^"]+)"\]$`)
+)
+
+type scimMeta struct {
+	ResourceType string    `json:"resourceType"`
+	Created      time.Time `json:"created"`
+	LastModified time.Time `json:"lastModified"`
+	Location     string    `json:"location"`
+}
+
+type scimEmail struct {
+	Value   string `json:"value"`
+	Primary bool   `json:"primary"`
+}
+
+type scimUser struct {
+	Schemas    []string    `json:"schemas"`
+	ID         string      `json:"id"`
+	ExternalID string      `json:"externalId,omitempty"`
+	UserName   string      `json:"userName"`
+	Active     bool        `json:"active"`
+	Emails     []scimEmail `json:"emails"`
+	Meta       scimMeta    `json:"meta"`
+}
+
+type scimMember struct {
+	Value   string `json:"value"`
+	Display string `json:"display,omitempty"`
+}
+
+type scimGroup struct {
+	Schemas     []string     `json:"schemas"`
+	ID          string       `json:"id"`
+	ExternalID  string       `json:"externalId,omitempty"`
+	DisplayName string       `json:"displayName"`
+	Members     []scimMember `json:"members"`
+	Meta        scimMeta     `json:"meta"`
+}
+
+type scimListResponse struct {
+	Schemas      []string `json:"schemas"`
+	TotalResults int      `json:"totalResults"`
+	StartIndex   int      `json:"startIndex"`
+	ItemsPerPage int      `json:"itemsPerPage"`
+	Resources    any      `json:"Resources"`
+}
+
+type scimPatchRequest struct {
+	Operations []scimPatchOperation `json:"Operations"`
+}
+
+type scimPatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+// scimUserParams is a User as IdPs send it. Attributes we don't keep, like
+// names, are ignored.
+type scimUserParams struct {
+	UserName   string      `json:"userName"`
+	ExternalID string      `json:"externalId"`
+	Active     *bool       `json:"active"`
+	Emails     []scimEmail `json:"emails"`
+}
+
+type scimGroupParams struct {
+	DisplayName string       `json:"displayName"`
+	ExternalID  string       `json:"externalId"`
+	Members     []scimMember `json:"members"`
+}
+
+func respondWithSCIM(w http.ResponseWriter, status int, payload any) {
+	w.Header().Set("Content-Type", "application/scim+json")
+	dat, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error marshalling JSON: %s", err)
+		w.WriteHeader(500)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(dat)
+}
+
+// respondWithSCIMError responds in the error format SCIM clients expect
+// instead of errorResponse. scimType is only set for the 400 and 409
+// errors that have one.
+func respondWithSCIMError(w http.ResponseWriter, status int, scimType, detail string, err error) {
+	type response struct {
+		Schemas  []string `json:"schemas"`
+		Status   string   `json:"status"`
+		ScimType string   `json:"scimType,omitempty"`
+		Detail   string   `json:"detail"`
+	}
+
+	requestID := w.Header().Get(requestIDHeader)
+	if err != nil {
+		log.Printf("[%s] %v", requestID, err)
+	}
+	if status > 499 {
+		log.Printf("[%s] Responding with 5XX error: %s", requestID, detail)
+	}
+	respondWithSCIM(w, status, response{
+		Schemas:  []string{scimSchemaError},
+		Status:   strconv.Itoa(status),
+		ScimType: scimType,
+		Detail:   detail,
+	})
+}
+
+func hashSCIMToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+func (cfg *apiConfig) scimBaseURL() string {
+	return cfg.appBaseURL + "/scim/v2"
+}
+
+// scimOrganization authenticates the IdP by the organization's SCIM token.
+func (cfg *apiConfig) scimOrganization(w http.ResponseWriter, r *http.Request) (database.SCIMConfig, bool) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusUnauthorized, "", "Couldn't find token", err)
+		return database.SCIMConfig{}, false
+	}
+	config, err := cfg.db.GetSCIMConfigByTokenHash(hashSCIMToken(token))
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't check token", err)
+		return database.SCIMConfig{}, false
+	}
+	if config.OrganizationID == uuid.Nil {
+		respondWithSCIMError(w, http.StatusUnauthorized, "", "Invalid token", nil)
+		return database.SCIMConfig{}, false
+	}
+	return config, true
+}
+
+func (cfg *apiConfig) scimUserResource(user database.ManagedUser) scimUser {
+	return scimUser{
+		Schemas:    []string{scimSchemaUser},
+		ID:         user.ID.String(),
+		ExternalID: user.ExternalID,
+		UserName:   user.Email,
+		Active:     user.DeactivatedAt == nil,
+		Emails:     []scimEmail{{Value: user.Email, Primary: true}},
+		Meta: scimMeta{
+			ResourceType: "User",
+			Created:      user.CreatedAt,
+			LastModified: user.UpdatedAt,
+			Location:     cfg.scimBaseURL() + "/Users/" + user.ID.String(),
+		},
+	}
+}
+
+func (cfg *apiConfig) scimGroupResource(group database.SCIMGroup) scimGroup {
+	members := make([]scimMember, 0, len(group.Members))
+	for _, member := range group.Members {
+		members = append(members, scimMember{Value: member.UserID.String(), Display: member.Email})
+	}
+	return scimGroup{
+		Schemas:     []string{scimSchemaGroup},
+		ID:          group.ID.String(),
+		ExternalID:  group.ExternalID,
+		DisplayName: group.DisplayName,
+		Members:     members,
+		Meta: scimMeta{
+			ResourceType: "Group",
+			Created:      group.CreatedAt,
+			LastModified: group.UpdatedAt,
+			Location:     cfg.scimBaseURL() + "/Groups/" + group.ID.String(),
+		},
+	}
+}
+
+// parseSCIMListQuery reads the filter and page of a list request. nameAttr
+// is the attribute that filters on SCIMFilter.Name.
+func parseSCIMListQuery(r *http.Request, nameAttr string) (database.SCIMFilter, int, int, error) {
+	filter := database.SCIMFilter{}
+	if expr := r.URL.Query().Get("filter"); expr != "" {
+		match := scimFilterPattern.FindStringSubmatch(expr)
+		if match == nil {
+			return filter, 0, 0, errors.New("only equality filters on a single attribute are supported")
+		}
+		var value string
+		if err := json.Unmarshal([]byte(match[2]), &value); err != nil {
+			return filter, 0, 0, errors.New("invalid filter value")
+		}
+		switch {
+		case strings.EqualFold(match[1], nameAttr):
+			filter.Name = value
+		case strings.EqualFold(match[1], "externalId"):
+			filter.ExternalID = value
+		default:
+			return filter, 0, 0, errors.New("can't filter on " + match[1])
+		}
+	}
+
+	startIndex := 1
+	if s := r.URL.Query().Get("startIndex"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return filter, 0, 0, errors.New("invalid startIndex")
+		}
+		startIndex = max(n, 1)
+	}
+	count := scimDefaultPageSize
+	if s := r.URL.Query().Get("count"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil {
+			return filter, 0, 0, errors.New("invalid count")
+		}
+		count = min(max(n, 0), scimMaxPageSize)
+	}
+	return filter, startIndex, count, nil
+}
+
+// scimUserEmail is the email of a User: its userName when that's an email,
+// its primary email otherwise.
+func scimUserEmail(params scimUserParams) string {
+	if strings.Contains(params.UserName, "@") {
+		return strings.TrimSpace(params.UserName)
+	}
+	for _, email := range params.Emails {
+		if email.Primary {
+			return strings.TrimSpace(email.Value)
+		}
+	}
+	if len(params.Emails) > 0 {
+		return strings.TrimSpace(params.Emails[0].Value)
+	}
+	return ""
+}
+
+// parseSCIMBool reads a boolean that some IdPs send as a string.
+func parseSCIMBool(raw json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(raw, &b); err == nil {
+		return b, nil
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return false, err
+	}
+	return strconv.ParseBool(strings.ToLower(s))
+}
+
+func (cfg *apiConfig) handlerSCIMServiceProviderConfig(w http.ResponseWriter, r *http.Request) {
+	type supported struct {
+		Supported bool `json:"supported"`
+	}
+	type filter struct {
+		Supported  bool `json:"supported"`
+		MaxResults int  `json:"maxResults"`
+	}
+	type bulk struct {
+		Supported      bool `json:"supported"`
+		MaxOperations  int  `json:"maxOperations"`
+		MaxPayloadSize int  `json:"maxPayloadSize"`
+	}
+	type authenticationScheme struct {
+		Type        string `json:"type"`
+		Name        string `json:"name"`
+		Description string `json:"description"`
+	}
+	type response struct {
+		Schemas               []string               `json:"schemas"`
+		Patch                 supported              `json:"patch"`
+		Bulk                  bulk                   `json:"bulk"`
+		Filter                filter                 `json:"filter"`
+		ChangePassword        supported              `json:"changePassword"`
+		Sort                  supported              `json:"sort"`
+		ETag                  supported              `json:"etag"`
+		AuthenticationSchemes []authenticationScheme `json:"authenticationSchemes"`
+	}
+
+	if _, ok := cfg.scimOrganization(w, r); !ok {
+		return
+	}
+
+	respondWithSCIM(w, http.StatusOK, response{
+		Schemas: []string{scimSchemaSPConfig},
+		Patch:   supported{Supported: true},
+		Filter:  filter{Supported: true, MaxResults: scimMaxPageSize},
+		AuthenticationSchemes: []authenticationScheme{{
+			Type:        "oauthbearertoken",
+			Name:        "Bearer token",
+			Description: "The organization's SCIM token",
+		}},
+	})
+}
+
+func (cfg *apiConfig) handlerSCIMUsersList(w http.ResponseWriter, r *http.Request) {
+	config, ok := cfg.scimOrganization(w, r)
+	if !ok {
+		return
+	}
+	filter, startIndex, count, err := parseSCIMListQuery(r, "userName")
+	if err != nil {
+		respondWithSCIMError(w, http.StatusBadRequest, "invalidFilter", err.Error(), nil)
+		return
+	}
+
+	users, total, err := cfg.db.GetManagedUsers(config.OrganizationID, filter, startIndex-1, count)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't get users", err)
+		return
+	}
+	resources := make([]scimUser, 0, len(users))
+	for _, user := range users {
+		resources = append(resources, cfg.scimUserResource(user))
+	}
+
+	respondWithSCIM(w, http.StatusOK, scimListResponse{
+		Schemas:      []string{scimSchemaListResponse},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	})
+}
+
+// handlerSCIMUserCreate provisions a member. Provisioning a deactivated
+// member again brings them back.
+func (cfg *apiConfig) handlerSCIMUserCreate(w http.ResponseWriter, r *http.Request) {
+	config, ok := cfg.scimOrganization(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := scimUserParams{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusBadRequest, "invalidSyntax", "Couldn't decode user", err)
+		return
+	}
+	email := scimUserEmail(params)
+	if !strings.Contains(email, "@") {
+		respondWithSCIMError(w, http.StatusBadRequest, "invalidValue", "userName or emails must hold an email address", nil)
+		return
+	}
+	active := params.Active == nil || *params.Active
+
+	existing, err := cfg.db.GetUserByEmail(email)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't get user", err)
+		return
+	}
+	if existing.ID != uuid.Nil {
+		managed, err := cfg.db.GetManagedUser(config.OrganizationID, existing.ID)
+		if err != nil {
+			respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't get user", err)
+			return
+		}
+		if managed.ID == uuid.Nil || managed.DeactivatedAt == nil {
+			respondWithSCIMError(w, http.StatusConflict, "uniqueness", "A user with this userName already exists", nil)
+			return
+		}
+		user, ok := cfg.updateSCIMUser(w, config, managed, email, params.ExternalID, active)
+		if !ok {
+			return
+		}
+		respondWithSCIM(w, http.StatusCreated, cfg.scimUserResource(user))
+		return
+	}
+
+	password := make([]byte, 32)
+	_, err = rand.Read(password)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't create password", err)
+		return
+	}
+	hash, err := auth.HashPassword(hex.EncodeToString(password))
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't hash password", err)
+		return
+	}
+	created, err := cfg.db.CreateSSOUser(database.CreateSSOUserParams{
+		Email:          email,
+		Password:       hash,
+		OrganizationID: config.OrganizationID,
+		Role:           database.OrganizationRoleMember,
+		ExternalID:     params.ExternalID,
+	})
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't create user", err)
+		return
+	}
+	if !active {
+		err = cfg.db.DeactivateUser(created.ID)
+		if err != nil {
+			respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't deactivate user", err)
+			return
+		}
+	}
+
+	user, err := cfg.db.GetManagedUser(config.OrganizationID, created.ID)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't get user", err)
+		return
+	}
+	respondWithSCIM(w, http.StatusCreated, cfg.scimUserResource(user))
+}
+
+func (cfg *apiConfig) handlerSCIMUserGet(w http.ResponseWriter, r *http.Request) {
+	config, ok := cfg.scimOrganization(w, r)
+	if !ok {
+		return
+	}
+	user, ok := cfg.scimUserFromRequest(w, r, config)
+	if !ok {
+		return
+	}
+
+	respondWithSCIM(w, http.StatusOK, cfg.scimUserResource(user))
+}
+
+func (cfg *apiConfig) handlerSCIMUserReplace(w http.ResponseWriter, r *http.Request) {
+	config, ok := cfg.scimOrganization(w, r)
+	if !ok {
+		return
+	}
+	user, ok := cfg.scimUserFromRequest(w, r, config)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := scimUserParams{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusBadRequest, "invalidSyntax", "Couldn't decode user", err)
+		return
+	}
+	email := scimUserEmail(params)
+	if !strings.Contains(email, "@") {
+		respondWithSCIMError(w, http.StatusBadRequest, "invalidValue", "userName or emails must hold an email address", nil)
+		return
+	}
+
+	user, ok = cfg.updateSCIMUser(w, config, user, email, params.ExternalID, params.Active == nil || *params.Active)
+	if !ok {
+		return
+	}
+	respondWithSCIM(w, http.StatusOK, cfg.scimUserResource(user))
+}
+
+// handlerSCIMUserPatch applies the changes IdPs make with PATCH, mostly
+// setting active to deactivate and reactivate users.
+func (cfg *apiConfig) handlerSCIMUserPatch(w http.ResponseWriter, r *http.Request) {
+	config, ok := cfg.scimOrganization(w, r)
+	if !ok {
+		return
+	}
+	user, ok := cfg.scimUserFromRequest(w, r, config)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := scimPatchRequest{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusBadRequest, "invalidSyntax", "Couldn't decode patch", err)
+		return
+	}
+
+	email, externalID, active := user.Email, user.ExternalID, user.DeactivatedAt == nil
+	apply := func(path string, value json.RawMessage) error {
+		var err error
+		switch strings.ToLower(path) {
+		case "active":
+			active, err = parseSCIMBool(value)
+		case "username":
+			err = json.Unmarshal(value, &email)
+		case "externalid":
+			err = json.Unmarshal(value, &externalID)
+		case `emails[type eq "work"].value`, "emails[primary eq true].value":
+			err = json.Unmarshal(value, &email)
+		}
+		return err
+	}
+	for _, op := range params.Operations {
+		switch strings.ToLower(op.Op) {
+		case "add", "replace":
+			if op.Path != "" {
+				err = apply(op.Path, op.Value)
+				break
+			}
+			values := map[string]json.RawMessage{}
+			err = json.Unmarshal(op.Value, &values)
+			for path, value := range values {
+				if err == nil {
+					err = apply(path, value)
+				}
+			}
+		case "remove":
+			if !strings.EqualFold(op.Path, "externalId") {
+				respondWithSCIMError(w, http.StatusBadRequest, "mutability", "Only externalId can be removed", nil)
+				return
+			}
+			externalID = ""
+		default:
+			respondWithSCIMError(w, http.StatusBadRequest, "invalidSyntax", "Unknown operation "+op.Op, nil)
+			return
+		}
+		if err != nil {
+			respondWithSCIMError(w, http.StatusBadRequest, "invalidValue", "Invalid value for "+op.Path, err)
+			return
+		}
+	}
+	email = strings.TrimSpace(email)
+	if !strings.Contains(email, "@") {
+		respondWithSCIMError(w, http.StatusBadRequest, "invalidValue", "userName must be an email address", nil)
+		return
+	}
+
+	user, ok = cfg.updateSCIMUser(w, config, user, email, externalID, active)
+	if !ok {
+		return
+	}
+	respondWithSCIM(w, http.StatusOK, cfg.scimUserResource(user))
+}
+
+// handlerSCIMUserDelete deprovisions a user. Their account is only
+// deactivated; their videos stay with them unless the organization named a
+// successor to take them over.
+func (cfg *apiConfig) handlerSCIMUserDelete(w http.ResponseWriter, r *http.Request) {
+	config, ok := cfg.scimOrganization(w, r)
+	if !ok {
+		return
+	}
+	user, ok := cfg.scimUserFromRequest(w, r, config)
+	if !ok {
+		return
+	}
+
+	err := cfg.db.DeactivateUser(user.ID)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't deactivate user", err)
+		return
+	}
+	err = cfg.db.RemoveUserFromSCIMGroups(user.ID)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't remove user from groups", err)
+		return
+	}
+	err = cfg.db.SyncSCIMRoles(config.OrganizationID, config.OwnerGroups)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't update roles", err)
+		return
+	}
+
+	if config.VideoSuccessorID != nil && *config.VideoSuccessorID != user.ID {
+		successorOK, err := cfg.isActiveMember(config.OrganizationID, *config.VideoSuccessorID)
+		if err != nil {
+			respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't get successor", err)
+			return
+		}
+		if successorOK {
+			moved, err := cfg.db.ReassignVideos(user.ID, *config.VideoSuccessorID)
+			if err != nil {
+				respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't reassign videos", err)
+				return
+			}
+			log.Printf("Reassigned %d videos of deprovisioned user %s to %s", moved, user.ID, *config.VideoSuccessorID)
+		} else {
+			log.Printf("Video successor %s of organization %s left it, user %s keeps their videos", *config.VideoSuccessorID, config.OrganizationID, user.ID)
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// updateSCIMUser brings a user's email, external ID and active state in
+// line with the IdP. It responds with an error and returns false when it
+// can't.
+func (cfg *apiConfig) updateSCIMUser(w http.ResponseWriter, config database.SCIMConfig, user database.ManagedUser, email, externalID string, active bool) (database.ManagedUser, bool) {
+	if email != user.Email {
+		existing, err := cfg.db.GetUserByEmail(email)
+		if err != nil {
+			respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't get user", err)
+			return database.ManagedUser{}, false
+		}
+		if existing.ID != uuid.Nil {
+			respondWithSCIMError(w, http.StatusConflict, "uniqueness", "A user with this userName already exists", nil)
+			return database.ManagedUser{}, false
+		}
+	}
+	if email != user.Email || externalID != user.ExternalID {
+		err := cfg.db.UpdateManagedUser(user.ID, email, externalID)
+		if err != nil {
+			respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't update user", err)
+			return database.ManagedUser{}, false
+		}
+	}
+
+	var err error
+	switch {
+	case active && user.DeactivatedAt != nil:
+		err = cfg.db.ReactivateUser(user.ID)
+		if err == nil {
+			err = cfg.rejoinOrganization(config.OrganizationID, user.ID)
+		}
+	case !active && user.DeactivatedAt == nil:
+		err = cfg.db.DeactivateUser(user.ID)
+	}
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't change whether the user is active", err)
+		return database.ManagedUser{}, false
+	}
+
+	updated, err := cfg.db.GetManagedUser(config.OrganizationID, user.ID)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't get user", err)
+		return database.ManagedUser{}, false
+	}
+	return updated, true
+}
+
+// rejoinOrganization adds a reactivated user back to the organization if an
+// owner removed them meanwhile.
+func (cfg *apiConfig) rejoinOrganization(orgID, userID uuid.UUID) error {
+	member, err := cfg.db.GetOrganizationMember(userID)
+	if err != nil || member.OrganizationID != uuid.Nil {
+		return err
+	}
+	return cfg.db.AddOrganizationMember(orgID, userID, database.OrganizationRoleMember)
+}
+
+func (cfg *apiConfig) isActiveMember(orgID, userID uuid.UUID) (bool, error) {
+	member, err := cfg.db.GetOrganizationMember(userID)
+	if err != nil || member.OrganizationID != orgID {
+		return false, err
+	}
+	deactivated, err := cfg.db.IsUserDeactivated(userID)
+	return !deactivated, err
+}
+
+// scimUserFromRequest looks up the user in the path among the
+// organization's provisioned users, responding with an error and returning
+// false when it isn't one.
+func (cfg *apiConfig) scimUserFromRequest(w http.ResponseWriter, r *http.Request, config database.SCIMConfig) (database.ManagedUser, bool) {
+	userID, err := uuid.Parse(r.PathValue("userID"))
+	if err != nil {
+		respondWithSCIMError(w, http.StatusNotFound, "", "User not found", nil)
+		return database.ManagedUser{}, false
+	}
+	user, err := cfg.db.GetManagedUser(config.OrganizationID, userID)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't get user", err)
+		return database.ManagedUser{}, false
+	}
+	if user.ID == uuid.Nil {
+		respondWithSCIMError(w, http.StatusNotFound, "", "User not found", nil)
+		return database.ManagedUser{}, false
+	}
+	return user, true
+}
+
+func (cfg *apiConfig) handlerSCIMGroupsList(w http.ResponseWriter, r *http.Request) {
+	config, ok := cfg.scimOrganization(w, r)
+	if !ok {
+		return
+	}
+	filter, startIndex, count, err := parseSCIMListQuery(r, "displayName")
+	if err != nil {
+		respondWithSCIMError(w, http.StatusBadRequest, "invalidFilter", err.Error(), nil)
+		return
+	}
+
+	groups, total, err := cfg.db.GetSCIMGroups(config.OrganizationID, filter, startIndex-1, count)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't get groups", err)
+		return
+	}
+	resources := make([]scimGroup, 0, len(groups))
+	for _, group := range groups {
+		resources = append(resources, cfg.scimGroupResource(group))
+	}
+
+	respondWithSCIM(w, http.StatusOK, scimListResponse{
+		Schemas:      []string{scimSchemaListResponse},
+		TotalResults: total,
+		StartIndex:   startIndex,
+		ItemsPerPage: len(resources),
+		Resources:    resources,
+	})
+}
+
+func (cfg *apiConfig) handlerSCIMGroupCreate(w http.ResponseWriter, r *http.Request) {
+	config, ok := cfg.scimOrganization(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := scimGroupParams{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusBadRequest, "invalidSyntax", "Couldn't decode group", err)
+		return
+	}
+	params.DisplayName = strings.TrimSpace(params.DisplayName)
+	if params.DisplayName == "" {
+		respondWithSCIMError(w, http.StatusBadRequest, "invalidValue", "displayName is required", nil)
+		return
+	}
+	memberIDs, ok := cfg.scimGroupMemberIDs(w, config, params.Members)
+	if !ok {
+		return
+	}
+
+	group, err := cfg.db.CreateSCIMGroup(config.OrganizationID, params.DisplayName, params.ExternalID, memberIDs)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't create group", err)
+		return
+	}
+	err = cfg.db.SyncSCIMRoles(config.OrganizationID, config.OwnerGroups)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't update roles", err)
+		return
+	}
+
+	respondWithSCIM(w, http.StatusCreated, cfg.scimGroupResource(group))
+}
+
+func (cfg *apiConfig) handlerSCIMGroupGet(w http.ResponseWriter, r *http.Request) {
+	config, ok := cfg.scimOrganization(w, r)
+	if !ok {
+		return
+	}
+	group, ok := cfg.scimGroupFromRequest(w, r, config)
+	if !ok {
+		return
+	}
+
+	respondWithSCIM(w, http.StatusOK, cfg.scimGroupResource(group))
+}
+
+func (cfg *apiConfig) handlerSCIMGroupReplace(w http.ResponseWriter, r *http.Request) {
+	config, ok := cfg.scimOrganization(w, r)
+	if !ok {
+		return
+	}
+	group, ok := cfg.scimGroupFromRequest(w, r, config)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := scimGroupParams{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusBadRequest, "invalidSyntax", "Couldn't decode group", err)
+		return
+	}
+	params.DisplayName = strings.TrimSpace(params.DisplayName)
+	if params.DisplayName == "" {
+		respondWithSCIMError(w, http.StatusBadRequest, "invalidValue", "displayName is required", nil)
+		return
+	}
+	memberIDs, ok := cfg.scimGroupMemberIDs(w, config, params.Members)
+	if !ok {
+		return
+	}
+
+	cfg.saveSCIMGroup(w, config, group.ID, params.DisplayName, params.ExternalID, memberIDs)
+}
+
+// handlerSCIMGroupPatch applies membership changes, which IdPs push as
+// PATCH operations on members.
+func (cfg *apiConfig) handlerSCIMGroupPatch(w http.ResponseWriter, r *http.Request) {
+	config, ok := cfg.scimOrganization(w, r)
+	if !ok {
+		return
+	}
+	group, ok := cfg.scimGroupFromRequest(w, r, config)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := scimPatchRequest{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusBadRequest, "invalidSyntax", "Couldn't decode patch", err)
+		return
+	}
+
+	displayName, externalID := group.DisplayName, group.ExternalID
+	memberIDs := []uuid.UUID{}
+	for _, member := range group.Members {
+		memberIDs = append(memberIDs, member.UserID)
+	}
+
+	for _, op := range params.Operations {
+		opName := strings.ToLower(op.Op)
+		path := strings.ToLower(op.Path)
+		if opName != "add" && opName != "replace" && opName != "remove" {
+			respondWithSCIMError(w, http.StatusBadRequest, "invalidSyntax", "Unknown operation "+op.Op, nil)
+			return
+		}
+
+		values := scimGroupParams{}
+		switch {
+		case path == "" && opName != "remove":
+			err = json.Unmarshal(op.Value, &values)
+		case path == "members" && len(op.Value) > 0:
+			err = json.Unmarshal(op.Value, &values.Members)
+		case path == "displayname" && opName != "remove":
+			err = json.Unmarshal(op.Value, &values.DisplayName)
+		case path == "externalid" && opName != "remove":
+			err = json.Unmarshal(op.Value, &values.ExternalID)
+		}
+		if err != nil {
+			respondWithSCIMError(w, http.StatusBadRequest, "invalidValue", "Invalid value for "+op.Path, err)
+			return
+		}
+		changedIDs, ok := cfg.scimGroupMemberIDs(w, config, values.Members)
+		if !ok {
+			return
+		}
+
+		switch {
+		case path == "" || path == "displayname" || path == "externalid":
+			if values.DisplayName != "" {
+				displayName = strings.TrimSpace(values.DisplayName)
+			}
+			if values.ExternalID != "" || path == "externalid" {
+				externalID = values.ExternalID
+			}
+			if path == "" && opName == "replace" && values.Members != nil {
+				memberIDs = changedIDs
+			} else if path == "" {
+				memberIDs = appendNew(memberIDs, changedIDs)
+			}
+		case path == "members":
+			switch opName {
+			case "add":
+				memberIDs = appendNew(memberIDs, changedIDs)
+			case "replace":
+				memberIDs = changedIDs
+			case "remove":
+				if len(op.Value) == 0 {
+					memberIDs = []uuid.UUID{}
+				} else {
+					memberIDs = slices.DeleteFunc(memberIDs, func(id uuid.UUID) bool { return slices.Contains(changedIDs, id) })
+				}
+			}
+		case opName == "remove" && scimMemberPathPattern.MatchString(op.Path):
+			removeID, err := uuid.Parse(scimMemberPathPattern.FindStringSubmatch(op.Path)[1])
+			if err == nil {
+				memberIDs = slices.DeleteFunc(memberIDs, func(id uuid.UUID) bool { return id == removeID })
+			}
+		default:
+			respondWithSCIMError(w, http.StatusBadRequest, "invalidPath", "Unsupported path "+op.Path, nil)
+			return
+		}
+	}
+
+	cfg.saveSCIMGroup(w, config, group.ID, displayName, externalID, memberIDs)
+}
+
+func (cfg *apiConfig) handlerSCIMGroupDelete(w http.ResponseWriter, r *http.Request) {
+	config, ok := cfg.scimOrganization(w, r)
+	if !ok {
+		return
+	}
+	group, ok := cfg.scimGroupFromRequest(w, r, config)
+	if !ok {
+		return
+	}
+
+	_, err := cfg.db.DeleteSCIMGroup(config.OrganizationID, group.ID)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't delete group", err)
+		return
+	}
+	err = cfg.db.SyncSCIMRoles(config.OrganizationID, config.OwnerGroups)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't update roles", err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// saveSCIMGroup stores a changed group, updates the roles that depend on it
+// and responds with it.
+func (cfg *apiConfig) saveSCIMGroup(w http.ResponseWriter, config database.SCIMConfig, groupID uuid.UUID, displayName, externalID string, memberIDs []uuid.UUID) {
+	err := cfg.db.UpdateSCIMGroup(groupID, displayName, externalID, memberIDs)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't update group", err)
+		return
+	}
+	err = cfg.db.SyncSCIMRoles(config.OrganizationID, config.OwnerGroups)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't update roles", err)
+		return
+	}
+	group, err := cfg.db.GetSCIMGroup(config.OrganizationID, groupID)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't get group", err)
+		return
+	}
+
+	respondWithSCIM(w, http.StatusOK, cfg.scimGroupResource(group))
+}
+
+// scimGroupMemberIDs checks group members are users the organization
+// provisioned. Groups can't make local accounts owners.
+func (cfg *apiConfig) scimGroupMemberIDs(w http.ResponseWriter, config database.SCIMConfig, members []scimMember) ([]uuid.UUID, bool) {
+	ids := []uuid.UUID{}
+	for _, member := range members {
+		id, err := uuid.Parse(member.Value)
+		if err != nil {
+			respondWithSCIMError(w, http.StatusBadRequest, "invalidValue", "Unknown member "+member.Value, nil)
+			return nil, false
+		}
+		user, err := cfg.db.GetManagedUser(config.OrganizationID, id)
+		if err != nil {
+			respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't get user", err)
+			return nil, false
+		}
+		if user.ID == uuid.Nil {
+			respondWithSCIMError(w, http.StatusBadRequest, "invalidValue", "Unknown member "+member.Value, nil)
+			return nil, false
+		}
+		ids = appendNew(ids, []uuid.UUID{id})
+	}
+	return ids, true
+}
+
+func (cfg *apiConfig) scimGroupFromRequest(w http.ResponseWriter, r *http.Request, config database.SCIMConfig) (database.SCIMGroup, bool) {
+	groupID, err := uuid.Parse(r.PathValue("groupID"))
+	if err != nil {
+		respondWithSCIMError(w, http.StatusNotFound, "", "Group not found", nil)
+		return database.SCIMGroup{}, false
+	}
+	group, err := cfg.db.GetSCIMGroup(config.OrganizationID, groupID)
+	if err != nil {
+		respondWithSCIMError(w, http.StatusInternalServerError, "", "Couldn't get group", err)
+		return database.SCIMGroup{}, false
+	}
+	if group.ID == uuid.Nil {
+		respondWithSCIMError(w, http.StatusNotFound, "", "Group not found", nil)
+		return database.SCIMGroup{}, false
+	}
+	return group, true
+}
+
+// appendNew appends the IDs that aren't in ids yet.
+func appendNew(ids, more []uuid.UUID) []uuid.UUID {
+	for _, id := range more {
+		if !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// deactivatedUserMiddleware refuses access tokens of deactivated users,
+// which stay valid until they expire otherwise.
+func (cfg *apiConfig) deactivatedUserMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := auth.GetBearerToken(r.Header)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		deactivated, err := cfg.db.IsUserDeactivated(userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't check account", err)
+			return
+		}
+		if deactivated {
+			respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Your account was deactivated", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handlerOrganizationSCIMToken creates the organization's SCIM token, or
+// replaces it. The token is only shown here.
+func (cfg *apiConfig) handlerOrganizationSCIMToken(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Token   string `json:"token"`
+		BaseURL string `json:"base_url"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	org, ok := cfg.getOwnedOrganization(w, userID)
+	if !ok {
+		return
+	}
+	scimToken, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create token", err)
+		return
+	}
+	err = cfg.db.SetSCIMToken(org.ID, hashSCIMToken(scimToken))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save token", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		Token:   scimToken,
+		BaseURL: cfg.scimBaseURL(),
+	})
+}
+
+func (cfg *apiConfig) handlerOrganizationSCIMGet(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	org, ok := cfg.getOwnedOrganization(w, userID)
+	if !ok {
+		return
+	}
+	config, err := cfg.db.GetSCIMConfig(org.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get provisioning settings", err)
+		return
+	}
+	if config.OrganizationID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Provisioning isn't set up", nil)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, config)
+}
+
+// handlerOrganizationSCIMUpdate sets which groups make owners and who takes
+// over the videos of deprovisioned users.
+func (cfg *apiConfig) handlerOrganizationSCIMUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		OwnerGroups      []string   `json:"owner_groups"`
+		VideoSuccessorID *uuid.UUID `json:"video_successor_id"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	org, ok := cfg.getOwnedOrganization(w, userID)
+	if !ok {
+		return
+	}
+	config, err := cfg.db.GetSCIMConfig(org.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get provisioning settings", err)
+		return
+	}
+	if config.OrganizationID == uuid.Nil {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Provisioning isn't set up", nil)
+		return
+	}
+
+	ownerGroups := []string{}
+	for _, group := range params.OwnerGroups {
+		group = strings.TrimSpace(group)
+		if group == "" || strings.Contains(group, ",") {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Owner groups can't be empty or contain commas", nil)
+			return
+		}
+		ownerGroups = append(ownerGroups, group)
+	}
+	if params.VideoSuccessorID != nil {
+		active, err := cfg.isActiveMember(org.ID, *params.VideoSuccessorID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get successor", err)
+			return
+		}
+		if !active {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "The video successor must be an active member of the organization", nil)
+			return
+		}
+	}
+
+	err = cfg.db.UpdateSCIMConfig(org.ID, ownerGroups, params.VideoSuccessorID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save provisioning settings", err)
+		return
+	}
+	err = cfg.db.SyncSCIMRoles(org.ID, ownerGroups)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update roles", err)
+		return
+	}
+	config, err = cfg.db.GetSCIMConfig(org.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get provisioning settings", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, config)
+}
+
+// handlerOrganizationSCIMDelete turns provisioning off and forgets the
+// groups. Provisioned users keep their accounts.
+func (cfg *apiConfig) handlerOrganizationSCIMDelete(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	org, ok := cfg.getOwnedOrganization(w, userID)
+	if !ok {
+		return
+	}
+	deleted, err := cfg.db.DeleteSCIMConfig(org.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't delete provisioning settings", err)
+		return
+	}
+	if !deleted {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Provisioning isn't set up", nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
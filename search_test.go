@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+// fakeSearchCluster answers bulk requests and searches like OpenSearch.
+// Searches return hits for the given IDs.
+type fakeSearchCluster struct {
+	mu      sync.Mutex
+	indexed map[string]searchDocument
+	deleted []string
+	query   map[string]any
+	hits    []string
+}
+
+func newFakeSearchCluster(t *testing.T, cfg *apiConfig) *fakeSearchCluster {
+	t.Helper()
+	cluster := &fakeSearchCluster{indexed: map[string]searchDocument{}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cluster.mu.Lock()
+		defer cluster.mu.Unlock()
+		switch {
+		case r.URL.Path == "/_bulk":
+			scanner := bufio.NewScanner(r.Body)
+			for scanner.Scan() {
+				var action map[string]struct {
+					ID string `json:"_id"`
+				}
+				json.Unmarshal(scanner.Bytes(), &action)
+				if target, ok := action["delete"]; ok {
+					cluster.deleted = append(cluster.deleted, target.ID)
+					continue
+				}
+				scanner.Scan()
+				var doc searchDocument
+				json.Unmarshal(scanner.Bytes(), &doc)
+				cluster.indexed[action["index"].ID] = doc
+			}
+			io.WriteString(w, `{"errors":false,"items":[]}`)
+		case r.URL.Path == "/tubely-videos/_search":
+			json.NewDecoder(r.Body).Decode(&cluster.query)
+			hits := []map[string]any{}
+			for _, id := range cluster.hits {
+				hits = append(hits, map[string]any{
+					"_id":       id,
+					"_score":    1.5,
+					"highlight": map[string][]string{"title": {"<em>Boots</em> &amp; more"}},
+				})
+			}
+			json.NewEncoder(w).Encode(map[string]any{"hits": map[string]any{"total": map[string]any{"value": len(hits)}, "hits": hits}})
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(server.Close)
+
+	search, err := newSearchIndex(server.URL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.search = search
+	cfg.db = cfg.db.WithVideoChangeHook(cfg.queueSearchIndex)
+	return cluster
+}
+
+func TestFlushSearchIndex(t *testing.T) {
+	cfg := newTestConfig(t)
+	cluster := newFakeSearchCluster(t, cfg)
+
+	public, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Boots", Tags: []string{"shoes"}, UserID: uuid.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	private, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Secret", Visibility: database.VisibilityPrivate, UserID: uuid.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cfg.db.PutVideoTranslation(public.ID, "de", "Stiefel", ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cfg.flushSearchIndex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	doc, ok := cluster.indexed[public.ID.String()]
+	if !ok || doc.Title != "Boots" || len(doc.Translations) != 1 || doc.Translations[0].Title != "Stiefel" {
+		t.Errorf("indexed %+v", cluster.indexed)
+	}
+	if _, ok := cluster.indexed[private.ID.String()]; ok {
+		t.Error("indexed a private video")
+	}
+	if len(cluster.deleted) != 1 || cluster.deleted[0] != private.ID.String() {
+		t.Errorf("deleted %v, want the private video", cluster.deleted)
+	}
+
+	// trashing takes it out of the index on the next flush
+	if err := cfg.db.TrashVideo(public.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.flushSearchIndex(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(cluster.deleted) != 2 || cluster.deleted[1] != public.ID.String() {
+		t.Errorf("deleted %v, want the trashed video too", cluster.deleted)
+	}
+}
+
+func TestHandlerSearch(t *testing.T) {
+	cfg := newTestConfig(t)
+	cluster := newFakeSearchCluster(t, cfg)
+
+	listed, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Boots & more", UserID: uuid.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hidden, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Boots", Visibility: database.VisibilityPrivate, UserID: uuid.New()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the index still has a video that was made private since
+	cluster.hits = []string{listed.ID.String(), hidden.ID.String()}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/search?q=bots&tag=Shoes&orientation=portrait&created_after=2026-01-01T00:00:00Z", nil)
+	w := httptest.NewRecorder()
+	cfg.handlerSearch(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	var resp struct {
+		Results []searchResult `json:"results"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Results) != 1 || resp.Results[0].Video.ID != listed.ID {
+		t.Fatalf("results %+v, want only the listed video", resp.Results)
+	}
+	if got := resp.Results[0].Highlights["title"]; len(got) != 1 || got[0] != "<em>Boots</em> &amp; more" {
+		t.Errorf("highlights %v", resp.Results[0].Highlights)
+	}
+
+	query, _ := json.Marshal(cluster.query)
+	for _, want := range []string{`"fuzziness":"AUTO"`, `"query":"bots"`, `{"term":{"tags.keyword":"shoes"}}`, `{"term":{"orientation":"portrait"}}`, `"gte":"2026-01-01T00:00:00Z"`, `"encoder":"html"`} {
+		if !strings.Contains(string(query), want) {
+			t.Errorf("query %s is missing %s", query, want)
+		}
+	}
+}
+
+func TestHandlerSearchRefusesBadRequests(t *testing.T) {
+	cfg := newTestConfig(t)
+	newFakeSearchCluster(t, cfg)
+
+	for _, query := range []string{"", "q=boots&limit=0", "q=boots&offset=9990&limit=50", "q=boots&user_id=me", "q=boots&created_before=yesterday"} {
+		w := httptest.NewRecorder()
+		cfg.handlerSearch(w, httptest.NewRequest(http.MethodGet, "/api/search?"+query, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%q: status %d, want 400", query, w.Code)
+		}
+	}
+}
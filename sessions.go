@@ -0,0 +1,151 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/google/uuid"
+)
+
+// user agents are stored to tell devices apart, nobody needs more than this
+const maxSessionUserAgentLength = 512
+
+// handlerSessionsRetrieve lists the devices signed in to the user's account,
+// marking the one making the request.
+func (cfg *apiConfig) handlerSessionsRetrieve(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+	currentID, err := auth.GetJWTSessionID(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	sessions, err := cfg.db.GetActiveSessions(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get sessions", err)
+		return
+	}
+	for i := range sessions {
+		sessions[i].Current = currentID != uuid.Nil && sessions[i].ID == currentID
+	}
+
+	respondWithJSON(w, http.StatusOK, sessions)
+}
+
+// handlerSessionRevoke signs one of the user's devices out. The device can't
+// refresh anymore, and revokedSessionMiddleware refuses the access token it
+// holds.
+func (cfg *apiConfig) handlerSessionRevoke(w http.ResponseWriter, r *http.Request) {
+	sessionID, err := uuid.Parse(r.PathValue("sessionID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid session ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	revoked, err := cfg.db.RevokeSession(userID, sessionID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't revoke session", err)
+		return
+	}
+	if !revoked {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Session not found", nil)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerSessionsRevokeOthers signs out every device but the one making the
+// request, for when the user suspects someone else got in.
+func (cfg *apiConfig) handlerSessionsRevokeOthers(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Revoked int64 `json:"revoked"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+	currentID, err := auth.GetJWTSessionID(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+	// older tokens don't say which session is theirs, the user would be
+	// signed out too
+	if currentID == uuid.Nil {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "Sign in again to tell this session apart from the others", nil)
+		return
+	}
+
+	revoked, err := cfg.db.RevokeOtherSessions(userID, currentID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't revoke sessions", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{Revoked: revoked})
+}
+
+// revokedSessionMiddleware refuses access tokens of revoked sessions, which
+// stay valid until they expire otherwise. Scoped tokens are checked by
+// scopeMiddleware, and tokens from before sessions were recorded in them
+// can't be told apart.
+func (cfg *apiConfig) revokedSessionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, _, scopes, ok := cfg.bearerAccessToken(r)
+		if !ok || scopes != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		sessionID, err := auth.GetJWTSessionID(token, cfg.jwtSecret)
+		if err != nil || sessionID == uuid.Nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		revoked, err := cfg.db.IsSessionRevoked(sessionID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't check session", err)
+			return
+		}
+		if revoked {
+			respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Session was revoked", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func truncateUserAgent(userAgent string) string {
+	if len(userAgent) > maxSessionUserAgentLength {
+		return userAgent[:maxSessionUserAgentLength]
+	}
+	return userAgent
+}
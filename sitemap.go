@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+const (
+	sitemapRefreshInterval = time.Hour
+	sitemapCacheControl    = "public, max-age=3600"
+	// the most URLs a single sitemap may list
+	maxSitemapURLs = 50000
+	// the longest video search engines accept in a video sitemap, in seconds
+	maxSitemapVideoDuration = 28800
+)
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	NS      string       `xml:"xmlns,attr"`
+	VideoNS string       `xml:"xmlns:video,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapURL struct {
+	Loc     string        `xml:"loc"`
+	LastMod string        `xml:"lastmod"`
+	Video   *sitemapVideo `xml:"video:video,omitempty"`
+}
+
+type sitemapVideo struct {
+	ThumbnailLoc    string              `xml:"video:thumbnail_loc"`
+	Title           string              `xml:"video:title"`
+	Description     string              `xml:"video:description"`
+	ContentLoc      string              `xml:"video:content_loc,omitempty"`
+	PlayerLoc       string              `xml:"video:player_loc"`
+	Duration        int                 `xml:"video:duration,omitempty"`
+	PublicationDate string              `xml:"video:publication_date"`
+	FamilyFriendly  string              `xml:"video:family_friendly"`
+	Restriction     *sitemapRestriction `xml:"video:restriction,omitempty"`
+	Tags            []string            `xml:"video:tag"`
+}
+
+type sitemapRestriction struct {
+	Relationship string `xml:"relationship,attr"`
+	Countries    string `xml:",chardata"`
+}
+
+// sitemapCache holds the last generated sitemap, so crawlers don't cost a
+// scan of all videos.
+type sitemapCache struct {
+	mu   sync.RWMutex
+	body []byte
+	etag string
+}
+
+func (c *sitemapCache) get() ([]byte, string) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.body, c.etag
+}
+
+func (c *sitemapCache) set(body []byte) {
+	hash := sha256.Sum256(body)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.body = body
+	c.etag = `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+func (cfg *apiConfig) handlerSitemap(w http.ResponseWriter, r *http.Request) {
+	body, etag := cfg.sitemap.get()
+	if body == nil {
+		// requested before the first scheduled run finished
+		if err := cfg.refreshSitemap(r.Context()); err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't build sitemap", err)
+			return
+		}
+		body, etag = cfg.sitemap.get()
+	}
+
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Header().Set("Cache-Control", sitemapCacheControl)
+	w.Header().Set("ETag", etag)
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+}
+
+// handlerRobots points crawlers at the sitemap.
+func (cfg *apiConfig) handlerRobots(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", sitemapCacheControl)
+	fmt.Fprintf(w, "User-agent: *\nAllow: /\nDisallow: /api/\nDisallow: /admin/\n\nSitemap: %s/sitemap.xml\n", cfg.appBaseURL)
+}
+
+// refreshSitemap lists the watch pages of all public videos, with the video
+// sitemap extension describing each video.
+func (cfg *apiConfig) refreshSitemap(ctx context.Context) error {
+	videos, err := cfg.db.GetPublicVideos()
+	if err != nil {
+		return err
+	}
+
+	urlSet := sitemapURLSet{
+		NS:      "http://www.sitemaps.org/schemas/sitemap/0.9",
+		VideoNS: "http://www.google.com/schemas/sitemap-video/1.1",
+		URLs:    []sitemapURL{},
+	}
+	for _, video := range videos {
+		if !isVideoEmbeddable(video) {
+			continue
+		}
+		if len(urlSet.URLs) == maxSitemapURLs {
+			log.Printf("Sitemap is full at %d videos, older ones are left out", maxSitemapURLs)
+			break
+		}
+		entry, err := cfg.sitemapEntry(video)
+		if err != nil {
+			return err
+		}
+		urlSet.URLs = append(urlSet.URLs, entry)
+	}
+
+	body, err := xml.MarshalIndent(urlSet, "", "  ")
+	if err != nil {
+		return err
+	}
+	cfg.sitemap.set(append([]byte(xml.Header), body...))
+	return nil
+}
+
+func (cfg *apiConfig) sitemapEntry(video database.Video) (sitemapURL, error) {
+	entry := sitemapURL{
+		Loc:     cfg.watchURL(video.ID),
+		LastMod: video.UpdatedAt.UTC().Format(time.RFC3339),
+	}
+
+	if video.AgeRestricted {
+		video.ThumbnailURL = video.BlurredThumbnailURL
+	}
+	// search engines need a thumbnail to show the video
+	if video.ThumbnailURL == nil {
+		return entry, nil
+	}
+
+	published := video.CreatedAt
+	if video.PublishAt != nil {
+		published = *video.PublishAt
+	}
+	description := video.Description
+	if description == "" {
+		description = video.Title
+	}
+
+	v := &sitemapVideo{
+		ThumbnailLoc:    cfg.signAssetURL(*video.ThumbnailURL),
+		Title:           video.Title,
+		Description:     description,
+		PlayerLoc:       cfg.embedURL(video.ID),
+		PublicationDate: published.UTC().Format(time.RFC3339),
+		FamilyFriendly:  "yes",
+		Tags:            video.Tags,
+	}
+	if video.AgeRestricted {
+		v.FamilyFriendly = "no"
+	}
+	if len(video.AllowedCountries) > 0 {
+		v.Restriction = &sitemapRestriction{Relationship: "allow", Countries: strings.Join(video.AllowedCountries, " ")}
+	} else if len(video.BlockedCountries) > 0 {
+		v.Restriction = &sitemapRestriction{Relationship: "deny", Countries: strings.Join(video.BlockedCountries, " ")}
+	}
+
+	versions, err := cfg.db.GetVideoVersions(video.ID)
+	if err != nil {
+		return sitemapURL{}, err
+	}
+	if key, ok := cfg.objectKeyFromURL(*video.VideoURL); ok {
+		for _, version := range versions {
+			if version.S3Key == key && version.DurationSeconds != nil {
+				v.Duration = min(max(int(math.Round(*version.DurationSeconds)), 1), maxSitemapVideoDuration)
+				break
+			}
+		}
+	}
+
+	// the file is only listed where anyone may fetch it directly, everything
+	// else plays through the embed page
+	watermarked, err := cfg.isWatermarkProtected(video)
+	if err != nil {
+		return sitemapURL{}, err
+	}
+	if !cfg.playbackTokens && !watermarked && v.Restriction == nil {
+		domain, err := cfg.playbackDomain(video.UserID)
+		if err != nil {
+			return sitemapURL{}, err
+		}
+		v.ContentLoc = cfg.withPlaybackDomain(*video.VideoURL, domain)
+	}
+
+	entry.Video = v
+	return entry, nil
+}
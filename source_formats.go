@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// sourceMediaTypes are the containers uploads are accepted in, every one of
+// them is normalized to MP4 by the pipeline.
+var sourceMediaTypes = map[string]string{
+	"video/mp4":        "mp4",
+	"video/quicktime":  "mov",
+	"video/x-matroska": "mkv",
+	"video/webm":       "webm",
+}
+
+// clients often send these as application/octet-stream, the file name
+// tells them apart then
+var sourceExtensions = map[string]string{
+	".mp4":  "mp4",
+	".m4v":  "mp4",
+	".mov":  "mov",
+	".mkv":  "mkv",
+	".webm": "webm",
+}
+
+var (
+	// codecs MP4 players handle, streams in them are copied when the
+	// profile copies
+	mp4VideoCodecs = []string{"h264", "hevc", "av1"}
+	mp4AudioCodecs = []string{"aac", "mp3", "ac3", "eac3"}
+	// codecs ffmpeg can decode well enough to re-encode, anything else is
+	// rejected
+	decodableVideoCodecs = []string{"h264", "hevc", "av1", "vp8", "vp9", "mpeg4", "mpeg2video", "prores", "mjpeg", "dnxhd"}
+	decodableAudioCodecs = []string{"aac", "mp3", "ac3", "eac3", "opus", "vorbis", "flac", "alac"}
+)
+
+// sourceMediaTypeAllowed reports whether an upload with the given content
+// type and file name is in one of the accepted containers.
+func sourceMediaTypeAllowed(mediaType, fileName string) bool {
+	if _, ok := sourceMediaTypes[mediaType]; ok {
+		return true
+	}
+	if mediaType != "application/octet-stream" {
+		return false
+	}
+	_, ok := sourceExtensions[strings.ToLower(path.Ext(fileName))]
+	return ok
+}
+
+// color transfers of HDR video, PQ (HDR10) and HLG
+var hdrColorTransfers = []string{"smpte2084", "arib-std-b67"}
+
+// sdrToneMapFilter maps HDR to SDR BT.709. Without it HDR sources come out
+// washed out in SDR renditions.
+const sdrToneMapFilter = "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=tonemap=hable:desat=0,zscale=t=bt709:m=bt709:r=tv,format=yuv420p"
+
+// hdrVideoCodecArgs encode 10-bit HEVC tagged with the source's HDR color
+// transfer.
+func hdrVideoCodecArgs(transfer string) []string {
+	return []string{
+		"-c:v", "libx265", "-pix_fmt", "yuv420p10le", "-tag:v", "hvc1",
+		"-x265-params", "hdr10-opt=1:repeat-headers=1",
+		"-color_primaries", "bt2020", "-color_trc", transfer, "-colorspace", "bt2020nc",
+	}
+}
+
+// sourceInfo is what ffprobe found in an upload.
+type sourceInfo struct {
+	Format      string   `json:"format"`
+	VideoCodec  string   `json:"video_codec"`
+	AudioCodecs []string `json:"audio_codecs"`
+	BitDepth    int      `json:"bit_depth"`
+	// ColorTransfer is set when the source says, HDR sources always do
+	ColorTransfer string `json:"color_transfer,omitempty"`
+	HDR           bool   `json:"hdr"`
+	// Duration is in seconds, 0 when the container doesn't say
+	Duration float64 `json:"duration"`
+	// VideoDuration is how long the video stream says it is, 0 when it
+	// doesn't
+	VideoDuration float64 `json:"video_duration"`
+}
+
+// unsupportedSourceError is returned for uploads the pipeline can't turn
+// into MP4. It lists what was detected so users know what to convert.
+type unsupportedSourceError struct {
+	info   sourceInfo
+	reason string
+}
+
+func (e *unsupportedSourceError) Error() string {
+	audio := "none"
+	if len(e.info.AudioCodecs) > 0 {
+		audio = strings.Join(e.info.AudioCodecs, ", ")
+	}
+	video := e.info.VideoCodec
+	if video == "" {
+		video = "none"
+	}
+	return fmt.Sprintf("%s (detected container %s, video %s, audio %s)", e.reason, e.info.Format, video, audio)
+}
+
+func probeSource(ctx context.Context, filePath string) (sourceInfo, error) {
+	cmd := ffmpegRunner.Command(ctx, "ffprobe", "-v", "error", "-print_format", "json", "-show_streams", "-show_format", filePath)
+	var out, stderr bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return sourceInfo{}, newCommandError("ffprobe", err, stderr.Bytes())
+	}
+
+	var result struct {
+		Streams []struct {
+			CodecType     string `json:"codec_type"`
+			CodecName     string `json:"codec_name"`
+			PixelFormat   string `json:"pix_fmt"`
+			ColorTransfer string `json:"color_transfer"`
+			Duration      string `json:"duration"`
+			// cover art shows up as a single-frame video stream
+			Disposition struct {
+				AttachedPic int `json:"attached_pic"`
+			} `json:"disposition"`
+		} `json:"streams"`
+		Format struct {
+			FormatName string `json:"format_name"`
+			Duration   string `json:"duration"`
+		} `json:"format"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		return sourceInfo{}, err
+	}
+
+	info := sourceInfo{Format: result.Format.FormatName, AudioCodecs: []string{}}
+	if duration, err := strconv.ParseFloat(result.Format.Duration, 64); err == nil {
+		info.Duration = duration
+	}
+	for _, stream := range result.Streams {
+		switch stream.CodecType {
+		case "video":
+			if info.VideoCodec == "" && stream.Disposition.AttachedPic == 0 {
+				info.VideoCodec = stream.CodecName
+				info.BitDepth = pixelFormatBitDepth(stream.PixelFormat)
+				info.ColorTransfer = stream.ColorTransfer
+				info.HDR = slices.Contains(hdrColorTransfers, stream.ColorTransfer)
+				if duration, err := strconv.ParseFloat(stream.Duration, 64); err == nil {
+					info.VideoDuration = duration
+				}
+			}
+		case "audio":
+			info.AudioCodecs = append(info.AudioCodecs, stream.CodecName)
+		}
+	}
+	return info, nil
+}
+
+// pixelFormatBitDepth reads the bit depth from names like yuv420p10le or
+// p010le, anything without one is 8-bit.
+func pixelFormatBitDepth(pixelFormat string) int {
+	for _, depth := range []int{16, 12, 10} {
+		if strings.Contains(pixelFormat, strconv.Itoa(depth)) {
+			return depth
+		}
+	}
+	return 8
+}
+
+// checkSupported rejects sources without a video stream or with codecs we
+// can't decode.
+func (info sourceInfo) checkSupported() error {
+	if info.VideoCodec == "" {
+		return &unsupportedSourceError{info: info, reason: "no video stream found"}
+	}
+	if !slices.Contains(decodableVideoCodecs, info.VideoCodec) {
+		return &unsupportedSourceError{info: info, reason: fmt.Sprintf("video codec %s isn't supported", info.VideoCodec)}
+	}
+	for _, codec := range info.AudioCodecs {
+		if !slices.Contains(decodableAudioCodecs, codec) && !strings.HasPrefix(codec, "pcm_") {
+			return &unsupportedSourceError{info: info, reason: fmt.Sprintf("audio codec %s isn't supported", codec)}
+		}
+	}
+	return nil
+}
+
+// normalizedProfile adapts profile to the source so the result is a
+// playable SDR MP4: streams the profile would copy are re-encoded when MP4
+// players can't handle their codec, HDR is tone mapped, and subtitle and data
+// streams of other containers are dropped.
+func (info sourceInfo) normalizedProfile(profile transcodeProfile) transcodeProfile {
+	profile = info.mp4Profile(profile)
+	if info.HDR {
+		if profile.Video.Codec == "copy" {
+			profile.Video = defaultSourceVideoOptions()
+		}
+		profile.toneMap = true
+	} else if info.BitDepth > 8 && profile.Video.Codec == "copy" && info.VideoCodec == "h264" {
+		// hardly any player decodes 10-bit H.264
+		profile.Video = defaultSourceVideoOptions()
+	}
+	return profile
+}
+
+// hdrProfile returns the profile of the HDR rendition of an HDR source, if
+// the profile keeps one.
+func (info sourceInfo) hdrProfile(profile transcodeProfile) (transcodeProfile, bool) {
+	if !info.HDR || (!profile.HDR && profile.Video.Codec != "copy") {
+		return transcodeProfile{}, false
+	}
+	profile = info.mp4Profile(profile)
+	if profile.Video.Codec != "copy" {
+		profile.Video.Codec = "hevc"
+		profile.hdrTransfer = info.ColorTransfer
+	}
+	return profile, true
+}
+
+func (info sourceInfo) mp4Profile(profile transcodeProfile) transcodeProfile {
+	if profile.Video.Codec == "copy" && !slices.Contains(mp4VideoCodecs, info.VideoCodec) {
+		profile.Video = defaultSourceVideoOptions()
+	}
+	if profile.Audio.Codec == "copy" {
+		for _, codec := range info.AudioCodecs {
+			if !slices.Contains(mp4AudioCodecs, codec) {
+				profile.Audio = transcodeAudioOptions{Codec: "aac", Bitrate: "160k"}
+				break
+			}
+		}
+	}
+	if !strings.Contains(info.Format, "mp4") {
+		profile.dropExtraStreams = true
+	}
+	return profile
+}
+
+// defaultSourceVideoOptions re-encode sources profiles would copy but
+// players can't play.
+func defaultSourceVideoOptions() transcodeVideoOptions {
+	crf := 23
+	return transcodeVideoOptions{Codec: "h264", CRF: &crf, Preset: "veryfast"}
+}
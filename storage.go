@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+)
+
+// s3EndpointConfig points the S3 client somewhere other than AWS.
+type s3EndpointConfig struct {
+	// URL replaces the regional AWS endpoint when set
+	URL string
+	// PathStyle puts the bucket in the path instead of the host name, most
+	// self-hosted stores don't resolve bucket subdomains
+	PathStyle bool
+	// InsecureSkipVerify accepts self-signed certificates, for development
+	InsecureSkipVerify bool
+}
+
+func newS3Client(awsConfig aws.Config, endpoint s3EndpointConfig) *s3.Client {
+	return s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		o.UsePathStyle = endpoint.PathStyle
+		if endpoint.URL == "" {
+			return
+		}
+		o.BaseEndpoint = aws.String(endpoint.URL)
+		// not every S3-compatible store accepts the checksums the SDK adds
+		// by default, only send them when the operation needs one
+		o.RequestChecksumCalculation = aws.RequestChecksumCalculationWhenRequired
+		o.ResponseChecksumValidation = aws.ResponseChecksumValidationWhenRequired
+		if endpoint.InsecureSkipVerify {
+			o.HTTPClient = awshttp.NewBuildableClient().WithTransportOptions(func(t *http.Transport) {
+				t.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+			})
+		}
+	})
+}
+
+func (cfg *apiConfig) objectURL(key string) string {
+	route := cfg.storageRoute(key)
+	return fmt.Sprintf("%s/%s", route.CDNURL, route.bucketKey(key))
+}
+
+// objectKeyFromURL returns the S3 key behind a URL built with objectURL.
+func (cfg *apiConfig) objectKeyFromURL(objectURL string) (string, bool) {
+	for _, route := range cfg.storageRoutes.sortedByPrefix() {
+		key, ok := strings.CutPrefix(objectURL, route.CDNURL+"/"+route.Prefix)
+		if ok && contentClassOfKey(key) == route.class {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// putObject uploads body with a CRC32C checksum the SDK computes on the way,
+// S3 rejects the upload when what it received doesn't match.
+func (cfg *apiConfig) putObject(ctx context.Context, key, contentType string, body io.Reader, enc objectEncryption, tags objectTags) error {
+	route := cfg.storageRoute(key)
+	input := &s3.PutObjectInput{
+		Bucket:            aws.String(route.Bucket),
+		Key:               aws.String(route.bucketKey(key)),
+		Body:              body,
+		ContentType:       aws.String(contentType),
+		ChecksumAlgorithm: types.ChecksumAlgorithmCrc32c,
+		StorageClass:      types.StorageClass(route.StorageClass),
+		Tagging:           aws.String(tags.with(objectTags{objectTagContentClass: string(route.class)}).encode()),
+	}
+	enc.applyPut(input)
+	_, err := cfg.s3Client.PutObject(ctx, input)
+	return err
+}
+
+// putFileObject uploads a file along with its SHA-256, which S3 verifies
+// before storing the object. It returns the hex checksum so it can be
+// handed to clients to verify their downloads the same way.
+func (cfg *apiConfig) putFileObject(ctx context.Context, key, contentType string, f *os.File, enc objectEncryption, tags objectTags) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	sum := hash.Sum(nil)
+
+	route := cfg.storageRoute(key)
+	input := &s3.PutObjectInput{
+		Bucket:         aws.String(route.Bucket),
+		Key:            aws.String(route.bucketKey(key)),
+		Body:           f,
+		ContentType:    aws.String(contentType),
+		ChecksumSHA256: aws.String(base64.StdEncoding.EncodeToString(sum)),
+		StorageClass:   types.StorageClass(route.StorageClass),
+		Tagging:        aws.String(tags.with(objectTags{objectTagContentClass: string(route.class)}).encode()),
+	}
+	enc.applyPut(input)
+	_, err := cfg.s3Client.PutObject(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sum), nil
+}
+
+// copyObject copies an object within S3, into the bucket of dstKey's class.
+// Objects over 5GB can't be copied in a single request.
+func (cfg *apiConfig) copyObject(ctx context.Context, srcKey, dstKey string, enc objectEncryption) error {
+	src := cfg.storageRoute(srcKey)
+	dst := cfg.storageRoute(dstKey)
+	input := &s3.CopyObjectInput{
+		Bucket:       aws.String(dst.Bucket),
+		Key:          aws.String(dst.bucketKey(dstKey)),
+		CopySource:   aws.String(src.Bucket + "/" + url.PathEscape(src.bucketKey(srcKey))),
+		StorageClass: types.StorageClass(dst.StorageClass),
+	}
+	enc.applyCopy(input)
+	_, err := cfg.s3Client.CopyObject(ctx, input)
+	return err
+}
+
+func (cfg *apiConfig) downloadObject(ctx context.Context, key string, dst io.Writer) error {
+	route := cfg.storageRoute(key)
+	return cfg.downloadBucketObject(ctx, route.Bucket, route.bucketKey(key), dst)
+}
+
+func (cfg *apiConfig) downloadBucketObject(ctx context.Context, bucket, key string, dst io.Writer) error {
+	out, err := cfg.s3Client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	defer out.Body.Close()
+
+	_, err = io.Copy(dst, out.Body)
+	return err
+}
+
+func (cfg *apiConfig) deleteObject(ctx context.Context, key string) error {
+	route := cfg.storageRoute(key)
+	_, err := cfg.s3Client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(route.Bucket),
+		Key:    aws.String(route.bucketKey(key)),
+	})
+	return err
+}
+
+// presignPostObject returns the URL and form fields of a browser upload to
+// key. The signed policy pins the key and content type and caps the size, so
+// S3 rejects anything else. It doesn't set server-side encryption, objects
+// uploaded through it are only staged for processing, which re-uploads them
+// encrypted.
+func (cfg *apiConfig) presignPostObject(ctx context.Context, key, contentType string, maxBytes int64, expires time.Duration) (string, map[string]string, error) {
+	route := cfg.storageRoute(key)
+	presignClient := s3.NewPresignClient(cfg.s3Client)
+	req, err := presignClient.PresignPostObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(route.Bucket),
+		Key:    aws.String(route.bucketKey(key)),
+	}, func(o *s3.PresignPostOptions) {
+		o.Expires = expires
+		o.Conditions = []interface{}{
+			map[string]string{"key": route.bucketKey(key)},
+			[]interface{}{"eq", "$Content-Type", contentType},
+			[]interface{}{"content-length-range", 1, maxBytes},
+		}
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	// the policy only accepts the upload with this field set
+	req.Values["Content-Type"] = contentType
+	return req.URL, req.Values, nil
+}
+
+func (cfg *apiConfig) presignGetObject(ctx context.Context, key string, expires time.Duration) (string, error) {
+	route := cfg.storageRoute(key)
+	presignClient := s3.NewPresignClient(cfg.s3Client)
+	req, err := presignClient.PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(route.Bucket),
+		Key:    aws.String(route.bucketKey(key)),
+	}, s3.WithPresignExpires(expires))
+	if err != nil {
+		return "", err
+	}
+	return req.URL, nil
+}
+
+// listObjectKeys returns the keys starting with prefix, wherever their
+// class is stored.
+func (cfg *apiConfig) listObjectKeys(ctx context.Context, prefix string) ([]string, error) {
+	route := cfg.storageRoute(prefix)
+	bucketKeys, err := cfg.listBucketKeys(ctx, route.Bucket, route.bucketKey(prefix))
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(bucketKeys))
+	for _, bucketKey := range bucketKeys {
+		keys = append(keys, strings.TrimPrefix(bucketKey, route.Prefix))
+	}
+	return keys, nil
+}
+
+// listStoredObjects lists the objects of every content class by their keys.
+func (cfg *apiConfig) listStoredObjects(ctx context.Context) ([]storedObject, error) {
+	objects := []storedObject{}
+	for _, location := range cfg.storageRoutes.locations() {
+		found, err := cfg.listBucketObjects(ctx, location.Bucket, location.Prefix)
+		if err != nil {
+			return nil, fmt.Errorf("bucket %s: %w", location.Bucket, err)
+		}
+		for _, object := range found {
+			key, ok := cfg.keyFromBucketKey(location.Bucket, object.Key)
+			if !ok {
+				continue
+			}
+			object.Key = key
+			objects = append(objects, object)
+		}
+	}
+	return objects, nil
+}
+
+func (cfg *apiConfig) listBucketKeys(ctx context.Context, bucket, prefix string) ([]string, error) {
+	objects, err := cfg.listBucketObjects(ctx, bucket, prefix)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(objects))
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	return keys, nil
+}
+
+type storedObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+func (cfg *apiConfig) listBucketObjects(ctx context.Context, bucket, prefix string) ([]storedObject, error) {
+	paginator := s3.NewListObjectsV2Paginator(cfg.s3Client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	})
+
+	objects := []storedObject{}
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range page.Contents {
+			objects = append(objects, storedObject{
+				Key:          aws.ToString(object.Key),
+				Size:         aws.ToInt64(object.Size),
+				LastModified: aws.ToTime(object.LastModified),
+			})
+		}
+	}
+	return objects, nil
+}
+
+// deleteVideoAssets removes the uploaded video objects and the local
+// thumbnails of a video. Missing files are not treated as errors.
+func (cfg *apiConfig) deleteVideoAssets(ctx context.Context, video database.Video) error {
+	versions, err := cfg.db.GetVideoVersions(video.ID)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if err := cfg.deleteObject(ctx, version.S3Key); err != nil {
+			return fmt.Errorf("couldn't delete video object %s: %w", version.S3Key, err)
+		}
+		if version.HDRKey != nil {
+			if err := cfg.deleteObject(ctx, *version.HDRKey); err != nil {
+				return fmt.Errorf("couldn't delete HDR rendition %s: %w", *version.HDRKey, err)
+			}
+		}
+		// several versions can share a source, deleting it twice is fine
+		if version.SourceKey != nil {
+			if err := cfg.deleteObject(ctx, *version.SourceKey); err != nil {
+				return fmt.Errorf("couldn't delete video source %s: %w", *version.SourceKey, err)
+			}
+		}
+	}
+
+	if video.VideoURL != nil {
+		if key, ok := cfg.objectKeyFromURL(*video.VideoURL); ok {
+			if err := cfg.deleteObject(ctx, key); err != nil {
+				return fmt.Errorf("couldn't delete video object %s: %w", key, err)
+			}
+		}
+	}
+
+	// packaged renditions and audio tracks live under per-video prefixes
+	for _, prefix := range []string{"drm", "hls", "audio"} {
+		keys, err := cfg.listObjectKeys(ctx, fmt.Sprintf("%s/%s/", prefix, video.ID))
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := cfg.deleteObject(ctx, key); err != nil {
+				return fmt.Errorf("couldn't delete rendition object %s: %w", key, err)
+			}
+		}
+	}
+
+	exportKeys, err := cfg.listObjectKeys(ctx, videoExportPrefix(video.ID))
+	if err != nil {
+		return err
+	}
+	for _, key := range exportKeys {
+		if err := cfg.deleteObject(ctx, key); err != nil {
+			return fmt.Errorf("couldn't delete export %s: %w", key, err)
+		}
+	}
+
+	thumbnailURLs := []*string{video.ThumbnailURL, video.BlurredThumbnailURL}
+	variants, err := cfg.db.GetThumbnailVariants(video.ID)
+	if err != nil {
+		return err
+	}
+	for _, variant := range variants {
+		thumbnailURLs = append(thumbnailURLs, &variant.ThumbnailURL)
+	}
+	candidates, err := cfg.db.GetThumbnailCandidates(video.ID)
+	if err != nil {
+		return err
+	}
+	for _, candidate := range candidates {
+		thumbnailURLs = append(thumbnailURLs, &candidate.ThumbnailURL)
+	}
+	for _, thumbnailURL := range thumbnailURLs {
+		if thumbnailURL == nil {
+			continue
+		}
+		if thumbnailPath, ok := cfg.assetPathFromURL(*thumbnailURL); ok {
+			err := os.Remove(thumbnailPath)
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("couldn't delete thumbnail %s: %w", thumbnailPath, err)
+			}
+		}
+	}
+	return nil
+}
+
+// uploadDirectory uploads every file below dir to keys under prefix, keeping
+// the relative paths so manifests can reference their segments.
+func (cfg *apiConfig) uploadDirectory(ctx context.Context, dir, prefix string, enc objectEncryption, tags objectTags) error {
+	return filepath.WalkDir(dir, func(filePath string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, filePath)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(filePath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		key := prefix + "/" + filepath.ToSlash(rel)
+		err = cfg.putObject(ctx, key, streamingContentType(filePath), f, enc, tags)
+		if err != nil {
+			return fmt.Errorf("couldn't upload %s: %w", key, err)
+		}
+		return nil
+	})
+}
+
+func streamingContentType(filePath string) string {
+	switch filepath.Ext(filePath) {
+	case ".m3u8":
+		return "application/vnd.apple.mpegurl"
+	case ".mpd":
+		return "application/dash+xml"
+	case ".m4s":
+		return "video/iso.segment"
+	case ".mp4":
+		return "video/mp4"
+	}
+	if contentType := mime.TypeByExtension(filepath.Ext(filePath)); contentType != "" {
+		return contentType
+	}
+	return "application/octet-stream"
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// contentClass groups objects that can live in their own bucket. Keys keep
+// the same shape wherever their class is stored, the class is read from the
+// key's first segment.
+type contentClass string
+
+const (
+	contentClassDefault    contentClass = "default"
+	contentClassOriginals  contentClass = "originals"
+	contentClassRenditions contentClass = "renditions"
+	contentClassExports    contentClass = "exports"
+)
+
+// testDataPrefix is where every object goes in test data mode.
+const testDataPrefix = "test-data/"
+
+// storageLifecycleRulePrefix marks the lifecycle rules managed from the
+// routes file, rules with other IDs are left alone.
+const storageLifecycleRulePrefix = "tubely-"
+
+// contentClassSegments maps the first segment of keys to their class,
+// everything else (staged uploads, bumpers) is default.
+var contentClassSegments = map[string]contentClass{
+	"originals": contentClassOriginals,
+	"landscape": contentClassRenditions,
+	"portrait":  contentClassRenditions,
+	"other":     contentClassRenditions,
+	"hls":       contentClassRenditions,
+	"drm":       contentClassRenditions,
+	"audio":     contentClassRenditions,
+	"exports":   contentClassExports,
+}
+
+// storageRoute is where a content class is stored and served from.
+type storageRoute struct {
+	class contentClass
+	// Bucket defaults to S3_BUCKET
+	Bucket string `json:"bucket"`
+	// Prefix is put in front of every key, ending in a slash
+	Prefix string `json:"prefix"`
+	// StorageClass is the S3 storage class new objects are written with,
+	// the bucket's default when empty
+	StorageClass string `json:"storage_class"`
+	// CDNURL serves the class, defaults to S3_CF_DISTRO
+	CDNURL string `json:"cdn_url"`
+	// CFDistributionID is invalidated when objects are replaced, defaults
+	// to CF_DISTRIBUTION_ID
+	CFDistributionID string            `json:"cf_distribution_id"`
+	Lifecycle        *storageLifecycle `json:"lifecycle"`
+}
+
+// storageLifecycle becomes a lifecycle rule on the route's bucket, limited
+// to its prefix.
+type storageLifecycle struct {
+	TransitionAfterDays    int    `json:"transition_after_days"`
+	TransitionStorageClass string `json:"transition_storage_class"`
+	ExpireAfterDays        int    `json:"expire_after_days"`
+}
+
+type storageRoutes map[contentClass]storageRoute
+
+// loadStorageRoutes reads the routes file, a JSON object from content class
+// to route like {"originals": {"bucket": "tubely-originals"}}. Classes it
+// doesn't name, and the default class, use S3_BUCKET and S3_CF_DISTRO.
+func loadStorageRoutes(path string, defaultRoute storageRoute) (storageRoutes, error) {
+	defaultRoute.class = contentClassDefault
+	routes := storageRoutes{contentClassDefault: defaultRoute}
+	for _, class := range []contentClass{contentClassOriginals, contentClassRenditions, contentClassExports} {
+		route := defaultRoute
+		route.class = class
+		routes[class] = route
+	}
+	if path == "" {
+		return routes, nil
+	}
+
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file map[contentClass]storageRoute
+	err = json.Unmarshal(dat, &file)
+	if err != nil {
+		return nil, err
+	}
+
+	for class, route := range file {
+		if class == contentClassDefault {
+			return nil, errors.New("the default class is set with S3_BUCKET and S3_CF_DISTRO")
+		}
+		if _, ok := routes[class]; !ok {
+			return nil, fmt.Errorf("unknown content class %q, must be originals, renditions or exports", class)
+		}
+		route.class = class
+		if route.Bucket == "" {
+			route.Bucket = defaultRoute.Bucket
+		}
+		route.CDNURL = strings.TrimSuffix(route.CDNURL, "/")
+		if route.CDNURL == "" {
+			route.CDNURL = defaultRoute.CDNURL
+		}
+		if route.CFDistributionID == "" {
+			route.CFDistributionID = defaultRoute.CFDistributionID
+		}
+		if err := route.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %w", class, err)
+		}
+		routes[class] = route
+	}
+
+	// keys are found by their location, two classes can't share one
+	for _, a := range routes {
+		for _, b := range routes {
+			if a.class == b.class || a.Bucket != b.Bucket {
+				continue
+			}
+			if a.Prefix != "" && strings.HasPrefix(a.Prefix, b.Prefix) && b.Prefix != "" {
+				return nil, fmt.Errorf("%s and %s share bucket %s with overlapping prefixes", a.class, b.class, a.Bucket)
+			}
+			if a.Lifecycle != nil && a.Prefix == "" {
+				return nil, fmt.Errorf("%s needs a prefix or a bucket of its own for its lifecycle", a.class)
+			}
+		}
+	}
+	return routes, nil
+}
+
+// forTestData sends every class under testDataPrefix of the bucket, so a
+// test run's objects stay apart from real ones and are removed together.
+// The routes' lifecycles and storage classes are dropped with their
+// locations.
+func (routes storageRoutes) forTestData(bucket, cdnURL string) storageRoutes {
+	cdnURL = strings.TrimSuffix(cdnURL, "/")
+	testRoutes := storageRoutes{}
+	for class, route := range routes {
+		testRoute := storageRoute{
+			class:            class,
+			Bucket:           bucket,
+			Prefix:           testDataPrefix,
+			CDNURL:           route.CDNURL,
+			CFDistributionID: route.CFDistributionID,
+		}
+		if cdnURL != "" {
+			// the distribution fronts the real buckets, not this one
+			testRoute.CDNURL = cdnURL
+			testRoute.CFDistributionID = ""
+		}
+		testRoutes[class] = testRoute
+	}
+	return testRoutes
+}
+
+func (r storageRoute) validate() error {
+	if r.Prefix != "" {
+		if !strings.HasSuffix(r.Prefix, "/") || strings.HasPrefix(r.Prefix, "/") {
+			return errors.New("prefix must end with a slash and not start with one")
+		}
+		first, _, _ := strings.Cut(r.Prefix, "/")
+		if _, ok := contentClassSegments[first]; ok || first+"/" == uploadStagingPrefix || first+"/" == testDataPrefix || first == "bumpers" {
+			return fmt.Errorf("prefix can't start with %s/, keys of the app do", first)
+		}
+	}
+	if r.StorageClass != "" && !slices.Contains(types.StorageClass("").Values(), types.StorageClass(r.StorageClass)) {
+		return fmt.Errorf("unknown storage class %q", r.StorageClass)
+	}
+	if r.CDNURL == "" {
+		return errors.New("cdn_url is required")
+	}
+	if l := r.Lifecycle; l != nil {
+		if l.TransitionAfterDays < 0 || l.ExpireAfterDays < 0 {
+			return errors.New("lifecycle days can't be negative")
+		}
+		if (l.TransitionAfterDays > 0) != (l.TransitionStorageClass != "") {
+			return errors.New("lifecycle needs both transition_after_days and transition_storage_class, or neither")
+		}
+		if l.TransitionStorageClass != "" && !slices.Contains(types.TransitionStorageClass("").Values(), types.TransitionStorageClass(l.TransitionStorageClass)) {
+			return fmt.Errorf("unknown transition storage class %q", l.TransitionStorageClass)
+		}
+		if l.ExpireAfterDays > 0 && l.TransitionAfterDays >= l.ExpireAfterDays {
+			return errors.New("objects must transition before they expire")
+		}
+		if l.TransitionAfterDays == 0 && l.ExpireAfterDays == 0 {
+			return errors.New("lifecycle needs a transition or an expiry")
+		}
+	}
+	return nil
+}
+
+func contentClassOfKey(key string) contentClass {
+	first, _, _ := strings.Cut(key, "/")
+	if class, ok := contentClassSegments[first]; ok {
+		return class
+	}
+	return contentClassDefault
+}
+
+// storageRoute returns where the object with the key is stored.
+func (cfg *apiConfig) storageRoute(key string) storageRoute {
+	return cfg.storageRoutes[contentClassOfKey(key)]
+}
+
+// bucketKey is the key of the object in its route's bucket.
+func (r storageRoute) bucketKey(key string) string {
+	return r.Prefix + key
+}
+
+// keyFromBucketKey maps an object found in a bucket back to its key.
+// Objects outside every route, like those of other apps sharing the
+// bucket, aren't ours.
+func (cfg *apiConfig) keyFromBucketKey(bucket, bucketKey string) (string, bool) {
+	routes := cfg.storageRoutes.sortedByPrefix()
+	for _, route := range routes {
+		if route.Bucket != bucket {
+			continue
+		}
+		key, ok := strings.CutPrefix(bucketKey, route.Prefix)
+		// test data shares the bucket but isn't this instance's to manage
+		if ok && !strings.HasPrefix(key, testDataPrefix) && contentClassOfKey(key) == route.class {
+			return key, true
+		}
+	}
+	return "", false
+}
+
+// sortedByPrefix puts the longest prefixes first, so an object is matched
+// to the most specific route.
+func (routes storageRoutes) sortedByPrefix() []storageRoute {
+	sorted := make([]storageRoute, 0, len(routes))
+	for _, route := range routes {
+		sorted = append(sorted, route)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i].Prefix) != len(sorted[j].Prefix) {
+			return len(sorted[i].Prefix) > len(sorted[j].Prefix)
+		}
+		return sorted[i].class < sorted[j].class
+	})
+	return sorted
+}
+
+// locations returns the distinct buckets and prefixes objects are stored
+// under.
+func (routes storageRoutes) locations() []storageRoute {
+	locations := []storageRoute{}
+	for _, route := range routes.sortedByPrefix() {
+		covered := slices.ContainsFunc(locations, func(l storageRoute) bool {
+			return l.Bucket == route.Bucket && strings.HasPrefix(route.Prefix, l.Prefix)
+		})
+		if covered {
+			continue
+		}
+		// a shorter prefix found later covers the ones already listed
+		locations = slices.DeleteFunc(locations, func(l storageRoute) bool {
+			return l.Bucket == route.Bucket && strings.HasPrefix(l.Prefix, route.Prefix)
+		})
+		locations = append(locations, route)
+	}
+	return locations
+}
+
+// applyStorageLifecycles writes the lifecycle rules of the routes file to
+// their buckets. Rules set up outside the app are kept.
+func (cfg *apiConfig) applyStorageLifecycles(ctx context.Context) error {
+	rulesByBucket := map[string][]types.LifecycleRule{}
+	for _, route := range cfg.storageRoutes {
+		if _, ok := rulesByBucket[route.Bucket]; !ok {
+			rulesByBucket[route.Bucket] = []types.LifecycleRule{}
+		}
+		if route.Lifecycle == nil {
+			continue
+		}
+		rule := types.LifecycleRule{
+			ID:     aws.String(storageLifecycleRulePrefix + string(route.class)),
+			Status: types.ExpirationStatusEnabled,
+			Filter: &types.LifecycleRuleFilter{Prefix: aws.String(route.Prefix)},
+		}
+		if route.Lifecycle.TransitionAfterDays > 0 {
+			rule.Transitions = []types.Transition{{
+				Days:         aws.Int32(int32(route.Lifecycle.TransitionAfterDays)),
+				StorageClass: types.TransitionStorageClass(route.Lifecycle.TransitionStorageClass),
+			}}
+		}
+		if route.Lifecycle.ExpireAfterDays > 0 {
+			rule.Expiration = &types.LifecycleExpiration{Days: aws.Int32(int32(route.Lifecycle.ExpireAfterDays))}
+		}
+		rulesByBucket[route.Bucket] = append(rulesByBucket[route.Bucket], rule)
+	}
+
+	for bucket, rules := range rulesByBucket {
+		if err := cfg.applyBucketLifecycle(ctx, bucket, rules); err != nil {
+			return fmt.Errorf("bucket %s: %w", bucket, err)
+		}
+	}
+	return nil
+}
+
+func (cfg *apiConfig) applyBucketLifecycle(ctx context.Context, bucket string, managed []types.LifecycleRule) error {
+	current, err := cfg.s3Client.GetBucketLifecycleConfiguration(ctx, &s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(bucket),
+	})
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && apiErr.ErrorCode() == "NoSuchLifecycleConfiguration" {
+		current, err = &s3.GetBucketLifecycleConfigurationOutput{}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	rules := []types.LifecycleRule{}
+	hadManaged := false
+	for _, rule := range current.Rules {
+		if strings.HasPrefix(aws.ToString(rule.ID), storageLifecycleRulePrefix) {
+			hadManaged = true
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	if !hadManaged && len(managed) == 0 {
+		return nil
+	}
+	rules = append(rules, managed...)
+
+	if len(rules) == 0 {
+		_, err = cfg.s3Client.DeleteBucketLifecycle(ctx, &s3.DeleteBucketLifecycleInput{
+			Bucket: aws.String(bucket),
+		})
+		return err
+	}
+	_, err = cfg.s3Client.PutBucketLifecycleConfiguration(ctx, &s3.PutBucketLifecycleConfigurationInput{
+		Bucket:                 aws.String(bucket),
+		LifecycleConfiguration: &types.BucketLifecycleConfiguration{Rules: rules},
+	})
+	if err == nil {
+		log.Printf("Applied %d storage lifecycle rules to bucket %s", len(managed), bucket)
+	}
+	return err
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// without thumbnail candidates the final generated thumbnail is taken a
+	// little way in, past fade-ins and title cards
+	generatedThumbnailPosition = 0.1
+
+	thumbnailCandidateCount = 5
+	// scene scores above this start a new shot
+	sceneChangeThreshold = 0.3
+	// frames with a lower average luma are black or close to it
+	blackFrameLuma = 32
+)
+
+// setPlaceholderThumbnail gives a video without a thumbnail the first
+// decodable frame of its upload, so clients have something to show while the
+// file is processed. The caller is responsible for saving the video.
+func (cfg *apiConfig) setPlaceholderThumbnail(ctx context.Context, video *database.Video, filePath string) error {
+	if video.ThumbnailURL != nil && !video.ThumbnailGenerated {
+		return nil
+	}
+	return cfg.setGeneratedThumbnail(ctx, video, filePath, 0, "placeholder")
+}
+
+// setFinalThumbnail replaces a generated thumbnail with the best of the
+// thumbnail candidates, or a frame from further into the processed file when
+// there are none. Thumbnails uploaded by the owner are kept. The caller is
+// responsible for saving the video.
+func (cfg *apiConfig) setFinalThumbnail(ctx context.Context, video *database.Video, filePath string, candidates []database.CreateThumbnailCandidateParams) error {
+	if video.ThumbnailURL != nil && !video.ThumbnailGenerated {
+		return nil
+	}
+	if len(candidates) > 0 {
+		return cfg.setGeneratedThumbnail(ctx, video, filePath, candidates[0].Timestamp, "thumbnail")
+	}
+	duration, err := getVideoDuration(ctx, filePath)
+	if err != nil {
+		return err
+	}
+	return cfg.setGeneratedThumbnail(ctx, video, filePath, duration*generatedThumbnailPosition, "thumbnail")
+}
+
+// storeThumbnailCandidates replaces the thumbnail candidates of a video with
+// frames picked from the processed file. It returns them best first.
+func (cfg *apiConfig) storeThumbnailCandidates(ctx context.Context, video database.Video, filePath string) ([]database.CreateThumbnailCandidateParams, error) {
+	duration, err := getVideoDuration(ctx, filePath)
+	if err != nil {
+		return nil, err
+	}
+	frames, err := detectSceneFrames(ctx, filePath, duration)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := []database.CreateThumbnailCandidateParams{}
+	for _, frame := range pickThumbnailCandidates(frames, duration, thumbnailCandidateCount) {
+		fileName := fmt.Sprintf("%s-candidate-%s.jpg", video.ID, uuid.New())
+		err := extractFrame(ctx, filePath, frame.Timestamp, filepath.Join(cfg.assetsRoot, fileName))
+		if err != nil {
+			cfg.removeThumbnailCandidateFiles(candidates)
+			return nil, err
+		}
+		candidates = append(candidates, database.CreateThumbnailCandidateParams{
+			VideoID:      video.ID,
+			ThumbnailURL: fmt.Sprintf("http://localhost:8091/assets/%s", fileName),
+			Timestamp:    frame.Timestamp,
+			SceneScore:   frame.SceneScore,
+		})
+	}
+
+	previous, err := cfg.db.WithContext(ctx).ReplaceThumbnailCandidates(video.ID, candidates)
+	if err != nil {
+		cfg.removeThumbnailCandidateFiles(candidates)
+		return nil, err
+	}
+	for _, candidate := range previous {
+		cfg.removeThumbnailCandidateFile(candidate.ThumbnailURL)
+	}
+	return candidates, nil
+}
+
+func (cfg *apiConfig) removeThumbnailCandidateFiles(candidates []database.CreateThumbnailCandidateParams) {
+	for _, candidate := range candidates {
+		cfg.removeThumbnailCandidateFile(candidate.ThumbnailURL)
+	}
+}
+
+func (cfg *apiConfig) removeThumbnailCandidateFile(thumbnailURL string) {
+	if candidatePath, ok := cfg.assetPathFromURL(thumbnailURL); ok {
+		if err := os.Remove(candidatePath); err != nil && !os.IsNotExist(err) {
+			log.Printf("Couldn't remove thumbnail candidate %s: %v", candidatePath, err)
+		}
+	}
+}
+
+// sceneFrame is a frame scene detection selected.
+type sceneFrame struct {
+	Timestamp  float64
+	SceneScore float64
+	// Luma is the average brightness, 0 to 255
+	Luma float64
+}
+
+// detectSceneFrames lists the frames that start a new shot, plus at least
+// one every tenth of the video so videos that are a single shot still yield
+// some.
+func detectSceneFrames(ctx context.Context, filePath string, duration float64) ([]sceneFrame, error) {
+	filter := fmt.Sprintf(
+		"scale=320:-2,select='gt(scene,%g)+isnan(prev_selected_t)+gte(t-prev_selected_t,%g)',signalstats,metadata=print:file=-",
+		sceneChangeThreshold, duration/10,
+	)
+	cmd := ffmpegRunner.Command(ctx, "ffmpeg", "-nostats", "-i", filePath, "-an", "-sn", "-dn", "-vf", filter, "-f", "null", "-")
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return nil, newCommandError("ffmpeg", err, stderr.Bytes())
+	}
+	return parseSceneFrames(stdout.String()), nil
+}
+
+// parseSceneFrames reads the output of the metadata filter, a frame line
+// with its pts_time followed by key=value lines.
+func parseSceneFrames(output string) []sceneFrame {
+	frames := []sceneFrame{}
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "frame:") {
+			for _, field := range strings.Fields(line) {
+				if value, ok := strings.CutPrefix(field, "pts_time:"); ok {
+					timestamp, err := strconv.ParseFloat(value, 64)
+					if err == nil {
+						frames = append(frames, sceneFrame{Timestamp: timestamp})
+					}
+				}
+			}
+			continue
+		}
+		if len(frames) == 0 {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		switch key {
+		case "lavfi.scene_score":
+			frames[len(frames)-1].SceneScore = n
+		case "lavfi.signalstats.YAVG":
+			frames[len(frames)-1].Luma = n
+		}
+	}
+	return frames
+}
+
+// pickThumbnailCandidates picks up to n frames that aren't black, preferring
+// clear shot changes, and keeps them apart in time so they show different
+// scenes. They are returned best first.
+func pickThumbnailCandidates(frames []sceneFrame, duration float64, n int) []sceneFrame {
+	lit := []sceneFrame{}
+	for _, frame := range frames {
+		if frame.Luma >= blackFrameLuma {
+			lit = append(lit, frame)
+		}
+	}
+	slices.SortStableFunc(lit, func(a, b sceneFrame) int {
+		return cmp.Compare(b.SceneScore, a.SceneScore)
+	})
+
+	minGap := duration / float64(2*n)
+	picked := []sceneFrame{}
+	for _, frame := range lit {
+		if len(picked) == n {
+			break
+		}
+		distinct := true
+		for _, p := range picked {
+			if math.Abs(p.Timestamp-frame.Timestamp) < minGap {
+				distinct = false
+				break
+			}
+		}
+		if distinct {
+			picked = append(picked, frame)
+		}
+	}
+	return picked
+}
+
+func (cfg *apiConfig) setGeneratedThumbnail(ctx context.Context, video *database.Video, filePath string, offset float64, name string) error {
+	fileName := fmt.Sprintf("%s-%s.jpg", video.ID, name)
+	thumbnailPath := filepath.Join(cfg.assetsRoot, fileName)
+
+	err := extractFrame(ctx, filePath, offset, thumbnailPath)
+	if err != nil {
+		return err
+	}
+
+	previous := video.ThumbnailURL
+	thumbnailURL := fmt.Sprintf("http://localhost:8091/assets/%s", fileName)
+	video.ThumbnailURL = &thumbnailURL
+	video.ThumbnailGenerated = true
+
+	// the old generated frame is no longer referenced
+	if previous != nil && *previous != thumbnailURL {
+		if previousPath, ok := cfg.assetPathFromURL(*previous); ok {
+			if err := os.Remove(previousPath); err != nil && !os.IsNotExist(err) {
+				log.Printf("Couldn't remove old thumbnail %s: %v", previousPath, err)
+			}
+		}
+	}
+
+	return cfg.ensureBlurredThumbnail(ctx, video)
+}
+
+// extractFrame writes the frame at offset seconds into input as a JPEG.
+// input can be a file or a URL, ffmpeg only fetches what it needs to seek.
+func extractFrame(ctx context.Context, input string, offset float64, outputPath string) error {
+	return extractScaledFrame(ctx, input, offset, 0, outputPath)
+}
+
+// extractScaledFrame is extractFrame scaled to width pixels wide, 0 keeps
+// the video's size.
+func extractScaledFrame(ctx context.Context, input string, offset float64, width int, outputPath string) error {
+	args := []string{
+		"-y",
+		"-ss", strconv.FormatFloat(offset, 'f', 3, 64),
+		"-i", input,
+		"-frames:v", "1",
+		"-q:v", "3",
+	}
+	if width > 0 {
+		args = append(args, "-vf", fmt.Sprintf("scale=%d:-2", width))
+	}
+	args = append(args, outputPath)
+	cmd := ffmpegRunner.Command(ctx, "ffmpeg", args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return newCommandError("ffmpeg", err, stderr.Bytes())
+	}
+	return nil
+}
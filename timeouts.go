@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+const (
+	// most routes only touch the database, anything slower is stuck or a
+	// client trickling its request
+	defaultRouteTimeout = 15 * time.Second
+	// uploads stream up to a GB and are processed before the response
+	uploadRouteTimeout    = time.Hour
+	thumbnailRouteTimeout = 2 * time.Minute
+	// leaves a handler that gave up on its context time to send the error
+	routeWriteGrace = 5 * time.Second
+
+	// headers come before we know the route, so this applies everywhere
+	serverReadHeaderTimeout = 10 * time.Second
+	serverIdleTimeout       = 2 * time.Minute
+)
+
+// routeTimeouts overrides defaultRouteTimeout by mux pattern.
+var routeTimeouts = map[string]time.Duration{
+	"POST /api/video_upload/{videoID}":                  uploadRouteTimeout,
+	"POST /api/videos/{videoID}/replace":                uploadRouteTimeout,
+	"POST /api/upload_sessions/{sessionID}/complete":    uploadRouteTimeout,
+	"POST /api/thumbnail_upload/{videoID}":              thumbnailRouteTimeout,
+	"POST /api/videos/{videoID}/thumbnail/from-frame":   thumbnailRouteTimeout,
+	"POST /api/videos/{videoID}/thumbnail_variants":     thumbnailRouteTimeout,
+	"PUT /api/videos/{videoID}/audio_tracks/{language}": uploadRouteTimeout,
+	"PUT /api/organizations/me/bumpers/{position}":      uploadRouteTimeout,
+}
+
+// timeoutMiddleware bounds how long reading the request, handling it and
+// writing the response may take, depending on the route the mux picks.
+// Server-wide read and write timeouts can't tell an upload from a metadata
+// call, so they are extended here per request.
+func timeoutMiddleware(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timeout := defaultRouteTimeout
+		if _, pattern := mux.Handler(r); pattern != "" {
+			if override, ok := routeTimeouts[pattern]; ok {
+				timeout = override
+			}
+		}
+
+		deadline := time.Now().Add(timeout)
+		rc := http.NewResponseController(w)
+		// only fails for writers that don't support deadlines, the server's
+		// own timeouts still apply then
+		_ = rc.SetReadDeadline(deadline)
+		_ = rc.SetWriteDeadline(deadline.Add(routeWriteGrace))
+
+		ctx, cancel := context.WithDeadline(r.Context(), deadline)
+		defer cancel()
+		mux.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
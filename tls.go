@@ -0,0 +1,55 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// newACMECertManager obtains and renews certificates for a fixed set of
+// domains from an ACME CA, Let's Encrypt unless directoryURL says
+// otherwise. Keys and certificates are kept in cacheDir so restarts don't
+// hit the CA's rate limits.
+func newACMECertManager(directoryURL, email string, domains []string, cacheDir string) (*autocert.Manager, error) {
+	normalized := make([]string, 0, len(domains))
+	for _, domain := range domains {
+		domain = strings.ToLower(strings.TrimSpace(domain))
+		if domain != "" {
+			normalized = append(normalized, domain)
+		}
+	}
+	if len(normalized) == 0 {
+		return nil, errors.New("no domains to get certificates for")
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(normalized...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      email,
+	}
+	if directoryURL != "" {
+		m.Client = &acme.Client{DirectoryURL: directoryURL}
+	}
+	return m, nil
+}
+
+// httpsRedirectHandler sends plain HTTP requests to the same URL on the
+// HTTPS port.
+func httpsRedirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		target := "https://" + host + r.URL.RequestURI()
+		http.Redirect(w, r, target, http.StatusMovedPermanently)
+	})
+}
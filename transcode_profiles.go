@@ -0,0 +1,323 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// originalTranscodeProfile only remuxes uploads for fast start. It always
+// exists, deployments can't redefine it.
+const originalTranscodeProfile = "original"
+
+// transcodeProfile is a named set of ffmpeg settings uploads are processed
+// with. Each field is checked against an allowlist when profiles are loaded.
+type transcodeProfile struct {
+	Name      string                `json:"name"`
+	Container string                `json:"container"`
+	Video     transcodeVideoOptions `json:"video"`
+	Audio     transcodeAudioOptions `json:"audio"`
+	// HDR keeps an HDR rendition of HDR sources next to the tone-mapped SDR
+	// one. Profiles copying the video always keep it.
+	HDR bool `json:"hdr,omitempty"`
+	// dropExtraStreams leaves out subtitle and data streams MP4 can't
+	// hold, set for sources in other containers
+	dropExtraStreams bool
+	// toneMap converts HDR sources to SDR
+	toneMap bool
+	// hdrTransfer encodes a 10-bit HDR rendition with this color transfer
+	hdrTransfer string
+	// loudnessMeasured is the first loudnorm pass over the source
+	loudnessMeasured *loudnormMeasurement
+	// bumpers wraps the source in the owner's organization bumpers, picked
+	// per upload
+	bumpers bumperSelection
+}
+
+type transcodeVideoOptions struct {
+	Codec string `json:"codec"`
+	// CRF and Bitrate are mutually exclusive ways to control quality
+	CRF        *int   `json:"crf,omitempty"`
+	Bitrate    string `json:"bitrate,omitempty"`
+	MaxBitrate string `json:"max_bitrate,omitempty"`
+	Preset     string `json:"preset,omitempty"`
+	// MaxHeight downscales taller videos, keeping the aspect ratio
+	MaxHeight int `json:"max_height,omitempty"`
+	// PerTitle picks the bitrate of each video from how complex it is,
+	// instead of crf or bitrate
+	PerTitle *perTitleOptions `json:"per_title,omitempty"`
+}
+
+type transcodeAudioOptions struct {
+	Codec    string `json:"codec"`
+	Bitrate  string `json:"bitrate,omitempty"`
+	Channels int    `json:"channels,omitempty"`
+	// Loudnorm normalizes loudness to EBU R128 targets, in two passes
+	Loudnorm *loudnormOptions `json:"loudnorm,omitempty"`
+}
+
+type transcodeProfiles struct {
+	defaultName string
+	byName      map[string]transcodeProfile
+}
+
+var (
+	transcodeProfileNameRegexp = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+	transcodeBitrateRegexp     = regexp.MustCompile(`^[1-9][0-9]{0,5}[kM]$`)
+
+	transcodeContainers  = []string{"mp4"}
+	transcodeVideoCodecs = map[string][]string{
+		"copy": nil,
+		"h264": {"-c:v", "libx264", "-pix_fmt", "yuv420p"},
+		// hvc1 is the tag Apple players require for HEVC in MP4
+		"hevc": {"-c:v", "libx265", "-pix_fmt", "yuv420p", "-tag:v", "hvc1"},
+	}
+	transcodePresets     = []string{"ultrafast", "superfast", "veryfast", "faster", "fast", "medium", "slow", "slower", "veryslow"}
+	transcodeAudioCodecs = []string{"copy", "aac"}
+	transcodeChannels    = []int{1, 2, 6}
+)
+
+// loadTranscodeProfiles reads the profiles file, a JSON object like
+// {"default": "web", "profiles": [{"name": "web", ...}]}. Without a path only
+// the original profile is available.
+func loadTranscodeProfiles(path string) (transcodeProfiles, error) {
+	profiles := transcodeProfiles{
+		defaultName: originalTranscodeProfile,
+		byName: map[string]transcodeProfile{
+			originalTranscodeProfile: {
+				Name:      originalTranscodeProfile,
+				Container: "mp4",
+				Video:     transcodeVideoOptions{Codec: "copy"},
+				Audio:     transcodeAudioOptions{Codec: "copy"},
+			},
+		},
+	}
+	if path == "" {
+		return profiles, nil
+	}
+
+	dat, err := os.ReadFile(path)
+	if err != nil {
+		return transcodeProfiles{}, err
+	}
+	var file struct {
+		Default  string             `json:"default"`
+		Profiles []transcodeProfile `json:"profiles"`
+	}
+	err = json.Unmarshal(dat, &file)
+	if err != nil {
+		return transcodeProfiles{}, err
+	}
+
+	for _, profile := range file.Profiles {
+		if _, ok := profiles.byName[profile.Name]; ok {
+			return transcodeProfiles{}, fmt.Errorf("profile %q is defined more than once", profile.Name)
+		}
+		if err := profile.validate(); err != nil {
+			return transcodeProfiles{}, fmt.Errorf("profile %q: %w", profile.Name, err)
+		}
+		profiles.byName[profile.Name] = profile
+	}
+
+	if file.Default != "" {
+		if _, ok := profiles.byName[file.Default]; !ok {
+			return transcodeProfiles{}, fmt.Errorf("default profile %q isn't defined", file.Default)
+		}
+		profiles.defaultName = file.Default
+	}
+	return profiles, nil
+}
+
+func (p transcodeProfile) validate() error {
+	if !transcodeProfileNameRegexp.MatchString(p.Name) {
+		return errors.New("name must be 1-32 lowercase letters, digits, dashes or underscores")
+	}
+	if !slices.Contains(transcodeContainers, p.Container) {
+		return fmt.Errorf("container must be one of %v", transcodeContainers)
+	}
+
+	video := p.Video
+	if _, ok := transcodeVideoCodecs[video.Codec]; !ok {
+		return errors.New("video codec must be copy, h264 or hevc")
+	}
+	if video.Codec == "copy" {
+		if video.CRF != nil || video.Bitrate != "" || video.MaxBitrate != "" || video.Preset != "" || video.MaxHeight != 0 || video.PerTitle != nil {
+			return errors.New("copied video can't have encoding options")
+		}
+	} else {
+		if video.PerTitle != nil {
+			if video.CRF != nil || video.Bitrate != "" || video.MaxBitrate != "" {
+				return errors.New("per_title video can't have crf, bitrate or max_bitrate")
+			}
+			if err := video.PerTitle.validate(); err != nil {
+				return err
+			}
+		} else if (video.CRF == nil) == (video.Bitrate == "") {
+			return errors.New("video needs either crf, bitrate or per_title")
+		}
+		if video.CRF != nil && (*video.CRF < 0 || *video.CRF > 51) {
+			return errors.New("crf must be between 0 and 51")
+		}
+		if video.Bitrate != "" && !transcodeBitrateRegexp.MatchString(video.Bitrate) {
+			return errors.New("video bitrate must look like 2500k or 5M")
+		}
+		if video.MaxBitrate != "" && !transcodeBitrateRegexp.MatchString(video.MaxBitrate) {
+			return errors.New("video max_bitrate must look like 2500k or 5M")
+		}
+		if video.Preset != "" && !slices.Contains(transcodePresets, video.Preset) {
+			return fmt.Errorf("preset must be one of %v", transcodePresets)
+		}
+		if video.MaxHeight != 0 && (video.MaxHeight < 144 || video.MaxHeight > 4320 || video.MaxHeight%2 != 0) {
+			return errors.New("max_height must be an even number between 144 and 4320")
+		}
+	}
+
+	if p.HDR && video.Codec != "hevc" {
+		return errors.New("hdr needs the hevc video codec")
+	}
+
+	audio := p.Audio
+	if !slices.Contains(transcodeAudioCodecs, audio.Codec) {
+		return fmt.Errorf("audio codec must be one of %v", transcodeAudioCodecs)
+	}
+	if audio.Codec == "copy" {
+		if audio.Bitrate != "" || audio.Channels != 0 || audio.Loudnorm != nil {
+			return errors.New("copied audio can't have encoding options")
+		}
+	} else {
+		if audio.Loudnorm != nil {
+			if err := audio.Loudnorm.validate(); err != nil {
+				return err
+			}
+		}
+		if audio.Bitrate != "" && !transcodeBitrateRegexp.MatchString(audio.Bitrate) {
+			return errors.New("audio bitrate must look like 128k")
+		}
+		if audio.Channels != 0 && !slices.Contains(transcodeChannels, audio.Channels) {
+			return fmt.Errorf("channels must be one of %v", transcodeChannels)
+		}
+	}
+	return nil
+}
+
+// ffmpegArgs returns the codec and container options of the profile. Every
+// stream is copied unless the profile re-encodes it.
+func (p transcodeProfile) ffmpegArgs() []string {
+	args := append([]string{"-c", "copy"}, p.videoArgs()...)
+
+	audio := p.Audio
+	if audio.Codec != "copy" {
+		args = append(args, "-c:a", audio.Codec)
+		if audio.Bitrate != "" {
+			args = append(args, "-b:a", audio.Bitrate)
+		}
+		if audio.Channels != 0 {
+			args = append(args, "-ac", strconv.Itoa(audio.Channels))
+		}
+		if audio.Loudnorm != nil {
+			// loudnorm upsamples to 192 kHz internally
+			args = append(args, "-af", audio.Loudnorm.filter(p.loudnessMeasured), "-ar", "48000")
+		}
+	}
+
+	if p.dropExtraStreams {
+		args = append(args, "-sn", "-dn")
+	}
+
+	return append(args, "-movflags", "faststart", "-f", p.Container)
+}
+
+// videoArgs returns the options re-encoding the video, none when it's
+// copied.
+func (p transcodeProfile) videoArgs() []string {
+	video := p.Video
+	if video.Codec == "copy" {
+		return nil
+	}
+
+	var args []string
+	if p.hdrTransfer != "" {
+		args = append(args, hdrVideoCodecArgs(p.hdrTransfer)...)
+	} else {
+		args = append(args, transcodeVideoCodecs[video.Codec]...)
+	}
+	if video.Preset != "" {
+		args = append(args, "-preset", video.Preset)
+	}
+	if video.CRF != nil {
+		args = append(args, "-crf", strconv.Itoa(*video.CRF))
+	}
+	if video.Bitrate != "" {
+		args = append(args, "-b:v", video.Bitrate)
+	}
+	if video.MaxBitrate != "" {
+		args = append(args, "-maxrate", video.MaxBitrate, "-bufsize", video.MaxBitrate)
+	}
+	if video.PerTitle != nil && video.CRF == nil && video.Bitrate == "" {
+		// no bitrate was picked for this encode, aim for the quality the
+		// samples are measured at
+		args = append(args, "-crf", strconv.Itoa(video.PerTitle.CRF))
+	}
+
+	filters := []string{}
+	if video.MaxHeight != 0 {
+		filters = append(filters, fmt.Sprintf("scale=-2:'min(ih,%d)'", video.MaxHeight))
+	}
+	if p.toneMap {
+		filters = append(filters, sdrToneMapFilter)
+		args = append(args, "-color_primaries", "bt709", "-color_trc", "bt709", "-colorspace", "bt709")
+	}
+	if len(filters) > 0 {
+		args = append(args, "-vf", strings.Join(filters, ","))
+	}
+	return args
+}
+
+func (cfg *apiConfig) defaultTranscodeProfile() transcodeProfile {
+	return cfg.transcodeProfiles.byName[cfg.transcodeProfiles.defaultName]
+}
+
+// transcodeProfileFromRequest returns the profile named by the request's
+// profile query parameter, or the default one.
+func (cfg *apiConfig) transcodeProfileFromRequest(r *http.Request) (transcodeProfile, error) {
+	return cfg.transcodeProfileByName(r.URL.Query().Get("profile"))
+}
+
+// transcodeProfileByName returns the named profile, or the default one when
+// name is empty.
+func (cfg *apiConfig) transcodeProfileByName(name string) (transcodeProfile, error) {
+	if name == "" {
+		return cfg.defaultTranscodeProfile(), nil
+	}
+	profile, ok := cfg.transcodeProfiles.byName[name]
+	if !ok {
+		return transcodeProfile{}, fmt.Errorf("unknown transcode profile %q", name)
+	}
+	return profile, nil
+}
+
+func (cfg *apiConfig) handlerTranscodeProfilesRetrieve(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Default  string             `json:"default"`
+		Profiles []transcodeProfile `json:"profiles"`
+	}
+
+	profiles := make([]transcodeProfile, 0, len(cfg.transcodeProfiles.byName))
+	for _, profile := range cfg.transcodeProfiles.byName {
+		profiles = append(profiles, profile)
+	}
+	slices.SortFunc(profiles, func(a, b transcodeProfile) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	respondWithJSON(w, http.StatusOK, response{
+		Default:  cfg.transcodeProfiles.defaultName,
+		Profiles: profiles,
+	})
+}
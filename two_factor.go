@@ -0,0 +1,331 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	// shown as the account's issuer in authenticator apps
+	totpIssuer        = "Tubely"
+	recoveryCodeCount = 10
+)
+
+// handlerTOTPEnroll starts setting up an authenticator app. The secret only
+// takes effect once a code from the app is confirmed.
+func (cfg *apiConfig) handlerTOTPEnroll(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		Secret          string `json:"secret"`
+		ProvisioningURI string `json:"provisioning_uri"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	user, err := cfg.db.GetUser(userID)
+	if err != nil || user == nil {
+		respondWithError(w, http.StatusNotFound, errCodeUserNotFound, "Couldn't find user", err)
+		return
+	}
+
+	secret, err := auth.MakeTOTPSecret()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create secret", err)
+		return
+	}
+	started, err := cfg.db.StartTOTPEnrollment(userID, secret)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save secret", err)
+		return
+	}
+	if !started {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "Two-factor authentication is already enabled", nil)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		Secret:          secret,
+		ProvisioningURI: auth.TOTPProvisioningURI(secret, totpIssuer, user.Email),
+	})
+}
+
+// handlerTOTPConfirm enables two-factor authentication once the user proves
+// their app produces the right codes. The recovery codes are only ever shown
+// in this response.
+func (cfg *apiConfig) handlerTOTPConfirm(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+	}
+	type response struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	twoFactor, err := cfg.db.GetTwoFactor(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get two-factor settings", err)
+		return
+	}
+	if twoFactor.EnabledAt != nil {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "Two-factor authentication is already enabled", nil)
+		return
+	}
+	if twoFactor.Secret == nil {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "Start the enrollment first", nil)
+		return
+	}
+	step, ok := auth.ValidateTOTP(*twoFactor.Secret, params.Code, time.Now())
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Incorrect code", nil)
+		return
+	}
+
+	codes, hashes, err := makeRecoveryCodes()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create recovery codes", err)
+		return
+	}
+	err = cfg.db.EnableTOTP(userID, step, hashes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't enable two-factor authentication", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{RecoveryCodes: codes})
+}
+
+// handlerTOTPDisable turns two-factor authentication off, which takes a
+// current code or a recovery code. Owners of organizations requiring it
+// can't.
+func (cfg *apiConfig) handlerTOTPDisable(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recovery_code"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	twoFactor, err := cfg.db.GetTwoFactor(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get two-factor settings", err)
+		return
+	}
+	if twoFactor.EnabledAt == nil {
+		// drops an enrollment that was never confirmed
+		err = cfg.db.DisableTOTP(userID)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't disable two-factor authentication", err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	required, err := cfg.twoFactorRequired(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get organization", err)
+		return
+	}
+	if required {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "Your organization requires two-factor authentication", nil)
+		return
+	}
+
+	ok, err := cfg.checkSecondFactor(r, userID, twoFactor, params.Code, params.RecoveryCode)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't check code", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, errCodeInvalidCredentials, "Incorrect code", nil)
+		return
+	}
+
+	err = cfg.db.DisableTOTP(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't disable two-factor authentication", err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handlerRecoveryCodesRegenerate replaces the user's recovery codes, for when
+// they ran low or were exposed. It takes a current code.
+func (cfg *apiConfig) handlerRecoveryCodesRegenerate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Code string `json:"code"`
+	}
+	type response struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err = decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	twoFactor, err := cfg.db.GetTwoFactor(userID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get two-factor settings", err)
+		return
+	}
+	if twoFactor.EnabledAt == nil {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "Two-factor authentication isn't enabled", nil)
+		return
+	}
+	ok, err := cfg.checkSecondFactor(r, userID, twoFactor, params.Code, "")
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't check code", err)
+		return
+	}
+	if !ok {
+		respondWithError(w, http.StatusUnauthorized, errCodeInvalidCredentials, "Incorrect code", nil)
+		return
+	}
+
+	codes, hashes, err := makeRecoveryCodes()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create recovery codes", err)
+		return
+	}
+	err = cfg.db.ReplaceRecoveryCodes(userID, hashes)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save recovery codes", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, response{RecoveryCodes: codes})
+}
+
+// checkSecondFactor verifies a TOTP code, or a recovery code when no TOTP
+// code is given. Accepted codes are used up.
+func (cfg *apiConfig) checkSecondFactor(r *http.Request, userID uuid.UUID, twoFactor database.TwoFactor, code, recoveryCode string) (bool, error) {
+	if code != "" {
+		if twoFactor.Secret == nil {
+			return false, nil
+		}
+		step, ok := auth.ValidateTOTP(*twoFactor.Secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+		return cfg.db.UseTOTPStep(userID, step)
+	}
+	if recoveryCode == "" {
+		return false, nil
+	}
+
+	used, err := cfg.db.UseRecoveryCode(userID, hashRecoveryCode(recoveryCode))
+	if err != nil || !used {
+		return false, err
+	}
+	ipAddress := ""
+	if addr, ok := cfg.clientIP(r); ok {
+		ipAddress = addr.String()
+	}
+	err = cfg.db.CreateAuditLogEntry(database.CreateAuditLogEntryParams{
+		UserID:    userID,
+		Action:    database.AuditActionRecoveryCodeUsed,
+		IPAddress: ipAddress,
+	})
+	return err == nil, err
+}
+
+// twoFactorRequired reports whether the user owns an organization that
+// requires two-factor authentication of its owners.
+func (cfg *apiConfig) twoFactorRequired(userID uuid.UUID) (bool, error) {
+	member, err := cfg.db.GetOrganizationMember(userID)
+	if err != nil {
+		return false, err
+	}
+	if member.OrganizationID == uuid.Nil || member.Role != database.OrganizationRoleOwner {
+		return false, nil
+	}
+	org, err := cfg.db.GetOrganization(member.OrganizationID)
+	if err != nil {
+		return false, err
+	}
+	return org.RequireTwoFactor, nil
+}
+
+// makeRecoveryCodes returns new recovery codes for the user and the hashes
+// to store.
+func makeRecoveryCodes() ([]string, []string, error) {
+	codes, err := auth.MakeRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		return nil, nil, err
+	}
+	hashes := make([]string, 0, len(codes))
+	for _, code := range codes {
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	hash := sha256.Sum256([]byte(auth.NormalizeRecoveryCode(code)))
+	return hex.EncodeToString(hash[:])
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func newTestConfig(t *testing.T) *apiConfig {
+	t.Helper()
+	db, err := database.NewClient(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("Couldn't open test database: %v", err)
+	}
+	return &apiConfig{db: db}
+}
+
+// enrollTOTP gives a new user two-factor authentication with the returned
+// secret and recovery codes.
+func enrollTOTP(t *testing.T, cfg *apiConfig) (uuid.UUID, string, []string) {
+	t.Helper()
+	user, err := cfg.db.CreateUser(database.CreateUserParams{Email: uuid.NewString() + "@example.com", Password: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, err := auth.MakeTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := cfg.db.StartTOTPEnrollment(user.ID, secret); err != nil || !ok {
+		t.Fatalf("StartTOTPEnrollment = %v, %v", ok, err)
+	}
+	codes, hashes, err := makeRecoveryCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// enrolled with a code from a while ago, so current codes are new
+	if err := cfg.db.EnableTOTP(user.ID, auth.TOTPStep(time.Now())-10, hashes); err != nil {
+		t.Fatal(err)
+	}
+	return user.ID, secret, codes
+}
+
+func checkSecondFactor(t *testing.T, cfg *apiConfig, userID uuid.UUID, code, recoveryCode string) bool {
+	t.Helper()
+	twoFactor, err := cfg.db.GetTwoFactor(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := cfg.checkSecondFactor(httptest.NewRequest("POST", "/api/login", nil), userID, twoFactor, code, recoveryCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ok
+}
+
+func TestCheckSecondFactorRefusesReplayedCode(t *testing.T) {
+	cfg := newTestConfig(t)
+	userID, secret, _ := enrollTOTP(t, cfg)
+
+	step := auth.TOTPStep(time.Now())
+	code, err := auth.TOTPCode(secret, step)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !checkSecondFactor(t, cfg, userID, code, "") {
+		t.Fatal("current code was refused")
+	}
+	if checkSecondFactor(t, cfg, userID, code, "") {
+		t.Error("the same code was accepted twice")
+	}
+
+	// a code from the previous step is still in the window, but can't be
+	// used once a later one was
+	previous, err := auth.TOTPCode(secret, step-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkSecondFactor(t, cfg, userID, previous, "") {
+		t.Error("a code older than the last accepted one was accepted")
+	}
+}
+
+func TestUseTOTPStep(t *testing.T) {
+	cfg := newTestConfig(t)
+	userID, _, _ := enrollTOTP(t, cfg)
+	step := auth.TOTPStep(time.Now())
+
+	if ok, err := cfg.db.UseTOTPStep(userID, step); err != nil || !ok {
+		t.Fatalf("first use = %v, %v, want true", ok, err)
+	}
+	if ok, err := cfg.db.UseTOTPStep(userID, step); err != nil || ok {
+		t.Fatalf("replay = %v, %v, want false", ok, err)
+	}
+	if ok, err := cfg.db.UseTOTPStep(userID, step-1); err != nil || ok {
+		t.Fatalf("earlier step = %v, %v, want false", ok, err)
+	}
+	if ok, err := cfg.db.UseTOTPStep(userID, step+1); err != nil || !ok {
+		t.Fatalf("next step = %v, %v, want true", ok, err)
+	}
+}
+
+func TestCheckSecondFactorRecoveryCodeOnce(t *testing.T) {
+	cfg := newTestConfig(t)
+	userID, _, codes := enrollTOTP(t, cfg)
+
+	// typed back in the way people do
+	typed := "  " + codes[0][:5] + " " + codes[0][6:] + " "
+	if !checkSecondFactor(t, cfg, userID, "", typed) {
+		t.Fatal("recovery code was refused")
+	}
+	if checkSecondFactor(t, cfg, userID, "", codes[0]) {
+		t.Error("recovery code was accepted a second time")
+	}
+	if !checkSecondFactor(t, cfg, userID, "", codes[1]) {
+		t.Error("another recovery code was refused after the first was used")
+	}
+
+	twoFactor, err := cfg.db.GetTwoFactor(userID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if twoFactor.RecoveryCodesLeft != len(codes)-2 {
+		t.Errorf("%d recovery codes left, want %d", twoFactor.RecoveryCodesLeft, len(codes)-2)
+	}
+
+	entries, err := cfg.db.GetAuditLogEntries(database.AuditLogFilter{UserID: &userID, Action: database.AuditActionRecoveryCodeUsed}, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("%d audit log entries of used recovery codes, want 2", len(entries))
+	}
+}
+
+func TestCheckSecondFactorRefusesCodeOutsideWindow(t *testing.T) {
+	cfg := newTestConfig(t)
+	userID, secret, _ := enrollTOTP(t, cfg)
+
+	if checkSecondFactor(t, cfg, userID, "", "") {
+		t.Error("no code was accepted")
+	}
+	future, err := auth.TOTPCode(secret, auth.TOTPStep(time.Now())+5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if checkSecondFactor(t, cfg, userID, future, "") {
+		t.Error("a code from outside the window was accepted")
+	}
+}
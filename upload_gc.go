@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+const (
+	uploadGCInterval = 15 * time.Minute
+	// uploads that start just before their session expires may still land,
+	// and their S3 events take a moment to arrive
+	uploadSessionGracePeriod = time.Hour
+	uploadStagingPrefix      = "uploads/"
+)
+
+// abortedMultipartUploads counts the multipart uploads aborted since the
+// process started.
+var abortedMultipartUploads atomic.Int64
+
+// cleanUpAbandonedUploads marks upload sessions that expired without an
+// upload as abandoned and deletes whatever they staged. Multipart uploads
+// to the staging prefix that were never finished are aborted, S3 keeps
+// billing for their parts otherwise. Expired upload grants are dropped.
+func (cfg *apiConfig) cleanUpAbandonedUploads(ctx context.Context) error {
+	db := cfg.db.WithContext(ctx)
+	cutoff := time.Now().UTC().Add(-uploadSessionGracePeriod)
+
+	sessions, err := db.GetUploadSessionsExpiredBefore(cutoff)
+	if err != nil {
+		return err
+	}
+	abandoned := 0
+	for _, session := range sessions {
+		ok, err := db.AbandonUploadSession(session.ID)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			// completed or picked up since we listed it
+			continue
+		}
+		abandoned++
+		// the upload may have landed without the session being completed
+		err = cfg.deleteObject(ctx, session.S3Key)
+		if err != nil {
+			return fmt.Errorf("couldn't delete staged upload %s: %w", session.S3Key, err)
+		}
+	}
+	if abandoned > 0 {
+		log.Printf("Cleaned up %d abandoned upload sessions", abandoned)
+	}
+
+	aborted, err := cfg.abortStaleMultipartUploads(ctx, uploadStagingPrefix, cutoff.Add(-cfg.uploadSessionTTL))
+	if err != nil {
+		return err
+	}
+	if aborted > 0 {
+		log.Printf("Aborted %d stale multipart uploads", aborted)
+	}
+
+	expired, err := db.DeleteUploadGrantsExpiredBefore(cutoff)
+	if err != nil {
+		return err
+	}
+	if expired > 0 {
+		log.Printf("Deleted %d expired upload grants", expired)
+	}
+	return nil
+}
+
+// abortStaleMultipartUploads aborts the multipart uploads under prefix that
+// were started before cutoff. It returns how many it aborted.
+func (cfg *apiConfig) abortStaleMultipartUploads(ctx context.Context, prefix string, cutoff time.Time) (int, error) {
+	route := cfg.storageRoute(prefix)
+	paginator := s3.NewListMultipartUploadsPaginator(cfg.s3Client, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(route.Bucket),
+		Prefix: aws.String(route.bucketKey(prefix)),
+	})
+
+	aborted := 0
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return aborted, err
+		}
+		for _, upload := range page.Uploads {
+			if !aws.ToTime(upload.Initiated).Before(cutoff) {
+				continue
+			}
+			_, err := cfg.s3Client.AbortMultipartUpload(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(route.Bucket),
+				Key:      upload.Key,
+				UploadId: upload.UploadId,
+			})
+			if err != nil {
+				return aborted, fmt.Errorf("couldn't abort multipart upload of %s: %w", aws.ToString(upload.Key), err)
+			}
+			aborted++
+			abortedMultipartUploads.Add(1)
+		}
+	}
+	return aborted, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	uploadGrantHeader     = "X-Upload-Grant"
+	defaultUploadGrantTTL = time.Hour
+	maxUploadGrantTTL     = 7 * 24 * time.Hour
+	// same limit as direct uploads
+	maxUploadGrantBytes = 1 << 30
+)
+
+// handlerUploadGrantCreate lets the owner's backend hand one upload to the
+// video to someone else, typically a user of its own app, without sharing
+// its credentials. The grant works once, until it expires, for files up to
+// max_bytes.
+func (cfg *apiConfig) handlerUploadGrantCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		MaxBytes         int64 `json:"max_bytes"`
+		ExpiresInSeconds int   `json:"expires_in_seconds"`
+	}
+	type response struct {
+		database.UploadGrant
+		// Token goes in the X-Upload-Grant header of a multipart POST to
+		// UploadURL. It isn't shown again.
+		Token     string `json:"token"`
+		UploadURL string `json:"upload_url"`
+	}
+
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+	if params.MaxBytes == 0 {
+		params.MaxBytes = maxUploadGrantBytes
+	}
+	if params.MaxBytes < 0 || params.MaxBytes > maxUploadGrantBytes {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("max_bytes must be between 1 and %d", maxUploadGrantBytes), nil)
+		return
+	}
+	ttl := defaultUploadGrantTTL
+	if params.ExpiresInSeconds != 0 {
+		ttl = time.Duration(params.ExpiresInSeconds) * time.Second
+	}
+	if ttl <= 0 || ttl > maxUploadGrantTTL {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("expires_in_seconds must be between 1 and %d", int(maxUploadGrantTTL.Seconds())), nil)
+		return
+	}
+
+	token, err := auth.MakeRefreshToken()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create upload grant", err)
+		return
+	}
+	grant, err := cfg.db.CreateUploadGrant(database.CreateUploadGrantParams{
+		VideoID:   video.ID,
+		UserID:    video.UserID,
+		TokenHash: hashUploadGrantToken(token),
+		MaxBytes:  params.MaxBytes,
+		ExpiresAt: time.Now().UTC().Add(ttl),
+	})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create upload grant", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusCreated, response{
+		UploadGrant: grant,
+		Token:       token,
+		UploadURL:   fmt.Sprintf("%s/api/video_upload/%s", cfg.appBaseURL, video.ID),
+	})
+}
+
+// receiveGrantedUpload handles an upload authorized by a grant rather than
+// the owner's JWT. The grant is used up even if the upload then fails.
+func (cfg *apiConfig) receiveGrantedUpload(w http.ResponseWriter, r *http.Request, videoID uuid.UUID, token string) {
+	grant, err := cfg.db.ClaimUploadGrant(hashUploadGrantToken(token), videoID, time.Now().UTC())
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't check upload grant", err)
+		return
+	}
+	if grant.ID == uuid.Nil {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "Upload grant is invalid, used or expired", nil)
+		return
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil || video.UserID != grant.UserID {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil)
+		return
+	}
+
+	// room for the multipart framing around the file
+	r.Body = http.MaxBytesReader(w, r.Body, grant.MaxBytes+64<<10)
+	cfg.receiveVideoFile(w, r, video)
+}
+
+func hashUploadGrantToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
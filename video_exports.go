@@ -0,0 +1,395 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	jobTypeVideoExport = "video_export"
+
+	videoExportPurgeInterval = time.Hour
+)
+
+// renditions a download bundle can include, of the current version
+const (
+	exportRenditionSDR      = "sdr"
+	exportRenditionHDR      = "hdr"
+	exportRenditionOriginal = "original"
+)
+
+type videoExportPayload struct {
+	ExportID uuid.UUID `json:"export_id"`
+}
+
+// handlerVideoExportCreate queues assembling a zip of the video's files for
+// its owner. The body picks the renditions, caption languages and whether
+// the thumbnail goes in; metadata is always included. Renditions default
+// to sdr and captions to every language.
+func (cfg *apiConfig) handlerVideoExportCreate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Renditions []string  `json:"renditions"`
+		Captions   *[]string `json:"captions"`
+		Thumbnail  *bool     `json:"thumbnail"`
+	}
+
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	params := parameters{}
+	err := json.NewDecoder(r.Body).Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	options := database.VideoExportOptions{
+		Renditions: params.Renditions,
+		Thumbnail:  params.Thumbnail == nil || *params.Thumbnail,
+	}
+	if options.Renditions == nil {
+		options.Renditions = []string{exportRenditionSDR}
+	}
+	if params.Captions != nil {
+		options.Captions = *params.Captions
+	}
+
+	versions, err := cfg.db.GetVideoVersions(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't retrieve versions", err)
+		return
+	}
+	if len(versions) == 0 && len(options.Renditions) > 0 {
+		respondWithError(w, http.StatusConflict, errCodeConflict, "Video has no uploaded file", nil)
+		return
+	}
+	for i, rendition := range options.Renditions {
+		if slices.Contains(options.Renditions[:i], rendition) {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("Rendition %s is listed twice", rendition), nil)
+			return
+		}
+		if _, err := exportRenditionKey(cfg.currentVideoVersion(video, versions), rendition); err != nil {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("Can't export rendition: %v", err), err)
+			return
+		}
+	}
+
+	languages, err := cfg.db.GetCaptionLanguages(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get captions", err)
+		return
+	}
+	for _, language := range options.Captions {
+		if !slices.Contains(languages, language) {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("Video has no %s captions", language), nil)
+			return
+		}
+	}
+
+	if slices.Contains(options.Renditions, exportRenditionOriginal) {
+		ipAddress := ""
+		if addr, ok := cfg.clientIP(r); ok {
+			ipAddress = addr.String()
+		}
+		// the bundle is a way to download the original like any other
+		err = cfg.db.CreateAuditLogEntry(database.CreateAuditLogEntryParams{
+			UserID:    video.UserID,
+			Action:    database.AuditActionSourceDownload,
+			VideoID:   &video.ID,
+			IPAddress: ipAddress,
+			Detail:    "export",
+		})
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't record download", err)
+			return
+		}
+	}
+
+	export, err := cfg.db.CreateVideoExport(video.ID, video.UserID, options)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create export", err)
+		return
+	}
+
+	_, err = cfg.enqueueJob(jobTypeVideoExport, &video.ID, videoExportPayload{ExportID: export.ID})
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create export job", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusAccepted, export)
+}
+
+// handlerVideoExportGet reports on an export, with a download link once
+// it's ready that stays valid until the zip expires.
+func (cfg *apiConfig) handlerVideoExportGet(w http.ResponseWriter, r *http.Request) {
+	type response struct {
+		database.VideoExport
+		DownloadURL *string `json:"download_url"`
+	}
+
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return
+	}
+	exportID, err := uuid.Parse(r.PathValue("exportID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid ID", err)
+		return
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	export, err := cfg.db.GetVideoExport(exportID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get export", err)
+		return
+	}
+	if export.ID == uuid.Nil || export.UserID != userID || export.VideoID != videoID {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Couldn't find export", nil)
+		return
+	}
+
+	resp := response{VideoExport: export}
+	if export.Status == database.VideoExportStatusReady && export.S3Key != nil && export.ExpiresAt != nil {
+		remaining := time.Until(*export.ExpiresAt)
+		if remaining <= 0 {
+			respondWithError(w, http.StatusGone, errCodeNotFound, "Export expired", nil)
+			return
+		}
+		downloadURL, err := cfg.presignGetObject(r.Context(), *export.S3Key, remaining)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't create download URL", err)
+			return
+		}
+		resp.DownloadURL = &downloadURL
+	}
+
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+func (cfg *apiConfig) runVideoExportJob(ctx context.Context, job database.Job) error {
+	var payload videoExportPayload
+	if err := json.Unmarshal(job.Payload, &payload); err != nil {
+		return err
+	}
+
+	export, err := cfg.db.GetVideoExport(payload.ExportID)
+	if err != nil {
+		return err
+	}
+	if export.ID == uuid.Nil {
+		return fmt.Errorf("export %s no longer exists", payload.ExportID)
+	}
+
+	err = cfg.buildVideoExport(ctx, export)
+	if err != nil {
+		if failErr := cfg.db.FailVideoExport(export.ID, err.Error()); failErr != nil {
+			return failErr
+		}
+		return err
+	}
+	return nil
+}
+
+func (cfg *apiConfig) buildVideoExport(ctx context.Context, export database.VideoExport) error {
+	type metadata struct {
+		Video        database.Video              `json:"video"`
+		Chapters     []database.Chapter          `json:"chapters"`
+		Translations []database.VideoTranslation `json:"translations"`
+	}
+
+	video, err := cfg.db.GetVideo(export.VideoID)
+	if err != nil {
+		return err
+	}
+	if video.ID == uuid.Nil {
+		return fmt.Errorf("video %s no longer exists", export.VideoID)
+	}
+
+	tempFile, err := os.CreateTemp("", "tubely-video-export.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	archive := zip.NewWriter(tempFile)
+
+	chapters, err := cfg.db.GetChapters(video.ID)
+	if err != nil {
+		return err
+	}
+	translations, err := cfg.db.GetVideoTranslations(video.ID)
+	if err != nil {
+		return err
+	}
+	err = writeZipJSON(archive, "metadata.json", metadata{Video: video, Chapters: chapters, Translations: translations})
+	if err != nil {
+		return err
+	}
+
+	if len(export.Options.Renditions) > 0 {
+		versions, err := cfg.db.GetVideoVersions(video.ID)
+		if err != nil {
+			return err
+		}
+		if len(versions) == 0 {
+			return fmt.Errorf("video %s has no uploaded file", video.ID)
+		}
+		version := cfg.currentVideoVersion(video, versions)
+		for _, rendition := range export.Options.Renditions {
+			key, err := exportRenditionKey(version, rendition)
+			if err != nil {
+				return err
+			}
+			name := fmt.Sprintf("renditions/%s%s", rendition, filepath.Ext(key))
+			// video is already compressed, don't spend time deflating it
+			f, err := archive.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store, Modified: version.CreatedAt})
+			if err != nil {
+				return err
+			}
+			err = cfg.downloadObject(ctx, key, f)
+			if err != nil {
+				return fmt.Errorf("couldn't download %s: %w", key, err)
+			}
+		}
+	}
+
+	languages := export.Options.Captions
+	if languages == nil {
+		languages, err = cfg.db.GetCaptionLanguages(video.ID)
+		if err != nil {
+			return err
+		}
+	}
+	for _, language := range languages {
+		cues, err := cfg.db.GetCaptions(video.ID, language)
+		if err != nil {
+			return err
+		}
+		if len(cues) == 0 {
+			continue
+		}
+		f, err := archive.Create(fmt.Sprintf("captions/%s.vtt", language))
+		if err != nil {
+			return err
+		}
+		writeWebVTT(f, cues)
+	}
+
+	if export.Options.Thumbnail && video.ThumbnailURL != nil {
+		if thumbnailPath, ok := cfg.assetPathFromURL(*video.ThumbnailURL); ok {
+			err = copyFileToZip(archive, "thumbnail"+filepath.Ext(thumbnailPath), thumbnailPath)
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return err
+	}
+
+	_, err = tempFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	enc, err := cfg.objectEncryptionForUser(video.UserID)
+	if err != nil {
+		return err
+	}
+	tags, err := cfg.objectTagsForUser(video.UserID)
+	if err != nil {
+		return err
+	}
+	key := videoExportKey(video.ID, export.ID)
+	err = cfg.putObject(ctx, key, "application/zip", tempFile, enc, tags)
+	if err != nil {
+		return fmt.Errorf("couldn't upload export: %w", err)
+	}
+
+	return cfg.db.CompleteVideoExport(export.ID, key, time.Now().Add(exportLinkExpiry))
+}
+
+// videoExportKey keeps a video's exports under a prefix of its own, so
+// they go with the video's other files when it's deleted.
+func videoExportKey(videoID, exportID uuid.UUID) string {
+	return fmt.Sprintf("%s%s.zip", videoExportPrefix(videoID), exportID)
+}
+
+func videoExportPrefix(videoID uuid.UUID) string {
+	return fmt.Sprintf("exports/videos/%s/", videoID)
+}
+
+// exportRenditionKey returns the key of the rendition of the version.
+func exportRenditionKey(version database.VideoVersion, rendition string) (string, error) {
+	switch rendition {
+	case exportRenditionSDR:
+		return version.S3Key, nil
+	case exportRenditionHDR:
+		if version.HDRKey == nil {
+			return "", fmt.Errorf("video has no hdr rendition")
+		}
+		return *version.HDRKey, nil
+	case exportRenditionOriginal:
+		if version.SourceKey == nil {
+			return "", fmt.Errorf("original isn't stored")
+		}
+		return *version.SourceKey, nil
+	}
+	return "", fmt.Errorf("unknown rendition %q, must be sdr, hdr or original", rendition)
+}
+
+// purgeExpiredVideoExports deletes the zips of exports whose links expired.
+func (cfg *apiConfig) purgeExpiredVideoExports(ctx context.Context) error {
+	exports, err := cfg.db.GetExpiredVideoExports(time.Now())
+	if err != nil {
+		return err
+	}
+
+	for _, export := range exports {
+		if export.S3Key != nil {
+			err = cfg.deleteObject(ctx, *export.S3Key)
+			if err != nil {
+				return fmt.Errorf("couldn't delete export %s: %w", export.ID, err)
+			}
+		}
+		err = cfg.db.DeleteVideoExport(export.ID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(exports) > 0 {
+		log.Printf("Purged %d expired video exports", len(exports))
+	}
+	return nil
+}
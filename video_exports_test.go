@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+func TestHandlerVideoExportCreate(t *testing.T) {
+	cfg := newTestConfig(t)
+	cfg.jwtSecret = "secret"
+	cfg.jobQueue = dbJobQueue{db: cfg.db, visibilityTimeout: time.Minute}
+
+	userID := uuid.New()
+	video, err := cfg.db.CreateVideo(database.CreateVideoParams{Title: "Boots", UserID: userID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := auth.MakeJWT(userID, uuid.New(), cfg.jwtSecret, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	export := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/api/videos/"+video.ID.String()+"/export", strings.NewReader(body))
+		req.SetPathValue("videoID", video.ID.String())
+		req.Header.Set("Authorization", "Bearer "+token)
+		w := httptest.NewRecorder()
+		cfg.handlerVideoExportCreate(w, req)
+		return w
+	}
+
+	if w := export(`{}`); w.Code != http.StatusConflict {
+		t.Errorf("without a file: status %d, want 409", w.Code)
+	}
+	// metadata and captions alone don't need one
+	if w := export(`{"renditions":[]}`); w.Code != http.StatusAccepted {
+		t.Errorf("without renditions: status %d: %s", w.Code, w.Body)
+	}
+
+	_, err = cfg.db.CreateVideoVersion(database.CreateVideoVersionParams{VideoID: video.ID, Version: 1, S3Key: "landscape/boots.mp4", TranscodeProfile: "original"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.db.PutCaptions(video.ID, "en", []database.CaptionCue{{StartMS: 0, EndMS: 1000, Text: "Hi"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, body := range []string{
+		`{"renditions":["hdr"]}`,
+		`{"renditions":["original"]}`,
+		`{"renditions":["sdr","sdr"]}`,
+		`{"renditions":["4k"]}`,
+		`{"captions":["de"]}`,
+	} {
+		if w := export(body); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, w.Code)
+		}
+	}
+
+	w := export(`{"captions":["en"],"thumbnail":false}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var created database.VideoExport
+	if err := json.NewDecoder(w.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	stored, err := cfg.db.GetVideoExport(created.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored.Status != database.VideoExportStatusPending || !slices.Equal(stored.Options.Renditions, []string{"sdr"}) || !slices.Equal(stored.Options.Captions, []string{"en"}) || stored.Options.Thumbnail {
+		t.Errorf("stored %+v", stored)
+	}
+}
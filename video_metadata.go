@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	maxMetadataKeys        = 50
+	maxMetadataValueLength = 500
+	// the encoded size of all fields together
+	maxMetadataBytes = 8 << 10
+	// listings filter on ?metadata.<key>=<value>
+	metadataFilterPrefix = "metadata."
+	maxExternalIDLength  = 255
+)
+
+var metadataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// validateVideoMetadata checks the integrator's fields. Values are free
+// form, keys are short identifiers so they work as query parameters.
+func validateVideoMetadata(params *database.CreateVideoParams) error {
+	if params.Metadata == nil {
+		params.Metadata = map[string]string{}
+	}
+	if len(params.Metadata) > maxMetadataKeys {
+		return fmt.Errorf("a video can have at most %d metadata fields", maxMetadataKeys)
+	}
+	for key, value := range params.Metadata {
+		if !metadataKeyPattern.MatchString(key) {
+			return fmt.Errorf("metadata key %q must be 1 to 64 letters, digits, '_', '-' or '.'", key)
+		}
+		if len(value) > maxMetadataValueLength {
+			return fmt.Errorf("metadata value of %q can be at most %d characters long", key, maxMetadataValueLength)
+		}
+	}
+	dat, err := json.Marshal(params.Metadata)
+	if err != nil {
+		return err
+	}
+	if len(dat) > maxMetadataBytes {
+		return fmt.Errorf("metadata can be at most %d bytes", maxMetadataBytes)
+	}
+	return nil
+}
+
+// checkExternalID validates the external ID of a new or updated video and
+// makes sure no other video of the user's organization has it. It responds
+// with an error and returns false when the ID can't be used. videoID is the
+// video being updated, uuid.Nil for new ones.
+func (cfg *apiConfig) checkExternalID(w http.ResponseWriter, userID, videoID uuid.UUID, params *database.CreateVideoParams) bool {
+	if params.ExternalID == nil {
+		return true
+	}
+	externalID := strings.TrimSpace(*params.ExternalID)
+	if externalID == "" {
+		params.ExternalID = nil
+		return true
+	}
+	if len(externalID) > maxExternalIDLength || strings.ContainsFunc(externalID, unicode.IsControl) {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("External ID must be 1 to %d printable characters", maxExternalIDLength), nil)
+		return false
+	}
+	params.ExternalID = &externalID
+
+	// trashed videos keep their ID, they may be restored
+	existing, err := cfg.db.GetVideoByExternalID(userID, externalID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't check external ID", err)
+		return false
+	}
+	if existing.ID != uuid.Nil && existing.ID != videoID {
+		respondWithError(w, http.StatusConflict, errCodeConflict, fmt.Sprintf("Another video already has external ID %q", externalID), nil)
+		return false
+	}
+	return true
+}
+
+// handlerVideoByExternalIDGet looks a video up by the external ID it has in
+// the user's organization and responds like GET /api/videos/{videoID}.
+func (cfg *apiConfig) handlerVideoByExternalIDGet(w http.ResponseWriter, r *http.Request) {
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return
+	}
+
+	video, err := cfg.db.GetVideoByExternalID(userID, r.PathValue("externalID"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get video", err)
+		return
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "No video has this external ID", nil)
+		return
+	}
+
+	r.SetPathValue("videoID", video.ID.String())
+	cfg.handlerVideoGet(w, r)
+}
+
+// handlerVideoUpdate changes the fields given in the body and leaves the
+// rest alone. Metadata is merged: fields set to null are removed, fields
+// left out are kept. An empty external_id removes it, tags replace the
+// video's.
+func (cfg *apiConfig) handlerVideoUpdate(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Title       *string            `json:"title"`
+		Description *string            `json:"description"`
+		Metadata    map[string]*string `json:"metadata"`
+		ExternalID  *string            `json:"external_id"`
+		Tags        *[]string          `json:"tags"`
+	}
+
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+
+	if params.Title != nil {
+		if strings.TrimSpace(*params.Title) == "" {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Title can't be empty", nil)
+			return
+		}
+		video.Title = *params.Title
+	}
+	if params.Description != nil {
+		video.Description = *params.Description
+	}
+	for key, value := range params.Metadata {
+		if value == nil {
+			delete(video.Metadata, key)
+			continue
+		}
+		video.Metadata[key] = *value
+	}
+	err = validateVideoMetadata(&video.CreateVideoParams)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid metadata", err)
+		return
+	}
+	if params.Tags != nil {
+		video.Tags = *params.Tags
+		err = validateVideoTags(&video.CreateVideoParams)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Invalid tags", err)
+			return
+		}
+	}
+	if params.ExternalID != nil {
+		video.ExternalID = params.ExternalID
+		if !cfg.checkExternalID(w, video.UserID, video.ID, &video.CreateVideoParams) {
+			return
+		}
+	}
+
+	err = cfg.db.UpdateVideo(video)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't update video", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, cfg.withSignedURLs(video))
+}
+
+// metadataFilter collects the ?metadata.<key>=<value> parameters of a
+// listing.
+func metadataFilter(query url.Values) map[string]string {
+	filter := map[string]string{}
+	for param, values := range query {
+		if key, ok := strings.CutPrefix(param, metadataFilterPrefix); ok && key != "" {
+			filter[key] = values[0]
+		}
+	}
+	return filter
+}
+
+// matchesMetadata reports whether the video has every field of the filter
+// with the same value.
+func matchesMetadata(video database.Video, filter map[string]string) bool {
+	for key, value := range filter {
+		if v, ok := video.Metadata[key]; !ok || v != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/auth"
+	"github.com/bootdotdev/learn-file-storage-s3-golang-starter/internal/database"
+	"github.com/google/uuid"
+)
+
+const (
+	maxTranslationTitleLength       = 200
+	maxTranslationDescriptionLength = 5000
+)
+
+// handlerVideoTranslationPut sets the video's title and description in the
+// language. Viewers asking for it with Accept-Language get them instead of
+// the originals.
+func (cfg *apiConfig) handlerVideoTranslationPut(w http.ResponseWriter, r *http.Request) {
+	type parameters struct {
+		Title       string `json:"title"`
+		Description string `json:"description"`
+	}
+
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+	language := r.PathValue("language")
+	if !audioTrackLanguagePattern.MatchString(language) {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, "Language must be a BCP 47 tag like en or pt-BR", nil)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parameters{}
+	err := decoder.Decode(&params)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeMalformedRequest, "Couldn't decode parameters", err)
+		return
+	}
+	params.Title = strings.TrimSpace(params.Title)
+	if params.Title == "" || len(params.Title) > maxTranslationTitleLength {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("Title must be 1 to %d characters long", maxTranslationTitleLength), nil)
+		return
+	}
+	if len(params.Description) > maxTranslationDescriptionLength {
+		respondWithError(w, http.StatusBadRequest, errCodeValidationFailed, fmt.Sprintf("Description can be at most %d characters long", maxTranslationDescriptionLength), nil)
+		return
+	}
+
+	translation, err := cfg.db.PutVideoTranslation(video.ID, language, params.Title, params.Description)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't save translation", err)
+		return
+	}
+	cfg.queueSearchIndex(video.ID)
+
+	respondWithJSON(w, http.StatusOK, translation)
+}
+
+func (cfg *apiConfig) handlerVideoTranslationsRetrieve(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	translations, err := cfg.db.GetVideoTranslations(video.ID)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't get translations", err)
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, translations)
+}
+
+func (cfg *apiConfig) handlerVideoTranslationDelete(w http.ResponseWriter, r *http.Request) {
+	video, ok := cfg.ownedVideoFromRequest(w, r)
+	if !ok {
+		return
+	}
+
+	deleted, err := cfg.db.DeleteVideoTranslation(video.ID, r.PathValue("language"))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, errCodeInternal, "Couldn't delete translation", err)
+		return
+	}
+	if !deleted {
+		respondWithError(w, http.StatusNotFound, errCodeNotFound, "Translation not found", nil)
+		return
+	}
+	cfg.queueSearchIndex(video.ID)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// ownedVideoFromRequest loads the video in the path for its owner. It
+// responds with an error and returns false for anyone else.
+func (cfg *apiConfig) ownedVideoFromRequest(w http.ResponseWriter, r *http.Request) (database.Video, bool) {
+	videoID, err := uuid.Parse(r.PathValue("videoID"))
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, errCodeInvalidID, "Invalid video ID", err)
+		return database.Video{}, false
+	}
+
+	token, err := auth.GetBearerToken(r.Header)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't find JWT", err)
+		return database.Video{}, false
+	}
+	userID, err := auth.ValidateJWT(token, cfg.jwtSecret)
+	if err != nil {
+		respondWithError(w, http.StatusUnauthorized, errCodeUnauthenticated, "Couldn't validate JWT", err)
+		return database.Video{}, false
+	}
+
+	video, err := cfg.db.GetVideo(videoID)
+	if err != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", err)
+		return database.Video{}, false
+	}
+	if video.ID == uuid.Nil || video.DeletedAt != nil {
+		respondWithError(w, http.StatusNotFound, errCodeVideoNotFound, "Couldn't find video", nil)
+		return database.Video{}, false
+	}
+	if video.UserID != userID {
+		respondWithError(w, http.StatusForbidden, errCodeForbidden, "You don't own this video", nil)
+		return database.Video{}, false
+	}
+	return video, true
+}
+
+// localizeVideo swaps the title and description for the translation that
+// best matches the viewer's Accept-Language. Owners always see the
+// originals, they edit them.
+func (cfg *apiConfig) localizeVideo(r *http.Request, video database.Video) (database.Video, error) {
+	preferred := acceptedLanguages(r.Header.Get("Accept-Language"))
+	if len(preferred) == 0 || cfg.isVideoOwner(r, video) {
+		return video, nil
+	}
+
+	translations, err := cfg.db.GetVideoTranslations(video.ID)
+	if err != nil {
+		return database.Video{}, err
+	}
+	available := make([]string, 0, len(translations))
+	for _, t := range translations {
+		available = append(available, t.Language)
+	}
+	i, ok := matchLanguage(preferred, available)
+	if !ok {
+		return video, nil
+	}
+
+	t := translations[i]
+	video.Title = t.Title
+	if t.Description != "" {
+		video.Description = t.Description
+	}
+	video.Language = t.Language
+	return video, nil
+}
+
+// acceptedLanguages returns the languages of an Accept-Language header,
+// most preferred first. Wildcards and refused languages are left out.
+func acceptedLanguages(header string) []string {
+	type accepted struct {
+		language string
+		quality  float64
+	}
+	languages := []accepted{}
+	for _, part := range strings.Split(header, ",") {
+		language, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		language = strings.TrimSpace(language)
+		if language == "" || language == "*" {
+			continue
+		}
+		quality := 1.0
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			var err error
+			quality, err = strconv.ParseFloat(q, 64)
+			if err != nil {
+				continue
+			}
+		}
+		if quality <= 0 {
+			continue
+		}
+		languages = append(languages, accepted{language: language, quality: quality})
+	}
+	// equal qualities keep the order they were listed in
+	slices.SortStableFunc(languages, func(a, b accepted) int {
+		return cmp.Compare(b.quality, a.quality)
+	})
+
+	preferred := make([]string, 0, len(languages))
+	for _, l := range languages {
+		preferred = append(preferred, l.language)
+	}
+	return preferred
+}
+
+// matchLanguage returns the index of the available language that serves the
+// most preferred language. A preference matches its own tag first, then the
+// tag with subtags dropped ("pt-BR" falls back to "pt"), then any regional
+// variant of it ("pt" takes "pt-BR").
+func matchLanguage(preferred, available []string) (int, bool) {
+	for _, want := range preferred {
+		for tag := want; tag != ""; {
+			if i := slices.IndexFunc(available, func(a string) bool { return strings.EqualFold(a, tag) }); i >= 0 {
+				return i, true
+			}
+			cut := strings.LastIndex(tag, "-")
+			if cut < 0 {
+				break
+			}
+			tag = tag[:cut]
+		}
+		if i := slices.IndexFunc(available, func(a string) bool {
+			return len(a) > len(want) && strings.EqualFold(a[:len(want)+1], want+"-")
+		}); i >= 0 {
+			return i, true
+		}
+	}
+	return 0, false
+}
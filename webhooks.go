@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const webhookTimeout = 10 * time.Second
+
+type webhookEvent struct {
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+// sendWebhook posts an event to the configured webhook URL. The body is
+// signed with HMAC-SHA256 of WEBHOOK_SECRET in the X-Tubely-Signature header
+// so receivers can verify it came from us.
+func (cfg *apiConfig) sendWebhook(ctx context.Context, event string, data any) error {
+	if cfg.webhookURL == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(webhookEvent{
+		Event:     event,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, cfg.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Tubely-Event", event)
+	if cfg.webhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(cfg.webhookSecret))
+		mac.Write(body)
+		req.Header.Set("X-Tubely-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook responded with %s", resp.Status)
+	}
+	return nil
+}